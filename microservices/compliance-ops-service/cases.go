@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Case is a compliance case worked by an analyst
+type Case struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`     // kyc_review, sanctions_screening, pep_screening, ...
+	Status      string                 `json:"status"`   // open, in_review, escalated, closed
+	Priority    string                 `json:"priority"` // low, medium, high, critical
+	Source      string                 `json:"source,omitempty"`
+	ReferenceID string                 `json:"reference_id,omitempty"`
+	Subject     map[string]interface{} `json:"subject,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+	AssignedTo  string                 `json:"assigned_to,omitempty"`
+	Resolution  string                 `json:"resolution,omitempty"` // true_match, false_positive, ...
+	Notes       []CaseNote             `json:"notes,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+	UpdatedAt   time.Time              `json:"updated_at"`
+	ClosedAt    *time.Time             `json:"closed_at,omitempty"`
+}
+
+// CaseNote is an analyst note on a case
+type CaseNote struct {
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateCaseRequest represents a request to open a case
+type CreateCaseRequest struct {
+	Type        string                 `json:"type"`
+	Priority    string                 `json:"priority"`
+	Source      string                 `json:"source"`
+	ReferenceID string                 `json:"reference_id"`
+	Subject     map[string]interface{} `json:"subject"`
+	Details     map[string]interface{} `json:"details"`
+}
+
+// UpdateCaseRequest represents an analyst update to a case
+type UpdateCaseRequest struct {
+	Status     string `json:"status,omitempty"`
+	AssignedTo string `json:"assigned_to,omitempty"`
+	Resolution string `json:"resolution,omitempty"`
+	Note       string `json:"note,omitempty"`
+	Author     string `json:"author,omitempty"`
+}
+
+var (
+	validCaseTypes = map[string]bool{
+		"kyc_review": true, "kyb_review": true, "sanctions_screening": true,
+		"pep_screening": true, "transaction_monitoring": true, "fraud_review": true,
+	}
+	validPriorities = map[string]bool{"low": true, "medium": true, "high": true, "critical": true}
+	validStatuses   = map[string]bool{"open": true, "in_review": true, "escalated": true, "closed": true}
+)
+
+// CaseStore keeps compliance cases in memory
+type CaseStore struct {
+	mu    sync.RWMutex
+	cases map[string]*Case
+}
+
+// NewCaseStore creates a new case store
+func NewCaseStore() *CaseStore {
+	return &CaseStore{
+		cases: make(map[string]*Case),
+	}
+}
+
+// Create opens a new case. A case already open for the same type and
+// reference is returned instead of opening a duplicate.
+func (s *CaseStore) Create(req *CreateCaseRequest) (*Case, bool, error) {
+	if !validCaseTypes[req.Type] {
+		return nil, false, fmt.Errorf("invalid case type: %s", req.Type)
+	}
+	if req.Priority == "" {
+		req.Priority = "medium"
+	}
+	if !validPriorities[req.Priority] {
+		return nil, false, fmt.Errorf("invalid priority: %s", req.Priority)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.ReferenceID != "" {
+		for _, existing := range s.cases {
+			if existing.Type == req.Type && existing.ReferenceID == req.ReferenceID && existing.Status != "closed" {
+				return existing, false, nil
+			}
+		}
+	}
+
+	now := time.Now()
+	c := &Case{
+		ID:          newCaseID(),
+		Type:        req.Type,
+		Status:      "open",
+		Priority:    req.Priority,
+		Source:      req.Source,
+		ReferenceID: req.ReferenceID,
+		Subject:     req.Subject,
+		Details:     req.Details,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.cases[c.ID] = c
+
+	return c, true, nil
+}
+
+// Get returns a case by ID
+func (s *CaseStore) Get(id string) (*Case, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.cases[id]
+	return c, ok
+}
+
+// List returns cases filtered by status, type and reference, newest first
+func (s *CaseStore) List(status, caseType, referenceID string) []*Case {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cases := []*Case{}
+	for _, c := range s.cases {
+		if status != "" && c.Status != status {
+			continue
+		}
+		if caseType != "" && c.Type != caseType {
+			continue
+		}
+		if referenceID != "" && c.ReferenceID != referenceID {
+			continue
+		}
+		cases = append(cases, c)
+	}
+
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].CreatedAt.After(cases[j].CreatedAt)
+	})
+
+	return cases
+}
+
+// Update applies an analyst update to a case
+func (s *CaseStore) Update(id string, req *UpdateCaseRequest) (*Case, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.cases[id]
+	if !ok {
+		return nil, fmt.Errorf("case not found: %s", id)
+	}
+	if c.Status == "closed" {
+		return nil, errors.New("case is closed")
+	}
+
+	now := time.Now()
+	if req.Status != "" {
+		if !validStatuses[req.Status] {
+			return nil, fmt.Errorf("invalid status: %s", req.Status)
+		}
+		if req.Status == "closed" {
+			if req.Resolution == "" {
+				return nil, errors.New("resolution is required to close a case")
+			}
+			c.ClosedAt = &now
+		}
+		c.Status = req.Status
+	}
+	if req.AssignedTo != "" {
+		c.AssignedTo = req.AssignedTo
+	}
+	if req.Resolution != "" {
+		c.Resolution = req.Resolution
+	}
+	if req.Note != "" {
+		c.Notes = append(c.Notes, CaseNote{Author: req.Author, Text: req.Note, CreatedAt: now})
+	}
+	c.UpdatedAt = now
+
+	return c, nil
+}
+
+func newCaseID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "case_" + hex.EncodeToString(b)
+}
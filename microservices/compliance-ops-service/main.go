@@ -8,35 +8,32 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Global services
+var (
+	caseStore *CaseStore
+)
+
 func main() {
 	port := flag.String("port", "8114", "Port to listen on")
 	flag.Parse()
 
 	log.Printf("Starting Compliance Ops Microservice on port %s...", *port)
 
+	caseStore = NewCaseStore()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"compliance-ops","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/cases", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]map[string]interface{}{
-			{
-				"id": "case_123",
-				"type": "kyc_review",
-				"status": "pending",
-				"priority": "high",
-				"assigned_to": "analyst_456",
-				"created_at": time.Now().Format(time.RFC3339),
-			},
-		})
-	})
+	mux.HandleFunc("/v1/cases", handleCases)
+	mux.HandleFunc("/v1/cases/", handleCaseByID)
 
 	mux.HandleFunc("/v1/sar", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -66,3 +63,72 @@ func main() {
 
 	log.Println("Compliance Ops service exited")
 }
+
+func handleCases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(caseStore.List(query.Get("status"), query.Get("type"), query.Get("reference_id")))
+
+	case "POST":
+		var req CreateCaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		c, created, err := caseStore.Create(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if created {
+			log.Printf("Opened %s case %s (%s)", c.Type, c.ID, c.Priority)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(c)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCaseByID(w http.ResponseWriter, r *http.Request) {
+	caseID := strings.TrimPrefix(r.URL.Path, "/v1/cases/")
+
+	switch r.Method {
+	case "GET":
+		c, ok := caseStore.Get(caseID)
+		if !ok {
+			http.Error(w, "Case not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	case "PATCH":
+		var req UpdateCaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		c, err := caseStore.Update(caseID, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
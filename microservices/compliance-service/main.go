@@ -8,16 +8,39 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Global services
+var (
+	screeningService *ScreeningService
+)
+
 func main() {
 	port := flag.String("port", "8088", "Port to listen on")
 	flag.Parse()
 
 	log.Printf("Starting Compliance Microservice on port %s...", *port)
 
+	// Load sanctions and PEP lists from local files
+	watchlistDir := os.Getenv("WATCHLIST_DIR")
+	if watchlistDir == "" {
+		watchlistDir = "/data/watchlists"
+	}
+	complianceOpsURL := os.Getenv("COMPLIANCE_OPS_URL")
+	if complianceOpsURL == "" {
+		complianceOpsURL = "http://compliance-ops-service:8114"
+	}
+
+	screeningService = NewScreeningService(watchlistDir, NewHTTPCaseOpener(complianceOpsURL))
+	if loaded, err := screeningService.Reload(); err != nil {
+		log.Printf("Failed to load watchlists from %s: %v", watchlistDir, err)
+	} else {
+		log.Printf("Loaded watchlists from %s: %v", watchlistDir, loaded)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -29,6 +52,10 @@ func main() {
 		json.NewEncoder(w).Encode([]map[string]interface{}{})
 	})
 
+	mux.HandleFunc("/v1/screening", handleScreening)
+	mux.HandleFunc("/v1/screening/", handleScreeningByID)
+	mux.HandleFunc("/v1/watchlists/reload", handleWatchlistReload)
+
 	server := &http.Server{
 		Addr: ":" + *port,
 		Handler: mux,
@@ -46,3 +73,58 @@ func main() {
 
 	log.Println("Compliance service exited")
 }
+
+func handleScreening(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ScreeningRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := screeningService.Screen(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func handleScreeningByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, ok := screeningService.GetResult(strings.TrimPrefix(r.URL.Path, "/v1/screening/"))
+	if !ok {
+		http.Error(w, "Screening not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func handleWatchlistReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	loaded, err := screeningService.Reload()
+	if err != nil {
+		log.Printf("Failed to reload watchlists: %v", err)
+		http.Error(w, "Failed to reload watchlists", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"lists_loaded": loaded})
+}
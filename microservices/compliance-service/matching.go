@@ -0,0 +1,293 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// transliterations folds Latin diacritics and romanises Cyrillic and Greek
+// so that names in native scripts compare against the Latin list entries.
+// Cyrillic follows the BGN/PCGN style used by OFAC and the UN.
+var transliterations = map[rune]string{
+	// Latin with diacritics
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ĉ': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ģ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ķ': "k", 'ł': "l", 'ľ': "l", 'ĺ': "l", 'ļ': "l", 'ñ': "n", 'ń': "n", 'ň': "n", 'ņ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ŕ': "r", 'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ș': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'ț': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z", 'þ': "th",
+
+	// Cyrillic
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+
+	// Greek
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o", 'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+}
+
+// nameNoise are honorifics and legal forms that do not identify a party
+var nameNoise = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "sir": true, "sheikh": true,
+	"ltd": true, "llc": true, "inc": true, "co": true, "corp": true, "plc": true,
+	"gmbh": true, "sa": true, "ag": true, "jsc": true, "ooo": true, "oao": true, "pjsc": true,
+}
+
+// NormalizeName transliterates a name to lower-case Latin and returns its
+// tokens without punctuation or noise words
+func NormalizeName(name string) []string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if t, ok := transliterations[r]; ok {
+			sb.WriteString(t)
+			continue
+		}
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			sb.WriteRune(r)
+		case unicode.IsLetter(r):
+			// Scripts without a transliteration are kept as they are
+			sb.WriteRune(r)
+		case r == '\'' || r == '’' || r == '`':
+			// Apostrophes join, e.g. O'Neil
+		default:
+			sb.WriteRune(' ')
+		}
+	}
+
+	var tokens []string
+	for _, token := range strings.Fields(sb.String()) {
+		if !nameNoise[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// NameSimilarity scores two names from 0 to 1. Token order does not matter
+// ("PUTIN, Vladimir" matches "Vladimir Putin"), each token is compared with
+// Jaro-Winkler so spelling variants still score high, and initials match
+// tokens they abbreviate. Extra tokens on either side lower the score.
+func NameSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	tokenScore := (bestTokenMatches(a, b) + bestTokenMatches(b, a)) / 2
+
+	// Compare the sorted concatenations too, which catches names split
+	// differently ("Abu Bakr" and "Abubakr")
+	joinedA := append([]string(nil), a...)
+	joinedB := append([]string(nil), b...)
+	sort.Strings(joinedA)
+	sort.Strings(joinedB)
+	joinedScore := JaroWinkler(strings.Join(joinedA, ""), strings.Join(joinedB, ""))
+
+	if joinedScore > tokenScore {
+		return joinedScore
+	}
+	return tokenScore
+}
+
+// bestTokenMatches averages, over the tokens of a, the best match in b,
+// weighting each token by its length
+func bestTokenMatches(a, b []string) float64 {
+	total, weights := 0.0, 0.0
+	for _, ta := range a {
+		best := 0.0
+		for _, tb := range b {
+			score := JaroWinkler(ta, tb)
+			if len(ta) == 1 && strings.HasPrefix(tb, ta) || len(tb) == 1 && strings.HasPrefix(ta, tb) {
+				score = 0.9
+			}
+			if score > best {
+				best = score
+			}
+		}
+		weight := float64(len([]rune(ta)))
+		total += best * weight
+		weights += weight
+	}
+	return total / weights
+}
+
+// JaroWinkler returns the Jaro-Winkler similarity of two strings
+func JaroWinkler(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+
+	window := max(len(ra), len(rb))/2 - 1
+	if window < 0 {
+		window = 0
+	}
+
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i := range ra {
+		start := max(0, i-window)
+		end := min(len(rb), i+window+1)
+		for j := start; j < end; j++ {
+			if !matchedB[j] && ra[i] == rb[j] {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+
+	if matches == 0 {
+		return 0
+	}
+
+	transpositions := 0
+	j := 0
+	for i := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if ra[i] != rb[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(transpositions)/2)/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(ra), len(rb)) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// partialDate is a date of birth that may only be known to the month or year
+type partialDate struct {
+	year, month, day int
+}
+
+var dateLayouts = []struct {
+	layout    string
+	precision int // 3 day, 2 month, 1 year
+}{
+	{"2006-01-02", 3},
+	{"02 Jan 2006", 3},
+	{"2 Jan 2006", 3},
+	{"02/01/2006", 3},
+	{"2006/01/02", 3},
+	{"Jan 2006", 2},
+	{"2006-01", 2},
+	{"2006", 1},
+}
+
+// parsePartialDate parses the date formats used by the lists, ignoring
+// qualifiers such as "circa"
+func parsePartialDate(value string) (partialDate, bool) {
+	value = strings.TrimSpace(value)
+	for _, prefix := range []string{"circa", "Circa", "approximately", "ca."} {
+		value = strings.TrimSpace(strings.TrimPrefix(value, prefix))
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout.layout, value)
+		if err != nil {
+			continue
+		}
+		date := partialDate{year: t.Year()}
+		if layout.precision >= 2 {
+			date.month = int(t.Month())
+		}
+		if layout.precision == 3 {
+			date.day = t.Day()
+		}
+		return date, true
+	}
+
+	// Year ranges such as "1960 to 1962" keep their first year
+	if fields := strings.Fields(value); len(fields) > 0 {
+		if year, err := strconv.Atoi(fields[0]); err == nil && year > 1800 {
+			return partialDate{year: year}, true
+		}
+	}
+
+	return partialDate{}, false
+}
+
+// datesMatch compares two partial dates at the precision they share
+func datesMatch(a, b partialDate) bool {
+	if a.year != b.year {
+		return false
+	}
+	if a.month != 0 && b.month != 0 && a.month != b.month {
+		return false
+	}
+	if a.day != 0 && b.day != 0 && a.day != b.day {
+		return false
+	}
+	return true
+}
+
+// countryCodes maps the country names used by OFAC and the UN to ISO 3166
+// alpha-2 codes. Codes pass through unchanged.
+var countryCodes = map[string]string{
+	"afghanistan": "AF", "albania": "AL", "algeria": "DZ", "angola": "AO", "argentina": "AR",
+	"armenia": "AM", "austria": "AT", "azerbaijan": "AZ", "bahrain": "BH", "bangladesh": "BD",
+	"belarus": "BY", "belgium": "BE", "bosnia and herzegovina": "BA", "brazil": "BR",
+	"bulgaria": "BG", "burma": "MM", "myanmar": "MM", "burundi": "BI", "cambodia": "KH",
+	"canada": "CA", "central african republic": "CF", "china": "CN", "colombia": "CO",
+	"congo, democratic republic of the": "CD", "democratic republic of the congo": "CD",
+	"cuba": "CU", "cyprus": "CY", "czech republic": "CZ", "egypt": "EG", "eritrea": "ER",
+	"ethiopia": "ET", "france": "FR", "georgia": "GE", "germany": "DE", "ghana": "GH",
+	"greece": "GR", "guinea": "GN", "haiti": "HT", "hong kong": "HK", "india": "IN",
+	"indonesia": "ID", "iran": "IR", "iran (islamic republic of)": "IR", "iraq": "IQ",
+	"ireland": "IE", "israel": "IL", "italy": "IT", "japan": "JP", "jordan": "JO",
+	"kazakhstan": "KZ", "kenya": "KE", "korea, north": "KP", "north korea": "KP",
+	"democratic people's republic of korea": "KP", "korea, south": "KR", "south korea": "KR",
+	"kuwait": "KW", "kyrgyzstan": "KG", "lebanon": "LB", "liberia": "LR", "libya": "LY",
+	"malaysia": "MY", "mali": "ML", "mexico": "MX", "moldova": "MD", "morocco": "MA",
+	"mozambique": "MZ", "netherlands": "NL", "nicaragua": "NI", "niger": "NE", "nigeria": "NG",
+	"pakistan": "PK", "palestinian": "PS", "panama": "PA", "philippines": "PH", "poland": "PL",
+	"qatar": "QA", "russia": "RU", "russian federation": "RU", "rwanda": "RW",
+	"saudi arabia": "SA", "serbia": "RS", "singapore": "SG", "somalia": "SO",
+	"south africa": "ZA", "south sudan": "SS", "spain": "ES", "sri lanka": "LK", "sudan": "SD",
+	"switzerland": "CH", "syria": "SY", "syrian arab republic": "SY", "tajikistan": "TJ",
+	"tanzania": "TZ", "thailand": "TH", "tunisia": "TN", "turkey": "TR", "turkiye": "TR",
+	"turkmenistan": "TM", "uganda": "UG", "ukraine": "UA", "united arab emirates": "AE",
+	"united kingdom": "GB", "united states": "US", "uzbekistan": "UZ", "venezuela": "VE",
+	"vietnam": "VN", "viet nam": "VN", "yemen": "YE", "zambia": "ZM", "zimbabwe": "ZW",
+}
+
+// NormalizeCountry returns the ISO alpha-2 code of a country name or code,
+// or the lower-cased input when the name is not known
+func NormalizeCountry(country string) string {
+	country = strings.TrimSpace(country)
+	if len(country) == 2 {
+		return strings.ToUpper(country)
+	}
+	if code, ok := countryCodes[strings.ToLower(country)]; ok {
+		return code
+	}
+	return strings.ToLower(country)
+}
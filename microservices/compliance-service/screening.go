@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ScreeningClear means no watchlist entry scored above the threshold
+	ScreeningClear = "clear"
+
+	// ScreeningPotentialMatch means at least one hit needs review
+	ScreeningPotentialMatch = "potential_match"
+
+	// DefaultMatchThreshold is the minimum hit score reported
+	DefaultMatchThreshold = 0.85
+
+	maxScreeningHits = 10
+)
+
+// ScreeningRequest asks for a party to be screened against the watchlists
+type ScreeningRequest struct {
+	Name        string   `json:"name"`
+	EntityType  string   `json:"entity_type,omitempty"`   // individual, entity
+	DateOfBirth string   `json:"date_of_birth,omitempty"` // YYYY-MM-DD, YYYY-MM or YYYY
+	Country     string   `json:"country,omitempty"`
+	Context     string   `json:"context"` // onboarding, payout
+	ReferenceID string   `json:"reference_id,omitempty"`
+	Sources     []string `json:"sources,omitempty"` // defaults to all loaded lists
+	Threshold   float64  `json:"threshold,omitempty"`
+}
+
+// ScreeningHit is a watchlist entry that matched the screened party
+type ScreeningHit struct {
+	EntryID      string   `json:"entry_id"`
+	Source       string   `json:"source"`
+	SourceID     string   `json:"source_id"`
+	EntryType    string   `json:"entry_type"`
+	MatchedName  string   `json:"matched_name"`
+	PrimaryName  string   `json:"primary_name"`
+	NameScore    float64  `json:"name_score"`
+	Score        float64  `json:"score"`
+	DOBMatch     *bool    `json:"dob_match,omitempty"`
+	CountryMatch *bool    `json:"country_match,omitempty"`
+	Programs     []string `json:"programs,omitempty"`
+	PEP          bool     `json:"pep"`
+}
+
+// ScreeningResult is the outcome of screening one party
+type ScreeningResult struct {
+	ID          string           `json:"id"`
+	Request     ScreeningRequest `json:"request"`
+	Status      string           `json:"status"`
+	Hits        []ScreeningHit   `json:"hits"`
+	CaseID      string           `json:"case_id,omitempty"`
+	ListsLoaded map[string]int   `json:"lists_loaded"`
+	ScreenedAt  time.Time        `json:"screened_at"`
+}
+
+// indexedEntry is a watchlist entry with its names normalised once at load
+type indexedEntry struct {
+	entry     *WatchlistEntry
+	names     [][]string
+	dates     []partialDate
+	countries map[string]bool
+}
+
+// Watchlists is an immutable, indexed set of watchlist entries
+type Watchlists struct {
+	entries  []indexedEntry
+	bySource map[string]int
+	loadedAt time.Time
+}
+
+// NewWatchlists indexes entries for screening
+func NewWatchlists(entries []*WatchlistEntry) *Watchlists {
+	w := &Watchlists{
+		bySource: make(map[string]int),
+		loadedAt: time.Now(),
+	}
+
+	for _, entry := range entries {
+		indexed := indexedEntry{entry: entry, countries: make(map[string]bool)}
+		for _, name := range entry.Names {
+			if tokens := NormalizeName(name); len(tokens) > 0 {
+				indexed.names = append(indexed.names, tokens)
+			}
+		}
+		for _, dob := range entry.DatesOfBirth {
+			if date, ok := parsePartialDate(dob); ok {
+				indexed.dates = append(indexed.dates, date)
+			}
+		}
+		for _, country := range entry.Countries {
+			indexed.countries[NormalizeCountry(country)] = true
+		}
+		if len(indexed.names) > 0 {
+			w.entries = append(w.entries, indexed)
+			w.bySource[entry.Source]++
+		}
+	}
+
+	return w
+}
+
+// Screen returns the entries matching a party, best first. Date of birth and
+// country only adjust the score of a name match: a matching date or country
+// raises it, a conflicting one lowers it, and missing data leaves it as is.
+func (w *Watchlists) Screen(req *ScreeningRequest) []ScreeningHit {
+	threshold := req.Threshold
+	if threshold <= 0 {
+		threshold = DefaultMatchThreshold
+	}
+
+	query := NormalizeName(req.Name)
+	if len(query) == 0 {
+		return nil
+	}
+
+	var dob *partialDate
+	if req.DateOfBirth != "" {
+		if date, ok := parsePartialDate(req.DateOfBirth); ok {
+			dob = &date
+		}
+	}
+	country := ""
+	if req.Country != "" {
+		country = NormalizeCountry(req.Country)
+	}
+
+	sources := make(map[string]bool)
+	for _, source := range req.Sources {
+		sources[source] = true
+	}
+
+	var hits []ScreeningHit
+	for _, indexed := range w.entries {
+		entry := indexed.entry
+		if len(sources) > 0 && !sources[entry.Source] {
+			continue
+		}
+		if req.EntityType != "" && entry.EntryType != req.EntityType &&
+			(req.EntityType == "individual" || entry.EntryType == "individual") {
+			continue
+		}
+
+		nameScore, matched := 0.0, 0
+		for i, tokens := range indexed.names {
+			if !sharesInitial(query, tokens) {
+				continue
+			}
+			if score := NameSimilarity(query, tokens); score > nameScore {
+				nameScore, matched = score, i
+			}
+		}
+		// Disambiguation can at most add 0.08, so weaker names never qualify
+		if nameScore < threshold-0.08 {
+			continue
+		}
+
+		hit := ScreeningHit{
+			EntryID:     entry.ID,
+			Source:      entry.Source,
+			SourceID:    entry.SourceID,
+			EntryType:   entry.EntryType,
+			MatchedName: entry.Names[matched],
+			PrimaryName: entry.Names[0],
+			NameScore:   round3(nameScore),
+			Programs:    entry.Programs,
+			PEP:         entry.Source == SourcePEP,
+		}
+
+		score := nameScore
+		if dob != nil && len(indexed.dates) > 0 {
+			match := false
+			for _, date := range indexed.dates {
+				if datesMatch(*dob, date) {
+					match = true
+					break
+				}
+			}
+			hit.DOBMatch = &match
+			if match {
+				score += 0.05
+			} else {
+				score -= 0.15
+			}
+		}
+		if country != "" && len(indexed.countries) > 0 {
+			match := indexed.countries[country]
+			hit.CountryMatch = &match
+			if match {
+				score += 0.03
+			} else {
+				score -= 0.05
+			}
+		}
+
+		if score > 1 {
+			score = 1
+		}
+		if score < threshold {
+			continue
+		}
+
+		hit.Score = round3(score)
+		hits = append(hits, hit)
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	if len(hits) > maxScreeningHits {
+		hits = hits[:maxScreeningHits]
+	}
+
+	return hits
+}
+
+// sharesInitial is a cheap pre-filter: two names can only match if some
+// token of one starts with the same letter as some token of the other
+func sharesInitial(a, b []string) bool {
+	for _, ta := range a {
+		for _, tb := range b {
+			if ta[0] == tb[0] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func round3(value float64) float64 {
+	return float64(int(value*1000+0.5)) / 1000
+}
+
+// CaseOpener opens compliance cases for screening hits
+type CaseOpener interface {
+	OpenCase(ctx context.Context, result *ScreeningResult) (string, error)
+}
+
+// ScreeningService screens parties and keeps the results for review
+type ScreeningService struct {
+	mu      sync.RWMutex
+	lists   *Watchlists
+	dir     string
+	cases   CaseOpener
+	results map[string]*ScreeningResult
+}
+
+// NewScreeningService creates a screening service over the lists in dir
+func NewScreeningService(dir string, cases CaseOpener) *ScreeningService {
+	return &ScreeningService{
+		lists:   NewWatchlists(nil),
+		dir:     dir,
+		cases:   cases,
+		results: make(map[string]*ScreeningResult),
+	}
+}
+
+// Reload reads the watchlist files again and swaps them in atomically
+func (s *ScreeningService) Reload() (map[string]int, error) {
+	entries, err := LoadWatchlistDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lists := NewWatchlists(entries)
+
+	s.mu.Lock()
+	s.lists = lists
+	s.mu.Unlock()
+
+	return lists.bySource, nil
+}
+
+// SetWatchlists replaces the loaded lists
+func (s *ScreeningService) SetWatchlists(entries []*WatchlistEntry) {
+	lists := NewWatchlists(entries)
+	s.mu.Lock()
+	s.lists = lists
+	s.mu.Unlock()
+}
+
+// Screen screens a party and opens a compliance case when there are hits
+func (s *ScreeningService) Screen(ctx context.Context, req *ScreeningRequest) (*ScreeningResult, error) {
+	if err := ValidateScreeningRequest(req); err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+
+	s.mu.RLock()
+	lists := s.lists
+	s.mu.RUnlock()
+
+	result := &ScreeningResult{
+		ID:          newScreeningID(),
+		Request:     *req,
+		Status:      ScreeningClear,
+		Hits:        lists.Screen(req),
+		ListsLoaded: lists.bySource,
+		ScreenedAt:  time.Now(),
+	}
+
+	if len(result.Hits) > 0 {
+		result.Status = ScreeningPotentialMatch
+		if s.cases != nil {
+			caseID, err := s.cases.OpenCase(ctx, result)
+			if err != nil {
+				// The hit still blocks the caller; the case can be raised manually
+				log.Printf("Failed to open compliance case for screening %s: %v", result.ID, err)
+			}
+			result.CaseID = caseID
+		}
+	}
+
+	s.mu.Lock()
+	s.results[result.ID] = result
+	s.mu.Unlock()
+
+	return result, nil
+}
+
+// GetResult returns a stored screening result
+func (s *ScreeningService) GetResult(id string) (*ScreeningResult, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result, ok := s.results[id]
+	return result, ok
+}
+
+// ValidateScreeningRequest validates a screening request
+func ValidateScreeningRequest(req *ScreeningRequest) error {
+	if req == nil {
+		return errors.New("request cannot be nil")
+	}
+	if len(NormalizeName(req.Name)) == 0 {
+		return errors.New("name is required")
+	}
+	switch req.EntityType {
+	case "", "individual", "entity", "vessel", "aircraft":
+	default:
+		return fmt.Errorf("invalid entity_type: %s", req.EntityType)
+	}
+	switch req.Context {
+	case "onboarding", "payout", "manual":
+	default:
+		return fmt.Errorf("invalid context: %s", req.Context)
+	}
+	if req.DateOfBirth != "" {
+		if _, ok := parsePartialDate(req.DateOfBirth); !ok {
+			return fmt.Errorf("invalid date_of_birth: %s", req.DateOfBirth)
+		}
+	}
+	if req.Threshold < 0 || req.Threshold > 1 {
+		return errors.New("threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+func newScreeningID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "scr_" + hex.EncodeToString(b)
+}
+
+// HTTPCaseOpener opens cases in compliance-ops-service
+type HTTPCaseOpener struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPCaseOpener creates a case opener for compliance-ops-service
+func NewHTTPCaseOpener(baseURL string) *HTTPCaseOpener {
+	return &HTTPCaseOpener{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// OpenCase creates a sanctions screening case for the result's hits
+func (c *HTTPCaseOpener) OpenCase(ctx context.Context, result *ScreeningResult) (string, error) {
+	priority := "medium"
+	for _, hit := range result.Hits {
+		if hit.Score >= 0.95 && !hit.PEP {
+			priority = "high"
+		}
+	}
+
+	caseType := "sanctions_screening"
+	allPEP := true
+	for _, hit := range result.Hits {
+		allPEP = allPEP && hit.PEP
+	}
+	if allPEP {
+		caseType = "pep_screening"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":         caseType,
+		"priority":     priority,
+		"source":       "compliance-service",
+		"reference_id": result.Request.ReferenceID,
+		"subject": map[string]interface{}{
+			"name":          result.Request.Name,
+			"entity_type":   result.Request.EntityType,
+			"date_of_birth": result.Request.DateOfBirth,
+			"country":       result.Request.Country,
+		},
+		"details": map[string]interface{}{
+			"screening_id": result.ID,
+			"context":      result.Request.Context,
+			"hits":         result.Hits,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal case: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/cases", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to open case: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("compliance-ops returned status %d", resp.StatusCode)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("failed to decode case: %w", err)
+	}
+
+	return created.ID, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSDNXML = `<?xml version="1.0" standalone="yes"?>
+<sdnList xmlns="http://tempuri.org/sdnList.xsd">
+  <sdnEntry>
+    <uid>100</uid>
+    <firstName>Vladimir Vladimirovich</firstName>
+    <lastName>PUTIN</lastName>
+    <sdnType>Individual</sdnType>
+    <programList><program>RUSSIA-EO14024</program></programList>
+    <akaList><aka><uid>1</uid><type>a.k.a.</type><lastName>PUTIN</lastName><firstName>Vladimir</firstName></aka></akaList>
+    <dateOfBirthList><dateOfBirthItem><uid>2</uid><dateOfBirth>07 Oct 1952</dateOfBirth></dateOfBirthItem></dateOfBirthList>
+    <nationalityList><nationality><uid>3</uid><country>Russia</country></nationality></nationalityList>
+  </sdnEntry>
+  <sdnEntry>
+    <uid>200</uid>
+    <lastName>BANCO NACIONAL DE CUBA</lastName>
+    <sdnType>Entity</sdnType>
+    <programList><program>CUBA</program></programList>
+    <addressList><address><uid>4</uid><city>Havana</city><country>Cuba</country></address></addressList>
+  </sdnEntry>
+</sdnList>`
+
+const testSDNCSV = `101,"ALI, Hassan","individual","SDGT",-0-,-0-,-0-,-0-,-0-,-0-,-0-,"DOB 12 Mar 1970; nationality Iraq;"
+102,"OCEAN STAR SHIPPING CO","-0-","IRAN",-0-,-0-,-0-,-0-,-0-,-0-,-0-,-0-
+`
+
+const testAltCSV = `101,1,"aka","ALI, Hasan",-0-
+`
+
+const testUNXML = `<?xml version="1.0" encoding="UTF-8"?>
+<CONSOLIDATED_LIST>
+  <INDIVIDUALS>
+    <INDIVIDUAL>
+      <DATAID>6908</DATAID>
+      <FIRST_NAME>ABDUL</FIRST_NAME>
+      <SECOND_NAME>KARIM</SECOND_NAME>
+      <UN_LIST_TYPE>Al-Qaida</UN_LIST_TYPE>
+      <REFERENCE_NUMBER>QDi.001</REFERENCE_NUMBER>
+      <NATIONALITY><VALUE>Afghanistan</VALUE></NATIONALITY>
+      <INDIVIDUAL_ALIAS><QUALITY>Good</QUALITY><ALIAS_NAME>Abdulkarim</ALIAS_NAME></INDIVIDUAL_ALIAS>
+      <INDIVIDUAL_DATE_OF_BIRTH><TYPE_OF_DATE>APPROXIMATELY</TYPE_OF_DATE><YEAR>1965</YEAR></INDIVIDUAL_DATE_OF_BIRTH>
+    </INDIVIDUAL>
+  </INDIVIDUALS>
+  <ENTITIES>
+    <ENTITY>
+      <DATAID>7001</DATAID>
+      <FIRST_NAME>AL-RASHID TRUST</FIRST_NAME>
+      <UN_LIST_TYPE>Al-Qaida</UN_LIST_TYPE>
+      <REFERENCE_NUMBER>QDe.005</REFERENCE_NUMBER>
+      <ENTITY_ADDRESS><COUNTRY>Pakistan</COUNTRY></ENTITY_ADDRESS>
+    </ENTITY>
+  </ENTITIES>
+</CONSOLIDATED_LIST>`
+
+const testEUXML = `<?xml version="1.0" encoding="UTF-8"?>
+<export xmlns="http://eu.europa.ec/fpi/fsd/export">
+  <sanctionEntity logicalId="13" designationDate="2022-02-28">
+    <regulation programme="UKR"/>
+    <subjectType code="person" classificationCode="P"/>
+    <nameAlias firstName="Sergey" lastName="Lavrov" wholeName="Sergey Viktorovich LAVROV"/>
+    <nameAlias wholeName="Сергей Викторович Лавров"/>
+    <birthdate birthdate="1950-03-21" year="1950" countryIso2Code="RU"/>
+    <citizenship countryIso2Code="RU"/>
+  </sanctionEntity>
+</export>`
+
+const testPEPCSV = `name,aliases,date_of_birth,country,position
+Jean Dupont,Jean-Pierre Dupont;J. Dupont,1961-05-04,FR,Minister of Finance
+`
+
+func newTestScreening(t *testing.T) *ScreeningService {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"sdn.xml":             testSDNXML,
+		"consolidated.xml":    testUNXML,
+		"eu_consolidated.xml": testEUXML,
+		"pep.csv":             testPEPCSV,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	service := NewScreeningService(dir, nil)
+	if _, err := service.Reload(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return service
+}
+
+type recordingCaseOpener struct {
+	results []*ScreeningResult
+}
+
+func (r *recordingCaseOpener) OpenCase(ctx context.Context, result *ScreeningResult) (string, error) {
+	r.results = append(r.results, result)
+	return "case_test", nil
+}
+
+func TestLoadWatchlists(t *testing.T) {
+	service := newTestScreening(t)
+
+	loaded := service.lists.bySource
+	expected := map[string]int{SourceOFACSDN: 2, SourceUN: 2, SourceEU: 1, SourcePEP: 1}
+	for source, count := range expected {
+		if loaded[source] != count {
+			t.Errorf("Expected %d %s entries, got %d", count, source, loaded[source])
+		}
+	}
+
+	entries, err := LoadOFACSDNCSV(strings.NewReader(testSDNCSV), strings.NewReader(testAltCSV))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 CSV entries, got %d", len(entries))
+	}
+	if len(entries[0].Names) != 2 || entries[0].DatesOfBirth[0] != "12 Mar 1970" || entries[0].Countries[0] != "Iraq" {
+		t.Errorf("Expected alias, DOB and nationality from CSV, got %+v", entries[0])
+	}
+	if entries[1].EntryType != "entity" {
+		t.Errorf("Expected entity type for -0- SDN type, got %s", entries[1].EntryType)
+	}
+}
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		minimum float64
+		maximum float64
+	}{
+		{"Vladimir Putin", "PUTIN, Vladimir Vladimirovich", 0.95, 1},
+		{"Владимир Путин", "Vladimir Putin", 1, 1},
+		{"José Müller", "Jose Muller", 1, 1},
+		{"Hasan Ali", "ALI, Hassan", 0.9, 1},
+		{"Abdul Karim", "Abdulkarim", 0.9, 1},
+		{"Mary Johnson", "Vladimir Putin", 0, 0.6},
+	}
+
+	for _, tt := range tests {
+		score := NameSimilarity(NormalizeName(tt.a), NormalizeName(tt.b))
+		if score < tt.minimum || score > tt.maximum {
+			t.Errorf("Expected similarity of %q and %q in [%.2f, %.2f], got %.3f", tt.a, tt.b, tt.minimum, tt.maximum, score)
+		}
+	}
+}
+
+func TestWatchlists_Screen(t *testing.T) {
+	lists := NewWatchlists([]*WatchlistEntry{{
+		ID:        "ofac_sdn:300",
+		Source:    SourceOFACSDN,
+		SourceID:  "300",
+		EntryType: "individual",
+		Names:     []string{"Viktor Anatolyevich BOUT", "Victor Butt"},
+	}})
+
+	tests := []struct {
+		name    string
+		party   string
+		matched string
+		exact   bool
+	}{
+		{"exact", "Viktor Anatolyevich Bout", "Viktor Anatolyevich BOUT", true},
+		{"fuzzy", "Viktor Anatolievich Bout", "Viktor Anatolyevich BOUT", false},
+		{"alias", "Victor Butt", "Victor Butt", true},
+		{"below threshold", "Vincent Bout", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := lists.Screen(&ScreeningRequest{Name: tt.party, Context: "payout"})
+			if tt.matched == "" {
+				if len(hits) != 0 {
+					t.Errorf("Expected no hits, got %+v", hits)
+				}
+				return
+			}
+
+			if len(hits) != 1 {
+				t.Fatalf("Expected 1 hit, got %+v", hits)
+			}
+			hit := hits[0]
+			if hit.MatchedName != tt.matched || hit.PrimaryName != "Viktor Anatolyevich BOUT" {
+				t.Errorf("Expected %q matched on entry %q, got %q on %q", tt.matched, "Viktor Anatolyevich BOUT", hit.MatchedName, hit.PrimaryName)
+			}
+			if tt.exact && hit.Score != 1 {
+				t.Errorf("Expected an exact match to score 1, got %.3f", hit.Score)
+			}
+			if !tt.exact && (hit.Score >= 1 || hit.Score < DefaultMatchThreshold) {
+				t.Errorf("Expected a fuzzy score in [%.2f, 1), got %.3f", DefaultMatchThreshold, hit.Score)
+			}
+		})
+	}
+}
+
+func TestScreeningService_Screen(t *testing.T) {
+	service := newTestScreening(t)
+	cases := &recordingCaseOpener{}
+	service.cases = cases
+	ctx := context.Background()
+
+	// Cyrillic input matches the EU entry, with DOB and country confirming it
+	result, err := service.Screen(ctx, &ScreeningRequest{
+		Name:        "Сергей Лавров",
+		EntityType:  "individual",
+		DateOfBirth: "1950-03-21",
+		Country:     "RU",
+		Context:     "onboarding",
+		ReferenceID: "merchant_1",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if result.Status != ScreeningPotentialMatch || len(result.Hits) == 0 {
+		t.Fatalf("Expected a potential match, got %+v", result)
+	}
+	hit := result.Hits[0]
+	if hit.Source != SourceEU || hit.DOBMatch == nil || !*hit.DOBMatch || hit.CountryMatch == nil || !*hit.CountryMatch {
+		t.Errorf("Expected EU hit with DOB and country match, got %+v", hit)
+	}
+	if result.CaseID != "case_test" || len(cases.results) != 1 {
+		t.Errorf("Expected a case to be opened, got %q", result.CaseID)
+	}
+
+	// A different date of birth rules out a same-name hit
+	result, err = service.Screen(ctx, &ScreeningRequest{
+		Name:        "Vladimir Putin",
+		EntityType:  "individual",
+		DateOfBirth: "1988-01-15",
+		Country:     "US",
+		Context:     "payout",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Status != ScreeningClear {
+		t.Errorf("Expected clear result for different DOB and country, got %+v", result.Hits)
+	}
+
+	// Approximate year of birth from the UN list still matches
+	result, _ = service.Screen(ctx, &ScreeningRequest{Name: "Abdulkarim", DateOfBirth: "1965-06-01", Context: "payout"})
+	if len(result.Hits) == 0 || result.Hits[0].Source != SourceUN {
+		t.Errorf("Expected UN hit, got %+v", result.Hits)
+	}
+
+	// PEP aliases match and are flagged as PEP
+	result, _ = service.Screen(ctx, &ScreeningRequest{Name: "Jean-Pierre Dupont", Country: "FR", Context: "onboarding"})
+	if len(result.Hits) == 0 || !result.Hits[0].PEP {
+		t.Errorf("Expected PEP hit, got %+v", result.Hits)
+	}
+
+	// Individuals are not matched against entities
+	result, _ = service.Screen(ctx, &ScreeningRequest{Name: "Banco Nacional de Cuba", EntityType: "individual", Context: "payout"})
+	if len(result.Hits) != 0 {
+		t.Errorf("Expected no hits for individual against entity, got %+v", result.Hits)
+	}
+
+	result, _ = service.Screen(ctx, &ScreeningRequest{Name: "Banco Nacional de Cuba", EntityType: "entity", Context: "payout"})
+	if len(result.Hits) == 0 {
+		t.Error("Expected entity hit")
+	}
+
+	if _, err := service.Screen(ctx, &ScreeningRequest{Name: "", Context: "payout"}); err == nil {
+		t.Error("Expected error for empty name")
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Watchlist sources
+const (
+	SourceOFACSDN = "ofac_sdn"
+	SourceUN      = "un_consolidated"
+	SourceEU      = "eu_consolidated"
+	SourcePEP     = "pep"
+)
+
+// WatchlistEntry is one sanctioned or politically exposed party
+type WatchlistEntry struct {
+	ID           string   `json:"id"`
+	Source       string   `json:"source"`
+	SourceID     string   `json:"source_id"`
+	EntryType    string   `json:"entry_type"` // individual, entity, vessel, aircraft
+	Names        []string `json:"names"`      // primary name first, then aliases
+	DatesOfBirth []string `json:"dates_of_birth,omitempty"`
+	Countries    []string `json:"countries,omitempty"`
+	Programs     []string `json:"programs,omitempty"`
+	Remarks      string   `json:"remarks,omitempty"`
+}
+
+// LoadWatchlistDir loads every list found in dir. Files are recognised by
+// their published names:
+//
+//	sdn.xml                  OFAC SDN list, XML
+//	sdn.csv (+ alt.csv)      OFAC SDN list, legacy CSV with aliases
+//	consolidated.xml         UN Security Council consolidated list
+//	un_consolidated.xml      UN Security Council consolidated list
+//	eu_consolidated.xml      EU financial sanctions (FSF) list, XML
+//	pep.csv                  PEP list: name,aliases,date_of_birth,country,position
+func LoadWatchlistDir(dir string) ([]*WatchlistEntry, error) {
+	var entries []*WatchlistEntry
+
+	load := func(name string, loader func(io.Reader) ([]*WatchlistEntry, error)) error {
+		path := filepath.Join(dir, name)
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer f.Close()
+
+		loaded, err := loader(f)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", path, err)
+		}
+		entries = append(entries, loaded...)
+		return nil
+	}
+
+	if err := load("sdn.xml", LoadOFACSDNXML); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "sdn.xml")); os.IsNotExist(err) {
+		if err := load("sdn.csv", func(r io.Reader) ([]*WatchlistEntry, error) {
+			aliases, err := os.Open(filepath.Join(dir, "alt.csv"))
+			if err != nil {
+				return LoadOFACSDNCSV(r, nil)
+			}
+			defer aliases.Close()
+			return LoadOFACSDNCSV(r, aliases)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range []string{"consolidated.xml", "un_consolidated.xml"} {
+		if err := load(name, LoadUNConsolidatedXML); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := load("eu_consolidated.xml", LoadEUConsolidatedXML); err != nil {
+		return nil, err
+	}
+
+	if err := load("pep.csv", LoadPEPCSV); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// OFAC SDN XML (https://www.treasury.gov/ofac/downloads/sdn.xml)
+
+type ofacSDNList struct {
+	Entries []struct {
+		UID       string   `xml:"uid"`
+		FirstName string   `xml:"firstName"`
+		LastName  string   `xml:"lastName"`
+		SDNType   string   `xml:"sdnType"`
+		Remarks   string   `xml:"remarks"`
+		Programs  []string `xml:"programList>program"`
+		Akas      []struct {
+			FirstName string `xml:"firstName"`
+			LastName  string `xml:"lastName"`
+		} `xml:"akaList>aka"`
+		DatesOfBirth []string `xml:"dateOfBirthList>dateOfBirthItem>dateOfBirth"`
+		Addresses    []struct {
+			Country string `xml:"country"`
+		} `xml:"addressList>address"`
+		Nationalities []string `xml:"nationalityList>nationality>country"`
+		Citizenships  []string `xml:"citizenshipList>citizenship>country"`
+	} `xml:"sdnEntry"`
+}
+
+// LoadOFACSDNXML parses the OFAC SDN list in its XML format
+func LoadOFACSDNXML(r io.Reader) ([]*WatchlistEntry, error) {
+	var list ofacSDNList
+	if err := xml.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode SDN XML: %w", err)
+	}
+
+	entries := make([]*WatchlistEntry, 0, len(list.Entries))
+	for _, e := range list.Entries {
+		entry := &WatchlistEntry{
+			ID:           SourceOFACSDN + ":" + e.UID,
+			Source:       SourceOFACSDN,
+			SourceID:     e.UID,
+			EntryType:    ofacEntryType(e.SDNType),
+			Names:        []string{joinName(e.FirstName, e.LastName)},
+			DatesOfBirth: e.DatesOfBirth,
+			Programs:     e.Programs,
+			Remarks:      e.Remarks,
+		}
+		for _, aka := range e.Akas {
+			entry.Names = appendUnique(entry.Names, joinName(aka.FirstName, aka.LastName))
+		}
+		for _, address := range e.Addresses {
+			entry.Countries = appendUnique(entry.Countries, address.Country)
+		}
+		for _, country := range append(e.Nationalities, e.Citizenships...) {
+			entry.Countries = appendUnique(entry.Countries, country)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// LoadOFACSDNCSV parses the legacy OFAC sdn.csv and, when given, alt.csv.
+// sdn.csv has no header: ent_num, SDN_Name, SDN_Type, Program, Title,
+// Call_Sign, Vess_type, Tonnage, GRT, Vess_flag, Vess_owner, Remarks.
+// alt.csv: ent_num, alt_num, alt_type, alt_name, alt_remarks. Dates of birth
+// only appear in the remarks ("DOB 01 Jan 1960").
+func LoadOFACSDNCSV(sdn io.Reader, alt io.Reader) ([]*WatchlistEntry, error) {
+	rows, err := readCSV(sdn, ',')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sdn.csv: %w", err)
+	}
+
+	byID := make(map[string]*WatchlistEntry)
+	entries := make([]*WatchlistEntry, 0, len(rows))
+	for _, row := range rows {
+		if len(row) < 4 || strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		id := strings.TrimSpace(row[0])
+		entry := &WatchlistEntry{
+			ID:        SourceOFACSDN + ":" + id,
+			Source:    SourceOFACSDN,
+			SourceID:  id,
+			EntryType: ofacEntryType(ofacNull(row[2])),
+			Names:     []string{ofacNull(row[1])},
+			Programs:  splitList(ofacNull(row[3]), "] ["),
+		}
+		if len(row) >= 12 {
+			entry.Remarks = ofacNull(row[11])
+			entry.DatesOfBirth = remarksField(entry.Remarks, "DOB")
+			entry.Countries = append(remarksField(entry.Remarks, "nationality"), remarksField(entry.Remarks, "citizen")...)
+		}
+		byID[id] = entry
+		entries = append(entries, entry)
+	}
+
+	if alt != nil {
+		aliases, err := readCSV(alt, ',')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read alt.csv: %w", err)
+		}
+		for _, row := range aliases {
+			if len(row) < 4 {
+				continue
+			}
+			if entry, ok := byID[strings.TrimSpace(row[0])]; ok {
+				entry.Names = appendUnique(entry.Names, ofacNull(row[3]))
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// UN Security Council consolidated list
+// (https://scsanctions.un.org/resources/xml/en/consolidated.xml)
+
+type unConsolidatedList struct {
+	Individuals []struct {
+		DataID      string   `xml:"DATAID"`
+		FirstName   string   `xml:"FIRST_NAME"`
+		SecondName  string   `xml:"SECOND_NAME"`
+		ThirdName   string   `xml:"THIRD_NAME"`
+		FourthName  string   `xml:"FOURTH_NAME"`
+		ListType    string   `xml:"UN_LIST_TYPE"`
+		Reference   string   `xml:"REFERENCE_NUMBER"`
+		Comments    string   `xml:"COMMENTS1"`
+		Nationality []string `xml:"NATIONALITY>VALUE"`
+		Aliases     []struct {
+			Name string `xml:"ALIAS_NAME"`
+		} `xml:"INDIVIDUAL_ALIAS"`
+		DatesOfBirth []struct {
+			Date string `xml:"DATE"`
+			Year string `xml:"YEAR"`
+		} `xml:"INDIVIDUAL_DATE_OF_BIRTH"`
+		Addresses []struct {
+			Country string `xml:"COUNTRY"`
+		} `xml:"INDIVIDUAL_ADDRESS"`
+	} `xml:"INDIVIDUALS>INDIVIDUAL"`
+	Entities []struct {
+		DataID    string `xml:"DATAID"`
+		FirstName string `xml:"FIRST_NAME"`
+		ListType  string `xml:"UN_LIST_TYPE"`
+		Reference string `xml:"REFERENCE_NUMBER"`
+		Comments  string `xml:"COMMENTS1"`
+		Aliases   []struct {
+			Name string `xml:"ALIAS_NAME"`
+		} `xml:"ENTITY_ALIAS"`
+		Addresses []struct {
+			Country string `xml:"COUNTRY"`
+		} `xml:"ENTITY_ADDRESS"`
+	} `xml:"ENTITIES>ENTITY"`
+}
+
+// LoadUNConsolidatedXML parses the UN Security Council consolidated list
+func LoadUNConsolidatedXML(r io.Reader) ([]*WatchlistEntry, error) {
+	var list unConsolidatedList
+	if err := xml.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode UN XML: %w", err)
+	}
+
+	entries := make([]*WatchlistEntry, 0, len(list.Individuals)+len(list.Entities))
+	for _, i := range list.Individuals {
+		entry := &WatchlistEntry{
+			ID:        SourceUN + ":" + i.DataID,
+			Source:    SourceUN,
+			SourceID:  i.Reference,
+			EntryType: "individual",
+			Names:     []string{joinName(i.FirstName, i.SecondName, i.ThirdName, i.FourthName)},
+			Countries: i.Nationality,
+			Programs:  []string{i.ListType},
+			Remarks:   i.Comments,
+		}
+		for _, alias := range i.Aliases {
+			entry.Names = appendUnique(entry.Names, alias.Name)
+		}
+		for _, dob := range i.DatesOfBirth {
+			if dob.Date != "" {
+				entry.DatesOfBirth = appendUnique(entry.DatesOfBirth, dob.Date)
+			} else {
+				entry.DatesOfBirth = appendUnique(entry.DatesOfBirth, dob.Year)
+			}
+		}
+		for _, address := range i.Addresses {
+			entry.Countries = appendUnique(entry.Countries, address.Country)
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, e := range list.Entities {
+		entry := &WatchlistEntry{
+			ID:        SourceUN + ":" + e.DataID,
+			Source:    SourceUN,
+			SourceID:  e.Reference,
+			EntryType: "entity",
+			Names:     []string{strings.TrimSpace(e.FirstName)},
+			Programs:  []string{e.ListType},
+			Remarks:   e.Comments,
+		}
+		for _, alias := range e.Aliases {
+			entry.Names = appendUnique(entry.Names, alias.Name)
+		}
+		for _, address := range e.Addresses {
+			entry.Countries = appendUnique(entry.Countries, address.Country)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// EU financial sanctions files consolidated list, XML format 1.1
+
+type euConsolidatedList struct {
+	Entities []struct {
+		LogicalID   string `xml:"logicalId,attr"`
+		Remark      string `xml:"remark"`
+		SubjectType struct {
+			Code string `xml:"code,attr"`
+		} `xml:"subjectType"`
+		Regulations []struct {
+			Programme string `xml:"programme,attr"`
+		} `xml:"regulation"`
+		NameAliases []struct {
+			WholeName string `xml:"wholeName,attr"`
+		} `xml:"nameAlias"`
+		BirthDates []struct {
+			BirthDate string `xml:"birthdate,attr"`
+			Year      string `xml:"year,attr"`
+			Country   string `xml:"countryIso2Code,attr"`
+		} `xml:"birthdate"`
+		Citizenships []struct {
+			Country string `xml:"countryIso2Code,attr"`
+		} `xml:"citizenship"`
+		Addresses []struct {
+			Country string `xml:"countryIso2Code,attr"`
+		} `xml:"address"`
+	} `xml:"sanctionEntity"`
+}
+
+// LoadEUConsolidatedXML parses the EU consolidated financial sanctions list
+func LoadEUConsolidatedXML(r io.Reader) ([]*WatchlistEntry, error) {
+	var list euConsolidatedList
+	if err := xml.NewDecoder(r).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode EU XML: %w", err)
+	}
+
+	entries := make([]*WatchlistEntry, 0, len(list.Entities))
+	for _, e := range list.Entities {
+		entryType := "entity"
+		if e.SubjectType.Code == "person" {
+			entryType = "individual"
+		}
+
+		entry := &WatchlistEntry{
+			ID:        SourceEU + ":" + e.LogicalID,
+			Source:    SourceEU,
+			SourceID:  e.LogicalID,
+			EntryType: entryType,
+			Remarks:   e.Remark,
+		}
+		for _, alias := range e.NameAliases {
+			entry.Names = appendUnique(entry.Names, alias.WholeName)
+		}
+		for _, regulation := range e.Regulations {
+			entry.Programs = appendUnique(entry.Programs, regulation.Programme)
+		}
+		for _, birth := range e.BirthDates {
+			if birth.BirthDate != "" {
+				entry.DatesOfBirth = appendUnique(entry.DatesOfBirth, birth.BirthDate)
+			} else {
+				entry.DatesOfBirth = appendUnique(entry.DatesOfBirth, birth.Year)
+			}
+		}
+		for _, citizenship := range e.Citizenships {
+			entry.Countries = appendUnique(entry.Countries, citizenship.Country)
+		}
+		for _, address := range e.Addresses {
+			entry.Countries = appendUnique(entry.Countries, address.Country)
+		}
+		if len(entry.Names) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// LoadPEPCSV parses a PEP list with a header row of name, aliases,
+// date_of_birth, country and position. Aliases are separated by semicolons.
+func LoadPEPCSV(r io.Reader) ([]*WatchlistEntry, error) {
+	rows, err := readCSV(r, ',')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PEP CSV: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, column := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, fmt.Errorf("PEP CSV has no name column")
+	}
+
+	field := func(row []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var entries []*WatchlistEntry
+	for n, row := range rows[1:] {
+		name := field(row, "name")
+		if name == "" {
+			continue
+		}
+		entry := &WatchlistEntry{
+			ID:        fmt.Sprintf("%s:%d", SourcePEP, n+1),
+			Source:    SourcePEP,
+			SourceID:  fmt.Sprintf("%d", n+1),
+			EntryType: "individual",
+			Names:     []string{name},
+			Remarks:   field(row, "position"),
+		}
+		for _, alias := range splitList(field(row, "aliases"), ";") {
+			entry.Names = appendUnique(entry.Names, alias)
+		}
+		if dob := field(row, "date_of_birth"); dob != "" {
+			entry.DatesOfBirth = []string{dob}
+		}
+		if country := field(row, "country"); country != "" {
+			entry.Countries = []string{country}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func readCSV(r io.Reader, separator rune) ([][]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = separator
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	return reader.ReadAll()
+}
+
+func ofacEntryType(sdnType string) string {
+	switch strings.ToLower(strings.TrimSpace(sdnType)) {
+	case "individual":
+		return "individual"
+	case "vessel":
+		return "vessel"
+	case "aircraft":
+		return "aircraft"
+	}
+	return "entity"
+}
+
+// ofacNull maps the "-0-" placeholder of the OFAC CSV files to empty
+func ofacNull(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "-0-" {
+		return ""
+	}
+	return value
+}
+
+// remarksField extracts "<label> <value>;" items from OFAC remarks, e.g.
+// "DOB 07 Oct 1952; nationality Russia;"
+func remarksField(remarks, label string) []string {
+	var values []string
+	for _, part := range strings.Split(remarks, ";") {
+		part = strings.TrimSpace(part)
+		if len(part) > len(label) && strings.EqualFold(part[:len(label)], label) {
+			values = appendUnique(values, strings.TrimSpace(part[len(label):]))
+		}
+	}
+	return values
+}
+
+func joinName(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, " ")
+}
+
+func splitList(value, separator string) []string {
+	var items []string
+	for _, item := range strings.Split(strings.Trim(value, "[]"), separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func appendUnique(values []string, value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return values
+	}
+	for _, existing := range values {
+		if strings.EqualFold(existing, value) {
+			return values
+		}
+	}
+	return append(values, value)
+}
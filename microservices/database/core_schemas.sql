@@ -71,6 +71,58 @@ CREATE INDEX idx_payments_account_id ON payments(account_id);
 CREATE INDEX idx_payments_provider ON payments(provider);
 CREATE INDEX idx_payments_status ON payments(status);
 
+CREATE TABLE payment_attempts (
+    id VARCHAR(255) PRIMARY KEY,
+    payment_id VARCHAR(255) NOT NULL,
+    attempt_number INTEGER NOT NULL,
+    status VARCHAR(50) NOT NULL DEFAULT 'processing',
+    decline_code VARCHAR(100),
+    decline_category VARCHAR(20),
+    failure_reason TEXT,
+    provider_transaction_id VARCHAR(255),
+    next_retry_at TIMESTAMP WITH TIME ZONE,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+    
+    CONSTRAINT payment_attempts_status_check CHECK (status IN ('processing', 'succeeded', 'failed')),
+    CONSTRAINT payment_attempts_decline_check CHECK (decline_category IS NULL OR decline_category IN ('hard', 'soft')),
+    UNIQUE (payment_id, attempt_number)
+);
+
+CREATE INDEX idx_payment_attempts_payment_id ON payment_attempts(payment_id);
+CREATE INDEX idx_payment_attempts_next_retry ON payment_attempts(next_retry_at) WHERE next_retry_at IS NOT NULL;
+
+CREATE TABLE card_tokens (
+    token VARCHAR(64) PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    bin VARCHAR(8) NOT NULL,
+    last4 VARCHAR(4) NOT NULL,
+    expiry_month INTEGER NOT NULL,
+    expiry_year INTEGER NOT NULL,
+    brand VARCHAR(50) NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    encrypted_pan BYTEA NOT NULL,
+    nonce BYTEA NOT NULL,
+    wrapped_key TEXT NOT NULL,
+    key_name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_card_tokens_account_id ON card_tokens(account_id);
+CREATE INDEX idx_card_tokens_fingerprint ON card_tokens(fingerprint);
+
+CREATE TABLE card_token_access (
+    id VARCHAR(255) PRIMARY KEY,
+    token VARCHAR(64) NOT NULL,
+    caller VARCHAR(100) NOT NULL,
+    purpose VARCHAR(255) NOT NULL,
+    granted BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    accessed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_card_token_access_token ON card_token_access(token, accessed_at);
+
 -- =====================================================
 -- LEDGER SERVICE SCHEMA
 -- =====================================================
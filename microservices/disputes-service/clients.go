@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Ledger accounts chargebacks move through. A chargeback is held in the
+// pending account until the dispute is won and returned to the merchant,
+// or lost and settled.
+const (
+	ChargebacksPendingAccount = "chargebacks_pending"
+	ChargebacksSettledAccount = "chargebacks_settled"
+)
+
+// AccountTypeLiability is the ledger account type merchant and chargeback
+// accounts are opened with
+const AccountTypeLiability = "liability"
+
+// LedgerTransfer moves an amount between two ledger accounts. ID
+// identifies the transfer to the ledger, so a retried transfer is booked
+// once.
+type LedgerTransfer struct {
+	ID            string
+	TransactionID string
+	FromAccount   string
+	ToAccount     string
+	AmountMinor   int64
+	Currency      string
+	Description   string
+	Metadata      map[string]interface{}
+}
+
+// LedgerPoster posts transfers to the ledger
+type LedgerPoster interface {
+	Post(ctx context.Context, transfer *LedgerTransfer) error
+}
+
+// RiskSignaler tells risk-service about disputes against a merchant
+type RiskSignaler interface {
+	DisputeSignal(ctx context.Context, merchantID, disputeID, status string) error
+}
+
+// HTTPLedgerPoster posts to ledger-service over HTTP, each transfer as one
+// ledger transfer keyed by its ID
+type HTTPLedgerPoster struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPLedgerPoster creates a new ledger client
+func NewHTTPLedgerPoster(baseURL string) *HTTPLedgerPoster {
+	return &HTTPLedgerPoster{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// money is ledger-service's amount; values are decimal strings
+type money struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// Post moves the amount from the from account to the to account in one
+// transfer, opening either account if it does not exist yet. The ledger
+// answers a transfer it already booked with the original.
+func (c *HTTPLedgerPoster) Post(ctx context.Context, transfer *LedgerTransfer) error {
+	metadata := map[string]interface{}{"transaction_id": transfer.TransactionID, "created_by": "disputes-service"}
+	for key, value := range transfer.Metadata {
+		metadata[key] = value
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"transfer_id":       transfer.ID,
+		"from_account":      transfer.FromAccount,
+		"to_account":        transfer.ToAccount,
+		"from_account_type": AccountTypeLiability,
+		"to_account_type":   AccountTypeLiability,
+		"type":              "chargeback",
+		"amount":            money{Value: formatMinorUnits(transfer.AmountMinor), Currency: transfer.Currency},
+		"description":       transfer.Description,
+		"metadata":          metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal transfer: %w", err)
+	}
+
+	if err := postJSON(ctx, c.client, c.baseURL+"/v1/transfers", body); err != nil {
+		return fmt.Errorf("failed to post transfer %s: %w", transfer.ID, err)
+	}
+	return nil
+}
+
+// HTTPRiskClient posts profile signals to risk-service over HTTP
+type HTTPRiskClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRiskClient creates a new risk-service client
+func NewHTTPRiskClient(baseURL string) *HTTPRiskClient {
+	return &HTTPRiskClient{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// DisputeSignal records a dispute opened, won or lost on the merchant's
+// risk profile
+func (c *HTTPRiskClient) DisputeSignal(ctx context.Context, merchantID, disputeID, status string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"type":         "dispute",
+		"entity_type":  "merchant",
+		"status":       status,
+		"reference_id": disputeID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal signal: %w", err)
+	}
+
+	return postJSON(ctx, c.client, c.baseURL+"/v1/profiles/"+merchantID+"/signals", body)
+}
+
+// postJSON posts a JSON body and checks for a success status
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dispute statuses. A chargeback needs a response from the merchant until
+// its deadline, is under review once represented and ends won or lost.
+const (
+	DisputeStatusNeedsResponse = "needs_response"
+	DisputeStatusUnderReview   = "under_review"
+	DisputeStatusWon           = "won"
+	DisputeStatusLost          = "lost"
+)
+
+// Ledger postings of a dispute
+const (
+	PostingChargeback = "chargeback" // merchant debited into pending
+	PostingReversal   = "reversal"   // pending returned to the merchant on a win
+	PostingFinal      = "final"      // pending settled on a loss
+)
+
+// Posting statuses
+const (
+	PostingStatusPosted = "posted"
+	PostingStatusFailed = "failed"
+)
+
+// Evidence types merchants can submit with a representment
+var evidenceTypes = map[string]bool{
+	"receipt":                true,
+	"delivery_proof":         true,
+	"customer_communication": true,
+	"terms_acceptance":       true,
+	"refund_policy":          true,
+	"authorization_proof":    true,
+	"other":                  true,
+}
+
+var (
+	// ErrDisputeNotFound is returned for unknown disputes
+	ErrDisputeNotFound = errors.New("dispute not found")
+	// ErrInvalidTransition is returned for status changes the lifecycle
+	// does not allow
+	ErrInvalidTransition = errors.New("invalid dispute status transition")
+	// ErrDeadlinePassed is returned for representments after the response
+	// deadline
+	ErrDeadlinePassed = errors.New("response deadline has passed")
+)
+
+// disputeTransitions lists the statuses each dispute status can move to
+var disputeTransitions = map[string][]string{
+	DisputeStatusNeedsResponse: {DisputeStatusUnderReview, DisputeStatusWon, DisputeStatusLost},
+	DisputeStatusUnderReview:   {DisputeStatusWon, DisputeStatusLost},
+	DisputeStatusWon:           {},
+	DisputeStatusLost:          {},
+}
+
+// DisputeEvent records a change to a dispute
+type DisputeEvent struct {
+	Status string    `json:"status"`
+	Note   string    `json:"note,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Evidence is one item backing a representment
+type Evidence struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	DocumentID  string `json:"document_id,omitempty"` // evidence-service file
+	URL         string `json:"url,omitempty"`
+}
+
+// Representment is the merchant's response to a chargeback
+type Representment struct {
+	Evidence    []Evidence `json:"evidence"`
+	Note        string     `json:"note,omitempty"`
+	SubmittedBy string     `json:"submitted_by,omitempty"`
+	SubmittedAt time.Time  `json:"submitted_at"`
+}
+
+// DisputePosting is a ledger posting of a dispute
+type DisputePosting struct {
+	Kind        string     `json:"kind"`
+	FromAccount string     `json:"from_account"`
+	ToAccount   string     `json:"to_account"`
+	AmountMinor int64      `json:"amount_minor"`
+	Status      string     `json:"status"`
+	PostedAt    *time.Time `json:"posted_at,omitempty"`
+}
+
+// Dispute is a chargeback raised against a payment
+type Dispute struct {
+	ID                string           `json:"id"`
+	Provider          string           `json:"provider"`
+	ProviderDisputeID string           `json:"provider_dispute_id"`
+	TransactionID     string           `json:"transaction_id"`
+	MerchantID        string           `json:"merchant_id"`
+	AmountMinor       int64            `json:"amount_minor"`
+	Currency          string           `json:"currency"`
+	Network           string           `json:"network"`
+	ReasonCode        string           `json:"reason_code"`
+	Category          string           `json:"category"`
+	ReasonDescription string           `json:"reason_description,omitempty"`
+	Status            string           `json:"status"`
+	ResponseDueBy     time.Time        `json:"response_due_by"`
+	Representment     *Representment   `json:"representment,omitempty"`
+	Postings          []DisputePosting `json:"postings"`
+	Events            []DisputeEvent   `json:"events"`
+	CreatedAt         time.Time        `json:"created_at"`
+	UpdatedAt         time.Time        `json:"updated_at"`
+	ResolvedAt        *time.Time       `json:"resolved_at,omitempty"`
+}
+
+// DisputeFilters narrows dispute listings and stats
+type DisputeFilters struct {
+	MerchantID string
+	Status     string
+	Category   string
+	From       time.Time // created at or after
+	To         time.Time // created before
+}
+
+// DisputeService tracks chargebacks through their lifecycle and keeps the
+// ledger and the merchant's risk profile in step
+type DisputeService struct {
+	mu       sync.RWMutex
+	disputes map[string]*Dispute
+	order    []string
+	byRef    map[string]string // provider/provider dispute ID to dispute ID
+	adapters *AdapterRegistry
+	ledger   LedgerPoster
+	risk     RiskSignaler
+	journal  Journal
+}
+
+// NewDisputeService creates a dispute service
+func NewDisputeService() *DisputeService {
+	return &DisputeService{
+		disputes: make(map[string]*Dispute),
+		byRef:    make(map[string]string),
+		adapters: NewAdapterRegistry(),
+	}
+}
+
+// SetLedgerPoster configures posting chargebacks to the ledger
+func (s *DisputeService) SetLedgerPoster(ledger LedgerPoster) {
+	s.ledger = ledger
+}
+
+// SetRiskSignaler configures reporting disputes to risk-service
+func (s *DisputeService) SetRiskSignaler(risk RiskSignaler) {
+	s.risk = risk
+}
+
+// Adapters returns the provider notification adapters
+func (s *DisputeService) Adapters() *AdapterRegistry {
+	return s.adapters
+}
+
+// HandleNotification applies a provider's dispute webhook. Repeated
+// notifications of a dispute that is already opened or resolved are
+// ignored.
+func (s *DisputeService) HandleNotification(ctx context.Context, provider string, header http.Header, body []byte) (*Dispute, error) {
+	notification, err := s.adapters.Parse(provider, header, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.ApplyNotification(ctx, notification)
+}
+
+// ApplyNotification opens, updates or resolves the dispute a notification
+// is about
+func (s *DisputeService) ApplyNotification(ctx context.Context, n *DisputeNotification) (*Dispute, error) {
+	if n.ProviderDisputeID == "" {
+		return nil, errors.New("provider_dispute_id is required")
+	}
+
+	s.mu.RLock()
+	disputeID, exists := s.byRef[disputeRef(n.Provider, n.ProviderDisputeID)]
+	s.mu.RUnlock()
+
+	switch n.Type {
+	case NotificationOpened:
+		if exists {
+			return s.GetDispute(disputeID)
+		}
+		return s.openDispute(ctx, n)
+
+	case NotificationUpdated:
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, n.ProviderDisputeID)
+		}
+		return s.update(disputeID, func(d *Dispute) {
+			if n.ResponseDueBy != nil {
+				d.ResponseDueBy = *n.ResponseDueBy
+			}
+		})
+
+	case NotificationWon, NotificationLost:
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, n.ProviderDisputeID)
+		}
+		dispute, err := s.GetDispute(disputeID)
+		if err != nil {
+			return nil, err
+		}
+		if dispute.Status == n.Type {
+			return dispute, nil
+		}
+		return s.Resolve(ctx, disputeID, n.Type, "reported by "+n.Provider)
+
+	default:
+		return nil, fmt.Errorf("invalid notification type: %s", n.Type)
+	}
+}
+
+// openDispute records a new chargeback, debits the merchant and reports
+// the dispute to risk-service
+func (s *DisputeService) openDispute(ctx context.Context, n *DisputeNotification) (*Dispute, error) {
+	if n.TransactionID == "" || n.MerchantID == "" {
+		return nil, errors.New("transaction_id and merchant_id are required")
+	}
+	if n.AmountMinor <= 0 || n.Currency == "" {
+		return nil, errors.New("a positive amount and a currency are required")
+	}
+
+	reason := ClassifyReason(n.Network, n.ReasonCode)
+	if reason.Category == CategoryOther && n.Category != "" {
+		reason.Category = n.Category
+	}
+
+	now := time.Now()
+	dueBy := now.Add(ResponseWindow(reason.Network))
+	if n.ResponseDueBy != nil {
+		dueBy = *n.ResponseDueBy
+	}
+
+	dispute := &Dispute{
+		ID:                generateID("dsp"),
+		Provider:          n.Provider,
+		ProviderDisputeID: n.ProviderDisputeID,
+		TransactionID:     n.TransactionID,
+		MerchantID:        n.MerchantID,
+		AmountMinor:       n.AmountMinor,
+		Currency:          strings.ToUpper(n.Currency),
+		Network:           reason.Network,
+		ReasonCode:        reason.Code,
+		Category:          reason.Category,
+		ReasonDescription: reason.Description,
+		Status:            DisputeStatusNeedsResponse,
+		ResponseDueBy:     dueBy,
+		Postings:          []DisputePosting{},
+		Events:            []DisputeEvent{{Status: DisputeStatusNeedsResponse, At: now}},
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+
+	s.mu.Lock()
+	ref := disputeRef(n.Provider, n.ProviderDisputeID)
+	if existing, ok := s.byRef[ref]; ok {
+		s.mu.Unlock()
+		return s.GetDispute(existing)
+	}
+	err := s.commitLocked(&JournalEntry{Kind: JournalDispute, Dispute: dispute})
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save dispute: %w", err)
+	}
+
+	s.post(ctx, dispute.ID, PostingChargeback, dispute.MerchantID, ChargebacksPendingAccount)
+	s.signal(ctx, dispute, "opened")
+
+	return s.GetDispute(dispute.ID)
+}
+
+// SubmitRepresentment records the merchant's evidence against a chargeback
+// before its deadline
+func (s *DisputeService) SubmitRepresentment(disputeID string, rep *Representment) (*Dispute, error) {
+	if len(rep.Evidence) == 0 {
+		return nil, errors.New("at least one piece of evidence is required")
+	}
+	for _, item := range rep.Evidence {
+		if !evidenceTypes[item.Type] {
+			return nil, fmt.Errorf("invalid evidence type: %s", item.Type)
+		}
+		if item.DocumentID == "" && item.URL == "" && item.Description == "" {
+			return nil, fmt.Errorf("%s evidence needs a document, URL or description", item.Type)
+		}
+	}
+
+	dispute, err := s.GetDispute(disputeID)
+	if err != nil {
+		return nil, err
+	}
+	if dispute.Status == DisputeStatusNeedsResponse && time.Now().After(dispute.ResponseDueBy) {
+		return nil, fmt.Errorf("%w: was due by %s", ErrDeadlinePassed, dispute.ResponseDueBy.Format(time.RFC3339))
+	}
+
+	submitted := *rep
+	submitted.Evidence = append([]Evidence(nil), rep.Evidence...)
+	submitted.SubmittedAt = time.Now()
+	return s.transition(disputeID, DisputeStatusUnderReview, fmt.Sprintf("%d pieces of evidence", len(rep.Evidence)), func(d *Dispute) {
+		d.Representment = &submitted
+	})
+}
+
+// Accept concedes a chargeback without a representment
+func (s *DisputeService) Accept(ctx context.Context, disputeID string) (*Dispute, error) {
+	return s.Resolve(ctx, disputeID, DisputeStatusLost, "accepted by merchant")
+}
+
+// Resolve closes a dispute won or lost. A win returns the chargeback to
+// the merchant; a loss settles it.
+func (s *DisputeService) Resolve(ctx context.Context, disputeID, outcome, note string) (*Dispute, error) {
+	if outcome != DisputeStatusWon && outcome != DisputeStatusLost {
+		return nil, fmt.Errorf("%w: outcome must be %s or %s", ErrInvalidTransition, DisputeStatusWon, DisputeStatusLost)
+	}
+
+	dispute, err := s.transition(disputeID, outcome, note, func(d *Dispute) {
+		now := time.Now()
+		d.ResolvedAt = &now
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if outcome == DisputeStatusWon {
+		s.post(ctx, disputeID, PostingReversal, ChargebacksPendingAccount, dispute.MerchantID)
+	} else {
+		s.post(ctx, disputeID, PostingFinal, ChargebacksPendingAccount, ChargebacksSettledAccount)
+	}
+	s.signal(ctx, dispute, outcome)
+
+	return s.GetDispute(disputeID)
+}
+
+// ExpireOverdue loses disputes still needing a response after their
+// deadline and returns how many
+func (s *DisputeService) ExpireOverdue(ctx context.Context, now time.Time) int {
+	s.mu.RLock()
+	var overdue []string
+	for _, id := range s.order {
+		dispute := s.disputes[id]
+		if dispute.Status == DisputeStatusNeedsResponse && now.After(dispute.ResponseDueBy) {
+			overdue = append(overdue, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	expired := 0
+	for _, id := range overdue {
+		if _, err := s.Resolve(ctx, id, DisputeStatusLost, "response deadline passed"); err != nil {
+			log.Printf("Failed to expire dispute %s: %v", id, err)
+			continue
+		}
+		expired++
+	}
+	return expired
+}
+
+// post moves a dispute's amount between two ledger accounts and records
+// the posting, failed or not, on the dispute
+func (s *DisputeService) post(ctx context.Context, disputeID, kind, from, to string) {
+	dispute, err := s.GetDispute(disputeID)
+	if err != nil || s.ledger == nil {
+		return
+	}
+
+	posting := DisputePosting{Kind: kind, FromAccount: from, ToAccount: to, AmountMinor: dispute.AmountMinor}
+	s.postLedger(ctx, dispute, &posting)
+
+	_, err = s.update(disputeID, func(d *Dispute) {
+		d.Postings = append(d.Postings, posting)
+	})
+	if err != nil {
+		log.Printf("Failed to record %s of dispute %s: %v", kind, disputeID, err)
+	}
+}
+
+// postLedger posts one posting and sets its status. A dispute has at most
+// one posting of each kind, so the kind keys the ledger transfer and a
+// retried posting is booked once.
+func (s *DisputeService) postLedger(ctx context.Context, dispute *Dispute, posting *DisputePosting) {
+	err := s.ledger.Post(ctx, &LedgerTransfer{
+		ID:            dispute.ID + ":" + posting.Kind,
+		TransactionID: dispute.ID,
+		FromAccount:   posting.FromAccount,
+		ToAccount:     posting.ToAccount,
+		AmountMinor:   posting.AmountMinor,
+		Currency:      dispute.Currency,
+		Description:   fmt.Sprintf("Chargeback %s of payment %s", posting.Kind, dispute.TransactionID),
+		Metadata: map[string]interface{}{
+			"dispute_id":          dispute.ID,
+			"payment_id":          dispute.TransactionID,
+			"merchant_id":         dispute.MerchantID,
+			"provider_dispute_id": dispute.ProviderDisputeID,
+			"reason_code":         dispute.ReasonCode,
+			"posting":             posting.Kind,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to post %s of dispute %s to the ledger: %v", posting.Kind, dispute.ID, err)
+		posting.Status = PostingStatusFailed
+		return
+	}
+
+	now := time.Now()
+	posting.Status = PostingStatusPosted
+	posting.PostedAt = &now
+}
+
+// RetryLedgerPostings posts failed dispute postings again and returns how
+// many went through
+func (s *DisputeService) RetryLedgerPostings(ctx context.Context) int {
+	if s.ledger == nil {
+		return 0
+	}
+
+	s.mu.RLock()
+	var pending []*Dispute
+	for _, id := range s.order {
+		dispute := s.disputes[id]
+		for _, posting := range dispute.Postings {
+			if posting.Status == PostingStatusFailed {
+				pending = append(pending, copyDispute(dispute))
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	posted := 0
+	for _, dispute := range pending {
+		for i := range dispute.Postings {
+			posting := dispute.Postings[i]
+			if posting.Status != PostingStatusFailed {
+				continue
+			}
+			s.postLedger(ctx, dispute, &posting)
+			if posting.Status != PostingStatusPosted {
+				continue
+			}
+			posted++
+			_, err := s.update(dispute.ID, func(d *Dispute) {
+				d.Postings[i] = posting
+			})
+			if err != nil {
+				log.Printf("Failed to record %s of dispute %s: %v", posting.Kind, dispute.ID, err)
+			}
+		}
+	}
+	return posted
+}
+
+// signal reports a dispute to risk-service; failures are only logged as
+// profiles recover from missed signals through decay
+func (s *DisputeService) signal(ctx context.Context, dispute *Dispute, status string) {
+	if s.risk == nil {
+		return
+	}
+	if err := s.risk.DisputeSignal(ctx, dispute.MerchantID, dispute.ID, status); err != nil {
+		log.Printf("Failed to report dispute %s to risk service: %v", dispute.ID, err)
+	}
+}
+
+// transition moves a dispute to a new status if the lifecycle allows it
+func (s *DisputeService) transition(disputeID, status, note string, fn func(d *Dispute)) (*Dispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.disputes[disputeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, disputeID)
+	}
+	if !canTransition(stored.Status, status) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, stored.Status, status)
+	}
+
+	now := time.Now()
+	dispute := copyDispute(stored)
+	dispute.Status = status
+	dispute.UpdatedAt = now
+	dispute.Events = append(dispute.Events, DisputeEvent{Status: status, Note: note, At: now})
+	if fn != nil {
+		fn(dispute)
+	}
+	if err := s.commitLocked(&JournalEntry{Kind: JournalDispute, Dispute: dispute}); err != nil {
+		return nil, fmt.Errorf("failed to save dispute %s: %w", disputeID, err)
+	}
+
+	return dispute, nil
+}
+
+// update applies fn to a dispute without changing its status
+func (s *DisputeService) update(disputeID string, fn func(d *Dispute)) (*Dispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.disputes[disputeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, disputeID)
+	}
+	dispute := copyDispute(stored)
+	fn(dispute)
+	dispute.UpdatedAt = time.Now()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalDispute, Dispute: dispute}); err != nil {
+		return nil, fmt.Errorf("failed to save dispute %s: %w", disputeID, err)
+	}
+
+	return dispute, nil
+}
+
+// canTransition reports whether a dispute can move between two statuses
+func canTransition(from, to string) bool {
+	for _, allowed := range disputeTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDispute returns a dispute
+func (s *DisputeService) GetDispute(disputeID string) (*Dispute, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dispute, ok := s.disputes[disputeID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDisputeNotFound, disputeID)
+	}
+	return copyDispute(dispute), nil
+}
+
+// ListDisputes returns disputes matching the filters, newest first
+func (s *DisputeService) ListDisputes(filters DisputeFilters) []*Dispute {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	disputes := []*Dispute{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		dispute := s.disputes[s.order[i]]
+		if filters.matches(dispute) {
+			disputes = append(disputes, copyDispute(dispute))
+		}
+	}
+	return disputes
+}
+
+func (f DisputeFilters) matches(dispute *Dispute) bool {
+	if f.MerchantID != "" && dispute.MerchantID != f.MerchantID {
+		return false
+	}
+	if f.Status != "" && dispute.Status != f.Status {
+		return false
+	}
+	if f.Category != "" && dispute.Category != f.Category {
+		return false
+	}
+	if !f.From.IsZero() && dispute.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !dispute.CreatedAt.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// OutcomeStats counts disputes by outcome. WinRate is won over resolved
+// disputes.
+type OutcomeStats struct {
+	Total   int     `json:"total"`
+	Open    int     `json:"open"`
+	Won     int     `json:"won"`
+	Lost    int     `json:"lost"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// ReasonStats are the outcomes of disputes with one reason code
+type ReasonStats struct {
+	Network     string `json:"network"`
+	ReasonCode  string `json:"reason_code"`
+	Category    string `json:"category"`
+	Description string `json:"description,omitempty"`
+	OutcomeStats
+}
+
+// DisputeStats is the dashboard of dispute outcomes
+type DisputeStats struct {
+	Overall    OutcomeStats             `json:"overall"`
+	ByCategory map[string]*OutcomeStats `json:"by_category"`
+	ByReason   []*ReasonStats           `json:"by_reason"`
+}
+
+func (o *OutcomeStats) add(status string) {
+	o.Total++
+	switch status {
+	case DisputeStatusWon:
+		o.Won++
+	case DisputeStatusLost:
+		o.Lost++
+	default:
+		o.Open++
+	}
+	if resolved := o.Won + o.Lost; resolved > 0 {
+		o.WinRate = float64(o.Won) / float64(resolved)
+	}
+}
+
+// Stats returns win rates of disputes matching the filters, overall, by
+// category and by reason code, busiest reason codes first
+func (s *DisputeService) Stats(filters DisputeFilters) *DisputeStats {
+	stats := &DisputeStats{ByCategory: make(map[string]*OutcomeStats)}
+	byReason := make(map[string]*ReasonStats)
+
+	for _, dispute := range s.ListDisputes(filters) {
+		stats.Overall.add(dispute.Status)
+
+		category, ok := stats.ByCategory[dispute.Category]
+		if !ok {
+			category = &OutcomeStats{}
+			stats.ByCategory[dispute.Category] = category
+		}
+		category.add(dispute.Status)
+
+		key := dispute.Network + "/" + dispute.ReasonCode
+		reason, ok := byReason[key]
+		if !ok {
+			reason = &ReasonStats{
+				Network:     dispute.Network,
+				ReasonCode:  dispute.ReasonCode,
+				Category:    dispute.Category,
+				Description: dispute.ReasonDescription,
+			}
+			byReason[key] = reason
+			stats.ByReason = append(stats.ByReason, reason)
+		}
+		reason.add(dispute.Status)
+	}
+
+	sort.SliceStable(stats.ByReason, func(i, j int) bool {
+		if stats.ByReason[i].Total != stats.ByReason[j].Total {
+			return stats.ByReason[i].Total > stats.ByReason[j].Total
+		}
+		return stats.ByReason[i].Network+stats.ByReason[i].ReasonCode < stats.ByReason[j].Network+stats.ByReason[j].ReasonCode
+	})
+	return stats
+}
+
+// disputeRef keys a dispute by its provider's ID
+func disputeRef(provider, providerDisputeID string) string {
+	return provider + "/" + providerDisputeID
+}
+
+// copyDispute returns a copy of a dispute safe to hand out
+func copyDispute(dispute *Dispute) *Dispute {
+	found := *dispute
+	found.Postings = append([]DisputePosting{}, dispute.Postings...)
+	found.Events = append([]DisputeEvent(nil), dispute.Events...)
+	if dispute.Representment != nil {
+		rep := *dispute.Representment
+		rep.Evidence = append([]Evidence(nil), rep.Evidence...)
+		found.Representment = &rep
+	}
+	return &found
+}
+
+// lastID keeps generated IDs unique when the clock does not advance
+// between calls
+var lastID int64
+
+// generateID returns a unique ID with the given prefix
+func generateID(prefix string) string {
+	for {
+		last := atomic.LoadInt64(&lastID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, next) {
+			return fmt.Sprintf("%s_%d", prefix, next)
+		}
+	}
+}
+
+// formatMinorUnits renders minor units as a decimal amount, e.g. -1234 as
+// "-12.34"
+func formatMinorUnits(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
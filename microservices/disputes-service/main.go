@@ -1,36 +1,89 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Global services
+var (
+	disputeService *DisputeService
+)
+
 func main() {
 	port := flag.String("port", "8101", "Port to listen on")
 	flag.Parse()
 
 	log.Printf("Starting Disputes & Chargebacks Microservice on port %s...", *port)
 
+	disputeService = NewDisputeService()
+
+	// Disputes are journaled to disk and reloaded on start, so a replayed
+	// notification finds its dispute instead of debiting the merchant again
+	journalPath := os.Getenv("DISPUTES_JOURNAL_PATH")
+	if journalPath == "" {
+		journalPath = "data/disputes/journal.jsonl"
+	}
+	journal, err := OpenFileJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to open dispute journal: %v", err)
+	}
+	defer journal.Close()
+	if err := disputeService.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load disputes: %v", err)
+	}
+	log.Printf("Journaling disputes to %s", journalPath)
+
+	genericKey := []byte(os.Getenv("DISPUTE_WEBHOOK_SIGNING_KEY"))
+	if len(genericKey) == 0 {
+		log.Println("DISPUTE_WEBHOOK_SIGNING_KEY not set, generic dispute notifications will be rejected")
+	}
+	disputeService.Adapters().Register("generic", NewGenericAdapter(genericKey))
+	stripeSecret := []byte(os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	if len(stripeSecret) == 0 {
+		log.Println("STRIPE_WEBHOOK_SECRET not set, Stripe dispute notifications will be rejected")
+	}
+	disputeService.Adapters().Register("stripe", NewStripeAdapter(stripeSecret))
+
+	if ledgerURL := os.Getenv("LEDGER_SERVICE_URL"); ledgerURL != "" {
+		disputeService.SetLedgerPoster(NewHTTPLedgerPoster(ledgerURL))
+		log.Printf("Posting chargebacks to ledger service at %s", ledgerURL)
+	}
+	if riskURL := os.Getenv("RISK_SERVICE_URL"); riskURL != "" {
+		disputeService.SetRiskSignaler(NewHTTPRiskClient(riskURL))
+		log.Printf("Reporting disputes to risk service at %s", riskURL)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"disputes","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/disputes", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]map[string]interface{}{})
-	})
+	mux.HandleFunc("/v1/disputes", handleDisputes)
+	mux.HandleFunc("/v1/disputes/stats", handleDisputeStats)
+	mux.HandleFunc("/v1/disputes/notifications/", handleNotification)
+	mux.HandleFunc("/v1/disputes/", handleDisputeByID)
+	mux.HandleFunc("/v1/reason-codes", handleReasonCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runDeadlines(ctx, 15*time.Minute)
+	go runLedgerRetry(ctx, time.Minute)
 
 	server := &http.Server{
-		Addr: ":" + *port,
+		Addr:    ":" + *port,
 		Handler: mux,
 	}
 
@@ -44,5 +97,239 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+
 	log.Println("Disputes & Chargebacks service exited")
 }
+
+// runDeadlines periodically loses disputes whose response deadline passed
+func runDeadlines(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if expired := disputeService.ExpireOverdue(ctx, now); expired > 0 {
+				log.Printf("Lost %d disputes past their response deadline", expired)
+			}
+		}
+	}
+}
+
+// runLedgerRetry periodically retries failed chargeback postings
+func runLedgerRetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if posted := disputeService.RetryLedgerPostings(ctx); posted > 0 {
+				log.Printf("Posted %d chargeback postings to the ledger on retry", posted)
+			}
+		}
+	}
+}
+
+// disputeErrorStatus maps dispute errors to HTTP statuses
+func disputeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrDisputeNotFound), errors.Is(err, ErrUnknownProvider):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidSignature):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrDeadlinePassed):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// parseFilters reads ?merchant_id=, ?status=, ?category= and the
+// ?from=&to= dates (YYYY-MM-DD, to exclusive)
+func parseFilters(r *http.Request) (DisputeFilters, error) {
+	query := r.URL.Query()
+	filters := DisputeFilters{
+		MerchantID: query.Get("merchant_id"),
+		Status:     query.Get("status"),
+		Category:   query.Get("category"),
+	}
+	for name, target := range map[string]*time.Time{"from": &filters.From, "to": &filters.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return filters, fmt.Errorf("%s must be YYYY-MM-DD", name)
+			}
+			*target = parsed
+		}
+	}
+	return filters, nil
+}
+
+// handleDisputes lists disputes and opens ones reported by hand in the
+// generic notification format
+func handleDisputes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		filters, err := parseFilters(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		disputes := disputeService.ListDisputes(filters)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"disputes": disputes,
+			"total":    len(disputes),
+		})
+
+	case "POST":
+		var notification DisputeNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		notification.Type = NotificationOpened
+		if notification.Provider == "" {
+			notification.Provider = "manual"
+		}
+
+		dispute, err := disputeService.ApplyNotification(r.Context(), &notification)
+		if err != nil {
+			http.Error(w, err.Error(), disputeErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(dispute)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleNotification receives provider dispute webhooks at
+// /v1/disputes/notifications/{provider}
+func handleNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	provider := strings.TrimPrefix(r.URL.Path, "/v1/disputes/notifications/")
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dispute, err := disputeService.HandleNotification(r.Context(), provider, r.Header, body)
+	if err != nil {
+		log.Printf("Failed to handle %s dispute notification: %v", provider, err)
+		http.Error(w, err.Error(), disputeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
+
+// handleDisputeStats serves win rates overall, by category and by reason
+// code for the dashboard, with the same filters as the dispute list
+func handleDisputeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filters, err := parseFilters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disputeService.Stats(filters))
+}
+
+// handleDisputeByID serves GET /v1/disputes/{id} and the POST actions
+// representment, accept and outcome
+func handleDisputeByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/disputes/"), "/")
+	disputeID := parts[0]
+	if disputeID == "" {
+		http.Error(w, "Dispute ID required", http.StatusBadRequest)
+		return
+	}
+
+	var dispute *Dispute
+	var err error
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		dispute, err = disputeService.GetDispute(disputeID)
+
+	case len(parts) == 2 && parts[1] == "representment" && r.Method == "POST":
+		var rep Representment
+		if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		dispute, err = disputeService.SubmitRepresentment(disputeID, &rep)
+
+	case len(parts) == 2 && parts[1] == "accept" && r.Method == "POST":
+		dispute, err = disputeService.Accept(r.Context(), disputeID)
+
+	case len(parts) == 2 && parts[1] == "outcome" && r.Method == "POST":
+		var req struct {
+			Outcome string `json:"outcome"`
+			Note    string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		dispute, err = disputeService.Resolve(r.Context(), disputeID, req.Outcome, req.Note)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), disputeErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
+
+// handleReasonCode classifies ?network=&code= and returns its response
+// window
+func handleReasonCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	reason := ClassifyReason(query.Get("network"), query.Get("code"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reason":               reason,
+		"response_window_days": int(ResponseWindow(reason.Network).Hours() / 24),
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification types providers send about a dispute
+const (
+	NotificationOpened  = "opened"  // a chargeback was raised
+	NotificationUpdated = "updated" // details such as the deadline changed
+	NotificationWon     = "won"
+	NotificationLost    = "lost"
+)
+
+var (
+	// ErrUnknownProvider is returned for notifications from providers
+	// without an adapter
+	ErrUnknownProvider = errors.New("unknown dispute provider")
+	// ErrInvalidSignature is returned for notifications that do not carry
+	// the provider's signature
+	ErrInvalidSignature = errors.New("invalid notification signature")
+)
+
+// DisputeSignatureHeader carries the hex HMAC-SHA256 of a generic
+// notification body
+const DisputeSignatureHeader = "X-Dispute-Signature"
+
+// StripeSignatureHeader carries Stripe's webhook signature
+const StripeSignatureHeader = "Stripe-Signature"
+
+// stripeSignatureTolerance is how old a signed Stripe event may be before
+// it is rejected as a replay
+const stripeSignatureTolerance = 5 * time.Minute
+
+// DisputeNotification is a provider's dispute event in the service's terms
+type DisputeNotification struct {
+	Type              string     `json:"type"`
+	Provider          string     `json:"provider,omitempty"`
+	ProviderDisputeID string     `json:"provider_dispute_id"`
+	TransactionID     string     `json:"transaction_id"`
+	MerchantID        string     `json:"merchant_id"`
+	AmountMinor       int64      `json:"amount_minor"`
+	Currency          string     `json:"currency"`
+	Network           string     `json:"network"`
+	ReasonCode        string     `json:"reason_code"`
+	Category          string     `json:"category,omitempty"` // used when the reason code is not known
+	ResponseDueBy     *time.Time `json:"response_due_by,omitempty"`
+}
+
+// NotificationAdapter verifies a provider's dispute webhook and turns it
+// into a notification
+type NotificationAdapter interface {
+	ParseNotification(header http.Header, body []byte) (*DisputeNotification, error)
+}
+
+// AdapterRegistry maps providers to their notification adapters
+type AdapterRegistry struct {
+	mu       sync.RWMutex
+	adapters map[string]NotificationAdapter
+}
+
+// NewAdapterRegistry creates an empty registry. Adapters are registered
+// with their signing secrets.
+func NewAdapterRegistry() *AdapterRegistry {
+	return &AdapterRegistry{
+		adapters: make(map[string]NotificationAdapter),
+	}
+}
+
+// Register sets the adapter of a provider
+func (r *AdapterRegistry) Register(provider string, adapter NotificationAdapter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.adapters[provider] = adapter
+}
+
+// Parse verifies a provider's webhook and turns its body into a
+// notification
+func (r *AdapterRegistry) Parse(provider string, header http.Header, body []byte) (*DisputeNotification, error) {
+	r.mu.RLock()
+	adapter, ok := r.adapters[provider]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, provider)
+	}
+
+	notification, err := adapter.ParseNotification(header, body)
+	if err != nil {
+		return nil, err
+	}
+	notification.Provider = provider
+	return notification, nil
+}
+
+// GenericAdapter reads notifications already in the service's format, for
+// providers that send them that way. Each body is signed with a shared key
+// in DisputeSignatureHeader.
+type GenericAdapter struct {
+	signingKey []byte
+}
+
+// NewGenericAdapter creates a generic adapter. Without a key every
+// notification is rejected.
+func NewGenericAdapter(signingKey []byte) *GenericAdapter {
+	return &GenericAdapter{signingKey: signingKey}
+}
+
+// ParseNotification verifies and decodes a notification
+func (a *GenericAdapter) ParseNotification(header http.Header, body []byte) (*DisputeNotification, error) {
+	if !verifyHMAC(a.signingKey, body, header.Get(DisputeSignatureHeader)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var notification DisputeNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, fmt.Errorf("invalid notification: %w", err)
+	}
+	return &notification, nil
+}
+
+// stripeReasons maps Stripe's dispute reasons to categories for disputes
+// without a network reason code
+var stripeReasons = map[string]string{
+	"fraudulent":                CategoryFraud,
+	"unrecognized":              CategoryFraud,
+	"duplicate":                 CategoryProcessingError,
+	"incorrect_account_details": CategoryProcessingError,
+	"credit_not_processed":      CategoryConsumerDispute,
+	"product_not_received":      CategoryConsumerDispute,
+	"product_unacceptable":      CategoryConsumerDispute,
+	"subscription_canceled":     CategoryConsumerDispute,
+}
+
+// StripeAdapter reads Stripe charge.dispute.* webhook events. The merchant
+// is taken from the dispute's merchant_id metadata.
+type StripeAdapter struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewStripeAdapter creates a Stripe adapter that checks events against the
+// webhook endpoint's signing secret. Without a secret every event is
+// rejected.
+func NewStripeAdapter(secret []byte) *StripeAdapter {
+	return &StripeAdapter{secret: secret, now: time.Now}
+}
+
+// ParseNotification verifies and decodes a Stripe dispute event
+func (a *StripeAdapter) ParseNotification(header http.Header, body []byte) (*DisputeNotification, error) {
+	if err := a.verify(header.Get(StripeSignatureHeader), body); err != nil {
+		return nil, err
+	}
+
+	var event struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID                string            `json:"id"`
+				Charge            string            `json:"charge"`
+				Amount            int64             `json:"amount"`
+				Currency          string            `json:"currency"`
+				Reason            string            `json:"reason"`
+				Status            string            `json:"status"`
+				NetworkReasonCode string            `json:"network_reason_code"`
+				Metadata          map[string]string `json:"metadata"`
+				EvidenceDetails   struct {
+					DueBy int64 `json:"due_by"`
+				} `json:"evidence_details"`
+				PaymentMethodDetails struct {
+					Card struct {
+						Brand string `json:"brand"`
+					} `json:"card"`
+				} `json:"payment_method_details"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid stripe event: %w", err)
+	}
+	dispute := event.Data.Object
+
+	notification := &DisputeNotification{
+		ProviderDisputeID: dispute.ID,
+		TransactionID:     dispute.Charge,
+		MerchantID:        dispute.Metadata["merchant_id"],
+		AmountMinor:       dispute.Amount,
+		Currency:          strings.ToUpper(dispute.Currency),
+		Network:           dispute.PaymentMethodDetails.Card.Brand,
+		ReasonCode:        dispute.NetworkReasonCode,
+		Category:          stripeReasons[dispute.Reason],
+	}
+	if dispute.EvidenceDetails.DueBy > 0 {
+		dueBy := time.Unix(dispute.EvidenceDetails.DueBy, 0).UTC()
+		notification.ResponseDueBy = &dueBy
+	}
+
+	switch {
+	case event.Type == "charge.dispute.created":
+		notification.Type = NotificationOpened
+	case event.Type == "charge.dispute.closed" && dispute.Status == "won":
+		notification.Type = NotificationWon
+	case event.Type == "charge.dispute.closed" && dispute.Status == "lost":
+		notification.Type = NotificationLost
+	case event.Type == "charge.dispute.updated":
+		notification.Type = NotificationUpdated
+	default:
+		return nil, fmt.Errorf("unsupported stripe event %s with status %s", event.Type, dispute.Status)
+	}
+	return notification, nil
+}
+
+// verify checks a Stripe-Signature header of the form t=<unix>,v1=<hex>:
+// one v1 signature must be the HMAC-SHA256 of "<t>.<body>" and the
+// timestamp must be recent
+func (a *StripeAdapter) verify(signature string, body []byte) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("%w: missing timestamp or v1 signature", ErrInvalidSignature)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp", ErrInvalidSignature)
+	}
+	age := a.now().Sub(time.Unix(seconds, 0))
+	if age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+
+	signed := append([]byte(timestamp+"."), body...)
+	for _, candidate := range signatures {
+		if verifyHMAC(a.secret, signed, candidate) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// verifyHMAC reports whether signature is the hex HMAC-SHA256 of body
+// under key. Without a key nothing verifies.
+func verifyHMAC(key, body []byte, signature string) bool {
+	if len(key) == 0 || signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Dispute reason categories networks' reason codes fall into
+const (
+	CategoryFraud           = "fraud"
+	CategoryAuthorization   = "authorization"
+	CategoryProcessingError = "processing_error"
+	CategoryConsumerDispute = "consumer_dispute"
+	CategoryOther           = "other"
+)
+
+// Card networks
+const (
+	NetworkVisa       = "visa"
+	NetworkMastercard = "mastercard"
+	NetworkAmex       = "amex"
+)
+
+// ReasonInfo describes a network reason code
+type ReasonInfo struct {
+	Network     string `json:"network"`
+	Code        string `json:"code"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+}
+
+// reasonCodes lists the reason codes of each network that have their own
+// description; other codes are categorised by their prefix
+var reasonCodes = map[string]map[string]ReasonInfo{
+	NetworkVisa: {
+		"10.1": {Category: CategoryFraud, Description: "EMV liability shift counterfeit fraud"},
+		"10.2": {Category: CategoryFraud, Description: "EMV liability shift non-counterfeit fraud"},
+		"10.3": {Category: CategoryFraud, Description: "Other fraud, card-present environment"},
+		"10.4": {Category: CategoryFraud, Description: "Other fraud, card-absent environment"},
+		"10.5": {Category: CategoryFraud, Description: "Visa fraud monitoring program"},
+		"11.1": {Category: CategoryAuthorization, Description: "Card recovery bulletin"},
+		"11.2": {Category: CategoryAuthorization, Description: "Declined authorization"},
+		"11.3": {Category: CategoryAuthorization, Description: "No authorization"},
+		"12.1": {Category: CategoryProcessingError, Description: "Late presentment"},
+		"12.2": {Category: CategoryProcessingError, Description: "Incorrect transaction code"},
+		"12.3": {Category: CategoryProcessingError, Description: "Incorrect currency"},
+		"12.4": {Category: CategoryProcessingError, Description: "Incorrect account number"},
+		"12.5": {Category: CategoryProcessingError, Description: "Incorrect amount"},
+		"12.6": {Category: CategoryProcessingError, Description: "Duplicate processing or paid by other means"},
+		"12.7": {Category: CategoryProcessingError, Description: "Invalid data"},
+		"13.1": {Category: CategoryConsumerDispute, Description: "Merchandise or services not received"},
+		"13.2": {Category: CategoryConsumerDispute, Description: "Cancelled recurring transaction"},
+		"13.3": {Category: CategoryConsumerDispute, Description: "Not as described or defective merchandise"},
+		"13.4": {Category: CategoryConsumerDispute, Description: "Counterfeit merchandise"},
+		"13.5": {Category: CategoryConsumerDispute, Description: "Misrepresentation"},
+		"13.6": {Category: CategoryConsumerDispute, Description: "Credit not processed"},
+		"13.7": {Category: CategoryConsumerDispute, Description: "Cancelled merchandise or services"},
+	},
+	NetworkMastercard: {
+		"4808": {Category: CategoryAuthorization, Description: "Authorization-related chargeback"},
+		"4831": {Category: CategoryProcessingError, Description: "Transaction amount differs"},
+		"4834": {Category: CategoryProcessingError, Description: "Point-of-interaction error"},
+		"4837": {Category: CategoryFraud, Description: "No cardholder authorization"},
+		"4840": {Category: CategoryFraud, Description: "Fraudulent processing of transactions"},
+		"4841": {Category: CategoryConsumerDispute, Description: "Cancelled recurring or digital goods transaction"},
+		"4842": {Category: CategoryProcessingError, Description: "Late presentment"},
+		"4846": {Category: CategoryProcessingError, Description: "Correct transaction currency code not provided"},
+		"4849": {Category: CategoryFraud, Description: "Questionable merchant activity"},
+		"4853": {Category: CategoryConsumerDispute, Description: "Cardholder dispute"},
+		"4855": {Category: CategoryConsumerDispute, Description: "Goods or services not provided"},
+		"4859": {Category: CategoryConsumerDispute, Description: "Addendum, no-show or ATM dispute"},
+		"4860": {Category: CategoryConsumerDispute, Description: "Credit not processed"},
+		"4863": {Category: CategoryFraud, Description: "Cardholder does not recognize"},
+		"4870": {Category: CategoryFraud, Description: "Chip liability shift"},
+		"4871": {Category: CategoryFraud, Description: "Chip/PIN liability shift"},
+	},
+	NetworkAmex: {
+		"A01": {Category: CategoryAuthorization, Description: "Charge amount exceeds authorization amount"},
+		"A02": {Category: CategoryAuthorization, Description: "No valid authorization"},
+		"C02": {Category: CategoryConsumerDispute, Description: "Credit not processed"},
+		"C08": {Category: CategoryConsumerDispute, Description: "Goods or services not received"},
+		"C31": {Category: CategoryConsumerDispute, Description: "Goods or services not as described"},
+		"F24": {Category: CategoryFraud, Description: "No card member authorization"},
+		"F29": {Category: CategoryFraud, Description: "Card not present"},
+		"P05": {Category: CategoryProcessingError, Description: "Incorrect charge amount"},
+		"P08": {Category: CategoryProcessingError, Description: "Duplicate charge"},
+	},
+}
+
+// responseWindows is how long merchants have to answer a chargeback on each
+// network when the provider does not give a deadline
+var responseWindows = map[string]time.Duration{
+	NetworkVisa:       30 * 24 * time.Hour,
+	NetworkMastercard: 45 * 24 * time.Hour,
+	NetworkAmex:       20 * 24 * time.Hour,
+}
+
+// defaultResponseWindow applies to networks without their own
+const defaultResponseWindow = 20 * 24 * time.Hour
+
+// ClassifyReason maps a network reason code to its category. Unlisted
+// codes are categorised by the ranges each network groups them in.
+func ClassifyReason(network, code string) ReasonInfo {
+	network = strings.ToLower(strings.TrimSpace(network))
+	code = strings.ToUpper(strings.TrimSpace(code))
+
+	info := ReasonInfo{Network: network, Code: code, Category: CategoryOther}
+	if known, ok := reasonCodes[network][code]; ok {
+		info.Category = known.Category
+		info.Description = known.Description
+		return info
+	}
+
+	switch network {
+	case NetworkVisa:
+		switch {
+		case strings.HasPrefix(code, "10."):
+			info.Category = CategoryFraud
+		case strings.HasPrefix(code, "11."):
+			info.Category = CategoryAuthorization
+		case strings.HasPrefix(code, "12."):
+			info.Category = CategoryProcessingError
+		case strings.HasPrefix(code, "13."):
+			info.Category = CategoryConsumerDispute
+		}
+	case NetworkAmex:
+		switch {
+		case strings.HasPrefix(code, "F"):
+			info.Category = CategoryFraud
+		case strings.HasPrefix(code, "A"):
+			info.Category = CategoryAuthorization
+		case strings.HasPrefix(code, "P"):
+			info.Category = CategoryProcessingError
+		case strings.HasPrefix(code, "C"):
+			info.Category = CategoryConsumerDispute
+		}
+	}
+	return info
+}
+
+// ResponseWindow returns how long a merchant has to answer a chargeback on
+// a network
+func ResponseWindow(network string) time.Duration {
+	if window, ok := responseWindows[strings.ToLower(network)]; ok {
+		return window
+	}
+	return defaultResponseWindow
+}
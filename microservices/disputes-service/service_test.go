@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type stubLedgerPoster struct {
+	transfers []*LedgerTransfer
+	err       error
+}
+
+func (l *stubLedgerPoster) Post(ctx context.Context, transfer *LedgerTransfer) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.transfers = append(l.transfers, transfer)
+	return nil
+}
+
+type stubRiskSignaler struct {
+	signals []string
+}
+
+func (r *stubRiskSignaler) DisputeSignal(ctx context.Context, merchantID, disputeID, status string) error {
+	r.signals = append(r.signals, merchantID+":"+status)
+	return nil
+}
+
+func newTestDisputeService() (*DisputeService, *stubLedgerPoster, *stubRiskSignaler) {
+	ledger := &stubLedgerPoster{}
+	risk := &stubRiskSignaler{}
+	service := NewDisputeService()
+	service.Adapters().Register("generic", NewGenericAdapter(testSigningKey))
+	service.Adapters().Register("stripe", NewStripeAdapter(testSigningKey))
+	service.SetLedgerPoster(ledger)
+	service.SetRiskSignaler(risk)
+	return service, ledger, risk
+}
+
+var testSigningKey = []byte("whsec_test")
+
+func sign(body []byte) string {
+	mac := hmac.New(sha256.New, testSigningKey)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func stripeHeader(body []byte, at time.Time) http.Header {
+	timestamp := fmt.Sprintf("%d", at.Unix())
+	header := http.Header{}
+	header.Set(StripeSignatureHeader, fmt.Sprintf("t=%s,v1=%s", timestamp, sign(append([]byte(timestamp+"."), body...))))
+	return header
+}
+
+func openNotification(id, network, code string) *DisputeNotification {
+	return &DisputeNotification{
+		Type:              NotificationOpened,
+		Provider:          "generic",
+		ProviderDisputeID: id,
+		TransactionID:     "pay_" + id,
+		MerchantID:        "merchant_1",
+		AmountMinor:       5000,
+		Currency:          "usd",
+		Network:           network,
+		ReasonCode:        code,
+	}
+}
+
+func TestClassifyReason(t *testing.T) {
+	tests := []struct {
+		network, code, category string
+	}{
+		{"Visa", "10.4", CategoryFraud},
+		{"visa", "13.9", CategoryConsumerDispute},
+		{"mastercard", "4853", CategoryConsumerDispute},
+		{"mastercard", "4808", CategoryAuthorization},
+		{"amex", "p22", CategoryProcessingError},
+		{"discover", "UA02", CategoryOther},
+	}
+
+	for _, tt := range tests {
+		if reason := ClassifyReason(tt.network, tt.code); reason.Category != tt.category {
+			t.Errorf("Expected %s %s to be %s, got %s", tt.network, tt.code, tt.category, reason.Category)
+		}
+	}
+	if ResponseWindow("mastercard") != 45*24*time.Hour {
+		t.Errorf("Expected 45 day Mastercard window, got %v", ResponseWindow("mastercard"))
+	}
+}
+
+func TestDisputeService_ChargebackWon(t *testing.T) {
+	ctx := context.Background()
+	service, ledger, risk := newTestDisputeService()
+
+	dispute, err := service.ApplyNotification(ctx, openNotification("dp_1", "visa", "13.1"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dispute.Status != DisputeStatusNeedsResponse || dispute.Category != CategoryConsumerDispute || dispute.Currency != "USD" {
+		t.Errorf("Expected consumer dispute needing response, got %+v", dispute)
+	}
+	if due := dispute.ResponseDueBy.Sub(dispute.CreatedAt); due != 30*24*time.Hour {
+		t.Errorf("Expected 30 day Visa deadline, got %v", due)
+	}
+	if len(dispute.Postings) != 1 || ledger.transfers[0].FromAccount != "merchant_1" || ledger.transfers[0].ToAccount != ChargebacksPendingAccount {
+		t.Errorf("Expected merchant debited into pending, got %+v", dispute.Postings)
+	}
+
+	// Repeated notifications do not debit again
+	again, _ := service.ApplyNotification(ctx, openNotification("dp_1", "visa", "13.1"))
+	if again.ID != dispute.ID || len(ledger.transfers) != 1 {
+		t.Errorf("Expected the same dispute without a new posting, got %s with %d transfers", again.ID, len(ledger.transfers))
+	}
+
+	if _, err := service.SubmitRepresentment(dispute.ID, &Representment{}); err == nil {
+		t.Error("Expected error for a representment without evidence")
+	}
+	if _, err := service.SubmitRepresentment(dispute.ID, &Representment{Evidence: []Evidence{{Type: "selfie", Description: "x"}}}); err == nil {
+		t.Error("Expected error for an unknown evidence type")
+	}
+	reviewed, err := service.SubmitRepresentment(dispute.ID, &Representment{Evidence: []Evidence{
+		{Type: "delivery_proof", DocumentID: "evd_1"},
+		{Type: "customer_communication", Description: "Customer confirmed receipt"},
+	}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reviewed.Status != DisputeStatusUnderReview || len(reviewed.Representment.Evidence) != 2 {
+		t.Errorf("Expected dispute under review with 2 evidence items, got %+v", reviewed)
+	}
+
+	won, err := service.ApplyNotification(ctx, &DisputeNotification{Type: NotificationWon, Provider: "generic", ProviderDisputeID: "dp_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if won.Status != DisputeStatusWon || won.ResolvedAt == nil || len(won.Postings) != 2 {
+		t.Errorf("Expected won dispute with reversal, got %+v", won)
+	}
+	reversal := ledger.transfers[1]
+	if reversal.FromAccount != ChargebacksPendingAccount || reversal.ToAccount != "merchant_1" || reversal.AmountMinor != 5000 {
+		t.Errorf("Expected 5000 returned to merchant_1, got %+v", reversal)
+	}
+
+	if _, err := service.Accept(ctx, dispute.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected ErrInvalidTransition, got %v", err)
+	}
+	if len(risk.signals) != 2 || risk.signals[0] != "merchant_1:opened" || risk.signals[1] != "merchant_1:won" {
+		t.Errorf("Expected opened and won signals, got %v", risk.signals)
+	}
+}
+
+func TestDisputeService_LostAndExpired(t *testing.T) {
+	ctx := context.Background()
+	service, ledger, _ := newTestDisputeService()
+
+	accepted, _ := service.ApplyNotification(ctx, openNotification("dp_1", "mastercard", "4837"))
+	lost, err := service.Accept(ctx, accepted.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if lost.Status != DisputeStatusLost || lost.Postings[1].Kind != PostingFinal || ledger.transfers[1].ToAccount != ChargebacksSettledAccount {
+		t.Errorf("Expected lost dispute settled, got %+v", lost)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	n := openNotification("dp_2", "visa", "10.4")
+	n.ResponseDueBy = &past
+	overdue, _ := service.ApplyNotification(ctx, n)
+	if _, err := service.SubmitRepresentment(overdue.ID, &Representment{Evidence: []Evidence{{Type: "receipt", DocumentID: "evd_2"}}}); !errors.Is(err, ErrDeadlinePassed) {
+		t.Errorf("Expected ErrDeadlinePassed, got %v", err)
+	}
+	if expired := service.ExpireOverdue(ctx, time.Now()); expired != 1 {
+		t.Errorf("Expected 1 expired dispute, got %d", expired)
+	}
+	if found, _ := service.GetDispute(overdue.ID); found.Status != DisputeStatusLost {
+		t.Errorf("Expected expired dispute lost, got %s", found.Status)
+	}
+}
+
+func TestDisputeService_LedgerRetry(t *testing.T) {
+	ctx := context.Background()
+	service, ledger, _ := newTestDisputeService()
+
+	ledger.err = errors.New("connection refused")
+	dispute, _ := service.ApplyNotification(ctx, openNotification("dp_1", "visa", "10.4"))
+	if dispute.Postings[0].Status != PostingStatusFailed {
+		t.Fatalf("Expected failed posting, got %s", dispute.Postings[0].Status)
+	}
+
+	ledger.err = nil
+	if posted := service.RetryLedgerPostings(ctx); posted != 1 {
+		t.Errorf("Expected 1 posting retried, got %d", posted)
+	}
+	if found, _ := service.GetDispute(dispute.ID); found.Postings[0].Status != PostingStatusPosted {
+		t.Errorf("Expected posted posting, got %s", found.Postings[0].Status)
+	}
+	if posted := service.RetryLedgerPostings(ctx); posted != 0 {
+		t.Errorf("Expected nothing left to retry, got %d", posted)
+	}
+	if len(ledger.transfers) != 1 || ledger.transfers[0].ID != dispute.ID+":"+PostingChargeback {
+		t.Errorf("Expected the retry keyed by the chargeback posting, got %d transfers", len(ledger.transfers))
+	}
+}
+
+func TestDisputeService_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	restart := func() (*DisputeService, *stubLedgerPoster, *FileJournal) {
+		t.Helper()
+		journal, err := OpenFileJournal(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		service, ledger, _ := newTestDisputeService()
+		if err := service.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return service, ledger, journal
+	}
+
+	service, ledger, journal := restart()
+	opened, err := service.ApplyNotification(ctx, openNotification("dp_1", "visa", "10.4"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(ledger.transfers) != 1 {
+		t.Fatalf("Expected the chargeback posted, got %d transfers", len(ledger.transfers))
+	}
+	journal.Close()
+
+	service, ledger, journal = restart()
+	defer journal.Close()
+
+	// The provider retries the notification after the restart
+	replayed, err := service.ApplyNotification(ctx, openNotification("dp_1", "visa", "10.4"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if replayed.ID != opened.ID || len(replayed.Postings) != 1 || replayed.Postings[0].Status != PostingStatusPosted {
+		t.Errorf("Expected dispute %s with its posted chargeback, got %+v", opened.ID, replayed)
+	}
+	if len(ledger.transfers) != 0 {
+		t.Errorf("Expected no second chargeback, got %d transfers", len(ledger.transfers))
+	}
+
+	won, err := service.ApplyNotification(ctx, &DisputeNotification{Type: NotificationWon, Provider: "generic", ProviderDisputeID: "dp_1"})
+	if err != nil || won.Status != DisputeStatusWon {
+		t.Fatalf("Expected won dispute, got %+v (%v)", won, err)
+	}
+	if disputes := service.ListDisputes(DisputeFilters{}); len(disputes) != 1 {
+		t.Errorf("Expected 1 dispute, got %d", len(disputes))
+	}
+}
+
+func TestHTTPLedgerPoster_PostsOneTransfer(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transfers" {
+			t.Errorf("Expected /v1/transfers, got %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	err := NewHTTPLedgerPoster(server.URL).Post(context.Background(), &LedgerTransfer{
+		ID:            "dsp_1:chargeback",
+		TransactionID: "dsp_1",
+		FromAccount:   "merchant_1",
+		ToAccount:     ChargebacksPendingAccount,
+		AmountMinor:   2500,
+		Currency:      "USD",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(requests))
+	}
+	body := requests[0]
+	if body["transfer_id"] != "dsp_1:chargeback" || body["from_account"] != "merchant_1" || body["to_account"] != ChargebacksPendingAccount {
+		t.Errorf("Expected the chargeback transfer, got %v", body)
+	}
+	if body["from_account_type"] != AccountTypeLiability || body["to_account_type"] != AccountTypeLiability {
+		t.Errorf("Expected liability account types, got %v", body)
+	}
+	if amount, _ := body["amount"].(map[string]interface{}); amount["value"] != "25.00" || amount["currency"] != "USD" {
+		t.Errorf("Expected amount 25.00 USD, got %v", body["amount"])
+	}
+}
+
+func TestDisputeService_StripeNotifications(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestDisputeService()
+
+	created := []byte(`{"type":"charge.dispute.created","data":{"object":{"id":"dp_9","charge":"ch_9","amount":2599,"currency":"usd",
+		"reason":"product_not_received","status":"needs_response","network_reason_code":"","metadata":{"merchant_id":"merchant_2"},
+		"evidence_details":{"due_by":4102444800},"payment_method_details":{"card":{"brand":"discover"}}}}}`)
+	dispute, err := service.HandleNotification(ctx, "stripe", stripeHeader(created, time.Now()), created)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dispute.MerchantID != "merchant_2" || dispute.AmountMinor != 2599 || dispute.Category != CategoryConsumerDispute {
+		t.Errorf("Expected merchant_2 consumer dispute of 2599, got %+v", dispute)
+	}
+	if dispute.ResponseDueBy.Year() != 2100 {
+		t.Errorf("Expected Stripe's deadline, got %v", dispute.ResponseDueBy)
+	}
+
+	closed := []byte(`{"type":"charge.dispute.closed","data":{"object":{"id":"dp_9","status":"lost"}}}`)
+	if dispute, err = service.HandleNotification(ctx, "stripe", stripeHeader(closed, time.Now()), closed); err != nil || dispute.Status != DisputeStatusLost {
+		t.Errorf("Expected lost dispute, got %v and %v", dispute, err)
+	}
+	if _, err := service.HandleNotification(ctx, "unknown", http.Header{}, closed); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("Expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+func TestDisputeService_RejectsUnsignedNotifications(t *testing.T) {
+	ctx := context.Background()
+	service, ledger, _ := newTestDisputeService()
+
+	created := []byte(`{"type":"charge.dispute.created","data":{"object":{"id":"dp_9","charge":"ch_9","amount":2599,"currency":"usd",
+		"reason":"fraudulent","status":"needs_response","metadata":{"merchant_id":"merchant_2"}}}}`)
+	forged := stripeHeader([]byte(`{"type":"charge.dispute.created"}`), time.Now())
+	stale := stripeHeader(created, time.Now().Add(-time.Hour))
+	for name, header := range map[string]http.Header{"unsigned": {}, "forged": forged, "stale": stale} {
+		if _, err := service.HandleNotification(ctx, "stripe", header, created); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature for %s Stripe event, got %v", name, err)
+		}
+	}
+
+	body, _ := json.Marshal(openNotification("dp_1", "visa", "10.4"))
+	if _, err := service.HandleNotification(ctx, "generic", http.Header{}, body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for unsigned notification, got %v", err)
+	}
+	header := http.Header{}
+	header.Set(DisputeSignatureHeader, sign(body))
+	if _, err := service.HandleNotification(ctx, "generic", header, body); err != nil {
+		t.Errorf("Expected signed notification to be accepted, got %v", err)
+	}
+
+	unkeyed := NewStripeAdapter(nil)
+	if _, err := unkeyed.ParseNotification(stripeHeader(created, time.Now()), created); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected every event rejected without a secret, got %v", err)
+	}
+	if len(ledger.transfers) != 1 {
+		t.Errorf("Expected only the signed notification to post a chargeback, got %d transfers", len(ledger.transfers))
+	}
+}
+
+func TestDisputeService_Stats(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestDisputeService()
+
+	for i, outcome := range []string{DisputeStatusWon, DisputeStatusWon, DisputeStatusLost, ""} {
+		dispute, _ := service.ApplyNotification(ctx, openNotification("fraud_"+string(rune('a'+i)), "visa", "10.4"))
+		if outcome != "" {
+			service.Resolve(ctx, dispute.ID, outcome, "")
+		}
+	}
+	other, _ := service.ApplyNotification(ctx, openNotification("cd_1", "visa", "13.1"))
+	service.Resolve(ctx, other.ID, DisputeStatusLost, "")
+
+	stats := service.Stats(DisputeFilters{})
+	if stats.Overall.Total != 5 || stats.Overall.Open != 1 || stats.Overall.WinRate != 0.5 {
+		t.Errorf("Expected 5 disputes, 1 open and 50%% won, got %+v", stats.Overall)
+	}
+	if len(stats.ByReason) != 2 || stats.ByReason[0].ReasonCode != "10.4" {
+		t.Fatalf("Expected 10.4 first of 2 reason codes, got %+v", stats.ByReason)
+	}
+	if rate := stats.ByReason[0].WinRate; rate < 0.66 || rate > 0.67 {
+		t.Errorf("Expected 2 of 3 won for 10.4, got %v", rate)
+	}
+	if stats.ByCategory[CategoryConsumerDispute].Lost != 1 {
+		t.Errorf("Expected 1 lost consumer dispute, got %+v", stats.ByCategory[CategoryConsumerDispute])
+	}
+
+	if filtered := service.Stats(DisputeFilters{MerchantID: "merchant_2"}); filtered.Overall.Total != 0 {
+		t.Errorf("Expected no disputes for merchant_2, got %d", filtered.Overall.Total)
+	}
+}
@@ -34,12 +34,31 @@ func (s *Service) ReleaseEscrow(ctx context.Context, escrowID string) error {
 		return fmt.Errorf("release conditions not met: %w", err)
 	}
 
-	// Update escrow status
-	escrow.Status = "released"
-	escrow.UpdatedAt = time.Now()
 	if escrow.Metadata == nil {
 		escrow.Metadata = make(map[string]interface{})
 	}
+
+	// Releases risk-service sends to review are held until an analyst decides
+	if assessment := s.assessReleaseRisk(ctx, escrow); assessment != nil {
+		escrow.Metadata["risk_assessment_id"] = assessment.ID
+		switch assessment.Decision {
+		case "block":
+			return fmt.Errorf("%w %s", ErrReleaseBlocked, assessment.ID)
+		case "review":
+			escrow.Status = "pending_review"
+			escrow.UpdatedAt = time.Now()
+			escrow.Metadata["review_case_id"] = assessment.ReviewCaseID
+			escrow.Metadata["review_reason"] = "risk_review"
+			if err := s.repo.UpdateEscrow(ctx, escrow); err != nil {
+				return fmt.Errorf("failed to update escrow: %w", err)
+			}
+			return nil
+		}
+	}
+
+	// Update escrow status
+	escrow.Status = "released"
+	escrow.UpdatedAt = time.Now()
 	escrow.Metadata["released_at"] = time.Now()
 	escrow.Metadata["release_reason"] = "normal_completion"
 
@@ -86,6 +105,7 @@ func (s *Service) CancelEscrow(ctx context.Context, escrowID string) error {
 	if err := s.repo.UpdateEscrow(ctx, escrow); err != nil {
 		return fmt.Errorf("failed to update escrow: %w", err)
 	}
+	s.releaseEscrowLimit(ctx, escrow)
 
 	// TODO: Process refund if funded
 	// TODO: Send notifications
@@ -269,34 +289,6 @@ func (s *Service) expireEscrow(ctx context.Context, escrow *Escrow) error {
 	return s.repo.UpdateEscrow(ctx, escrow)
 }
 
-// CalculateEscrowFees calculates fees for escrow transaction
-func (s *Service) CalculateEscrowFees(amount Money) (Money, error) {
-	// Base fee: 2.5% of transaction amount
-	baseFeeRate := 0.025
-	
-	// Minimum fee: $1.00
-	minFee := FromMinorUnits(amount.Currency, 100)
-	
-	// Maximum fee: $100.00
-	maxFee := FromMinorUnits(amount.Currency, 10000)
-	
-	// Calculate fee
-	amountFloat, _ := amount.Value.Float64()
-	feeAmount := amountFloat * baseFeeRate
-	
-	fee := FromMinorUnits(amount.Currency, int64(feeAmount*100))
-	
-	// Apply min/max limits
-	if fee.Value.Cmp(minFee.Value) < 0 {
-		fee = minFee
-	}
-	if fee.Value.Cmp(maxFee.Value) > 0 {
-		fee = maxFee
-	}
-	
-	return fee, nil
-}
-
 // GetEscrowMetrics returns business metrics for escrows
 func (s *Service) GetEscrowMetrics(ctx context.Context) (*EscrowMetrics, error) {
 	// This would typically query aggregated data
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ErrFeesUnavailable is returned when fees-service cannot price an escrow
+var ErrFeesUnavailable = errors.New("fees unavailable")
+
+// FeeRequest asks fees-service to price a transaction
+type FeeRequest struct {
+	MerchantID    string `json:"merchant_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Type          string `json:"type"`
+	Currency      string `json:"currency"`
+	AmountMinor   int64  `json:"amount_minor"`
+}
+
+// FeeQuote is the fee fees-service charged and the plan it came from
+type FeeQuote struct {
+	FeeMinor    int64  `json:"fee_minor"`
+	Currency    string `json:"currency"`
+	PlanID      string `json:"plan_id"`
+	PlanVersion int    `json:"plan_version"`
+	RuleID      string `json:"rule_id"`
+}
+
+// FeeCalculator prices transactions with the merchant's pricing plan
+type FeeCalculator interface {
+	Calculate(ctx context.Context, req *FeeRequest) (*FeeQuote, error)
+}
+
+// SetFeeCalculator configures pricing with fees-service
+func (s *Service) SetFeeCalculator(fees FeeCalculator) {
+	s.fees = fees
+}
+
+// chargeEscrowFees prices an escrow with the seller's plan. An escrow is not
+// created unpriced: ErrFeesUnavailable is returned while fees-service is
+// down.
+func (s *Service) chargeEscrowFees(ctx context.Context, escrow *Escrow) error {
+	if s.fees == nil {
+		return nil
+	}
+
+	quote, err := s.fees.Calculate(ctx, &FeeRequest{
+		MerchantID:    escrow.SellerID,
+		TransactionID: escrow.ID,
+		Type:          "escrow",
+		Currency:      escrow.Amount.Currency,
+		AmountMinor:   moneyToMinorUnits(escrow.Amount),
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFeesUnavailable, err)
+	}
+	escrow.Metadata["fees"] = FromMinorUnits(escrow.Amount.Currency, quote.FeeMinor)
+	escrow.Metadata["fee_plan"] = fmt.Sprintf("%s@%d", quote.PlanID, quote.PlanVersion)
+	return nil
+}
+
+// moneyToMinorUnits converts an amount to minor units of its currency,
+// rounding half away from zero
+func moneyToMinorUnits(m Money) int64 {
+	if m.Value == nil {
+		return 0
+	}
+	scaled := new(big.Float).Mul(m.Value, new(big.Float).SetInt(currencyScale(m.Currency)))
+	if scaled.Sign() < 0 {
+		scaled.Sub(scaled, big.NewFloat(0.5))
+	} else {
+		scaled.Add(scaled, big.NewFloat(0.5))
+	}
+	minor, _ := scaled.Int64()
+	return minor
+}
+
+// HTTPFeeCalculator calls the fees-service pricing API over HTTP
+type HTTPFeeCalculator struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPFeeCalculator creates a new fees client
+func NewHTTPFeeCalculator(baseURL string) *HTTPFeeCalculator {
+	return &HTTPFeeCalculator{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Calculate prices a transaction
+func (c *HTTPFeeCalculator) Calculate(ctx context.Context, feeReq *FeeRequest) (*FeeQuote, error) {
+	var quote FeeQuote
+	if err := postJSON(ctx, c.client, c.baseURL+"/api/v1/fees/calculate", feeReq, &quote); err != nil {
+		return nil, err
+	}
+	return &quote, nil
+}
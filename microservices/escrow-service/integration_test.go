@@ -222,36 +222,6 @@ func TestEscrowMetrics(t *testing.T) {
 	}
 }
 
-// TestEscrowFeeCalculation tests fee calculation
-func TestEscrowFeeCalculation(t *testing.T) {
-	repo := NewMockRepository()
-	service := NewService(repo, nil)
-
-	testCases := []struct {
-		amount      Money
-		expectedMin float64
-		expectedMax float64
-	}{
-		{FromMinorUnits("USD", 10000), 1.0, 2.5},   // $100 -> $1-2.50 fee
-		{FromMinorUnits("USD", 100000), 25.0, 25.0}, // $1000 -> $25 fee
-		{FromMinorUnits("USD", 50), 1.0, 1.0},       // $0.50 -> $1 min fee
-	}
-
-	for _, tc := range testCases {
-		fee, err := service.CalculateEscrowFees(tc.amount)
-		if err != nil {
-			t.Errorf("Failed to calculate fee for %v: %v", tc.amount, err)
-			continue
-		}
-
-		feeFloat, _ := fee.Value.Float64()
-		if feeFloat < tc.expectedMin || feeFloat > tc.expectedMax {
-			t.Errorf("Fee %f not in expected range [%f, %f] for amount %v",
-				feeFloat, tc.expectedMin, tc.expectedMax, tc.amount)
-		}
-	}
-}
-
 // TestConcurrentEscrowOperations tests thread safety
 func TestConcurrentEscrowOperations(t *testing.T) {
 	repo := NewMockRepository()
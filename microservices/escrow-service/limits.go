@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ErrLimitExceeded is returned when an escrow does not fit the buyer's limits
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// LimitRequest asks risk-service to use limit for an action
+type LimitRequest struct {
+	EntityID    string `json:"entity_id"`
+	EntityType  string `json:"entity_type,omitempty"`
+	Tier        string `json:"tier,omitempty"`
+	Action      string `json:"action"`
+	Amount      *Money `json:"amount"`
+	ReferenceID string `json:"reference_id,omitempty"`
+}
+
+// LimitDecision is risk-service's answer to a limit request. The headroom
+// left is only recorded, so it is kept as risk-service sent it.
+type LimitDecision struct {
+	Allowed       bool            `json:"allowed"`
+	Reason        string          `json:"reason,omitempty"`
+	ReservationID string          `json:"reservation_id,omitempty"`
+	Headroom      json.RawMessage `json:"headroom,omitempty"`
+}
+
+// LimitChecker enforces dynamic limits against live usage
+type LimitChecker interface {
+	Consume(ctx context.Context, req *LimitRequest) (*LimitDecision, error)
+	Release(ctx context.Context, reservationID string) error
+}
+
+// SetLimitChecker configures dynamic escrow limits
+func (s *Service) SetLimitChecker(limits LimitChecker) {
+	s.limits = limits
+}
+
+// SetLimitChecker configures dynamic limits; without one the fixed maximums apply
+func (v *BusinessRuleValidator) SetLimitChecker(limits LimitChecker) {
+	v.limits = limits
+}
+
+// consumeEscrowLimit uses the buyer's limit for an escrow. It returns false
+// when the limits service is unavailable.
+func (v *BusinessRuleValidator) consumeEscrowLimit(ctx context.Context, escrow *Escrow) (bool, error) {
+	amount := escrow.Amount
+	req := &LimitRequest{
+		EntityID:    escrow.BuyerID,
+		EntityType:  "user",
+		Action:      "escrow",
+		Amount:      &amount,
+		ReferenceID: escrow.ID,
+	}
+	if tier, ok := escrow.Metadata["tier"].(string); ok {
+		req.Tier = tier
+	}
+
+	decision, err := v.limits.Consume(ctx, req)
+	if err != nil {
+		log.Printf("Limits unavailable for escrow %s, using fixed limits: %v", escrow.ID, err)
+		return false, nil
+	}
+
+	if escrow.Metadata == nil {
+		escrow.Metadata = make(map[string]interface{})
+	}
+	escrow.Metadata["limit_headroom"] = decision.Headroom
+	if !decision.Allowed {
+		return true, fmt.Errorf("%w: %s", ErrLimitExceeded, decision.Reason)
+	}
+	escrow.Metadata["limit_reservation_id"] = decision.ReservationID
+
+	return true, nil
+}
+
+// releaseEscrowLimit gives back the limit used by an escrow that will not
+// go ahead
+func (s *Service) releaseEscrowLimit(ctx context.Context, escrow *Escrow) {
+	reservationID, ok := escrow.Metadata["limit_reservation_id"].(string)
+	if s.limits == nil || !ok || reservationID == "" {
+		return
+	}
+
+	if err := s.limits.Release(ctx, reservationID); err != nil {
+		log.Printf("Failed to release limit reservation %s for escrow %s: %v", reservationID, escrow.ID, err)
+	}
+}
+
+// HTTPLimitChecker calls the risk-service limits API over HTTP
+type HTTPLimitChecker struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPLimitChecker creates a new limits client
+func NewHTTPLimitChecker(baseURL string) *HTTPLimitChecker {
+	return &HTTPLimitChecker{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Consume checks and uses limit for an action
+func (c *HTTPLimitChecker) Consume(ctx context.Context, limitReq *LimitRequest) (*LimitDecision, error) {
+	var decision LimitDecision
+	if err := postJSON(ctx, c.client, c.baseURL+"/v1/limits/consume", limitReq, &decision); err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+// Release gives back the usage of a reservation
+func (c *HTTPLimitChecker) Release(ctx context.Context, reservationID string) error {
+	return postJSON(ctx, c.client, c.baseURL+"/v1/limits/reservations/"+reservationID+"/release", nil, nil)
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -16,6 +19,9 @@ import (
 // Global services
 var (
 	escrowService *Service
+
+	// reviewSigningKey verifies review decisions from risk-service
+	reviewSigningKey []byte
 )
 
 func main() {
@@ -28,6 +34,27 @@ func main() {
 	// Initialize escrow service with mock repository
 	escrowService = NewService(&MockRepository{}, nil)
 
+	// Assess releases with risk-service; review decisions hold the release
+	// until risk-service reports the analyst's decision. Its dynamic limits
+	// replace the fixed maximum escrow amounts.
+	if riskServiceURL := os.Getenv("RISK_SERVICE_URL"); riskServiceURL != "" {
+		escrowService.SetRiskAssessor(NewHTTPRiskAssessor(riskServiceURL))
+		escrowService.SetLimitChecker(NewHTTPLimitChecker(riskServiceURL))
+	}
+
+	// Review decisions are only accepted when signed by risk-service
+	reviewSigningKey = []byte(os.Getenv("REVIEW_SIGNING_KEY"))
+	if len(reviewSigningKey) == 0 {
+		log.Println("REVIEW_SIGNING_KEY not set, review decisions will be rejected")
+	}
+
+	// Price escrows with the seller's plan in fees-service
+	if feesServiceURL := os.Getenv("FEES_SERVICE_URL"); feesServiceURL != "" {
+		escrowService.SetFeeCalculator(NewHTTPFeeCalculator(feesServiceURL))
+	} else {
+		log.Println("FEES_SERVICE_URL not set, escrows will be created without fees")
+	}
+
 	// Create router
 	mux := http.NewServeMux()
 
@@ -103,6 +130,15 @@ func handleEscrows(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		escrow, err := escrowService.CreateEscrow(r.Context(), &req)
+		if errors.Is(err, ErrLimitExceeded) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, ErrFeesUnavailable) {
+			log.Printf("Failed to create escrow: %v", err)
+			http.Error(w, "Fees unavailable", http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			log.Printf("Failed to create escrow: %v", err)
 			http.Error(w, "Failed to create escrow", http.StatusInternalServerError)
@@ -142,6 +178,8 @@ func handleEscrowByID(w http.ResponseWriter, r *http.Request) {
 			handleReleaseEscrow(w, r, escrowID)
 		} else if r.URL.Path[len("/v1/escrows/"):] == escrowID+"/cancel" {
 			handleCancelEscrow(w, r, escrowID)
+		} else if strings.HasSuffix(escrowID, "/review") {
+			handleReleaseReview(w, r, strings.TrimSuffix(escrowID, "/review"))
 		}
 	}
 }
@@ -205,3 +243,38 @@ func handleCancelEscrow(w http.ResponseWriter, r *http.Request, escrowID string)
 	
 	w.WriteHeader(http.StatusOK)
 }
+
+// handleReleaseReview applies a manual review decision from risk-service.
+// The decision must be signed by risk-service; a mismatched case is
+// forbidden rather than a conflict, which risk-service takes as resolved.
+func handleReleaseReview(w http.ResponseWriter, r *http.Request, escrowID string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !verifyReviewSignature(reviewSigningKey, body, r.Header.Get(ReviewSignatureHeader)) {
+		http.Error(w, "Invalid review signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReviewDecision
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	escrow, err := escrowService.ResolveReleaseReview(r.Context(), escrowID, &req)
+	if err != nil {
+		log.Printf("Failed to resolve release review: %v", err)
+		status := http.StatusConflict
+		if errors.Is(err, ErrReviewCaseMismatch) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(escrow)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrReleaseBlocked is returned when risk-service blocks an escrow release
+	ErrReleaseBlocked = errors.New("escrow release blocked by risk assessment")
+
+	// ErrReviewCaseMismatch is returned when a review decision is not for
+	// the review case an escrow release is held for
+	ErrReviewCaseMismatch = errors.New("review decision does not match the escrow's review case")
+)
+
+// ReviewSignatureHeader carries risk-service's HMAC-SHA256 of a review
+// decision, keyed with the review signing key the services share
+const ReviewSignatureHeader = "X-Review-Signature"
+
+// RiskAssessmentRequest is the assessment request sent to risk-service
+type RiskAssessmentRequest struct {
+	EntityID   string                 `json:"entity_id"`
+	EntityType string                 `json:"entity_type"`
+	Context    map[string]interface{} `json:"context"`
+	Amount     *Money                 `json:"amount,omitempty"`
+}
+
+// RiskAssessmentResult is the part of a risk-service assessment escrows rely on
+type RiskAssessmentResult struct {
+	ID           string  `json:"id"`
+	RiskScore    float64 `json:"risk_score"`
+	Decision     string  `json:"decision"` // allow, review, block
+	ReviewCaseID string  `json:"review_case_id,omitempty"`
+}
+
+// RiskAssessor assesses escrow releases before funds go to the seller
+type RiskAssessor interface {
+	Assess(ctx context.Context, req *RiskAssessmentRequest) (*RiskAssessmentResult, error)
+}
+
+// ReviewDecision is a manual review outcome reported back by risk-service
+type ReviewDecision struct {
+	ReviewCaseID string `json:"review_case_id"`
+	AssessmentID string `json:"assessment_id"`
+	Decision     string `json:"decision"` // approve, decline
+	Status       string `json:"status"`   // approved, declined, expired
+	Analyst      string `json:"analyst,omitempty"`
+}
+
+// SetRiskAssessor configures risk-service assessment of escrow releases
+func (s *Service) SetRiskAssessor(risk RiskAssessor) {
+	s.risk = risk
+}
+
+// assessReleaseRisk asks risk-service about releasing an escrow to the
+// seller. It returns nil when no assessor is configured or risk-service is
+// unavailable, in which case the release goes ahead.
+func (s *Service) assessReleaseRisk(ctx context.Context, escrow *Escrow) *RiskAssessmentResult {
+	if s.risk == nil {
+		return nil
+	}
+
+	amount := escrow.Amount
+	result, err := s.risk.Assess(ctx, &RiskAssessmentRequest{
+		EntityID:   escrow.SellerID,
+		EntityType: "merchant",
+		Context: map[string]interface{}{
+			"escrow_id": escrow.ID,
+			"action":    "release",
+			"buyer_id":  escrow.BuyerID,
+		},
+		Amount: &amount,
+	})
+	if err != nil {
+		log.Printf("Risk assessment unavailable for escrow %s release: %v", escrow.ID, err)
+		return nil
+	}
+
+	return result
+}
+
+// ResolveReleaseReview completes or stops an escrow release held for manual
+// review. A declined release moves the escrow to disputed so operations can
+// refund or cancel it.
+func (s *Service) ResolveReleaseReview(ctx context.Context, escrowID string, decision *ReviewDecision) (*Escrow, error) {
+	if decision.Decision != "approve" && decision.Decision != "decline" {
+		return nil, fmt.Errorf("invalid review decision: %s", decision.Decision)
+	}
+
+	escrow, err := s.repo.GetEscrow(ctx, escrowID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow: %w", err)
+	}
+
+	if err := ValidateEscrowAction(escrow, "review"); err != nil {
+		return nil, fmt.Errorf("review not allowed: %w", err)
+	}
+
+	caseID, _ := escrow.Metadata["review_case_id"].(string)
+	if caseID == "" || decision.ReviewCaseID != caseID {
+		return nil, fmt.Errorf("%w: review case %q", ErrReviewCaseMismatch, decision.ReviewCaseID)
+	}
+	if decision.Analyst == "" && decision.Status != "expired" {
+		return nil, fmt.Errorf("%w: no analyst decided review case %s", ErrReviewCaseMismatch, caseID)
+	}
+
+	now := time.Now()
+	escrow.Metadata["review_decision"] = decision.Decision
+	escrow.Metadata["review_status"] = decision.Status
+	escrow.Metadata["reviewed_at"] = now
+	if decision.Analyst != "" {
+		escrow.Metadata["reviewed_by"] = decision.Analyst
+	}
+
+	if decision.Decision == "approve" {
+		escrow.Status = "released"
+		escrow.Metadata["released_at"] = now
+		escrow.Metadata["release_reason"] = "risk_review_approved"
+	} else {
+		escrow.Status = "disputed"
+		escrow.Metadata["disputed_at"] = now
+		escrow.Metadata["dispute_reason"] = "risk_review_declined"
+	}
+	escrow.UpdatedAt = now
+
+	if err := s.repo.UpdateEscrow(ctx, escrow); err != nil {
+		return nil, fmt.Errorf("failed to update escrow: %w", err)
+	}
+
+	return escrow, nil
+}
+
+// verifyReviewSignature reports whether a review decision body carries
+// risk-service's signature. Without a key no decision is accepted.
+func verifyReviewSignature(key, body []byte, signature string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// HTTPRiskAssessor calls risk-service over HTTP
+type HTTPRiskAssessor struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRiskAssessor creates a new risk-service client
+func NewHTTPRiskAssessor(baseURL string) *HTTPRiskAssessor {
+	return &HTTPRiskAssessor{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Assess requests a risk assessment
+func (a *HTTPRiskAssessor) Assess(ctx context.Context, assessment *RiskAssessmentRequest) (*RiskAssessmentResult, error) {
+	var result RiskAssessmentResult
+	if err := postJSON(ctx, a.client, a.baseURL+"/v1/assess", assessment, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
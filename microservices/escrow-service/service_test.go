@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -135,6 +137,185 @@ func TestEscrowService_CancelEscrow(t *testing.T) {
 	}
 }
 
+type stubRiskAssessor struct {
+	decision string
+}
+
+func (a *stubRiskAssessor) Assess(ctx context.Context, req *RiskAssessmentRequest) (*RiskAssessmentResult, error) {
+	return &RiskAssessmentResult{ID: "risk_1", Decision: a.decision, ReviewCaseID: "review_1"}, nil
+}
+
+func TestEscrowService_ReleaseHeldForReview(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	service.SetRiskAssessor(&stubRiskAssessor{decision: "review"})
+	ctx := context.Background()
+
+	fundedEscrow := func() *Escrow {
+		escrow, err := service.CreateEscrow(ctx, &CreateEscrowRequest{
+			BuyerID:  "buyer_123",
+			SellerID: "seller_456",
+			Amount:   FromMinorUnits("USD", 10000),
+			Terms:    "Standard escrow terms for testing",
+		})
+		if err != nil {
+			t.Fatalf("Failed to create escrow: %v", err)
+		}
+		if err := service.FundEscrow(ctx, &FundEscrowRequest{EscrowID: escrow.ID, Amount: FromMinorUnits("USD", 10000)}); err != nil {
+			t.Fatalf("Failed to fund escrow: %v", err)
+		}
+		return escrow
+	}
+
+	escrow := fundedEscrow()
+	if err := service.ReleaseEscrow(ctx, escrow.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	held, _ := service.GetEscrow(ctx, escrow.ID)
+	if held.Status != "pending_review" || held.Metadata["review_case_id"] != "review_1" {
+		t.Fatalf("Expected release held for review_1, got %s", held.Status)
+	}
+	if err := service.ReleaseEscrow(ctx, escrow.ID); err == nil {
+		t.Error("Expected error releasing an escrow held for review")
+	}
+
+	if _, err := service.ResolveReleaseReview(ctx, escrow.ID, &ReviewDecision{ReviewCaseID: "", Decision: "approve", Analyst: "analyst_1"}); !errors.Is(err, ErrReviewCaseMismatch) {
+		t.Errorf("Expected ErrReviewCaseMismatch without a review case, got %v", err)
+	}
+	if _, err := service.ResolveReleaseReview(ctx, escrow.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "approve"}); !errors.Is(err, ErrReviewCaseMismatch) {
+		t.Errorf("Expected ErrReviewCaseMismatch without an analyst, got %v", err)
+	}
+
+	released, err := service.ResolveReleaseReview(ctx, escrow.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "approve", Analyst: "analyst_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if released.Status != "released" {
+		t.Errorf("Expected released after approval, got %s", released.Status)
+	}
+
+	// Declined releases move to disputed
+	escrow = fundedEscrow()
+	service.ReleaseEscrow(ctx, escrow.ID)
+	declined, err := service.ResolveReleaseReview(ctx, escrow.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "decline", Status: "expired"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if declined.Status != "disputed" {
+		t.Errorf("Expected disputed after decline, got %s", declined.Status)
+	}
+}
+
+// stubLimitChecker allows escrows up to a fixed amount each
+type stubLimitChecker struct {
+	maxMinor int64
+	released []string
+}
+
+func (c *stubLimitChecker) Consume(ctx context.Context, req *LimitRequest) (*LimitDecision, error) {
+	if moneyToMinorUnits(*req.Amount) > c.maxMinor {
+		return &LimitDecision{Allowed: false, Reason: "amount exceeds per-transaction limit"}, nil
+	}
+	return &LimitDecision{Allowed: true, ReservationID: "res_" + req.ReferenceID, Headroom: json.RawMessage(`{}`)}, nil
+}
+
+func (c *stubLimitChecker) Release(ctx context.Context, reservationID string) error {
+	c.released = append(c.released, reservationID)
+	return nil
+}
+
+func TestEscrowService_DynamicLimits(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	limits := &stubLimitChecker{maxMinor: 50000}
+	service.SetLimitChecker(limits)
+	ctx := context.Background()
+
+	create := func(minor int64) (*Escrow, error) {
+		return service.CreateEscrow(ctx, &CreateEscrowRequest{
+			BuyerID:  "buyer_123",
+			SellerID: "seller_456",
+			Amount:   FromMinorUnits("USD", minor),
+			Terms:    "Standard escrow terms for testing",
+		})
+	}
+
+	escrow, err := create(20000)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := escrow.Metadata["limit_headroom"].(json.RawMessage); !ok || escrow.Metadata["limit_reservation_id"] != "res_"+escrow.ID {
+		t.Errorf("Expected headroom and a reservation in metadata, got %v", escrow.Metadata)
+	}
+
+	if _, err := create(60000); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Expected ErrLimitExceeded, got %v", err)
+	}
+
+	// The minimum amount is still checked locally
+	if _, err := create(50); err == nil || errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Expected minimum amount error, got %v", err)
+	}
+
+	if err := service.CancelEscrow(ctx, escrow.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(limits.released) != 1 || limits.released[0] != "res_"+escrow.ID {
+		t.Errorf("Expected the cancelled escrow's reservation released, got %v", limits.released)
+	}
+}
+
+// stubFeeCalculator charges 1% with plan "custom", or fails when err is set
+type stubFeeCalculator struct {
+	requests []*FeeRequest
+	err      error
+}
+
+func (f *stubFeeCalculator) Calculate(ctx context.Context, req *FeeRequest) (*FeeQuote, error) {
+	f.requests = append(f.requests, req)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &FeeQuote{FeeMinor: req.AmountMinor / 100, Currency: req.Currency, PlanID: "custom", PlanVersion: 2}, nil
+}
+
+func TestEscrowService_Fees(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	fees := &stubFeeCalculator{}
+	service.SetFeeCalculator(fees)
+	ctx := context.Background()
+
+	create := func() (*Escrow, error) {
+		return service.CreateEscrow(ctx, &CreateEscrowRequest{
+			BuyerID:  "buyer_123",
+			SellerID: "seller_456",
+			Amount:   FromMinorUnits("USD", 20000),
+			Terms:    "Standard escrow terms for testing",
+		})
+	}
+
+	escrow, err := create()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	fee, _ := escrow.Metadata["fees"].(Money).Value.Float64()
+	if fee != 2.0 || escrow.Metadata["fee_plan"] != "custom@2" {
+		t.Errorf("Expected a 2.00 fee on plan custom@2, got %v on %v", fee, escrow.Metadata["fee_plan"])
+	}
+	req := fees.requests[0]
+	if req.MerchantID != "seller_456" || req.TransactionID != escrow.ID || req.Type != "escrow" || req.AmountMinor != 20000 {
+		t.Errorf("Expected the seller's escrow priced by reference, got %+v", req)
+	}
+	if minor := moneyToMinorUnits(FromMinorUnits("JPY", 20000)); minor != 20000 {
+		t.Errorf("Expected 20000 yen in minor units, got %d", minor)
+	}
+
+	// The escrow is not created unpriced when fees-service is unavailable
+	fees.err = errors.New("connection refused")
+	if _, err := create(); !errors.Is(err, ErrFeesUnavailable) {
+		t.Errorf("Expected ErrFeesUnavailable, got %v", err)
+	}
+}
+
 func TestMoney_FromMinorUnits(t *testing.T) {
 	tests := []struct {
 		currency    string
@@ -144,6 +325,8 @@ func TestMoney_FromMinorUnits(t *testing.T) {
 		{"USD", 10000, 100.0},
 		{"EUR", 2550, 25.5},
 		{"GBP", 199, 1.99},
+		{"JPY", 500, 500},
+		{"KWD", 1250, 1.25},
 	}
 
 	for _, test := range tests {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
 	"time"
 )
 
@@ -16,13 +17,30 @@ type Money struct {
 // FromMinorUnits creates a Money instance from minor units (e.g., cents)
 func FromMinorUnits(currency string, minorUnits int64) Money {
 	value := new(big.Float).SetInt64(minorUnits)
-	value.Quo(value, big.NewFloat(100))
+	value.Quo(value, new(big.Float).SetInt(currencyScale(currency)))
 	return Money{
 		Value:    value,
 		Currency: currency,
 	}
 }
 
+// currencyExponents lists the ISO 4217 minor unit exponents of currencies
+// whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyScale returns how many minor units make one unit of a currency
+func currencyScale(currency string) *big.Int {
+	exponent, ok := currencyExponents[strings.ToUpper(currency)]
+	if !ok {
+		exponent = 2
+	}
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+}
+
 // Escrow represents an escrow transaction
 type Escrow struct {
 	ID        string                 `json:"id"`
@@ -81,6 +99,9 @@ type Repository interface {
 type Service struct {
 	repo   Repository
 	logger interface{}
+	risk   RiskAssessor
+	limits LimitChecker
+	fees   FeeCalculator
 }
 
 // NewService creates a new escrow service
@@ -100,11 +121,7 @@ func (s *Service) CreateEscrow(ctx context.Context, req *CreateEscrowRequest) (*
 
 	// Business rule validation
 	validator := NewBusinessRuleValidator()
-	
-	// Check escrow limits
-	if err := validator.ValidateEscrowLimits(req.Amount); err != nil {
-		return nil, fmt.Errorf("business rule violation: %w", err)
-	}
+	validator.SetLimitChecker(s.limits)
 
 	// Check participant eligibility
 	if err := validator.ValidateParticipantEligibility(req.BuyerID, req.SellerID); err != nil {
@@ -134,7 +151,19 @@ func (s *Service) CreateEscrow(ctx context.Context, req *CreateEscrowRequest) (*
 		UpdatedAt: time.Now(),
 	}
 
+	// Check escrow limits once the escrow has an ID to reserve against
+	if err := validator.ValidateEscrowLimits(ctx, escrow); err != nil {
+		return nil, fmt.Errorf("business rule violation: %w", err)
+	}
+
+	// Price the escrow with the seller's plan
+	if err := s.chargeEscrowFees(ctx, escrow); err != nil {
+		s.releaseEscrowLimit(ctx, escrow)
+		return nil, fmt.Errorf("failed to calculate fees: %w", err)
+	}
+
 	if err := s.repo.CreateEscrow(ctx, escrow); err != nil {
+		s.releaseEscrowLimit(ctx, escrow)
 		return nil, fmt.Errorf("failed to create escrow: %w", err)
 	}
 
@@ -205,6 +234,13 @@ func (s *Service) ConfirmDelivery(ctx context.Context, req *ConfirmDeliveryReque
 
 	escrow.Status = "delivered"
 	escrow.UpdatedAt = time.Now()
+	if escrow.Metadata == nil {
+		escrow.Metadata = make(map[string]interface{})
+	}
+	escrow.Metadata["delivered_at"] = time.Now()
+	if req.Proof != "" {
+		escrow.Metadata["delivery_proof"] = req.Proof
+	}
 
 	if err := s.repo.UpdateEscrow(ctx, escrow); err != nil {
 		return err
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math/big"
@@ -79,14 +80,15 @@ func ValidateFundEscrowRequest(req *FundEscrowRequest) error {
 // ValidateEscrowStateTransition validates if state transition is allowed
 func ValidateEscrowStateTransition(currentStatus, newStatus string) error {
 	validTransitions := map[string][]string{
-		"pending":   {"funded", "cancelled"},
-		"funded":    {"delivered", "released", "disputed", "cancelled"},
-		"delivered": {"released", "disputed"},
-		"disputed":  {"released", "refunded", "cancelled"},
-		"released":  {}, // Terminal state
-		"refunded":  {}, // Terminal state
-		"cancelled": {}, // Terminal state
-		"expired":   {}, // Terminal state
+		"pending":        {"funded", "cancelled"},
+		"funded":         {"delivered", "released", "pending_review", "disputed", "cancelled"},
+		"delivered":      {"released", "pending_review", "disputed"},
+		"pending_review": {"released", "disputed"},
+		"disputed":       {"released", "refunded", "cancelled"},
+		"released":       {}, // Terminal state
+		"refunded":       {}, // Terminal state
+		"cancelled":      {}, // Terminal state
+		"expired":        {}, // Terminal state
 	}
 
 	allowedStates, exists := validTransitions[currentStatus]
@@ -110,14 +112,15 @@ func ValidateEscrowAction(escrow *Escrow, action string) error {
 	}
 
 	allowedActions := map[string][]string{
-		"pending":   {"fund", "cancel"},
-		"funded":    {"release", "dispute", "cancel", "deliver"},
-		"delivered": {"release", "dispute"},
-		"disputed":  {"release", "refund", "cancel"},
-		"released":  {},
-		"refunded":  {},
-		"cancelled": {},
-		"expired":   {},
+		"pending":        {"fund", "cancel"},
+		"funded":         {"release", "dispute", "cancel", "deliver"},
+		"delivered":      {"release", "dispute"},
+		"pending_review": {"review"},
+		"disputed":       {"release", "refund", "cancel"},
+		"released":       {},
+		"refunded":       {},
+		"cancelled":      {},
+		"expired":        {},
 	}
 
 	actions, exists := allowedActions[escrow.Status]
@@ -203,7 +206,8 @@ func validateTerms(terms string) error {
 // BusinessRuleValidator provides business rule validation
 type BusinessRuleValidator struct {
 	minEscrowAmount map[string]*big.Float // Currency -> minimum amount
-	maxEscrowAmount map[string]*big.Float // Currency -> maximum amount
+	maxEscrowAmount map[string]*big.Float // Currency -> fallback maximum amount
+	limits          LimitChecker
 }
 
 // NewBusinessRuleValidator creates a new validator with default rules
@@ -223,7 +227,8 @@ func NewBusinessRuleValidator() *BusinessRuleValidator {
 }
 
 // ValidateEscrowLimits validates escrow amount against business limits
-func (v *BusinessRuleValidator) ValidateEscrowLimits(amount Money) error {
+func (v *BusinessRuleValidator) ValidateEscrowLimits(ctx context.Context, escrow *Escrow) error {
+	amount := escrow.Amount
 	currency := amount.Currency
 	
 	// Check minimum amount
@@ -233,6 +238,13 @@ func (v *BusinessRuleValidator) ValidateEscrowLimits(amount Money) error {
 		}
 	}
 
+	// Dynamic limits scoped to the buyer's tier and risk level
+	if v.limits != nil {
+		if checked, err := v.consumeEscrowLimit(ctx, escrow); checked {
+			return err
+		}
+	}
+
 	// Check maximum amount
 	if maxAmount, exists := v.maxEscrowAmount[currency]; exists {
 		if amount.Value.Cmp(maxAmount) > 0 {
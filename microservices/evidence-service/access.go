@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Case types evidence is linked to
+const (
+	CaseTypeEscrow  = "escrow"
+	CaseTypeDispute = "dispute"
+	CaseTypeKYC     = "kyc"
+)
+
+// staffRoles may see evidence of any case
+var staffRoles = map[string]bool{
+	"admin":      true,
+	"support":    true,
+	"compliance": true,
+}
+
+var (
+	// ErrCaseNotFound is returned for cases the owning service does not know
+	ErrCaseNotFound = errors.New("case not found")
+	// ErrAccessDenied is returned when the caller is not a party to the case
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// Actor is who is calling, as set by the API gateway from the caller's
+// token
+type Actor struct {
+	UserID string
+	Role   string
+}
+
+// IsStaff reports whether the actor may see every case
+func (a Actor) IsStaff() bool {
+	return staffRoles[a.Role]
+}
+
+// CaseResolver returns the parties of a case
+type CaseResolver interface {
+	Parties(ctx context.Context, caseType, caseID string) ([]string, error)
+}
+
+// CaseRecords fetches the escrows and disputes evidence bundles describe
+type CaseRecords interface {
+	Escrow(ctx context.Context, escrowID string) (*EscrowRecord, error)
+	Dispute(ctx context.Context, disputeID string) (*DisputeRecord, error)
+}
+
+// HTTPCaseResolver looks up escrow parties in escrow-service and dispute
+// merchants in disputes-service. A KYC case is identified by its subject,
+// who is its only party.
+type HTTPCaseResolver struct {
+	escrowURL   string
+	disputesURL string
+	client      *http.Client
+}
+
+// NewHTTPCaseResolver creates a resolver over escrow-service and
+// disputes-service
+func NewHTTPCaseResolver(escrowURL, disputesURL string) *HTTPCaseResolver {
+	return &HTTPCaseResolver{
+		escrowURL:   escrowURL,
+		disputesURL: disputesURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Parties returns the user IDs that take part in a case
+func (c *HTTPCaseResolver) Parties(ctx context.Context, caseType, caseID string) ([]string, error) {
+	switch caseType {
+	case CaseTypeEscrow:
+		var escrow struct {
+			BuyerID  string `json:"buyer_id"`
+			SellerID string `json:"seller_id"`
+		}
+		if err := c.get(ctx, c.escrowURL+"/v1/escrows/"+caseID, &escrow); err != nil {
+			return nil, err
+		}
+		return []string{escrow.BuyerID, escrow.SellerID}, nil
+
+	case CaseTypeDispute:
+		var dispute struct {
+			MerchantID string `json:"merchant_id"`
+		}
+		if err := c.get(ctx, c.disputesURL+"/v1/disputes/"+caseID, &dispute); err != nil {
+			return nil, err
+		}
+		return []string{dispute.MerchantID}, nil
+
+	case CaseTypeKYC:
+		return []string{caseID}, nil
+
+	default:
+		return nil, fmt.Errorf("invalid case type: %s", caseType)
+	}
+}
+
+// Escrow fetches an escrow from escrow-service
+func (c *HTTPCaseResolver) Escrow(ctx context.Context, escrowID string) (*EscrowRecord, error) {
+	var escrow EscrowRecord
+	if err := c.get(ctx, c.escrowURL+"/v1/escrows/"+escrowID, &escrow); err != nil {
+		return nil, err
+	}
+	return &escrow, nil
+}
+
+// Dispute fetches a dispute from disputes-service
+func (c *HTTPCaseResolver) Dispute(ctx context.Context, disputeID string) (*DisputeRecord, error) {
+	var dispute DisputeRecord
+	if err := c.get(ctx, c.disputesURL+"/v1/disputes/"+disputeID, &dispute); err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// get fetches a case and decodes it into out
+func (c *HTTPCaseResolver) get(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrCaseNotFound, url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode case: %w", err)
+	}
+	return nil
+}
+
+// checkAccess allows staff and the parties of a case
+func checkAccess(ctx context.Context, cases CaseResolver, actor Actor, caseType, caseID string) error {
+	if actor.IsStaff() {
+		return nil
+	}
+	if actor.UserID == "" {
+		return fmt.Errorf("%w: caller is not identified", ErrAccessDenied)
+	}
+
+	parties, err := cases.Parties(ctx, caseType, caseID)
+	if err != nil {
+		return err
+	}
+	for _, party := range parties {
+		if party != "" && party == actor.UserID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not a party to %s %s", ErrAccessDenied, actor.UserID, caseType, caseID)
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bundle item kinds
+const (
+	BundleItemDispute  = "dispute"
+	BundleItemOrder    = "order"
+	BundleItemTerms    = "terms"
+	BundleItemDelivery = "delivery"
+	BundleItemFile     = "file"
+)
+
+const (
+	// bundleHeaderLines are the page header and the blank line below it
+	bundleHeaderLines = 2
+	// maxPreviewLines bounds how much of a text file is printed; the
+	// original is attached in full
+	maxPreviewLines = 500
+)
+
+var (
+	// ErrBundleNotFound is returned for unknown evidence bundles
+	ErrBundleNotFound = errors.New("evidence bundle not found")
+	// ErrHashMismatch is returned when stored contents no longer match the
+	// hash taken at upload
+	ErrHashMismatch = errors.New("evidence contents do not match their hash")
+)
+
+// bundleEvidenceOrder is the order uploaded files appear in a bundle,
+// strongest representment evidence first
+var bundleEvidenceOrder = []string{
+	"delivery_proof", "customer_communication", "terms_acceptance", "receipt",
+	"authorization_proof", "refund_policy", "photo", "other",
+}
+
+// timelineLabels describe the escrow metadata timestamps escrow-service
+// records
+var timelineLabels = map[string]string{
+	"funded_at":    "escrow funded",
+	"delivered_at": "delivery confirmed",
+	"released_at":  "funds released to seller",
+	"cancelled_at": "escrow cancelled",
+	"disputed_at":  "escrow disputed",
+	"expired_at":   "escrow expired",
+}
+
+// EscrowRecord is an escrow as escrow-service returns it
+type EscrowRecord struct {
+	ID       string `json:"id"`
+	BuyerID  string `json:"buyer_id"`
+	SellerID string `json:"seller_id"`
+	Amount   struct {
+		Value interface{} `json:"value"`
+	} `json:"amount"`
+	Currency  string                 `json:"currency"`
+	Status    string                 `json:"status"`
+	Terms     string                 `json:"terms"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// DisputeRecord is a dispute as disputes-service returns it
+type DisputeRecord struct {
+	ID                string    `json:"id"`
+	Provider          string    `json:"provider"`
+	TransactionID     string    `json:"transaction_id"`
+	MerchantID        string    `json:"merchant_id"`
+	AmountMinor       int64     `json:"amount_minor"`
+	Currency          string    `json:"currency"`
+	Network           string    `json:"network"`
+	ReasonCode        string    `json:"reason_code"`
+	Category          string    `json:"category"`
+	ReasonDescription string    `json:"reason_description"`
+	Status            string    `json:"status"`
+	ResponseDueBy     time.Time `json:"response_due_by"`
+	Representment     *struct {
+		Evidence []struct {
+			Type        string `json:"type"`
+			Description string `json:"description"`
+			DocumentID  string `json:"document_id"`
+			URL         string `json:"url"`
+		} `json:"evidence"`
+		Note        string    `json:"note"`
+		SubmittedAt time.Time `json:"submitted_at"`
+	} `json:"representment"`
+	Events []struct {
+		Status string    `json:"status"`
+		Note   string    `json:"note"`
+		At     time.Time `json:"at"`
+	} `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BundleRequest asks for the evidence bundle of a dispute, optionally
+// with the escrow the disputed payment funded
+type BundleRequest struct {
+	DisputeID string `json:"dispute_id"`
+	EscrowID  string `json:"escrow_id,omitempty"`
+}
+
+// BundleItem is one entry of a bundle's index
+type BundleItem struct {
+	Number      int    `json:"number"`
+	Kind        string `json:"kind"`
+	Title       string `json:"title"`
+	FileID      string `json:"file_id,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	SizeBytes   int64  `json:"size_bytes,omitempty"`
+	SHA256      string `json:"sha256"`
+	Page        int    `json:"page"`
+	Note        string `json:"note,omitempty"`
+}
+
+// Bundle is a generated representment document for a dispute
+type Bundle struct {
+	ID          string       `json:"id"`
+	DisputeID   string       `json:"dispute_id"`
+	EscrowID    string       `json:"escrow_id,omitempty"`
+	Items       []BundleItem `json:"items"`
+	Pages       int          `json:"pages"`
+	SizeBytes   int64        `json:"size_bytes"`
+	SHA256      string       `json:"sha256"`
+	StorageKey  string       `json:"-"`
+	GeneratedBy string       `json:"generated_by"`
+	GeneratedAt time.Time    `json:"generated_at"`
+}
+
+// bundleSection is an item's pages before the bundle is paginated
+type bundleSection struct {
+	item       BundleItem
+	lines      []string
+	image      *pdfImage
+	attachment *pdfAttachment
+}
+
+// SetCaseRecords sets where escrows and disputes are fetched from for
+// evidence bundles
+func (s *EvidenceService) SetCaseRecords(records CaseRecords) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+}
+
+// BuildBundle assembles the dispute, the escrow's order details, timeline,
+// terms and delivery proofs, and every uploaded file of the cases into one
+// paginated PDF with an index of the items and their hashes
+func (s *EvidenceService) BuildBundle(ctx context.Context, actor Actor, req *BundleRequest) (*Bundle, error) {
+	s.mu.RLock()
+	records := s.records
+	s.mu.RUnlock()
+	if records == nil {
+		return nil, errors.New("case records are not configured")
+	}
+	if req.DisputeID == "" {
+		return nil, errors.New("dispute_id is required")
+	}
+
+	if err := checkAccess(ctx, s.cases, actor, CaseTypeDispute, req.DisputeID); err != nil {
+		return nil, err
+	}
+	dispute, err := records.Dispute(ctx, req.DisputeID)
+	if err != nil {
+		return nil, err
+	}
+	var escrow *EscrowRecord
+	if req.EscrowID != "" {
+		if err := checkAccess(ctx, s.cases, actor, CaseTypeEscrow, req.EscrowID); err != nil {
+			return nil, err
+		}
+		if escrow, err = records.Escrow(ctx, req.EscrowID); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := s.bundleFiles(ctx, actor, dispute, escrow)
+	if err != nil {
+		return nil, err
+	}
+
+	sections := []*bundleSection{disputeSection(dispute)}
+	if escrow != nil {
+		sections = append(sections, orderSection(escrow, dispute))
+		if escrow.Terms != "" {
+			sections = append(sections, termsSection(escrow))
+		}
+	}
+	var deliveryFiles []*EvidenceFile
+	for _, file := range files {
+		if file.EvidenceType == "delivery_proof" {
+			deliveryFiles = append(deliveryFiles, file)
+		}
+	}
+	// The delivery proofs are numbered right after the delivery section
+	if delivery := deliverySection(escrow, deliveryFiles, len(sections)+2); delivery != nil {
+		sections = append(sections, delivery)
+	}
+	for _, file := range files {
+		section, err := s.fileSection(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section)
+	}
+
+	bundle := &Bundle{
+		ID:          generateID("bnd"),
+		DisputeID:   dispute.ID,
+		GeneratedBy: actor.UserID,
+		GeneratedAt: time.Now(),
+	}
+	if escrow != nil {
+		bundle.EscrowID = escrow.ID
+	}
+	pdf, pages := paginateBundle(bundle, sections)
+	sum := sha256.Sum256(pdf)
+	bundle.Pages = pages
+	bundle.SizeBytes = int64(len(pdf))
+	bundle.SHA256 = hex.EncodeToString(sum[:])
+	bundle.StorageKey = "bundles/" + bundle.DisputeID + "/" + bundle.ID
+	for _, section := range sections {
+		bundle.Items = append(bundle.Items, section.item)
+	}
+
+	if err := s.store.Put(ctx, bundle.StorageKey, bytes.NewReader(pdf)); err != nil {
+		return nil, err
+	}
+
+	var events []AuditEvent
+	for _, file := range files {
+		events = append(events, auditEvent(file.ID, AuditBundled, actor, bundle.ID))
+	}
+	s.mu.Lock()
+	err = s.commitLocked(&JournalEntry{Kind: JournalBundle, Bundle: bundle, StorageKey: bundle.StorageKey, Audit: events})
+	s.mu.Unlock()
+	if err != nil {
+		s.store.Delete(ctx, bundle.StorageKey)
+		return nil, fmt.Errorf("failed to record bundle: %w", err)
+	}
+
+	found := *bundle
+	return &found, nil
+}
+
+// GetBundle returns a bundle's record if the actor may see its dispute
+func (s *EvidenceService) GetBundle(ctx context.Context, actor Actor, bundleID string) (*Bundle, error) {
+	s.mu.RLock()
+	bundle, ok := s.bundles[bundleID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBundleNotFound, bundleID)
+	}
+	if err := checkAccess(ctx, s.cases, actor, CaseTypeDispute, bundle.DisputeID); err != nil {
+		return nil, err
+	}
+	found := *bundle
+	return &found, nil
+}
+
+// DownloadBundle opens a bundle's PDF for the actor
+func (s *EvidenceService) DownloadBundle(ctx context.Context, actor Actor, bundleID string) (*Bundle, io.ReadCloser, error) {
+	bundle, err := s.GetBundle(ctx, actor, bundleID)
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := s.store.Get(ctx, bundle.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundle, contents, nil
+}
+
+// ListBundles returns the bundles of a dispute, oldest first
+func (s *EvidenceService) ListBundles(ctx context.Context, actor Actor, disputeID string) ([]*Bundle, error) {
+	if err := checkAccess(ctx, s.cases, actor, CaseTypeDispute, disputeID); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bundles := []*Bundle{}
+	for _, id := range s.bundleOrder {
+		if bundle := s.bundles[id]; bundle.DisputeID == disputeID {
+			found := *bundle
+			bundles = append(bundles, &found)
+		}
+	}
+	return bundles, nil
+}
+
+// bundleFiles returns the files of the dispute and escrow cases and the
+// documents the representment cites, strongest evidence first
+func (s *EvidenceService) bundleFiles(ctx context.Context, actor Actor, dispute *DisputeRecord, escrow *EscrowRecord) ([]*EvidenceFile, error) {
+	cited := make(map[string]bool)
+	if dispute.Representment != nil {
+		for _, evidence := range dispute.Representment.Evidence {
+			if evidence.DocumentID != "" {
+				cited[evidence.DocumentID] = true
+			}
+		}
+	}
+
+	s.mu.RLock()
+	var files []*EvidenceFile
+	for _, id := range s.order {
+		file := s.files[id]
+		ofCase := (file.CaseType == CaseTypeDispute && file.CaseID == dispute.ID) ||
+			(escrow != nil && file.CaseType == CaseTypeEscrow && file.CaseID == escrow.ID)
+		if ofCase || cited[file.ID] {
+			found := *file
+			files = append(files, &found)
+		}
+		delete(cited, id)
+	}
+	s.mu.RUnlock()
+
+	for id := range cited {
+		return nil, fmt.Errorf("%w: representment cites %s", ErrFileNotFound, id)
+	}
+	for _, file := range files {
+		if err := checkAccess(ctx, s.cases, actor, file.CaseType, file.CaseID); err != nil {
+			return nil, err
+		}
+	}
+
+	rank := make(map[string]int, len(bundleEvidenceOrder))
+	for i, evidenceType := range bundleEvidenceOrder {
+		rank[evidenceType] = i + 1
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return rank[files[i].EvidenceType] < rank[files[j].EvidenceType]
+	})
+	return files, nil
+}
+
+// disputeSection describes the chargeback being answered
+func disputeSection(dispute *DisputeRecord) *bundleSection {
+	reason := dispute.ReasonCode
+	if dispute.ReasonDescription != "" {
+		reason += " - " + dispute.ReasonDescription
+	}
+	lines := []string{
+		field("Dispute", dispute.ID),
+		field("Transaction", dispute.TransactionID),
+		field("Merchant", dispute.MerchantID),
+		field("Amount", formatMinorUnits(dispute.AmountMinor)+" "+dispute.Currency),
+		field("Network", dispute.Network),
+		field("Reason", reason),
+		field("Category", dispute.Category),
+		field("Status", dispute.Status),
+		field("Opened", formatTime(dispute.CreatedAt)),
+		field("Response due by", formatTime(dispute.ResponseDueBy)),
+	}
+	if dispute.Representment != nil && dispute.Representment.Note != "" {
+		lines = append(lines, "", "Representment note:")
+		lines = append(lines, wrapText(dispute.Representment.Note, pdfLineWidth)...)
+	}
+	return generatedSection(BundleItemDispute, "Dispute "+dispute.ID, lines)
+}
+
+// orderSection gives the escrow's order details and a timeline of the
+// escrow and the dispute
+func orderSection(escrow *EscrowRecord, dispute *DisputeRecord) *bundleSection {
+	lines := []string{
+		field("Escrow", escrow.ID),
+		field("Buyer", escrow.BuyerID),
+		field("Seller", escrow.SellerID),
+		field("Amount", fmt.Sprint(escrow.Amount.Value)+" "+escrow.Currency),
+		field("Status", escrow.Status),
+		"",
+		"Timeline",
+	}
+
+	type event struct {
+		at    time.Time
+		label string
+	}
+	events := []event{{escrow.CreatedAt, "escrow created"}}
+	keys := make([]string, 0, len(escrow.Metadata))
+	for key := range escrow.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := escrow.Metadata[key].(string)
+		if !ok || !strings.HasSuffix(key, "_at") {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			continue
+		}
+		label, ok := timelineLabels[key]
+		if !ok {
+			label = strings.ReplaceAll(strings.TrimSuffix(key, "_at"), "_", " ")
+		}
+		events = append(events, event{at, label})
+	}
+	for _, e := range dispute.Events {
+		label := "dispute " + strings.ReplaceAll(e.Status, "_", " ")
+		if e.Note != "" {
+			label += ": " + e.Note
+		}
+		events = append(events, event{e.At, label})
+	}
+	if dispute.Representment != nil {
+		events = append(events, event{dispute.Representment.SubmittedAt, "representment submitted"})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at.Before(events[j].at) })
+
+	for _, e := range events {
+		for i, line := range wrapText(e.label, pdfLineWidth-26) {
+			prefix := strings.Repeat(" ", 26)
+			if i == 0 {
+				prefix = fmt.Sprintf("%-26s", formatTime(e.at))
+			}
+			lines = append(lines, prefix+line)
+		}
+	}
+	return generatedSection(BundleItemOrder, "Order details and escrow timeline", lines)
+}
+
+// termsSection prints the terms the escrow was agreed under. Its hash is
+// of the terms text so it can be checked against the escrow's.
+func termsSection(escrow *EscrowRecord) *bundleSection {
+	sum := sha256.Sum256([]byte(escrow.Terms))
+	hash := hex.EncodeToString(sum[:])
+	version, _ := escrow.Metadata["terms_version"].(string)
+	if version == "" {
+		version = "sha256:" + hash[:12]
+	}
+
+	lines := []string{field("Version", version), ""}
+	lines = append(lines, wrapText(escrow.Terms, pdfLineWidth)...)
+	return &bundleSection{
+		item: BundleItem{
+			Kind:   BundleItemTerms,
+			Title:  "Terms, version " + version,
+			SHA256: hash,
+			Note:   "hash of the terms text",
+		},
+		lines: lines,
+	}
+}
+
+// deliverySection summarises the delivery confirmation and the uploaded
+// delivery proofs, which follow as their own items from firstFile
+func deliverySection(escrow *EscrowRecord, files []*EvidenceFile, firstFile int) *bundleSection {
+	var lines []string
+	if escrow != nil {
+		if at, ok := escrow.Metadata["delivered_at"].(string); ok {
+			if delivered, err := time.Parse(time.RFC3339Nano, at); err == nil {
+				lines = append(lines, field("Delivery confirmed", formatTime(delivered)))
+			}
+		}
+		if proof, ok := escrow.Metadata["delivery_proof"].(string); ok && proof != "" {
+			lines = append(lines, "Proof given on confirmation:")
+			lines = append(lines, wrapText(proof, pdfLineWidth)...)
+		}
+	}
+	if len(files) > 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "Uploaded delivery proofs:")
+		for i, file := range files {
+			lines = append(lines, fmt.Sprintf("  Item %d: %s", firstFile+i, file.FileName), "    SHA-256 "+file.SHA256)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return generatedSection(BundleItemDelivery, "Delivery proofs", lines)
+}
+
+// fileSection describes an uploaded file, previews text and images and
+// attaches the original. Contents are checked against the upload hash.
+func (s *EvidenceService) fileSection(ctx context.Context, file *EvidenceFile) (*bundleSection, error) {
+	title := file.FileName
+	if title == "" {
+		title = file.ID
+	}
+	section := &bundleSection{
+		item: BundleItem{
+			Kind:        BundleItemFile,
+			Title:       title,
+			FileID:      file.ID,
+			ContentType: file.ContentType,
+			SizeBytes:   file.SizeBytes,
+			SHA256:      file.SHA256,
+		},
+		lines: []string{
+			field("File", file.ID),
+			field("Case", file.CaseType+" "+file.CaseID),
+			field("Evidence type", file.EvidenceType),
+			field("Content type", file.ContentType),
+			field("Size", fmt.Sprintf("%d bytes", file.SizeBytes)),
+			field("Uploaded", formatTime(file.UploadedAt)+" by "+file.UploadedBy),
+		},
+	}
+	if file.Description != "" {
+		section.lines = append(section.lines, "", "Description:")
+		section.lines = append(section.lines, wrapText(file.Description, pdfLineWidth)...)
+	}
+
+	if file.Status == FileStatusExpired {
+		section.item.Note = "contents deleted when retention ended; hash taken at upload"
+		section.lines = append(section.lines, "", "The contents were deleted when the file's retention ended.")
+		return section, nil
+	}
+
+	contents, err := s.store.Get(ctx, file.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(contents)
+	contents.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file.ID, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != file.SHA256 {
+		return nil, fmt.Errorf("%w: %s", ErrHashMismatch, file.ID)
+	}
+	section.attachment = &pdfAttachment{contentType: file.ContentType, data: data}
+
+	switch {
+	case file.ContentType == "text/plain":
+		text := wrapText(string(data), pdfLineWidth)
+		section.lines = append(section.lines, "", "Contents:")
+		if len(text) > maxPreviewLines {
+			text = append(text[:maxPreviewLines], fmt.Sprintf("[%d more lines in the attached original]", len(text)-maxPreviewLines))
+		}
+		section.lines = append(section.lines, text...)
+
+	case strings.HasPrefix(file.ContentType, "image/"):
+		preview, err := pdfImageFrom(file.ContentType, data)
+		if err != nil {
+			section.item.Note = "not previewed; see the attached original"
+		} else {
+			section.image = preview
+		}
+
+	default:
+		section.item.Note = "not previewed; see the attached original"
+	}
+	return section, nil
+}
+
+// generatedSection is a section written by the bundle itself. Its hash is
+// of its lines joined by newlines.
+func generatedSection(kind, title string, lines []string) *bundleSection {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return &bundleSection{
+		item:  BundleItem{Kind: kind, Title: title, SHA256: hex.EncodeToString(sum[:])},
+		lines: lines,
+	}
+}
+
+// paginateBundle numbers the sections, lays them out after the index with
+// each starting on a new page and renders the PDF
+func paginateBundle(bundle *Bundle, sections []*bundleSection) ([]byte, int) {
+	perPage := pdfLinesPerPage - bundleHeaderLines
+
+	split := func(lines []string) [][]string {
+		var pages [][]string
+		for len(lines) > perPage {
+			pages = append(pages, lines[:perPage])
+			lines = lines[perPage:]
+		}
+		return append(pages, lines)
+	}
+
+	// Number the items and attachments, then lay out the sections to
+	// learn where each starts
+	var body []pdfPage
+	var attachments []pdfAttachment
+	for i, section := range sections {
+		section.item.Number = i + 1
+		section.item.Page = len(body) + 1
+
+		lines := append([]string{
+			fmt.Sprintf("%d. %s", section.item.Number, section.item.Title),
+			"SHA-256 " + section.item.SHA256,
+		}, "")
+		if section.item.Note != "" {
+			lines = append(lines[:2], "Note: "+section.item.Note, "")
+		}
+		if section.attachment != nil {
+			section.attachment.name = fmt.Sprintf("%03d-%s", section.item.Number, attachmentName(section.item.Title))
+			attachments = append(attachments, *section.attachment)
+			lines = append(lines, field("Attached as", section.attachment.name))
+		}
+		for _, page := range split(append(lines, section.lines...)) {
+			body = append(body, pdfPage{lines: page})
+		}
+		if section.image != nil {
+			body = append(body, pdfPage{
+				lines: []string{fmt.Sprintf("%d. %s (preview)", section.item.Number, section.item.Title), ""},
+				image: section.image,
+			})
+		}
+	}
+
+	index := func() []string {
+		lines := []string{
+			"EVIDENCE BUNDLE " + bundle.ID,
+			"",
+			field("Dispute", bundle.DisputeID),
+		}
+		if bundle.EscrowID != "" {
+			lines = append(lines, field("Escrow", bundle.EscrowID))
+		}
+		lines = append(lines,
+			field("Generated", formatTime(bundle.GeneratedAt)),
+			field("Items", fmt.Sprint(len(sections))),
+			"",
+			"Generated items are hashed over their printed lines joined by newlines, terms over",
+			"their text and uploaded files over their original contents, which are attached.",
+			"",
+			fmt.Sprintf("%-4s %-6s %s", "No.", "Page", "Item"),
+			strings.Repeat("-", pdfLineWidth),
+		)
+		for _, section := range sections {
+			lines = append(lines,
+				fmt.Sprintf("%-4d %-6d %.84s", section.item.Number, section.item.Page, section.item.Title),
+				fmt.Sprintf("%11s SHA-256 %s", "", section.item.SHA256),
+			)
+		}
+		return lines
+	}
+	// The index's length does not depend on the page numbers it lists
+	indexPages := len(split(index()))
+	for _, section := range sections {
+		section.item.Page += indexPages
+	}
+
+	var pages []pdfPage
+	for _, page := range split(index()) {
+		pages = append(pages, pdfPage{lines: page})
+	}
+	pages = append(pages, body...)
+
+	for i := range pages {
+		header := fmt.Sprintf("Evidence bundle %s, dispute %s", bundle.ID, bundle.DisputeID)
+		pageNumber := fmt.Sprintf("Page %d of %d", i+1, len(pages))
+		header = fmt.Sprintf("%-*.*s%s", pdfLineWidth-len(pageNumber), pdfLineWidth-len(pageNumber)-1, header, pageNumber)
+		pages[i].lines = append([]string{header, ""}, pages[i].lines...)
+	}
+
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].name < attachments[j].name })
+	return renderPDF(pages, attachments), len(pages)
+}
+
+// attachmentName makes a file name safe to embed
+func attachmentName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// field formats a labelled line
+func field(label, value string) string {
+	return fmt.Sprintf("%-20s %s", label+":", value)
+}
+
+// formatTime prints a time in UTC, or "-" for none
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04:05 UTC")
+}
+
+// formatMinorUnits formats minor units as a decimal amount, e.g. 1050 as
+// 10.50
+func formatMinorUnits(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Evidence file statuses. Expired files keep their record and hash but
+// their contents are deleted.
+const (
+	FileStatusActive  = "active"
+	FileStatusExpired = "expired"
+)
+
+// Audit actions
+const (
+	AuditUpload   = "upload"
+	AuditDownload = "download"
+	AuditDenied   = "denied"
+	AuditExpired  = "expired"
+	AuditBundled  = "bundled"
+)
+
+// allowedTypes are the content types evidence may have, detected from the
+// file's first bytes, with the largest size allowed for each
+var allowedTypes = map[string]int64{
+	"application/pdf": 20 << 20,
+	"image/png":       10 << 20,
+	"image/jpeg":      10 << 20,
+	"image/gif":       10 << 20,
+	"image/webp":      10 << 20,
+	"text/plain":      1 << 20,
+}
+
+// evidenceTypes are the kinds of evidence each case type takes
+var evidenceTypes = map[string][]string{
+	CaseTypeEscrow:  {"receipt", "delivery_proof", "customer_communication", "terms_acceptance", "photo", "other"},
+	CaseTypeDispute: {"receipt", "delivery_proof", "customer_communication", "terms_acceptance", "refund_policy", "authorization_proof", "other"},
+	CaseTypeKYC:     {"identity_document", "proof_of_address", "business_registration", "selfie", "other"},
+}
+
+// defaultRetention is how long evidence is kept by case type when no
+// policy for its evidence type is set
+var defaultRetention = map[string]time.Duration{
+	CaseTypeEscrow:  7 * 365 * 24 * time.Hour,
+	CaseTypeDispute: 2 * 365 * 24 * time.Hour,
+	CaseTypeKYC:     5 * 365 * 24 * time.Hour,
+}
+
+var (
+	// ErrFileNotFound is returned for unknown evidence files
+	ErrFileNotFound = errors.New("evidence file not found")
+	// ErrFileExpired is returned when an expired file's contents are asked
+	// for
+	ErrFileExpired = errors.New("evidence file has expired")
+	// ErrInvalidFile is returned for uploads that fail validation
+	ErrInvalidFile = errors.New("invalid evidence file")
+)
+
+// EvidenceFile is an uploaded file linked to a case
+type EvidenceFile struct {
+	ID           string    `json:"id"`
+	CaseType     string    `json:"case_type"`
+	CaseID       string    `json:"case_id"`
+	EvidenceType string    `json:"evidence_type"`
+	FileName     string    `json:"file_name"`
+	Description  string    `json:"description,omitempty"`
+	ContentType  string    `json:"content_type"`
+	SizeBytes    int64     `json:"size_bytes"`
+	SHA256       string    `json:"sha256"`
+	StorageKey   string    `json:"-"`
+	Status       string    `json:"status"`
+	UploadedBy   string    `json:"uploaded_by"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+	RetainUntil  time.Time `json:"retain_until"`
+}
+
+// UploadRequest describes a file being uploaded
+type UploadRequest struct {
+	CaseType     string
+	CaseID       string
+	EvidenceType string
+	FileName     string
+	Description  string
+	ContentType  string // as declared by the client
+}
+
+// AuditEvent records an access to an evidence file
+type AuditEvent struct {
+	FileID  string    `json:"file_id"`
+	Action  string    `json:"action"`
+	ActorID string    `json:"actor_id,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// RetentionPolicy is how long evidence of a case type is kept. Without an
+// evidence type it applies to the case type's other evidence.
+type RetentionPolicy struct {
+	CaseType      string `json:"case_type"`
+	EvidenceType  string `json:"evidence_type,omitempty"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// EvidenceService stores evidence files, controls who sees them and
+// deletes them once their retention ends
+type EvidenceService struct {
+	mu        sync.RWMutex
+	files     map[string]*EvidenceFile
+	order     []string
+	audit     []AuditEvent
+	retention map[string]time.Duration // by "case_type/evidence_type"
+	store     BlobStore
+	cases     CaseResolver
+	records   CaseRecords
+	journal   Journal
+
+	bundles     map[string]*Bundle
+	bundleOrder []string
+}
+
+// NewEvidenceService creates an evidence service over a blob store
+func NewEvidenceService(store BlobStore, cases CaseResolver) *EvidenceService {
+	return &EvidenceService{
+		files:     make(map[string]*EvidenceFile),
+		retention: make(map[string]time.Duration),
+		store:     store,
+		cases:     cases,
+		bundles:   make(map[string]*Bundle),
+	}
+}
+
+// Upload validates a file, stores it with its SHA-256 hash and links it to
+// a case the actor is a party to
+func (s *EvidenceService) Upload(ctx context.Context, actor Actor, req *UploadRequest, r io.Reader) (*EvidenceFile, error) {
+	if !validEvidenceType(req.CaseType, req.EvidenceType) {
+		return nil, fmt.Errorf("%w: %s is not %s evidence", ErrInvalidFile, req.EvidenceType, req.CaseType)
+	}
+	if req.CaseID == "" {
+		return nil, fmt.Errorf("%w: case_id is required", ErrInvalidFile)
+	}
+	if err := checkAccess(ctx, s.cases, actor, req.CaseType, req.CaseID); err != nil {
+		return nil, err
+	}
+	if actor.IsStaff() {
+		// Staff skip the party check but may only link to real cases
+		if _, err := s.cases.Parties(ctx, req.CaseType, req.CaseID); err != nil {
+			return nil, err
+		}
+	}
+
+	// The first bytes decide the content type, whatever the client claims
+	reader := bufio.NewReaderSize(r, 512)
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	if len(head) == 0 {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalidFile)
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	limit, ok := allowedTypes[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: content type %s is not allowed", ErrInvalidFile, contentType)
+	}
+	if declared, _, err := mime.ParseMediaType(req.ContentType); err == nil &&
+		declared != "application/octet-stream" && declared != contentType {
+		return nil, fmt.Errorf("%w: declared as %s but content is %s", ErrInvalidFile, declared, contentType)
+	}
+
+	now := time.Now()
+	file := &EvidenceFile{
+		ID:           generateID("evd"),
+		CaseType:     req.CaseType,
+		CaseID:       req.CaseID,
+		EvidenceType: req.EvidenceType,
+		FileName:     req.FileName,
+		Description:  req.Description,
+		ContentType:  contentType,
+		Status:       FileStatusActive,
+		UploadedBy:   actor.UserID,
+		UploadedAt:   now,
+		RetainUntil:  now.Add(s.retentionFor(req.CaseType, req.EvidenceType)),
+	}
+	file.StorageKey = req.CaseType + "/" + req.CaseID + "/" + file.ID
+
+	// Hash and count while storing, reading one byte past the limit to
+	// catch files that are too large
+	hash := sha256.New()
+	counter := &countingReader{r: io.LimitReader(reader, limit+1)}
+	if err := s.store.Put(ctx, file.StorageKey, io.TeeReader(counter, hash)); err != nil {
+		return nil, err
+	}
+	if counter.n > limit {
+		s.store.Delete(ctx, file.StorageKey)
+		return nil, fmt.Errorf("%w: %s files may be at most %d bytes", ErrInvalidFile, contentType, limit)
+	}
+	file.SizeBytes = counter.n
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	s.mu.Lock()
+	err = s.commitLocked(&JournalEntry{
+		Kind:       JournalFile,
+		File:       file,
+		StorageKey: file.StorageKey,
+		Audit:      []AuditEvent{auditEvent(file.ID, AuditUpload, actor, file.SHA256)},
+	})
+	s.mu.Unlock()
+	if err != nil {
+		s.store.Delete(ctx, file.StorageKey)
+		return nil, fmt.Errorf("failed to record upload: %w", err)
+	}
+
+	found := *file
+	return &found, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// GetFile returns a file's record if the actor may see it
+func (s *EvidenceService) GetFile(ctx context.Context, actor Actor, fileID string) (*EvidenceFile, error) {
+	file, err := s.file(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccess(ctx, s.cases, actor, file.CaseType, file.CaseID); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Download opens a file's contents for the actor. Every attempt is
+// audited, including denied ones, and contents are only handed out once
+// the download is recorded.
+func (s *EvidenceService) Download(ctx context.Context, actor Actor, fileID string) (*EvidenceFile, io.ReadCloser, error) {
+	file, err := s.file(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkAccess(ctx, s.cases, actor, file.CaseType, file.CaseID); err != nil {
+		s.record(fileID, AuditDenied, actor, err.Error())
+		return nil, nil, err
+	}
+	if file.Status == FileStatusExpired {
+		s.record(fileID, AuditDenied, actor, "expired")
+		return nil, nil, fmt.Errorf("%w: %s", ErrFileExpired, fileID)
+	}
+
+	contents, err := s.store.Get(ctx, file.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.record(fileID, AuditDownload, actor, ""); err != nil {
+		contents.Close()
+		return nil, nil, err
+	}
+	return file, contents, nil
+}
+
+// ListFiles returns the files of a case, oldest first, if the actor may
+// see them
+func (s *EvidenceService) ListFiles(ctx context.Context, actor Actor, caseType, caseID string) ([]*EvidenceFile, error) {
+	if err := checkAccess(ctx, s.cases, actor, caseType, caseID); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files := []*EvidenceFile{}
+	for _, id := range s.order {
+		file := s.files[id]
+		if file.CaseType == caseType && file.CaseID == caseID {
+			found := *file
+			files = append(files, &found)
+		}
+	}
+	return files, nil
+}
+
+// AuditTrail returns the audit events of a file, or of all files without
+// an ID
+func (s *EvidenceService) AuditTrail(fileID string) []AuditEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []AuditEvent{}
+	for _, event := range s.audit {
+		if fileID == "" || event.FileID == fileID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// SetRetentionPolicy sets how long new evidence of a case type, and
+// optionally one evidence type, is kept
+func (s *EvidenceService) SetRetentionPolicy(policy *RetentionPolicy) error {
+	if _, ok := evidenceTypes[policy.CaseType]; !ok {
+		return fmt.Errorf("invalid case type: %s", policy.CaseType)
+	}
+	if policy.EvidenceType != "" && !validEvidenceType(policy.CaseType, policy.EvidenceType) {
+		return fmt.Errorf("invalid evidence type for %s: %s", policy.CaseType, policy.EvidenceType)
+	}
+	if policy.RetentionDays <= 0 {
+		return errors.New("retention_days must be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *policy
+	if err := s.commitLocked(&JournalEntry{Kind: JournalRetention, Retention: &saved}); err != nil {
+		return fmt.Errorf("failed to record retention policy: %w", err)
+	}
+	return nil
+}
+
+// RetentionPolicies returns the retention of every case and evidence type
+func (s *EvidenceService) RetentionPolicies() []RetentionPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	days := func(d time.Duration) int { return int(d / (24 * time.Hour)) }
+	policies := []RetentionPolicy{}
+	for _, caseType := range []string{CaseTypeEscrow, CaseTypeDispute, CaseTypeKYC} {
+		policies = append(policies, RetentionPolicy{CaseType: caseType, RetentionDays: days(s.retentionForLocked(caseType, ""))})
+		for _, evidenceType := range evidenceTypes[caseType] {
+			if retention, ok := s.retention[caseType+"/"+evidenceType]; ok {
+				policies = append(policies, RetentionPolicy{CaseType: caseType, EvidenceType: evidenceType, RetentionDays: days(retention)})
+			}
+		}
+	}
+	return policies
+}
+
+func (s *EvidenceService) retentionFor(caseType, evidenceType string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.retentionForLocked(caseType, evidenceType)
+}
+
+func (s *EvidenceService) retentionForLocked(caseType, evidenceType string) time.Duration {
+	if retention, ok := s.retention[caseType+"/"+evidenceType]; ok {
+		return retention
+	}
+	if retention, ok := s.retention[caseType+"/"]; ok {
+		return retention
+	}
+	return defaultRetention[caseType]
+}
+
+// EnforceRetention deletes the contents of files past their retention and
+// returns how many expired
+func (s *EvidenceService) EnforceRetention(ctx context.Context, now time.Time) int {
+	s.mu.RLock()
+	var due []*EvidenceFile
+	for _, id := range s.order {
+		file := s.files[id]
+		if file.Status == FileStatusActive && now.After(file.RetainUntil) {
+			due = append(due, file)
+		}
+	}
+	s.mu.RUnlock()
+
+	expired := 0
+	for _, file := range due {
+		if err := s.store.Delete(ctx, file.StorageKey); err != nil {
+			log.Printf("Failed to delete expired evidence %s: %v", file.ID, err)
+			continue
+		}
+
+		expiredFile := *file
+		expiredFile.Status = FileStatusExpired
+		s.mu.Lock()
+		err := s.commitLocked(&JournalEntry{
+			Kind:       JournalFile,
+			File:       &expiredFile,
+			StorageKey: file.StorageKey,
+			Audit:      []AuditEvent{auditEvent(file.ID, AuditExpired, Actor{}, "retention ended "+file.RetainUntil.Format(time.RFC3339))},
+		})
+		s.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to record expiry of evidence %s: %v", file.ID, err)
+			continue
+		}
+		expired++
+	}
+	return expired
+}
+
+// file returns a copy of a file's record
+func (s *EvidenceService) file(fileID string) (*EvidenceFile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, ok := s.files[fileID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, fileID)
+	}
+	found := *file
+	return &found, nil
+}
+
+// record appends an audit event
+func (s *EvidenceService) record(fileID, action string, actor Actor, detail string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.commitLocked(&JournalEntry{Kind: JournalAudit, Audit: []AuditEvent{auditEvent(fileID, action, actor, detail)}})
+	if err != nil {
+		log.Printf("Failed to record %s of evidence %s: %v", action, fileID, err)
+		return fmt.Errorf("failed to audit %s: %w", action, err)
+	}
+	return nil
+}
+
+// auditEvent is an event of an actor's access to a file now
+func auditEvent(fileID, action string, actor Actor, detail string) AuditEvent {
+	return AuditEvent{
+		FileID:  fileID,
+		Action:  action,
+		ActorID: actor.UserID,
+		Role:    actor.Role,
+		Detail:  detail,
+		At:      time.Now(),
+	}
+}
+
+// validEvidenceType reports whether a case type takes an evidence type
+func validEvidenceType(caseType, evidenceType string) bool {
+	for _, allowed := range evidenceTypes[caseType] {
+		if allowed == evidenceType {
+			return true
+		}
+	}
+	return false
+}
+
+// lastID keeps generated IDs unique when the clock does not advance
+// between calls
+var lastID int64
+
+// generateID returns a unique ID with the given prefix
+func generateID(prefix string) string {
+	for {
+		last := atomic.LoadInt64(&lastID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, next) {
+			return fmt.Sprintf("%s_%d", prefix, next)
+		}
+	}
+}
@@ -1,39 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// maxUploadBytes bounds upload requests; each content type has its own
+// smaller limit
+const maxUploadBytes = 25 << 20
+
+// Global services
+var (
+	evidenceService *EvidenceService
+)
+
 func main() {
 	port := flag.String("port", "8087", "Port to listen on")
 	flag.Parse()
 
 	log.Printf("Starting Evidence Microservice on port %s...", *port)
 
+	storageDir := getEnv("EVIDENCE_STORAGE_DIR", "data/evidence")
+	store, err := NewLocalBlobStore(storageDir)
+	if err != nil {
+		log.Fatalf("Failed to open evidence store: %v", err)
+	}
+	log.Printf("Storing evidence under %s", storageDir)
+
+	cases := NewHTTPCaseResolver(
+		getEnv("ESCROW_SERVICE_URL", "http://escrow-service:8081"),
+		getEnv("DISPUTES_SERVICE_URL", "http://disputes-service:8101"),
+	)
+	evidenceService = NewEvidenceService(store, cases)
+	evidenceService.SetCaseRecords(cases)
+
+	// File records, bundles, retention policies and the audit log are
+	// journaled next to the blobs and reloaded on start
+	journalPath := getEnv("EVIDENCE_JOURNAL_PATH", filepath.Join(storageDir, "journal.jsonl"))
+	journal, err := OpenFileJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to open evidence journal: %v", err)
+	}
+	defer journal.Close()
+	if err := evidenceService.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load evidence records: %v", err)
+	}
+	log.Printf("Journaling evidence records to %s", journalPath)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"evidence","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/upload", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"id": "evidence_123",
-			"status": "uploaded",
-		})
-	})
+	mux.HandleFunc("/v1/upload", handleUpload)
+	mux.HandleFunc("/v1/evidence", handleEvidence)
+	mux.HandleFunc("/v1/evidence/", handleEvidenceByID)
+	mux.HandleFunc("/v1/retention-policies", handleRetentionPolicies)
+	mux.HandleFunc("/v1/bundles", handleBundles)
+	mux.HandleFunc("/v1/bundles/", handleBundleByID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runRetention(ctx, time.Hour)
 
 	server := &http.Server{
-		Addr: ":" + *port,
+		Addr:    ":" + *port,
 		Handler: mux,
 	}
 
@@ -47,5 +91,290 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+
 	log.Println("Evidence service exited")
 }
+
+// runRetention periodically deletes evidence past its retention
+func runRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if expired := evidenceService.EnforceRetention(ctx, now); expired > 0 {
+				log.Printf("Deleted %d evidence files past their retention", expired)
+			}
+		}
+	}
+}
+
+// getEnv gets an environment variable with a fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// actorFrom reads the caller the API gateway identified
+func actorFrom(r *http.Request) Actor {
+	return Actor{UserID: r.Header.Get("X-User-ID"), Role: r.Header.Get("X-User-Role")}
+}
+
+// evidenceErrorStatus maps evidence errors to HTTP statuses
+func evidenceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrFileNotFound), errors.Is(err, ErrCaseNotFound), errors.Is(err, ErrBlobNotFound), errors.Is(err, ErrBundleNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrFileExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrInvalidFile):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrHashMismatch):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handleUpload accepts a multipart "file" with case_type, case_id,
+// evidence_type and an optional description
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Invalid multipart upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	evidence, err := evidenceService.Upload(r.Context(), actorFrom(r), &UploadRequest{
+		CaseType:     r.FormValue("case_type"),
+		CaseID:       r.FormValue("case_id"),
+		EvidenceType: r.FormValue("evidence_type"),
+		Description:  r.FormValue("description"),
+		FileName:     header.Filename,
+		ContentType:  header.Header.Get("Content-Type"),
+	}, file)
+	if err != nil {
+		http.Error(w, err.Error(), evidenceErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(evidence)
+}
+
+// handleEvidence lists the files of ?case_type=&case_id= and accepts
+// uploads like /v1/upload
+func handleEvidence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		handleUpload(w, r)
+
+	case "GET":
+		query := r.URL.Query()
+		files, err := evidenceService.ListFiles(r.Context(), actorFrom(r), query.Get("case_type"), query.Get("case_id"))
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"files": files,
+			"total": len(files),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEvidenceByID serves GET /v1/evidence/{id}, its /download and, for
+// staff, its /audit trail
+func handleEvidenceByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/evidence/"), "/")
+	fileID := parts[0]
+	actor := actorFrom(r)
+
+	switch {
+	case len(parts) == 1:
+		file, err := evidenceService.GetFile(r.Context(), actor, fileID)
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file)
+
+	case len(parts) == 2 && parts[1] == "download":
+		file, contents, err := evidenceService.Download(r.Context(), actor, fileID)
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+		defer contents.Close()
+
+		w.Header().Set("Content-Type", file.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, strings.ReplaceAll(file.FileName, `"`, "")))
+		w.Header().Set("X-Content-SHA256", file.SHA256)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.Copy(w, contents)
+
+	case len(parts) == 2 && parts[1] == "audit":
+		if !actor.IsStaff() {
+			http.Error(w, ErrAccessDenied.Error(), http.StatusForbidden)
+			return
+		}
+		if _, err := evidenceService.GetFile(r.Context(), actor, fileID); err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evidenceService.AuditTrail(fileID))
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleRetentionPolicies lists retention by case and evidence type and
+// lets staff change it
+func handleRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evidenceService.RetentionPolicies())
+
+	case "PUT":
+		if !actorFrom(r).IsStaff() {
+			http.Error(w, ErrAccessDenied.Error(), http.StatusForbidden)
+			return
+		}
+
+		var policy RetentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := evidenceService.SetRetentionPolicy(&policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evidenceService.RetentionPolicies())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBundles generates a representment bundle for a dispute and lists
+// the bundles of ?dispute_id=
+func handleBundles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var req BundleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		bundle, err := evidenceService.BuildBundle(r.Context(), actorFrom(r), &req)
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(bundle)
+
+	case "GET":
+		bundles, err := evidenceService.ListBundles(r.Context(), actorFrom(r), r.URL.Query().Get("dispute_id"))
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"bundles": bundles,
+			"total":   len(bundles),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBundleByID serves GET /v1/bundles/{id} and its /download
+func handleBundleByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/bundles/"), "/")
+	bundleID := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		bundle, err := evidenceService.GetBundle(r.Context(), actorFrom(r), bundleID)
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bundle)
+
+	case len(parts) == 2 && parts[1] == "download":
+		bundle, contents, err := evidenceService.DownloadBundle(r.Context(), actorFrom(r), bundleID)
+		if err != nil {
+			http.Error(w, err.Error(), evidenceErrorStatus(err))
+			return
+		}
+		defer contents.Close()
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.pdf"`, bundle.DisputeID, bundle.ID))
+		w.Header().Set("X-Content-SHA256", bundle.SHA256)
+		io.Copy(w, contents)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
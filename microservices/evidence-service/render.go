@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+const (
+	// pdfLinesPerPage is how many text lines fit on an A4 page at 12pt
+	// leading
+	pdfLinesPerPage = 60
+	// pdfLineWidth is how many Courier 9pt characters fit between the
+	// margins
+	pdfLineWidth = 95
+	// maxImagePixels bounds the images decoded for previews
+	maxImagePixels = 25_000_000
+)
+
+// errImageNotRendered is returned for images the PDF cannot preview
+var errImageNotRendered = errors.New("image cannot be previewed")
+
+// pdfImage is an image XObject
+type pdfImage struct {
+	width      int
+	height     int
+	colorSpace string // DeviceRGB or DeviceGray
+	filter     string // DCTDecode or FlateDecode
+	data       []byte
+}
+
+// pdfPage is a page of text lines with an optional image drawn below them
+type pdfPage struct {
+	lines []string
+	image *pdfImage
+}
+
+// pdfAttachment is a file embedded in the PDF as it was uploaded
+type pdfAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// pdfImageFrom prepares an uploaded image for a PDF page. JPEGs are
+// embedded as they are; other images are decoded and stored as RGB.
+func pdfImageFrom(contentType string, data []byte) (*pdfImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errImageNotRendered, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", errImageNotRendered, config.Width, config.Height)
+	}
+
+	if format == "jpeg" && contentType == "image/jpeg" {
+		switch config.ColorModel {
+		case color.YCbCrModel:
+			return &pdfImage{width: config.Width, height: config.Height, colorSpace: "DeviceRGB", filter: "DCTDecode", data: data}, nil
+		case color.GrayModel:
+			return &pdfImage{width: config.Width, height: config.Height, colorSpace: "DeviceGray", filter: "DCTDecode", data: data}, nil
+		}
+		// CMYK JPEGs are decoded below as PDF readers disagree on their
+		// inversion
+	}
+
+	var img image.Image
+	if format == "jpeg" {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errImageNotRendered, err)
+	}
+
+	// Transparent pixels are drawn over white
+	bounds := img.Bounds()
+	var raw bytes.Buffer
+	w := zlib.NewWriter(&raw)
+	row := make([]byte, 0, 3*bounds.Dx())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			row = append(row, byte((r+0xffff-a)>>8), byte((g+0xffff-a)>>8), byte((b+0xffff-a)>>8))
+		}
+		w.Write(row)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress image: %w", err)
+	}
+	return &pdfImage{width: bounds.Dx(), height: bounds.Dy(), colorSpace: "DeviceRGB", filter: "FlateDecode", data: raw.Bytes()}, nil
+}
+
+// renderPDF writes pages as a PDF 1.4 document in a fixed-width font, with
+// attachments embedded as files. Attachment names must be sorted.
+func renderPDF(pages []pdfPage, attachments []pdfAttachment) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	stream := func(dict string, data []byte) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", len(offsets), dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Objects 1-3 are the catalog, page tree and font. Each page then adds
+	// a page object, its content stream and its image if it has one, and
+	// each attachment adds a file specification and its stream.
+	pageObjects := make([]int, len(pages))
+	next := 4
+	for i, page := range pages {
+		pageObjects[i] = next
+		next += 2
+		if page.image != nil {
+			next++
+		}
+	}
+	kids := make([]string, len(pages))
+	for i, number := range pageObjects {
+		kids[i] = fmt.Sprintf("%d 0 R", number)
+	}
+	names := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		names[i] = fmt.Sprintf("(%s) %d 0 R", escapePDFText(attachment.name), next+2*i)
+	}
+
+	catalog := "<< /Type /Catalog /Pages 2 0 R"
+	if len(attachments) > 0 {
+		catalog += fmt.Sprintf(" /Names << /EmbeddedFiles << /Names [%s] >> >>", strings.Join(names, " "))
+	}
+	object(catalog + " >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	for i, page := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 9 Tf 12 TL 40 800 Td\n")
+		for _, line := range page.lines {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", escapePDFText(line))
+		}
+		content.WriteString("ET")
+
+		resources := "/Font << /F1 3 0 R >>"
+		if img := page.image; img != nil {
+			// Scale the image into the space below the text, never
+			// enlarging it
+			top := 800.0 - 12*float64(len(page.lines))
+			scale := 1.0
+			if s := 515 / float64(img.width); s < scale {
+				scale = s
+			}
+			if s := (top - 40) / float64(img.height); s < scale {
+				scale = s
+			}
+			width, height := float64(img.width)*scale, float64(img.height)*scale
+			fmt.Fprintf(&content, "\nq %.2f 0 0 %.2f 40 %.2f cm /Im1 Do Q", width, height, top-height)
+			resources += fmt.Sprintf(" /XObject << /Im1 %d 0 R >>", pageObjects[i]+2)
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << %s >> /Contents %d 0 R >>", resources, pageObjects[i]+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+		if img := page.image; img != nil {
+			stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+				img.width, img.height, img.colorSpace, img.filter), img.data)
+		}
+	}
+
+	for _, attachment := range attachments {
+		name := escapePDFText(attachment.name)
+		object(fmt.Sprintf("<< /Type /Filespec /F (%s) /UF (%s) /EF << /F %d 0 R >> >>", name, name, len(offsets)+2))
+		stream(fmt.Sprintf("/Type /EmbeddedFile /Subtype /%s /Params << /Size %d >>", pdfName(attachment.contentType), len(attachment.data)), attachment.data)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
+
+// pdfName encodes a string as a PDF name, e.g. application/pdf as
+// application#2Fpdf
+func pdfName(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if c > 32 && c < 127 && !strings.ContainsRune("#/()<>[]{}%", rune(c)) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "#%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapePDFText escapes a string for a PDF literal, dropping characters the
+// standard fonts cannot show
+func escapePDFText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// wrapText splits text into lines of at most width characters, breaking
+// at spaces where it can
+func wrapText(text string, width int) []string {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\t", "    ")
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \r")
+		for len(line) > width {
+			cut := strings.LastIndexByte(line[:width+1], ' ')
+			if cut <= 0 {
+				cut = width
+			}
+			lines = append(lines, line[:cut])
+			line = strings.TrimLeft(line[cut:], " ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
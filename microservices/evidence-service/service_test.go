@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubCases struct {
+	parties  map[string][]string
+	escrows  map[string]*EscrowRecord
+	disputes map[string]*DisputeRecord
+}
+
+func (c *stubCases) Parties(ctx context.Context, caseType, caseID string) ([]string, error) {
+	parties, ok := c.parties[caseType+"/"+caseID]
+	if !ok {
+		return nil, ErrCaseNotFound
+	}
+	return parties, nil
+}
+
+func (c *stubCases) Escrow(ctx context.Context, escrowID string) (*EscrowRecord, error) {
+	if escrow, ok := c.escrows[escrowID]; ok {
+		return escrow, nil
+	}
+	return nil, ErrCaseNotFound
+}
+
+func (c *stubCases) Dispute(ctx context.Context, disputeID string) (*DisputeRecord, error) {
+	if dispute, ok := c.disputes[disputeID]; ok {
+		return dispute, nil
+	}
+	return nil, ErrCaseNotFound
+}
+
+var (
+	buyer  = Actor{UserID: "buyer_1"}
+	seller = Actor{UserID: "seller_1"}
+	other  = Actor{UserID: "user_9"}
+	staff  = Actor{UserID: "agent_1", Role: "support"}
+)
+
+func newTestEvidenceService(t *testing.T) (*EvidenceService, *LocalBlobStore) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cases := &stubCases{parties: map[string][]string{
+		"escrow/esc_1":  {"buyer_1", "seller_1"},
+		"dispute/dsp_1": {"merchant_1"},
+	}}
+	return NewEvidenceService(store, cases), store
+}
+
+func pdfFile(body string) []byte {
+	return []byte("%PDF-1.4\n" + body + "\n%%EOF\n")
+}
+
+func TestEvidenceService_Upload(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestEvidenceService(t)
+	content := pdfFile("delivery note")
+
+	file, err := service.Upload(ctx, seller, &UploadRequest{
+		CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "delivery_proof",
+		FileName: "pod.pdf", ContentType: "application/pdf",
+	}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	if file.SHA256 != hex.EncodeToString(sum[:]) || file.SizeBytes != int64(len(content)) {
+		t.Errorf("Expected hash and size of the content, got %s and %d", file.SHA256, file.SizeBytes)
+	}
+	if file.ContentType != "application/pdf" || file.UploadedBy != "seller_1" {
+		t.Errorf("Expected pdf uploaded by seller_1, got %s by %s", file.ContentType, file.UploadedBy)
+	}
+	if retained := file.RetainUntil.Sub(file.UploadedAt); retained != 7*365*24*time.Hour {
+		t.Errorf("Expected 7 years escrow retention, got %v", retained)
+	}
+
+	rejected := []struct {
+		name    string
+		actor   Actor
+		req     UploadRequest
+		content []byte
+		want    error
+	}{
+		{"not a party", other, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "receipt"}, content, ErrAccessDenied},
+		{"unknown case", staff, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_2", EvidenceType: "receipt"}, content, ErrCaseNotFound},
+		{"wrong evidence type", seller, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "selfie"}, content, ErrInvalidFile},
+		{"executable", seller, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "receipt"}, []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00"), ErrInvalidFile},
+		{"mismatched type", seller, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "receipt", ContentType: "image/png"}, content, ErrInvalidFile},
+		{"empty", seller, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "receipt"}, nil, ErrInvalidFile},
+		{"too large", seller, UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "other"}, bytes.Repeat([]byte("a"), 1<<20+1), ErrInvalidFile},
+	}
+	for _, tt := range rejected {
+		_, err := service.Upload(ctx, tt.actor, &tt.req, bytes.NewReader(tt.content))
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	files, err := service.ListFiles(ctx, buyer, CaseTypeEscrow, "esc_1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only the valid upload stored, got %d files", len(files))
+	}
+}
+
+func TestEvidenceService_DownloadAccessAndAudit(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestEvidenceService(t)
+	content := pdfFile("terms v3 accepted")
+
+	file, err := service.Upload(ctx, buyer, &UploadRequest{CaseType: CaseTypeEscrow, CaseID: "esc_1", EvidenceType: "terms_acceptance"}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, contents, err := service.Download(ctx, seller, file.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(contents)
+	contents.Close()
+	if !bytes.Equal(data, content) {
+		t.Errorf("Expected the uploaded content back, got %q", data)
+	}
+
+	if _, _, err := service.Download(ctx, other, file.ID); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied, got %v", err)
+	}
+	if _, err := service.GetFile(ctx, other, file.ID); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied, got %v", err)
+	}
+	if _, _, err := service.Download(ctx, staff, file.ID); err != nil {
+		t.Errorf("Expected staff to download, got %v", err)
+	}
+
+	trail := service.AuditTrail(file.ID)
+	actions := []string{AuditUpload, AuditDownload, AuditDenied, AuditDownload}
+	if len(trail) != len(actions) {
+		t.Fatalf("Expected %d audit events, got %+v", len(actions), trail)
+	}
+	for i, action := range actions {
+		if trail[i].Action != action {
+			t.Errorf("Expected audit event %d to be %s, got %s", i, action, trail[i].Action)
+		}
+	}
+	if trail[2].ActorID != "user_9" || trail[3].Role != "support" {
+		t.Errorf("Expected actors recorded, got %+v", trail)
+	}
+}
+
+func TestEvidenceService_Retention(t *testing.T) {
+	ctx := context.Background()
+	service, store := newTestEvidenceService(t)
+
+	if err := service.SetRetentionPolicy(&RetentionPolicy{CaseType: CaseTypeDispute, EvidenceType: "selfie", RetentionDays: 30}); err == nil {
+		t.Error("Expected error for evidence the case type does not take")
+	}
+	if err := service.SetRetentionPolicy(&RetentionPolicy{CaseType: CaseTypeDispute, EvidenceType: "receipt", RetentionDays: 30}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	merchant := Actor{UserID: "merchant_1"}
+	receipt, _ := service.Upload(ctx, merchant, &UploadRequest{CaseType: CaseTypeDispute, CaseID: "dsp_1", EvidenceType: "receipt"}, bytes.NewReader(pdfFile("receipt")))
+	note, _ := service.Upload(ctx, merchant, &UploadRequest{CaseType: CaseTypeDispute, CaseID: "dsp_1", EvidenceType: "other"}, bytes.NewReader([]byte("customer called twice")))
+	if receipt.RetainUntil.Sub(receipt.UploadedAt) != 30*24*time.Hour || note.ContentType != "text/plain" {
+		t.Errorf("Expected 30 day receipt retention and a text note, got %v and %s", receipt.RetainUntil.Sub(receipt.UploadedAt), note.ContentType)
+	}
+
+	if expired := service.EnforceRetention(ctx, time.Now().Add(31*24*time.Hour)); expired != 1 {
+		t.Fatalf("Expected 1 expired file, got %d", expired)
+	}
+	if _, _, err := service.Download(ctx, merchant, receipt.ID); !errors.Is(err, ErrFileExpired) {
+		t.Errorf("Expected ErrFileExpired, got %v", err)
+	}
+	if _, err := store.Get(ctx, receipt.StorageKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected the expired blob deleted, got %v", err)
+	}
+	if found, _ := service.GetFile(ctx, merchant, receipt.ID); found.Status != FileStatusExpired || found.SHA256 == "" {
+		t.Errorf("Expected the expired record kept with its hash, got %+v", found)
+	}
+	if _, _, err := service.Download(ctx, merchant, note.ID); err != nil {
+		t.Errorf("Expected the note kept for 2 years, got %v", err)
+	}
+}
+
+func TestLocalBlobStore_RejectsEscapingKeys(t *testing.T) {
+	store, _ := NewLocalBlobStore(t.TempDir())
+	if err := store.Put(context.Background(), "../outside", bytes.NewReader([]byte("x"))); err == nil {
+		t.Error("Expected error for a key outside the store")
+	}
+}
+
+func TestEvidenceService_BuildBundle(t *testing.T) {
+	ctx := context.Background()
+	service, store := newTestEvidenceService(t)
+	merchant := Actor{UserID: "merchant_1"}
+
+	opened := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	cases := &stubCases{
+		parties: map[string][]string{
+			"escrow/esc_1":  {"buyer_1", "merchant_1"},
+			"dispute/dsp_1": {"merchant_1"},
+		},
+		escrows: map[string]*EscrowRecord{"esc_1": {
+			ID: "esc_1", BuyerID: "buyer_1", SellerID: "merchant_1", Currency: "USD", Status: "released",
+			Terms:     "Goods ship within 3 days. Refunds within 14 days of delivery.",
+			CreatedAt: opened.AddDate(0, 0, -20),
+			Metadata: map[string]interface{}{
+				"funded_at":      opened.AddDate(0, 0, -19).Format(time.RFC3339Nano),
+				"delivered_at":   opened.AddDate(0, 0, -15).Format(time.RFC3339Nano),
+				"delivery_proof": "Courier tracking 1Z999 signed by J. Moyo",
+			},
+		}},
+		disputes: map[string]*DisputeRecord{"dsp_1": {
+			ID: "dsp_1", MerchantID: "merchant_1", AmountMinor: 12500, Currency: "USD", Network: "visa",
+			ReasonCode: "13.1", Status: "needs_response", CreatedAt: opened, ResponseDueBy: opened.AddDate(0, 0, 30),
+		}},
+	}
+	service.cases = cases
+	service.SetCaseRecords(cases)
+
+	var img bytes.Buffer
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	rgba.Set(1, 1, color.RGBA{R: 255, A: 255})
+	png.Encode(&img, rgba)
+
+	uploads := []struct {
+		actor    Actor
+		caseType string
+		caseID   string
+		evidence string
+		content  []byte
+	}{
+		{merchant, CaseTypeDispute, "dsp_1", "receipt", pdfFile("receipt")},
+		{merchant, CaseTypeEscrow, "esc_1", "customer_communication", []byte("Buyer: it arrived, thanks (and early)")},
+		{buyer, CaseTypeEscrow, "esc_1", "photo", img.Bytes()},
+		{merchant, CaseTypeEscrow, "esc_1", "delivery_proof", pdfFile("signed proof of delivery")},
+	}
+	var files []*EvidenceFile
+	for _, upload := range uploads {
+		file, err := service.Upload(ctx, upload.actor, &UploadRequest{CaseType: upload.caseType, CaseID: upload.caseID, EvidenceType: upload.evidence, FileName: upload.evidence + ".dat"}, bytes.NewReader(upload.content))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		files = append(files, file)
+	}
+
+	if _, err := service.BuildBundle(ctx, buyer, &BundleRequest{DisputeID: "dsp_1", EscrowID: "esc_1"}); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected ErrAccessDenied for the buyer, got %v", err)
+	}
+
+	bundle, err := service.BuildBundle(ctx, merchant, &BundleRequest{DisputeID: "dsp_1", EscrowID: "esc_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	kinds := []string{BundleItemDispute, BundleItemOrder, BundleItemTerms, BundleItemDelivery, BundleItemFile, BundleItemFile, BundleItemFile, BundleItemFile}
+	if len(bundle.Items) != len(kinds) {
+		t.Fatalf("Expected %d items, got %+v", len(kinds), bundle.Items)
+	}
+	for i, kind := range kinds {
+		if bundle.Items[i].Kind != kind || bundle.Items[i].Number != i+1 || len(bundle.Items[i].SHA256) != 64 {
+			t.Errorf("Expected item %d to be a hashed %s, got %+v", i+1, kind, bundle.Items[i])
+		}
+	}
+	// Delivery proofs come first among the files, then communications,
+	// receipts and photos
+	order := []string{files[3].ID, files[1].ID, files[0].ID, files[2].ID}
+	for i, id := range order {
+		if item := bundle.Items[4+i]; item.FileID != id || item.SHA256 != service.files[id].SHA256 {
+			t.Errorf("Expected item %d to be %s with its upload hash, got %+v", 5+i, id, item)
+		}
+	}
+	terms := sha256.Sum256([]byte(cases.escrows["esc_1"].Terms))
+	if bundle.Items[2].SHA256 != hex.EncodeToString(terms[:]) {
+		t.Errorf("Expected the terms hashed over their text, got %s", bundle.Items[2].SHA256)
+	}
+	for i := 1; i < len(bundle.Items); i++ {
+		if bundle.Items[i].Page <= bundle.Items[i-1].Page || bundle.Items[i].Page > bundle.Pages {
+			t.Errorf("Expected items on increasing pages within %d, got %+v", bundle.Pages, bundle.Items)
+		}
+	}
+
+	_, contents, err := service.DownloadBundle(ctx, merchant, bundle.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(contents)
+	contents.Close()
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != bundle.SHA256 || !bytes.HasPrefix(data, []byte("%PDF-1.4")) {
+		t.Errorf("Expected the stored PDF to match the bundle hash")
+	}
+	pdf := string(data)
+	for _, want := range []string{
+		"EVIDENCE BUNDLE " + bundle.ID,
+		"Page 1 of ",
+		"Courier tracking 1Z999 signed by J. Moyo",
+		"delivery confirmed",
+		"Buyer: it arrived, thanks \\(and early\\)",
+		"/Subtype /Image",
+		"/EmbeddedFile /Subtype /application#2Fpdf",
+		"SHA-256 " + files[0].SHA256,
+	} {
+		if !strings.Contains(pdf, want) {
+			t.Errorf("Expected the PDF to contain %q", want)
+		}
+	}
+	if embedded := strings.Count(pdf, "/Type /EmbeddedFile"); embedded != len(files) {
+		t.Errorf("Expected %d embedded originals, got %d", len(files), embedded)
+	}
+
+	trail := service.AuditTrail(files[0].ID)
+	if last := trail[len(trail)-1]; last.Action != AuditBundled || last.Detail != bundle.ID {
+		t.Errorf("Expected the file audited as bundled, got %+v", last)
+	}
+	if bundles, _ := service.ListBundles(ctx, merchant, "dsp_1"); len(bundles) != 1 {
+		t.Errorf("Expected 1 bundle for the dispute, got %d", len(bundles))
+	}
+
+	// Contents changed behind the service's back are refused
+	store.Put(ctx, files[0].StorageKey, bytes.NewReader(pdfFile("forged receipt")))
+	if _, err := service.BuildBundle(ctx, merchant, &BundleRequest{DisputeID: "dsp_1"}); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Expected ErrHashMismatch, got %v", err)
+	}
+}
+
+func TestEvidenceService_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, _ := NewLocalBlobStore(dir)
+	cases := &stubCases{
+		parties: map[string][]string{"dispute/dsp_1": {"merchant_1"}},
+		disputes: map[string]*DisputeRecord{"dsp_1": {
+			ID: "dsp_1", MerchantID: "merchant_1", AmountMinor: 2500, Currency: "USD", Network: "visa", ReasonCode: "13.1",
+		}},
+	}
+	merchant := Actor{UserID: "merchant_1"}
+
+	open := func() (*EvidenceService, *FileJournal) {
+		journal, err := OpenFileJournal(filepath.Join(dir, "journal.jsonl"))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		service := NewEvidenceService(store, cases)
+		service.SetCaseRecords(cases)
+		if err := service.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return service, journal
+	}
+
+	service, journal := open()
+	if err := service.SetRetentionPolicy(&RetentionPolicy{CaseType: CaseTypeDispute, EvidenceType: "receipt", RetentionDays: 30}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	receipt, err := service.Upload(ctx, merchant, &UploadRequest{CaseType: CaseTypeDispute, CaseID: "dsp_1", EvidenceType: "receipt"}, bytes.NewReader(pdfFile("receipt")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, contents, _ := service.Download(ctx, merchant, receipt.ID)
+	contents.Close()
+	service.Download(ctx, other, receipt.ID)
+	bundle, err := service.BuildBundle(ctx, merchant, &BundleRequest{DisputeID: "dsp_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service.EnforceRetention(ctx, time.Now().Add(31*24*time.Hour))
+	journal.Close()
+
+	// A crash mid-write leaves a partial last line, which is skipped
+	partial, _ := os.OpenFile(filepath.Join(dir, "journal.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	partial.WriteString(`{"kind":"audit","audit":[{"file_id":`)
+	partial.Close()
+
+	restarted, journal := open()
+	defer journal.Close()
+	found, err := restarted.GetFile(ctx, merchant, receipt.ID)
+	if err != nil {
+		t.Fatalf("Expected the file record reloaded, got %v", err)
+	}
+	if found.SHA256 != receipt.SHA256 || found.StorageKey != receipt.StorageKey || found.Status != FileStatusExpired {
+		t.Errorf("Expected the expired record with its hash and key, got %+v", found)
+	}
+
+	trail := restarted.AuditTrail(receipt.ID)
+	actions := []string{AuditUpload, AuditDownload, AuditDenied, AuditBundled, AuditExpired}
+	if len(trail) != len(actions) {
+		t.Fatalf("Expected %d audit events, got %+v", len(actions), trail)
+	}
+	for i, action := range actions {
+		if trail[i].Action != action {
+			t.Errorf("Expected audit event %d to be %s, got %s", i, action, trail[i].Action)
+		}
+	}
+
+	if reloaded, err := restarted.GetBundle(ctx, merchant, bundle.ID); err != nil || reloaded.SHA256 != bundle.SHA256 || reloaded.StorageKey != bundle.StorageKey {
+		t.Errorf("Expected the bundle reloaded, got %+v (%v)", reloaded, err)
+	}
+	policies := restarted.RetentionPolicies()
+	kept := false
+	for _, policy := range policies {
+		kept = kept || (policy.EvidenceType == "receipt" && policy.RetentionDays == 30)
+	}
+	if !kept {
+		t.Errorf("Expected the receipt retention policy reloaded, got %+v", policies)
+	}
+
+	// New records go on after the reloaded ones
+	note, err := restarted.Upload(ctx, merchant, &UploadRequest{CaseType: CaseTypeDispute, CaseID: "dsp_1", EvidenceType: "other"}, bytes.NewReader([]byte("called twice")))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if files, _ := restarted.ListFiles(ctx, merchant, CaseTypeDispute, "dsp_1"); len(files) != 2 || files[1].ID != note.ID {
+		t.Errorf("Expected both files listed in upload order, got %d", len(files))
+	}
+	journal.Close()
+
+	// The dropped partial line does not corrupt what was written after it
+	again, journal := open()
+	if files, _ := again.ListFiles(ctx, merchant, CaseTypeDispute, "dsp_1"); len(files) != 2 {
+		t.Errorf("Expected both files after a second restart, got %d", len(files))
+	}
+}
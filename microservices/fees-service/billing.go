@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invoice statuses
+const (
+	InvoiceStatusIssued  = "issued"
+	InvoiceStatusSettled = "settled"
+)
+
+// ErrInvoiceNotFound is returned for unknown invoices
+var ErrInvoiceNotFound = errors.New("invoice not found")
+
+// BillingProfile is who a merchant's fee invoices are addressed to. Country
+// is the merchant's tax jurisdiction and VATExempt drops VAT from its fees.
+type BillingProfile struct {
+	MerchantID string    `json:"merchant_id"`
+	Name       string    `json:"name,omitempty"`
+	Country    string    `json:"country,omitempty"`
+	VATNumber  string    `json:"vat_number,omitempty"`
+	VATExempt  bool      `json:"vat_exempt,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// InvoiceLine totals a merchant's fees of one type and method
+type InvoiceLine struct {
+	Description string `json:"description"`
+	FeeType     string `json:"fee_type"`
+	Method      string `json:"method,omitempty"`
+	Count       int    `json:"count"`
+	VolumeMinor int64  `json:"volume_minor"`
+	FeeMinor    int64  `json:"fee_minor"`
+}
+
+// InvoiceTaxLine totals the tax charged on an invoice's fees at one rate
+type InvoiceTaxLine struct {
+	TaxType      string `json:"tax_type"`
+	Jurisdiction string `json:"jurisdiction"`
+	Base         string `json:"base"`
+	RateBps      int64  `json:"rate_bps"`
+	BaseMinor    int64  `json:"base_minor"`
+	TaxMinor     int64  `json:"tax_minor"`
+}
+
+// Invoice bills a merchant the fees of one month in one currency
+type Invoice struct {
+	ID                  string           `json:"id"`
+	Number              string           `json:"number"`
+	MerchantID          string           `json:"merchant_id"`
+	MerchantName        string           `json:"merchant_name,omitempty"`
+	Country             string           `json:"country,omitempty"`
+	VATNumber           string           `json:"vat_number,omitempty"`
+	Period              string           `json:"period"` // YYYY-MM
+	PeriodStart         time.Time        `json:"period_start"`
+	PeriodEnd           time.Time        `json:"period_end"`
+	Currency            string           `json:"currency"`
+	Lines               []InvoiceLine    `json:"lines"`
+	FeeIDs              []string         `json:"fee_ids"`
+	SubtotalMinor       int64            `json:"subtotal_minor"`
+	TaxLines            []InvoiceTaxLine `json:"tax_lines"`
+	VATMinor            int64            `json:"vat_minor"`
+	TaxMinor            int64            `json:"tax_minor"` // all taxes, VAT included
+	TotalMinor          int64            `json:"total_minor"`
+	Status              string           `json:"status"`
+	SettlementReference string           `json:"settlement_reference,omitempty"`
+	IssuedAt            time.Time        `json:"issued_at"`
+	SettledAt           *time.Time       `json:"settled_at,omitempty"`
+}
+
+// BillingService invoices merchants for their recorded fees
+type BillingService struct {
+	mu       sync.RWMutex
+	pricing  *PricingService
+	profiles map[string]*BillingProfile
+	invoices map[string]*Invoice
+	order    []string
+	numbers  map[string]int // invoices issued per period
+	journal  Journal
+}
+
+// NewBillingService creates a billing service over the recorded fees
+func NewBillingService(pricing *PricingService) *BillingService {
+	return &BillingService{
+		pricing:  pricing,
+		profiles: make(map[string]*BillingProfile),
+		invoices: make(map[string]*Invoice),
+		numbers:  make(map[string]int),
+	}
+}
+
+// SaveProfile stores a merchant's billing profile. Its country and VAT
+// exemption apply to fees calculated from then on.
+func (b *BillingService) SaveProfile(profile *BillingProfile) (*BillingProfile, error) {
+	if profile.MerchantID == "" {
+		return nil, errors.New("merchant_id is required")
+	}
+	stored := *profile
+	stored.Country = strings.ToUpper(stored.Country)
+	if stored.Country != "" && len(stored.Country) != 2 {
+		return nil, fmt.Errorf("invalid country: %s", stored.Country)
+	}
+	stored.UpdatedAt = time.Now()
+
+	b.mu.Lock()
+	err := b.commitLocked(&JournalEntry{Kind: JournalProfile, Profile: &stored})
+	b.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save profile: %w", err)
+	}
+
+	b.pricing.setTaxProfile(stored.MerchantID, stored.Country, stored.VATExempt)
+
+	return &stored, nil
+}
+
+// GetProfile returns a merchant's billing profile, or an empty one
+func (b *BillingService) GetProfile(merchantID string) *BillingProfile {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if profile, ok := b.profiles[merchantID]; ok {
+		found := *profile
+		return &found
+	}
+	return &BillingProfile{MerchantID: merchantID}
+}
+
+// monthOf returns the start of the UTC month containing t
+func monthOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// RunBilling invoices every merchant for the fees charged in the month
+// containing period that have not been invoiced yet. Running it again for
+// the same month only invoices fees recorded since.
+func (b *BillingService) RunBilling(period time.Time) ([]*Invoice, error) {
+	start := monthOf(period)
+	end := start.AddDate(0, 1, 0)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type invoiceKey struct{ merchantID, currency string }
+	fees := make(map[invoiceKey][]*FeeCalculation)
+	for _, calc := range b.pricing.uninvoicedCalculations(start, end) {
+		key := invoiceKey{calc.MerchantID, calc.Currency}
+		fees[key] = append(fees[key], calc)
+	}
+
+	keys := make([]invoiceKey, 0, len(fees))
+	for key := range fees {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].merchantID != keys[j].merchantID {
+			return keys[i].merchantID < keys[j].merchantID
+		}
+		return keys[i].currency < keys[j].currency
+	})
+
+	invoices := []*Invoice{}
+	for _, key := range keys {
+		invoice := b.buildInvoice(key.merchantID, key.currency, start, end, fees[key])
+		if err := b.commitLocked(&JournalEntry{Kind: JournalInvoice, Invoice: invoice}); err != nil {
+			return nil, fmt.Errorf("failed to save invoice %s: %w", invoice.Number, err)
+		}
+		b.pricing.markInvoiced(invoice.FeeIDs, invoice.ID)
+
+		found := *invoice
+		invoices = append(invoices, &found)
+	}
+
+	return invoices, nil
+}
+
+// buildInvoice totals fees into an invoice with one line per fee type and
+// method and one tax line per tax and rate. Taxes were charged, and posted
+// to the ledger, with each fee.
+func (b *BillingService) buildInvoice(merchantID, currency string, start, end time.Time, fees []*FeeCalculation) *Invoice {
+	profile, ok := b.profiles[merchantID]
+	if !ok {
+		profile = &BillingProfile{MerchantID: merchantID}
+	}
+
+	period := start.Format("2006-01")
+
+	invoice := &Invoice{
+		ID:           generateID("inv"),
+		Number:       fmt.Sprintf("FEE-%s-%04d", period, b.numbers[period]+1),
+		MerchantID:   merchantID,
+		MerchantName: profile.Name,
+		Country:      profile.Country,
+		VATNumber:    profile.VATNumber,
+		Period:       period,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		Currency:     currency,
+		Status:       InvoiceStatusIssued,
+		IssuedAt:     time.Now(),
+	}
+
+	lines := make(map[string]*InvoiceLine)
+	var lineKeys []string
+	taxes := make(map[string]*InvoiceTaxLine)
+	var taxKeys []string
+	for _, calc := range fees {
+		key := calc.FeeType + "|" + calc.Method
+		line, ok := lines[key]
+		if !ok {
+			description := strings.ToUpper(calc.FeeType[:1]) + calc.FeeType[1:] + " fees"
+			if calc.Method != "" {
+				description += " (" + strings.ReplaceAll(calc.Method, "_", " ") + ")"
+			}
+			line = &InvoiceLine{Description: description, FeeType: calc.FeeType, Method: calc.Method}
+			lines[key] = line
+			lineKeys = append(lineKeys, key)
+		}
+		line.Count++
+		line.VolumeMinor += calc.AmountMinor
+		line.FeeMinor += calc.FeeMinor
+
+		invoice.FeeIDs = append(invoice.FeeIDs, calc.TransactionID)
+		invoice.SubtotalMinor += calc.FeeMinor
+
+		for _, tax := range calc.TaxLines {
+			key := fmt.Sprintf("%s|%s|%s|%d", tax.Jurisdiction, tax.TaxType, tax.Base, tax.RateBps)
+			total, ok := taxes[key]
+			if !ok {
+				total = &InvoiceTaxLine{TaxType: tax.TaxType, Jurisdiction: tax.Jurisdiction, Base: tax.Base, RateBps: tax.RateBps}
+				taxes[key] = total
+				taxKeys = append(taxKeys, key)
+			}
+			total.BaseMinor += tax.BaseMinor
+			total.TaxMinor += tax.TaxMinor
+
+			invoice.TaxMinor += tax.TaxMinor
+			if tax.TaxType == TaxTypeVAT {
+				invoice.VATMinor += tax.TaxMinor
+			}
+		}
+	}
+
+	sort.Strings(lineKeys)
+	for _, key := range lineKeys {
+		invoice.Lines = append(invoice.Lines, *lines[key])
+	}
+
+	sort.Strings(taxKeys)
+	invoice.TaxLines = []InvoiceTaxLine{}
+	for _, key := range taxKeys {
+		invoice.TaxLines = append(invoice.TaxLines, *taxes[key])
+	}
+
+	invoice.TotalMinor = invoice.SubtotalMinor + invoice.TaxMinor
+
+	return invoice
+}
+
+// GetInvoice returns an invoice
+func (b *BillingService) GetInvoice(invoiceID string) (*Invoice, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	invoice, ok := b.invoices[invoiceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceNotFound, invoiceID)
+	}
+	found := *invoice
+	return &found, nil
+}
+
+// ListInvoices returns invoices, newest first, optionally for one merchant
+// and period
+func (b *BillingService) ListInvoices(merchantID, period string) []*Invoice {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	invoices := []*Invoice{}
+	for i := len(b.order) - 1; i >= 0; i-- {
+		invoice := b.invoices[b.order[i]]
+		if merchantID != "" && invoice.MerchantID != merchantID {
+			continue
+		}
+		if period != "" && invoice.Period != period {
+			continue
+		}
+		found := *invoice
+		invoices = append(invoices, &found)
+	}
+	return invoices
+}
+
+// SettleInvoice marks an invoice as paid, for example by netting it against
+// a payout
+func (b *BillingService) SettleInvoice(invoiceID, reference string) (*Invoice, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	invoice, ok := b.invoices[invoiceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceNotFound, invoiceID)
+	}
+	if invoice.Status == InvoiceStatusSettled {
+		return nil, fmt.Errorf("invoice %s is already settled", invoice.Number)
+	}
+
+	now := time.Now()
+	settled := *invoice
+	settled.Status = InvoiceStatusSettled
+	settled.SettlementReference = reference
+	settled.SettledAt = &now
+	if err := b.commitLocked(&JournalEntry{Kind: JournalInvoice, Invoice: &settled}); err != nil {
+		return nil, fmt.Errorf("failed to settle invoice %s: %w", invoice.Number, err)
+	}
+
+	return &settled, nil
+}
+
+// OutstandingFees returns what a merchant owes per currency: unsettled
+// invoices plus fees not invoiced yet, tax included. Settlement can net
+// this against payouts.
+func (b *BillingService) OutstandingFees(merchantID string) map[string]int64 {
+	outstanding := make(map[string]int64)
+
+	b.mu.RLock()
+	for _, invoice := range b.invoices {
+		if invoice.MerchantID == merchantID && invoice.Status == InvoiceStatusIssued {
+			outstanding[invoice.Currency] += invoice.TotalMinor
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, calc := range b.pricing.ListCalculations(merchantID, 0) {
+		if calc.InvoiceID == "" {
+			outstanding[calc.Currency] += calc.FeeMinor + calc.TaxMinor
+		}
+	}
+
+	return outstanding
+}
+
+// uninvoicedCalculations returns recorded fees charged in [start, end) that
+// are not on an invoice
+func (s *PricingService) uninvoicedCalculations(start, end time.Time) []*FeeCalculation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var calculations []*FeeCalculation
+	for _, transactionID := range s.order {
+		calc := s.calculations[transactionID]
+		if calc.InvoiceID != "" || calc.ChargedAt.Before(start) || !calc.ChargedAt.Before(end) {
+			continue
+		}
+		found := *calc
+		calculations = append(calculations, &found)
+	}
+	return calculations
+}
+
+// markInvoiced records the invoice that billed fees
+func (s *PricingService) markInvoiced(transactionIDs []string, invoiceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, transactionID := range transactionIDs {
+		if calc, ok := s.calculations[transactionID]; ok {
+			calc.InvoiceID = invoiceID
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal entry kinds
+const (
+	JournalPlan        = "plan"
+	JournalAssignment  = "assignment"
+	JournalCalculation = "calculation"
+	JournalTaxRule     = "tax_rule"
+	JournalAgreement   = "agreement"
+	JournalProfile     = "profile"
+	JournalInvoice     = "invoice"
+)
+
+// maxJournalLine bounds one journal entry
+const maxJournalLine = 4 << 20
+
+// JournalEntry is one change to the pricing or billing records: a plan
+// version, assignment, tax rule or fee recorded, or an agreement, billing
+// profile or invoice saved, replacing the earlier one with the same ID.
+// Monthly and partner volumes are counted again from the fees on replay.
+type JournalEntry struct {
+	Kind        string                 `json:"kind"`
+	Plan        *PricingPlan           `json:"plan,omitempty"`
+	Assignment  *PlanAssignment        `json:"assignment,omitempty"`
+	Calculation *FeeCalculation        `json:"calculation,omitempty"`
+	TaxRule     *TaxRule               `json:"tax_rule,omitempty"`
+	Agreement   *RevenueShareAgreement `json:"agreement,omitempty"`
+	Profile     *BillingProfile        `json:"profile,omitempty"`
+	Invoice     *Invoice               `json:"invoice,omitempty"`
+}
+
+// Journal keeps fees, plans and invoices across restarts
+type Journal interface {
+	Append(entry *JournalEntry) error
+	Replay(fn func(entry *JournalEntry) error) error
+}
+
+// FileJournal appends journal entries as JSON lines to a file, syncing
+// each one before it is acknowledged
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenFileJournal opens the journal at path, creating it if needed
+func OpenFileJournal(path string) (*FileJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &FileJournal{path: path, file: file}, nil
+}
+
+// Append writes an entry and syncs it to disk
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Replay calls fn with every entry in the order they were written. A last
+// line cut short by a crash is cut off so later entries start on a line
+// of their own; a corrupt line elsewhere is an error.
+func (j *FileJournal) Replay(fn func(entry *JournalEntry) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64<<10)
+	var offset int64
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Dropping incomplete last line %d of journal %s", number, j.path)
+				if err := j.file.Truncate(offset); err != nil {
+					return fmt.Errorf("failed to truncate journal: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		if len(line) > maxJournalLine {
+			return fmt.Errorf("journal line %d is too long", number)
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt journal line %d: %w", number, err)
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Close closes the journal file
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// SetJournal loads the pricing records a journal holds and keeps every
+// later change in it. It is called before the service prices anything.
+func (s *PricingService) SetJournal(journal Journal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := journal.Replay(s.applyLocked); err != nil {
+		return fmt.Errorf("failed to load pricing journal: %w", err)
+	}
+	s.journal = journal
+	return nil
+}
+
+// commitLocked writes a change to the journal and then applies it, so
+// nothing is acknowledged that a restart would lose. Callers hold s.mu.
+func (s *PricingService) commitLocked(entry *JournalEntry) error {
+	if s.journal != nil {
+		if err := s.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	return s.applyLocked(entry)
+}
+
+// applyLocked applies a journal entry to the pricing records. Profiles and
+// invoices are written by the billing service and carry the merchant's tax
+// profile and the fees an invoice billed. Callers hold s.mu.
+func (s *PricingService) applyLocked(entry *JournalEntry) error {
+	switch entry.Kind {
+	case JournalPlan:
+		if entry.Plan == nil {
+			return errors.New("journal plan entry has no plan")
+		}
+		plan := *entry.Plan
+		s.plans[plan.ID] = append(s.plans[plan.ID], &plan)
+	case JournalAssignment:
+		if entry.Assignment == nil {
+			return errors.New("journal assignment entry has no assignment")
+		}
+		assignment := *entry.Assignment
+		s.assignments[assignment.MerchantID] = append(s.assignments[assignment.MerchantID], &assignment)
+	case JournalCalculation:
+		if entry.Calculation == nil {
+			return errors.New("journal calculation entry has no calculation")
+		}
+		calc := *entry.Calculation
+		if _, ok := s.calculations[calc.TransactionID]; !ok {
+			s.order = append(s.order, calc.TransactionID)
+			s.volumes[volumeKey(calc.MerchantID, calc.Currency, calc.ChargedAt)] += calc.AmountMinor
+			s.countPartnerVolume(&calc)
+		}
+		s.calculations[calc.TransactionID] = &calc
+	case JournalTaxRule:
+		if entry.TaxRule == nil {
+			return errors.New("journal tax rule entry has no rule")
+		}
+		rule := *entry.TaxRule
+		s.taxRules = append(s.taxRules, &rule)
+	case JournalAgreement:
+		if entry.Agreement == nil {
+			return errors.New("journal agreement entry has no agreement")
+		}
+		agreement := *entry.Agreement
+		for i, existing := range s.agreements {
+			if existing.ID == agreement.ID {
+				s.agreements[i] = &agreement
+				return nil
+			}
+		}
+		s.agreements = append(s.agreements, &agreement)
+	case JournalProfile:
+		if entry.Profile == nil {
+			return errors.New("journal profile entry has no profile")
+		}
+		s.taxProfiles[entry.Profile.MerchantID] = taxProfile{Country: entry.Profile.Country, VATExempt: entry.Profile.VATExempt}
+	case JournalInvoice:
+		if entry.Invoice == nil {
+			return errors.New("journal invoice entry has no invoice")
+		}
+		for _, transactionID := range entry.Invoice.FeeIDs {
+			if calc, ok := s.calculations[transactionID]; ok {
+				calc.InvoiceID = entry.Invoice.ID
+			}
+		}
+	default:
+		return fmt.Errorf("unknown journal entry kind %q", entry.Kind)
+	}
+	return nil
+}
+
+// SetJournal loads the billing profiles and invoices a journal holds and
+// keeps every later change in it. The pricing service shares the journal
+// and loads it first.
+func (b *BillingService) SetJournal(journal Journal) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := journal.Replay(b.applyLocked); err != nil {
+		return fmt.Errorf("failed to load billing journal: %w", err)
+	}
+	b.journal = journal
+	return nil
+}
+
+// commitLocked writes a change to the journal and then applies it. Callers
+// hold b.mu and apply the change to the pricing records after.
+func (b *BillingService) commitLocked(entry *JournalEntry) error {
+	if b.journal != nil {
+		if err := b.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	return b.applyLocked(entry)
+}
+
+// applyLocked applies a journal entry to the billing records, skipping the
+// pricing service's. Callers hold b.mu.
+func (b *BillingService) applyLocked(entry *JournalEntry) error {
+	switch entry.Kind {
+	case JournalProfile:
+		if entry.Profile == nil {
+			return errors.New("journal profile entry has no profile")
+		}
+		profile := *entry.Profile
+		b.profiles[profile.MerchantID] = &profile
+	case JournalInvoice:
+		if entry.Invoice == nil {
+			return errors.New("journal invoice entry has no invoice")
+		}
+		invoice := *entry.Invoice
+		if _, ok := b.invoices[invoice.ID]; !ok {
+			b.order = append(b.order, invoice.ID)
+			b.numbers[invoice.Period]++
+		}
+		b.invoices[invoice.ID] = &invoice
+	}
+	return nil
+}
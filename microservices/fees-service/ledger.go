@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FeeRevenueAccount is the ledger account fees are earned into
+const FeeRevenueAccount = "fee_revenue"
+
+// Ledger posting statuses of a fee
+const (
+	LedgerStatusPosted = "posted"
+	LedgerStatusFailed = "failed"
+)
+
+// PartnerPayableAccount is the ledger account holding the fee shares owed
+// to a partner
+func PartnerPayableAccount(partnerID string) string {
+	return "partner_payable_" + partnerID
+}
+
+// FeesReceivableAccount is the ledger account holding what a merchant owes
+// in fees
+func FeesReceivableAccount(merchantID string) string {
+	return "fees_receivable_" + merchantID
+}
+
+// TaxPayableAccount is the ledger account holding a tax owed to a
+// jurisdiction, e.g. "tax_payable_zw_vat"
+func TaxPayableAccount(jurisdiction, taxType string) string {
+	return "tax_payable_" + strings.ToLower(jurisdiction) + "_" + taxType
+}
+
+// Ledger account types the fee accounts are opened with
+const (
+	AccountTypeAsset     = "asset"
+	AccountTypeLiability = "liability"
+	AccountTypeRevenue   = "revenue"
+)
+
+// LedgerPosting moves an amount from the credit account to the debit
+// account of the ledger. ID identifies the posting to the ledger, so a
+// retried posting is booked once.
+type LedgerPosting struct {
+	ID            string                 `json:"id"`
+	TransactionID string                 `json:"transaction_id"`
+	Description   string                 `json:"description"`
+	Currency      string                 `json:"currency"`
+	AmountMinor   int64                  `json:"amount_minor"`
+	DebitAccount  string                 `json:"debit_account"`
+	CreditAccount string                 `json:"credit_account"`
+	DebitType     string                 `json:"debit_type"`
+	CreditType    string                 `json:"credit_type"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// LedgerPoster posts balanced entries to the ledger
+type LedgerPoster interface {
+	Post(ctx context.Context, posting *LedgerPosting) error
+}
+
+// SetLedgerPoster configures posting of recorded fees to the ledger
+func (s *PricingService) SetLedgerPoster(ledger LedgerPoster) {
+	s.ledger = ledger
+}
+
+// feePosting books a fee as receivable from the merchant and as revenue
+func feePosting(calc *FeeCalculation) *LedgerPosting {
+	return &LedgerPosting{
+		ID:            calc.ID + ":fee",
+		TransactionID: calc.TransactionID,
+		Description:   fmt.Sprintf("%s fee for %s", calc.FeeType, calc.TransactionID),
+		Currency:      calc.Currency,
+		AmountMinor:   calc.FeeMinor,
+		DebitAccount:  FeesReceivableAccount(calc.MerchantID),
+		CreditAccount: FeeRevenueAccount,
+		DebitType:     AccountTypeAsset,
+		CreditType:    AccountTypeRevenue,
+		Metadata: map[string]interface{}{
+			"fee_id":       calc.ID,
+			"merchant_id":  calc.MerchantID,
+			"plan_id":      calc.PlanID,
+			"plan_version": calc.PlanVersion,
+		},
+	}
+}
+
+// taxPosting books a tax line as receivable from the merchant and payable
+// to the jurisdiction
+func taxPosting(calc *FeeCalculation, line *TaxLine) *LedgerPosting {
+	return &LedgerPosting{
+		ID:            calc.ID + ":" + TaxPayableAccount(line.Jurisdiction, line.TaxType),
+		TransactionID: calc.TransactionID,
+		Description:   fmt.Sprintf("%s %s on %s for %s", line.Jurisdiction, strings.ToUpper(line.TaxType), line.Base, calc.TransactionID),
+		Currency:      calc.Currency,
+		AmountMinor:   line.TaxMinor,
+		DebitAccount:  FeesReceivableAccount(calc.MerchantID),
+		CreditAccount: TaxPayableAccount(line.Jurisdiction, line.TaxType),
+		DebitType:     AccountTypeAsset,
+		CreditType:    AccountTypeLiability,
+		Metadata: map[string]interface{}{
+			"fee_id":       calc.ID,
+			"merchant_id":  calc.MerchantID,
+			"tax_rule_id":  line.RuleID,
+			"rate_bps":     line.RateBps,
+			"tax_base":     line.BaseMinor,
+			"jurisdiction": line.Jurisdiction,
+		},
+	}
+}
+
+// splitPosting moves a partner's share of a fee out of fee revenue
+func splitPosting(calc *FeeCalculation, split *FeeSplit) *LedgerPosting {
+	return &LedgerPosting{
+		ID:            calc.ID + ":split:" + split.PartnerID,
+		TransactionID: calc.TransactionID,
+		Description:   fmt.Sprintf("Partner %s share of %s fee for %s", split.PartnerID, calc.FeeType, calc.TransactionID),
+		Currency:      calc.Currency,
+		AmountMinor:   split.AmountMinor,
+		DebitAccount:  FeeRevenueAccount,
+		CreditAccount: PartnerPayableAccount(split.PartnerID),
+		DebitType:     AccountTypeRevenue,
+		CreditType:    AccountTypeLiability,
+		Metadata: map[string]interface{}{
+			"fee_id":       calc.ID,
+			"merchant_id":  calc.MerchantID,
+			"partner_id":   split.PartnerID,
+			"agreement_id": split.AgreementID,
+			"share_bps":    split.ShareBps,
+		},
+	}
+}
+
+// postFee posts a recorded fee, its taxes and partner splits to the ledger. Failures are
+// kept on the calculation so RetryLedgerPostings can post it later; the
+// ledger books each posting ID once, so postings that went through before
+// the failure are not booked again.
+func (s *PricingService) postFee(ctx context.Context, calc *FeeCalculation) {
+	if s.ledger == nil || (calc.FeeMinor == 0 && calc.TaxMinor == 0) {
+		return
+	}
+
+	postings := []*LedgerPosting{}
+	if calc.FeeMinor > 0 {
+		postings = append(postings, feePosting(calc))
+	}
+	for i := range calc.TaxLines {
+		postings = append(postings, taxPosting(calc, &calc.TaxLines[i]))
+	}
+	for i := range calc.Splits {
+		postings = append(postings, splitPosting(calc, &calc.Splits[i]))
+	}
+
+	calc.LedgerStatus = LedgerStatusPosted
+	for _, posting := range postings {
+		if err := s.ledger.Post(ctx, posting); err != nil {
+			log.Printf("Failed to post fee %s for transaction %s to the ledger: %v", calc.ID, calc.TransactionID, err)
+			calc.LedgerStatus = LedgerStatusFailed
+			break
+		}
+	}
+
+	status := calc.LedgerStatus
+	err := s.updateCalculation(calc.TransactionID, func(stored *FeeCalculation) {
+		stored.LedgerStatus = status
+	})
+	if err != nil {
+		log.Printf("Failed to record ledger status of fee %s: %v", calc.ID, err)
+	}
+}
+
+// RetryLedgerPostings posts fees whose ledger posting failed and returns
+// how many were posted
+func (s *PricingService) RetryLedgerPostings(ctx context.Context) int {
+	if s.ledger == nil {
+		return 0
+	}
+
+	s.mu.RLock()
+	var failed []FeeCalculation
+	for _, transactionID := range s.order {
+		if calc := s.calculations[transactionID]; calc.LedgerStatus == LedgerStatusFailed {
+			failed = append(failed, *calc)
+		}
+	}
+	s.mu.RUnlock()
+
+	posted := 0
+	for i := range failed {
+		s.postFee(ctx, &failed[i])
+		if failed[i].LedgerStatus == LedgerStatusPosted {
+			posted++
+		}
+	}
+	return posted
+}
+
+// HTTPLedgerPoster posts to ledger-service over HTTP, each posting as one
+// transfer keyed by the posting ID
+type HTTPLedgerPoster struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPLedgerPoster creates a new ledger client
+func NewHTTPLedgerPoster(baseURL string) *HTTPLedgerPoster {
+	return &HTTPLedgerPoster{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// ledgerTransfer is ledger-service's transfer request; amounts are decimal
+// strings
+type ledgerTransfer struct {
+	TransferID      string                 `json:"transfer_id"`
+	FromAccount     string                 `json:"from_account"`
+	ToAccount       string                 `json:"to_account"`
+	FromAccountType string                 `json:"from_account_type"`
+	ToAccountType   string                 `json:"to_account_type"`
+	Type            string                 `json:"type"`
+	Amount          ledgerMoney            `json:"amount"`
+	Description     string                 `json:"description"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type ledgerMoney struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// Post moves the amount from the credit account to the debit account in
+// one transfer, opening either account if it does not exist yet
+func (c *HTTPLedgerPoster) Post(ctx context.Context, posting *LedgerPosting) error {
+	metadata := map[string]interface{}{"transaction_id": posting.TransactionID, "created_by": "fees-service"}
+	for key, value := range posting.Metadata {
+		metadata[key] = value
+	}
+
+	body, err := json.Marshal(&ledgerTransfer{
+		TransferID:      posting.ID,
+		FromAccount:     posting.CreditAccount,
+		ToAccount:       posting.DebitAccount,
+		FromAccountType: posting.CreditType,
+		ToAccountType:   posting.DebitType,
+		Type:            "fee",
+		Amount:          ledgerMoney{Value: formatMinorUnits(posting.AmountMinor, posting.Currency), Currency: posting.Currency},
+		Description:     posting.Description,
+		Metadata:        metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal transfer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/transfers", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call ledger service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// 200 means the ledger had already booked this posting
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ledger service returned status %d for posting %s", resp.StatusCode, posting.ID)
+	}
+
+	return nil
+}
+
+// formatMinorUnits renders minor units of a currency as a decimal amount,
+// e.g. -1234 USD as "-12.34" and 1234 JPY as "1234"
+func formatMinorUnits(minor int64, currency string) string {
+	return formatDecimal(minor, currencyExponent(currency))
+}
+
+// formatDecimal renders an integer with places implied decimal places
+func formatDecimal(value int64, places int) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	if places == 0 {
+		return fmt.Sprintf("%s%d", sign, value)
+	}
+	scale := int64(1)
+	for i := 0; i < places; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, value/scale, places, value%scale)
+}
@@ -1,34 +1,68 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-type FeeCalculation struct {
-	ID            string    `json:"id"`
-	TransactionID string    `json:"transaction_id"`
-	Amount        float64   `json:"amount"`
-	FeeAmount     float64   `json:"fee_amount"`
-	FeeType       string    `json:"fee_type"`
-	Currency      string    `json:"currency"`
-	CreatedAt     time.Time `json:"created_at"`
-}
+// Global services
+var (
+	pricingService *PricingService
+	billingService *BillingService
+)
 
 func main() {
-	log.Println("Starting Fees Service on port 8092...")
+	port := flag.String("port", "8092", "Port to listen on")
+	flag.Parse()
+
+	log.Printf("Starting Fees Service on port %s...", *port)
+
+	pricingService = NewPricingService()
+	billingService = NewBillingService(pricingService)
+
+	// Fees, plans, tax rules, agreements, billing profiles and invoices are
+	// journaled to disk and reloaded on start; monthly and partner volumes
+	// are counted again from the fees
+	journalPath := getEnv("FEES_JOURNAL_PATH", "data/fees/journal.jsonl")
+	journal, err := OpenFileJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to open fees journal: %v", err)
+	}
+	defer journal.Close()
+	if err := pricingService.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load pricing records: %v", err)
+	}
+	if err := billingService.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load billing records: %v", err)
+	}
+	log.Printf("Journaling fees and invoices to %s", journalPath)
+
+	if ledgerURL := os.Getenv("LEDGER_SERVICE_URL"); ledgerURL != "" {
+		pricingService.SetLedgerPoster(NewHTTPLedgerPoster(ledgerURL))
+		log.Printf("Posting fees to ledger service at %s", ledgerURL)
+	}
+
+	mux := http.NewServeMux()
 
 	// Health endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"fees","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
 	// Status endpoint
-	http.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
 		status := map[string]interface{}{
 			"service": "fees",
 			"status":  "active",
@@ -37,6 +71,12 @@ func main() {
 				"percentage_fees",
 				"fixed_fees",
 				"tiered_fees",
+				"pricing_plans",
+				"ledger_postings",
+				"monthly_invoicing",
+				"tax_rules",
+				"tax_returns",
+				"partner_revenue_share",
 				"currency_conversion",
 			},
 		}
@@ -44,64 +84,626 @@ func main() {
 		json.NewEncoder(w).Encode(status)
 	})
 
-	// Calculate fee endpoint
-	http.HandleFunc("/api/v1/fees/calculate", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	mux.HandleFunc("/api/v1/fees/calculate", handleCalculate)
+	mux.HandleFunc("/api/v1/fees", handleListFees)
+	mux.HandleFunc("/api/v1/fees/", handleGetFee)
+	mux.HandleFunc("/v1/plans", handlePlans)
+	mux.HandleFunc("/v1/plans/", handlePlanByID)
+	mux.HandleFunc("/v1/merchants/", handleMerchantPlan)
+	mux.HandleFunc("/v1/billing/runs", handleBillingRun)
+	mux.HandleFunc("/v1/invoices", handleListInvoices)
+	mux.HandleFunc("/v1/invoices/", handleInvoiceByID)
+	mux.HandleFunc("/v1/tax/rules", handleTaxRules)
+	mux.HandleFunc("/v1/tax/returns", handleTaxReturn)
+	mux.HandleFunc("/v1/partners/", handlePartner)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runLedgerRetry(ctx, time.Minute)
+	go runMonthlyBilling(ctx, time.Hour)
+
+	server := &http.Server{
+		Addr:    ":" + *port,
+		Handler: mux,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
+
+	log.Println("Fees service exited")
+}
+
+// getEnv returns an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// runLedgerRetry periodically re-posts fees the ledger rejected
+func runLedgerRetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if posted := pricingService.RetryLedgerPostings(ctx); posted > 0 {
+				log.Printf("Posted %d fees to the ledger on retry", posted)
+			}
+		}
+	}
+}
+
+// runMonthlyBilling invoices the previous month once it has ended. Billing
+// only picks up uninvoiced fees, so running it every interval is safe.
+func runMonthlyBilling(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous := monthOf(time.Now()).AddDate(0, -1, 0)
+			invoices, err := billingService.RunBilling(previous)
+			if err != nil {
+				log.Printf("Monthly billing for %s failed: %v", previous.Format("2006-01"), err)
+				continue
+			}
+			if len(invoices) > 0 {
+				log.Printf("Issued %d fee invoices for %s", len(invoices), previous.Format("2006-01"))
+			}
+		}
+	}
+}
+
+// handleCalculate prices a transaction with the merchant's plan
+func handleCalculate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req FeeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	calc, err := pricingService.Calculate(r.Context(), &req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrNoPriceRule) {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calc)
+}
+
+// handleListFees lists recorded fee calculations
+func handleListFees(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	fees := pricingService.ListCalculations(r.URL.Query().Get("merchant_id"), limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fees":  fees,
+		"total": len(fees),
+	})
+}
+
+// handleGetFee returns the recorded fee for a transaction
+func handleGetFee(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transactionID := strings.TrimPrefix(r.URL.Path, "/api/v1/fees/")
+	calc, ok := pricingService.GetCalculation(transactionID)
+	if !ok {
+		http.Error(w, "Fee not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(calc)
+}
+
+// handlePlans lists plans and creates new ones
+func handlePlans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pricingService.ListPlans())
+
+	case "POST":
+		var plan PricingPlan
+		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		var request struct {
-			Amount   float64 `json:"amount"`
-			Currency string  `json:"currency"`
-			Type     string  `json:"type"`
+		if _, err := pricingService.GetPlan(plan.ID, 0); err == nil {
+			http.Error(w, "Plan already exists, use PUT to add a version", http.StatusConflict)
+			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		saved, err := pricingService.SavePlan(&plan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Simple fee calculation (2.9% + 0.30)
-		feeAmount := request.Amount*0.029 + 0.30
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(saved)
 
-		response := FeeCalculation{
-			ID:            fmt.Sprintf("fee_%d", time.Now().Unix()),
-			TransactionID: fmt.Sprintf("txn_%d", time.Now().Unix()),
-			Amount:        request.Amount,
-			FeeAmount:     feeAmount,
-			FeeType:       request.Type,
-			Currency:      request.Currency,
-			CreatedAt:     time.Now(),
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePlanByID serves /v1/plans/{id}, /v1/plans/{id}/versions and
+// /v1/plans/{id}/versions/{version}. PUT adds a new version.
+func handlePlanByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/plans/"), "/")
+	planID := parts[0]
+	if planID == "" {
+		http.Error(w, "Plan ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		plan, err := pricingService.GetPlan(planID, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	})
+		json.NewEncoder(w).Encode(plan)
 
-	// List fees endpoint
-	http.HandleFunc("/api/v1/fees", func(w http.ResponseWriter, r *http.Request) {
-		fees := []FeeCalculation{
-			{
-				ID:            "fee_001",
-				TransactionID: "txn_001",
-				Amount:        100.00,
-				FeeAmount:     3.20,
-				FeeType:       "standard",
-				Currency:      "USD",
-				CreatedAt:     time.Now(),
-			},
+	case len(parts) == 1 && r.Method == "PUT":
+		var plan PricingPlan
+		if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		plan.ID = planID
+
+		if _, err := pricingService.GetPlan(planID, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		saved, err := pricingService.SavePlan(&plan)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	case len(parts) == 2 && parts[1] == "versions" && r.Method == "GET":
+		versions, err := pricingService.ListPlanVersions(planID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+
+	case len(parts) == 3 && parts[1] == "versions" && r.Method == "GET":
+		version, err := strconv.Atoi(parts[2])
+		if err != nil || version < 1 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+
+		plan, err := pricingService.GetPlan(planID, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleMerchantPlan serves /v1/merchants/{id}/plan (GET the plan in effect,
+// optionally ?at=RFC3339; POST an assignment), /v1/merchants/{id}/assignments,
+// /v1/merchants/{id}/billing-profile and /v1/merchants/{id}/fees (outstanding
+// fees per currency)
+func handleMerchantPlan(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/merchants/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	merchantID := parts[0]
+
+	switch {
+	case parts[1] == "plan" && r.Method == "GET":
+		at := time.Now()
+		if value := r.URL.Query().Get("at"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid at, expected RFC3339", http.StatusBadRequest)
+				return
+			}
+			at = parsed
+		}
+
+		plan, err := pricingService.PlanFor(merchantID, at)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+
+	case parts[1] == "plan" && r.Method == "POST":
+		var assignment PlanAssignment
+		if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		assignment.MerchantID = merchantID
+
+		saved, err := pricingService.AssignPlan(&assignment)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrPlanNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(saved)
+
+	case parts[1] == "assignments" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pricingService.ListAssignments(merchantID))
+
+	case parts[1] == "billing-profile" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(billingService.GetProfile(merchantID))
+
+	case parts[1] == "billing-profile" && r.Method == "PUT":
+		var profile BillingProfile
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		profile.MerchantID = merchantID
+
+		saved, err := billingService.SaveProfile(&profile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	case parts[1] == "fees" && r.Method == "GET":
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"fees":  fees,
-			"total": len(fees),
+			"merchant_id": merchantID,
+			"outstanding": billingService.OutstandingFees(merchantID),
 		})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleBillingRun invoices a month's fees: {"period": "2026-09"}
+func handleBillingRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Period string `json:"period"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	period, err := time.Parse("2006-01", req.Period)
+	if err != nil {
+		http.Error(w, "Invalid period, expected YYYY-MM", http.StatusBadRequest)
+		return
+	}
+
+	invoices, err := billingService.RunBilling(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"period":   req.Period,
+		"invoices": invoices,
+		"total":    len(invoices),
 	})
+}
+
+// handleListInvoices lists invoices, optionally ?merchant_id= and ?period=
+func handleListInvoices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoices := billingService.ListInvoices(r.URL.Query().Get("merchant_id"), r.URL.Query().Get("period"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invoices": invoices,
+		"total":    len(invoices),
+	})
+}
+
+// handleInvoiceByID serves /v1/invoices/{id}, /v1/invoices/{id}/pdf,
+// /v1/invoices/{id}/csv and POST /v1/invoices/{id}/settle
+func handleInvoiceByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/invoices/"), "/")
+	invoiceID := parts[0]
+	if invoiceID == "" || len(parts) > 2 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	if action == "settle" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Reference string `json:"reference"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		invoice, err := billingService.SettleInvoice(invoiceID, req.Reference)
+		if err != nil {
+			status := http.StatusConflict
+			if errors.Is(err, ErrInvoiceNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invoice)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invoice, err := billingService.GetInvoice(invoiceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invoice)
+
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, invoice.Number))
+		w.Write(InvoicePDF(invoice))
+
+	case "csv":
+		data, err := InvoiceCSV(invoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, invoice.Number))
+		w.Write(data)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleTaxRules lists tax rules, optionally ?jurisdiction=, and adds rules
+// or new versions of them
+func handleTaxRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pricingService.ListTaxRules(r.URL.Query().Get("jurisdiction")))
+
+	case "POST":
+		var rule TaxRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		saved, err := pricingService.AddTaxRule(&rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(saved)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTaxReturn reports the tax collected in a jurisdiction for a month
+// or quarter: ?jurisdiction=ZW&period=2026-Q3
+func handleTaxReturn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jurisdiction := r.URL.Query().Get("jurisdiction")
+	if jurisdiction == "" {
+		jurisdiction = HomeJurisdiction
+	}
+	period := r.URL.Query().Get("period")
+	start, end, err := parseReportPeriod(period)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pricingService.TaxReturn(jurisdiction, period, start, end))
+}
+
+// handlePartner serves /v1/partners/{id}/agreements (GET, POST),
+// POST /v1/partners/{id}/agreements/{agreement_id}/end and
+// /v1/partners/{id}/statement?period=2026-09, optionally &format=csv
+func handlePartner(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/partners/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	partnerID := parts[0]
+
+	switch {
+	case len(parts) == 2 && parts[1] == "agreements" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pricingService.ListAgreements(partnerID))
+
+	case len(parts) == 2 && parts[1] == "agreements" && r.Method == "POST":
+		var agreement RevenueShareAgreement
+		if err := json.NewDecoder(r.Body).Decode(&agreement); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		agreement.PartnerID = partnerID
+
+		saved, err := pricingService.CreateAgreement(&agreement)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(saved)
+
+	case len(parts) == 4 && parts[1] == "agreements" && parts[3] == "end" && r.Method == "POST":
+		var req struct {
+			EffectiveTo time.Time `json:"effective_to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.EffectiveTo.IsZero() {
+			req.EffectiveTo = time.Now()
+		}
+
+		agreement, err := pricingService.EndAgreement(parts[2], req.EffectiveTo)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrAgreementNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agreement)
+
+	case len(parts) == 2 && parts[1] == "statement" && r.Method == "GET":
+		period := r.URL.Query().Get("period")
+		start, end, err := parseReportPeriod(period)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		statement := pricingService.CommissionStatement(partnerID, period, start, end)
+
+		if r.URL.Query().Get("format") == "csv" {
+			data, err := StatementCSV(statement)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="commission-%s-%s.csv"`, partnerID, period))
+			w.Write(data)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statement)
 
-	log.Println("Fees service listening on port 8092")
-	if err := http.ListenAndServe(":8092", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
 	}
 }
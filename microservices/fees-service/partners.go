@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrAgreementNotFound is returned for unknown revenue-share agreements
+var ErrAgreementNotFound = errors.New("revenue-share agreement not found")
+
+// ShareTier pays ShareBps of a fee while the partner's fees for the month
+// are below UpToMinor. The last tier may leave UpToMinor at 0 for no bound.
+type ShareTier struct {
+	UpToMinor int64 `json:"up_to_minor,omitempty"`
+	ShareBps  int64 `json:"share_bps"`
+}
+
+// RevenueShareAgreement gives a partner a share of the fees collected from
+// the merchants it brought: a percentage of each fee, tiered on the
+// partner's monthly fee volume when Tiers are set, plus a bounty per
+// transaction in BountyCurrency. A fee can be shared with several partners
+// but never beyond the fee itself.
+type RevenueShareAgreement struct {
+	ID             string      `json:"id"`
+	PartnerID      string      `json:"partner_id"`
+	PartnerName    string      `json:"partner_name,omitempty"`
+	MerchantIDs    []string    `json:"merchant_ids"`
+	FeeType        string      `json:"fee_type,omitempty"` // empty shares every fee type
+	ShareBps       int64       `json:"share_bps,omitempty"`
+	Tiers          []ShareTier `json:"tiers,omitempty"`
+	BountyMinor    int64       `json:"bounty_minor,omitempty"`
+	BountyCurrency string      `json:"bounty_currency,omitempty"`
+	EffectiveFrom  time.Time   `json:"effective_from"`
+	EffectiveTo    *time.Time  `json:"effective_to,omitempty"`
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// FeeSplit is a partner's share of a fee
+type FeeSplit struct {
+	AgreementID string `json:"agreement_id"`
+	PartnerID   string `json:"partner_id"`
+	ShareBps    int64  `json:"share_bps"`
+	Tier        int    `json:"tier,omitempty"` // 1-based share tier, 0 without tiers
+	BountyMinor int64  `json:"bounty_minor,omitempty"`
+	AmountMinor int64  `json:"amount_minor"`
+	Capped      bool   `json:"capped,omitempty"` // cut back to what was left of the fee
+}
+
+// StatementLine totals a partner's commission on one merchant's fees in one
+// currency
+type StatementLine struct {
+	MerchantID  string `json:"merchant_id"`
+	Currency    string `json:"currency"`
+	Count       int    `json:"count"`
+	VolumeMinor int64  `json:"volume_minor"`
+	FeeMinor    int64  `json:"fee_minor"`
+	ShareMinor  int64  `json:"share_minor"`
+}
+
+// CommissionStatement is what a partner earned over a period
+type CommissionStatement struct {
+	PartnerID   string           `json:"partner_id"`
+	Period      string           `json:"period"`
+	PeriodStart time.Time        `json:"period_start"`
+	PeriodEnd   time.Time        `json:"period_end"`
+	Lines       []StatementLine  `json:"lines"`
+	Totals      map[string]int64 `json:"totals"` // commission per currency
+	GeneratedAt time.Time        `json:"generated_at"`
+}
+
+// activeAt reports whether the agreement applies at t
+func (a *RevenueShareAgreement) activeAt(t time.Time) bool {
+	if t.Before(a.EffectiveFrom) {
+		return false
+	}
+	return a.EffectiveTo == nil || t.Before(*a.EffectiveTo)
+}
+
+// covers reports whether the agreement shares the fee
+func (a *RevenueShareAgreement) covers(calc *FeeCalculation) bool {
+	if a.FeeType != "" && a.FeeType != calc.FeeType {
+		return false
+	}
+	if !a.activeAt(calc.ChargedAt) {
+		return false
+	}
+	for _, merchantID := range a.MerchantIDs {
+		if merchantID == calc.MerchantID {
+			return true
+		}
+	}
+	return false
+}
+
+// shareFor returns the share of a fee for the partner's monthly fee volume
+// and the 1-based tier it came from
+func (a *RevenueShareAgreement) shareFor(monthlyFees int64) (int64, int) {
+	for i, tier := range a.Tiers {
+		if tier.UpToMinor == 0 || monthlyFees < tier.UpToMinor {
+			return tier.ShareBps, i + 1
+		}
+	}
+	return a.ShareBps, 0
+}
+
+// CreateAgreement stores a revenue-share agreement
+func (s *PricingService) CreateAgreement(agreement *RevenueShareAgreement) (*RevenueShareAgreement, error) {
+	stored := *agreement
+	stored.MerchantIDs = append([]string(nil), agreement.MerchantIDs...)
+	stored.Tiers = append([]ShareTier(nil), agreement.Tiers...)
+	if err := validateAgreement(&stored); err != nil {
+		return nil, fmt.Errorf("invalid agreement: %w", err)
+	}
+
+	stored.ID = generateID("rsa")
+	stored.CreatedAt = time.Now()
+	if stored.EffectiveFrom.IsZero() {
+		stored.EffectiveFrom = stored.CreatedAt
+	}
+	if stored.EffectiveTo != nil && !stored.EffectiveTo.After(stored.EffectiveFrom) {
+		return nil, errors.New("effective_to must be after effective_from")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalAgreement, Agreement: &stored}); err != nil {
+		return nil, fmt.Errorf("failed to save agreement: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// EndAgreement stops an agreement sharing fees charged from at onwards
+func (s *PricingService) EndAgreement(agreementID string, at time.Time) (*RevenueShareAgreement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, agreement := range s.agreements {
+		if agreement.ID != agreementID {
+			continue
+		}
+		if !at.After(agreement.EffectiveFrom) {
+			return nil, errors.New("end must be after the agreement's effective_from")
+		}
+		if agreement.EffectiveTo != nil && agreement.EffectiveTo.Before(at) {
+			return nil, fmt.Errorf("agreement %s already ended", agreementID)
+		}
+		ended := *agreement
+		ended.EffectiveTo = &at
+		if err := s.commitLocked(&JournalEntry{Kind: JournalAgreement, Agreement: &ended}); err != nil {
+			return nil, fmt.Errorf("failed to end agreement: %w", err)
+		}
+		found := ended
+		return &found, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrAgreementNotFound, agreementID)
+}
+
+// ListAgreements returns agreements, optionally for one partner, oldest
+// first
+func (s *PricingService) ListAgreements(partnerID string) []*RevenueShareAgreement {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	agreements := []*RevenueShareAgreement{}
+	for _, agreement := range s.agreements {
+		if partnerID == "" || agreement.PartnerID == partnerID {
+			found := *agreement
+			agreements = append(agreements, &found)
+		}
+	}
+	return agreements
+}
+
+// partnerVolumeKey keys a partner's fee volume for a month
+func partnerVolumeKey(partnerID, currency string, t time.Time) string {
+	return fmt.Sprintf("%s|%s|%s", partnerID, currency, t.UTC().Format("2006-01"))
+}
+
+// applySplits shares a priced fee with the partners whose agreements cover
+// it, in the order the agreements were made. Callers hold s.mu.
+func (s *PricingService) applySplits(calc *FeeCalculation) {
+	calc.Splits = nil
+	calc.PlatformFeeMinor = calc.FeeMinor
+
+	for _, agreement := range s.agreements {
+		if calc.PlatformFeeMinor == 0 {
+			break
+		}
+		if !agreement.covers(calc) {
+			continue
+		}
+
+		bps, tier := agreement.shareFor(s.partnerVolumes[partnerVolumeKey(agreement.PartnerID, calc.Currency, calc.ChargedAt)])
+		split := FeeSplit{
+			AgreementID: agreement.ID,
+			PartnerID:   agreement.PartnerID,
+			ShareBps:    bps,
+			Tier:        tier,
+			AmountMinor: roundBps(calc.FeeMinor, bps, RoundingDown),
+		}
+		if agreement.BountyMinor > 0 && agreement.BountyCurrency == calc.Currency {
+			split.BountyMinor = agreement.BountyMinor
+			split.AmountMinor += agreement.BountyMinor
+		}
+		if split.AmountMinor > calc.PlatformFeeMinor {
+			split.AmountMinor = calc.PlatformFeeMinor
+			split.Capped = true
+		}
+		if split.AmountMinor == 0 {
+			continue
+		}
+
+		calc.Splits = append(calc.Splits, split)
+		calc.PlatformFeeMinor -= split.AmountMinor
+	}
+}
+
+// countPartnerVolume adds a recorded fee to its partners' monthly fee
+// volume. Callers hold s.mu.
+func (s *PricingService) countPartnerVolume(calc *FeeCalculation) {
+	for _, split := range calc.Splits {
+		s.partnerVolumes[partnerVolumeKey(split.PartnerID, calc.Currency, calc.ChargedAt)] += calc.FeeMinor
+	}
+}
+
+// CommissionStatement totals a partner's share of the fees charged in
+// [start, end)
+func (s *PricingService) CommissionStatement(partnerID, period string, start, end time.Time) *CommissionStatement {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lines := make(map[string]*StatementLine)
+	var keys []string
+	for _, transactionID := range s.order {
+		calc := s.calculations[transactionID]
+		if calc.ChargedAt.Before(start) || !calc.ChargedAt.Before(end) {
+			continue
+		}
+		for _, split := range calc.Splits {
+			if split.PartnerID != partnerID {
+				continue
+			}
+			key := calc.MerchantID + "|" + calc.Currency
+			line, ok := lines[key]
+			if !ok {
+				line = &StatementLine{MerchantID: calc.MerchantID, Currency: calc.Currency}
+				lines[key] = line
+				keys = append(keys, key)
+			}
+			line.Count++
+			line.VolumeMinor += calc.AmountMinor
+			line.FeeMinor += calc.FeeMinor
+			line.ShareMinor += split.AmountMinor
+		}
+	}
+
+	statement := &CommissionStatement{
+		PartnerID:   partnerID,
+		Period:      period,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Lines:       []StatementLine{},
+		Totals:      make(map[string]int64),
+		GeneratedAt: time.Now(),
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line := lines[key]
+		statement.Lines = append(statement.Lines, *line)
+		statement.Totals[line.Currency] += line.ShareMinor
+	}
+	return statement
+}
+
+// validateAgreement checks an agreement before it is stored
+func validateAgreement(agreement *RevenueShareAgreement) error {
+	if agreement.PartnerID == "" {
+		return errors.New("partner_id is required")
+	}
+	if len(agreement.MerchantIDs) == 0 {
+		return errors.New("agreement needs at least one merchant")
+	}
+	if agreement.ShareBps < 0 || agreement.ShareBps > 10000 {
+		return fmt.Errorf("share_bps must be between 0 and 10000, got %d", agreement.ShareBps)
+	}
+	if agreement.BountyMinor < 0 {
+		return errors.New("bounty cannot be negative")
+	}
+	agreement.BountyCurrency = strings.ToUpper(agreement.BountyCurrency)
+	if agreement.BountyMinor > 0 && len(agreement.BountyCurrency) != 3 {
+		return fmt.Errorf("invalid bounty currency: %q", agreement.BountyCurrency)
+	}
+	if agreement.ShareBps == 0 && agreement.BountyMinor == 0 && len(agreement.Tiers) == 0 {
+		return errors.New("agreement shares nothing: set share_bps, tiers or a bounty")
+	}
+
+	var previous int64
+	for i, tier := range agreement.Tiers {
+		if tier.ShareBps < 0 || tier.ShareBps > 10000 {
+			return fmt.Errorf("tier %d: share_bps must be between 0 and 10000, got %d", i+1, tier.ShareBps)
+		}
+		if tier.UpToMinor == 0 && i != len(agreement.Tiers)-1 {
+			return fmt.Errorf("tier %d: only the last tier can be unbounded", i+1)
+		}
+		if tier.UpToMinor != 0 && tier.UpToMinor <= previous {
+			return fmt.Errorf("tier %d: tiers must be in ascending order", i+1)
+		}
+		previous = tier.UpToMinor
+	}
+
+	return nil
+}
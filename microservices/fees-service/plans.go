@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PricingService stores versioned pricing plans and merchant assignments and
+// prices transactions with them. Monthly volume for tiered pricing is
+// counted from calculations that carry a transaction ID.
+type PricingService struct {
+	mu           sync.RWMutex
+	plans        map[string][]*PricingPlan // by plan ID, in version order
+	assignments  map[string][]*PlanAssignment
+	volumes      map[string]int64           // merchant|currency|month -> minor units
+	calculations map[string]*FeeCalculation // by transaction ID
+	order        []string
+	taxRules     []*TaxRule
+	taxProfiles  map[string]taxProfile
+	agreements   []*RevenueShareAgreement
+	// partner|currency|month -> fees shared with the partner, in minor units
+	partnerVolumes map[string]int64
+	ledger         LedgerPoster
+	journal        Journal
+}
+
+// NewPricingService creates a pricing service with the default plan
+func NewPricingService() *PricingService {
+	s := &PricingService{
+		plans:          make(map[string][]*PricingPlan),
+		assignments:    make(map[string][]*PlanAssignment),
+		volumes:        make(map[string]int64),
+		calculations:   make(map[string]*FeeCalculation),
+		taxRules:       DefaultTaxRules(),
+		taxProfiles:    make(map[string]taxProfile),
+		partnerVolumes: make(map[string]int64),
+	}
+	s.plans[DefaultPlanID] = []*PricingPlan{DefaultPricingPlan()}
+	return s
+}
+
+// SavePlan stores a new version of a plan and returns it
+func (s *PricingService) SavePlan(plan *PricingPlan) (*PricingPlan, error) {
+	stored := *plan
+	stored.Rules = append([]PriceRule(nil), plan.Rules...)
+	for i := range stored.Rules {
+		stored.Rules[i].Tiers = append([]VolumeTier(nil), stored.Rules[i].Tiers...)
+	}
+	if err := validatePlan(&stored); err != nil {
+		return nil, fmt.Errorf("invalid plan: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions := s.plans[stored.ID]
+	if stored.Name == "" && len(versions) > 0 {
+		stored.Name = versions[len(versions)-1].Name
+	}
+	stored.Version = len(versions) + 1
+	stored.CreatedAt = time.Now()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalPlan, Plan: &stored}); err != nil {
+		return nil, fmt.Errorf("failed to save plan: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// GetPlan returns a plan version; version 0 is the latest
+func (s *PricingService) GetPlan(planID string, version int) (*PricingPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.plans[planID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPlanNotFound, planID)
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	if version < 0 || version > len(versions) {
+		return nil, fmt.Errorf("%w: %s v%d", ErrPlanNotFound, planID, version)
+	}
+	return versions[version-1], nil
+}
+
+// ListPlans returns the latest version of every plan
+func (s *PricingService) ListPlans() []*PricingPlan {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plans := make([]*PricingPlan, 0, len(s.plans))
+	for _, versions := range s.plans {
+		plans = append(plans, versions[len(versions)-1])
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].ID < plans[j].ID
+	})
+	return plans
+}
+
+// ListPlanVersions returns every version of a plan
+func (s *PricingService) ListPlanVersions(planID string) ([]*PricingPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.plans[planID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPlanNotFound, planID)
+	}
+	return append([]*PricingPlan(nil), versions...), nil
+}
+
+// AssignPlan puts a merchant on a plan from the assignment's effective date
+func (s *PricingService) AssignPlan(assignment *PlanAssignment) (*PlanAssignment, error) {
+	if assignment.MerchantID == "" {
+		return nil, errors.New("merchant_id is required")
+	}
+	if _, err := s.GetPlan(assignment.PlanID, assignment.PlanVersion); err != nil {
+		return nil, err
+	}
+
+	stored := *assignment
+	stored.ID = generateID("pa")
+	stored.CreatedAt = time.Now()
+	if stored.EffectiveFrom.IsZero() {
+		stored.EffectiveFrom = stored.CreatedAt
+	}
+	if stored.EffectiveTo != nil && !stored.EffectiveTo.After(stored.EffectiveFrom) {
+		return nil, errors.New("effective_to must be after effective_from")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalAssignment, Assignment: &stored}); err != nil {
+		return nil, fmt.Errorf("failed to save assignment: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// ListAssignments returns a merchant's plan assignments
+func (s *PricingService) ListAssignments(merchantID string) []*PlanAssignment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*PlanAssignment(nil), s.assignments[merchantID]...)
+}
+
+// PlanFor returns the plan version that prices a merchant's transactions at
+// t. The latest assignment in effect wins; merchants without one are on the
+// default plan. Unpinned assignments use the latest version as of t.
+func (s *PricingService) PlanFor(merchantID string, t time.Time) (*PricingPlan, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	planID, version := DefaultPlanID, 0
+	var current *PlanAssignment
+	for _, assignment := range s.assignments[merchantID] {
+		if !assignment.activeAt(t) {
+			continue
+		}
+		if current == nil || !assignment.EffectiveFrom.Before(current.EffectiveFrom) {
+			current = assignment
+		}
+	}
+	if current != nil {
+		planID, version = current.PlanID, current.PlanVersion
+	}
+
+	versions := s.plans[planID]
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPlanNotFound, planID)
+	}
+	if version > 0 {
+		if version > len(versions) {
+			return nil, fmt.Errorf("%w: %s v%d", ErrPlanNotFound, planID, version)
+		}
+		return versions[version-1], nil
+	}
+
+	plan := versions[0]
+	for _, candidate := range versions[1:] {
+		if candidate.CreatedAt.After(t) {
+			break
+		}
+		plan = candidate
+	}
+	return plan, nil
+}
+
+// Calculate prices and taxes a transaction and splits its fee with
+// partners. With a transaction ID the amount counts towards the merchant's
+// monthly volume, once per transaction, and the fee, its taxes and splits
+// are recorded and posted to the ledger; asking again returns the recorded
+// calculation.
+func (s *PricingService) Calculate(ctx context.Context, req *FeeRequest) (*FeeCalculation, error) {
+	if err := normalizeFeeRequest(req); err != nil {
+		return nil, err
+	}
+
+	if existing, ok := s.GetCalculation(req.TransactionID); ok {
+		return existing, nil
+	}
+
+	plan, err := s.PlanFor(req.MerchantID, req.At)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := plan.matchRule(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if existing, ok := s.calculations[req.TransactionID]; ok && req.TransactionID != "" {
+		s.mu.Unlock()
+		found := *existing
+		return &found, nil
+	}
+
+	calc := &FeeCalculation{
+		ID:                 generateID("fee"),
+		TransactionID:      req.TransactionID,
+		MerchantID:         req.MerchantID,
+		FeeType:            req.Type,
+		Method:             req.Method,
+		Currency:           req.Currency,
+		Region:             req.Region,
+		AmountMinor:        req.AmountMinor,
+		PlanID:             plan.ID,
+		PlanVersion:        plan.Version,
+		MonthlyVolumeMinor: s.volumes[volumeKey(req.MerchantID, req.Currency, req.At)],
+		ChargedAt:          req.At,
+		CreatedAt:          time.Now(),
+	}
+	rule.price(calc)
+	s.applyTaxes(calc, req)
+	s.applySplits(calc)
+	calc.Amount = majorUnits(calc.AmountMinor, calc.Currency)
+	calc.FeeAmount = majorUnits(calc.FeeMinor, calc.Currency)
+
+	if req.TransactionID == "" {
+		s.mu.Unlock()
+		return calc, nil
+	}
+
+	stored := *calc
+	stored.TaxLines = append([]TaxLine(nil), calc.TaxLines...)
+	stored.Splits = append([]FeeSplit(nil), calc.Splits...)
+	err = s.commitLocked(&JournalEntry{Kind: JournalCalculation, Calculation: &stored})
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record fee: %w", err)
+	}
+
+	s.postFee(ctx, calc)
+	return calc, nil
+}
+
+// GetCalculation returns the recorded calculation for a transaction
+func (s *PricingService) GetCalculation(transactionID string) (*FeeCalculation, bool) {
+	if transactionID == "" {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	calc, ok := s.calculations[transactionID]
+	if !ok {
+		return nil, false
+	}
+	found := *calc
+	return &found, true
+}
+
+// ListCalculations returns recorded calculations, newest first, optionally
+// for one merchant
+func (s *PricingService) ListCalculations(merchantID string, limit int) []*FeeCalculation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	calculations := []*FeeCalculation{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		calc := s.calculations[s.order[i]]
+		if merchantID != "" && calc.MerchantID != merchantID {
+			continue
+		}
+		found := *calc
+		calculations = append(calculations, &found)
+		if limit > 0 && len(calculations) == limit {
+			break
+		}
+	}
+	return calculations
+}
+
+// updateCalculation applies fn to a copy of a recorded calculation and
+// records the copy
+func (s *PricingService) updateCalculation(transactionID string, fn func(calc *FeeCalculation)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calc, ok := s.calculations[transactionID]
+	if !ok {
+		return nil
+	}
+	updated := *calc
+	fn(&updated)
+	return s.commitLocked(&JournalEntry{Kind: JournalCalculation, Calculation: &updated})
+}
+
+// volumeKey keys a merchant's transaction volume for a month
+func volumeKey(merchantID, currency string, t time.Time) string {
+	return fmt.Sprintf("%s|%s|%s", merchantID, currency, t.UTC().Format("2006-01"))
+}
+
+// lastID keeps generated IDs unique when the clock does not advance
+// between calls
+var lastID int64
+
+// generateID returns a unique ID with the given prefix
+func generateID(prefix string) string {
+	for {
+		last := atomic.LoadInt64(&lastID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, next) {
+			return fmt.Sprintf("%s_%d", prefix, next)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Amounts in pricing are in minor units of their currency and rates in
+// basis points, so the same inputs always produce the same fee.
+
+// currencyExponents lists the ISO 4217 minor unit exponents of currencies
+// whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyExponent returns the number of minor unit digits of a currency
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// majorUnits converts minor units of a currency to a major unit amount
+func majorUnits(minor int64, currency string) float64 {
+	return float64(minor) / math.Pow10(currencyExponent(currency))
+}
+
+// Fee types priced by the engine
+const (
+	FeeTypePayment = "payment"
+	FeeTypeEscrow  = "escrow"
+)
+
+// DefaultPlanID is the plan used for merchants without an assignment
+const DefaultPlanID = "standard"
+
+var (
+	// ErrPlanNotFound is returned for unknown plans and versions
+	ErrPlanNotFound = errors.New("pricing plan not found")
+	// ErrNoPriceRule is returned when no rule of the plan prices a transaction
+	ErrNoPriceRule = errors.New("no price rule matches")
+)
+
+// VolumeTier prices transactions while the merchant's volume for the month
+// is below UpToMinor. The last tier may leave UpToMinor at 0 for no bound;
+// otherwise volume beyond it is priced at the rule's own rate.
+type VolumeTier struct {
+	UpToMinor     int64 `json:"up_to_minor,omitempty"`
+	PercentageBps int64 `json:"percentage_bps"`
+	FixedMinor    int64 `json:"fixed_minor,omitempty"`
+}
+
+// PriceRule prices the transactions it matches. Empty match fields match
+// anything; the most specific matching rule wins.
+type PriceRule struct {
+	ID            string       `json:"id"`
+	FeeType       string       `json:"fee_type,omitempty"`
+	Method        string       `json:"method,omitempty"`
+	Currency      string       `json:"currency,omitempty"`
+	Region        string       `json:"region,omitempty"`
+	PercentageBps int64        `json:"percentage_bps"`
+	FixedMinor    int64        `json:"fixed_minor,omitempty"`
+	MinFeeMinor   int64        `json:"min_fee_minor,omitempty"`
+	MaxFeeMinor   int64        `json:"max_fee_minor,omitempty"` // 0 is uncapped
+	Tiers         []VolumeTier `json:"tiers,omitempty"`
+}
+
+// PricingPlan is one version of a pricing plan. Versions are never changed;
+// updating a plan adds a version.
+type PricingPlan struct {
+	ID          string      `json:"id"`
+	Version     int         `json:"version"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Rules       []PriceRule `json:"rules"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// PlanAssignment puts a merchant on a plan from EffectiveFrom until
+// EffectiveTo. A zero PlanVersion follows the plan's latest version.
+type PlanAssignment struct {
+	ID            string     `json:"id"`
+	MerchantID    string     `json:"merchant_id"`
+	PlanID        string     `json:"plan_id"`
+	PlanVersion   int        `json:"plan_version,omitempty"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// activeAt reports whether the assignment applies at t
+func (a *PlanAssignment) activeAt(t time.Time) bool {
+	if t.Before(a.EffectiveFrom) {
+		return false
+	}
+	return a.EffectiveTo == nil || t.Before(*a.EffectiveTo)
+}
+
+// FeeRequest asks for the fee of a transaction
+type FeeRequest struct {
+	MerchantID    string    `json:"merchant_id,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty"` // counts the amount towards monthly volume
+	Type          string    `json:"type"`
+	Method        string    `json:"method,omitempty"`
+	Currency      string    `json:"currency"`
+	Region        string    `json:"region,omitempty"`
+	Jurisdiction  string    `json:"jurisdiction,omitempty"` // tax country, defaults to the merchant's
+	Amount        float64   `json:"amount,omitempty"`       // major units, used when AmountMinor is 0
+	AmountMinor   int64     `json:"amount_minor,omitempty"`
+	At            time.Time `json:"at,omitempty"`
+}
+
+// FeeCalculation is a priced transaction and how its fee was reached
+type FeeCalculation struct {
+	ID                 string     `json:"id"`
+	TransactionID      string     `json:"transaction_id,omitempty"`
+	MerchantID         string     `json:"merchant_id,omitempty"`
+	Amount             float64    `json:"amount"`
+	FeeAmount          float64    `json:"fee_amount"`
+	FeeType            string     `json:"fee_type"`
+	Method             string     `json:"method,omitempty"`
+	Currency           string     `json:"currency"`
+	Region             string     `json:"region,omitempty"`
+	AmountMinor        int64      `json:"amount_minor"`
+	FeeMinor           int64      `json:"fee_minor"`
+	PlanID             string     `json:"plan_id"`
+	PlanVersion        int        `json:"plan_version"`
+	RuleID             string     `json:"rule_id"`
+	PercentageBps      int64      `json:"percentage_bps"`
+	FixedMinor         int64      `json:"fixed_minor"`
+	Tier               int        `json:"tier,omitempty"` // 1-based volume tier, 0 without tiers
+	MonthlyVolumeMinor int64      `json:"monthly_volume_minor"`
+	CappedBy           string     `json:"capped_by,omitempty"` // min or max
+	Jurisdiction       string     `json:"jurisdiction"`
+	TaxLines           []TaxLine  `json:"tax_lines,omitempty"`
+	TaxMinor           int64      `json:"tax_minor"`
+	Splits             []FeeSplit `json:"splits,omitempty"`
+	PlatformFeeMinor   int64      `json:"platform_fee_minor"` // fee left after partner shares
+	ChargedAt          time.Time  `json:"charged_at"`
+	LedgerStatus       string     `json:"ledger_status,omitempty"` // posted, failed
+	InvoiceID          string     `json:"invoice_id,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+// DefaultPricingPlan returns the standard plan: card-style pricing for
+// payments by method and 2.5% for escrow, each with a minimum and a cap
+func DefaultPricingPlan() *PricingPlan {
+	payment := func(id, method string, bps int64) PriceRule {
+		return PriceRule{ID: id, FeeType: FeeTypePayment, Method: method, PercentageBps: bps, FixedMinor: 30, MinFeeMinor: 50, MaxFeeMinor: 50000}
+	}
+
+	return &PricingPlan{
+		ID:          DefaultPlanID,
+		Version:     1,
+		Name:        "Standard",
+		Description: "Default pricing for merchants without a negotiated plan",
+		Rules: []PriceRule{
+			{ID: "default", PercentageBps: 290, FixedMinor: 30},
+			payment("payment", "", 290),
+			payment("payment_debit_card", "debit_card", 240),
+			payment("payment_bank_transfer", "bank_transfer", 80),
+			payment("payment_ach", "ach", 80),
+			payment("payment_wire_transfer", "wire_transfer", 150),
+			payment("payment_paypal", "paypal", 340),
+			{ID: "escrow", FeeType: FeeTypeEscrow, PercentageBps: 250, MinFeeMinor: 100, MaxFeeMinor: 10000},
+		},
+	}
+}
+
+// specificity ranks a rule by how many match fields it sets
+func (r *PriceRule) specificity() int {
+	n := 0
+	for _, field := range []string{r.FeeType, r.Method, r.Currency, r.Region} {
+		if field != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// matches reports whether the rule prices the request
+func (r *PriceRule) matches(req *FeeRequest) bool {
+	return (r.FeeType == "" || r.FeeType == req.Type) &&
+		(r.Method == "" || r.Method == req.Method) &&
+		(r.Currency == "" || r.Currency == req.Currency) &&
+		(r.Region == "" || r.Region == req.Region)
+}
+
+// matchRule returns the most specific rule matching the request; between
+// equally specific rules the first one wins
+func (p *PricingPlan) matchRule(req *FeeRequest) (*PriceRule, error) {
+	var best *PriceRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(req) {
+			continue
+		}
+		if best == nil || rule.specificity() > best.specificity() {
+			best = rule
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%w: plan %s v%d, type %s, method %s, currency %s, region %s",
+			ErrNoPriceRule, p.ID, p.Version, req.Type, req.Method, req.Currency, req.Region)
+	}
+	return best, nil
+}
+
+// rateFor returns the percentage and fixed fee for a monthly volume and
+// the 1-based tier they came from
+func (r *PriceRule) rateFor(monthlyVolume int64) (int64, int64, int) {
+	for i, tier := range r.Tiers {
+		if tier.UpToMinor == 0 || monthlyVolume < tier.UpToMinor {
+			return tier.PercentageBps, tier.FixedMinor, i + 1
+		}
+	}
+	return r.PercentageBps, r.FixedMinor, 0
+}
+
+// price computes the fee for an amount under the rule
+func (r *PriceRule) price(calc *FeeCalculation) {
+	bps, fixed, tier := r.rateFor(calc.MonthlyVolumeMinor)
+	calc.RuleID = r.ID
+	calc.PercentageBps = bps
+	calc.FixedMinor = fixed
+	calc.Tier = tier
+
+	// Round half up to the nearest minor unit
+	fee := (calc.AmountMinor*bps+5000)/10000 + fixed
+
+	if r.MinFeeMinor > 0 && fee < r.MinFeeMinor {
+		fee = r.MinFeeMinor
+		calc.CappedBy = "min"
+	}
+	if r.MaxFeeMinor > 0 && fee > r.MaxFeeMinor {
+		fee = r.MaxFeeMinor
+		calc.CappedBy = "max"
+	}
+	calc.FeeMinor = fee
+}
+
+// validatePlan checks a plan's rules before it is stored
+func validatePlan(plan *PricingPlan) error {
+	if plan.ID == "" {
+		return errors.New("plan id is required")
+	}
+	if len(plan.Rules) == 0 {
+		return errors.New("plan needs at least one rule")
+	}
+
+	seen := make(map[string]bool)
+	for i := range plan.Rules {
+		rule := &plan.Rules[i]
+		if rule.ID == "" {
+			return fmt.Errorf("rule %d: id is required", i)
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("rule %s: duplicate id", rule.ID)
+		}
+		seen[rule.ID] = true
+
+		rule.Currency = strings.ToUpper(rule.Currency)
+		rule.Region = strings.ToUpper(rule.Region)
+		if rule.Currency != "" && len(rule.Currency) != 3 {
+			return fmt.Errorf("rule %s: invalid currency %s", rule.ID, rule.Currency)
+		}
+		if err := validateRate(rule.PercentageBps, rule.FixedMinor); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+		if rule.MinFeeMinor < 0 || rule.MaxFeeMinor < 0 {
+			return fmt.Errorf("rule %s: fee caps cannot be negative", rule.ID)
+		}
+		if rule.MaxFeeMinor > 0 && rule.MinFeeMinor > rule.MaxFeeMinor {
+			return fmt.Errorf("rule %s: minimum fee above maximum", rule.ID)
+		}
+
+		var previous int64
+		for j, tier := range rule.Tiers {
+			if err := validateRate(tier.PercentageBps, tier.FixedMinor); err != nil {
+				return fmt.Errorf("rule %s tier %d: %w", rule.ID, j+1, err)
+			}
+			if tier.UpToMinor == 0 && j != len(rule.Tiers)-1 {
+				return fmt.Errorf("rule %s tier %d: only the last tier can be unbounded", rule.ID, j+1)
+			}
+			if tier.UpToMinor != 0 && tier.UpToMinor <= previous {
+				return fmt.Errorf("rule %s tier %d: tiers must be in ascending order", rule.ID, j+1)
+			}
+			previous = tier.UpToMinor
+		}
+	}
+
+	return nil
+}
+
+// validateRate checks a percentage and fixed fee
+func validateRate(bps, fixed int64) error {
+	if bps < 0 || bps > 10000 {
+		return fmt.Errorf("percentage_bps must be between 0 and 10000, got %d", bps)
+	}
+	if fixed < 0 {
+		return fmt.Errorf("fixed fee cannot be negative, got %d", fixed)
+	}
+	return nil
+}
+
+// normalizeFeeRequest fills defaults and checks a fee request
+func normalizeFeeRequest(req *FeeRequest) error {
+	if req.Type == "" {
+		req.Type = FeeTypePayment
+	}
+	req.Currency = strings.ToUpper(req.Currency)
+	req.Region = strings.ToUpper(req.Region)
+	req.Jurisdiction = strings.ToUpper(req.Jurisdiction)
+	if len(req.Currency) != 3 {
+		return fmt.Errorf("invalid currency: %q", req.Currency)
+	}
+	if req.AmountMinor == 0 && req.Amount != 0 {
+		req.AmountMinor = int64(math.Round(req.Amount * math.Pow10(currencyExponent(req.Currency))))
+	}
+	if req.AmountMinor <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if req.At.IsZero() {
+		req.At = time.Now()
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// InvoiceCSV renders an invoice as CSV: one row per line item followed by
+// the subtotal, one row per tax and the total
+func InvoiceCSV(invoice *Invoice) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{
+		{"invoice_number", "merchant_id", "period", "currency", "description", "fee_type", "method", "count", "volume", "fees"},
+	}
+	for _, line := range invoice.Lines {
+		rows = append(rows, []string{
+			invoice.Number, invoice.MerchantID, invoice.Period, invoice.Currency,
+			line.Description, line.FeeType, line.Method, strconv.Itoa(line.Count),
+			formatMinorUnits(line.VolumeMinor, invoice.Currency), formatMinorUnits(line.FeeMinor, invoice.Currency),
+		})
+	}
+
+	summary := func(label string, minor int64) []string {
+		return []string{invoice.Number, invoice.MerchantID, invoice.Period, invoice.Currency, label, "", "", "", "", formatMinorUnits(minor, invoice.Currency)}
+	}
+	rows = append(rows, summary("Subtotal", invoice.SubtotalMinor))
+	for _, tax := range invoice.TaxLines {
+		rows = append(rows, summary(taxLineLabel(&tax, invoice.Currency), tax.TaxMinor))
+	}
+	rows = append(rows, summary("Total", invoice.TotalMinor))
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, fmt.Errorf("failed to write invoice csv: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// StatementCSV renders a partner commission statement as CSV: one row per
+// merchant and currency
+func StatementCSV(statement *CommissionStatement) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{
+		{"partner_id", "period", "merchant_id", "currency", "count", "volume", "fees", "commission"},
+	}
+	for _, line := range statement.Lines {
+		rows = append(rows, []string{
+			statement.PartnerID, statement.Period, line.MerchantID, line.Currency, strconv.Itoa(line.Count),
+			formatMinorUnits(line.VolumeMinor, line.Currency), formatMinorUnits(line.FeeMinor, line.Currency), formatMinorUnits(line.ShareMinor, line.Currency),
+		})
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, fmt.Errorf("failed to write statement csv: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfLinesPerPage is how many text lines fit on an A4 page at 12pt leading
+const pdfLinesPerPage = 60
+
+// InvoicePDF renders an invoice as a plain-text PDF in a fixed-width font
+func InvoicePDF(invoice *Invoice) []byte {
+	lines := []string{
+		"FEE INVOICE " + invoice.Number,
+		"",
+		"Merchant:    " + invoiceParty(invoice),
+		"Period:      " + invoice.PeriodStart.Format("2 Jan 2006") + " - " + invoice.PeriodEnd.AddDate(0, 0, -1).Format("2 Jan 2006"),
+		"Issued:      " + invoice.IssuedAt.Format("2 Jan 2006"),
+		"Currency:    " + invoice.Currency,
+		"Status:      " + invoice.Status,
+		"",
+		fmt.Sprintf("%-40s %8s %14s %12s", "Description", "Count", "Volume", "Fees"),
+		strings.Repeat("-", 77),
+	}
+	for _, line := range invoice.Lines {
+		lines = append(lines, fmt.Sprintf("%-40.40s %8d %14s %12s", line.Description, line.Count, formatMinorUnits(line.VolumeMinor, invoice.Currency), formatMinorUnits(line.FeeMinor, invoice.Currency)))
+	}
+	lines = append(lines,
+		strings.Repeat("-", 77),
+		fmt.Sprintf("%-64s %12s", "Subtotal", formatMinorUnits(invoice.SubtotalMinor, invoice.Currency)),
+	)
+	for _, tax := range invoice.TaxLines {
+		lines = append(lines, fmt.Sprintf("%-64.64s %12s", taxLineLabel(&tax, invoice.Currency), formatMinorUnits(tax.TaxMinor, invoice.Currency)))
+	}
+	lines = append(lines, fmt.Sprintf("%-64s %12s", "Total due", formatMinorUnits(invoice.TotalMinor, invoice.Currency)))
+	if invoice.VATMinor == 0 {
+		lines = append(lines, "", "VAT zero-rated or exempt.")
+	}
+
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	return renderTextPDF(pages)
+}
+
+// taxLineLabel describes a tax line, e.g. "ZW VAT 15.50% on fees of 12.00"
+func taxLineLabel(tax *InvoiceTaxLine, currency string) string {
+	base := "fees"
+	if tax.Base == TaxBaseTransaction {
+		base = "transactions"
+	}
+	return fmt.Sprintf("%s %s %s%% on %s of %s", tax.Jurisdiction, strings.ToUpper(tax.TaxType), formatDecimal(tax.RateBps, 2), base, formatMinorUnits(tax.BaseMinor, currency))
+}
+
+// invoiceParty describes who an invoice is addressed to
+func invoiceParty(invoice *Invoice) string {
+	party := invoice.MerchantID
+	if invoice.MerchantName != "" {
+		party = invoice.MerchantName + " (" + invoice.MerchantID + ")"
+	}
+	if invoice.VATNumber != "" {
+		party += ", VAT " + invoice.VATNumber
+	}
+	if invoice.Country != "" {
+		party += ", " + invoice.Country
+	}
+	return party
+}
+
+// renderTextPDF writes pages of text lines as a minimal PDF 1.4 document
+func renderTextPDF(pages [][]string) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1-3 are the catalog, page tree and font; each page then adds
+	// a page object and its content stream
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	for i, page := range pages {
+		var content strings.Builder
+		content.WriteString("BT /F1 9 Tf 12 TL 40 800 Td\n")
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) Tj T*\n", escapePDFText(line))
+		}
+		content.WriteString("ET")
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
+
+// escapePDFText escapes a string for a PDF literal, dropping characters the
+// standard fonts cannot show
+func escapePDFText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
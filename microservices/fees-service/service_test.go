@@ -0,0 +1,723 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPricingService_DefaultPlan(t *testing.T) {
+	service := NewPricingService()
+
+	testCases := []struct {
+		feeType  string
+		method   string
+		amount   int64
+		expected int64
+		ruleID   string
+	}{
+		{FeeTypeEscrow, "", 10000, 250, "escrow"},                // 2.5%
+		{FeeTypeEscrow, "", 50, 100, "escrow"},                   // $1 minimum
+		{FeeTypeEscrow, "", 10000000, 10000, "escrow"},           // $100 cap
+		{FeeTypePayment, "credit_card", 10000, 320, "payment"},   // 2.9% + 0.30
+		{FeeTypePayment, "paypal", 10000, 370, "payment_paypal"}, // 3.4% + 0.30
+		{FeeTypePayment, "ach", 1000, 50, "payment_ach"},         // $0.50 minimum
+		{FeeTypePayment, "credit_card", 1e8, 50000, "payment"},   // $500 cap
+		{"payout", "", 10000, 320, "default"},                    // no payout rule
+	}
+
+	for _, tc := range testCases {
+		calc, err := service.Calculate(context.Background(), &FeeRequest{Type: tc.feeType, Method: tc.method, Currency: "usd", AmountMinor: tc.amount})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if calc.FeeMinor != tc.expected || calc.RuleID != tc.ruleID {
+			t.Errorf("Expected %s %s fee %d by %s for %d, got %d by %s", tc.feeType, tc.method, tc.expected, tc.ruleID, tc.amount, calc.FeeMinor, calc.RuleID)
+		}
+		if calc.PlanID != DefaultPlanID || calc.PlanVersion != 1 {
+			t.Errorf("Expected the default plan, got %s v%d", calc.PlanID, calc.PlanVersion)
+		}
+	}
+
+	// Amounts in major units are still accepted
+	calc, err := service.Calculate(context.Background(), &FeeRequest{Type: FeeTypePayment, Currency: "USD", Amount: 100})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calc.AmountMinor != 10000 || calc.FeeAmount != 3.2 {
+		t.Errorf("Expected fee 3.20 on 100.00, got %v on %d", calc.FeeAmount, calc.AmountMinor)
+	}
+
+	// Major units follow the currency's exponent
+	calc, err = service.Calculate(context.Background(), &FeeRequest{Type: FeeTypePayment, Currency: "JPY", Amount: 10000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calc.AmountMinor != 10000 || calc.FeeAmount != float64(calc.FeeMinor) {
+		t.Errorf("Expected 10000 yen priced in whole yen, got fee %v (%d minor) on %d", calc.FeeAmount, calc.FeeMinor, calc.AmountMinor)
+	}
+	if got := formatMinorUnits(-1234, "USD") + " " + formatMinorUnits(1234, "JPY") + " " + formatMinorUnits(1234, "KWD"); got != "-12.34 1234 1.234" {
+		t.Errorf("Expected amounts formatted by exponent, got %q", got)
+	}
+
+	if _, err := service.Calculate(context.Background(), &FeeRequest{Currency: "USD"}); err == nil {
+		t.Error("Expected error for a missing amount")
+	}
+}
+
+func TestPricingService_PlansAndAssignments(t *testing.T) {
+	service := NewPricingService()
+
+	plan, err := service.SavePlan(&PricingPlan{
+		ID:   "enterprise",
+		Name: "Enterprise",
+		Rules: []PriceRule{
+			{ID: "cards", FeeType: FeeTypePayment, PercentageBps: 200, FixedMinor: 20},
+			{ID: "cards_eu", FeeType: FeeTypePayment, Region: "eu", PercentageBps: 150, FixedMinor: 20},
+			{ID: "cards_eur_eu", FeeType: FeeTypePayment, Currency: "EUR", Region: "EU", PercentageBps: 120},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if plan.Version != 1 {
+		t.Errorf("Expected version 1, got %d", plan.Version)
+	}
+
+	if _, err := service.SavePlan(&PricingPlan{ID: "bad", Rules: []PriceRule{{ID: "x", PercentageBps: 20000}}}); err == nil {
+		t.Error("Expected error for a rate above 100%")
+	}
+
+	from := time.Now().Add(-time.Hour)
+	until := time.Now().Add(time.Hour)
+	if _, err := service.AssignPlan(&PlanAssignment{MerchantID: "m1", PlanID: "enterprise", PlanVersion: 1, EffectiveFrom: from, EffectiveTo: &until}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.AssignPlan(&PlanAssignment{MerchantID: "m1", PlanID: "missing"}); !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("Expected ErrPlanNotFound, got %v", err)
+	}
+
+	price := func(req *FeeRequest) *FeeCalculation {
+		t.Helper()
+		calc, err := service.Calculate(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return calc
+	}
+
+	// The most specific rule wins
+	if calc := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "EUR", Region: "EU", AmountMinor: 10000}); calc.RuleID != "cards_eur_eu" || calc.FeeMinor != 120 {
+		t.Errorf("Expected cards_eur_eu fee 120, got %s %d", calc.RuleID, calc.FeeMinor)
+	}
+	if calc := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "USD", Region: "EU", AmountMinor: 10000}); calc.RuleID != "cards_eu" || calc.FeeMinor != 170 {
+		t.Errorf("Expected cards_eu fee 170, got %s %d", calc.RuleID, calc.FeeMinor)
+	}
+	// Escrow has no rule in this plan
+	if _, err := service.Calculate(context.Background(), &FeeRequest{MerchantID: "m1", Type: FeeTypeEscrow, Currency: "USD", AmountMinor: 10000}); !errors.Is(err, ErrNoPriceRule) {
+		t.Errorf("Expected ErrNoPriceRule, got %v", err)
+	}
+
+	// Outside the assignment the merchant is back on the default plan
+	if calc := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000, At: until.Add(time.Minute)}); calc.PlanID != DefaultPlanID {
+		t.Errorf("Expected the default plan after the assignment ends, got %s", calc.PlanID)
+	}
+
+	// A new version does not move merchants pinned to the old one
+	if _, err := service.SavePlan(&PricingPlan{ID: "enterprise", Rules: []PriceRule{{ID: "cards", PercentageBps: 100}}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calc := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000}); calc.PlanVersion != 1 || calc.FeeMinor != 220 {
+		t.Errorf("Expected pinned v1 fee 220, got v%d %d", calc.PlanVersion, calc.FeeMinor)
+	}
+
+	// Unpinned assignments follow the latest version
+	if _, err := service.AssignPlan(&PlanAssignment{MerchantID: "m2", PlanID: "enterprise", EffectiveFrom: from}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	latest, _ := service.GetPlan("enterprise", 0)
+	if latest.Version != 2 || latest.Name != "Enterprise" {
+		t.Errorf("Expected version 2 to keep the plan name, got v%d %q", latest.Version, latest.Name)
+	}
+	if calc := price(&FeeRequest{MerchantID: "m2", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000}); calc.PlanVersion != 2 || calc.FeeMinor != 100 {
+		t.Errorf("Expected v2 fee 100, got v%d %d", calc.PlanVersion, calc.FeeMinor)
+	}
+}
+
+func TestPricingService_VolumeTiers(t *testing.T) {
+	service := NewPricingService()
+
+	_, err := service.SavePlan(&PricingPlan{
+		ID: "volume",
+		Rules: []PriceRule{{
+			ID:            "tiered",
+			PercentageBps: 300,
+			Tiers: []VolumeTier{
+				{UpToMinor: 100000, PercentageBps: 300},
+				{UpToMinor: 500000, PercentageBps: 200},
+				{PercentageBps: 100},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.AssignPlan(&PlanAssignment{MerchantID: "m1", PlanID: "volume"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	charge := func(txID string, amount int64) *FeeCalculation {
+		t.Helper()
+		calc, err := service.Calculate(context.Background(), &FeeRequest{MerchantID: "m1", TransactionID: txID, Currency: "USD", AmountMinor: amount})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return calc
+	}
+
+	first := charge("tx1", 100000)
+	if first.Tier != 1 || first.FeeMinor != 3000 {
+		t.Errorf("Expected tier 1 fee 3000, got tier %d fee %d", first.Tier, first.FeeMinor)
+	}
+
+	// Recalculating a transaction does not count its volume twice
+	if again := charge("tx1", 100000); again.ID != first.ID {
+		t.Errorf("Expected the recorded calculation, got %s", again.ID)
+	}
+
+	second := charge("tx2", 400000)
+	if second.Tier != 2 || second.MonthlyVolumeMinor != 100000 || second.FeeMinor != 8000 {
+		t.Errorf("Expected tier 2 at volume 100000 fee 8000, got tier %d at %d fee %d", second.Tier, second.MonthlyVolumeMinor, second.FeeMinor)
+	}
+
+	third := charge("tx3", 10000)
+	if third.Tier != 3 || third.FeeMinor != 100 {
+		t.Errorf("Expected tier 3 fee 100, got tier %d fee %d", third.Tier, third.FeeMinor)
+	}
+
+	// Quotes without a transaction ID are not recorded
+	if _, err := service.Calculate(context.Background(), &FeeRequest{MerchantID: "m1", Currency: "USD", AmountMinor: 10000}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fees := service.ListCalculations("m1", 0); len(fees) != 3 || fees[0].TransactionID != "tx3" {
+		t.Errorf("Expected 3 recorded calculations newest first, got %d", len(fees))
+	}
+
+	// Volume resets each month
+	next := charge("tx4", 10000)
+	nextMonth, err := service.Calculate(context.Background(), &FeeRequest{MerchantID: "m1", TransactionID: "tx5", Currency: "USD", AmountMinor: 10000, At: time.Now().AddDate(0, 1, 0)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if next.Tier != 3 || nextMonth.Tier != 1 || nextMonth.MonthlyVolumeMinor != 0 {
+		t.Errorf("Expected volume to reset next month, got tier %d at %d", nextMonth.Tier, nextMonth.MonthlyVolumeMinor)
+	}
+}
+
+type stubLedgerPoster struct {
+	postings []*LedgerPosting
+	err      error
+}
+
+func (l *stubLedgerPoster) Post(ctx context.Context, posting *LedgerPosting) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.postings = append(l.postings, posting)
+	return nil
+}
+
+func TestPricingService_LedgerPostings(t *testing.T) {
+	ctx := context.Background()
+	service := NewPricingService()
+	ledger := &stubLedgerPoster{err: errors.New("connection refused")}
+	service.SetLedgerPoster(ledger)
+
+	calc, err := service.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if calc.LedgerStatus != LedgerStatusFailed {
+		t.Errorf("Expected ledger status failed, got %s", calc.LedgerStatus)
+	}
+
+	// Failed postings are retried
+	ledger.err = nil
+	if posted := service.RetryLedgerPostings(ctx); posted != 1 {
+		t.Fatalf("Expected 1 fee posted on retry, got %d", posted)
+	}
+	if recorded, ok := service.GetCalculation("tx1"); !ok || recorded.LedgerStatus != LedgerStatusPosted {
+		t.Errorf("Expected recorded fee to be posted, got %+v", recorded)
+	}
+
+	posting := ledger.postings[0]
+	if posting.DebitAccount != FeesReceivableAccount("m1") || posting.CreditAccount != FeeRevenueAccount || posting.AmountMinor != calc.FeeMinor {
+		t.Errorf("Expected %d from fee revenue to m1 receivable, got %+v", calc.FeeMinor, posting)
+	}
+
+	// The fee is followed by its taxes
+	if len(ledger.postings) != 1+len(calc.TaxLines) {
+		t.Fatalf("Expected %d postings, got %d", 1+len(calc.TaxLines), len(ledger.postings))
+	}
+	ids := make(map[string]bool)
+	for _, posting := range ledger.postings {
+		if posting.ID == "" || ids[posting.ID] || posting.DebitType == "" || posting.CreditType == "" {
+			t.Errorf("Expected unique posting IDs and account types, got %+v", posting)
+		}
+		ids[posting.ID] = true
+	}
+
+	// Recalculating a recorded transaction does not post again
+	if _, err := service.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(ledger.postings) != 1+len(calc.TaxLines) {
+		t.Errorf("Expected %d postings, got %d", 1+len(calc.TaxLines), len(ledger.postings))
+	}
+}
+
+func TestBillingService_MonthlyInvoices(t *testing.T) {
+	ctx := context.Background()
+	pricing := NewPricingService()
+	ledger := &stubLedgerPoster{}
+	pricing.SetLedgerPoster(ledger)
+	billing := NewBillingService(pricing)
+
+	if _, err := billing.SaveProfile(&BillingProfile{MerchantID: "abroad", Name: "Export Ltd", Country: "za"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	september := time.Date(2026, 9, 15, 12, 0, 0, 0, time.UTC)
+	charges := []*FeeRequest{
+		{MerchantID: "local", TransactionID: "tx1", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 10000, At: september},
+		{MerchantID: "local", TransactionID: "tx2", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 20000, At: september},
+		{MerchantID: "local", TransactionID: "tx3", Type: FeeTypeEscrow, Currency: "USD", AmountMinor: 100000, At: september},
+		{MerchantID: "abroad", TransactionID: "tx4", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 10000, At: september},
+		{MerchantID: "local", TransactionID: "tx5", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 10000, At: september.AddDate(0, 1, 0)},
+	}
+	var septemberFees, septemberTax int64
+	for _, req := range charges {
+		calc, err := pricing.Calculate(ctx, req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if req.MerchantID == "local" && calc.ChargedAt.Month() == time.September {
+			septemberFees += calc.FeeMinor
+			septemberTax += calc.TaxMinor
+		}
+	}
+
+	invoices, err := billing.RunBilling(september)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(invoices) != 2 {
+		t.Fatalf("Expected 2 invoices, got %d", len(invoices))
+	}
+
+	abroad, local := invoices[0], invoices[1]
+	if local.MerchantID != "local" || len(local.Lines) != 2 || len(local.FeeIDs) != 3 {
+		t.Fatalf("Expected 2 lines over 3 fees for local, got %+v", local)
+	}
+	if local.SubtotalMinor != septemberFees || local.TaxMinor != septemberTax {
+		t.Errorf("Expected subtotal %d and tax %d, got %d and %d", septemberFees, septemberTax, local.SubtotalMinor, local.TaxMinor)
+	}
+	if len(local.TaxLines) != 2 || local.TaxLines[0].TaxType != TaxTypeIMTT || local.TaxLines[1].RateBps != 1550 {
+		t.Errorf("Expected IMTT and 15.5%% VAT lines, got %+v", local.TaxLines)
+	}
+	if local.VATMinor != local.TaxLines[1].TaxMinor || local.VATMinor == 0 {
+		t.Errorf("Expected VAT of %d, got %d", local.TaxLines[1].TaxMinor, local.VATMinor)
+	}
+	if local.TotalMinor != local.SubtotalMinor+local.TaxMinor || local.Number != "FEE-2026-09-0002" {
+		t.Errorf("Expected total including tax on FEE-2026-09-0002, got %d on %s", local.TotalMinor, local.Number)
+	}
+	if abroad.TaxMinor != 0 || len(abroad.TaxLines) != 0 || abroad.MerchantName != "Export Ltd" {
+		t.Errorf("Expected untaxed invoice for Export Ltd, got %+v", abroad)
+	}
+
+	// Running again only bills fees recorded since
+	again, err := billing.RunBilling(september)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("Expected no new invoices, got %d (%v)", len(again), err)
+	}
+	if recorded, _ := pricing.GetCalculation("tx1"); recorded.InvoiceID != local.ID {
+		t.Errorf("Expected tx1 on invoice %s, got %s", local.ID, recorded.InvoiceID)
+	}
+
+	outstanding := billing.OutstandingFees("local")
+	october, _ := pricing.GetCalculation("tx5")
+	if outstanding["USD"] != local.TotalMinor+october.FeeMinor+october.TaxMinor {
+		t.Errorf("Expected outstanding %d, got %d", local.TotalMinor+october.FeeMinor+october.TaxMinor, outstanding["USD"])
+	}
+
+	settled, err := billing.SettleInvoice(local.ID, "payout_1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if settled.Status != InvoiceStatusSettled || billing.OutstandingFees("local")["USD"] != october.FeeMinor+october.TaxMinor {
+		t.Errorf("Expected settled invoice to no longer be outstanding, got %s", settled.Status)
+	}
+	if _, err := billing.SettleInvoice(local.ID, "payout_2"); err == nil {
+		t.Error("Expected error settling an invoice twice")
+	}
+	if _, err := billing.GetInvoice("missing"); !errors.Is(err, ErrInvoiceNotFound) {
+		t.Errorf("Expected ErrInvoiceNotFound, got %v", err)
+	}
+}
+
+func TestBillingService_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	september := time.Date(2026, 9, 15, 12, 0, 0, 0, time.UTC)
+
+	open := func() (*PricingService, *BillingService, *FileJournal) {
+		t.Helper()
+		journal, err := OpenFileJournal(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		pricing := NewPricingService()
+		billing := NewBillingService(pricing)
+		if err := pricing.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := billing.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return pricing, billing, journal
+	}
+
+	pricing, billing, journal := open()
+	if _, err := billing.SaveProfile(&BillingProfile{MerchantID: "m1", Country: "za"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	agreement, err := pricing.CreateAgreement(&RevenueShareAgreement{PartnerID: "reseller", MerchantIDs: []string{"m1"}, ShareBps: 2000, EffectiveFrom: september.AddDate(0, -1, 0)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := pricing.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx1", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 10000, At: september}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	invoices, err := billing.RunBilling(september)
+	if err != nil || len(invoices) != 1 {
+		t.Fatalf("Expected 1 invoice, got %d (%v)", len(invoices), err)
+	}
+	if _, err := billing.SettleInvoice(invoices[0].ID, "payout_1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := pricing.EndAgreement(agreement.ID, september.AddDate(0, 1, 0)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	volumes, partnerVolumes := pricing.volumes, pricing.partnerVolumes
+	journal.Close()
+
+	pricing, billing, journal = open()
+	defer journal.Close()
+
+	recorded, ok := pricing.GetCalculation("tx1")
+	if !ok || recorded.InvoiceID != invoices[0].ID {
+		t.Fatalf("Expected tx1 on invoice %s after restart, got %+v", invoices[0].ID, recorded)
+	}
+	if len(recorded.TaxLines) != 0 || len(recorded.Splits) != 1 {
+		t.Errorf("Expected an untaxed fee shared with the reseller, got %+v", recorded)
+	}
+	if len(pricing.volumes) != len(volumes) || pricing.volumes[volumeKey("m1", "USD", september)] != 10000 {
+		t.Errorf("Expected monthly volumes %v, got %v", volumes, pricing.volumes)
+	}
+	if len(pricing.partnerVolumes) != len(partnerVolumes) || pricing.partnerVolumes[partnerVolumeKey("reseller", "USD", september)] != recorded.FeeMinor {
+		t.Errorf("Expected partner volumes %v, got %v", partnerVolumes, pricing.partnerVolumes)
+	}
+	if agreements := pricing.ListAgreements("reseller"); len(agreements) != 1 || agreements[0].EffectiveTo == nil {
+		t.Errorf("Expected the ended agreement, got %+v", agreements)
+	}
+
+	invoice, err := billing.GetInvoice(invoices[0].ID)
+	if err != nil || invoice.Status != InvoiceStatusSettled || invoice.TotalMinor != invoices[0].TotalMinor {
+		t.Fatalf("Expected settled invoice after restart, got %+v (%v)", invoice, err)
+	}
+	if profile := billing.GetProfile("m1"); profile.Country != "ZA" {
+		t.Errorf("Expected profile in ZA, got %q", profile.Country)
+	}
+
+	// Invoice numbers and volumes carry on from the journal
+	later := september.AddDate(0, 0, 1)
+	next, err := pricing.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx2", Type: FeeTypePayment, Method: "card", Currency: "USD", AmountMinor: 10000, At: later})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if next.MonthlyVolumeMinor != 10000 {
+		t.Errorf("Expected monthly volume 10000, got %d", next.MonthlyVolumeMinor)
+	}
+	again, err := billing.RunBilling(september)
+	if err != nil || len(again) != 1 || again[0].Number != "FEE-2026-09-0002" || len(again[0].FeeIDs) != 1 {
+		t.Fatalf("Expected FEE-2026-09-0002 billing tx2 only, got %+v (%v)", again, err)
+	}
+}
+
+func TestBillingService_Render(t *testing.T) {
+	invoice := &Invoice{
+		Number:        "FEE-2026-09-0001",
+		MerchantID:    "m1",
+		MerchantName:  "Shop (Harare)",
+		Period:        "2026-09",
+		PeriodStart:   time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:     time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		Currency:      "USD",
+		Lines:         []InvoiceLine{{Description: "Payment fees (card)", FeeType: FeeTypePayment, Method: "card", Count: 2, VolumeMinor: 30000, FeeMinor: 930}},
+		SubtotalMinor: 930,
+		TaxLines:      []InvoiceTaxLine{{TaxType: TaxTypeVAT, Jurisdiction: "ZW", Base: TaxBaseFee, RateBps: 1500, BaseMinor: 930, TaxMinor: 140}},
+		VATMinor:      140,
+		TaxMinor:      140,
+		TotalMinor:    1070,
+		Status:        InvoiceStatusIssued,
+	}
+
+	pdf := string(InvoicePDF(invoice))
+	if !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Error("Expected a PDF document")
+	}
+	if !strings.Contains(pdf, `Shop \(Harare\)`) || !strings.Contains(pdf, "ZW VAT 15.00% on fees of 9.30") || !strings.Contains(pdf, "10.70") {
+		t.Error("Expected escaped merchant name and total in PDF")
+	}
+
+	data, err := InvoiceCSV(invoice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	rows := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(rows) != 5 || !strings.HasSuffix(rows[len(rows)-1], ",Total,,,,,10.70") {
+		t.Errorf("Expected header, 1 line and 3 totals, got %v", rows)
+	}
+}
+
+func TestPricingService_Taxes(t *testing.T) {
+	ctx := context.Background()
+	service := NewPricingService()
+	ledger := &stubLedgerPoster{}
+	service.SetLedgerPoster(ledger)
+
+	price := func(req *FeeRequest) *FeeCalculation {
+		t.Helper()
+		calc, err := service.Calculate(ctx, req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return calc
+	}
+
+	// VAT on the fee at the rate in effect, IMTT on the transaction
+	before := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000, At: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)})
+	after := price(&FeeRequest{MerchantID: "m1", TransactionID: "tx1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000, At: time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)})
+	if before.Jurisdiction != HomeJurisdiction || len(before.TaxLines) != 2 || before.TaxLines[1].RateBps != 1500 {
+		t.Fatalf("Expected ZW IMTT and 15%% VAT in 2024, got %+v", before.TaxLines)
+	}
+	// 320 fee: 15.5% is 49.6, IMTT 2% of 10000 is 200
+	if after.FeeMinor != 320 || after.TaxLines[0].TaxMinor != 200 || after.TaxLines[1].TaxMinor != 50 || after.TaxMinor != 250 {
+		t.Errorf("Expected IMTT 200 and VAT 50 on fee 320, got %+v", after.TaxLines)
+	}
+
+	// IMTT applies above the exemption threshold and only in US dollars
+	small := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "USD", AmountMinor: 500})
+	if len(small.TaxLines) != 1 || small.TaxLines[0].TaxType != TaxTypeVAT {
+		t.Errorf("Expected only VAT on an exempt transfer, got %+v", small.TaxLines)
+	}
+	if zig := price(&FeeRequest{MerchantID: "m1", Type: FeeTypePayment, Currency: "ZWG", AmountMinor: 10000}); len(zig.TaxLines) != 1 {
+		t.Errorf("Expected only VAT in ZWG, got %+v", zig.TaxLines)
+	}
+
+	// Other markets have their own rules, with capping and rounding
+	_, err := service.AddTaxRule(&TaxRule{ID: "za_vat", Jurisdiction: "za", TaxType: TaxTypeVAT, Base: TaxBaseFee, RateBps: 1500, CapMinor: 40, Rounding: RoundingDown, EffectiveFrom: time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	za := price(&FeeRequest{MerchantID: "m2", Type: FeeTypePayment, Currency: "ZAR", AmountMinor: 10000, Jurisdiction: "ZA"})
+	if len(za.TaxLines) != 1 || za.TaxLines[0].TaxMinor != 40 || !za.TaxLines[0].Capped {
+		t.Errorf("Expected ZA VAT capped at 40, got %+v", za.TaxLines)
+	}
+	if _, err := service.AddTaxRule(&TaxRule{ID: "bad", Jurisdiction: "ZA", TaxType: TaxTypeVAT, Base: "profit", EffectiveFrom: time.Now()}); err == nil {
+		t.Error("Expected error for an unknown tax base")
+	}
+
+	// VAT-exempt merchants only pay transaction taxes
+	billing := NewBillingService(service)
+	if _, err := billing.SaveProfile(&BillingProfile{MerchantID: "m3", Country: "ZW", VATExempt: true}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	exempt := price(&FeeRequest{MerchantID: "m3", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000})
+	if len(exempt.TaxLines) != 1 || exempt.TaxLines[0].TaxType != TaxTypeIMTT {
+		t.Errorf("Expected only IMTT for a VAT-exempt merchant, got %+v", exempt.TaxLines)
+	}
+
+	// Tax is posted as payable to the jurisdiction
+	if len(ledger.postings) != 3 || ledger.postings[1].CreditAccount != "tax_payable_zw_imtt" || ledger.postings[2].CreditAccount != "tax_payable_zw_vat" {
+		t.Fatalf("Expected fee, IMTT and VAT postings, got %d", len(ledger.postings))
+	}
+
+	start, end, err := parseReportPeriod("2026-Q3")
+	if err != nil || start.Month() != time.July || end.Month() != time.October {
+		t.Fatalf("Expected July to October, got %v to %v (%v)", start, end, err)
+	}
+	report := service.TaxReturn("zw", "2026-Q3", start, end)
+	if len(report.Lines) != 2 || report.Lines[0].TaxType != TaxTypeIMTT || report.Lines[0].BaseMinor != 10000 || report.Lines[1].TaxMinor != 50 {
+		t.Errorf("Expected IMTT on 10000 and VAT of 50, got %+v", report.Lines)
+	}
+	if _, _, err := parseReportPeriod("2026-Q5"); err == nil {
+		t.Error("Expected error for an invalid quarter")
+	}
+}
+
+func TestPricingService_RevenueShare(t *testing.T) {
+	ctx := context.Background()
+	service := NewPricingService()
+	ledger := &stubLedgerPoster{}
+	service.SetLedgerPoster(ledger)
+
+	september := time.Date(2026, 9, 10, 0, 0, 0, 0, time.UTC)
+	reseller, err := service.CreateAgreement(&RevenueShareAgreement{
+		PartnerID:     "reseller",
+		MerchantIDs:   []string{"m1"},
+		FeeType:       FeeTypeEscrow,
+		Tiers:         []ShareTier{{UpToMinor: 5000, ShareBps: 2000}, {ShareBps: 3000}},
+		EffectiveFrom: september.AddDate(0, -1, 0),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.CreateAgreement(&RevenueShareAgreement{
+		PartnerID:      "referrer",
+		MerchantIDs:    []string{"m1"},
+		BountyMinor:    100,
+		BountyCurrency: "usd",
+		EffectiveFrom:  september.AddDate(0, -1, 0),
+	}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.CreateAgreement(&RevenueShareAgreement{PartnerID: "p", MerchantIDs: []string{"m1"}}); err == nil {
+		t.Error("Expected error for an agreement that shares nothing")
+	}
+
+	escrow := func(txID string, amount int64) *FeeCalculation {
+		t.Helper()
+		calc, err := service.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: txID, Type: FeeTypeEscrow, Currency: "USD", AmountMinor: amount, At: september})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return calc
+	}
+
+	// 2.5% of 200000 is 5000: 20% to the reseller, then the referrer's bounty
+	first := escrow("tx1", 200000)
+	if len(first.Splits) != 2 || first.Splits[0].AmountMinor != 1000 || first.Splits[0].Tier != 1 || first.Splits[1].AmountMinor != 100 {
+		t.Fatalf("Expected reseller 1000 and referrer 100, got %+v", first.Splits)
+	}
+	if first.PlatformFeeMinor != 3900 {
+		t.Errorf("Expected platform fee 3900, got %d", first.PlatformFeeMinor)
+	}
+
+	// The reseller's monthly fees reached the next tier
+	second := escrow("tx2", 200000)
+	if second.Splits[0].ShareBps != 3000 || second.Splits[0].AmountMinor != 1500 {
+		t.Errorf("Expected 30%% tier share of 1500, got %+v", second.Splits[0])
+	}
+
+	// Shares never exceed the fee: of the 100 minimum fee the reseller gets
+	// 30 and the referrer what is left
+	small := escrow("tx3", 1000)
+	if small.FeeMinor != 100 || small.Splits[1].AmountMinor != 70 || !small.Splits[1].Capped || small.PlatformFeeMinor != 0 {
+		t.Errorf("Expected capped bounty of 70 leaving nothing, got %+v", small.Splits)
+	}
+
+	// Payment fees only carry the bounty
+	payment, err := service.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx4", Type: FeeTypePayment, Currency: "USD", AmountMinor: 10000, At: september})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(payment.Splits) != 1 || payment.Splits[0].PartnerID != "referrer" {
+		t.Errorf("Expected only the referrer bounty, got %+v", payment.Splits)
+	}
+
+	var shares int
+	for _, posting := range ledger.postings {
+		if posting.CreditAccount == PartnerPayableAccount("reseller") && posting.DebitAccount == FeeRevenueAccount {
+			shares++
+		}
+	}
+	if shares != 3 {
+		t.Errorf("Expected 3 reseller share postings, got %d", shares)
+	}
+
+	// Agreements stop sharing once ended
+	if _, err := service.EndAgreement(reseller.ID, september.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	later, err := service.Calculate(ctx, &FeeRequest{MerchantID: "m1", TransactionID: "tx5", Type: FeeTypeEscrow, Currency: "USD", AmountMinor: 200000, At: september.AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(later.Splits) != 1 || later.Splits[0].PartnerID != "referrer" {
+		t.Errorf("Expected only the referrer after the reseller agreement ended, got %+v", later.Splits)
+	}
+
+	start, end, _ := parseReportPeriod("2026-09")
+	statement := service.CommissionStatement("reseller", "2026-09", start, end)
+	if len(statement.Lines) != 1 || statement.Lines[0].Count != 3 || statement.Totals["USD"] != 2530 {
+		t.Errorf("Expected 3 fees earning 2530, got %+v", statement)
+	}
+
+	data, err := StatementCSV(statement)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rows := strings.Split(strings.TrimSpace(string(data)), "\n"); len(rows) != 2 || !strings.HasSuffix(rows[1], ",25.30") {
+		t.Errorf("Expected header and one row, got %v", rows)
+	}
+}
+
+func TestHTTPLedgerPoster_PostsOneTransfer(t *testing.T) {
+	var requests []map[string]interface{}
+	status := http.StatusCreated
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transfers" {
+			t.Errorf("Expected a transfer, got %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	poster := NewHTTPLedgerPoster(server.URL)
+	posting := feePosting(&FeeCalculation{ID: "fee_1", TransactionID: "tx1", MerchantID: "m1", Currency: "USD", FeeMinor: 250, FeeType: FeeTypePayment})
+	if err := poster.Post(context.Background(), posting); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A replay the ledger had already booked is a success
+	status = http.StatusOK
+	if err := poster.Post(context.Background(), posting); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	status = http.StatusNotFound
+	if err := poster.Post(context.Background(), posting); err == nil {
+		t.Error("Expected error for a rejected transfer")
+	}
+
+	body := requests[0]
+	if len(requests) != 3 || body["transfer_id"] != "fee_1:fee" || requests[1]["transfer_id"] != "fee_1:fee" {
+		t.Fatalf("Expected every attempt keyed by the posting ID, got %+v", requests)
+	}
+	if body["from_account"] != FeeRevenueAccount || body["to_account"] != "fees_receivable_m1" ||
+		body["from_account_type"] != AccountTypeRevenue || body["to_account_type"] != AccountTypeAsset {
+		t.Errorf("Expected fee revenue to m1 receivable with account types, got %+v", body)
+	}
+	if amount := body["amount"].(map[string]interface{}); amount["value"] != "2.50" {
+		t.Errorf("Expected 2.50, got %v", amount["value"])
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tax types
+const (
+	TaxTypeVAT  = "vat"
+	TaxTypeIMTT = "imtt" // Intermediated Money Transfer Tax
+)
+
+// What a tax rule is levied on
+const (
+	TaxBaseFee         = "fee"
+	TaxBaseTransaction = "transaction"
+)
+
+// Rounding of tax amounts to minor units
+const (
+	RoundingHalfUp = "half_up"
+	RoundingDown   = "down"
+	RoundingUp     = "up"
+)
+
+// HomeJurisdiction is where fees are taxed when neither the request nor
+// the merchant's billing profile names a country
+const HomeJurisdiction = "ZW"
+
+// TaxRule levies a tax in a jurisdiction. Rules sharing an ID are versions
+// of one tax: the version with the latest EffectiveFrom at or before a
+// transaction applies, so a rate change is a new version rather than an
+// edit. Empty FeeType, Methods and Currency match anything.
+type TaxRule struct {
+	ID              string     `json:"id"`
+	Jurisdiction    string     `json:"jurisdiction"` // ISO 3166 country code
+	TaxType         string     `json:"tax_type"`
+	Name            string     `json:"name,omitempty"`
+	Base            string     `json:"base"` // fee or transaction
+	FeeType         string     `json:"fee_type,omitempty"`
+	Methods         []string   `json:"methods,omitempty"`
+	Currency        string     `json:"currency,omitempty"`
+	RateBps         int64      `json:"rate_bps"`
+	ExemptUpToMinor int64      `json:"exempt_up_to_minor,omitempty"` // bases at or below are not taxed
+	CapMinor        int64      `json:"cap_minor,omitempty"`          // 0 is uncapped
+	Rounding        string     `json:"rounding,omitempty"`
+	EffectiveFrom   time.Time  `json:"effective_from"`
+	EffectiveTo     *time.Time `json:"effective_to,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// TaxLine is one tax charged on a fee calculation
+type TaxLine struct {
+	RuleID       string `json:"rule_id"`
+	TaxType      string `json:"tax_type"`
+	Jurisdiction string `json:"jurisdiction"`
+	Base         string `json:"base"`
+	BaseMinor    int64  `json:"base_minor"`
+	RateBps      int64  `json:"rate_bps"`
+	TaxMinor     int64  `json:"tax_minor"`
+	Capped       bool   `json:"capped,omitempty"`
+}
+
+// TaxReturnLine totals one tax at one rate and currency
+type TaxReturnLine struct {
+	TaxType   string `json:"tax_type"`
+	Currency  string `json:"currency"`
+	RateBps   int64  `json:"rate_bps"`
+	Count     int    `json:"count"`
+	BaseMinor int64  `json:"base_minor"`
+	TaxMinor  int64  `json:"tax_minor"`
+}
+
+// TaxReturn is the tax collected in a jurisdiction over a period
+type TaxReturn struct {
+	Jurisdiction string          `json:"jurisdiction"`
+	Period       string          `json:"period"`
+	PeriodStart  time.Time       `json:"period_start"`
+	PeriodEnd    time.Time       `json:"period_end"`
+	Lines        []TaxReturnLine `json:"lines"`
+	GeneratedAt  time.Time       `json:"generated_at"`
+}
+
+// taxProfile is what the pricing service knows of a merchant for tax
+type taxProfile struct {
+	Country   string
+	VATExempt bool
+}
+
+// DefaultTaxRules returns Zimbabwe's VAT on fees, raised from 15% to 15.5%
+// in January 2025, and the 2% IMTT on electronic payments in US dollars
+// with transfers up to $5 exempt
+func DefaultTaxRules() []*TaxRule {
+	from := func(year int, month time.Month) time.Time {
+		return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return []*TaxRule{
+		{ID: "zw_vat", Jurisdiction: "ZW", TaxType: TaxTypeVAT, Name: "VAT", Base: TaxBaseFee, RateBps: 1500, EffectiveFrom: from(2023, time.January)},
+		{ID: "zw_vat", Jurisdiction: "ZW", TaxType: TaxTypeVAT, Name: "VAT", Base: TaxBaseFee, RateBps: 1550, EffectiveFrom: from(2025, time.January)},
+		{ID: "zw_imtt_usd", Jurisdiction: "ZW", TaxType: TaxTypeIMTT, Name: "IMTT", Base: TaxBaseTransaction, FeeType: FeeTypePayment, Currency: "USD", RateBps: 200, ExemptUpToMinor: 500, EffectiveFrom: from(2023, time.January)},
+	}
+}
+
+// AddTaxRule stores a tax rule or a new version of one
+func (s *PricingService) AddTaxRule(rule *TaxRule) (*TaxRule, error) {
+	stored := *rule
+	stored.Methods = append([]string(nil), rule.Methods...)
+	if err := validateTaxRule(&stored); err != nil {
+		return nil, fmt.Errorf("invalid tax rule: %w", err)
+	}
+	stored.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalTaxRule, TaxRule: &stored}); err != nil {
+		return nil, fmt.Errorf("failed to save tax rule: %w", err)
+	}
+
+	return &stored, nil
+}
+
+// ListTaxRules returns every tax rule version, optionally for one
+// jurisdiction, ordered by ID and effective date
+func (s *PricingService) ListTaxRules(jurisdiction string) []*TaxRule {
+	jurisdiction = strings.ToUpper(jurisdiction)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rules := []*TaxRule{}
+	for _, rule := range s.taxRules {
+		if jurisdiction == "" || rule.Jurisdiction == jurisdiction {
+			rules = append(rules, rule)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].ID != rules[j].ID {
+			return rules[i].ID < rules[j].ID
+		}
+		return rules[i].EffectiveFrom.Before(rules[j].EffectiveFrom)
+	})
+	return rules
+}
+
+// setTaxProfile records a merchant's country and VAT exemption for tax on
+// later calculations
+func (s *PricingService) setTaxProfile(merchantID, country string, vatExempt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taxProfiles[merchantID] = taxProfile{Country: country, VATExempt: vatExempt}
+}
+
+// jurisdictionFor returns where a request is taxed. Callers hold s.mu.
+func (s *PricingService) jurisdictionFor(req *FeeRequest) string {
+	if req.Jurisdiction != "" {
+		return req.Jurisdiction
+	}
+	if profile := s.taxProfiles[req.MerchantID]; profile.Country != "" {
+		return profile.Country
+	}
+	return HomeJurisdiction
+}
+
+// activeTaxRules returns the version of each tax rule of a jurisdiction in
+// effect at t. Callers hold s.mu.
+func (s *PricingService) activeTaxRules(jurisdiction string, t time.Time) []*TaxRule {
+	current := make(map[string]*TaxRule)
+	var ids []string
+	for _, rule := range s.taxRules {
+		if rule.Jurisdiction != jurisdiction || t.Before(rule.EffectiveFrom) {
+			continue
+		}
+		existing, ok := current[rule.ID]
+		if !ok {
+			ids = append(ids, rule.ID)
+		}
+		if !ok || !rule.EffectiveFrom.Before(existing.EffectiveFrom) {
+			current[rule.ID] = rule
+		}
+	}
+
+	sort.Strings(ids)
+	var rules []*TaxRule
+	for _, id := range ids {
+		rule := current[id]
+		if rule.EffectiveTo == nil || t.Before(*rule.EffectiveTo) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// applyTaxes adds the tax lines of a priced calculation. Callers hold s.mu.
+func (s *PricingService) applyTaxes(calc *FeeCalculation, req *FeeRequest) {
+	calc.Jurisdiction = s.jurisdictionFor(req)
+	calc.TaxLines = nil
+	calc.TaxMinor = 0
+
+	exempt := s.taxProfiles[req.MerchantID].VATExempt
+	for _, rule := range s.activeTaxRules(calc.Jurisdiction, calc.ChargedAt) {
+		if exempt && rule.TaxType == TaxTypeVAT {
+			continue
+		}
+		if !rule.matches(calc) {
+			continue
+		}
+
+		base := calc.FeeMinor
+		if rule.Base == TaxBaseTransaction {
+			base = calc.AmountMinor
+		}
+		if base <= 0 || base <= rule.ExemptUpToMinor {
+			continue
+		}
+
+		line := TaxLine{
+			RuleID:       rule.ID,
+			TaxType:      rule.TaxType,
+			Jurisdiction: rule.Jurisdiction,
+			Base:         rule.Base,
+			BaseMinor:    base,
+			RateBps:      rule.RateBps,
+			TaxMinor:     roundBps(base, rule.RateBps, rule.Rounding),
+		}
+		if rule.CapMinor > 0 && line.TaxMinor > rule.CapMinor {
+			line.TaxMinor = rule.CapMinor
+			line.Capped = true
+		}
+		if line.TaxMinor == 0 {
+			continue
+		}
+
+		calc.TaxLines = append(calc.TaxLines, line)
+		calc.TaxMinor += line.TaxMinor
+	}
+}
+
+// matches reports whether the rule taxes the calculation
+func (r *TaxRule) matches(calc *FeeCalculation) bool {
+	if r.FeeType != "" && r.FeeType != calc.FeeType {
+		return false
+	}
+	if r.Currency != "" && r.Currency != calc.Currency {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, method := range r.Methods {
+		if method == calc.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// roundBps applies a rate in basis points to an amount in minor units
+func roundBps(amount, bps int64, rounding string) int64 {
+	switch rounding {
+	case RoundingDown:
+		return amount * bps / 10000
+	case RoundingUp:
+		return (amount*bps + 9999) / 10000
+	default:
+		return (amount*bps + 5000) / 10000
+	}
+}
+
+// validateTaxRule checks a tax rule before it is stored
+func validateTaxRule(rule *TaxRule) error {
+	if rule.ID == "" {
+		return errors.New("id is required")
+	}
+	rule.Jurisdiction = strings.ToUpper(rule.Jurisdiction)
+	rule.Currency = strings.ToUpper(rule.Currency)
+	if len(rule.Jurisdiction) != 2 {
+		return fmt.Errorf("invalid jurisdiction: %q", rule.Jurisdiction)
+	}
+	if rule.Currency != "" && len(rule.Currency) != 3 {
+		return fmt.Errorf("invalid currency: %s", rule.Currency)
+	}
+	if rule.TaxType == "" {
+		return errors.New("tax_type is required")
+	}
+	if rule.Base != TaxBaseFee && rule.Base != TaxBaseTransaction {
+		return fmt.Errorf("base must be %s or %s, got %q", TaxBaseFee, TaxBaseTransaction, rule.Base)
+	}
+	if rule.RateBps < 0 || rule.RateBps > 10000 {
+		return fmt.Errorf("rate_bps must be between 0 and 10000, got %d", rule.RateBps)
+	}
+	if rule.ExemptUpToMinor < 0 || rule.CapMinor < 0 {
+		return errors.New("exemption threshold and cap cannot be negative")
+	}
+	switch rule.Rounding {
+	case "":
+		rule.Rounding = RoundingHalfUp
+	case RoundingHalfUp, RoundingDown, RoundingUp:
+	default:
+		return fmt.Errorf("unknown rounding: %s", rule.Rounding)
+	}
+	if rule.EffectiveFrom.IsZero() {
+		return errors.New("effective_from is required")
+	}
+	if rule.EffectiveTo != nil && !rule.EffectiveTo.After(rule.EffectiveFrom) {
+		return errors.New("effective_to must be after effective_from")
+	}
+	return nil
+}
+
+// TaxReturn totals the tax on recorded fees charged in a jurisdiction in
+// [start, end)
+func (s *PricingService) TaxReturn(jurisdiction, period string, start, end time.Time) *TaxReturn {
+	jurisdiction = strings.ToUpper(jurisdiction)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	totals := make(map[string]*TaxReturnLine)
+	var keys []string
+	for _, transactionID := range s.order {
+		calc := s.calculations[transactionID]
+		if calc.Jurisdiction != jurisdiction || calc.ChargedAt.Before(start) || !calc.ChargedAt.Before(end) {
+			continue
+		}
+		for _, line := range calc.TaxLines {
+			key := fmt.Sprintf("%s|%s|%d", line.TaxType, calc.Currency, line.RateBps)
+			total, ok := totals[key]
+			if !ok {
+				total = &TaxReturnLine{TaxType: line.TaxType, Currency: calc.Currency, RateBps: line.RateBps}
+				totals[key] = total
+				keys = append(keys, key)
+			}
+			total.Count++
+			total.BaseMinor += line.BaseMinor
+			total.TaxMinor += line.TaxMinor
+		}
+	}
+
+	report := &TaxReturn{
+		Jurisdiction: jurisdiction,
+		Period:       period,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		Lines:        []TaxReturnLine{},
+		GeneratedAt:  time.Now(),
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report.Lines = append(report.Lines, *totals[key])
+	}
+	return report
+}
+
+// parseReportPeriod parses a month ("2026-09") or quarter ("2026-Q3") into its
+// UTC bounds
+func parseReportPeriod(period string) (time.Time, time.Time, error) {
+	if month, err := time.Parse("2006-01", period); err == nil {
+		return month, month.AddDate(0, 1, 0), nil
+	}
+
+	parts := strings.Split(strings.ToUpper(period), "-Q")
+	if len(parts) == 2 {
+		year, yearErr := strconv.Atoi(parts[0])
+		quarter, quarterErr := strconv.Atoi(parts[1])
+		if yearErr == nil && quarterErr == nil && quarter >= 1 && quarter <= 4 {
+			start := time.Date(year, time.Month(3*quarter-2), 1, 0, 0, 0, 0, time.UTC)
+			return start, start.AddDate(0, 3, 0), nil
+		}
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, expected YYYY-MM or YYYY-Qn", period)
+}
@@ -8,8 +8,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/project-x/microservices/screening"
+)
+
+// Global services
+var (
+	onboardingService *OnboardingService
 )
 
 func main() {
@@ -18,20 +26,20 @@ func main() {
 
 	log.Printf("Starting KYB (Business Onboarding) Microservice on port %s...", *port)
 
+	complianceURL := os.Getenv("COMPLIANCE_SERVICE_URL")
+	if complianceURL == "" {
+		complianceURL = "http://compliance-service:8088"
+	}
+	onboardingService = NewOnboardingService(screening.NewClient(complianceURL))
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"kyb","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/onboard", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"id": "kyb_123",
-			"company_name": "Acme Corp",
-			"status": "pending",
-		})
-	})
+	mux.HandleFunc("/v1/onboard", handleOnboard)
+	mux.HandleFunc("/v1/onboard/", handleOnboardingByID)
 
 	server := &http.Server{
 		Addr: ":" + *port,
@@ -50,3 +58,42 @@ func main() {
 
 	log.Println("KYB (Business Onboarding) service exited")
 }
+
+func handleOnboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req OnboardingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	onboarding, err := onboardingService.Onboard(r.Context(), &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(onboarding)
+}
+
+func handleOnboardingByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	onboarding, ok := onboardingService.Get(strings.TrimPrefix(r.URL.Path, "/v1/onboard/"))
+	if !ok {
+		http.Error(w, "Onboarding not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(onboarding)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/project-x/microservices/screening"
+)
+
+// Person is a director or beneficial owner of an onboarding business
+type Person struct {
+	Name        string `json:"name"`
+	DateOfBirth string `json:"date_of_birth,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Role        string `json:"role,omitempty"` // director, beneficial_owner
+}
+
+// OnboardingRequest represents a business onboarding application
+type OnboardingRequest struct {
+	CompanyName        string   `json:"company_name"`
+	RegistrationNumber string   `json:"registration_number,omitempty"`
+	Country            string   `json:"country"`
+	Directors          []Person `json:"directors,omitempty"`
+	BeneficialOwners   []Person `json:"beneficial_owners,omitempty"`
+}
+
+// PartyScreening records the screening outcome for one party of an application
+type PartyScreening struct {
+	Name        string `json:"name"`
+	Role        string `json:"role"` // company, director, beneficial_owner
+	ScreeningID string `json:"screening_id,omitempty"`
+	Status      string `json:"status"` // clear, potential_match, failed
+	CaseID      string `json:"case_id,omitempty"`
+	HitCount    int    `json:"hit_count"`
+}
+
+// Onboarding is a business onboarding application and its screening results
+type Onboarding struct {
+	ID                 string           `json:"id"`
+	CompanyName        string           `json:"company_name"`
+	RegistrationNumber string           `json:"registration_number,omitempty"`
+	Country            string           `json:"country"`
+	Directors          []Person         `json:"directors,omitempty"`
+	BeneficialOwners   []Person         `json:"beneficial_owners,omitempty"`
+	Status             string           `json:"status"` // pending, pending_review
+	Screening          []PartyScreening `json:"screening"`
+	CreatedAt          time.Time        `json:"created_at"`
+}
+
+// Screener screens a single name against watchlists
+type Screener interface {
+	Screen(ctx context.Context, req *screening.Request) (*screening.Result, error)
+}
+
+// OnboardingService onboards businesses and screens the company and its people
+type OnboardingService struct {
+	mu          sync.RWMutex
+	onboardings map[string]*Onboarding
+	screener    Screener
+}
+
+// NewOnboardingService creates a new onboarding service
+func NewOnboardingService(screener Screener) *OnboardingService {
+	return &OnboardingService{
+		onboardings: make(map[string]*Onboarding),
+		screener:    screener,
+	}
+}
+
+// Onboard creates an application and screens every party on it. Any potential
+// match, or a screening that could not be completed, sends the application to
+// manual review.
+func (s *OnboardingService) Onboard(ctx context.Context, req *OnboardingRequest) (*Onboarding, error) {
+	if strings.TrimSpace(req.CompanyName) == "" {
+		return nil, errors.New("company name is required")
+	}
+	if strings.TrimSpace(req.Country) == "" {
+		return nil, errors.New("country is required")
+	}
+	for _, person := range append(append([]Person{}, req.Directors...), req.BeneficialOwners...) {
+		if strings.TrimSpace(person.Name) == "" {
+			return nil, errors.New("director and beneficial owner names are required")
+		}
+	}
+
+	onboarding := &Onboarding{
+		ID:                 newOnboardingID(),
+		CompanyName:        req.CompanyName,
+		RegistrationNumber: req.RegistrationNumber,
+		Country:            req.Country,
+		Directors:          req.Directors,
+		BeneficialOwners:   req.BeneficialOwners,
+		Status:             "pending",
+		CreatedAt:          time.Now(),
+	}
+
+	parties := []*screening.Request{{
+		Name:       req.CompanyName,
+		EntityType: "entity",
+		Country:    req.Country,
+	}}
+	roles := []string{"company"}
+	for _, director := range req.Directors {
+		parties = append(parties, personScreening(director))
+		roles = append(roles, "director")
+	}
+	for _, owner := range req.BeneficialOwners {
+		parties = append(parties, personScreening(owner))
+		roles = append(roles, "beneficial_owner")
+	}
+
+	for i, party := range parties {
+		party.Context = "onboarding"
+		party.ReferenceID = onboarding.ID
+
+		screening := PartyScreening{Name: party.Name, Role: roles[i]}
+		result, err := s.screener.Screen(ctx, party)
+		if err != nil {
+			log.Printf("Failed to screen %s on %s: %v", roles[i], onboarding.ID, err)
+			screening.Status = "failed"
+			onboarding.Status = "pending_review"
+		} else {
+			screening.ScreeningID = result.ID
+			screening.Status = result.Status
+			screening.CaseID = result.CaseID
+			screening.HitCount = len(result.Hits)
+			if result.Status != "clear" {
+				onboarding.Status = "pending_review"
+			}
+		}
+		onboarding.Screening = append(onboarding.Screening, screening)
+	}
+
+	s.mu.Lock()
+	s.onboardings[onboarding.ID] = onboarding
+	s.mu.Unlock()
+
+	return onboarding, nil
+}
+
+// Get returns an onboarding application by ID
+func (s *OnboardingService) Get(id string) (*Onboarding, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	onboarding, ok := s.onboardings[id]
+	return onboarding, ok
+}
+
+func personScreening(person Person) *screening.Request {
+	return &screening.Request{
+		Name:        person.Name,
+		EntityType:  "individual",
+		DateOfBirth: person.DateOfBirth,
+		Country:     person.Country,
+	}
+}
+
+func newOnboardingID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "kyb_" + hex.EncodeToString(b)
+}
@@ -144,12 +144,6 @@ func (s *Service) TransferFunds(ctx context.Context, fromAccountID, toAccountID
 		return fmt.Errorf("to account %s is not active", toAccountID)
 	}
 
-	// Validate transfer limits
-	businessValidator := NewBusinessRuleValidator()
-	if err := businessValidator.ValidateTransferLimits(ctx, fromAccount, toAccount, amount); err != nil {
-		return fmt.Errorf("transfer limits validation failed: %w", err)
-	}
-
 	// Create transfer reference
 	transferRef := generateID()
 
@@ -187,23 +181,34 @@ func (s *Service) TransferFunds(ctx context.Context, fromAccountID, toAccountID
 		UpdatedAt: time.Now(),
 	}
 
+	// Validate transfer limits
+	businessValidator := NewBusinessRuleValidator()
+	businessValidator.SetLimitChecker(s.limits)
+	if err := businessValidator.ValidateTransferLimits(ctx, fromAccount, toAccount, amount, debitEntry); err != nil {
+		return fmt.Errorf("transfer limits validation failed: %w", err)
+	}
+
 	// Validate double-entry
 	entries := []*Entry{debitEntry, creditEntry}
 	if err := businessValidator.ValidateDoubleEntry(entries); err != nil {
+		s.releaseTransferLimit(ctx, debitEntry)
 		return fmt.Errorf("double-entry validation failed: %w", err)
 	}
 
 	// Validate account balances after transfer
 	if err := businessValidator.ValidateAccountBalance(ctx, fromAccount, debitEntry); err != nil {
+		s.releaseTransferLimit(ctx, debitEntry)
 		return fmt.Errorf("from account balance validation failed: %w", err)
 	}
 
 	if err := businessValidator.ValidateAccountBalance(ctx, toAccount, creditEntry); err != nil {
+		s.releaseTransferLimit(ctx, debitEntry)
 		return fmt.Errorf("to account balance validation failed: %w", err)
 	}
 
 	// Create both entries
 	if err := s.repo.CreateEntry(ctx, debitEntry); err != nil {
+		s.releaseTransferLimit(ctx, debitEntry)
 		return fmt.Errorf("failed to create debit entry: %w", err)
 	}
 
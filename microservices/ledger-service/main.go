@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -51,7 +52,12 @@ func main() {
 	log.Printf("✅ PostgreSQL connected for ledger service")
 
 	// Initialize ledger service with mock repository for now
-	ledgerService = NewService(&MockRepository{}, nil)
+	ledgerService = NewService(NewMockRepository(), nil)
+
+	// Transfers use risk-service's dynamic limits when configured
+	if riskServiceURL := os.Getenv("RISK_SERVICE_URL"); riskServiceURL != "" {
+		ledgerService.SetLimitChecker(NewHTTPLimitChecker(riskServiceURL))
+	}
 
 	// Create router
 	mux := http.NewServeMux()
@@ -64,6 +70,7 @@ func main() {
 	mux.HandleFunc("/v1/accounts/", handleAccountByID)
 	mux.HandleFunc("/v1/entries", handleEntries)
 	mux.HandleFunc("/v1/balance/", handleBalance)
+	mux.HandleFunc("/v1/transfers", handleTransfers)
 
 	// Create server with optimized settings for high-performance calculations
 	server := &http.Server{
@@ -209,6 +216,43 @@ func handleEntries(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleTransfers posts a balanced transfer between two accounts. A
+// transfer ID that was already posted returns the original transfer.
+func handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	transfer, err := ledgerService.PostTransfer(r.Context(), &req)
+	if err != nil {
+		log.Printf("Failed to post transfer %s: %v", req.TransferID, err)
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrTransferConflict):
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if transfer.Replayed {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(transfer)
+}
+
 // handleBalance handles balance retrieval
 func handleBalance(w http.ResponseWriter, r *http.Request) {
 	// Extract account ID from URL path
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -338,6 +339,68 @@ func TestLedgerService_ValidationErrors(t *testing.T) {
 	}
 }
 
+// stubLimitChecker allows transfers up to a fixed amount each
+type stubLimitChecker struct {
+	maxMinor int64
+	err      error
+	requests []*LimitRequest
+}
+
+func (c *stubLimitChecker) Consume(ctx context.Context, req *LimitRequest) (*LimitDecision, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.requests = append(c.requests, req)
+
+	if req.Amount.Value.Cmp(FromMinorUnits(req.Amount.Currency, c.maxMinor).Value) > 0 {
+		return &LimitDecision{Allowed: false, Reason: "amount exceeds per-transaction limit"}, nil
+	}
+	return &LimitDecision{Allowed: true, ReservationID: "res_" + req.ReferenceID}, nil
+}
+
+func (c *stubLimitChecker) Release(ctx context.Context, reservationID string) error {
+	return nil
+}
+
+func TestLedgerService_TransferLimits(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	limits := &stubLimitChecker{maxMinor: 10000}
+	service.SetLimitChecker(limits)
+	ctx := context.Background()
+
+	for _, id := range []string{"acc_limit_from", "acc_limit_to"} {
+		if _, err := service.CreateAccountWithValidation(ctx, &CreateAccountRequest{AccountID: id, Type: "asset", Currency: "USD"}); err != nil {
+			t.Fatalf("Failed to create account: %v", err)
+		}
+	}
+	if _, err := service.CreateEntryWithValidation(ctx, &CreateEntryRequest{
+		AccountID:   "acc_limit_from",
+		Type:        "credit",
+		Amount:      FromMinorUnits("USD", 50000),
+		Description: "Initial balance",
+	}); err != nil {
+		t.Fatalf("Failed to create initial entry: %v", err)
+	}
+
+	if err := service.TransferFunds(ctx, "acc_limit_from", "acc_limit_to", FromMinorUnits("USD", 5000), "Within limit"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(limits.requests) != 1 || limits.requests[0].Action != "transfer" || limits.requests[0].EntityID != "acc_limit_from" {
+		t.Errorf("Expected a transfer limit request for the source account, got %+v", limits.requests)
+	}
+
+	err := service.TransferFunds(ctx, "acc_limit_from", "acc_limit_to", FromMinorUnits("USD", 20000), "Over limit")
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Expected ErrLimitExceeded, got %v", err)
+	}
+
+	// The fixed limit applies while the limits service is unavailable
+	limits.err = errors.New("connection refused")
+	if err := service.TransferFunds(ctx, "acc_limit_from", "acc_limit_to", FromMinorUnits("USD", 20000), "Fallback"); err != nil {
+		t.Errorf("Expected the fixed limit to allow the transfer, got %v", err)
+	}
+}
+
 // Benchmark tests
 func BenchmarkLedgerService_CreateAccount(b *testing.B) {
 	repo := NewMockRepository()
@@ -388,3 +451,90 @@ func BenchmarkLedgerService_CreateEntry(b *testing.B) {
 		}
 	}
 }
+
+func TestLedgerService_PostTransfer(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+
+	req := &TransferRequest{
+		TransferID:      "fee_1:fee",
+		FromAccount:     "fee_revenue",
+		ToAccount:       "fees_receivable_merchant_1",
+		Amount:          FromMinorUnits("USD", 250),
+		Type:            "fee",
+		FromAccountType: "revenue",
+		ToAccountType:   "liability",
+	}
+	transfer, err := service.PostTransfer(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if transfer.Replayed || transfer.DebitEntryID == "" || transfer.CreditEntryID == "" {
+		t.Errorf("Expected a new transfer with two entries, got %+v", transfer)
+	}
+
+	// Posting the same transfer again books nothing
+	replay, err := service.PostTransfer(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !replay.Replayed || replay.DebitEntryID != transfer.DebitEntryID {
+		t.Errorf("Expected the original transfer replayed, got %+v", replay)
+	}
+	for account, want := range map[string]float64{"fee_revenue": -2.5, "fees_receivable_merchant_1": 2.5} {
+		balance, _ := service.GetBalance(ctx, account)
+		if got, _ := balance.Value.Float64(); got != want {
+			t.Errorf("Expected %s balance %.2f, got %.2f", account, want, got)
+		}
+	}
+	if entries, _ := repo.ListEntries(ctx, EntryFilters{TransactionID: "fee_1:fee"}); len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(entries))
+	}
+
+	conflict := *req
+	conflict.Amount = FromMinorUnits("USD", 300)
+	if _, err := service.PostTransfer(ctx, &conflict); !errors.Is(err, ErrTransferConflict) {
+		t.Errorf("Expected ErrTransferConflict, got %v", err)
+	}
+
+	unknown := &TransferRequest{TransferID: "t_2", FromAccount: "fee_revenue", ToAccount: "nowhere", Amount: FromMinorUnits("USD", 100)}
+	if _, err := service.PostTransfer(ctx, unknown); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Expected ErrAccountNotFound, got %v", err)
+	}
+	if balance, _ := service.GetBalance(ctx, "fee_revenue"); balance.Value.Cmp(FromMinorUnits("USD", -250).Value) != 0 {
+		t.Errorf("Expected a failed transfer to post nothing, got %s", balance.Value.String())
+	}
+}
+
+func TestLedgerService_PostTransferCompletesPartialPosting(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	for _, id := range []string{"merchant_1", "refunds_clearing"} {
+		service.CreateAccountWithValidation(ctx, &CreateAccountRequest{AccountID: id, Type: "liability", Currency: "USD"})
+	}
+
+	// A posting that stopped after its debit leg
+	repo.CreateEntry(ctx, &Entry{
+		ID: "ledger_partial", AccountID: "merchant_1", TransactionID: "ref_1", Amount: FromMinorUnits("USD", -1000),
+		Metadata: map[string]interface{}{"transfer_side": TransferSideDebit},
+	})
+	merchant, _ := repo.GetAccount(ctx, "merchant_1")
+	merchant.Balance = FromMinorUnits("USD", -1000)
+
+	transfer, err := service.PostTransfer(ctx, &TransferRequest{
+		TransferID: "ref_1", FromAccount: "merchant_1", ToAccount: "refunds_clearing", Amount: FromMinorUnits("USD", 1000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if transfer.DebitEntryID != "ledger_partial" {
+		t.Errorf("Expected the existing debit leg kept, got %s", transfer.DebitEntryID)
+	}
+	merchantBalance, _ := service.GetBalance(ctx, "merchant_1")
+	clearing, _ := service.GetBalance(ctx, "refunds_clearing")
+	if merchantBalance.Value.Cmp(FromMinorUnits("USD", -1000).Value) != 0 || clearing.Value.Cmp(FromMinorUnits("USD", 1000).Value) != 0 {
+		t.Errorf("Expected only the credit leg posted, got %s and %s", merchantBalance.Value.String(), clearing.Value.String())
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Transfer legs, recorded as the "transfer_side" metadata of its entries
+const (
+	TransferSideDebit  = "debit"
+	TransferSideCredit = "credit"
+)
+
+var (
+	// ErrAccountNotFound is returned when a transfer names an account that
+	// does not exist and is not to be opened
+	ErrAccountNotFound = errors.New("account not found")
+	// ErrTransferConflict is returned when a transfer ID is reused for a
+	// different transfer
+	ErrTransferConflict = errors.New("transfer id already used for a different transfer")
+)
+
+// TransferRequest moves an amount from one account to another as one
+// balanced posting. TransferID is the caller's idempotency key: posting the
+// same transfer again returns the original instead of booking it twice.
+type TransferRequest struct {
+	TransferID  string                 `json:"transfer_id"`
+	FromAccount string                 `json:"from_account"`
+	ToAccount   string                 `json:"to_account"`
+	Amount      Money                  `json:"amount"`
+	Type        string                 `json:"type"`
+	Description string                 `json:"description"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+
+	// Account types to open the accounts with if they do not exist yet;
+	// without one a missing account fails the transfer
+	FromAccountType string `json:"from_account_type,omitempty"`
+	ToAccountType   string `json:"to_account_type,omitempty"`
+}
+
+// Transfer is a posted transfer and its two entries
+type Transfer struct {
+	ID            string    `json:"id"`
+	FromAccount   string    `json:"from_account"`
+	ToAccount     string    `json:"to_account"`
+	Amount        Money     `json:"amount"`
+	DebitEntryID  string    `json:"debit_entry_id"`
+	CreditEntryID string    `json:"credit_entry_id"`
+	Replayed      bool      `json:"replayed"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PostTransfer posts both legs of a transfer under one lock after
+// validating the whole transfer, opening missing accounts when their type
+// is given. Its entries carry the transfer ID, so a retry of a transfer
+// that was posted returns it unchanged and a retry of one interrupted
+// between its legs posts only the missing leg.
+func (s *Service) PostTransfer(ctx context.Context, req *TransferRequest) (*Transfer, error) {
+	if req.TransferID == "" {
+		return nil, errors.New("transfer_id is required")
+	}
+	if req.FromAccount == "" || req.ToAccount == "" || req.FromAccount == req.ToAccount {
+		return nil, errors.New("from_account and to_account must be two different accounts")
+	}
+	if req.Amount.Value == nil || req.Amount.Value.Sign() <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	if req.Amount.Currency == "" {
+		return nil, errors.New("currency is required")
+	}
+
+	s.transferMu.Lock()
+	defer s.transferMu.Unlock()
+
+	existing, err := s.repo.ListEntries(ctx, EntryFilters{TransactionID: req.TransferID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up transfer %s: %w", req.TransferID, err)
+	}
+	legs := make(map[string]*Entry)
+	for _, entry := range existing {
+		side, _ := entry.Metadata["transfer_side"].(string)
+		if side != TransferSideDebit && side != TransferSideCredit {
+			continue
+		}
+		if !sameLeg(entry, req, side) {
+			return nil, fmt.Errorf("%w: %s", ErrTransferConflict, req.TransferID)
+		}
+		legs[side] = entry
+	}
+
+	from, err := s.transferAccount(ctx, req.FromAccount, req.FromAccountType, req.Amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.transferAccount(ctx, req.ToAccount, req.ToAccountType, req.Amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &Transfer{
+		ID:          req.TransferID,
+		FromAccount: req.FromAccount,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Replayed:    len(legs) > 0,
+		CreatedAt:   time.Now(),
+	}
+
+	sides := []struct {
+		side    string
+		account *Account
+		amount  *big.Float
+		other   string
+	}{
+		{TransferSideDebit, from, new(big.Float).Neg(req.Amount.Value), req.ToAccount},
+		{TransferSideCredit, to, new(big.Float).Set(req.Amount.Value), req.FromAccount},
+	}
+	var entries []*Entry
+	for _, side := range sides {
+		entry := legs[side.side]
+		if entry == nil {
+			metadata := map[string]interface{}{
+				"transfer_side": side.side,
+				"counterparty":  side.other,
+				"created_by":    "ledger-service",
+			}
+			for key, value := range req.Metadata {
+				metadata[key] = value
+			}
+			entry = &Entry{
+				ID:            generateID(),
+				AccountID:     side.account.ID,
+				TransactionID: req.TransferID,
+				Type:          req.Type,
+				Amount:        Money{Value: side.amount, Currency: req.Amount.Currency},
+				Description:   req.Description,
+				Reference:     req.TransferID,
+				Metadata:      metadata,
+				CreatedAt:     transfer.CreatedAt,
+				UpdatedAt:     transfer.CreatedAt,
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := NewBusinessRuleValidator().ValidateDoubleEntry(entries); err != nil {
+		return nil, fmt.Errorf("double-entry validation failed: %w", err)
+	}
+
+	for i, side := range sides {
+		entry := entries[i]
+		if legs[side.side] == nil {
+			if err := s.repo.CreateEntry(ctx, entry); err != nil {
+				return nil, fmt.Errorf("failed to create %s entry: %w", side.side, err)
+			}
+			side.account.Balance = Money{
+				Value:    new(big.Float).Add(side.account.Balance.Value, entry.Amount.Value),
+				Currency: side.account.Balance.Currency,
+			}
+			side.account.UpdatedAt = time.Now()
+			if err := s.repo.UpdateAccount(ctx, side.account); err != nil {
+				return nil, fmt.Errorf("failed to update account %s: %w", side.account.ID, err)
+			}
+		}
+		if side.side == TransferSideDebit {
+			transfer.DebitEntryID = entry.ID
+		} else {
+			transfer.CreditEntryID = entry.ID
+		}
+	}
+
+	return transfer, nil
+}
+
+// transferAccount returns a transfer's account, opening it with the given
+// type if it does not exist
+func (s *Service) transferAccount(ctx context.Context, accountID, accountType, currency string) (*Account, error) {
+	account, err := s.repo.GetAccount(ctx, accountID)
+	if err == nil && account != nil {
+		if account.Status != "active" {
+			return nil, fmt.Errorf("account %s is not active", accountID)
+		}
+		return account, nil
+	}
+	if accountType == "" {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, accountID)
+	}
+
+	return s.CreateAccountWithValidation(ctx, &CreateAccountRequest{
+		AccountID: accountID,
+		Type:      accountType,
+		Currency:  currency,
+		Metadata:  map[string]interface{}{"opened_by": "transfer"},
+	})
+}
+
+// sameLeg reports whether a posted entry is the given side of a transfer
+func sameLeg(entry *Entry, req *TransferRequest, side string) bool {
+	account, amount := req.FromAccount, new(big.Float).Neg(req.Amount.Value)
+	if side == TransferSideCredit {
+		account, amount = req.ToAccount, req.Amount.Value
+	}
+	return entry.AccountID == account &&
+		entry.Amount.Currency == req.Amount.Currency &&
+		entry.Amount.Value != nil && entry.Amount.Value.Cmp(amount) == 0
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -127,6 +129,11 @@ type Repository interface {
 type Service struct {
 	repo   Repository
 	logger interface{}
+	limits LimitChecker
+
+	// transferMu serialises transfers so each is checked and posted as
+	// one step
+	transferMu sync.Mutex
 }
 
 // NewService creates a new ledger service
@@ -174,6 +181,9 @@ func (s *Service) PostEntry(ctx context.Context, req *PostEntryRequest) (*Ledger
 	if err != nil {
 		return nil, err
 	}
+	if account == nil {
+		return nil, fmt.Errorf("account not found: %s", req.AccountID)
+	}
 
 	// Calculate new balance
 	newBalance := new(big.Float).Add(account.Balance.Value, req.Amount.Value)
@@ -218,6 +228,9 @@ func (s *Service) GetBalance(ctx context.Context, accountID string) (*Money, err
 	if err != nil {
 		return nil, err
 	}
+	if account == nil {
+		return nil, fmt.Errorf("account not found: %s", accountID)
+	}
 	return &account.Balance, nil
 }
 
@@ -282,6 +295,9 @@ func (m *MockRepository) ListEntries(ctx context.Context, filters EntryFilters)
 		if filters.AccountID != "" && entry.AccountID != filters.AccountID {
 			continue
 		}
+		if filters.TransactionID != "" && entry.TransactionID != filters.TransactionID {
+			continue
+		}
 		entries = append(entries, entry)
 	}
 	return entries, nil
@@ -297,7 +313,20 @@ func (m *MockRepository) DeleteEntry(ctx context.Context, id string) error {
 	return nil
 }
 
+// lastID keeps generated IDs unique when the clock does not advance
+// between calls
+var lastID int64
+
 // Helper functions
 func generateID() string {
-	return fmt.Sprintf("ledger_%d", time.Now().UnixNano())
+	for {
+		last := atomic.LoadInt64(&lastID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, next) {
+			return fmt.Sprintf("ledger_%d", next)
+		}
+	}
 }
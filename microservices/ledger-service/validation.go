@@ -225,6 +225,7 @@ func (v *LedgerValidator) ValidateMetadata(metadata map[string]interface{}) erro
 // BusinessRuleValidator handles business rule validation
 type BusinessRuleValidator struct {
 	validator *LedgerValidator
+	limits    LimitChecker
 }
 
 // NewBusinessRuleValidator creates a new business rule validator
@@ -311,16 +312,27 @@ func (v *BusinessRuleValidator) ValidateDoubleEntry(entries []*Entry) error {
 	return nil
 }
 
-// ValidateTransferLimits validates transfer amount limits
-func (v *BusinessRuleValidator) ValidateTransferLimits(ctx context.Context, fromAccount, toAccount *Account, amount Money) error {
+// ValidateTransferLimits validates transfer amount limits. Dynamic limit
+// usage is recorded on the transfer's debit entry.
+func (v *BusinessRuleValidator) ValidateTransferLimits(ctx context.Context, fromAccount, toAccount *Account, amount Money, debitEntry *Entry) error {
 	if fromAccount == nil || toAccount == nil {
 		return errors.New("both accounts must be provided")
 	}
 
-	// Daily transfer limits
-	dailyLimit := big.NewFloat(10000000) // $100k daily limit
-	if amount.Value.Cmp(dailyLimit) > 0 {
-		return errors.New("transfer exceeds daily limit")
+	// Dynamic limits scoped to the owner's tier and risk level, with a fixed
+	// fallback while they are unavailable
+	checked := false
+	if v.limits != nil {
+		var err error
+		if checked, err = v.consumeTransferLimit(ctx, fromAccount, amount, debitEntry); err != nil {
+			return err
+		}
+	}
+	if !checked {
+		dailyLimit := big.NewFloat(10000000) // $100k daily limit
+		if amount.Value.Cmp(dailyLimit) > 0 {
+			return errors.New("transfer exceeds daily limit")
+		}
 	}
 
 	// Cross-currency transfer validation
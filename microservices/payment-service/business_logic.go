@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"math/big"
 	"time"
 )
@@ -21,8 +22,14 @@ func (s *Service) ProcessPayment(ctx context.Context, paymentID string) error {
 		return fmt.Errorf("process not allowed: %w", err)
 	}
 
+	// Card payments can only be submitted through their provider's adapter
+	if payment.PaymentToken != "" && (s.tokenizer == nil || !s.tokenizer.HasProviderAdapter(payment.Provider)) {
+		return fmt.Errorf("%w: no adapter for provider %s", ErrDetokenizeNotAuthorized, payment.Provider)
+	}
+
 	// Validate business rules
 	validator := NewBusinessRuleValidator()
+	validator.SetLimitChecker(s.limits)
 	if err := validator.ValidatePaymentLimits(ctx, payment); err != nil {
 		return fmt.Errorf("payment limits validation failed: %w", err)
 	}
@@ -47,11 +54,28 @@ func (s *Service) ProcessPayment(ctx context.Context, paymentID string) error {
 	payment.Metadata["risk_score"] = riskScore
 	payment.Metadata["processed_at"] = time.Now()
 
-	// High risk payments require manual review
-	if riskScore > 70 {
+	// risk-service decides when available; otherwise the local score does
+	assessment := s.assessPaymentRisk(ctx, payment)
+	if assessment != nil {
+		payment.Metadata["risk_assessment_id"] = assessment.ID
+		if assessment.Decision == "block" {
+			return fmt.Errorf("%w %s", ErrPaymentBlocked, assessment.ID)
+		}
+	}
+
+	// Without risk-service there is no review case to hold a payment for,
+	// so high risk payments are declined and can be processed again once
+	// risk-service is back
+	if assessment == nil && riskScore > s.localRiskLimit {
+		return fmt.Errorf("%w: local risk score %.0f", ErrPaymentBlocked, riskScore)
+	}
+
+	// High risk payments are held for manual review
+	if assessment != nil && assessment.Decision == "review" {
 		payment.Status = "pending_review"
 		payment.Metadata["review_required"] = true
-		payment.Metadata["review_reason"] = "high_risk_score"
+		payment.Metadata["review_reason"] = "risk_review"
+		payment.Metadata["review_case_id"] = assessment.ReviewCaseID
 	} else {
 		// Update status to processing
 		payment.Status = "processing"
@@ -64,6 +88,16 @@ func (s *Service) ProcessPayment(ctx context.Context, paymentID string) error {
 		return fmt.Errorf("failed to update payment: %w", err)
 	}
 
+	// Held payments are not submitted until the review approves them
+	if payment.Status == "pending_review" {
+		return nil
+	}
+
+	// Every submission to the provider is recorded as its own attempt
+	if err := s.submitPayment(ctx, payment); err != nil {
+		return err
+	}
+
 	// TODO: Integrate with actual payment processor
 	// TODO: Handle webhook responses
 	// TODO: Update ledger entries
@@ -79,7 +113,7 @@ func (s *Service) CompletePayment(ctx context.Context, paymentID string, provide
 	}
 
 	// Validate completion is allowed
-	allowedStatuses := []string{"processing", "pending_review"}
+	allowedStatuses := []string{"processing"}
 	statusAllowed := false
 	for _, status := range allowedStatuses {
 		if payment.Status == status {
@@ -102,18 +136,39 @@ func (s *Service) CompletePayment(ctx context.Context, paymentID string, provide
 	payment.Metadata["completed_at"] = time.Now()
 	payment.Metadata["provider_transaction_id"] = providerTransactionID
 
-	// Calculate fees
-	fees, err := s.CalculatePaymentFees(*payment)
-	if err != nil {
-		return fmt.Errorf("failed to calculate fees: %w", err)
+	// Price the payment with the merchant's plan. The capture has happened,
+	// so a fees-service outage leaves the fee to RetryPendingFees.
+	if err := s.chargePaymentFees(ctx, payment); err != nil {
+		log.Printf("Failed to charge fees for payment %s, retrying later: %v", payment.ID, err)
+		payment.Metadata["fees_pending"] = true
 	}
-	payment.Metadata["fees"] = fees
 
 	// Update in repository
 	if err := s.repo.UpdatePayment(ctx, payment); err != nil {
 		return fmt.Errorf("failed to update payment: %w", err)
 	}
 
+	attempt, _, err := s.finishAttempt(ctx, payment.ID, func(attempt *PaymentAttempt) {
+		attempt.Status = "succeeded"
+		attempt.ProviderTransactionID = providerTransactionID
+	})
+	if err != nil {
+		return err
+	}
+	s.recordAttemptOutcome(payment, attempt)
+
+	if s.billing != nil {
+		if err := s.billing.handlePaymentCompleted(ctx, payment); err != nil {
+			log.Printf("Failed to settle invoice for payment %s: %v", payment.ID, err)
+		}
+	}
+
+	if s.checkout != nil {
+		if err := s.checkout.handlePaymentCompleted(ctx, payment); err != nil {
+			log.Printf("Failed to complete checkout session for payment %s: %v", payment.ID, err)
+		}
+	}
+
 	// TODO: Create ledger entries
 	// TODO: Send completion notifications
 	// TODO: Update escrow if applicable
@@ -143,22 +198,55 @@ func (s *Service) FailPayment(ctx context.Context, paymentID string, reason stri
 	payment.Metadata["failed_at"] = time.Now()
 	payment.Metadata["failure_reason"] = reason
 
-	// Increment retry count
-	if retryCount, exists := payment.Metadata["retry_count"]; exists {
-		if count, ok := retryCount.(float64); ok {
-			payment.Metadata["retry_count"] = count + 1
-		}
-	} else {
-		payment.Metadata["retry_count"] = 1
-	}
-
 	// Update in repository
 	if err := s.repo.UpdatePayment(ctx, payment); err != nil {
 		return fmt.Errorf("failed to update payment: %w", err)
 	}
 
+	decline := ClassifyDecline(reason)
+	attempt, attempts, err := s.finishAttempt(ctx, payment.ID, func(attempt *PaymentAttempt) {
+		attempt.Status = "failed"
+		attempt.FailureReason = reason
+		attempt.DeclineCode = decline.Code
+		attempt.DeclineCategory = decline.Category
+	})
+	if err != nil {
+		return err
+	}
+	s.recordAttemptOutcome(payment, attempt)
+
+	// Subscription invoices are retried by the dunning schedule instead
+	if _, isInvoice := payment.Metadata["invoice_id"]; isInvoice && s.billing != nil {
+		if err := s.billing.handlePaymentFailed(ctx, payment, reason); err != nil {
+			log.Printf("Failed to apply dunning for payment %s: %v", payment.ID, err)
+		}
+		return nil
+	}
+
+	scheduled, err := s.scheduleRetry(ctx, attempt, attempts)
+	if err != nil {
+		return err
+	}
+
+	if scheduled {
+		s.publishEvent(ctx, "payment.retry_scheduled", payment.ID, map[string]interface{}{
+			"payment_id":     payment.ID,
+			"attempt_number": attempt.AttemptNumber,
+			"decline_code":   decline.Code,
+			"next_retry_at":  attempt.NextRetryAt,
+		})
+	} else {
+		s.publishEvent(ctx, "payment.failed", payment.ID, map[string]interface{}{
+			"payment_id":       payment.ID,
+			"decline_code":     decline.Code,
+			"decline_category": decline.Category,
+			"attempts":         len(attempts),
+		})
+	
+		s.reopenCheckout(ctx, payment)
+	}
+
 	// TODO: Send failure notifications
-	// TODO: Handle automatic retry logic
 	// TODO: Update related escrow status
 
 	return nil
@@ -166,31 +254,36 @@ func (s *Service) FailPayment(ctx context.Context, paymentID string, reason stri
 
 // RefundPayment processes payment refund
 func (s *Service) RefundPayment(ctx context.Context, paymentID string, refundAmount Money, reason string) error {
+	_, err := s.RecordRefund(ctx, paymentID, "", refundAmount, reason)
+	return err
+}
+
+// RecordRefund applies a refund to a payment's status and refund history.
+// refunds-service reports each refund that succeeded with its refund ID;
+// reporting the same refund ID again leaves the payment unchanged.
+func (s *Service) RecordRefund(ctx context.Context, paymentID, refundID string, refundAmount Money, reason string) (*Payment, error) {
 	payment, err := s.repo.GetPayment(ctx, paymentID)
 	if err != nil {
-		return fmt.Errorf("failed to get payment: %w", err)
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	if refundID != "" && hasRefund(payment, refundID) {
+		return payment, nil
 	}
 
 	// Validate refund is allowed
 	if err := ValidatePaymentAction(payment, "refund"); err != nil {
-		return fmt.Errorf("refund not allowed: %w", err)
+		return nil, fmt.Errorf("refund not allowed: %w", err)
 	}
 
 	// Validate refund amount
 	if err := s.validateRefundAmount(payment, refundAmount); err != nil {
-		return fmt.Errorf("invalid refund amount: %w", err)
+		return nil, fmt.Errorf("invalid refund amount: %w", err)
 	}
 
 	// Check if partial or full refund
 	isFullRefund := refundAmount.Value.Cmp(payment.Amount.Value) == 0
 
-	// Update payment status
-	if isFullRefund {
-		payment.Status = "refunded"
-	} else {
-		payment.Status = "partially_refunded"
-	}
-
 	payment.UpdatedAt = time.Now()
 
 	if payment.Metadata == nil {
@@ -205,6 +298,9 @@ func (s *Service) RefundPayment(ctx context.Context, paymentID string, refundAmo
 		"refunded_at": time.Now(),
 		"is_full_refund": isFullRefund,
 	}
+	if refundID != "" {
+		refundData["refund_id"] = refundID
+	}
 
 	// Handle multiple refunds
 	if existingRefunds, exists := payment.Metadata["refunds"]; exists {
@@ -233,16 +329,46 @@ func (s *Service) RefundPayment(ctx context.Context, paymentID string, refundAmo
 
 	payment.Metadata["total_refunded"] = totalRefunded.String()
 
+	// Several partial refunds can add up to the full amount
+	if totalRefunded.Cmp(payment.Amount.Value) >= 0 {
+		payment.Status = "refunded"
+	} else {
+		payment.Status = "partially_refunded"
+	}
+
 	// Update in repository
 	if err := s.repo.UpdatePayment(ctx, payment); err != nil {
-		return fmt.Errorf("failed to update payment: %w", err)
+		return nil, fmt.Errorf("failed to update payment: %w", err)
 	}
 
-	// TODO: Process actual refund with payment provider
-	// TODO: Create refund ledger entries
-	// TODO: Send refund notifications
+	// Metrics count refunded payments, not refunds, so only the first
+	// refund of a payment is recorded
+	if refundCount(payment) == 1 {
+		if attempts, err := s.repo.ListPaymentAttempts(ctx, payment.ID); err == nil {
+			if authorizedAt, ok := authorizationTime(attempts); ok {
+				s.metrics.RecordRefund(payment, authorizedAt)
+			}
+		}
+	}
 
-	return nil
+	// Provider refunds and reversal ledger entries are owned by
+	// refunds-service, which reports refunds here once they succeed
+
+	return payment, nil
+}
+
+// hasRefund reports whether a refund ID is already in a payment's refunds
+func hasRefund(payment *Payment, refundID string) bool {
+	refunds, ok := payment.Metadata["refunds"].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, refund := range refunds {
+		if refundMap, ok := refund.(map[string]interface{}); ok && refundMap["refund_id"] == refundID {
+			return true
+		}
+	}
+	return false
 }
 
 // CancelPayment cancels a payment
@@ -271,6 +397,8 @@ func (s *Service) CancelPayment(ctx context.Context, paymentID string, reason st
 	if err := s.repo.UpdatePayment(ctx, payment); err != nil {
 		return fmt.Errorf("failed to update payment: %w", err)
 	}
+	s.releasePaymentLimit(ctx, payment)
+	s.reopenCheckout(ctx, payment)
 
 	// TODO: Cancel with payment provider if already processing
 	// TODO: Send cancellation notifications
@@ -291,19 +419,28 @@ func (s *Service) RetryPayment(ctx context.Context, paymentID string) error {
 		return fmt.Errorf("retry not allowed: %w", err)
 	}
 
-	// Check retry limits
-	maxRetries := 3
-	retryCount := 0
-	if count, exists := payment.Metadata["retry_count"]; exists {
-		if c, ok := count.(float64); ok {
-			retryCount = int(c)
-		}
+	// Check the decline and retry limits against the attempt history
+	last, attempts, err := s.latestAttempt(ctx, paymentID)
+	if err != nil {
+		return err
 	}
 
-	if retryCount >= maxRetries {
+	if last != nil && last.DeclineCategory == DeclineHard {
+		return ErrHardDecline
+	}
+
+	if maxRetries := s.maxRetries(payment); len(attempts)-1 >= maxRetries {
 		return fmt.Errorf("maximum retry attempts (%d) exceeded", maxRetries)
 	}
 
+	// The retry is happening now, so clear any schedule on the failed attempt
+	if last != nil && last.NextRetryAt != nil {
+		last.NextRetryAt = nil
+		if err := s.repo.UpdatePaymentAttempt(ctx, last); err != nil {
+			return fmt.Errorf("failed to update attempt: %w", err)
+		}
+	}
+
 	// Reset payment to pending for retry
 	payment.Status = "pending"
 	payment.UpdatedAt = time.Now()
@@ -322,77 +459,6 @@ func (s *Service) RetryPayment(ctx context.Context, paymentID string) error {
 	return s.ProcessPayment(ctx, paymentID)
 }
 
-// CalculatePaymentFees calculates fees for a payment
-func (s *Service) CalculatePaymentFees(payment Payment) (Money, error) {
-	if payment.Amount.Value == nil {
-		return Money{}, errors.New("payment amount cannot be nil")
-	}
-
-	// Base fee structure
-	baseFeePercent := 0.029 // 2.9%
-	fixedFee := big.NewFloat(30) // $0.30
-
-	// Payment method specific fees
-	methodFees := map[string]float64{
-		"credit_card":    0.029,
-		"debit_card":     0.024,
-		"bank_transfer":  0.008,
-		"ach":           0.008,
-		"wire_transfer": 0.015,
-		"paypal":        0.034,
-		"apple_pay":     0.029,
-		"google_pay":    0.029,
-	}
-
-	if methodFee, exists := methodFees[payment.Method]; exists {
-		baseFeePercent = methodFee
-	}
-
-	// Calculate percentage fee
-	percentageFee := big.NewFloat(0)
-	percentageFee.Mul(payment.Amount.Value, big.NewFloat(baseFeePercent))
-
-	// Total fee = percentage fee + fixed fee
-	totalFee := big.NewFloat(0)
-	totalFee.Add(percentageFee, fixedFee)
-
-	// Minimum fee
-	minFee := big.NewFloat(50) // $0.50
-	if totalFee.Cmp(minFee) < 0 {
-		totalFee = minFee
-	}
-
-	// Maximum fee cap (e.g., $500)
-	maxFee := big.NewFloat(50000) // $500
-	if totalFee.Cmp(maxFee) > 0 {
-		totalFee = maxFee
-	}
-
-	return Money{
-		Value:    totalFee,
-		Currency: payment.Amount.Currency,
-	}, nil
-}
-
-// GetPaymentMetrics returns payment metrics
-func (s *Service) GetPaymentMetrics(ctx context.Context) (*PaymentMetrics, error) {
-	// TODO: Implement actual metrics calculation from database
-	// This is a placeholder implementation
-
-	return &PaymentMetrics{
-		TotalPayments:     1000,
-		TotalVolume:       FromMinorUnits("USD", 50000000), // $500k
-		SuccessRate:       0.95,
-		AverageAmount:     FromMinorUnits("USD", 50000),    // $500
-		TopPaymentMethod:  "credit_card",
-		TopProvider:       "stripe",
-		ProcessingTime:    2.5, // seconds
-		RefundRate:        0.03,
-		ChargebackRate:    0.01,
-		FraudRate:         0.005,
-	}, nil
-}
-
 // validateRefundAmount validates refund amount against payment
 func (s *Service) validateRefundAmount(payment *Payment, refundAmount Money) error {
 	if refundAmount.Currency != payment.Amount.Currency {
@@ -430,16 +496,3 @@ func (s *Service) validateRefundAmount(payment *Payment, refundAmount Money) err
 	return nil
 }
 
-// PaymentMetrics represents payment analytics
-type PaymentMetrics struct {
-	TotalPayments     int     `json:"total_payments"`
-	TotalVolume       Money   `json:"total_volume"`
-	SuccessRate       float64 `json:"success_rate"`
-	AverageAmount     Money   `json:"average_amount"`
-	TopPaymentMethod  string  `json:"top_payment_method"`
-	TopProvider       string  `json:"top_provider"`
-	ProcessingTime    float64 `json:"processing_time_seconds"`
-	RefundRate        float64 `json:"refund_rate"`
-	ChargebackRate    float64 `json:"chargeback_rate"`
-	FraudRate         float64 `json:"fraud_rate"`
-}
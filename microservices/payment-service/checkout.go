@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// ErrCheckoutSessionNotFound is returned when a checkout session does not exist
+	ErrCheckoutSessionNotFound = errors.New("checkout session not found")
+
+	// ErrCheckoutSessionClosed is returned when a session can no longer be paid
+	ErrCheckoutSessionClosed = errors.New("checkout session is no longer open")
+)
+
+const (
+	defaultCheckoutExpiry = 24 * time.Hour
+	maxCheckoutExpiry     = 30 * 24 * time.Hour
+
+	// emvcoMerchantGUID identifies our scheme in the merchant account
+	// information template of the QR payload
+	emvcoMerchantGUID = "com.payments.checkout"
+)
+
+// CheckoutSession is a hosted payment page a merchant can share as a link or QR code
+type CheckoutSession struct {
+	ID                   string                 `json:"id"`
+	MerchantID           string                 `json:"merchant_id"`
+	MerchantName         string                 `json:"merchant_name"`
+	MerchantCity         string                 `json:"merchant_city"`
+	CountryCode          string                 `json:"country_code"`
+	MerchantCategoryCode string                 `json:"merchant_category_code"`
+	Amount               Money                  `json:"amount"`
+	AllowedMethods       []string               `json:"allowed_methods"`
+	Description          string                 `json:"description"`
+	Status               string                 `json:"status"` // open, pending, completed, expired, cancelled
+	URL                  string                 `json:"url"`
+	QRPayload            string                 `json:"qr_payload"`
+	SuccessURL           string                 `json:"success_url"`
+	CancelURL            string                 `json:"cancel_url"`
+	PaymentID            string                 `json:"payment_id,omitempty"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+	ExpiresAt            time.Time              `json:"expires_at"`
+	CompletedAt          *time.Time             `json:"completed_at,omitempty"`
+	CreatedAt            time.Time              `json:"created_at"`
+	UpdatedAt            time.Time              `json:"updated_at"`
+}
+
+// CreateCheckoutSessionRequest represents a request to create a checkout session
+type CreateCheckoutSessionRequest struct {
+	MerchantID           string                 `json:"merchant_id"`
+	MerchantName         string                 `json:"merchant_name"`
+	MerchantCity         string                 `json:"merchant_city"`
+	CountryCode          string                 `json:"country_code"`
+	MerchantCategoryCode string                 `json:"merchant_category_code"`
+	Amount               Money                  `json:"amount"`
+	AllowedMethods       []string               `json:"allowed_methods"`
+	Description          string                 `json:"description"`
+	SuccessURL           string                 `json:"success_url"`
+	CancelURL            string                 `json:"cancel_url"`
+	ExpiresAt            *time.Time             `json:"expires_at,omitempty"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// CompleteCheckoutSessionRequest carries the payer's details when paying a session
+type CompleteCheckoutSessionRequest struct {
+	AccountID     string `json:"account_id"`
+	Provider      string `json:"provider"`
+	PaymentMethod string `json:"payment_method"`
+	PaymentToken  string `json:"payment_token,omitempty"`
+}
+
+// CheckoutRepository interface for checkout session data access
+type CheckoutRepository interface {
+	CreateSession(ctx context.Context, session *CheckoutSession) error
+	GetSession(ctx context.Context, id string) (*CheckoutSession, error)
+	UpdateSession(ctx context.Context, session *CheckoutSession) error
+	ListSessions(ctx context.Context, merchantID string) ([]*CheckoutSession, error)
+}
+
+// CheckoutSessions creates and settles hosted checkout sessions
+type CheckoutSessions struct {
+	payments *Service
+	repo     CheckoutRepository
+	baseURL  string
+	now      func() time.Time
+
+	// mu serialises completion so a session can only be paid once
+	mu sync.Mutex
+}
+
+// NewCheckoutSessions creates a new checkout session service. baseURL is the
+// public address of the hosted payment page, e.g. https://pay.example.com/pay
+func NewCheckoutSessions(payments *Service, repo CheckoutRepository, baseURL string) *CheckoutSessions {
+	return &CheckoutSessions{
+		payments: payments,
+		repo:     repo,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		now:      time.Now,
+	}
+}
+
+// SetCheckoutSessions connects payment outcomes to checkout sessions
+func (s *Service) SetCheckoutSessions(checkout *CheckoutSessions) {
+	s.checkout = checkout
+}
+
+// reopenCheckout reopens the checkout session of a payment that will not
+// complete
+func (s *Service) reopenCheckout(ctx context.Context, payment *Payment) {
+	if s.checkout == nil {
+		return
+	}
+	if err := s.checkout.handlePaymentClosed(ctx, payment); err != nil {
+		log.Printf("Failed to reopen checkout session for payment %s: %v", payment.ID, err)
+	}
+}
+
+// CreateSession creates a checkout session with its shareable URL and QR payload
+func (c *CheckoutSessions) CreateSession(ctx context.Context, req *CreateCheckoutSessionRequest) (*CheckoutSession, error) {
+	now := c.now()
+	if err := ValidateCreateCheckoutSessionRequest(req, now); err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+
+	expiresAt := now.Add(defaultCheckoutExpiry)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+
+	countryCode := strings.ToUpper(req.CountryCode)
+	if countryCode == "" {
+		countryCode = "US"
+	}
+
+	categoryCode := req.MerchantCategoryCode
+	if categoryCode == "" {
+		categoryCode = "5999"
+	}
+
+	id, err := newCheckoutSessionID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	session := &CheckoutSession{
+		ID:                   id,
+		MerchantID:           req.MerchantID,
+		MerchantName:         req.MerchantName,
+		MerchantCity:         req.MerchantCity,
+		CountryCode:          countryCode,
+		MerchantCategoryCode: categoryCode,
+		Amount:               req.Amount,
+		AllowedMethods:       req.AllowedMethods,
+		Description:          req.Description,
+		Status:               "open",
+		URL:                  c.baseURL + "/" + id,
+		SuccessURL:           req.SuccessURL,
+		CancelURL:            req.CancelURL,
+		Metadata:             req.Metadata,
+		ExpiresAt:            expiresAt,
+		CreatedAt:            now,
+		UpdatedAt:            now,
+	}
+
+	session.QRPayload, err = BuildEMVCoQRPayload(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build QR payload: %w", err)
+	}
+
+	if err := c.repo.CreateSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to create checkout session: %w", err)
+	}
+
+	c.payments.publishEvent(ctx, "checkout.session.created", session.ID, checkoutEventData(session))
+
+	return session, nil
+}
+
+// GetSession retrieves a checkout session, expiring it if its time has passed
+func (c *CheckoutSessions) GetSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	session, err := c.repo.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Status == "open" && !c.now().Before(session.ExpiresAt) {
+		session.Status = "expired"
+		session.UpdatedAt = c.now()
+		if err := c.repo.UpdateSession(ctx, session); err != nil {
+			return nil, fmt.Errorf("failed to update checkout session: %w", err)
+		}
+		c.payments.publishEvent(ctx, "checkout.session.expired", session.ID, checkoutEventData(session))
+	}
+
+	return session, nil
+}
+
+// ListSessions lists a merchant's checkout sessions
+func (c *CheckoutSessions) ListSessions(ctx context.Context, merchantID string) ([]*CheckoutSession, error) {
+	return c.repo.ListSessions(ctx, merchantID)
+}
+
+// CancelSession closes an open session so it can no longer be paid
+func (c *CheckoutSessions) CancelSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, err := c.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Status != "open" {
+		return nil, ErrCheckoutSessionClosed
+	}
+
+	session.Status = "cancelled"
+	session.UpdatedAt = c.now()
+	if err := c.repo.UpdateSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to update checkout session: %w", err)
+	}
+
+	c.payments.publishEvent(ctx, "checkout.session.cancelled", session.ID, checkoutEventData(session))
+
+	return session, nil
+}
+
+// CompleteSession pays a session. The payment goes through the normal
+// CreatePayment and ProcessPayment path and the session waits pending
+// until the payment completes, when the merchant is notified through a
+// checkout.session.completed event. A payment that is declined, fails or
+// is cancelled reopens the session so the payer can try again.
+func (c *CheckoutSessions) CompleteSession(ctx context.Context, id string, req *CompleteCheckoutSessionRequest) (*CheckoutSession, error) {
+	if req == nil || strings.TrimSpace(req.AccountID) == "" {
+		return nil, errors.New("validation failed: account ID cannot be empty")
+	}
+
+	session, err := c.startPayment(ctx, id, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Payment outcomes reach the session through the payment service's
+	// hooks, which take c.mu, so the payment is processed without it
+	if err := c.payments.ProcessPayment(ctx, session.PaymentID); err != nil {
+		if cancelErr := c.payments.CancelPayment(ctx, session.PaymentID, "checkout payment not processed"); cancelErr != nil {
+			log.Printf("Failed to cancel payment %s of checkout session %s: %v", session.PaymentID, session.ID, cancelErr)
+		}
+		return nil, fmt.Errorf("failed to process payment: %w", err)
+	}
+
+	return c.GetSession(ctx, id)
+}
+
+// startPayment creates the payment of an open session and marks the
+// session pending so it can only be paid once
+func (c *CheckoutSessions) startPayment(ctx context.Context, id string, req *CompleteCheckoutSessionRequest) (*CheckoutSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, err := c.GetSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Status != "open" {
+		return nil, ErrCheckoutSessionClosed
+	}
+
+	if !containsString(session.AllowedMethods, req.PaymentMethod) {
+		return nil, fmt.Errorf("payment method %s is not allowed for this session", req.PaymentMethod)
+	}
+
+	payment, err := c.payments.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     req.AccountID,
+		Provider:      req.Provider,
+		PaymentMethod: req.PaymentMethod,
+		Amount:        session.Amount,
+		Description:   session.Description,
+		PaymentToken:  req.PaymentToken,
+		Metadata: map[string]interface{}{
+			"checkout_session_id": session.ID,
+			"merchant_id":         session.MerchantID,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payment: %w", err)
+	}
+
+	session.Status = "pending"
+	session.PaymentID = payment.ID
+	session.UpdatedAt = c.now()
+
+	if err := c.repo.UpdateSession(ctx, session); err != nil {
+		return nil, fmt.Errorf("failed to update checkout session: %w", err)
+	}
+
+	return session, nil
+}
+
+// handlePaymentCompleted completes the session a checkout payment belongs to
+func (c *CheckoutSessions) handlePaymentCompleted(ctx context.Context, payment *Payment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, err := c.sessionOf(ctx, payment)
+	if session == nil || err != nil {
+		return err
+	}
+
+	now := c.now()
+	session.Status = "completed"
+	session.CompletedAt = &now
+	session.UpdatedAt = now
+
+	if err := c.repo.UpdateSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update checkout session: %w", err)
+	}
+
+	c.payments.publishEvent(ctx, "checkout.session.completed", session.ID, checkoutEventData(session))
+
+	return nil
+}
+
+// handlePaymentClosed reopens the session of a checkout payment that failed
+// for good or was cancelled
+func (c *CheckoutSessions) handlePaymentClosed(ctx context.Context, payment *Payment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	session, err := c.sessionOf(ctx, payment)
+	if session == nil || err != nil {
+		return err
+	}
+
+	session.Status = "open"
+	session.PaymentID = ""
+	session.UpdatedAt = c.now()
+
+	if err := c.repo.UpdateSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to update checkout session: %w", err)
+	}
+
+	return nil
+}
+
+// sessionOf returns the pending session a payment was made for, or nil
+// when the payment is not the session's current one. Callers hold c.mu.
+func (c *CheckoutSessions) sessionOf(ctx context.Context, payment *Payment) (*CheckoutSession, error) {
+	sessionID, _ := payment.Metadata["checkout_session_id"].(string)
+	if sessionID == "" {
+		return nil, nil
+	}
+
+	session, err := c.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Status != "pending" || session.PaymentID != payment.ID {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// ValidateCreateCheckoutSessionRequest validates checkout session creation request
+func ValidateCreateCheckoutSessionRequest(req *CreateCheckoutSessionRequest, now time.Time) error {
+	if req == nil {
+		return errors.New("checkout session request cannot be nil")
+	}
+
+	if strings.TrimSpace(req.MerchantID) == "" {
+		return errors.New("merchant ID cannot be empty")
+	}
+
+	// Name and city are mandatory in EMVCo merchant-presented QR codes
+	if strings.TrimSpace(req.MerchantName) == "" {
+		return errors.New("merchant name cannot be empty")
+	}
+
+	if strings.TrimSpace(req.MerchantCity) == "" {
+		return errors.New("merchant city cannot be empty")
+	}
+
+	if req.CountryCode != "" && len(req.CountryCode) != 2 {
+		return errors.New("country code must be a two-letter ISO 3166 code")
+	}
+
+	if req.MerchantCategoryCode != "" {
+		if _, err := strconv.Atoi(req.MerchantCategoryCode); err != nil || len(req.MerchantCategoryCode) != 4 {
+			return errors.New("merchant category code must be four digits")
+		}
+	}
+
+	validator := NewPaymentValidator()
+	if err := validator.ValidateAmount(req.Amount); err != nil {
+		return fmt.Errorf("invalid amount: %w", err)
+	}
+
+	if err := validator.ValidateCurrency(req.Amount.Currency); err != nil {
+		return fmt.Errorf("invalid currency: %w", err)
+	}
+
+	if _, ok := iso4217Numeric[req.Amount.Currency]; !ok {
+		return fmt.Errorf("currency %s is not supported for QR checkout", req.Amount.Currency)
+	}
+
+	if len(req.AllowedMethods) == 0 {
+		return errors.New("at least one payment method must be allowed")
+	}
+
+	for _, method := range req.AllowedMethods {
+		if err := validator.ValidatePaymentMethod(method); err != nil {
+			return fmt.Errorf("invalid allowed method: %w", err)
+		}
+	}
+
+	if strings.TrimSpace(req.Description) == "" {
+		return errors.New("description cannot be empty")
+	}
+
+	if len(req.Description) > 500 {
+		return errors.New("description cannot exceed 500 characters")
+	}
+
+	if err := validateRedirectURL(req.SuccessURL); err != nil {
+		return fmt.Errorf("invalid success URL: %w", err)
+	}
+
+	if err := validateRedirectURL(req.CancelURL); err != nil {
+		return fmt.Errorf("invalid cancel URL: %w", err)
+	}
+
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return errors.New("expiry must be in the future")
+		}
+		if req.ExpiresAt.Sub(now) > maxCheckoutExpiry {
+			return errors.New("expiry cannot be more than 30 days away")
+		}
+	}
+
+	if err := validator.ValidateMetadata(req.Metadata); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	return nil
+}
+
+func validateRedirectURL(raw string) error {
+	if raw == "" {
+		return errors.New("URL cannot be empty")
+	}
+
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return errors.New("URL must use http or https")
+	}
+
+	if parsed.Host == "" {
+		return errors.New("URL must be absolute")
+	}
+
+	return nil
+}
+
+// EMVCo merchant-presented QR
+
+// iso4217Numeric maps supported currencies to their ISO 4217 numeric code
+// and number of minor unit digits
+var iso4217Numeric = map[string]struct {
+	Code   string
+	Digits int
+}{
+	"USD": {"840", 2},
+	"EUR": {"978", 2},
+	"GBP": {"826", 2},
+	"CAD": {"124", 2},
+	"AUD": {"036", 2},
+	"JPY": {"392", 0},
+	"CHF": {"756", 2},
+	"SEK": {"752", 2},
+	"NOK": {"578", 2},
+	"DKK": {"208", 2},
+}
+
+// BuildEMVCoQRPayload encodes a session as a dynamic EMVCo merchant-presented
+// QR payload. The session ID is carried as the reference label so scanning
+// apps can complete the right session.
+func BuildEMVCoQRPayload(session *CheckoutSession) (string, error) {
+	currency, ok := iso4217Numeric[session.Amount.Currency]
+	if !ok {
+		return "", fmt.Errorf("unsupported currency: %s", session.Amount.Currency)
+	}
+
+	if session.Amount.Value == nil {
+		return "", errors.New("amount cannot be nil")
+	}
+
+	merchantAccount := emvcoField("00", emvcoMerchantGUID) +
+		emvcoField("01", session.MerchantID)
+	if len(merchantAccount) > 99 {
+		return "", errors.New("merchant account information exceeds 99 characters")
+	}
+
+	var b strings.Builder
+	b.WriteString(emvcoField("00", "01")) // payload format indicator
+	b.WriteString(emvcoField("01", "12")) // dynamic, single use
+	b.WriteString(emvcoField("26", merchantAccount))
+	b.WriteString(emvcoField("52", session.MerchantCategoryCode))
+	b.WriteString(emvcoField("53", currency.Code))
+	b.WriteString(emvcoField("54", session.Amount.Value.Text('f', currency.Digits)))
+	b.WriteString(emvcoField("58", session.CountryCode))
+	b.WriteString(emvcoField("59", truncateBytes(session.MerchantName, 25)))
+	b.WriteString(emvcoField("60", truncateBytes(session.MerchantCity, 15)))
+	b.WriteString(emvcoField("62", emvcoField("05", truncateBytes(session.ID, 25))))
+
+	// The CRC covers everything up to and including its own tag and length
+	b.WriteString("6304")
+	payload := b.String()
+	return payload + fmt.Sprintf("%04X", crc16CCITT([]byte(payload))), nil
+}
+
+// ParseEMVCoQRPayload splits a QR payload into its top-level fields after
+// checking its CRC
+func ParseEMVCoQRPayload(payload string) (map[string]string, error) {
+	if len(payload) < 8 || payload[len(payload)-8:len(payload)-4] != "6304" {
+		return nil, errors.New("payload has no CRC field")
+	}
+
+	expected := fmt.Sprintf("%04X", crc16CCITT([]byte(payload[:len(payload)-4])))
+	if !strings.EqualFold(expected, payload[len(payload)-4:]) {
+		return nil, errors.New("payload CRC mismatch")
+	}
+
+	return parseEMVCoFields(payload)
+}
+
+func parseEMVCoFields(data string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for i := 0; i < len(data); {
+		if i+4 > len(data) {
+			return nil, errors.New("truncated field header")
+		}
+
+		tag := data[i : i+2]
+		length, err := strconv.Atoi(data[i+2 : i+4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid length for field %s", tag)
+		}
+
+		if i+4+length > len(data) {
+			return nil, fmt.Errorf("truncated value for field %s", tag)
+		}
+
+		fields[tag] = data[i+4 : i+4+length]
+		i += 4 + length
+	}
+	return fields, nil
+}
+
+func emvcoField(tag, value string) string {
+	return fmt.Sprintf("%s%02d%s", tag, len(value), value)
+}
+
+// crc16CCITT computes CRC-16/CCITT-FALSE as required by the EMVCo specification
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// truncateBytes shortens s to at most max bytes without splitting a rune.
+// EMVCo field lengths count bytes, so multi-byte characters use more of the
+// limit than they appear to.
+func truncateBytes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newCheckoutSessionID returns an unguessable ID, since holding the ID is
+// enough to pay the session
+func newCheckoutSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "cs_" + hex.EncodeToString(b), nil
+}
+
+func checkoutEventData(session *CheckoutSession) map[string]interface{} {
+	return map[string]interface{}{
+		"session_id":  session.ID,
+		"merchant_id": session.MerchantID,
+		"status":      session.Status,
+		"amount":      session.Amount.Value.String(),
+		"currency":    session.Amount.Currency,
+		"payment_id":  session.PaymentID,
+	}
+}
+
+// InMemoryCheckoutRepository implements CheckoutRepository in memory
+type InMemoryCheckoutRepository struct {
+	mu       sync.RWMutex
+	sessions map[string]*CheckoutSession
+}
+
+// NewInMemoryCheckoutRepository creates a new in-memory checkout repository
+func NewInMemoryCheckoutRepository() *InMemoryCheckoutRepository {
+	return &InMemoryCheckoutRepository{
+		sessions: make(map[string]*CheckoutSession),
+	}
+}
+
+func (r *InMemoryCheckoutRepository) CreateSession(ctx context.Context, session *CheckoutSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *session
+	r.sessions[session.ID] = &stored
+	return nil
+}
+
+func (r *InMemoryCheckoutRepository) GetSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	session, exists := r.sessions[id]
+	if !exists {
+		return nil, ErrCheckoutSessionNotFound
+	}
+	result := *session
+	return &result, nil
+}
+
+func (r *InMemoryCheckoutRepository) UpdateSession(ctx context.Context, session *CheckoutSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.sessions[session.ID]; !exists {
+		return ErrCheckoutSessionNotFound
+	}
+	stored := *session
+	r.sessions[session.ID] = &stored
+	return nil
+}
+
+func (r *InMemoryCheckoutRepository) ListSessions(ctx context.Context, merchantID string) ([]*CheckoutSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sessions := []*CheckoutSession{}
+	for _, session := range r.sessions {
+		if merchantID != "" && session.MerchantID != merchantID {
+			continue
+		}
+		result := *session
+		sessions = append(sessions, &result)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
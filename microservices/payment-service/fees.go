@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// ErrFeesUnavailable is returned when fees-service cannot price a payment
+var ErrFeesUnavailable = errors.New("fees unavailable")
+
+// FeeRequest asks fees-service to price a transaction
+type FeeRequest struct {
+	MerchantID    string `json:"merchant_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Type          string `json:"type"`
+	Method        string `json:"method,omitempty"`
+	Currency      string `json:"currency"`
+	Region        string `json:"region,omitempty"`
+	AmountMinor   int64  `json:"amount_minor"`
+}
+
+// FeeQuote is the fee fees-service charged and the plan it came from
+type FeeQuote struct {
+	FeeMinor    int64  `json:"fee_minor"`
+	Currency    string `json:"currency"`
+	PlanID      string `json:"plan_id"`
+	PlanVersion int    `json:"plan_version"`
+	RuleID      string `json:"rule_id"`
+}
+
+// FeeCalculator prices transactions with the merchant's pricing plan
+type FeeCalculator interface {
+	Calculate(ctx context.Context, req *FeeRequest) (*FeeQuote, error)
+}
+
+// SetFeeCalculator configures pricing with fees-service
+func (s *Service) SetFeeCalculator(fees FeeCalculator) {
+	s.fees = fees
+}
+
+// chargePaymentFees records the fee of a payment's merchant plan on the
+// payment, or nothing without a fee calculator
+func (s *Service) chargePaymentFees(ctx context.Context, payment *Payment) error {
+	if s.fees == nil {
+		return nil
+	}
+
+	req := &FeeRequest{
+		MerchantID:    payment.AccountID,
+		TransactionID: payment.ID,
+		Type:          "payment",
+		Method:        payment.Method,
+		Currency:      payment.Amount.Currency,
+		AmountMinor:   moneyToMinorUnits(payment.Amount),
+	}
+	if merchantID, ok := payment.Metadata["merchant_id"].(string); ok && merchantID != "" {
+		req.MerchantID = merchantID
+	}
+	if region, ok := payment.Metadata["region"].(string); ok {
+		req.Region = region
+	}
+
+	quote, err := s.fees.Calculate(ctx, req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFeesUnavailable, err)
+	}
+	payment.Metadata["fees"] = FromMinorUnits(payment.Amount.Currency, quote.FeeMinor)
+	payment.Metadata["fee_plan"] = fmt.Sprintf("%s@%d", quote.PlanID, quote.PlanVersion)
+	return nil
+}
+
+// RetryPendingFees charges the fees of completed payments that could not be
+// priced at completion and returns how many were charged. fees-service
+// dedupes by transaction ID, so a retry never charges a fee twice.
+func (s *Service) RetryPendingFees(ctx context.Context) (int, error) {
+	if s.fees == nil {
+		return 0, nil
+	}
+
+	charged := 0
+	for _, status := range []string{"completed", "partially_refunded", "refunded"} {
+		payments, err := s.repo.ListPayments(ctx, PaymentFilters{Status: status})
+		if err != nil {
+			return charged, fmt.Errorf("failed to list payments: %w", err)
+		}
+
+		for _, payment := range payments {
+			if pending, _ := payment.Metadata["fees_pending"].(bool); !pending {
+				continue
+			}
+			if err := s.chargePaymentFees(ctx, payment); err != nil {
+				log.Printf("Fee retry for payment %s failed: %v", payment.ID, err)
+				continue
+			}
+			delete(payment.Metadata, "fees_pending")
+			if err := s.repo.UpdatePayment(ctx, payment); err != nil {
+				return charged, fmt.Errorf("failed to update payment: %w", err)
+			}
+			charged++
+		}
+	}
+
+	return charged, nil
+}
+
+// moneyToMinorUnits converts an amount to minor units of its currency
+func moneyToMinorUnits(m Money) int64 {
+	if m.Value == nil {
+		return 0
+	}
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(m.Currency))), nil)
+	return roundHalfAway(new(big.Float).Mul(m.Value, new(big.Float).SetInt(scale))).Int64()
+}
+
+// HTTPFeeCalculator calls the fees-service pricing API over HTTP
+type HTTPFeeCalculator struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPFeeCalculator creates a new fees client
+func NewHTTPFeeCalculator(baseURL string) *HTTPFeeCalculator {
+	return &HTTPFeeCalculator{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Calculate prices a transaction
+func (c *HTTPFeeCalculator) Calculate(ctx context.Context, feeReq *FeeRequest) (*FeeQuote, error) {
+	var quote FeeQuote
+	if err := postJSON(ctx, c.client, c.baseURL+"/api/v1/fees/calculate", feeReq, &quote); err != nil {
+		return nil, err
+	}
+	return &quote, nil
+}
@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 // Global services
 var (
-	paymentService *Service
+	paymentService      *Service
+	subscriptionBilling *SubscriptionBilling
+	checkoutSessions    *CheckoutSessions
+
+	// reviewSigningKey verifies review decisions from risk-service
+	reviewSigningKey []byte
 )
 
 func main() {
@@ -25,19 +35,86 @@ func main() {
 
 	log.Printf("Starting Payment Microservice on port %s...", *port)
 
-	// Initialize payment service with mock repository
-	paymentService = NewService(&MockRepository{}, nil)
+	// Initialize payment service with in-memory repository
+	paymentService = NewService(NewInMemoryRepository(), nil)
+
+	// Publish domain events to the event bus when one is configured
+	if eventBusURL := os.Getenv("EVENTBUS_URL"); eventBusURL != "" {
+		paymentService.SetEventPublisher(NewHTTPEventPublisher(eventBusURL))
+	}
+
+	// Assess payments with risk-service; review decisions hold the payment
+	// until risk-service reports the analyst's decision. Its dynamic limits
+	// replace the fixed payment limit.
+	if riskServiceURL := os.Getenv("RISK_SERVICE_URL"); riskServiceURL != "" {
+		paymentService.SetRiskAssessor(NewHTTPRiskAssessor(riskServiceURL))
+		paymentService.SetLimitChecker(NewHTTPLimitChecker(riskServiceURL))
+	}
+
+	// Review decisions are only accepted when signed by risk-service
+	reviewSigningKey = []byte(os.Getenv("REVIEW_SIGNING_KEY"))
+	if len(reviewSigningKey) == 0 {
+		log.Println("REVIEW_SIGNING_KEY not set, review decisions will be rejected")
+	}
+
+	// Price payments with the merchant's plan in fees-service
+	if feesServiceURL := os.Getenv("FEES_SERVICE_URL"); feesServiceURL != "" {
+		paymentService.SetFeeCalculator(NewHTTPFeeCalculator(feesServiceURL))
+	} else {
+		log.Println("FEES_SERVICE_URL not set, payments will be completed without fees")
+	}
+
+	// Initialize card tokenization
+	tokenizer, err := newTokenizerFromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize card tokenization: %v", err)
+	}
+	paymentService.SetTokenizer(tokenizer)
+
+	// Initialize recurring billing
+	subscriptionBilling = NewSubscriptionBilling(paymentService, NewInMemorySubscriptionRepository(), DefaultDunningPolicy())
+	paymentService.SetSubscriptionBilling(subscriptionBilling)
+
+	billingCtx, stopBilling := context.WithCancel(context.Background())
+	defer stopBilling()
+	go runBillingScheduler(billingCtx, time.Minute)
+	go runRetryScheduler(billingCtx, time.Minute)
+	go runFeeRetry(billingCtx, time.Minute)
+
+	// Build metrics rollups from existing payments, then keep 90 days of hourly buckets
+	if err := paymentService.RebuildPaymentMetrics(context.Background()); err != nil {
+		log.Printf("Failed to rebuild payment metrics: %v", err)
+	}
+	go runMetricsPruner(billingCtx, time.Hour, 90*24*time.Hour)
+
+	// Initialize hosted checkout; links point at the public payment page
+	checkoutBaseURL := os.Getenv("CHECKOUT_BASE_URL")
+	if checkoutBaseURL == "" {
+		checkoutBaseURL = "http://localhost:" + *port + "/pay"
+	}
+	checkoutSessions = NewCheckoutSessions(paymentService, NewInMemoryCheckoutRepository(), checkoutBaseURL)
+	paymentService.SetCheckoutSessions(checkoutSessions)
 
 	// Create router
 	mux := http.NewServeMux()
 
 	// Health check endpoint
 	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/metrics", handlePrometheusMetrics)
 
 	// API endpoints
 	mux.HandleFunc("/v1/payments", handlePayments)
 	mux.HandleFunc("/v1/payments/", handlePaymentByID)
 	mux.HandleFunc("/v1/providers", handleProviders)
+	mux.HandleFunc("/v1/metrics/payments", handlePaymentMetrics)
+	mux.HandleFunc("/v1/tokens", handleTokens)
+	mux.HandleFunc("/v1/tokens/", handleTokenByID)
+	mux.HandleFunc("/v1/plans", handlePlans)
+	mux.HandleFunc("/v1/subscriptions", handleSubscriptions)
+	mux.HandleFunc("/v1/subscriptions/", handleSubscriptionByID)
+	mux.HandleFunc("/v1/checkout/sessions", handleCheckoutSessions)
+	mux.HandleFunc("/v1/checkout/sessions/", handleCheckoutSessionByID)
+	mux.HandleFunc("/pay/", handleHostedCheckout)
 
 	// Create server with optimized settings for high throughput
 	server := &http.Server{
@@ -104,6 +181,10 @@ func handlePayments(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		payment, err := paymentService.CreatePayment(r.Context(), &req)
+		if errors.Is(err, ErrLimitExceeded) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		if err != nil {
 			log.Printf("Failed to create payment: %v", err)
 			http.Error(w, "Failed to create payment", http.StatusInternalServerError)
@@ -123,6 +204,11 @@ func handlePaymentByID(w http.ResponseWriter, r *http.Request) {
 	
 	switch r.Method {
 	case "GET":
+		if strings.HasSuffix(paymentID, "/attempts") {
+			handlePaymentAttempts(w, r, strings.TrimSuffix(paymentID, "/attempts"))
+			return
+		}
+
 		payment, err := paymentService.GetPayment(r.Context(), paymentID)
 		if err != nil {
 			log.Printf("Failed to get payment: %v", err)
@@ -137,10 +223,37 @@ func handlePaymentByID(w http.ResponseWriter, r *http.Request) {
 		// Handle payment processing
 		if r.URL.Path[len("/v1/payments/"):] == paymentID+"/process" {
 			handleProcessPayment(w, r, paymentID)
+		} else if strings.HasSuffix(paymentID, "/review") {
+			handlePaymentReview(w, r, strings.TrimSuffix(paymentID, "/review"))
+		} else if strings.HasSuffix(paymentID, "/refunds") {
+			handlePaymentRefund(w, r, strings.TrimSuffix(paymentID, "/refunds"))
 		}
 	}
 }
 
+// handlePaymentRefund records a refund that succeeded in refunds-service
+func handlePaymentRefund(w http.ResponseWriter, r *http.Request, paymentID string) {
+	var req struct {
+		RefundID string `json:"refund_id"`
+		Amount   Money  `json:"amount"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Amount.Value == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := paymentService.RecordRefund(r.Context(), paymentID, req.RefundID, req.Amount, req.Reason)
+	if err != nil {
+		log.Printf("Failed to record refund %s for payment %s: %v", req.RefundID, paymentID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
 // handleProcessPayment handles payment processing
 func handleProcessPayment(w http.ResponseWriter, r *http.Request, paymentID string) {
 	var req ProcessPaymentRequest
@@ -160,6 +273,99 @@ func handleProcessPayment(w http.ResponseWriter, r *http.Request, paymentID stri
 	w.WriteHeader(http.StatusOK)
 }
 
+// handlePaymentReview applies a manual review decision from risk-service.
+// The decision must be signed by risk-service; a mismatched case is
+// forbidden rather than a conflict, which risk-service takes as resolved.
+func handlePaymentReview(w http.ResponseWriter, r *http.Request, paymentID string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !verifyReviewSignature(reviewSigningKey, body, r.Header.Get(ReviewSignatureHeader)) {
+		http.Error(w, "Invalid review signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReviewDecision
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := paymentService.ResolvePaymentReview(r.Context(), paymentID, &req)
+	if err != nil {
+		log.Printf("Failed to resolve payment review: %v", err)
+		status := http.StatusConflict
+		if errors.Is(err, ErrReviewCaseMismatch) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// handlePaymentAttempts lists the provider attempts of a payment
+func handlePaymentAttempts(w http.ResponseWriter, r *http.Request, paymentID string) {
+	attempts, err := paymentService.ListPaymentAttempts(r.Context(), paymentID)
+	if err != nil {
+		log.Printf("Failed to list payment attempts: %v", err)
+		http.Error(w, "Failed to list payment attempts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
+
+// handlePaymentMetrics returns payment metrics for a window. Query
+// parameters: from and to (RFC 3339, default last 24h), provider, method
+// and currency.
+func handlePaymentMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	query := MetricsQuery{
+		Provider: params.Get("provider"),
+		Method:   params.Get("method"),
+		Currency: params.Get("currency"),
+	}
+
+	for name, target := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" parameter", http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	metrics, err := paymentService.GetPaymentMetrics(r.Context(), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// handlePrometheusMetrics exposes payment counters for Prometheus scraping
+func handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := paymentService.metrics.WritePrometheus(w); err != nil {
+		log.Printf("Failed to write metrics: %v", err)
+	}
+}
+
 // handleProviders handles payment provider listing
 func handleProviders(w http.ResponseWriter, r *http.Request) {
 	providers, err := paymentService.GetProviders(r.Context())
@@ -172,3 +378,515 @@ func handleProviders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(providers)
 }
+
+// handleTokens handles card tokenization
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TokenizeCardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, err := paymentService.TokenizeCard(r.Context(), &req)
+	if err != nil {
+		// Never log the request itself, it carries the PAN
+		log.Printf("Failed to tokenize card for account %s: %v", req.AccountID, err)
+		http.Error(w, "Failed to tokenize card", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// handleTokenByID returns the non-sensitive details of a card token
+func handleTokenByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenID := r.URL.Path[len("/v1/tokens/"):]
+
+	token, err := paymentService.GetCardToken(r.Context(), tokenID)
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// newTokenizerFromEnv builds the card tokenizer from environment
+// configuration. Data keys come from Vault's transit engine when VAULT_ADDR
+// is set, otherwise from a local KMS under CARD_VAULT_MASTER_KEY; cards and
+// their access audit are stored in POSTGRES_URL. Outside development these
+// and CARD_FINGERPRINT_KEY are required; in development ephemeral keys and
+// in-memory stores stand in for them and every provider's card payments are
+// simulated.
+func newTokenizerFromEnv(ctx context.Context) (*Tokenizer, error) {
+	devMode := os.Getenv("ENVIRONMENT") == "development"
+
+	var keys KeyManager
+	if vaultAddr := os.Getenv("VAULT_ADDR"); vaultAddr != "" {
+		keys = NewVaultTransitKMS(vaultAddr, os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_TRANSIT_PATH"))
+		log.Printf("Wrapping card data keys with Vault transit at %s", vaultAddr)
+	} else {
+		var masterKey []byte
+		if encoded := os.Getenv("CARD_VAULT_MASTER_KEY"); encoded != "" {
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CARD_VAULT_MASTER_KEY: %w", err)
+			}
+			masterKey = key
+		} else if !devMode {
+			return nil, errors.New("VAULT_ADDR or CARD_VAULT_MASTER_KEY is required outside development")
+		} else {
+			log.Println("VAULT_ADDR and CARD_VAULT_MASTER_KEY not set, using an ephemeral local key")
+		}
+
+		kms, err := NewLocalKMS(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = kms
+	}
+
+	keyName := os.Getenv("CARD_VAULT_KEY_NAME")
+	if keyName == "" {
+		keyName = "card-pan"
+	}
+
+	fingerprintKey := []byte(os.Getenv("CARD_FINGERPRINT_KEY"))
+	if len(fingerprintKey) == 0 {
+		if !devMode {
+			return nil, errors.New("CARD_FINGERPRINT_KEY is required outside development")
+		}
+		log.Println("CARD_FINGERPRINT_KEY not set, using an ephemeral fingerprint key")
+		fingerprintKey = make([]byte, 32)
+		if _, err := rand.Read(fingerprintKey); err != nil {
+			return nil, fmt.Errorf("failed to generate fingerprint key: %w", err)
+		}
+	}
+
+	var vault CardVault
+	var audit TokenAuditLog
+	if postgresURL := os.Getenv("POSTGRES_URL"); postgresURL != "" {
+		db, err := openPostgreSQL(postgresURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open card vault: %w", err)
+		}
+		vault = NewPostgreSQLCardVault(db)
+		audit = NewPostgreSQLTokenAuditLog(db)
+	} else if !devMode {
+		return nil, errors.New("POSTGRES_URL is required outside development")
+	} else {
+		log.Println("POSTGRES_URL not set, vaulted cards and their access audit are kept in memory")
+		vault = NewInMemoryCardVault()
+		audit = NewInMemoryTokenAuditLog()
+	}
+
+	tokenizer := NewTokenizer(keys, keyName, vault, audit, fingerprintKey)
+
+	// Card payments are only submitted to providers with an adapter
+	if devMode {
+		providers, err := paymentService.GetProviders(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, provider := range providers {
+			tokenizer.RegisterProviderAdapter(provider.Name, &SimulatedCardAdapter{})
+		}
+		log.Println("Development mode: simulating card payments for every provider")
+	}
+
+	return tokenizer, nil
+}
+
+// runBillingScheduler periodically renews subscriptions and retries failed invoices
+func runBillingScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := subscriptionBilling.RunBillingCycle(ctx)
+			if err != nil {
+				log.Printf("Billing run failed: %v", err)
+				continue
+			}
+			if result.Renewed+result.Retried+result.Cancelled+result.Failed > 0 {
+				log.Printf("Billing run: renewed=%d retried=%d cancelled=%d failed=%d",
+					result.Renewed, result.Retried, result.Cancelled, result.Failed)
+			}
+		}
+	}
+}
+
+// runRetryScheduler periodically retries soft-declined payments that are due
+func runRetryScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			retried, err := paymentService.RunDueRetries(ctx)
+			if err != nil {
+				log.Printf("Payment retry run failed: %v", err)
+				continue
+			}
+			if retried > 0 {
+				log.Printf("Payment retry run: retried=%d", retried)
+			}
+		}
+	}
+}
+
+// runFeeRetry periodically charges fees that fees-service could not price
+// when their payments completed
+func runFeeRetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			charged, err := paymentService.RetryPendingFees(ctx)
+			if err != nil {
+				log.Printf("Fee retry run failed: %v", err)
+				continue
+			}
+			if charged > 0 {
+				log.Printf("Fee retry run: charged=%d", charged)
+			}
+		}
+	}
+}
+
+// runMetricsPruner periodically drops metrics rollups older than the retention
+func runMetricsPruner(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			paymentService.metrics.Prune(time.Now().Add(-retention))
+		}
+	}
+}
+
+// handlePlans handles billing plan listing and creation
+func handlePlans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		plans, err := subscriptionBilling.ListPlans(r.Context(), r.URL.Query().Get("merchant_id"))
+		if err != nil {
+			log.Printf("Failed to list plans: %v", err)
+			http.Error(w, "Failed to list plans", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plans)
+
+	case "POST":
+		var req CreatePlanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		plan, err := subscriptionBilling.CreatePlan(r.Context(), &req)
+		if err != nil {
+			log.Printf("Failed to create plan: %v", err)
+			http.Error(w, "Failed to create plan", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(plan)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSubscriptions handles subscription listing and creation
+func handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		subscriptions, err := subscriptionBilling.ListSubscriptions(r.Context(), SubscriptionFilters{
+			MerchantID: query.Get("merchant_id"),
+			AccountID:  query.Get("account_id"),
+			Status:     query.Get("status"),
+		})
+		if err != nil {
+			log.Printf("Failed to list subscriptions: %v", err)
+			http.Error(w, "Failed to list subscriptions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptions)
+
+	case "POST":
+		var req CreateSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		subscription, err := subscriptionBilling.Subscribe(r.Context(), &req)
+		if err != nil {
+			log.Printf("Failed to create subscription: %v", err)
+			http.Error(w, "Failed to create subscription", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(subscription)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSubscriptionByID handles individual subscription operations:
+// GET /v1/subscriptions/{id}, GET /v1/subscriptions/{id}/invoices,
+// POST /v1/subscriptions/{id}/cancel and POST /v1/subscriptions/{id}/change-plan
+func handleSubscriptionByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/v1/subscriptions/"):], "/"), "/")
+	subscriptionID := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case r.Method == "GET" && action == "":
+		subscription, err := subscriptionBilling.GetSubscription(r.Context(), subscriptionID)
+		if err != nil {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+
+	case r.Method == "GET" && action == "invoices":
+		invoices, err := subscriptionBilling.ListInvoices(r.Context(), subscriptionID)
+		if err != nil {
+			log.Printf("Failed to list invoices: %v", err)
+			http.Error(w, "Failed to list invoices", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invoices)
+
+	case r.Method == "POST" && action == "cancel":
+		var req struct {
+			AtPeriodEnd bool `json:"at_period_end"`
+		}
+		if r.ContentLength > 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		subscription, err := subscriptionBilling.CancelSubscription(r.Context(), subscriptionID, req.AtPeriodEnd)
+		if err != nil {
+			log.Printf("Failed to cancel subscription: %v", err)
+			http.Error(w, "Failed to cancel subscription", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+
+	case r.Method == "POST" && action == "change-plan":
+		var req struct {
+			PlanID string `json:"plan_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		subscription, err := subscriptionBilling.ChangePlan(r.Context(), subscriptionID, req.PlanID)
+		if err != nil {
+			log.Printf("Failed to change subscription plan: %v", err)
+			http.Error(w, "Failed to change plan", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscription)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleCheckoutSessions handles checkout session listing and creation
+func handleCheckoutSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		sessions, err := checkoutSessions.ListSessions(r.Context(), r.URL.Query().Get("merchant_id"))
+		if err != nil {
+			log.Printf("Failed to list checkout sessions: %v", err)
+			http.Error(w, "Failed to list checkout sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+
+	case "POST":
+		var req CreateCheckoutSessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		session, err := checkoutSessions.CreateSession(r.Context(), &req)
+		if err != nil {
+			log.Printf("Failed to create checkout session: %v", err)
+			http.Error(w, "Failed to create checkout session", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(session)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCheckoutSessionByID handles individual checkout session operations:
+// GET /v1/checkout/sessions/{id}, GET /v1/checkout/sessions/{id}/qr,
+// POST /v1/checkout/sessions/{id}/complete and POST /v1/checkout/sessions/{id}/cancel
+func handleCheckoutSessionByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/v1/checkout/sessions/"):], "/"), "/")
+	sessionID := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case r.Method == "GET" && action == "":
+		session, err := checkoutSessions.GetSession(r.Context(), sessionID)
+		if err != nil {
+			http.Error(w, "Checkout session not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+
+	case r.Method == "GET" && action == "qr":
+		session, err := checkoutSessions.GetSession(r.Context(), sessionID)
+		if err != nil {
+			http.Error(w, "Checkout session not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, session.QRPayload)
+
+	case r.Method == "POST" && action == "complete":
+		var req CompleteCheckoutSessionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		session, err := checkoutSessions.CompleteSession(r.Context(), sessionID, &req)
+		if err != nil {
+			log.Printf("Failed to complete checkout session %s: %v", sessionID, err)
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrCheckoutSessionNotFound) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, ErrCheckoutSessionClosed) {
+				status = http.StatusConflict
+			}
+			http.Error(w, "Failed to complete checkout session", status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session":      session,
+			"redirect_url": session.SuccessURL,
+		})
+
+	case r.Method == "POST" && action == "cancel":
+		session, err := checkoutSessions.CancelSession(r.Context(), sessionID)
+		if err != nil {
+			log.Printf("Failed to cancel checkout session %s: %v", sessionID, err)
+			http.Error(w, "Failed to cancel checkout session", http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session":      session,
+			"redirect_url": session.CancelURL,
+		})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleHostedCheckout serves the public view of a session behind its shareable
+// link. Only what the payer needs to see is exposed.
+func handleHostedCheckout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := checkoutSessions.GetSession(r.Context(), strings.Trim(r.URL.Path[len("/pay/"):], "/"))
+	if err != nil {
+		http.Error(w, "Checkout session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":              session.ID,
+		"merchant_name":   session.MerchantName,
+		"amount":          session.Amount,
+		"description":     session.Description,
+		"allowed_methods": session.AllowedMethods,
+		"status":          session.Status,
+		"expires_at":      session.ExpiresAt,
+		"qr_payload":      session.QRPayload,
+	})
+}
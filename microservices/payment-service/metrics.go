@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rollupKey identifies one hourly rollup bucket
+type rollupKey struct {
+	Hour     int64
+	Provider string
+	Method   string
+	Currency string
+}
+
+// rollupBucket holds pre-aggregated payment outcomes
+type rollupBucket struct {
+	Authorized       int
+	Declined         int
+	Refunded         int
+	DeclinesByReason map[string]int
+	LatencySeconds   float64
+	LatencyCount     int
+	Volume           *big.Float
+}
+
+func newRollupBucket() *rollupBucket {
+	return &rollupBucket{
+		DeclinesByReason: make(map[string]int),
+		Volume:           new(big.Float),
+	}
+}
+
+func (b *rollupBucket) merge(other *rollupBucket) {
+	b.Authorized += other.Authorized
+	b.Declined += other.Declined
+	b.Refunded += other.Refunded
+	b.LatencySeconds += other.LatencySeconds
+	b.LatencyCount += other.LatencyCount
+	b.Volume.Add(b.Volume, other.Volume)
+	for reason, count := range other.DeclinesByReason {
+		b.DeclinesByReason[reason] += count
+	}
+}
+
+// PaymentMetricsCollector keeps hourly rollups of payment outcomes by
+// provider, method and currency, so metrics over any window are computed
+// from at most one bucket per hour and dimension rather than raw payments.
+type PaymentMetricsCollector struct {
+	mu      sync.RWMutex
+	buckets map[rollupKey]*rollupBucket
+	// totals are all-time counters for Prometheus, which must never decrease
+	totals map[rollupKey]*rollupBucket
+}
+
+// NewPaymentMetricsCollector creates an empty metrics collector
+func NewPaymentMetricsCollector() *PaymentMetricsCollector {
+	return &PaymentMetricsCollector{
+		buckets: make(map[rollupKey]*rollupBucket),
+		totals:  make(map[rollupKey]*rollupBucket),
+	}
+}
+
+// MetricsQuery selects the window and dimensions for payment metrics
+type MetricsQuery struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Provider string    `json:"provider,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Currency string    `json:"currency,omitempty"`
+}
+
+// PaymentMetrics represents payment analytics. RefundRate is the share of
+// the payments authorized in the window that have since been refunded.
+type PaymentMetrics struct {
+	From              time.Time                    `json:"from"`
+	To                time.Time                    `json:"to"`
+	TotalPayments     int                          `json:"total_payments"`
+	Authorized        int                          `json:"authorized"`
+	Declined          int                          `json:"declined"`
+	TotalVolume       Money                        `json:"total_volume"`
+	VolumeByCurrency  map[string]Money             `json:"volume_by_currency"`
+	AuthorizationRate float64                      `json:"authorization_rate"`
+	AverageAmount     Money                        `json:"average_amount"`
+	TopPaymentMethod  string                       `json:"top_payment_method"`
+	TopProvider       string                       `json:"top_provider"`
+	ProcessingTime    float64                      `json:"processing_time_seconds"`
+	RefundRate        float64                      `json:"refund_rate"`
+	DeclinesByReason  map[string]int               `json:"declines_by_reason"`
+	ByProvider        map[string]*MetricsBreakdown `json:"by_provider"`
+	ByMethod          map[string]*MetricsBreakdown `json:"by_method"`
+	ByCurrency        map[string]*MetricsBreakdown `json:"by_currency"`
+}
+
+// MetricsBreakdown holds the metrics of one provider, method or currency
+type MetricsBreakdown struct {
+	Authorized        int              `json:"authorized"`
+	Declined          int              `json:"declined"`
+	AuthorizationRate float64          `json:"authorization_rate"`
+	ProcessingTime    float64          `json:"processing_time_seconds"`
+	DeclinesByReason  map[string]int   `json:"declines_by_reason"`
+	Volume            map[string]Money `json:"volume"`
+}
+
+// RecordAuthorization records a successful attempt and its latency
+func (c *PaymentMetricsCollector) RecordAuthorization(payment *Payment, at time.Time, latency time.Duration) {
+	c.record(payment, at, func(b *rollupBucket) {
+		b.Authorized++
+		if payment.Amount.Value != nil {
+			b.Volume.Add(b.Volume, payment.Amount.Value)
+		}
+		if latency > 0 {
+			b.LatencySeconds += latency.Seconds()
+			b.LatencyCount++
+		}
+	})
+}
+
+// RecordDecline records a declined attempt with its decline code
+func (c *PaymentMetricsCollector) RecordDecline(payment *Payment, at time.Time, latency time.Duration, declineCode string) {
+	c.record(payment, at, func(b *rollupBucket) {
+		b.Declined++
+		b.DeclinesByReason[declineCode]++
+		if latency > 0 {
+			b.LatencySeconds += latency.Seconds()
+			b.LatencyCount++
+		}
+	})
+}
+
+// RecordRefund records that a payment was refunded. It is called once per
+// payment, at its first refund, with the time the payment was authorized,
+// so refunded payments never outnumber authorized ones in a window.
+func (c *PaymentMetricsCollector) RecordRefund(payment *Payment, authorizedAt time.Time) {
+	c.record(payment, authorizedAt, func(b *rollupBucket) {
+		b.Refunded++
+	})
+}
+
+func (c *PaymentMetricsCollector) record(payment *Payment, at time.Time, update func(b *rollupBucket)) {
+	key := rollupKey{
+		Hour:     at.UTC().Truncate(time.Hour).Unix(),
+		Provider: payment.Provider,
+		Method:   payment.Method,
+		Currency: payment.Amount.Currency,
+	}
+	totalKey := key
+	totalKey.Hour = 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, target := range []struct {
+		buckets map[rollupKey]*rollupBucket
+		key     rollupKey
+	}{{c.buckets, key}, {c.totals, totalKey}} {
+		bucket, exists := target.buckets[target.key]
+		if !exists {
+			bucket = newRollupBucket()
+			target.buckets[target.key] = bucket
+		}
+		update(bucket)
+	}
+}
+
+// Prune drops hourly buckets older than the cutoff. All-time totals are kept.
+func (c *PaymentMetricsCollector) Prune(before time.Time) {
+	cutoff := before.UTC().Truncate(time.Hour).Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.buckets {
+		if key.Hour < cutoff {
+			delete(c.buckets, key)
+		}
+	}
+}
+
+// replace swaps in the rollups of another collector
+func (c *PaymentMetricsCollector) replace(other *PaymentMetricsCollector) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buckets = other.buckets
+	c.totals = other.totals
+}
+
+// Query aggregates the hourly rollups that fall inside the query window.
+// Windows are resolved to whole hours.
+func (c *PaymentMetricsCollector) Query(query MetricsQuery) *PaymentMetrics {
+	from := query.From.UTC().Truncate(time.Hour).Unix()
+	to := query.To.UTC().Unix()
+
+	overall := newRollupBucket()
+	volumes := make(map[string]*big.Float)
+	byProvider := make(map[string]*rollupBucket)
+	byMethod := make(map[string]*rollupBucket)
+	byCurrency := make(map[string]*rollupBucket)
+	providerVolumes := make(map[string]map[string]*big.Float)
+	methodVolumes := make(map[string]map[string]*big.Float)
+
+	c.mu.RLock()
+	for key, bucket := range c.buckets {
+		if key.Hour < from || key.Hour >= to {
+			continue
+		}
+		if query.Provider != "" && key.Provider != query.Provider {
+			continue
+		}
+		if query.Method != "" && key.Method != query.Method {
+			continue
+		}
+		if query.Currency != "" && key.Currency != query.Currency {
+			continue
+		}
+
+		overall.Authorized += bucket.Authorized
+		overall.Declined += bucket.Declined
+		overall.Refunded += bucket.Refunded
+		overall.LatencySeconds += bucket.LatencySeconds
+		overall.LatencyCount += bucket.LatencyCount
+		for reason, count := range bucket.DeclinesByReason {
+			overall.DeclinesByReason[reason] += count
+		}
+
+		addVolume(volumes, key.Currency, bucket.Volume)
+		mergeInto(byProvider, key.Provider, bucket)
+		mergeInto(byMethod, key.Method, bucket)
+		mergeInto(byCurrency, key.Currency, bucket)
+
+		if providerVolumes[key.Provider] == nil {
+			providerVolumes[key.Provider] = make(map[string]*big.Float)
+		}
+		addVolume(providerVolumes[key.Provider], key.Currency, bucket.Volume)
+		if methodVolumes[key.Method] == nil {
+			methodVolumes[key.Method] = make(map[string]*big.Float)
+		}
+		addVolume(methodVolumes[key.Method], key.Currency, bucket.Volume)
+	}
+	c.mu.RUnlock()
+
+	metrics := &PaymentMetrics{
+		From:              query.From,
+		To:                query.To,
+		TotalPayments:     overall.Authorized + overall.Declined,
+		Authorized:        overall.Authorized,
+		Declined:          overall.Declined,
+		VolumeByCurrency:  toMoneyMap(volumes),
+		AuthorizationRate: rate(overall.Authorized, overall.Authorized+overall.Declined),
+		ProcessingTime:    averageLatency(overall),
+		RefundRate:        rate(overall.Refunded, overall.Authorized),
+		DeclinesByReason:  overall.DeclinesByReason,
+		ByProvider:        make(map[string]*MetricsBreakdown),
+		ByMethod:          make(map[string]*MetricsBreakdown),
+		ByCurrency:        make(map[string]*MetricsBreakdown),
+	}
+
+	// A single total only makes sense when there is a single currency
+	if len(volumes) == 1 {
+		for currency, volume := range volumes {
+			metrics.TotalVolume = Money{Value: volume, Currency: currency}
+			if overall.Authorized > 0 {
+				average := new(big.Float).Quo(volume, big.NewFloat(float64(overall.Authorized)))
+				metrics.AverageAmount = Money{Value: average, Currency: currency}
+			}
+		}
+	}
+
+	for provider, bucket := range byProvider {
+		metrics.ByProvider[provider] = toBreakdown(bucket, providerVolumes[provider])
+	}
+	for method, bucket := range byMethod {
+		metrics.ByMethod[method] = toBreakdown(bucket, methodVolumes[method])
+	}
+	for currency, bucket := range byCurrency {
+		metrics.ByCurrency[currency] = toBreakdown(bucket, map[string]*big.Float{currency: bucket.Volume})
+	}
+
+	metrics.TopProvider = topByAuthorized(byProvider)
+	metrics.TopPaymentMethod = topByAuthorized(byMethod)
+
+	return metrics
+}
+
+// WritePrometheus writes the all-time counters in the Prometheus text format
+func (c *PaymentMetricsCollector) WritePrometheus(w io.Writer) error {
+	c.mu.RLock()
+	keys := make([]rollupKey, 0, len(c.totals))
+	totals := make(map[rollupKey]*rollupBucket, len(c.totals))
+	for key, bucket := range c.totals {
+		keys = append(keys, key)
+		copied := newRollupBucket()
+		copied.merge(bucket)
+		totals[key] = copied
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Currency < b.Currency
+	})
+
+	var sb strings.Builder
+	writeHeader := func(name, help, kind string) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	writeHeader("payment_authorizations_total", "Payment attempts authorised by the provider", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "payment_authorizations_total{%s} %d\n", promLabels(key), totals[key].Authorized)
+	}
+
+	writeHeader("payment_declines_total", "Payment attempts declined by the provider, by decline code", "counter")
+	for _, key := range keys {
+		reasons := make([]string, 0, len(totals[key].DeclinesByReason))
+		for reason := range totals[key].DeclinesByReason {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&sb, "payment_declines_total{%s,reason=\"%s\"} %d\n",
+				promLabels(key), promEscape(reason), totals[key].DeclinesByReason[reason])
+		}
+	}
+
+	writeHeader("payment_refunds_total", "Payments refunded", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "payment_refunds_total{%s} %d\n", promLabels(key), totals[key].Refunded)
+	}
+
+	writeHeader("payment_volume_total", "Authorised payment volume in major currency units", "counter")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "payment_volume_total{%s} %s\n", promLabels(key), totals[key].Volume.Text('f', 2))
+	}
+
+	writeHeader("payment_attempt_latency_seconds", "Time from submission to provider outcome", "summary")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "payment_attempt_latency_seconds_sum{%s} %g\n", promLabels(key), totals[key].LatencySeconds)
+		fmt.Fprintf(&sb, "payment_attempt_latency_seconds_count{%s} %d\n", promLabels(key), totals[key].LatencyCount)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// GetPaymentMetrics returns payment metrics for the query window
+func (s *Service) GetPaymentMetrics(ctx context.Context, query MetricsQuery) (*PaymentMetrics, error) {
+	if query.To.IsZero() {
+		query.To = time.Now()
+	}
+	if query.From.IsZero() {
+		query.From = query.To.Add(-24 * time.Hour)
+	}
+	if !query.From.Before(query.To) {
+		return nil, fmt.Errorf("invalid window: from %s is not before to %s", query.From, query.To)
+	}
+
+	return s.metrics.Query(query), nil
+}
+
+// RebuildPaymentMetrics recomputes the rollups from the payments repository,
+// used at startup and after backfills
+func (s *Service) RebuildPaymentMetrics(ctx context.Context) error {
+	collector := NewPaymentMetricsCollector()
+	const pageSize = 500
+
+	for offset := 0; ; offset += pageSize {
+		payments, err := s.repo.ListPayments(ctx, PaymentFilters{Limit: pageSize, Offset: offset})
+		if err != nil {
+			return fmt.Errorf("failed to list payments: %w", err)
+		}
+
+		for _, payment := range payments {
+			attempts, err := s.repo.ListPaymentAttempts(ctx, payment.ID)
+			if err != nil {
+				return fmt.Errorf("failed to list attempts: %w", err)
+			}
+
+			for _, attempt := range attempts {
+				if attempt.CompletedAt == nil {
+					continue
+				}
+				latency := attempt.CompletedAt.Sub(attempt.StartedAt)
+				switch attempt.Status {
+				case "succeeded":
+					collector.RecordAuthorization(payment, *attempt.CompletedAt, latency)
+				case "failed":
+					collector.RecordDecline(payment, *attempt.CompletedAt, latency, attempt.DeclineCode)
+				}
+			}
+
+			if authorizedAt, ok := authorizationTime(attempts); ok && refundCount(payment) > 0 {
+				collector.RecordRefund(payment, authorizedAt)
+			}
+		}
+
+		if len(payments) < pageSize {
+			break
+		}
+	}
+
+	s.metrics.replace(collector)
+	return nil
+}
+
+// authorizationTime returns when the last succeeded attempt of a payment
+// completed
+func authorizationTime(attempts []*PaymentAttempt) (time.Time, bool) {
+	var authorizedAt time.Time
+	found := false
+	for _, attempt := range attempts {
+		if attempt.Status == "succeeded" && attempt.CompletedAt != nil {
+			authorizedAt = *attempt.CompletedAt
+			found = true
+		}
+	}
+	return authorizedAt, found
+}
+
+// refundCount returns how many refunds a payment's refunds list holds
+func refundCount(payment *Payment) int {
+	refunds, _ := payment.Metadata["refunds"].([]interface{})
+	return len(refunds)
+}
+
+// recordAttemptOutcome feeds a finished attempt into the metrics rollups
+func (s *Service) recordAttemptOutcome(payment *Payment, attempt *PaymentAttempt) {
+	at := time.Now()
+	var latency time.Duration
+	if attempt != nil && attempt.CompletedAt != nil {
+		at = *attempt.CompletedAt
+		latency = attempt.CompletedAt.Sub(attempt.StartedAt)
+	}
+
+	if payment.Status == "completed" {
+		s.metrics.RecordAuthorization(payment, at, latency)
+		return
+	}
+
+	declineCode := "unknown"
+	if attempt != nil && attempt.DeclineCode != "" {
+		declineCode = attempt.DeclineCode
+	}
+	s.metrics.RecordDecline(payment, at, latency, declineCode)
+}
+
+// Helper functions
+
+func rate(numerator, denominator int) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return float64(numerator) / float64(denominator)
+}
+
+func averageLatency(b *rollupBucket) float64 {
+	if b.LatencyCount == 0 {
+		return 0
+	}
+	return b.LatencySeconds / float64(b.LatencyCount)
+}
+
+func addVolume(volumes map[string]*big.Float, currency string, amount *big.Float) {
+	if volumes[currency] == nil {
+		volumes[currency] = new(big.Float)
+	}
+	volumes[currency].Add(volumes[currency], amount)
+}
+
+func mergeInto(groups map[string]*rollupBucket, name string, bucket *rollupBucket) {
+	if groups[name] == nil {
+		groups[name] = newRollupBucket()
+	}
+	groups[name].merge(bucket)
+}
+
+func toMoneyMap(volumes map[string]*big.Float) map[string]Money {
+	result := make(map[string]Money, len(volumes))
+	for currency, volume := range volumes {
+		result[currency] = Money{Value: volume, Currency: currency}
+	}
+	return result
+}
+
+func toBreakdown(bucket *rollupBucket, volumes map[string]*big.Float) *MetricsBreakdown {
+	return &MetricsBreakdown{
+		Authorized:        bucket.Authorized,
+		Declined:          bucket.Declined,
+		AuthorizationRate: rate(bucket.Authorized, bucket.Authorized+bucket.Declined),
+		ProcessingTime:    averageLatency(bucket),
+		DeclinesByReason:  bucket.DeclinesByReason,
+		Volume:            toMoneyMap(volumes),
+	}
+}
+
+func topByAuthorized(groups map[string]*rollupBucket) string {
+	top := ""
+	best := 0
+	for name, bucket := range groups {
+		if bucket.Authorized > best || (bucket.Authorized == best && best > 0 && name < top) {
+			top = name
+			best = bucket.Authorized
+		}
+	}
+	return top
+}
+
+func promLabels(key rollupKey) string {
+	return fmt.Sprintf("provider=\"%s\",method=\"%s\",currency=\"%s\"",
+		promEscape(key.Provider), promEscape(key.Method), promEscape(key.Currency))
+}
+
+func promEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/lib/pq"
@@ -19,16 +21,27 @@ type PostgreSQLRepository struct {
 
 // NewPostgreSQLRepository creates a new PostgreSQL repository
 func NewPostgreSQLRepository(connectionString string) (*PostgreSQLRepository, error) {
+	db, err := openPostgreSQL(connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgreSQLRepository{db: db}, nil
+}
+
+// openPostgreSQL opens and pings a PostgreSQL database
+func openPostgreSQL(connectionString string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &PostgreSQLRepository{db: db}, nil
+	return db, nil
 }
 
 // CreatePayment creates a new payment in the database
@@ -344,6 +357,145 @@ func (r *PostgreSQLRepository) GetProviders(ctx context.Context) ([]*Provider, e
 	return providers, nil
 }
 
+// CreatePaymentAttempt records a provider attempt for a payment
+func (r *PostgreSQLRepository) CreatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	query := `
+		INSERT INTO payment_attempts (
+			id, payment_id, attempt_number, status, decline_code, decline_category,
+			failure_reason, provider_transaction_id, next_retry_at, started_at, completed_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	_, err := r.db.ExecContext(ctx, query,
+		attempt.ID,
+		attempt.PaymentID,
+		attempt.AttemptNumber,
+		attempt.Status,
+		attempt.DeclineCode,
+		attempt.DeclineCategory,
+		attempt.FailureReason,
+		attempt.ProviderTransactionID,
+		attempt.NextRetryAt,
+		attempt.StartedAt,
+		attempt.CompletedAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create payment attempt: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePaymentAttempt updates the outcome of a provider attempt
+func (r *PostgreSQLRepository) UpdatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	query := `
+		UPDATE payment_attempts
+		SET status = $2, decline_code = $3, decline_category = $4, failure_reason = $5,
+			provider_transaction_id = $6, next_retry_at = $7, completed_at = $8
+		WHERE id = $1`
+
+	result, err := r.db.ExecContext(ctx, query,
+		attempt.ID,
+		attempt.Status,
+		attempt.DeclineCode,
+		attempt.DeclineCategory,
+		attempt.FailureReason,
+		attempt.ProviderTransactionID,
+		attempt.NextRetryAt,
+		attempt.CompletedAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to update payment attempt: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("payment attempt not found: %s", attempt.ID)
+	}
+
+	return nil
+}
+
+// ListPaymentAttempts retrieves the attempts of a payment in order
+func (r *PostgreSQLRepository) ListPaymentAttempts(ctx context.Context, paymentID string) ([]*PaymentAttempt, error) {
+	query := `
+		SELECT id, payment_id, attempt_number, status, decline_code, decline_category,
+			   failure_reason, provider_transaction_id, next_retry_at, started_at, completed_at
+		FROM payment_attempts
+		WHERE payment_id = $1
+		ORDER BY attempt_number`
+
+	return r.queryPaymentAttempts(ctx, query, paymentID)
+}
+
+// ListRetriesDue retrieves the latest attempts whose retry time has passed
+func (r *PostgreSQLRepository) ListRetriesDue(ctx context.Context, before time.Time) ([]*PaymentAttempt, error) {
+	query := `
+		SELECT id, payment_id, attempt_number, status, decline_code, decline_category,
+			   failure_reason, provider_transaction_id, next_retry_at, started_at, completed_at
+		FROM payment_attempts
+		WHERE next_retry_at IS NOT NULL AND next_retry_at <= $1
+		ORDER BY next_retry_at`
+
+	return r.queryPaymentAttempts(ctx, query, before)
+}
+
+func (r *PostgreSQLRepository) queryPaymentAttempts(ctx context.Context, query string, args ...interface{}) ([]*PaymentAttempt, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query payment attempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []*PaymentAttempt{}
+	for rows.Next() {
+		var attempt PaymentAttempt
+		var declineCode, declineCategory, failureReason, providerTransactionID sql.NullString
+		var nextRetryAt, completedAt sql.NullTime
+
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.PaymentID,
+			&attempt.AttemptNumber,
+			&attempt.Status,
+			&declineCode,
+			&declineCategory,
+			&failureReason,
+			&providerTransactionID,
+			&nextRetryAt,
+			&attempt.StartedAt,
+			&completedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payment attempt: %w", err)
+		}
+
+		attempt.DeclineCode = declineCode.String
+		attempt.DeclineCategory = declineCategory.String
+		attempt.FailureReason = failureReason.String
+		attempt.ProviderTransactionID = providerTransactionID.String
+		if nextRetryAt.Valid {
+			attempt.NextRetryAt = &nextRetryAt.Time
+		}
+		if completedAt.Valid {
+			attempt.CompletedAt = &completedAt.Time
+		}
+
+		attempts = append(attempts, &attempt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating payment attempts: %w", err)
+	}
+
+	return attempts, nil
+}
+
 // Close closes the database connection
 func (r *PostgreSQLRepository) Close() error {
 	return r.db.Close()
@@ -353,3 +505,304 @@ func (r *PostgreSQLRepository) Close() error {
 func (r *PostgreSQLRepository) Health(ctx context.Context) error {
 	return r.db.PingContext(ctx)
 }
+
+// PostgreSQLCardVault implements CardVault with PostgreSQL. Card numbers
+// are stored encrypted under their wrapped data key.
+type PostgreSQLCardVault struct {
+	db *sql.DB
+}
+
+// NewPostgreSQLCardVault creates a card vault over db
+func NewPostgreSQLCardVault(db *sql.DB) *PostgreSQLCardVault {
+	return &PostgreSQLCardVault{db: db}
+}
+
+// SaveCard stores a vaulted card
+func (v *PostgreSQLCardVault) SaveCard(ctx context.Context, card *VaultedCard) error {
+	query := `
+		INSERT INTO card_tokens (
+			token, account_id, bin, last4, expiry_month, expiry_year, brand,
+			fingerprint, encrypted_pan, nonce, wrapped_key, key_name, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+	_, err := v.db.ExecContext(ctx, query,
+		card.Token,
+		card.AccountID,
+		card.BIN,
+		card.Last4,
+		card.ExpiryMonth,
+		card.ExpiryYear,
+		card.Brand,
+		card.Fingerprint,
+		card.EncryptedPAN,
+		card.Nonce,
+		card.WrappedKey,
+		card.KeyName,
+		card.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save card: %w", err)
+	}
+
+	return nil
+}
+
+// GetCard retrieves a vaulted card by token
+func (v *PostgreSQLCardVault) GetCard(ctx context.Context, token string) (*VaultedCard, error) {
+	query := `
+		SELECT token, account_id, bin, last4, expiry_month, expiry_year, brand,
+			   fingerprint, encrypted_pan, nonce, wrapped_key, key_name, created_at
+		FROM card_tokens
+		WHERE token = $1`
+
+	card := &VaultedCard{}
+	err := v.db.QueryRowContext(ctx, query, token).Scan(
+		&card.Token,
+		&card.AccountID,
+		&card.BIN,
+		&card.Last4,
+		&card.ExpiryMonth,
+		&card.ExpiryYear,
+		&card.Brand,
+		&card.Fingerprint,
+		&card.EncryptedPAN,
+		&card.Nonce,
+		&card.WrappedKey,
+		&card.KeyName,
+		&card.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get card: %w", err)
+	}
+
+	return card, nil
+}
+
+// PostgreSQLTokenAuditLog implements TokenAuditLog with PostgreSQL
+type PostgreSQLTokenAuditLog struct {
+	db *sql.DB
+}
+
+// NewPostgreSQLTokenAuditLog creates a token audit log over db
+func NewPostgreSQLTokenAuditLog(db *sql.DB) *PostgreSQLTokenAuditLog {
+	return &PostgreSQLTokenAuditLog{db: db}
+}
+
+// RecordAccess stores a detokenization attempt
+func (l *PostgreSQLTokenAuditLog) RecordAccess(ctx context.Context, record *TokenAccessRecord) error {
+	query := `
+		INSERT INTO card_token_access (id, token, caller, purpose, granted, reason, accessed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := l.db.ExecContext(ctx, query,
+		record.ID,
+		record.Token,
+		record.Caller,
+		record.Purpose,
+		record.Granted,
+		record.Reason,
+		record.Timestamp,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record token access: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccess lists the detokenization attempts of a token, oldest first
+func (l *PostgreSQLTokenAuditLog) ListAccess(ctx context.Context, token string) ([]*TokenAccessRecord, error) {
+	query := `
+		SELECT id, token, caller, purpose, granted, reason, accessed_at
+		FROM card_token_access
+		WHERE token = $1
+		ORDER BY accessed_at`
+
+	rows, err := l.db.QueryContext(ctx, query, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list token access: %w", err)
+	}
+	defer rows.Close()
+
+	records := []*TokenAccessRecord{}
+	for rows.Next() {
+		record := &TokenAccessRecord{}
+		if err := rows.Scan(
+			&record.ID,
+			&record.Token,
+			&record.Caller,
+			&record.Purpose,
+			&record.Granted,
+			&record.Reason,
+			&record.Timestamp,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan token access: %w", err)
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating token access: %w", err)
+	}
+
+	return records, nil
+}
+
+// InMemoryRepository implements Repository in memory. Unlike MockRepository
+// it keeps state, which the scheduled billing flows depend on.
+type InMemoryRepository struct {
+	mu       sync.RWMutex
+	payments map[string]*Payment
+	attempts map[string][]*PaymentAttempt
+}
+
+// NewInMemoryRepository creates a new in-memory repository
+func NewInMemoryRepository() *InMemoryRepository {
+	return &InMemoryRepository{
+		payments: make(map[string]*Payment),
+		attempts: make(map[string][]*PaymentAttempt),
+	}
+}
+
+func (r *InMemoryRepository) CreatePayment(ctx context.Context, payment *Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.payments[payment.ID]; exists {
+		return fmt.Errorf("payment already exists: %s", payment.ID)
+	}
+	r.payments[payment.ID] = clonePayment(payment)
+	return nil
+}
+
+func (r *InMemoryRepository) GetPayment(ctx context.Context, id string) (*Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	payment, exists := r.payments[id]
+	if !exists {
+		return nil, fmt.Errorf("payment not found: %s", id)
+	}
+	return clonePayment(payment), nil
+}
+
+func (r *InMemoryRepository) ListPayments(ctx context.Context, filters PaymentFilters) ([]*Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	payments := []*Payment{}
+	for _, payment := range r.payments {
+		if filters.AccountID != "" && payment.AccountID != filters.AccountID {
+			continue
+		}
+		if filters.Provider != "" && payment.Provider != filters.Provider {
+			continue
+		}
+		if filters.Status != "" && payment.Status != filters.Status {
+			continue
+		}
+		payments = append(payments, clonePayment(payment))
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.After(payments[j].CreatedAt)
+	})
+
+	if filters.Offset > 0 {
+		if filters.Offset >= len(payments) {
+			return []*Payment{}, nil
+		}
+		payments = payments[filters.Offset:]
+	}
+	if filters.Limit > 0 && filters.Limit < len(payments) {
+		payments = payments[:filters.Limit]
+	}
+
+	return payments, nil
+}
+
+func (r *InMemoryRepository) UpdatePayment(ctx context.Context, payment *Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.payments[payment.ID]; !exists {
+		return fmt.Errorf("payment not found: %s", payment.ID)
+	}
+	r.payments[payment.ID] = clonePayment(payment)
+	return nil
+}
+
+func (r *InMemoryRepository) DeletePayment(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.payments[id]; !exists {
+		return fmt.Errorf("payment not found: %s", id)
+	}
+	delete(r.payments, id)
+	return nil
+}
+
+func (r *InMemoryRepository) GetProviders(ctx context.Context) ([]*Provider, error) {
+	return (&MockRepository{}).GetProviders(ctx)
+}
+
+func (r *InMemoryRepository) CreatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *attempt
+	r.attempts[attempt.PaymentID] = append(r.attempts[attempt.PaymentID], &stored)
+	return nil
+}
+
+func (r *InMemoryRepository) UpdatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, existing := range r.attempts[attempt.PaymentID] {
+		if existing.ID == attempt.ID {
+			stored := *attempt
+			r.attempts[attempt.PaymentID][i] = &stored
+			return nil
+		}
+	}
+	return fmt.Errorf("payment attempt not found: %s", attempt.ID)
+}
+
+func (r *InMemoryRepository) ListPaymentAttempts(ctx context.Context, paymentID string) ([]*PaymentAttempt, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	attempts := make([]*PaymentAttempt, 0, len(r.attempts[paymentID]))
+	for _, attempt := range r.attempts[paymentID] {
+		result := *attempt
+		attempts = append(attempts, &result)
+	}
+	return attempts, nil
+}
+
+func (r *InMemoryRepository) ListRetriesDue(ctx context.Context, before time.Time) ([]*PaymentAttempt, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	due := []*PaymentAttempt{}
+	for _, attempts := range r.attempts {
+		last := attempts[len(attempts)-1]
+		if last.NextRetryAt != nil && !last.NextRetryAt.After(before) {
+			result := *last
+			due = append(due, &result)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRetryAt.Before(*due[j].NextRetryAt) })
+	return due, nil
+}
+
+// clonePayment copies a payment so callers cannot mutate stored state
+func clonePayment(payment *Payment) *Payment {
+	clone := *payment
+	if payment.Amount.Value != nil {
+		clone.Amount.Value = new(big.Float).Copy(payment.Amount.Value)
+	}
+	if payment.Metadata != nil {
+		clone.Metadata = make(map[string]interface{}, len(payment.Metadata))
+		for key, value := range payment.Metadata {
+			clone.Metadata[key] = value
+		}
+	}
+	return &clone
+}
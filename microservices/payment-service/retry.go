@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	// DeclineHard means the issuer will not approve the payment on retry
+	DeclineHard = "hard"
+
+	// DeclineSoft means the decline is temporary and a retry may succeed
+	DeclineSoft = "soft"
+)
+
+// ErrHardDecline is returned when retrying a payment that was hard declined
+var ErrHardDecline = errors.New("payment was hard declined and cannot be retried")
+
+// DeclineClassification is the normalised result of a provider decline
+type DeclineClassification struct {
+	Code     string `json:"code"`
+	Category string `json:"category"` // hard, soft
+}
+
+// declineCodes maps normalised decline codes to their category. Card network
+// response codes are used by adyen, worldpay and checkout; the named codes
+// are used by stripe and braintree.
+var declineCodes = map[string]string{
+	// Soft declines
+	"insufficient_funds":          DeclineSoft,
+	"do_not_honor":                DeclineSoft,
+	"generic_decline":             DeclineSoft,
+	"card_declined":               DeclineSoft,
+	"processing_error":            DeclineSoft,
+	"issuer_not_available":        DeclineSoft,
+	"try_again_later":             DeclineSoft,
+	"rate_limit":                  DeclineSoft,
+	"timeout":                     DeclineSoft,
+	"card_velocity_exceeded":      DeclineSoft,
+	"withdrawal_count_limit":      DeclineSoft,
+	"approve_with_id":             DeclineSoft,
+	"reenter_transaction":         DeclineSoft,
+	"05":                          DeclineSoft, // do not honour
+	"51":                          DeclineSoft, // insufficient funds
+	"61":                          DeclineSoft, // exceeds withdrawal amount limit
+	"65":                          DeclineSoft, // exceeds withdrawal frequency limit
+	"91":                          DeclineSoft, // issuer unavailable
+	"96":                          DeclineSoft, // system malfunction
+	"19":                          DeclineSoft, // re-enter transaction
+	"expired_card":                DeclineHard,
+	"incorrect_number":            DeclineHard,
+	"invalid_number":              DeclineHard,
+	"invalid_account":             DeclineHard,
+	"account_closed":              DeclineHard,
+	"lost_card":                   DeclineHard,
+	"stolen_card":                 DeclineHard,
+	"pickup_card":                 DeclineHard,
+	"fraudulent":                  DeclineHard,
+	"restricted_card":             DeclineHard,
+	"card_not_supported":          DeclineHard,
+	"currency_not_supported":      DeclineHard,
+	"transaction_not_allowed":     DeclineHard,
+	"revocation_of_authorization": DeclineHard,
+	"authentication_required":     DeclineHard,
+	"04":                          DeclineHard, // pick up card
+	"07":                          DeclineHard, // pick up card, special condition
+	"14":                          DeclineHard, // invalid card number
+	"15":                          DeclineHard, // no such issuer
+	"41":                          DeclineHard, // lost card
+	"43":                          DeclineHard, // stolen card
+	"54":                          DeclineHard, // expired card
+	"57":                          DeclineHard, // transaction not permitted to cardholder
+	"62":                          DeclineHard, // restricted card
+	"R0":                          DeclineHard, // stop payment order
+	"R1":                          DeclineHard, // revocation of all authorisations
+}
+
+// DeclineError is returned by provider adapters when the provider declines
+// a payment. Its message starts with the decline code so ClassifyDecline
+// can read it back from the failure reason.
+type DeclineError struct {
+	Code    string
+	Message string
+}
+
+func (e *DeclineError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// declineCodeLabels may introduce a code in a failure reason ("code: 51")
+var declineCodeLabels = map[string]bool{
+	"code":          true,
+	"decline_code":  true,
+	"response_code": true,
+}
+
+// lookupDeclineCode finds a code in declineCodes and returns it with its
+// category. Named codes are lower case and network codes upper case,
+// whatever case the provider used.
+func lookupDeclineCode(code string) (string, string, bool) {
+	for _, candidate := range []string{code, strings.ToLower(code), strings.ToUpper(code)} {
+		if category, ok := declineCodes[candidate]; ok {
+			return candidate, category, true
+		}
+	}
+	return "", "", false
+}
+
+// ClassifyDecline maps a provider failure reason to a decline category. The
+// reason is a bare code ("51", "insufficient_funds") or starts with one or
+// more codes each followed by a colon ("card_declined: stolen_card: ...",
+// "code: 51 - do not honour"); hard codes win over soft ones. Numbers in
+// the free text after the codes are never read as codes, so "timeout after
+// 15 seconds" is not a "15" hard decline. Unknown reasons are treated as
+// soft so they still get a capped number of retries.
+func ClassifyDecline(reason string) DeclineClassification {
+	var codes []string
+	segments := strings.Split(reason, ":")
+	for i, segment := range segments {
+		segment = strings.TrimSpace(segment)
+		if declineCodeLabels[strings.ToLower(segment)] && i+1 < len(segments) {
+			// A labelled code may be followed by a message
+			if fields := strings.Fields(segments[i+1]); len(fields) > 0 {
+				codes = append(codes, strings.TrimRight(fields[0], ",.;-"))
+			}
+			break
+		}
+		if _, _, ok := lookupDeclineCode(segment); !ok {
+			break
+		}
+		codes = append(codes, segment)
+	}
+
+	var soft *DeclineClassification
+	for _, token := range codes {
+		code, category, ok := lookupDeclineCode(token)
+		if !ok {
+			continue
+		}
+		if category == DeclineHard {
+			return DeclineClassification{Code: code, Category: DeclineHard}
+		}
+		if soft == nil {
+			soft = &DeclineClassification{Code: code, Category: DeclineSoft}
+		}
+	}
+
+	if soft != nil {
+		return *soft
+	}
+
+	return DeclineClassification{Code: "unknown", Category: DeclineSoft}
+}
+
+// RetryPolicy controls automatic retries of soft-declined payments. The
+// fields and schedule follow servicediscovery.RetryConfig and
+// RetryWithBackoff: the first retry waits BaseDelay, each later one
+// multiplies the delay by Multiplier up to MaxDelay with ±25% jitter.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+}
+
+// DefaultRetryPolicy returns the default payment retry policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  15 * time.Minute,
+		MaxDelay:   24 * time.Hour,
+		Multiplier: 4.0,
+	}
+}
+
+// Delay returns the wait before the given retry (1 for the first retry).
+// jitter is a random number in [0, 1); 0.5 gives the delay without jitter.
+func (p RetryPolicy) Delay(retry int, jitter float64) time.Duration {
+	if retry <= 1 {
+		return p.BaseDelay
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(retry-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	return time.Duration(delay + jitter*delay*0.5 - delay*0.25)
+}
+
+// PaymentAttempt records one submission of a payment to its provider
+type PaymentAttempt struct {
+	ID                    string     `json:"id"`
+	PaymentID             string     `json:"payment_id"`
+	AttemptNumber         int        `json:"attempt_number"`
+	Status                string     `json:"status"` // processing, succeeded, failed
+	DeclineCode           string     `json:"decline_code,omitempty"`
+	DeclineCategory       string     `json:"decline_category,omitempty"`
+	FailureReason         string     `json:"failure_reason,omitempty"`
+	ProviderTransactionID string     `json:"provider_transaction_id,omitempty"`
+	NextRetryAt           *time.Time `json:"next_retry_at,omitempty"`
+	StartedAt             time.Time  `json:"started_at"`
+	CompletedAt           *time.Time `json:"completed_at,omitempty"`
+}
+
+// SetRetryPolicy configures automatic retries of soft-declined payments
+func (s *Service) SetRetryPolicy(policy RetryPolicy) {
+	s.retryPolicy = policy
+}
+
+// ListPaymentAttempts returns every provider attempt made for a payment
+func (s *Service) ListPaymentAttempts(ctx context.Context, paymentID string) ([]*PaymentAttempt, error) {
+	return s.repo.ListPaymentAttempts(ctx, paymentID)
+}
+
+// RunDueRetries retries every payment whose scheduled retry time has passed
+func (s *Service) RunDueRetries(ctx context.Context) (int, error) {
+	attempts, err := s.repo.ListRetriesDue(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list due retries: %w", err)
+	}
+
+	retried := 0
+	for _, attempt := range attempts {
+		if err := s.RetryPayment(ctx, attempt.PaymentID); err != nil {
+			log.Printf("Automatic retry of payment %s failed: %v", attempt.PaymentID, err)
+			continue
+		}
+		retried++
+	}
+
+	return retried, nil
+}
+
+// startAttempt records a new provider attempt for a payment
+func (s *Service) startAttempt(ctx context.Context, payment *Payment) (*PaymentAttempt, error) {
+	attempts, err := s.repo.ListPaymentAttempts(ctx, payment.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attempts: %w", err)
+	}
+
+	attempt := &PaymentAttempt{
+		ID:            fmt.Sprintf("%s_attempt_%d", payment.ID, len(attempts)+1),
+		PaymentID:     payment.ID,
+		AttemptNumber: len(attempts) + 1,
+		Status:        "processing",
+		StartedAt:     time.Now(),
+	}
+
+	if err := s.repo.CreatePaymentAttempt(ctx, attempt); err != nil {
+		return nil, fmt.Errorf("failed to record attempt: %w", err)
+	}
+
+	return attempt, nil
+}
+
+// latestAttempt returns the most recent attempt of a payment, or nil
+func (s *Service) latestAttempt(ctx context.Context, paymentID string) (*PaymentAttempt, []*PaymentAttempt, error) {
+	attempts, err := s.repo.ListPaymentAttempts(ctx, paymentID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list attempts: %w", err)
+	}
+
+	if len(attempts) == 0 {
+		return nil, attempts, nil
+	}
+
+	return attempts[len(attempts)-1], attempts, nil
+}
+
+// finishAttempt closes the latest open attempt of a payment
+func (s *Service) finishAttempt(ctx context.Context, paymentID string, update func(attempt *PaymentAttempt)) (*PaymentAttempt, []*PaymentAttempt, error) {
+	attempt, attempts, err := s.latestAttempt(ctx, paymentID)
+	if err != nil || attempt == nil || attempt.Status != "processing" {
+		return attempt, attempts, err
+	}
+
+	now := time.Now()
+	attempt.CompletedAt = &now
+	update(attempt)
+
+	if err := s.repo.UpdatePaymentAttempt(ctx, attempt); err != nil {
+		return nil, nil, fmt.Errorf("failed to update attempt: %w", err)
+	}
+
+	return attempt, attempts, nil
+}
+
+// maxRetries returns how many times a payment may be retried. Subscription
+// invoice payments are retried on the dunning schedule, so its length is
+// their limit.
+func (s *Service) maxRetries(payment *Payment) int {
+	if _, isInvoice := payment.Metadata["invoice_id"]; isInvoice && s.billing != nil {
+		return len(s.billing.policy.RetrySchedule)
+	}
+	return s.retryPolicy.MaxRetries
+}
+
+// scheduleRetry sets the next retry time on a failed attempt when the
+// decline is soft and the retry budget is not exhausted. It reports whether
+// a retry was scheduled.
+func (s *Service) scheduleRetry(ctx context.Context, attempt *PaymentAttempt, attempts []*PaymentAttempt) (bool, error) {
+	if attempt == nil || attempt.DeclineCategory != DeclineSoft {
+		return false, nil
+	}
+
+	retriesUsed := len(attempts) - 1
+	if retriesUsed >= s.retryPolicy.MaxRetries {
+		return false, nil
+	}
+
+	next := time.Now().Add(s.retryPolicy.Delay(retriesUsed+1, rand.Float64()))
+	attempt.NextRetryAt = &next
+
+	if err := s.repo.UpdatePaymentAttempt(ctx, attempt); err != nil {
+		return false, fmt.Errorf("failed to schedule retry: %w", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrPaymentBlocked is returned when risk-service blocks a payment, or
+	// the local risk score does while risk-service is unavailable
+	ErrPaymentBlocked = errors.New("payment blocked by risk assessment")
+
+	// ErrReviewCaseMismatch is returned when a review decision is not for
+	// the review case a payment is held for
+	ErrReviewCaseMismatch = errors.New("review decision does not match the payment's review case")
+)
+
+// ReviewSignatureHeader carries risk-service's HMAC-SHA256 of a review
+// decision, keyed with the review signing key the services share
+const ReviewSignatureHeader = "X-Review-Signature"
+
+// RiskAssessmentRequest is the assessment request sent to risk-service
+type RiskAssessmentRequest struct {
+	EntityID      string                 `json:"entity_id"`
+	EntityType    string                 `json:"entity_type"`
+	Context       map[string]interface{} `json:"context"`
+	Amount        *Money                 `json:"amount,omitempty"`
+	PaymentMethod string                 `json:"payment_method,omitempty"`
+}
+
+// RiskAssessmentResult is the part of a risk-service assessment payments rely on
+type RiskAssessmentResult struct {
+	ID           string  `json:"id"`
+	RiskScore    float64 `json:"risk_score"`
+	RiskLevel    string  `json:"risk_level"`
+	Decision     string  `json:"decision"` // allow, review, block
+	ReviewCaseID string  `json:"review_case_id,omitempty"`
+}
+
+// RiskAssessor assesses payments before they are submitted to a provider
+type RiskAssessor interface {
+	Assess(ctx context.Context, req *RiskAssessmentRequest) (*RiskAssessmentResult, error)
+}
+
+// ReviewDecision is a manual review outcome reported back by risk-service
+type ReviewDecision struct {
+	ReviewCaseID string `json:"review_case_id"`
+	AssessmentID string `json:"assessment_id"`
+	Decision     string `json:"decision"` // approve, decline
+	Status       string `json:"status"`   // approved, declined, expired
+	Analyst      string `json:"analyst,omitempty"`
+}
+
+// SetRiskAssessor configures risk-service assessment of processed payments
+func (s *Service) SetRiskAssessor(risk RiskAssessor) {
+	s.risk = risk
+}
+
+// assessPaymentRisk asks risk-service about a payment. It returns nil when
+// no assessor is configured or risk-service is unavailable, in which case
+// the local risk score decides.
+func (s *Service) assessPaymentRisk(ctx context.Context, payment *Payment) *RiskAssessmentResult {
+	if s.risk == nil {
+		return nil
+	}
+
+	amount := payment.Amount
+	result, err := s.risk.Assess(ctx, &RiskAssessmentRequest{
+		EntityID:   payment.AccountID,
+		EntityType: "user",
+		Context: map[string]interface{}{
+			"payment_id": payment.ID,
+			"action":     "process",
+			"provider":   payment.Provider,
+		},
+		Amount:        &amount,
+		PaymentMethod: payment.Method,
+	})
+	if err != nil {
+		log.Printf("Risk assessment unavailable for payment %s, using local score: %v", payment.ID, err)
+		return nil
+	}
+
+	return result
+}
+
+// ResolvePaymentReview releases or cancels a payment held for manual review
+func (s *Service) ResolvePaymentReview(ctx context.Context, paymentID string, decision *ReviewDecision) (*Payment, error) {
+	if decision.Decision != "approve" && decision.Decision != "decline" {
+		return nil, fmt.Errorf("invalid review decision: %s", decision.Decision)
+	}
+
+	payment, err := s.repo.GetPayment(ctx, paymentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+
+	if err := ValidatePaymentAction(payment, "review"); err != nil {
+		return nil, fmt.Errorf("review not allowed: %w", err)
+	}
+
+	caseID, _ := payment.Metadata["review_case_id"].(string)
+	if caseID == "" || decision.ReviewCaseID != caseID {
+		return nil, fmt.Errorf("%w: review case %q", ErrReviewCaseMismatch, decision.ReviewCaseID)
+	}
+	if decision.Analyst == "" && decision.Status != "expired" {
+		return nil, fmt.Errorf("%w: no analyst decided review case %s", ErrReviewCaseMismatch, caseID)
+	}
+
+	now := time.Now()
+	payment.Metadata["review_decision"] = decision.Decision
+	payment.Metadata["review_status"] = decision.Status
+	payment.Metadata["reviewed_at"] = now
+	if decision.Analyst != "" {
+		payment.Metadata["reviewed_by"] = decision.Analyst
+	}
+
+	if decision.Decision == "approve" {
+		payment.Status = "processing"
+	} else {
+		payment.Status = "cancelled"
+		payment.Metadata["cancel_reason"] = "risk_review_declined"
+	}
+	payment.UpdatedAt = now
+
+	if err := s.repo.UpdatePayment(ctx, payment); err != nil {
+		return nil, fmt.Errorf("failed to update payment: %w", err)
+	}
+
+	// The held submission to the provider goes ahead once approved
+	if payment.Status == "processing" {
+		if err := s.submitPayment(ctx, payment); err != nil {
+			return nil, err
+		}
+		if payment, err = s.repo.GetPayment(ctx, paymentID); err != nil {
+			return nil, fmt.Errorf("failed to get payment: %w", err)
+		}
+	}
+	if payment.Status == "cancelled" {
+		s.releasePaymentLimit(ctx, payment)
+		s.reopenCheckout(ctx, payment)
+	}
+
+	s.publishEvent(ctx, "payment.review_resolved", payment.ID, map[string]interface{}{
+		"decision":       decision.Decision,
+		"review_case_id": decision.ReviewCaseID,
+		"status":         payment.Status,
+	})
+
+	return payment, nil
+}
+
+// verifyReviewSignature reports whether a review decision body carries
+// risk-service's signature. Without a key no decision is accepted.
+func verifyReviewSignature(key, body []byte, signature string) bool {
+	if len(key) == 0 {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// HTTPRiskAssessor calls risk-service over HTTP
+type HTTPRiskAssessor struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPRiskAssessor creates a new risk-service client
+func NewHTTPRiskAssessor(baseURL string) *HTTPRiskAssessor {
+	return &HTTPRiskAssessor{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Assess requests a risk assessment
+func (a *HTTPRiskAssessor) Assess(ctx context.Context, assessment *RiskAssessmentRequest) (*RiskAssessmentResult, error) {
+	var result RiskAssessmentResult
+	if err := postJSON(ctx, a.client, a.baseURL+"/v1/assess", assessment, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -2,7 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPaymentService_CreatePayment(t *testing.T) {
@@ -140,6 +152,1541 @@ func TestPaymentService_ValidateProvider(t *testing.T) {
 	}
 }
 
+type stubProviderAdapter struct {
+	cards []*CardData
+	err   error
+}
+
+func (a *stubProviderAdapter) SubmitCardPayment(ctx context.Context, payment *Payment, card *CardData) (string, error) {
+	if a.err != nil {
+		return "", a.err
+	}
+	a.cards = append(a.cards, card)
+	return "ch_" + payment.ID, nil
+}
+
+func newTestTokenizer(t *testing.T) *Tokenizer {
+	kms, err := NewLocalKMS(nil)
+	if err != nil {
+		t.Fatalf("Failed to create local KMS: %v", err)
+	}
+	tokenizer := NewTokenizer(kms, "card-pan", NewInMemoryCardVault(), NewInMemoryTokenAuditLog(), []byte("test-fingerprint-key"))
+	tokenizer.RegisterProviderAdapter("stripe", &stubProviderAdapter{})
+	return tokenizer
+}
+
+func TestTokenizer_TokenizeAndDetokenize(t *testing.T) {
+	tokenizer := newTestTokenizer(t)
+	ctx := context.Background()
+
+	token, err := tokenizer.Tokenize(ctx, &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "4242 4242 4242 4242",
+		ExpiryMonth: 12,
+		ExpiryYear:  time.Now().Year() + 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if !strings.HasPrefix(token.Token, "tok_") || strings.Contains(token.Token, "4242") {
+		t.Errorf("Token should be opaque, got %s", token.Token)
+	}
+
+	if token.BIN != "424242" || token.Last4 != "4242" || token.Brand != "visa" {
+		t.Errorf("Unexpected card details: bin=%s last4=%s brand=%s", token.BIN, token.Last4, token.Brand)
+	}
+
+	// The same card tokenized twice yields different tokens but one fingerprint
+	second, err := tokenizer.Tokenize(ctx, &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "4242424242424242",
+		ExpiryMonth: 12,
+		ExpiryYear:  time.Now().Year() + 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if second.Token == token.Token {
+		t.Error("Expected distinct tokens for separate tokenizations")
+	}
+	if second.Fingerprint != token.Fingerprint {
+		t.Error("Expected identical fingerprints for the same card")
+	}
+
+	adapter := &stubProviderAdapter{}
+	tokenizer.RegisterProviderAdapter("stripe", adapter)
+	payment := &Payment{ID: "pay_1", AccountID: "acc_123", Provider: "stripe", PaymentToken: token.Token}
+	if _, err := tokenizer.SubmitCardPayment(ctx, payment); err != nil {
+		t.Fatalf("Expected provider adapter to receive the card, got %v", err)
+	}
+	if len(adapter.cards) != 1 || adapter.cards[0].PAN != "4242424242424242" {
+		t.Errorf("Expected original PAN handed to the adapter, got %+v", adapter.cards)
+	}
+
+	// Naming a provider without a registered adapter discloses nothing
+	payment.Provider = "reporting-service"
+	if _, err := tokenizer.SubmitCardPayment(ctx, payment); err != ErrDetokenizeNotAuthorized {
+		t.Errorf("Expected ErrDetokenizeNotAuthorized, got %v", err)
+	}
+
+	history, err := tokenizer.AccessHistory(ctx, token.Token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(history) != 2 || !history[0].Granted || history[1].Granted {
+		t.Errorf("Expected one granted and one denied access record, got %+v", history)
+	}
+}
+
+func TestTokenizer_RejectsInvalidCards(t *testing.T) {
+	tokenizer := newTestTokenizer(t)
+
+	testCases := []*TokenizeCardRequest{
+		{AccountID: "acc_123", PAN: "4242424242424241", ExpiryMonth: 12, ExpiryYear: time.Now().Year() + 1},
+		{AccountID: "acc_123", PAN: "4242424242424242", ExpiryMonth: 1, ExpiryYear: 2020},
+		{AccountID: "acc_123", PAN: "4242424242424242", ExpiryMonth: 13, ExpiryYear: time.Now().Year() + 1},
+		{AccountID: "", PAN: "4242424242424242", ExpiryMonth: 12, ExpiryYear: time.Now().Year() + 1},
+	}
+
+	for i, req := range testCases {
+		if _, err := tokenizer.Tokenize(context.Background(), req); err == nil {
+			t.Errorf("Case %d: expected tokenization to fail", i)
+		}
+	}
+}
+
+func TestPaymentService_CreatePaymentWithToken(t *testing.T) {
+	service := NewService(&MockRepository{}, nil)
+	service.SetTokenizer(newTestTokenizer(t))
+
+	token, err := service.TokenizeCard(context.Background(), &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "5555555555554444",
+		ExpiryMonth: 6,
+		ExpiryYear:  time.Now().Year() + 3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to tokenize card: %v", err)
+	}
+
+	payment, err := service.CreatePayment(context.Background(), &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 5000),
+		Description:   "Tokenized card payment",
+		PaymentToken:  token.Token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if payment.Metadata["card_last4"] != "4444" || payment.Metadata["card_brand"] != "mastercard" {
+		t.Errorf("Expected card details on payment metadata, got %v", payment.Metadata)
+	}
+
+	// Tokens are bound to the account that created them
+	_, err = service.CreatePayment(context.Background(), &CreatePaymentRequest{
+		AccountID:     "acc_999",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 5000),
+		Description:   "Token from another account",
+		PaymentToken:  token.Token,
+	})
+	if err == nil {
+		t.Error("Expected error for token owned by another account")
+	}
+}
+
+func TestPaymentService_ProcessPaymentSubmitsCardToAdapter(t *testing.T) {
+	ctx := context.Background()
+	service := NewService(NewInMemoryRepository(), nil)
+	tokenizer := newTestTokenizer(t)
+	adapter := &stubProviderAdapter{}
+	tokenizer.RegisterProviderAdapter("stripe", adapter)
+	service.SetTokenizer(tokenizer)
+
+	token, err := service.TokenizeCard(ctx, &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "5555555555554444",
+		ExpiryMonth: 6,
+		ExpiryYear:  time.Now().Year() + 3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to tokenize card: %v", err)
+	}
+
+	newPayment := func() *Payment {
+		payment, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+			AccountID:     "acc_123",
+			Provider:      "stripe",
+			PaymentMethod: "credit_card",
+			Amount:        FromMinorUnits("USD", 5000),
+			Description:   "Tokenized card payment",
+			PaymentToken:  token.Token,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+		return payment
+	}
+
+	payment := newPayment()
+	if err := service.ProcessPayment(ctx, payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(adapter.cards) != 1 || adapter.cards[0].PAN != "5555555555554444" {
+		t.Fatalf("Expected the card submitted to the adapter, got %+v", adapter.cards)
+	}
+	attempts, _ := service.ListPaymentAttempts(ctx, payment.ID)
+	if len(attempts) != 1 || attempts[0].ProviderTransactionID != "ch_"+payment.ID {
+		t.Errorf("Expected the provider transaction on the attempt, got %+v", attempts)
+	}
+
+	// A rejected submission fails the payment
+	adapter.err = errors.New("card_declined")
+	declined := newPayment()
+	if err := service.ProcessPayment(ctx, declined.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if found, _ := service.GetPayment(ctx, declined.ID); found.Status != "failed" {
+		t.Errorf("Expected failed payment, got %s", found.Status)
+	}
+
+	// Cards are not processed for providers without an adapter
+	unsupported, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "adyen",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 5000),
+		Description:   "Tokenized card payment",
+		PaymentToken:  token.Token,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if err := service.ProcessPayment(ctx, unsupported.ID); !errors.Is(err, ErrDetokenizeNotAuthorized) {
+		t.Errorf("Expected ErrDetokenizeNotAuthorized, got %v", err)
+	}
+	if found, _ := service.GetPayment(ctx, unsupported.ID); found.Status != "pending" {
+		t.Errorf("Expected payment to stay pending, got %s", found.Status)
+	}
+}
+
+func TestVaultTransitKMS_WrapsDataKeys(t *testing.T) {
+	// A stand-in for the transit engine: ciphertexts name the issued key
+	issued := map[string]string{}
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		data := map[string]string{}
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/card-pan":
+			ciphertext := fmt.Sprintf("vault:v1:%d", len(issued))
+			issued[ciphertext] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%032d", len(issued))))
+			data["plaintext"], data["ciphertext"] = issued[ciphertext], ciphertext
+		case "/v1/transit/decrypt/card-pan":
+			plaintext, ok := issued[fmt.Sprint(body["ciphertext"])]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data["plaintext"] = plaintext
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer vault.Close()
+
+	ctx := context.Background()
+	kms := NewVaultTransitKMS(vault.URL, "test-token", "")
+	tokenizer := NewTokenizer(kms, "card-pan", NewInMemoryCardVault(), NewInMemoryTokenAuditLog(), []byte("test-fingerprint-key"))
+	adapter := &stubProviderAdapter{}
+	tokenizer.RegisterProviderAdapter("stripe", adapter)
+
+	token, err := tokenizer.Tokenize(ctx, &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "4242424242424242",
+		ExpiryMonth: 12,
+		ExpiryYear:  time.Now().Year() + 1,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	payment := &Payment{ID: "pay_1", AccountID: "acc_123", Provider: "stripe", PaymentToken: token.Token}
+	if _, err := tokenizer.SubmitCardPayment(ctx, payment); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(adapter.cards) != 1 || adapter.cards[0].PAN != "4242424242424242" {
+		t.Errorf("Expected the card decrypted with the transit data key, got %+v", adapter.cards)
+	}
+
+	if _, _, err := NewVaultTransitKMS(vault.URL, "wrong-token", "").GenerateDataKey(ctx, "card-pan"); err == nil {
+		t.Error("Expected error when Vault rejects the token")
+	}
+}
+
+func TestPaymentService_RejectsRawCardNumbers(t *testing.T) {
+	service := NewService(&MockRepository{}, nil)
+
+	_, err := service.CreatePayment(context.Background(), &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 5000),
+		Description:   "Raw card in metadata",
+		Metadata:      map[string]interface{}{"note": "4111-1111-1111-1111"},
+	})
+	if err == nil {
+		t.Error("Expected raw card number in metadata to be rejected")
+	}
+}
+
+func newTestBilling(t *testing.T) (*Service, *SubscriptionBilling, *InMemoryEventPublisher, string, *time.Time) {
+	service := NewService(NewInMemoryRepository(), nil)
+	service.SetTokenizer(newTestTokenizer(t))
+	events := NewInMemoryEventPublisher()
+	service.SetEventPublisher(events)
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	billing := NewSubscriptionBilling(service, NewInMemorySubscriptionRepository(), DefaultDunningPolicy())
+	billing.now = func() time.Time { return clock }
+	service.SetSubscriptionBilling(billing)
+
+	token, err := service.TokenizeCard(context.Background(), &TokenizeCardRequest{
+		AccountID:   "acc_123",
+		PAN:         "4111111111111111",
+		ExpiryMonth: 12,
+		ExpiryYear:  time.Now().Year() + 3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to tokenize card: %v", err)
+	}
+
+	return service, billing, events, token.Token, &clock
+}
+
+func createTestPlan(t *testing.T, billing *SubscriptionBilling, name string, minorUnits int64, trialDays int) *BillingPlan {
+	plan, err := billing.CreatePlan(context.Background(), &CreatePlanRequest{
+		MerchantID: "merchant_1",
+		Name:       name,
+		Amount:     FromMinorUnits("USD", minorUnits),
+		Interval:   "month",
+		TrialDays:  trialDays,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create plan: %v", err)
+	}
+	return plan
+}
+
+func TestSubscriptionBilling_SubscribeChargesFirstPeriod(t *testing.T) {
+	service, billing, events, token, _ := newTestBilling(t)
+	ctx := context.Background()
+	plan := createTestPlan(t, billing, "Pro", 10000, 0)
+
+	subscription, err := billing.Subscribe(ctx, &CreateSubscriptionRequest{
+		AccountID:     "acc_123",
+		PlanID:        plan.ID,
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		PaymentToken:  token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if subscription.Status != "active" {
+		t.Errorf("Expected status 'active', got %s", subscription.Status)
+	}
+
+	invoices, _ := billing.ListInvoices(ctx, subscription.ID)
+	if len(invoices) != 1 {
+		t.Fatalf("Expected 1 invoice, got %d", len(invoices))
+	}
+
+	payment, err := service.GetPayment(ctx, invoices[0].PaymentID)
+	if err != nil {
+		t.Fatalf("Expected invoice payment, got %v", err)
+	}
+	if payment.PaymentToken != token || payment.Status != "processing" {
+		t.Errorf("Expected processing payment on saved token, got %s on %s", payment.Status, payment.PaymentToken)
+	}
+
+	if err := service.CompletePayment(ctx, payment.ID, "txn_1"); err != nil {
+		t.Fatalf("Failed to complete payment: %v", err)
+	}
+
+	invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+	if invoices[0].Status != "paid" {
+		t.Errorf("Expected invoice status 'paid', got %s", invoices[0].Status)
+	}
+
+	if len(events.EventsOfType("subscription.created")) != 1 || len(events.EventsOfType("invoice.paid")) != 1 {
+		t.Error("Expected subscription.created and invoice.paid events")
+	}
+}
+
+func TestSubscriptionBilling_TrialThenRenewal(t *testing.T) {
+	_, billing, _, token, clock := newTestBilling(t)
+	ctx := context.Background()
+	plan := createTestPlan(t, billing, "Pro", 10000, 14)
+
+	subscription, err := billing.Subscribe(ctx, &CreateSubscriptionRequest{
+		AccountID:     "acc_123",
+		PlanID:        plan.ID,
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		PaymentToken:  token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if subscription.Status != "trialing" {
+		t.Errorf("Expected status 'trialing', got %s", subscription.Status)
+	}
+
+	invoices, _ := billing.ListInvoices(ctx, subscription.ID)
+	if len(invoices) != 0 {
+		t.Errorf("Expected no invoices during trial, got %d", len(invoices))
+	}
+
+	*clock = clock.AddDate(0, 0, 15)
+	result, err := billing.RunBillingCycle(ctx)
+	if err != nil {
+		t.Fatalf("Billing run failed: %v", err)
+	}
+	if result.Renewed != 1 {
+		t.Errorf("Expected 1 renewal, got %d", result.Renewed)
+	}
+
+	subscription, _ = billing.GetSubscription(ctx, subscription.ID)
+	if subscription.Status != "active" {
+		t.Errorf("Expected status 'active', got %s", subscription.Status)
+	}
+
+	invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+	if len(invoices) != 1 || invoices[0].PaymentID == "" {
+		t.Errorf("Expected one charged invoice after trial, got %d", len(invoices))
+	}
+}
+
+func TestSubscriptionBilling_Dunning(t *testing.T) {
+	service, billing, events, token, clock := newTestBilling(t)
+	ctx := context.Background()
+	plan := createTestPlan(t, billing, "Pro", 10000, 0)
+
+	subscription, err := billing.Subscribe(ctx, &CreateSubscriptionRequest{
+		AccountID:     "acc_123",
+		PlanID:        plan.ID,
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		PaymentToken:  token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	invoices, _ := billing.ListInvoices(ctx, subscription.ID)
+	if err := service.FailPayment(ctx, invoices[0].PaymentID, "insufficient_funds"); err != nil {
+		t.Fatalf("Failed to fail payment: %v", err)
+	}
+
+	subscription, _ = billing.GetSubscription(ctx, subscription.ID)
+	if subscription.Status != "past_due" {
+		t.Errorf("Expected status 'past_due', got %s", subscription.Status)
+	}
+
+	invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+	if invoices[0].NextAttemptAt == nil || !invoices[0].NextAttemptAt.Equal(clock.Add(24*time.Hour)) {
+		t.Fatalf("Expected retry scheduled in 24h, got %v", invoices[0].NextAttemptAt)
+	}
+
+	// Nothing is retried before the scheduled attempt
+	result, _ := billing.RunBillingCycle(ctx)
+	if result.Retried != 0 {
+		t.Errorf("Expected no retries before schedule, got %d", result.Retried)
+	}
+
+	*clock = clock.Add(25 * time.Hour)
+	result, _ = billing.RunBillingCycle(ctx)
+	if result.Retried != 1 {
+		t.Errorf("Expected 1 retry, got %d", result.Retried)
+	}
+
+	payment, _ := service.GetPayment(ctx, invoices[0].PaymentID)
+	if payment.Status != "processing" {
+		t.Errorf("Expected retried payment to be processing, got %s", payment.Status)
+	}
+
+	// A hard decline ends dunning straight away
+	if err := service.FailPayment(ctx, payment.ID, "stolen_card"); err != nil {
+		t.Fatalf("Failed to fail payment: %v", err)
+	}
+
+	subscription, _ = billing.GetSubscription(ctx, subscription.ID)
+	if subscription.Status != "unpaid" {
+		t.Errorf("Expected status 'unpaid', got %s", subscription.Status)
+	}
+
+	invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+	if invoices[0].Status != "uncollectible" {
+		t.Errorf("Expected invoice status 'uncollectible', got %s", invoices[0].Status)
+	}
+
+	if len(events.EventsOfType("subscription.past_due")) != 1 || len(events.EventsOfType("subscription.unpaid")) != 1 {
+		t.Error("Expected subscription.past_due and subscription.unpaid events")
+	}
+}
+
+func TestSubscriptionBilling_ChangePlanProration(t *testing.T) {
+	_, billing, _, token, clock := newTestBilling(t)
+	ctx := context.Background()
+	basic := createTestPlan(t, billing, "Basic", 10000, 0)
+	premium := createTestPlan(t, billing, "Premium", 30000, 0)
+
+	subscription, err := billing.Subscribe(ctx, &CreateSubscriptionRequest{
+		AccountID:     "acc_123",
+		PlanID:        basic.ID,
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		PaymentToken:  token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// January has 31 days; upgrade with 15.5 days left, exactly half
+	*clock = clock.Add(time.Duration(15.5 * float64(24*time.Hour)))
+	if _, err := billing.ChangePlan(ctx, subscription.ID, premium.ID); err != nil {
+		t.Fatalf("Failed to change plan: %v", err)
+	}
+
+	invoices, _ := billing.ListInvoices(ctx, subscription.ID)
+	if len(invoices) != 2 {
+		t.Fatalf("Expected 2 invoices, got %d", len(invoices))
+	}
+
+	total, _ := invoices[1].Total.Value.Float64()
+	if total != 100 {
+		t.Errorf("Expected prorated total 100, got %v", total)
+	}
+
+	// Downgrading back leaves a credit for the next invoice
+	if _, err := billing.ChangePlan(ctx, subscription.ID, basic.ID); err != nil {
+		t.Fatalf("Failed to change plan: %v", err)
+	}
+
+	subscription, _ = billing.GetSubscription(ctx, subscription.ID)
+	credit, _ := subscription.CreditBalance.Value.Float64()
+	if credit != 100 {
+		t.Errorf("Expected credit balance 100, got %v", credit)
+	}
+}
+
+func TestSubscriptionBilling_DunningRetriesSamePayment(t *testing.T) {
+	service, billing, _, token, clock := newTestBilling(t)
+	ctx := context.Background()
+	plan := createTestPlan(t, billing, "Pro", 10000, 0)
+
+	// The payment retry policy does not cut dunning short
+	service.SetRetryPolicy(RetryPolicy{MaxRetries: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, Multiplier: 2})
+
+	// A charge that never reaches the provider is cancelled, not left pending
+	service.SetRiskAssessor(&stubRiskAssessor{result: &RiskAssessmentResult{ID: "risk_1", Decision: "block"}})
+	subscription, err := billing.Subscribe(ctx, &CreateSubscriptionRequest{
+		AccountID:     "acc_123",
+		PlanID:        plan.ID,
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		PaymentToken:  token,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	invoices, _ := billing.ListInvoices(ctx, subscription.ID)
+	blocked, _ := service.GetPayment(ctx, invoices[0].PaymentID)
+	if blocked.Status != "cancelled" {
+		t.Errorf("Expected the unsubmitted payment cancelled, got %s", blocked.Status)
+	}
+
+	// The next attempt needs a new payment
+	service.SetRiskAssessor(nil)
+	*clock = clock.Add(25 * time.Hour)
+	if result, _ := billing.RunBillingCycle(ctx); result.Retried != 1 {
+		t.Fatalf("Expected 1 retry, got %d", result.Retried)
+	}
+
+	invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+	paymentID := invoices[0].PaymentID
+	if paymentID == blocked.ID {
+		t.Fatal("Expected a new payment after the cancelled one")
+	}
+
+	// Later attempts retry that payment in place, past the payment retry policy
+	for _, wait := range []time.Duration{3 * 24 * time.Hour, 5 * 24 * time.Hour} {
+		if err := service.FailPayment(ctx, paymentID, "insufficient_funds"); err != nil {
+			t.Fatalf("Failed to fail payment: %v", err)
+		}
+		*clock = clock.Add(wait + time.Hour)
+		if result, _ := billing.RunBillingCycle(ctx); result.Retried != 1 {
+			t.Fatalf("Expected 1 retry, got %d", result.Retried)
+		}
+
+		invoices, _ = billing.ListInvoices(ctx, subscription.ID)
+		if invoices[0].PaymentID != paymentID {
+			t.Errorf("Expected payment %s retried in place, got %s", paymentID, invoices[0].PaymentID)
+		}
+	}
+
+	payment, _ := service.GetPayment(ctx, paymentID)
+	attempts, _ := service.ListPaymentAttempts(ctx, paymentID)
+	if payment.Status != "processing" || len(attempts) != 3 {
+		t.Errorf("Expected the payment processing on its third attempt, got %s after %d", payment.Status, len(attempts))
+	}
+
+	payments, _ := service.ListPayments(ctx, PaymentFilters{AccountID: "acc_123"})
+	if len(payments) != 2 {
+		t.Errorf("Expected 2 payments for the invoice, got %d", len(payments))
+	}
+}
+
+func TestScaleMoney_MinorUnits(t *testing.T) {
+	tests := []struct {
+		amount      Money
+		numerator   int64
+		denominator int64
+		expected    string
+	}{
+		{FromMinorUnits("USD", 10000), 1, 3, "33.33"},
+		{FromMinorUnits("USD", 10000), 2, 3, "66.67"},
+		{FromMinorUnits("USD", -5), 1, 2, "-0.03"},
+		{Money{Value: big.NewFloat(1000), Currency: "JPY"}, 1, 3, "333"},
+		{Money{Value: big.NewFloat(10), Currency: "KWD"}, 2, 3, "6.667"},
+	}
+
+	for _, tt := range tests {
+		scaled := scaleMoney(tt.amount, tt.numerator, tt.denominator)
+		if got := scaled.Value.Text('f', currencyExponent(scaled.Currency)); got != tt.expected {
+			t.Errorf("Expected %s %s * %d/%d to be %s, got %s", tt.amount.Value.String(), tt.amount.Currency, tt.numerator, tt.denominator, tt.expected, got)
+		}
+	}
+}
+
+func TestMoneyToMinorUnits_CurrencyExponent(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		expected int64
+	}{
+		{FromMinorUnits("USD", 12550), 12550},
+		{Money{Value: big.NewFloat(0.125), Currency: "USD"}, 13},
+		{Money{Value: big.NewFloat(5000), Currency: "JPY"}, 5000},
+		{Money{Value: big.NewFloat(1.2346), Currency: "KWD"}, 1235},
+		{FromMinorUnits("JPY", 5000), 5000},
+	}
+
+	for _, tt := range tests {
+		if got := moneyToMinorUnits(tt.amount); got != tt.expected {
+			t.Errorf("Expected %s %s to be %d minor units, got %d", tt.amount.Value.String(), tt.amount.Currency, tt.expected, got)
+		}
+	}
+}
+
+func newTestCheckoutRequest() *CreateCheckoutSessionRequest {
+	return &CreateCheckoutSessionRequest{
+		MerchantID:     "merchant_1",
+		MerchantName:   "Corner Bakery",
+		MerchantCity:   "Harare",
+		CountryCode:    "ZW",
+		Amount:         FromMinorUnits("USD", 12550),
+		AllowedMethods: []string{"credit_card", "apple_pay"},
+		Description:    "Birthday cake",
+		SuccessURL:     "https://bakery.example.com/thanks",
+		CancelURL:      "https://bakery.example.com/cart",
+	}
+}
+
+func TestCRC16CCITT(t *testing.T) {
+	if crc := crc16CCITT([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("Expected CRC 0x29B1, got 0x%04X", crc)
+	}
+}
+
+func TestCheckoutSessions_CreateSession(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	checkout := NewCheckoutSessions(service, NewInMemoryCheckoutRepository(), "https://pay.example.com/pay/")
+
+	session, err := checkout.CreateSession(context.Background(), newTestCheckoutRequest())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if session.URL != "https://pay.example.com/pay/"+session.ID {
+		t.Errorf("Expected shareable URL for session, got %s", session.URL)
+	}
+
+	fields, err := ParseEMVCoQRPayload(session.QRPayload)
+	if err != nil {
+		t.Fatalf("Expected valid QR payload, got %v", err)
+	}
+
+	expected := map[string]string{
+		"00": "01",
+		"01": "12",
+		"52": "5999",
+		"53": "840",
+		"54": "125.50",
+		"58": "ZW",
+		"59": "Corner Bakery",
+		"60": "Harare",
+	}
+	for tag, value := range expected {
+		if fields[tag] != value {
+			t.Errorf("Expected QR field %s to be %q, got %q", tag, value, fields[tag])
+		}
+	}
+
+	additional, err := parseEMVCoFields(fields["62"])
+	if err != nil || additional["05"] != session.ID {
+		t.Errorf("Expected session ID as reference label, got %v", additional)
+	}
+
+	// Tampering with the payload breaks the CRC
+	tampered := strings.Replace(session.QRPayload, "125.50", "025.50", 1)
+	if _, err := ParseEMVCoQRPayload(tampered); err == nil {
+		t.Error("Expected CRC error for tampered payload")
+	}
+
+	// Field lengths count bytes, so multi-byte names are cut to fit whole
+	req := newTestCheckoutRequest()
+	req.MerchantName = "Pâtisserie Crème Brûlée Genève"
+	req.MerchantCity = "Genève Pâquis Est"
+	session, err = checkout.CreateSession(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	fields, err = ParseEMVCoQRPayload(session.QRPayload)
+	if err != nil {
+		t.Fatalf("Expected valid QR payload, got %v", err)
+	}
+	if fields["59"] != "Pâtisserie Crème Brûl" || fields["60"] != "Genève Pâquis" {
+		t.Errorf("Expected names cut to 25 and 15 bytes on rune boundaries, got %q and %q", fields["59"], fields["60"])
+	}
+}
+
+func TestCheckoutSessions_CreateSessionValidation(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	checkout := NewCheckoutSessions(service, NewInMemoryCheckoutRepository(), "https://pay.example.com/pay")
+
+	tests := []struct {
+		name   string
+		mutate func(req *CreateCheckoutSessionRequest)
+	}{
+		{"no allowed methods", func(req *CreateCheckoutSessionRequest) { req.AllowedMethods = nil }},
+		{"unknown method", func(req *CreateCheckoutSessionRequest) { req.AllowedMethods = []string{"cash"} }},
+		{"relative redirect", func(req *CreateCheckoutSessionRequest) { req.SuccessURL = "/thanks" }},
+		{"missing city", func(req *CreateCheckoutSessionRequest) { req.MerchantCity = "" }},
+		{"past expiry", func(req *CreateCheckoutSessionRequest) {
+			past := time.Now().Add(-time.Minute)
+			req.ExpiresAt = &past
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestCheckoutRequest()
+			tt.mutate(req)
+			if _, err := checkout.CreateSession(context.Background(), req); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestCheckoutSessions_CompleteSession(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	events := NewInMemoryEventPublisher()
+	service.SetEventPublisher(events)
+	checkout := NewCheckoutSessions(service, NewInMemoryCheckoutRepository(), "https://pay.example.com/pay")
+	service.SetCheckoutSessions(checkout)
+	ctx := context.Background()
+
+	session, err := checkout.CreateSession(ctx, newTestCheckoutRequest())
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	payer := &CompleteCheckoutSessionRequest{
+		AccountID:     "acc_payer",
+		Provider:      "stripe",
+		PaymentMethod: "paypal",
+	}
+	if _, err := checkout.CompleteSession(ctx, session.ID, payer); err == nil {
+		t.Error("Expected error for method not allowed by the session")
+	}
+
+	payer.PaymentMethod = "credit_card"
+	session, err = checkout.CompleteSession(ctx, session.ID, payer)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The session waits for the provider to settle the payment
+	if session.Status != "pending" {
+		t.Errorf("Expected status 'pending', got %s", session.Status)
+	}
+
+	payment, err := service.GetPayment(ctx, session.PaymentID)
+	if err != nil {
+		t.Fatalf("Expected payment to be created, got %v", err)
+	}
+	if payment.Status != "processing" {
+		t.Errorf("Expected payment to be processed, got %s", payment.Status)
+	}
+	if payment.Metadata["checkout_session_id"] != session.ID || payment.Amount.Value.Cmp(session.Amount.Value) != 0 {
+		t.Errorf("Expected payment for session amount, got %v", payment.Metadata)
+	}
+	if len(events.EventsOfType("checkout.session.completed")) != 0 {
+		t.Error("Expected no checkout.session.completed event before the payment completes")
+	}
+
+	if _, err := checkout.CompleteSession(ctx, session.ID, payer); !errors.Is(err, ErrCheckoutSessionClosed) {
+		t.Errorf("Expected ErrCheckoutSessionClosed while the payment is pending, got %v", err)
+	}
+
+	if err := service.CompletePayment(ctx, payment.ID, "txn_checkout"); err != nil {
+		t.Fatalf("Failed to complete payment: %v", err)
+	}
+
+	session, _ = checkout.GetSession(ctx, session.ID)
+	if session.Status != "completed" || session.CompletedAt == nil {
+		t.Errorf("Expected status 'completed' once the payment completes, got %s", session.Status)
+	}
+	if len(events.EventsOfType("checkout.session.completed")) != 1 {
+		t.Error("Expected checkout.session.completed event")
+	}
+
+	if _, err := checkout.CompleteSession(ctx, session.ID, payer); !errors.Is(err, ErrCheckoutSessionClosed) {
+		t.Errorf("Expected ErrCheckoutSessionClosed on second completion, got %v", err)
+	}
+}
+
+func TestCheckoutSessions_ReopenOnFailedPayment(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	checkout := NewCheckoutSessions(service, NewInMemoryCheckoutRepository(), "https://pay.example.com/pay")
+	service.SetCheckoutSessions(checkout)
+	ctx := context.Background()
+
+	session, err := checkout.CreateSession(ctx, newTestCheckoutRequest())
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	payer := &CompleteCheckoutSessionRequest{
+		AccountID:     "acc_payer",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+	}
+
+	// A declined payment is cancelled and the payer can try again
+	service.localRiskLimit = 5
+	if _, err := checkout.CompleteSession(ctx, session.ID, payer); !errors.Is(err, ErrPaymentBlocked) {
+		t.Fatalf("Expected ErrPaymentBlocked, got %v", err)
+	}
+	session, _ = checkout.GetSession(ctx, session.ID)
+	if session.Status != "open" || session.PaymentID != "" {
+		t.Errorf("Expected session reopened after a declined payment, got %s with payment %q", session.Status, session.PaymentID)
+	}
+	payments, _ := service.ListPayments(ctx, PaymentFilters{AccountID: "acc_payer"})
+	if len(payments) != 1 || payments[0].Status != "cancelled" {
+		t.Errorf("Expected the declined payment to be cancelled, got %v", payments)
+	}
+
+	// A payment the provider declines for good reopens the session too
+	service.localRiskLimit = 70
+	session, err = checkout.CompleteSession(ctx, session.ID, payer)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := service.FailPayment(ctx, session.PaymentID, "stolen_card"); err != nil {
+		t.Fatalf("Failed to fail payment: %v", err)
+	}
+	session, _ = checkout.GetSession(ctx, session.ID)
+	if session.Status != "open" || session.PaymentID != "" {
+		t.Errorf("Expected session reopened after a failed payment, got %s with payment %q", session.Status, session.PaymentID)
+	}
+}
+
+func TestCheckoutSessions_Expiry(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	checkout := NewCheckoutSessions(service, NewInMemoryCheckoutRepository(), "https://pay.example.com/pay")
+	ctx := context.Background()
+
+	session, err := checkout.CreateSession(ctx, newTestCheckoutRequest())
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	checkout.now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+
+	session, err = checkout.GetSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if session.Status != "expired" {
+		t.Errorf("Expected status 'expired', got %s", session.Status)
+	}
+
+	_, err = checkout.CompleteSession(ctx, session.ID, &CompleteCheckoutSessionRequest{
+		AccountID:     "acc_payer",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+	})
+	if !errors.Is(err, ErrCheckoutSessionClosed) {
+		t.Errorf("Expected ErrCheckoutSessionClosed for expired session, got %v", err)
+	}
+}
+
+func TestClassifyDecline(t *testing.T) {
+	tests := []struct {
+		reason   string
+		code     string
+		category string
+	}{
+		{"insufficient_funds", "insufficient_funds", DeclineSoft},
+		{"51", "51", DeclineSoft},
+		{"43", "43", DeclineHard},
+		{"card_declined: stolen_card", "stolen_card", DeclineHard},
+		{"code: 05 - Do not honour", "05", DeclineSoft},
+		{"decline_code: 14, invalid card number", "14", DeclineHard},
+		{"Expired_Card", "expired_card", DeclineHard},
+		{"something unexpected", "unknown", DeclineSoft},
+		{"timeout after 15 seconds", "unknown", DeclineSoft},
+		{"timeout: gave up after 15 seconds", "timeout", DeclineSoft},
+		{"Issuer response 05 - Do not honour", "unknown", DeclineSoft},
+		{(&DeclineError{Code: "R1", Message: "revoked 41 days ago"}).Error(), "R1", DeclineHard},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			decline := ClassifyDecline(tt.reason)
+			if decline.Code != tt.code || decline.Category != tt.category {
+				t.Errorf("Expected %s/%s, got %s/%s", tt.code, tt.category, decline.Code, decline.Category)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{
+		MaxRetries: 5,
+		BaseDelay:  time.Minute,
+		MaxDelay:   time.Hour,
+		Multiplier: 4,
+	}
+
+	expected := []time.Duration{time.Minute, 4 * time.Minute, 16 * time.Minute, time.Hour, time.Hour}
+	for i, want := range expected {
+		if got := policy.Delay(i+1, 0.5); got != want {
+			t.Errorf("Expected delay %v for retry %d, got %v", want, i+1, got)
+		}
+	}
+
+	// Jitter stays within ±25%
+	if got := policy.Delay(2, 0); got != 3*time.Minute {
+		t.Errorf("Expected minimum jittered delay 3m, got %v", got)
+	}
+	if got := policy.Delay(2, 0.999999); got < 4*time.Minute || got > 5*time.Minute {
+		t.Errorf("Expected maximum jittered delay near 5m, got %v", got)
+	}
+}
+
+func createProcessedPayment(t *testing.T, service *Service) *Payment {
+	payment, err := service.CreatePayment(context.Background(), &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 10000),
+		Description:   "Retry test payment",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	if err := service.ProcessPayment(context.Background(), payment.ID); err != nil {
+		t.Fatalf("Failed to process payment: %v", err)
+	}
+	return payment
+}
+
+func TestPaymentService_SoftDeclineRetries(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	service.SetRetryPolicy(RetryPolicy{MaxRetries: 2, Multiplier: 2})
+	ctx := context.Background()
+	payment := createProcessedPayment(t, service)
+
+	for i := 0; i < 2; i++ {
+		if err := service.FailPayment(ctx, payment.ID, "insufficient_funds"); err != nil {
+			t.Fatalf("Failed to fail payment: %v", err)
+		}
+
+		attempts, _ := service.ListPaymentAttempts(ctx, payment.ID)
+		last := attempts[len(attempts)-1]
+		if last.Status != "failed" || last.DeclineCategory != DeclineSoft || last.NextRetryAt == nil {
+			t.Fatalf("Expected failed soft decline with retry scheduled, got %+v", last)
+		}
+
+		retried, err := service.RunDueRetries(ctx)
+		if err != nil || retried != 1 {
+			t.Fatalf("Expected 1 due retry, got %d (%v)", retried, err)
+		}
+	}
+
+	// The retry budget is spent, so the third failure is final
+	if err := service.FailPayment(ctx, payment.ID, "insufficient_funds"); err != nil {
+		t.Fatalf("Failed to fail payment: %v", err)
+	}
+
+	attempts, _ := service.ListPaymentAttempts(ctx, payment.ID)
+	if len(attempts) != 3 {
+		t.Fatalf("Expected 3 attempt records, got %d", len(attempts))
+	}
+	for i, attempt := range attempts {
+		if attempt.AttemptNumber != i+1 {
+			t.Errorf("Expected attempt number %d, got %d", i+1, attempt.AttemptNumber)
+		}
+	}
+	if attempts[2].NextRetryAt != nil {
+		t.Error("Expected no retry after max attempts")
+	}
+
+	if err := service.RetryPayment(ctx, payment.ID); err == nil {
+		t.Error("Expected error when retry limit exceeded")
+	}
+}
+
+func TestPaymentService_HardDeclineNotRetried(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	ctx := context.Background()
+	payment := createProcessedPayment(t, service)
+
+	if err := service.FailPayment(ctx, payment.ID, "stolen_card"); err != nil {
+		t.Fatalf("Failed to fail payment: %v", err)
+	}
+
+	attempts, _ := service.ListPaymentAttempts(ctx, payment.ID)
+	if len(attempts) != 1 || attempts[0].DeclineCategory != DeclineHard || attempts[0].NextRetryAt != nil {
+		t.Fatalf("Expected one hard-declined attempt with no retry, got %+v", attempts)
+	}
+
+	if err := service.RetryPayment(ctx, payment.ID); !errors.Is(err, ErrHardDecline) {
+		t.Errorf("Expected ErrHardDecline, got %v", err)
+	}
+}
+
+func TestPaymentService_GetPaymentMetrics(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	ctx := context.Background()
+
+	outcomes := []struct {
+		provider string
+		reason   string
+	}{
+		{"stripe", ""},
+		{"stripe", ""},
+		{"stripe", "insufficient_funds"},
+		{"adyen", ""},
+		{"adyen", "43"},
+	}
+
+	for _, outcome := range outcomes {
+		payment, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+			AccountID:     "acc_123",
+			Provider:      outcome.provider,
+			PaymentMethod: "credit_card",
+			Amount:        FromMinorUnits("USD", 10000),
+			Description:   "Metrics test payment",
+		})
+		if err != nil {
+			t.Fatalf("Failed to create payment: %v", err)
+		}
+		if err := service.ProcessPayment(ctx, payment.ID); err != nil {
+			t.Fatalf("Failed to process payment: %v", err)
+		}
+
+		if outcome.reason == "" {
+			err = service.CompletePayment(ctx, payment.ID, "txn_"+payment.ID)
+		} else {
+			err = service.FailPayment(ctx, payment.ID, outcome.reason)
+		}
+		if err != nil {
+			t.Fatalf("Failed to finish payment: %v", err)
+		}
+	}
+
+	metrics, err := service.GetPaymentMetrics(ctx, MetricsQuery{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if metrics.Authorized != 3 || metrics.Declined != 2 {
+		t.Errorf("Expected 3 authorized and 2 declined, got %d and %d", metrics.Authorized, metrics.Declined)
+	}
+
+	if metrics.AuthorizationRate != 0.6 {
+		t.Errorf("Expected authorization rate 0.6, got %v", metrics.AuthorizationRate)
+	}
+
+	if metrics.DeclinesByReason["insufficient_funds"] != 1 || metrics.DeclinesByReason["43"] != 1 {
+		t.Errorf("Expected decline breakdown by code, got %v", metrics.DeclinesByReason)
+	}
+
+	volume, _ := metrics.TotalVolume.Value.Float64()
+	if volume != 300 || metrics.TotalVolume.Currency != "USD" {
+		t.Errorf("Expected volume 300 USD, got %v %s", volume, metrics.TotalVolume.Currency)
+	}
+
+	if metrics.TopProvider != "stripe" {
+		t.Errorf("Expected top provider stripe, got %s", metrics.TopProvider)
+	}
+
+	if rate := metrics.ByProvider["adyen"].AuthorizationRate; rate != 0.5 {
+		t.Errorf("Expected adyen authorization rate 0.5, got %v", rate)
+	}
+
+	// Filters and windows are applied to the rollups
+	filtered, _ := service.GetPaymentMetrics(ctx, MetricsQuery{Provider: "adyen"})
+	if filtered.TotalPayments != 2 {
+		t.Errorf("Expected 2 adyen payments, got %d", filtered.TotalPayments)
+	}
+
+	past, _ := service.GetPaymentMetrics(ctx, MetricsQuery{
+		From: time.Now().Add(-72 * time.Hour),
+		To:   time.Now().Add(-48 * time.Hour),
+	})
+	if past.TotalPayments != 0 {
+		t.Errorf("Expected no payments in past window, got %d", past.TotalPayments)
+	}
+
+	// Rebuilding from the repository gives the same numbers
+	if err := service.RebuildPaymentMetrics(ctx); err != nil {
+		t.Fatalf("Failed to rebuild metrics: %v", err)
+	}
+	rebuilt, _ := service.GetPaymentMetrics(ctx, MetricsQuery{})
+	if rebuilt.Authorized != 3 || rebuilt.Declined != 2 {
+		t.Errorf("Expected rebuilt metrics to match, got %d and %d", rebuilt.Authorized, rebuilt.Declined)
+	}
+
+	var out strings.Builder
+	if err := service.metrics.WritePrometheus(&out); err != nil {
+		t.Fatalf("Failed to write Prometheus metrics: %v", err)
+	}
+	for _, line := range []string{
+		`payment_authorizations_total{provider="stripe",method="credit_card",currency="USD"} 2`,
+		`payment_declines_total{provider="adyen",method="credit_card",currency="USD",reason="43"} 1`,
+		`# TYPE payment_volume_total counter`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected Prometheus output to contain %q", line)
+		}
+	}
+}
+
+type stubRiskAssessor struct {
+	result *RiskAssessmentResult
+}
+
+func (a *stubRiskAssessor) Assess(ctx context.Context, req *RiskAssessmentRequest) (*RiskAssessmentResult, error) {
+	return a.result, nil
+}
+
+func TestPaymentService_RiskReviewHold(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	service.SetRiskAssessor(&stubRiskAssessor{result: &RiskAssessmentResult{ID: "risk_1", Decision: "review", ReviewCaseID: "review_1"}})
+	ctx := context.Background()
+
+	held := createProcessedPayment(t, service)
+	payment, _ := service.GetPayment(ctx, held.ID)
+	if payment.Status != "pending_review" || payment.Metadata["review_case_id"] != "review_1" {
+		t.Fatalf("Expected payment held for review_1, got %s (%v)", payment.Status, payment.Metadata["review_case_id"])
+	}
+	if attempts, _ := service.ListPaymentAttempts(ctx, held.ID); len(attempts) != 0 {
+		t.Errorf("Expected no provider attempt while held, got %d", len(attempts))
+	}
+
+	if _, err := service.ResolvePaymentReview(ctx, held.ID, &ReviewDecision{ReviewCaseID: "review_other", Decision: "approve", Analyst: "analyst_1"}); !errors.Is(err, ErrReviewCaseMismatch) {
+		t.Errorf("Expected ErrReviewCaseMismatch for mismatched review case, got %v", err)
+	}
+	if _, err := service.ResolvePaymentReview(ctx, held.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "approve", Status: "approved"}); !errors.Is(err, ErrReviewCaseMismatch) {
+		t.Errorf("Expected ErrReviewCaseMismatch without an analyst, got %v", err)
+	}
+
+	payment, err := service.ResolvePaymentReview(ctx, held.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "approve", Status: "approved", Analyst: "analyst_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if payment.Status != "processing" {
+		t.Errorf("Expected processing after approval, got %s", payment.Status)
+	}
+	if attempts, _ := service.ListPaymentAttempts(ctx, held.ID); len(attempts) != 1 {
+		t.Errorf("Expected 1 provider attempt after approval, got %d", len(attempts))
+	}
+
+	// A declined review cancels the payment
+	declined := createProcessedPayment(t, service)
+	payment, err = service.ResolvePaymentReview(ctx, declined.ID, &ReviewDecision{ReviewCaseID: "review_1", Decision: "decline", Status: "expired"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if payment.Status != "cancelled" {
+		t.Errorf("Expected cancelled after decline, got %s", payment.Status)
+	}
+
+	// Blocked payments are rejected outright
+	service.SetRiskAssessor(&stubRiskAssessor{result: &RiskAssessmentResult{ID: "risk_2", Decision: "block"}})
+	blocked, _ := service.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 10000),
+		Description:   "Blocked payment",
+	})
+	if err := service.ProcessPayment(ctx, blocked.ID); !errors.Is(err, ErrPaymentBlocked) {
+		t.Errorf("Expected ErrPaymentBlocked, got %v", err)
+	}
+
+	// A payment without a review case cannot be released
+	service.SetRiskAssessor(nil)
+	local, _ := service.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     "acc_123",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 10000),
+		Description:   "Held payment without a case",
+	})
+	local.Status = "pending_review"
+	service.repo.UpdatePayment(ctx, local)
+	if _, err := service.ResolvePaymentReview(ctx, local.ID, &ReviewDecision{Decision: "approve", Analyst: "analyst_1"}); !errors.Is(err, ErrReviewCaseMismatch) {
+		t.Errorf("Expected ErrReviewCaseMismatch for a hold without a case, got %v", err)
+	}
+}
+
+// unavailableRiskAssessor fails every assessment like an unreachable risk-service
+type unavailableRiskAssessor struct{}
+
+func (unavailableRiskAssessor) Assess(ctx context.Context, req *RiskAssessmentRequest) (*RiskAssessmentResult, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestPaymentService_RiskServiceUnavailable(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	service.SetRiskAssessor(unavailableRiskAssessor{})
+	ctx := context.Background()
+
+	create := func(minorUnits int64) *Payment {
+		payment, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+			AccountID:     "acc_123",
+			Provider:      "stripe",
+			PaymentMethod: "credit_card",
+			Amount:        FromMinorUnits("USD", minorUnits),
+			Description:   "Payment while risk-service is down",
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return payment
+	}
+
+	// Low risk payments go ahead on the local score
+	low := create(10000)
+	if err := service.ProcessPayment(ctx, low.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if found, _ := service.GetPayment(ctx, low.ID); found.Status != "processing" {
+		t.Errorf("Expected processing, got %s", found.Status)
+	}
+
+	// High risk payments are declined rather than held with no review case
+	service.localRiskLimit = 5
+	high := create(10000)
+	if err := service.ProcessPayment(ctx, high.ID); !errors.Is(err, ErrPaymentBlocked) {
+		t.Fatalf("Expected ErrPaymentBlocked, got %v", err)
+	}
+	found, _ := service.GetPayment(ctx, high.ID)
+	if found.Status != "pending" {
+		t.Errorf("Expected the declined payment left pending to process again, got %s", found.Status)
+	}
+
+	// Once risk-service is back the payment is assessed again
+	service.SetRiskAssessor(&stubRiskAssessor{result: &RiskAssessmentResult{ID: "risk_back", Decision: "allow"}})
+	if err := service.ProcessPayment(ctx, high.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if found, _ := service.GetPayment(ctx, high.ID); found.Status != "processing" {
+		t.Errorf("Expected processing once risk-service allows it, got %s", found.Status)
+	}
+}
+
+func TestVerifyReviewSignature(t *testing.T) {
+	key := []byte("review-signing-key")
+	body := []byte(`{"review_case_id":"review_1","decision":"approve"}`)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !verifyReviewSignature(key, body, signature) {
+		t.Error("Expected signed decision to verify")
+	}
+	if verifyReviewSignature(key, []byte(`{"review_case_id":"review_1","decision":"decline"}`), signature) {
+		t.Error("Expected altered decision to fail verification")
+	}
+	if verifyReviewSignature(nil, body, signature) {
+		t.Error("Expected no decision to verify without a key")
+	}
+	if verifyReviewSignature(key, body, "") {
+		t.Error("Expected unsigned decision to fail verification")
+	}
+}
+
+// stubLimitChecker allows payments until their total reaches budget
+type stubLimitChecker struct {
+	budget   int64
+	used     map[string]int64
+	released []string
+}
+
+func (c *stubLimitChecker) Consume(ctx context.Context, req *LimitRequest) (*LimitDecision, error) {
+	if c.used == nil {
+		c.used = make(map[string]int64)
+	}
+	amount := moneyToMinorUnits(*req.Amount)
+	total := amount
+	for reference, used := range c.used {
+		if reference != req.ReferenceID {
+			total += used
+		}
+	}
+	if total > c.budget {
+		return &LimitDecision{Allowed: false, Reason: "amount exceeds daily limit"}, nil
+	}
+
+	c.used[req.ReferenceID] = amount
+	headroom := fmt.Sprintf(`{"daily_amount_minor":%d}`, c.budget-total)
+	return &LimitDecision{Allowed: true, ReservationID: "res_" + req.ReferenceID, Headroom: json.RawMessage(headroom)}, nil
+}
+
+func (c *stubLimitChecker) Release(ctx context.Context, reservationID string) error {
+	c.released = append(c.released, reservationID)
+	delete(c.used, strings.TrimPrefix(reservationID, "res_"))
+	return nil
+}
+
+func TestPaymentService_DynamicLimits(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	limits := &stubLimitChecker{budget: 15000}
+	service.SetLimitChecker(limits)
+	ctx := context.Background()
+
+	create := func(minor int64) (*Payment, error) {
+		return service.CreatePayment(ctx, &CreatePaymentRequest{
+			AccountID:     "acc_limits",
+			Provider:      "stripe",
+			PaymentMethod: "credit_card",
+			Amount:        FromMinorUnits("USD", minor),
+			Description:   "Limited payment",
+		})
+	}
+
+	payment, err := create(10000)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	headroom, ok := payment.Metadata["limit_headroom"].(json.RawMessage)
+	if !ok || string(headroom) != `{"daily_amount_minor":5000}` || payment.Metadata["limit_reservation_id"] != "res_"+payment.ID {
+		t.Fatalf("Expected 5000 of headroom and a reservation, got %v", payment.Metadata)
+	}
+
+	// Processing checks the same reservation again without using more limit
+	if err := service.ProcessPayment(ctx, payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := create(10000); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Expected ErrLimitExceeded, got %v", err)
+	}
+
+	// Cancelling gives the limit back
+	second, err := create(5000)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := service.CancelPayment(ctx, second.ID, "customer request"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(limits.released) != 1 || limits.released[0] != "res_"+second.ID {
+		t.Errorf("Expected the cancelled payment's reservation released, got %v", limits.released)
+	}
+	if _, err := create(5000); err != nil {
+		t.Errorf("Expected released limit to be available, got %v", err)
+	}
+}
+
+// stubFeeCalculator charges 1% with plan "custom", or fails when err is set
+type stubFeeCalculator struct {
+	requests []*FeeRequest
+	err      error
+}
+
+func (f *stubFeeCalculator) Calculate(ctx context.Context, req *FeeRequest) (*FeeQuote, error) {
+	f.requests = append(f.requests, req)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &FeeQuote{FeeMinor: req.AmountMinor / 100, Currency: req.Currency, PlanID: "custom", PlanVersion: 1}, nil
+}
+
+func TestPaymentService_Fees(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	fees := &stubFeeCalculator{}
+	service.SetFeeCalculator(fees)
+	ctx := context.Background()
+
+	process := func() *Payment {
+		payment, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+			AccountID:     "acc_fees",
+			Provider:      "stripe",
+			PaymentMethod: "paypal",
+			Amount:        FromMinorUnits("USD", 10000),
+			Description:   "Priced payment",
+			Metadata:      map[string]interface{}{"merchant_id": "merchant_fees", "region": "US"},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := service.ProcessPayment(ctx, payment.ID); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return payment
+	}
+
+	payment := process()
+	if err := service.CompletePayment(ctx, payment.ID, "txn_"+payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	payment, _ = service.GetPayment(ctx, payment.ID)
+	fee, _ := payment.Metadata["fees"].(Money).Value.Float64()
+	if fee != 1.0 || payment.Metadata["fee_plan"] != "custom@1" {
+		t.Errorf("Expected a 1.00 fee on plan custom@1, got %v on %v", fee, payment.Metadata["fee_plan"])
+	}
+	req := fees.requests[0]
+	if req.MerchantID != "merchant_fees" || req.TransactionID != payment.ID || req.Method != "paypal" || req.Region != "US" || req.AmountMinor != 10000 {
+		t.Errorf("Expected the merchant's payment priced by reference, got %+v", req)
+	}
+
+	// A captured payment completes while fees-service is unavailable and
+	// its fee is charged on retry
+	fees.err = errors.New("connection refused")
+	payment = process()
+	if err := service.CompletePayment(ctx, payment.ID, "txn_"+payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	payment, _ = service.GetPayment(ctx, payment.ID)
+	if payment.Status != "completed" || payment.Metadata["fees"] != nil || payment.Metadata["fees_pending"] != true {
+		t.Errorf("Expected the payment completed with its fee pending, got %s with %v", payment.Status, payment.Metadata)
+	}
+	if charged, err := service.RetryPendingFees(ctx); err != nil || charged != 0 {
+		t.Errorf("Expected no fee charged while fees-service is down, got %d and %v", charged, err)
+	}
+
+	fees.err = nil
+	if charged, err := service.RetryPendingFees(ctx); err != nil || charged != 1 {
+		t.Fatalf("Expected the pending fee charged, got %d and %v", charged, err)
+	}
+	payment, _ = service.GetPayment(ctx, payment.ID)
+	if payment.Metadata["fee_plan"] != "custom@1" || payment.Metadata["fees_pending"] != nil {
+		t.Errorf("Expected the payment priced on plan custom@1, got %v", payment.Metadata)
+	}
+	if charged, _ := service.RetryPendingFees(ctx); charged != 0 {
+		t.Errorf("Expected nothing left to charge, got %d", charged)
+	}
+}
+
+func TestPaymentService_RecordRefund(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	ctx := context.Background()
+
+	payment, err := service.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     "acc_refunds",
+		Provider:      "stripe",
+		PaymentMethod: "credit_card",
+		Amount:        FromMinorUnits("USD", 10000),
+		Description:   "Refunded payment",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := service.ProcessPayment(ctx, payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := service.CompletePayment(ctx, payment.ID, "txn_"+payment.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	partial, err := service.RecordRefund(ctx, payment.ID, "ref_1", FromMinorUnits("USD", 4000), "damaged")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if partial.Status != "partially_refunded" {
+		t.Errorf("Expected status partially_refunded, got %s", partial.Status)
+	}
+
+	// Reporting the same refund again changes nothing
+	again, err := service.RecordRefund(ctx, payment.ID, "ref_1", FromMinorUnits("USD", 4000), "damaged")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if refunds := again.Metadata["refunds"].([]interface{}); len(refunds) != 1 {
+		t.Errorf("Expected 1 refund, got %d", len(refunds))
+	}
+
+	if _, err := service.RecordRefund(ctx, payment.ID, "ref_2", FromMinorUnits("USD", 7000), "damaged"); err == nil {
+		t.Error("Expected error refunding more than was paid")
+	}
+
+	// Partial refunds adding up to the amount refund the payment
+	full, err := service.RecordRefund(ctx, payment.ID, "ref_3", FromMinorUnits("USD", 6000), "damaged")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if full.Status != "refunded" {
+		t.Errorf("Expected status refunded, got %s", full.Status)
+	}
+
+	// Metrics count refunded payments, live and rebuilt, not refunds
+	metrics, _ := service.GetPaymentMetrics(ctx, MetricsQuery{})
+	if metrics.RefundRate != 1 {
+		t.Errorf("Expected the one authorized payment refunded, got %v", metrics.RefundRate)
+	}
+	if err := service.RebuildPaymentMetrics(ctx); err != nil {
+		t.Fatalf("Failed to rebuild metrics: %v", err)
+	}
+	metrics, _ = service.GetPaymentMetrics(ctx, MetricsQuery{})
+	if metrics.RefundRate != 1 {
+		t.Errorf("Expected the one authorized payment refunded, got %v", metrics.RefundRate)
+	}
+}
+
 // Benchmark tests
 func BenchmarkPaymentService_CreatePayment(b *testing.B) {
 	repo := &MockRepository{}
@@ -0,0 +1,1192 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPlanNotFound is returned when a billing plan does not exist
+	ErrPlanNotFound = errors.New("billing plan not found")
+
+	// ErrSubscriptionNotFound is returned when a subscription does not exist
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+
+	// ErrInvoiceNotFound is returned when an invoice does not exist
+	ErrInvoiceNotFound = errors.New("invoice not found")
+)
+
+// BillingPlan is a recurring price a merchant sells
+type BillingPlan struct {
+	ID            string                 `json:"id"`
+	MerchantID    string                 `json:"merchant_id"`
+	Name          string                 `json:"name"`
+	Amount        Money                  `json:"amount"`
+	Interval      string                 `json:"interval"` // day, week, month, year
+	IntervalCount int                    `json:"interval_count"`
+	TrialDays     int                    `json:"trial_days"`
+	Active        bool                   `json:"active"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt     time.Time              `json:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+}
+
+// Subscription binds a customer's saved payment token to a plan
+type Subscription struct {
+	ID                 string                 `json:"id"`
+	MerchantID         string                 `json:"merchant_id"`
+	AccountID          string                 `json:"account_id"`
+	PlanID             string                 `json:"plan_id"`
+	Provider           string                 `json:"provider"`
+	PaymentMethod      string                 `json:"payment_method"`
+	PaymentToken       string                 `json:"payment_token"`
+	Status             string                 `json:"status"` // trialing, active, past_due, unpaid, cancelled
+	CurrentPeriodStart time.Time              `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time              `json:"current_period_end"`
+	TrialEnd           *time.Time             `json:"trial_end,omitempty"`
+	CancelAtPeriodEnd  bool                   `json:"cancel_at_period_end"`
+	CancelledAt        *time.Time             `json:"cancelled_at,omitempty"`
+	CreditBalance      Money                  `json:"credit_balance"`
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt          time.Time              `json:"created_at"`
+	UpdatedAt          time.Time              `json:"updated_at"`
+}
+
+// InvoiceLineItem is a single charge or credit on an invoice
+type InvoiceLineItem struct {
+	Description string    `json:"description"`
+	Amount      Money     `json:"amount"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Proration   bool      `json:"proration"`
+}
+
+// Invoice is a bill for one subscription period or plan change
+type Invoice struct {
+	ID                string            `json:"id"`
+	SubscriptionID    string            `json:"subscription_id"`
+	MerchantID        string            `json:"merchant_id"`
+	AccountID         string            `json:"account_id"`
+	LineItems         []InvoiceLineItem `json:"line_items"`
+	Total             Money             `json:"total"`
+	Status            string            `json:"status"` // open, paid, uncollectible, void
+	PaymentID         string            `json:"payment_id,omitempty"`
+	AttemptCount      int               `json:"attempt_count"`
+	NextAttemptAt     *time.Time        `json:"next_attempt_at,omitempty"`
+	LastFailureReason string            `json:"last_failure_reason,omitempty"`
+	PeriodStart       time.Time         `json:"period_start"`
+	PeriodEnd         time.Time         `json:"period_end"`
+	PaidAt            *time.Time        `json:"paid_at,omitempty"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+}
+
+// CreatePlanRequest represents a request to create a billing plan
+type CreatePlanRequest struct {
+	MerchantID    string                 `json:"merchant_id"`
+	Name          string                 `json:"name"`
+	Amount        Money                  `json:"amount"`
+	Interval      string                 `json:"interval"`
+	IntervalCount int                    `json:"interval_count"`
+	TrialDays     int                    `json:"trial_days"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// CreateSubscriptionRequest represents a request to subscribe to a plan
+type CreateSubscriptionRequest struct {
+	AccountID     string                 `json:"account_id"`
+	PlanID        string                 `json:"plan_id"`
+	Provider      string                 `json:"provider"`
+	PaymentMethod string                 `json:"payment_method"`
+	PaymentToken  string                 `json:"payment_token"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// SubscriptionFilters represents filters for listing subscriptions
+type SubscriptionFilters struct {
+	MerchantID string `json:"merchant_id"`
+	AccountID  string `json:"account_id"`
+	Status     string `json:"status"`
+}
+
+// BillingRunResult summarises a scheduled billing run
+type BillingRunResult struct {
+	Renewed   int `json:"renewed"`
+	Retried   int `json:"retried"`
+	Cancelled int `json:"cancelled"`
+	Failed    int `json:"failed"`
+}
+
+// DunningPolicy decides how failed subscription charges are retried
+type DunningPolicy struct {
+	// RetrySchedule is the delay before each retry, measured from the
+	// previous failure. Its length is the maximum number of retries, and
+	// RetryPayment allows invoice payments the same number.
+	RetrySchedule []time.Duration
+	// FinalStatus is the subscription status once retries are exhausted
+	FinalStatus string
+}
+
+// DefaultDunningPolicy returns the default dunning policy
+func DefaultDunningPolicy() DunningPolicy {
+	return DunningPolicy{
+		RetrySchedule: []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 5 * 24 * time.Hour},
+		FinalStatus:   "unpaid",
+	}
+}
+
+// SubscriptionRepository interface for subscription data access
+type SubscriptionRepository interface {
+	CreatePlan(ctx context.Context, plan *BillingPlan) error
+	GetPlan(ctx context.Context, id string) (*BillingPlan, error)
+	ListPlans(ctx context.Context, merchantID string) ([]*BillingPlan, error)
+	CreateSubscription(ctx context.Context, subscription *Subscription) error
+	GetSubscription(ctx context.Context, id string) (*Subscription, error)
+	UpdateSubscription(ctx context.Context, subscription *Subscription) error
+	ListSubscriptions(ctx context.Context, filters SubscriptionFilters) ([]*Subscription, error)
+	CreateInvoice(ctx context.Context, invoice *Invoice) error
+	GetInvoice(ctx context.Context, id string) (*Invoice, error)
+	UpdateInvoice(ctx context.Context, invoice *Invoice) error
+	ListInvoices(ctx context.Context, subscriptionID string) ([]*Invoice, error)
+	ListOpenInvoices(ctx context.Context) ([]*Invoice, error)
+}
+
+// SubscriptionBilling runs recurring billing on top of the payment service
+type SubscriptionBilling struct {
+	payments *Service
+	repo     SubscriptionRepository
+	policy   DunningPolicy
+	now      func() time.Time
+}
+
+// NewSubscriptionBilling creates a new subscription billing engine
+func NewSubscriptionBilling(payments *Service, repo SubscriptionRepository, policy DunningPolicy) *SubscriptionBilling {
+	return &SubscriptionBilling{
+		payments: payments,
+		repo:     repo,
+		policy:   policy,
+		now:      time.Now,
+	}
+}
+
+// SetSubscriptionBilling connects payment outcomes to subscription billing
+func (s *Service) SetSubscriptionBilling(billing *SubscriptionBilling) {
+	s.billing = billing
+}
+
+// CreatePlan creates a new billing plan
+func (b *SubscriptionBilling) CreatePlan(ctx context.Context, req *CreatePlanRequest) (*BillingPlan, error) {
+	if err := ValidateCreatePlanRequest(req); err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+
+	intervalCount := req.IntervalCount
+	if intervalCount == 0 {
+		intervalCount = 1
+	}
+
+	now := b.now()
+	plan := &BillingPlan{
+		ID:            newBillingID("plan"),
+		MerchantID:    req.MerchantID,
+		Name:          req.Name,
+		Amount:        req.Amount,
+		Interval:      req.Interval,
+		IntervalCount: intervalCount,
+		TrialDays:     req.TrialDays,
+		Active:        true,
+		Metadata:      req.Metadata,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	if err := b.repo.CreatePlan(ctx, plan); err != nil {
+		return nil, fmt.Errorf("failed to create plan: %w", err)
+	}
+
+	return plan, nil
+}
+
+// ListPlans lists a merchant's billing plans
+func (b *SubscriptionBilling) ListPlans(ctx context.Context, merchantID string) ([]*BillingPlan, error) {
+	return b.repo.ListPlans(ctx, merchantID)
+}
+
+// Subscribe starts a subscription. Plans with a trial start in "trialing"
+// and are first charged when the trial ends; others are charged immediately.
+func (b *SubscriptionBilling) Subscribe(ctx context.Context, req *CreateSubscriptionRequest) (*Subscription, error) {
+	if err := ValidateCreateSubscriptionRequest(req); err != nil {
+		return nil, fmt.Errorf("validation failed: %w", err)
+	}
+
+	plan, err := b.repo.GetPlan(ctx, req.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	if !plan.Active {
+		return nil, errors.New("plan is not active")
+	}
+
+	// Recurring charges are only ever made against a saved token
+	card, err := b.payments.GetCardToken(ctx, req.PaymentToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment token: %w", err)
+	}
+	if card.AccountID != req.AccountID {
+		return nil, errors.New("payment token does not belong to account")
+	}
+
+	now := b.now()
+	subscription := &Subscription{
+		ID:            newBillingID("sub"),
+		MerchantID:    plan.MerchantID,
+		AccountID:     req.AccountID,
+		PlanID:        plan.ID,
+		Provider:      req.Provider,
+		PaymentMethod: req.PaymentMethod,
+		PaymentToken:  req.PaymentToken,
+		CreditBalance: zeroMoney(plan.Amount.Currency),
+		Metadata:      req.Metadata,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	if plan.TrialDays > 0 {
+		trialEnd := now.AddDate(0, 0, plan.TrialDays)
+		subscription.Status = "trialing"
+		subscription.TrialEnd = &trialEnd
+		subscription.CurrentPeriodStart = now
+		subscription.CurrentPeriodEnd = trialEnd
+	} else {
+		subscription.Status = "active"
+		subscription.CurrentPeriodStart = now
+		subscription.CurrentPeriodEnd = addBillingInterval(now, plan.Interval, plan.IntervalCount)
+	}
+
+	if err := b.repo.CreateSubscription(ctx, subscription); err != nil {
+		return nil, fmt.Errorf("failed to create subscription: %w", err)
+	}
+
+	b.payments.publishEvent(ctx, "subscription.created", subscription.ID, subscriptionEventData(subscription))
+
+	if subscription.Status == "active" {
+		if err := b.invoicePeriod(ctx, subscription, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	return subscription, nil
+}
+
+// GetSubscription retrieves a subscription by ID
+func (b *SubscriptionBilling) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	return b.repo.GetSubscription(ctx, id)
+}
+
+// ListSubscriptions lists subscriptions with filters
+func (b *SubscriptionBilling) ListSubscriptions(ctx context.Context, filters SubscriptionFilters) ([]*Subscription, error) {
+	return b.repo.ListSubscriptions(ctx, filters)
+}
+
+// ListInvoices lists the invoices of a subscription
+func (b *SubscriptionBilling) ListInvoices(ctx context.Context, subscriptionID string) ([]*Invoice, error) {
+	return b.repo.ListInvoices(ctx, subscriptionID)
+}
+
+// CancelSubscription cancels a subscription immediately or at period end
+func (b *SubscriptionBilling) CancelSubscription(ctx context.Context, id string, atPeriodEnd bool) (*Subscription, error) {
+	subscription, err := b.repo.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if subscription.Status == "cancelled" {
+		return nil, errors.New("subscription is already cancelled")
+	}
+
+	if atPeriodEnd {
+		subscription.CancelAtPeriodEnd = true
+		subscription.UpdatedAt = b.now()
+		if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+			return nil, fmt.Errorf("failed to update subscription: %w", err)
+		}
+		b.payments.publishEvent(ctx, "subscription.updated", subscription.ID, subscriptionEventData(subscription))
+		return subscription, nil
+	}
+
+	if err := b.cancel(ctx, subscription, "requested"); err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// ChangePlan moves a subscription to another plan. Active subscriptions are
+// prorated: unused time on the old plan is credited and the remaining time
+// on the new plan is charged straight away. A net credit is carried to the
+// next invoice.
+func (b *SubscriptionBilling) ChangePlan(ctx context.Context, id, planID string) (*Subscription, error) {
+	subscription, err := b.repo.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if subscription.Status != "active" && subscription.Status != "trialing" {
+		return nil, fmt.Errorf("plan change not allowed for subscription in status '%s'", subscription.Status)
+	}
+
+	if subscription.PlanID == planID {
+		return nil, errors.New("subscription is already on this plan")
+	}
+
+	oldPlan, err := b.repo.GetPlan(ctx, subscription.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	newPlan, err := b.repo.GetPlan(ctx, planID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !newPlan.Active {
+		return nil, errors.New("plan is not active")
+	}
+	if newPlan.MerchantID != oldPlan.MerchantID {
+		return nil, errors.New("cannot change to another merchant's plan")
+	}
+	if newPlan.Amount.Currency != oldPlan.Amount.Currency {
+		return nil, errors.New("cannot change to a plan in another currency")
+	}
+
+	now := b.now()
+	subscription.PlanID = newPlan.ID
+	subscription.UpdatedAt = now
+
+	// Trials carry no charges so there is nothing to prorate
+	if subscription.Status == "trialing" {
+		if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+			return nil, fmt.Errorf("failed to update subscription: %w", err)
+		}
+		b.payments.publishEvent(ctx, "subscription.plan_changed", subscription.ID, subscriptionEventData(subscription))
+		return subscription, nil
+	}
+
+	remaining, period := remainingPeriod(subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd, now)
+	currency := newPlan.Amount.Currency
+	credit := negateMoney(scaleMoney(oldPlan.Amount, int64(remaining), int64(period)))
+	charge := scaleMoney(newPlan.Amount, int64(remaining), int64(period))
+
+	invoice := &Invoice{
+		ID:             newBillingID("inv"),
+		SubscriptionID: subscription.ID,
+		MerchantID:     subscription.MerchantID,
+		AccountID:      subscription.AccountID,
+		LineItems: []InvoiceLineItem{
+			{
+				Description: fmt.Sprintf("Unused time on %s", oldPlan.Name),
+				Amount:      credit,
+				PeriodStart: now,
+				PeriodEnd:   subscription.CurrentPeriodEnd,
+				Proration:   true,
+			},
+			{
+				Description: fmt.Sprintf("Remaining time on %s", newPlan.Name),
+				Amount:      charge,
+				PeriodStart: now,
+				PeriodEnd:   subscription.CurrentPeriodEnd,
+				Proration:   true,
+			},
+		},
+		Status:      "open",
+		PeriodStart: now,
+		PeriodEnd:   subscription.CurrentPeriodEnd,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	net := addMoney(credit, charge)
+	if net.Value.Sign() < 0 {
+		// Downgrades leave a credit that is applied to the next invoice
+		subscription.CreditBalance = addMoney(subscription.CreditBalance, negateMoney(net))
+		invoice.Total = zeroMoney(currency)
+	} else {
+		invoice.Total = net
+	}
+
+	if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	if err := b.repo.CreateInvoice(ctx, invoice); err != nil {
+		return nil, fmt.Errorf("failed to create invoice: %w", err)
+	}
+
+	b.payments.publishEvent(ctx, "subscription.plan_changed", subscription.ID, subscriptionEventData(subscription))
+	b.payments.publishEvent(ctx, "invoice.created", invoice.ID, invoiceEventData(invoice))
+
+	if err := b.chargeInvoice(ctx, subscription, invoice); err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// RunBillingCycle renews subscriptions whose period has ended and retries
+// failed invoices whose next attempt is due. It is safe to run repeatedly.
+func (b *SubscriptionBilling) RunBillingCycle(ctx context.Context) (*BillingRunResult, error) {
+	result := &BillingRunResult{}
+	now := b.now()
+
+	subscriptions, err := b.repo.ListSubscriptions(ctx, SubscriptionFilters{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+
+	for _, subscription := range subscriptions {
+		if subscription.CurrentPeriodEnd.After(now) {
+			continue
+		}
+
+		if subscription.Status != "active" && subscription.Status != "trialing" {
+			continue
+		}
+
+		if subscription.CancelAtPeriodEnd {
+			if err := b.cancel(ctx, subscription, "period_end"); err != nil {
+				return result, err
+			}
+			result.Cancelled++
+			continue
+		}
+
+		if err := b.renew(ctx, subscription); err != nil {
+			result.Failed++
+			continue
+		}
+		result.Renewed++
+	}
+
+	invoices, err := b.repo.ListOpenInvoices(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list open invoices: %w", err)
+	}
+
+	for _, invoice := range invoices {
+		if invoice.NextAttemptAt == nil || invoice.NextAttemptAt.After(now) {
+			continue
+		}
+
+		subscription, err := b.repo.GetSubscription(ctx, invoice.SubscriptionID)
+		if err != nil {
+			result.Failed++
+			continue
+		}
+
+		if err := b.retryInvoice(ctx, subscription, invoice); err != nil {
+			result.Failed++
+			continue
+		}
+		result.Retried++
+	}
+
+	return result, nil
+}
+
+// renew advances a subscription to its next period and invoices it
+func (b *SubscriptionBilling) renew(ctx context.Context, subscription *Subscription) error {
+	plan, err := b.repo.GetPlan(ctx, subscription.PlanID)
+	if err != nil {
+		return err
+	}
+
+	wasTrialing := subscription.Status == "trialing"
+
+	subscription.CurrentPeriodStart = subscription.CurrentPeriodEnd
+	subscription.CurrentPeriodEnd = addBillingInterval(subscription.CurrentPeriodStart, plan.Interval, plan.IntervalCount)
+	subscription.Status = "active"
+	subscription.UpdatedAt = b.now()
+
+	if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	if wasTrialing {
+		b.payments.publishEvent(ctx, "subscription.trial_ended", subscription.ID, subscriptionEventData(subscription))
+	} else {
+		b.payments.publishEvent(ctx, "subscription.renewed", subscription.ID, subscriptionEventData(subscription))
+	}
+
+	return b.invoicePeriod(ctx, subscription, plan)
+}
+
+// invoicePeriod creates and charges the invoice for the current period,
+// applying any credit balance left by earlier downgrades
+func (b *SubscriptionBilling) invoicePeriod(ctx context.Context, subscription *Subscription, plan *BillingPlan) error {
+	now := b.now()
+	invoice := &Invoice{
+		ID:             newBillingID("inv"),
+		SubscriptionID: subscription.ID,
+		MerchantID:     subscription.MerchantID,
+		AccountID:      subscription.AccountID,
+		LineItems: []InvoiceLineItem{
+			{
+				Description: plan.Name,
+				Amount:      plan.Amount,
+				PeriodStart: subscription.CurrentPeriodStart,
+				PeriodEnd:   subscription.CurrentPeriodEnd,
+			},
+		},
+		Total:       plan.Amount,
+		Status:      "open",
+		PeriodStart: subscription.CurrentPeriodStart,
+		PeriodEnd:   subscription.CurrentPeriodEnd,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if subscription.CreditBalance.Value != nil && subscription.CreditBalance.Value.Sign() > 0 {
+		applied := subscription.CreditBalance
+		if applied.Value.Cmp(plan.Amount.Value) > 0 {
+			applied = plan.Amount
+		}
+
+		invoice.LineItems = append(invoice.LineItems, InvoiceLineItem{
+			Description: "Applied credit balance",
+			Amount:      negateMoney(applied),
+			PeriodStart: subscription.CurrentPeriodStart,
+			PeriodEnd:   subscription.CurrentPeriodEnd,
+		})
+		invoice.Total = addMoney(plan.Amount, negateMoney(applied))
+		subscription.CreditBalance = addMoney(subscription.CreditBalance, negateMoney(applied))
+
+		if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+			return fmt.Errorf("failed to update subscription: %w", err)
+		}
+	}
+
+	if err := b.repo.CreateInvoice(ctx, invoice); err != nil {
+		return fmt.Errorf("failed to create invoice: %w", err)
+	}
+
+	b.payments.publishEvent(ctx, "invoice.created", invoice.ID, invoiceEventData(invoice))
+
+	return b.chargeInvoice(ctx, subscription, invoice)
+}
+
+// chargeInvoice creates a payment against the subscription's saved token and
+// submits it for processing. The outcome arrives later through
+// CompletePayment or FailPayment.
+func (b *SubscriptionBilling) chargeInvoice(ctx context.Context, subscription *Subscription, invoice *Invoice) error {
+	if invoice.Total.Value.Sign() == 0 {
+		return b.markInvoicePaid(ctx, subscription, invoice)
+	}
+
+	invoice.AttemptCount++
+	invoice.NextAttemptAt = nil
+	invoice.UpdatedAt = b.now()
+
+	payment, err := b.payments.CreatePayment(ctx, &CreatePaymentRequest{
+		AccountID:     subscription.AccountID,
+		Provider:      subscription.Provider,
+		PaymentMethod: subscription.PaymentMethod,
+		Amount:        invoice.Total,
+		Description:   fmt.Sprintf("Subscription %s invoice %s", subscription.ID, invoice.ID),
+		PaymentToken:  subscription.PaymentToken,
+		Metadata: map[string]interface{}{
+			"invoice_id":      invoice.ID,
+			"subscription_id": subscription.ID,
+		},
+	})
+	if err != nil {
+		return b.handleChargeFailure(ctx, subscription, invoice, err.Error())
+	}
+
+	invoice.PaymentID = payment.ID
+	if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+
+	if err := b.payments.ProcessPayment(ctx, payment.ID); err != nil {
+		return b.abandonCharge(ctx, subscription, invoice, err.Error())
+	}
+
+	return nil
+}
+
+// retryInvoice makes the next dunning attempt on an open invoice. A failed
+// payment is retried in place; a new payment is only created when the last
+// one was cancelled before reaching the provider.
+func (b *SubscriptionBilling) retryInvoice(ctx context.Context, subscription *Subscription, invoice *Invoice) error {
+	if invoice.PaymentID == "" {
+		return b.chargeInvoice(ctx, subscription, invoice)
+	}
+
+	payment, err := b.payments.GetPayment(ctx, invoice.PaymentID)
+	if err != nil {
+		return fmt.Errorf("failed to get invoice payment: %w", err)
+	}
+
+	invoice.NextAttemptAt = nil
+	invoice.UpdatedAt = b.now()
+
+	switch payment.Status {
+	case "failed":
+	case "cancelled":
+		return b.chargeInvoice(ctx, subscription, invoice)
+	default:
+		// The last attempt is still in flight; its outcome reschedules dunning
+		if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+			return fmt.Errorf("failed to update invoice: %w", err)
+		}
+		return nil
+	}
+
+	invoice.AttemptCount++
+	if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+
+	if err := b.payments.RetryPayment(ctx, invoice.PaymentID); err != nil {
+		return b.abandonCharge(ctx, subscription, invoice, err.Error())
+	}
+
+	return nil
+}
+
+// abandonCharge applies the dunning policy to a charge that could not be
+// submitted. A payment left pending or processing is cancelled first so the
+// next attempt does not leave it behind.
+func (b *SubscriptionBilling) abandonCharge(ctx context.Context, subscription *Subscription, invoice *Invoice, reason string) error {
+	payment, err := b.payments.GetPayment(ctx, invoice.PaymentID)
+	if err != nil {
+		return fmt.Errorf("failed to get invoice payment: %w", err)
+	}
+
+	if payment.Status == "pending" || payment.Status == "processing" {
+		if err := b.payments.CancelPayment(ctx, payment.ID, reason); err != nil {
+			return fmt.Errorf("failed to cancel invoice payment: %w", err)
+		}
+	}
+
+	return b.handleChargeFailure(ctx, subscription, invoice, reason)
+}
+
+// handlePaymentCompleted settles the invoice a completed payment was for
+func (b *SubscriptionBilling) handlePaymentCompleted(ctx context.Context, payment *Payment) error {
+	invoice, subscription, err := b.invoiceForPayment(ctx, payment)
+	if err != nil || invoice == nil {
+		return err
+	}
+
+	return b.markInvoicePaid(ctx, subscription, invoice)
+}
+
+// handlePaymentFailed applies the dunning policy to a failed invoice payment
+func (b *SubscriptionBilling) handlePaymentFailed(ctx context.Context, payment *Payment, reason string) error {
+	invoice, subscription, err := b.invoiceForPayment(ctx, payment)
+	if err != nil || invoice == nil {
+		return err
+	}
+
+	return b.handleChargeFailure(ctx, subscription, invoice, reason)
+}
+
+// invoiceForPayment finds the invoice and subscription a payment belongs to
+func (b *SubscriptionBilling) invoiceForPayment(ctx context.Context, payment *Payment) (*Invoice, *Subscription, error) {
+	invoiceID, ok := payment.Metadata["invoice_id"].(string)
+	if !ok || invoiceID == "" {
+		return nil, nil, nil
+	}
+
+	invoice, err := b.repo.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subscription, err := b.repo.GetSubscription(ctx, invoice.SubscriptionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return invoice, subscription, nil
+}
+
+// markInvoicePaid closes an invoice and restores a past-due subscription
+func (b *SubscriptionBilling) markInvoicePaid(ctx context.Context, subscription *Subscription, invoice *Invoice) error {
+	now := b.now()
+	invoice.Status = "paid"
+	invoice.PaidAt = &now
+	invoice.NextAttemptAt = nil
+	invoice.UpdatedAt = now
+
+	if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+
+	b.payments.publishEvent(ctx, "invoice.paid", invoice.ID, invoiceEventData(invoice))
+
+	if subscription.Status == "past_due" {
+		subscription.Status = "active"
+		subscription.UpdatedAt = now
+		if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+			return fmt.Errorf("failed to update subscription: %w", err)
+		}
+		b.payments.publishEvent(ctx, "subscription.recovered", subscription.ID, subscriptionEventData(subscription))
+	}
+
+	return nil
+}
+
+// handleChargeFailure schedules the next dunning attempt, or gives up when
+// the decline cannot succeed on retry or the schedule is exhausted
+func (b *SubscriptionBilling) handleChargeFailure(ctx context.Context, subscription *Subscription, invoice *Invoice, reason string) error {
+	now := b.now()
+	invoice.LastFailureReason = reason
+	invoice.UpdatedAt = now
+
+	b.payments.publishEvent(ctx, "invoice.payment_failed", invoice.ID, invoiceEventData(invoice))
+
+	retriesUsed := invoice.AttemptCount - 1
+	if isRetryableChargeFailure(reason) && retriesUsed < len(b.policy.RetrySchedule) {
+		next := now.Add(b.policy.RetrySchedule[retriesUsed])
+		invoice.NextAttemptAt = &next
+		if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+			return fmt.Errorf("failed to update invoice: %w", err)
+		}
+
+		if subscription.Status != "past_due" {
+			subscription.Status = "past_due"
+			subscription.UpdatedAt = now
+			if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+				return fmt.Errorf("failed to update subscription: %w", err)
+			}
+			b.payments.publishEvent(ctx, "subscription.past_due", subscription.ID, subscriptionEventData(subscription))
+		}
+		return nil
+	}
+
+	invoice.Status = "uncollectible"
+	invoice.NextAttemptAt = nil
+	if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+		return fmt.Errorf("failed to update invoice: %w", err)
+	}
+
+	if b.policy.FinalStatus == "cancelled" {
+		return b.cancel(ctx, subscription, "dunning_exhausted")
+	}
+
+	subscription.Status = "unpaid"
+	subscription.UpdatedAt = now
+	if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+	b.payments.publishEvent(ctx, "subscription.unpaid", subscription.ID, subscriptionEventData(subscription))
+
+	return nil
+}
+
+// cancel ends a subscription and voids its open invoices
+func (b *SubscriptionBilling) cancel(ctx context.Context, subscription *Subscription, reason string) error {
+	now := b.now()
+	subscription.Status = "cancelled"
+	subscription.CancelledAt = &now
+	subscription.UpdatedAt = now
+	if subscription.Metadata == nil {
+		subscription.Metadata = make(map[string]interface{})
+	}
+	subscription.Metadata["cancellation_reason"] = reason
+
+	if err := b.repo.UpdateSubscription(ctx, subscription); err != nil {
+		return fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	invoices, err := b.repo.ListInvoices(ctx, subscription.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list invoices: %w", err)
+	}
+
+	for _, invoice := range invoices {
+		if invoice.Status != "open" {
+			continue
+		}
+		invoice.Status = "void"
+		invoice.NextAttemptAt = nil
+		invoice.UpdatedAt = now
+		if err := b.repo.UpdateInvoice(ctx, invoice); err != nil {
+			return fmt.Errorf("failed to update invoice: %w", err)
+		}
+	}
+
+	b.payments.publishEvent(ctx, "subscription.cancelled", subscription.ID, subscriptionEventData(subscription))
+	return nil
+}
+
+// isRetryableChargeFailure reports whether a failed charge may succeed if
+// retried. Hard declines, such as a stolen card, and requests we rejected
+// ourselves go straight to the final dunning status.
+func isRetryableChargeFailure(reason string) bool {
+	if strings.Contains(reason, "validation failed") || strings.Contains(reason, "invalid payment token") {
+		return false
+	}
+
+	return ClassifyDecline(reason).Category == DeclineSoft
+}
+
+// ValidateCreatePlanRequest validates plan creation request
+func ValidateCreatePlanRequest(req *CreatePlanRequest) error {
+	if req == nil {
+		return errors.New("plan request cannot be nil")
+	}
+
+	if strings.TrimSpace(req.MerchantID) == "" {
+		return errors.New("merchant ID cannot be empty")
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.New("plan name cannot be empty")
+	}
+
+	validator := NewPaymentValidator()
+	if err := validator.ValidateAmount(req.Amount); err != nil {
+		return fmt.Errorf("invalid amount: %w", err)
+	}
+
+	if err := validator.ValidateCurrency(req.Amount.Currency); err != nil {
+		return fmt.Errorf("invalid currency: %w", err)
+	}
+
+	validIntervals := map[string]bool{
+		"day":   true,
+		"week":  true,
+		"month": true,
+		"year":  true,
+	}
+
+	if !validIntervals[req.Interval] {
+		return fmt.Errorf("unsupported billing interval: %s", req.Interval)
+	}
+
+	if req.IntervalCount < 0 || req.IntervalCount > 12 {
+		return errors.New("interval count must be between 1 and 12")
+	}
+
+	if req.TrialDays < 0 || req.TrialDays > 365 {
+		return errors.New("trial days must be between 0 and 365")
+	}
+
+	return nil
+}
+
+// ValidateCreateSubscriptionRequest validates subscription creation request
+func ValidateCreateSubscriptionRequest(req *CreateSubscriptionRequest) error {
+	if req == nil {
+		return errors.New("subscription request cannot be nil")
+	}
+
+	if strings.TrimSpace(req.AccountID) == "" {
+		return errors.New("account ID cannot be empty")
+	}
+
+	if strings.TrimSpace(req.PlanID) == "" {
+		return errors.New("plan ID cannot be empty")
+	}
+
+	if req.PaymentToken == "" {
+		return errors.New("subscriptions require a saved payment token")
+	}
+
+	validator := NewPaymentValidator()
+	if err := validator.ValidateProvider(req.Provider); err != nil {
+		return fmt.Errorf("invalid provider: %w", err)
+	}
+
+	if err := validator.ValidatePaymentMethod(req.PaymentMethod); err != nil {
+		return fmt.Errorf("invalid payment method: %w", err)
+	}
+
+	return nil
+}
+
+// InMemorySubscriptionRepository implements SubscriptionRepository in memory
+type InMemorySubscriptionRepository struct {
+	mu            sync.RWMutex
+	plans         map[string]*BillingPlan
+	subscriptions map[string]*Subscription
+	invoices      map[string]*Invoice
+}
+
+// NewInMemorySubscriptionRepository creates a new in-memory subscription repository
+func NewInMemorySubscriptionRepository() *InMemorySubscriptionRepository {
+	return &InMemorySubscriptionRepository{
+		plans:         make(map[string]*BillingPlan),
+		subscriptions: make(map[string]*Subscription),
+		invoices:      make(map[string]*Invoice),
+	}
+}
+
+func (r *InMemorySubscriptionRepository) CreatePlan(ctx context.Context, plan *BillingPlan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *plan
+	r.plans[plan.ID] = &stored
+	return nil
+}
+
+func (r *InMemorySubscriptionRepository) GetPlan(ctx context.Context, id string) (*BillingPlan, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	plan, exists := r.plans[id]
+	if !exists {
+		return nil, ErrPlanNotFound
+	}
+	result := *plan
+	return &result, nil
+}
+
+func (r *InMemorySubscriptionRepository) ListPlans(ctx context.Context, merchantID string) ([]*BillingPlan, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	plans := []*BillingPlan{}
+	for _, plan := range r.plans {
+		if merchantID != "" && plan.MerchantID != merchantID {
+			continue
+		}
+		result := *plan
+		plans = append(plans, &result)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].CreatedAt.Before(plans[j].CreatedAt) })
+	return plans, nil
+}
+
+func (r *InMemorySubscriptionRepository) CreateSubscription(ctx context.Context, subscription *Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *subscription
+	r.subscriptions[subscription.ID] = &stored
+	return nil
+}
+
+func (r *InMemorySubscriptionRepository) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subscription, exists := r.subscriptions[id]
+	if !exists {
+		return nil, ErrSubscriptionNotFound
+	}
+	result := *subscription
+	return &result, nil
+}
+
+func (r *InMemorySubscriptionRepository) UpdateSubscription(ctx context.Context, subscription *Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.subscriptions[subscription.ID]; !exists {
+		return ErrSubscriptionNotFound
+	}
+	stored := *subscription
+	r.subscriptions[subscription.ID] = &stored
+	return nil
+}
+
+func (r *InMemorySubscriptionRepository) ListSubscriptions(ctx context.Context, filters SubscriptionFilters) ([]*Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subscriptions := []*Subscription{}
+	for _, subscription := range r.subscriptions {
+		if filters.MerchantID != "" && subscription.MerchantID != filters.MerchantID {
+			continue
+		}
+		if filters.AccountID != "" && subscription.AccountID != filters.AccountID {
+			continue
+		}
+		if filters.Status != "" && subscription.Status != filters.Status {
+			continue
+		}
+		result := *subscription
+		subscriptions = append(subscriptions, &result)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt) })
+	return subscriptions, nil
+}
+
+func (r *InMemorySubscriptionRepository) CreateInvoice(ctx context.Context, invoice *Invoice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *invoice
+	r.invoices[invoice.ID] = &stored
+	return nil
+}
+
+func (r *InMemorySubscriptionRepository) GetInvoice(ctx context.Context, id string) (*Invoice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	invoice, exists := r.invoices[id]
+	if !exists {
+		return nil, ErrInvoiceNotFound
+	}
+	result := *invoice
+	return &result, nil
+}
+
+func (r *InMemorySubscriptionRepository) UpdateInvoice(ctx context.Context, invoice *Invoice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.invoices[invoice.ID]; !exists {
+		return ErrInvoiceNotFound
+	}
+	stored := *invoice
+	r.invoices[invoice.ID] = &stored
+	return nil
+}
+
+func (r *InMemorySubscriptionRepository) ListInvoices(ctx context.Context, subscriptionID string) ([]*Invoice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	invoices := []*Invoice{}
+	for _, invoice := range r.invoices {
+		if invoice.SubscriptionID != subscriptionID {
+			continue
+		}
+		result := *invoice
+		invoices = append(invoices, &result)
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].CreatedAt.Before(invoices[j].CreatedAt) })
+	return invoices, nil
+}
+
+func (r *InMemorySubscriptionRepository) ListOpenInvoices(ctx context.Context) ([]*Invoice, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	invoices := []*Invoice{}
+	for _, invoice := range r.invoices {
+		if invoice.Status != "open" {
+			continue
+		}
+		result := *invoice
+		invoices = append(invoices, &result)
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].CreatedAt.Before(invoices[j].CreatedAt) })
+	return invoices, nil
+}
+
+// Helper functions
+
+// newBillingID returns a unique ID. A random suffix is added because billing
+// runs create many records within the same clock tick.
+func newBillingID(prefix string) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s_%d%s", prefix, time.Now().UnixNano(), hex.EncodeToString(suffix))
+}
+
+func addBillingInterval(t time.Time, interval string, count int) time.Time {
+	if count <= 0 {
+		count = 1
+	}
+
+	switch interval {
+	case "day":
+		return t.AddDate(0, 0, count)
+	case "week":
+		return t.AddDate(0, 0, 7*count)
+	case "year":
+		return t.AddDate(count, 0, 0)
+	default:
+		return t.AddDate(0, count, 0)
+	}
+}
+
+// remainingPeriod returns how much of a period is left at now and how long
+// the period is. A period with nothing left reports 0 of 1.
+func remainingPeriod(start, end, now time.Time) (time.Duration, time.Duration) {
+	total := end.Sub(start)
+	if total <= 0 || !now.Before(end) {
+		return 0, 1
+	}
+	if now.Before(start) {
+		return total, total
+	}
+	return end.Sub(now), total
+}
+
+// scaleMoney multiplies an amount by numerator/denominator in whole minor
+// units of its currency, rounding half away from zero. The denominator must
+// be positive.
+func scaleMoney(amount Money, numerator, denominator int64) Money {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(amount.Currency))), nil)
+
+	minor := new(big.Float).Mul(amount.Value, new(big.Float).SetInt(scale))
+	minorUnits := roundHalfAway(minor)
+	minorUnits.Mul(minorUnits, big.NewInt(numerator))
+
+	// QuoRem truncates towards zero, so the remainder decides the rounding
+	den := big.NewInt(denominator)
+	quo, rem := new(big.Int).QuoRem(minorUnits, den, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(int64(rem.Sign())))
+	}
+
+	value := new(big.Float).Quo(new(big.Float).SetInt(quo), new(big.Float).SetInt(scale))
+	return Money{Value: value, Currency: amount.Currency}
+}
+
+// roundHalfAway rounds a value to the nearest integer, halves away from zero
+func roundHalfAway(value *big.Float) *big.Int {
+	rounded := new(big.Float).Copy(value)
+	if rounded.Sign() < 0 {
+		rounded.Sub(rounded, big.NewFloat(0.5))
+	} else {
+		rounded.Add(rounded, big.NewFloat(0.5))
+	}
+	result, _ := rounded.Int(nil)
+	return result
+}
+
+func addMoney(a, b Money) Money {
+	sum := new(big.Float)
+	sum.Add(a.Value, b.Value)
+	return Money{Value: sum, Currency: a.Currency}
+}
+
+func negateMoney(amount Money) Money {
+	return Money{Value: new(big.Float).Neg(amount.Value), Currency: amount.Currency}
+}
+
+func zeroMoney(currency string) Money {
+	return Money{Value: big.NewFloat(0), Currency: currency}
+}
+
+func subscriptionEventData(subscription *Subscription) map[string]interface{} {
+	return map[string]interface{}{
+		"subscription_id":      subscription.ID,
+		"merchant_id":          subscription.MerchantID,
+		"account_id":           subscription.AccountID,
+		"plan_id":              subscription.PlanID,
+		"status":               subscription.Status,
+		"current_period_start": subscription.CurrentPeriodStart,
+		"current_period_end":   subscription.CurrentPeriodEnd,
+	}
+}
+
+func invoiceEventData(invoice *Invoice) map[string]interface{} {
+	return map[string]interface{}{
+		"invoice_id":      invoice.ID,
+		"subscription_id": invoice.SubscriptionID,
+		"merchant_id":     invoice.MerchantID,
+		"account_id":      invoice.AccountID,
+		"status":          invoice.Status,
+		"total":           invoice.Total.Value.String(),
+		"currency":        invoice.Total.Currency,
+		"attempt_count":   invoice.AttemptCount,
+		"payment_id":      invoice.PaymentID,
+	}
+}
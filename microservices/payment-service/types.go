@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
 	"time"
 )
 
@@ -15,14 +16,31 @@ type Money struct {
 
 // FromMinorUnits creates a Money instance from minor units (e.g., cents)
 func FromMinorUnits(currency string, minorUnits int64) Money {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(currency))), nil)
 	value := new(big.Float).SetInt64(minorUnits)
-	value.Quo(value, big.NewFloat(100))
+	value.Quo(value, new(big.Float).SetInt(scale))
 	return Money{
 		Value:    value,
 		Currency: currency,
 	}
 }
 
+// currencyExponents lists the ISO 4217 minor unit exponents of currencies
+// whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyExponent returns the number of minor unit digits of a currency
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exponent
+	}
+	return 2
+}
+
 // Payment represents a payment transaction
 type Payment struct {
 	ID          string                 `json:"id"`
@@ -32,6 +50,7 @@ type Payment struct {
 	Amount      Money                  `json:"amount"`
 	Currency    string                 `json:"currency"`
 	Status      string                 `json:"status"`
+	PaymentToken string                `json:"payment_token,omitempty"`
 	ExternalRef string                 `json:"external_ref,omitempty"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	CreatedAt   time.Time              `json:"created_at"`
@@ -45,6 +64,7 @@ type CreatePaymentRequest struct {
 	PaymentMethod string                 `json:"payment_method"`
 	Amount        Money                  `json:"amount"`
 	Description   string                 `json:"description"`
+	PaymentToken  string                 `json:"payment_token,omitempty"`
 	Metadata      map[string]interface{} `json:"metadata,omitempty"`
 }
 
@@ -80,22 +100,48 @@ type Repository interface {
 	UpdatePayment(ctx context.Context, payment *Payment) error
 	DeletePayment(ctx context.Context, id string) error
 	GetProviders(ctx context.Context) ([]*Provider, error)
+	CreatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error
+	UpdatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error
+	ListPaymentAttempts(ctx context.Context, paymentID string) ([]*PaymentAttempt, error)
+	ListRetriesDue(ctx context.Context, before time.Time) ([]*PaymentAttempt, error)
 }
 
 // Service represents the payment business logic
 type Service struct {
-	repo   Repository
-	logger interface{}
+	repo      Repository
+	logger    interface{}
+	tokenizer *Tokenizer
+	events    EventPublisher
+	billing   *SubscriptionBilling
+	checkout  *CheckoutSessions
+
+	retryPolicy RetryPolicy
+	metrics     *PaymentMetricsCollector
+	risk        RiskAssessor
+	limits      LimitChecker
+	fees        FeeCalculator
+
+	// localRiskLimit is the local risk score above which payments are
+	// declined while risk-service is unavailable
+	localRiskLimit float64
 }
 
 // NewService creates a new payment service
 func NewService(repo Repository, logger interface{}) *Service {
 	return &Service{
-		repo:   repo,
-		logger: logger,
+		repo:        repo,
+		logger:      logger,
+		retryPolicy:    DefaultRetryPolicy(),
+		metrics:        NewPaymentMetricsCollector(),
+		localRiskLimit: 70,
 	}
 }
 
+// SetTokenizer configures the card tokenizer used for tokenized payments
+func (s *Service) SetTokenizer(tokenizer *Tokenizer) {
+	s.tokenizer = tokenizer
+}
+
 // CreatePayment creates a new payment
 func (s *Service) CreatePayment(ctx context.Context, req *CreatePaymentRequest) (*Payment, error) {
 	// Validate request
@@ -113,6 +159,7 @@ func (s *Service) CreatePayment(ctx context.Context, req *CreatePaymentRequest)
 		Method:      req.PaymentMethod,
 		Provider:    req.Provider,
 		Status:      "pending",
+		PaymentToken: req.PaymentToken,
 		Metadata:    req.Metadata,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
@@ -125,8 +172,16 @@ func (s *Service) CreatePayment(ctx context.Context, req *CreatePaymentRequest)
 	payment.Metadata["created_by"] = "payment-service"
 	payment.Metadata["version"] = "1.0"
 
+	// Attach the non-sensitive card details of a tokenized card
+	if payment.PaymentToken != "" {
+		if err := s.attachCardToken(ctx, payment); err != nil {
+			return nil, fmt.Errorf("invalid payment token: %w", err)
+		}
+	}
+
 	// Calculate initial risk score
 	businessValidator := NewBusinessRuleValidator()
+	businessValidator.SetLimitChecker(s.limits)
 	riskScore, err := businessValidator.CalculateRiskScore(payment)
 	if err != nil {
 		return nil, fmt.Errorf("failed to calculate risk score: %w", err)
@@ -139,15 +194,18 @@ func (s *Service) CreatePayment(ctx context.Context, req *CreatePaymentRequest)
 	}
 
 	if err := businessValidator.ValidateFraudRules(ctx, payment); err != nil {
+		s.releasePaymentLimit(ctx, payment)
 		return nil, fmt.Errorf("fraud validation failed: %w", err)
 	}
 
 	if err := businessValidator.ValidateComplianceRules(ctx, payment); err != nil {
+		s.releasePaymentLimit(ctx, payment)
 		return nil, fmt.Errorf("compliance validation failed: %w", err)
 	}
 
 	// Create payment in repository
 	if err := s.repo.CreatePayment(ctx, payment); err != nil {
+		s.releasePaymentLimit(ctx, payment)
 		return nil, fmt.Errorf("failed to create payment: %w", err)
 	}
 
@@ -231,6 +289,22 @@ func (m *MockRepository) GetProviders(ctx context.Context) ([]*Provider, error)
 	}, nil
 }
 
+func (m *MockRepository) CreatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	return nil
+}
+
+func (m *MockRepository) UpdatePaymentAttempt(ctx context.Context, attempt *PaymentAttempt) error {
+	return nil
+}
+
+func (m *MockRepository) ListPaymentAttempts(ctx context.Context, paymentID string) ([]*PaymentAttempt, error) {
+	return []*PaymentAttempt{}, nil
+}
+
+func (m *MockRepository) ListRetriesDue(ctx context.Context, before time.Time) ([]*PaymentAttempt, error) {
+	return []*PaymentAttempt{}, nil
+}
+
 // Helper functions
 func generateID() string {
 	return fmt.Sprintf("payment_%d", time.Now().UnixNano())
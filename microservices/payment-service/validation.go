@@ -58,6 +58,15 @@ func (v *PaymentValidator) ValidateCreatePaymentRequest(req *CreatePaymentReques
 		return fmt.Errorf("invalid metadata: %w", err)
 	}
 
+	// Raw card numbers must be exchanged for a token before reaching payments
+	if err := ValidateNoRawCardData(req.Metadata); err != nil {
+		return fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	if req.PaymentToken != "" && !strings.HasPrefix(req.PaymentToken, "tok_") {
+		return errors.New("invalid payment token format")
+	}
+
 	return nil
 }
 
@@ -203,12 +212,14 @@ func ValidatePaymentAction(payment *Payment, action string) error {
 	}
 
 	allowedActions := map[string][]string{
-		"pending":    {"process", "cancel"},
-		"processing": {"complete", "fail", "cancel"},
-		"completed":  {"refund"},
-		"failed":     {"retry"},
-		"cancelled":  {},
-		"refunded":   {},
+		"pending":        {"process", "cancel"},
+		"pending_review": {"review", "cancel"},
+		"processing":     {"complete", "fail", "cancel"},
+		"completed":      {"refund"},
+		"failed":         {"retry"},
+		"cancelled":      {},
+		"partially_refunded": {"refund"},
+		"refunded":       {},
 	}
 
 	actions, exists := allowedActions[payment.Status]
@@ -228,12 +239,14 @@ func ValidatePaymentAction(payment *Payment, action string) error {
 // ValidatePaymentStateTransition validates if state transition is allowed
 func ValidatePaymentStateTransition(currentStatus, newStatus string) error {
 	validTransitions := map[string][]string{
-		"pending":    {"processing", "cancelled"},
-		"processing": {"completed", "failed", "cancelled"},
-		"completed":  {"refunded"},
-		"failed":     {"pending", "cancelled"}, // Allow retry
-		"cancelled":  {},                       // Terminal state
-		"refunded":   {},                       // Terminal state
+		"pending":        {"processing", "pending_review", "cancelled"},
+		"pending_review": {"processing", "cancelled"},
+		"processing":     {"completed", "failed", "cancelled"},
+		"completed":      {"refunded", "partially_refunded"},
+		"failed":         {"pending", "cancelled"}, // Allow retry
+		"cancelled":      {},                       // Terminal state
+		"partially_refunded": {"refunded", "partially_refunded"},
+		"refunded":       {},                       // Terminal state
 	}
 
 	allowedStates, exists := validTransitions[currentStatus]
@@ -253,6 +266,7 @@ func ValidatePaymentStateTransition(currentStatus, newStatus string) error {
 // BusinessRuleValidator handles business rule validation
 type BusinessRuleValidator struct {
 	validator *PaymentValidator
+	limits    LimitChecker
 }
 
 // NewBusinessRuleValidator creates a new business rule validator
@@ -264,7 +278,14 @@ func NewBusinessRuleValidator() *BusinessRuleValidator {
 
 // ValidatePaymentLimits validates payment against business limits
 func (v *BusinessRuleValidator) ValidatePaymentLimits(ctx context.Context, payment *Payment) error {
-	// Daily limit check (placeholder - would query actual transactions)
+	// Dynamic limits scoped to the payer's tier and risk level
+	if v.limits != nil {
+		if checked, err := v.consumePaymentLimit(ctx, payment); checked {
+			return err
+		}
+	}
+
+	// Fixed fallback limit while dynamic limits are unavailable
 	dailyLimit := big.NewFloat(1000000) // $10,000 daily limit
 	if payment.Amount.Value.Cmp(dailyLimit) > 0 {
 		return errors.New("payment exceeds daily limit")
@@ -435,6 +456,59 @@ func ValidateCardNumber(cardNumber string) error {
 	return nil
 }
 
+// ValidateCardExpiry validates that a card expiry month/year is well formed and not in the past
+func ValidateCardExpiry(month, year int, now time.Time) error {
+	if month < 1 || month > 12 {
+		return errors.New("expiry month must be between 1 and 12")
+	}
+
+	if year < 100 {
+		year += 2000
+	}
+
+	if year > now.Year()+20 {
+		return errors.New("expiry year is too far in the future")
+	}
+
+	// Cards are valid through the last day of the expiry month
+	expiresAt := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+	if !now.Before(expiresAt) {
+		return errors.New("card has expired")
+	}
+
+	return nil
+}
+
+// ValidateNoRawCardData rejects metadata carrying what looks like a PAN
+func ValidateNoRawCardData(metadata map[string]interface{}) error {
+	sensitiveKeys := map[string]bool{
+		"pan":         true,
+		"card_number": true,
+		"cardnumber":  true,
+		"card_no":     true,
+		"cvv":         true,
+		"cvc":         true,
+	}
+
+	for key, value := range metadata {
+		if sensitiveKeys[strings.ToLower(key)] {
+			return fmt.Errorf("metadata key '%s' may not carry card data, tokenize the card instead", key)
+		}
+
+		valueStr, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		digits := regexp.MustCompile(`[\s-]`).ReplaceAllString(valueStr, "")
+		if len(digits) >= 13 && len(digits) <= 19 && regexp.MustCompile(`^\d+$`).MatchString(digits) && isValidLuhn(digits) {
+			return fmt.Errorf("metadata value for key '%s' looks like a card number, tokenize the card instead", key)
+		}
+	}
+
+	return nil
+}
+
 // isValidLuhn implements the Luhn algorithm for card validation
 func isValidLuhn(cardNumber string) bool {
 	sum := 0
@@ -1,2 +1,6 @@
 module payouts-service
 go 1.24
+
+require github.com/project-x/microservices/screening v0.0.0
+
+replace github.com/project-x/microservices/screening => ../screening
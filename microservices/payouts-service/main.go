@@ -2,14 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/project-x/microservices/screening"
+)
+
+// Global services
+var (
+	payoutService *PayoutService
 )
 
 func main() {
@@ -18,16 +27,20 @@ func main() {
 
 	log.Printf("Starting Payouts Microservice on port %s...", *port)
 
+	complianceURL := os.Getenv("COMPLIANCE_SERVICE_URL")
+	if complianceURL == "" {
+		complianceURL = "http://compliance-service:8088"
+	}
+	payoutService = NewPayoutService(screening.NewClient(complianceURL))
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"payouts","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/payouts", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]map[string]interface{}{})
-	})
+	mux.HandleFunc("/v1/payouts", handlePayouts)
+	mux.HandleFunc("/v1/payouts/", handlePayoutByID)
 
 	server := &http.Server{
 		Addr: ":" + *port,
@@ -46,3 +59,56 @@ func main() {
 
 	log.Println("Payouts service exited")
 }
+
+func handlePayouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(payoutService.ListPayouts(query.Get("account_id"), query.Get("status")))
+
+	case "POST":
+		var req PayoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		payout, err := payoutService.CreatePayout(r.Context(), &req)
+		if err != nil {
+			if errors.Is(err, ErrScreeningUnavailable) {
+				log.Printf("Refusing payout for account %s: %v", req.AccountID, err)
+				http.Error(w, "Beneficiary screening unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if payout.Status == "held" {
+			log.Printf("Payout %s held for screening case %s", payout.ID, payout.CaseID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(payout)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handlePayoutByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payout, ok := payoutService.GetPayout(strings.TrimPrefix(r.URL.Path, "/v1/payouts/"))
+	if !ok {
+		http.Error(w, "Payout not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payout)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/project-x/microservices/screening"
+)
+
+// ErrScreeningUnavailable is returned when a payout cannot be screened
+var ErrScreeningUnavailable = errors.New("beneficiary screening unavailable")
+
+// PayoutRequest represents a request to pay out to a beneficiary
+type PayoutRequest struct {
+	AccountID              string  `json:"account_id"`
+	Amount                 float64 `json:"amount"`
+	Currency               string  `json:"currency"`
+	BeneficiaryName        string  `json:"beneficiary_name"`
+	BeneficiaryType        string  `json:"beneficiary_type,omitempty"` // individual, entity
+	BeneficiaryCountry     string  `json:"beneficiary_country,omitempty"`
+	BeneficiaryDateOfBirth string  `json:"beneficiary_date_of_birth,omitempty"`
+	BeneficiaryAccountIBAN string  `json:"beneficiary_iban,omitempty"`
+}
+
+// Payout is a payout to a beneficiary
+type Payout struct {
+	ID                     string    `json:"id"`
+	AccountID              string    `json:"account_id"`
+	Amount                 float64   `json:"amount"`
+	Currency               string    `json:"currency"`
+	BeneficiaryName        string    `json:"beneficiary_name"`
+	BeneficiaryType        string    `json:"beneficiary_type,omitempty"`
+	BeneficiaryCountry     string    `json:"beneficiary_country,omitempty"`
+	BeneficiaryAccountIBAN string    `json:"beneficiary_iban,omitempty"`
+	Status                 string    `json:"status"` // pending, held
+	HoldReason             string    `json:"hold_reason,omitempty"`
+	ScreeningID            string    `json:"screening_id,omitempty"`
+	CaseID                 string    `json:"case_id,omitempty"`
+	CreatedAt              time.Time `json:"created_at"`
+}
+
+// Screener screens a single name against watchlists
+type Screener interface {
+	Screen(ctx context.Context, req *screening.Request) (*screening.Result, error)
+}
+
+// PayoutService creates payouts after screening their beneficiaries
+type PayoutService struct {
+	mu       sync.RWMutex
+	payouts  map[string]*Payout
+	screener Screener
+}
+
+// NewPayoutService creates a new payout service
+func NewPayoutService(screener Screener) *PayoutService {
+	return &PayoutService{
+		payouts:  make(map[string]*Payout),
+		screener: screener,
+	}
+}
+
+// CreatePayout screens the beneficiary and creates the payout. Payouts to a
+// potential watchlist match are held for compliance review; if screening is
+// unavailable the payout is refused rather than sent unscreened.
+func (s *PayoutService) CreatePayout(ctx context.Context, req *PayoutRequest) (*Payout, error) {
+	if req.AccountID == "" {
+		return nil, errors.New("account ID is required")
+	}
+	if req.Amount <= 0 {
+		return nil, errors.New("amount must be positive")
+	}
+	if len(req.Currency) != 3 {
+		return nil, errors.New("currency must be a 3-letter code")
+	}
+	if strings.TrimSpace(req.BeneficiaryName) == "" {
+		return nil, errors.New("beneficiary name is required")
+	}
+	if req.BeneficiaryType == "" {
+		req.BeneficiaryType = "individual"
+	}
+	if req.BeneficiaryType != "individual" && req.BeneficiaryType != "entity" {
+		return nil, fmt.Errorf("invalid beneficiary type: %s", req.BeneficiaryType)
+	}
+
+	payout := &Payout{
+		ID:                     newPayoutID(),
+		AccountID:              req.AccountID,
+		Amount:                 req.Amount,
+		Currency:               strings.ToUpper(req.Currency),
+		BeneficiaryName:        req.BeneficiaryName,
+		BeneficiaryType:        req.BeneficiaryType,
+		BeneficiaryCountry:     req.BeneficiaryCountry,
+		BeneficiaryAccountIBAN: req.BeneficiaryAccountIBAN,
+		Status:                 "pending",
+		CreatedAt:              time.Now(),
+	}
+
+	result, err := s.screener.Screen(ctx, &screening.Request{
+		Name:        req.BeneficiaryName,
+		EntityType:  req.BeneficiaryType,
+		DateOfBirth: req.BeneficiaryDateOfBirth,
+		Country:     req.BeneficiaryCountry,
+		Context:     "payout",
+		ReferenceID: payout.ID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrScreeningUnavailable, err)
+	}
+
+	payout.ScreeningID = result.ID
+	if result.Status != "clear" {
+		payout.Status = "held"
+		payout.HoldReason = "watchlist_match"
+		payout.CaseID = result.CaseID
+	}
+
+	s.mu.Lock()
+	s.payouts[payout.ID] = payout
+	s.mu.Unlock()
+
+	return payout, nil
+}
+
+// GetPayout returns a payout by ID
+func (s *PayoutService) GetPayout(id string) (*Payout, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	payout, ok := s.payouts[id]
+	return payout, ok
+}
+
+// ListPayouts returns payouts for an account and status, newest first
+func (s *PayoutService) ListPayouts(accountID, status string) []*Payout {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	payouts := []*Payout{}
+	for _, payout := range s.payouts {
+		if accountID != "" && payout.AccountID != accountID {
+			continue
+		}
+		if status != "" && payout.Status != status {
+			continue
+		}
+		payouts = append(payouts, payout)
+	}
+
+	sort.Slice(payouts, func(i, j int) bool {
+		return payouts[i].CreatedAt.After(payouts[j].CreatedAt)
+	})
+
+	return payouts
+}
+
+func newPayoutID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "po_" + hex.EncodeToString(b)
+}
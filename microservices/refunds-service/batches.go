@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch statuses. A batch with invalid rows is rejected as a whole; a dry
+// run stops once its rows are validated.
+const (
+	BatchStatusValidated  = "validated"
+	BatchStatusRejected   = "rejected"
+	BatchStatusProcessing = "processing"
+	BatchStatusCompleted  = "completed"
+)
+
+// Batch row statuses
+const (
+	RowStatusValid   = "valid"
+	RowStatusInvalid = "invalid"
+	RowStatusError   = "error" // valid at upload but the refund could not be made
+)
+
+// MaxBatchRows is the most rows one batch file may hold
+const MaxBatchRows = 5000
+
+var (
+	// ErrBatchNotFound is returned for unknown batches
+	ErrBatchNotFound = errors.New("batch not found")
+	// ErrInvalidBatchFile is returned for files that cannot be read as
+	// batch rows
+	ErrInvalidBatchFile = errors.New("invalid batch file")
+)
+
+// BatchRow is one refund asked for in a batch file. Amount is in major
+// units; empty refunds the rest of the payment.
+type BatchRow struct {
+	Line          int    `json:"line"`
+	TransactionID string `json:"transaction_id"`
+	Amount        string `json:"amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// BatchRowResult is the outcome of one batch row. Status is valid or
+// invalid after validation, then the refund's status or error once
+// processed.
+type BatchRowResult struct {
+	BatchRow
+	AmountMinor int64  `json:"amount_minor"`
+	Status      string `json:"status"`
+	RefundID    string `json:"refund_id,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Batch is an uploaded file of refunds
+type Batch struct {
+	ID          string            `json:"id"`
+	FileName    string            `json:"file_name,omitempty"`
+	DryRun      bool              `json:"dry_run"`
+	Status      string            `json:"status"`
+	TotalRows   int               `json:"total_rows"`
+	InvalidRows int               `json:"invalid_rows"`
+	Processed   int               `json:"processed"`
+	Succeeded   int               `json:"succeeded"`
+	Failed      int               `json:"failed"` // refused by the provider or not made
+	Queued      int               `json:"queued"` // waiting for merchant funds
+	TotalMinor  int64             `json:"total_minor"`
+	Rows        []*BatchRowResult `json:"rows"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CompletedAt *time.Time        `json:"completed_at,omitempty"`
+}
+
+// BatchService validates batch files and works through their refunds in
+// the background at a limited rate
+type BatchService struct {
+	mu       sync.RWMutex
+	batches  map[string]*Batch
+	order    []string
+	refunds  *RefundService
+	interval time.Duration // between refunds of a batch
+}
+
+// NewBatchService creates a batch service that makes refunds through the
+// refund service at 5 per second
+func NewBatchService(refunds *RefundService) *BatchService {
+	return &BatchService{
+		batches:  make(map[string]*Batch),
+		refunds:  refunds,
+		interval: 200 * time.Millisecond,
+	}
+}
+
+// SetRateLimit sets how many refunds per second batches make
+func (s *BatchService) SetRateLimit(perSecond int) {
+	if perSecond <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = time.Second / time.Duration(perSecond)
+}
+
+// ParseBatchCSV reads batch rows from CSV with a header naming the
+// transaction_id, amount, currency and reason columns; only
+// transaction_id is required
+func ParseBatchCSV(r io.Reader) ([]BatchRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalidBatchFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBatchFile, err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["transaction_id"]; !ok {
+		return nil, fmt.Errorf("%w: header has no transaction_id column", ErrInvalidBatchFile)
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []BatchRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBatchFile, err)
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, BatchRow{
+			Line:          line,
+			TransactionID: field(record, "transaction_id"),
+			Amount:        field(record, "amount"),
+			Currency:      strings.ToUpper(field(record, "currency")),
+			Reason:        field(record, "reason"),
+		})
+	}
+	return rows, nil
+}
+
+// ParseBatchJSON reads batch rows from a JSON array of rows or an object
+// with a rows array. Amounts may be numbers or strings.
+func ParseBatchJSON(r io.Reader) ([]BatchRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBatchFile, err)
+	}
+
+	type jsonRow struct {
+		TransactionID string      `json:"transaction_id"`
+		Amount        json.Number `json:"amount"`
+		Currency      string      `json:"currency"`
+		Reason        string      `json:"reason"`
+	}
+	var decoded []jsonRow
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		var wrapped struct {
+			Rows []jsonRow `json:"rows"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBatchFile, err)
+		}
+		decoded = wrapped.Rows
+	}
+
+	rows := make([]BatchRow, 0, len(decoded))
+	for i, row := range decoded {
+		rows = append(rows, BatchRow{
+			Line:          i + 1,
+			TransactionID: strings.TrimSpace(row.TransactionID),
+			Amount:        strings.TrimSpace(row.Amount.String()),
+			Currency:      strings.ToUpper(strings.TrimSpace(row.Currency)),
+			Reason:        strings.TrimSpace(row.Reason),
+		})
+	}
+	return rows, nil
+}
+
+// SubmitBatch validates every row of a file against its payment. Rows for
+// the same payment count against its refundable balance together. Valid
+// batches that are not dry runs are processed in the background.
+func (s *BatchService) SubmitBatch(ctx context.Context, fileName string, rows []BatchRow, dryRun bool) (*Batch, error) {
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%w: no rows", ErrInvalidBatchFile)
+	}
+	if len(rows) > MaxBatchRows {
+		return nil, fmt.Errorf("%w: %d rows, at most %d allowed", ErrInvalidBatchFile, len(rows), MaxBatchRows)
+	}
+
+	batch := &Batch{
+		ID:        generateID("batch"),
+		FileName:  fileName,
+		DryRun:    dryRun,
+		TotalRows: len(rows),
+		CreatedAt: time.Now(),
+	}
+
+	held := make(map[string]int64)
+	for _, row := range rows {
+		result := &BatchRowResult{BatchRow: row, Status: RowStatusValid}
+		batch.Rows = append(batch.Rows, result)
+
+		amount, err := s.validateRow(ctx, row, held[row.TransactionID])
+		if err != nil {
+			result.Status = RowStatusInvalid
+			result.Error = err.Error()
+			batch.InvalidRows++
+			continue
+		}
+		result.AmountMinor = amount
+		held[row.TransactionID] += amount
+		batch.TotalMinor += amount
+	}
+
+	switch {
+	case batch.InvalidRows > 0:
+		batch.Status = BatchStatusRejected
+	case dryRun:
+		batch.Status = BatchStatusValidated
+	default:
+		batch.Status = BatchStatusProcessing
+	}
+	if batch.Status != BatchStatusProcessing {
+		now := time.Now()
+		batch.CompletedAt = &now
+	}
+
+	s.mu.Lock()
+	s.batches[batch.ID] = batch
+	s.order = append(s.order, batch.ID)
+	found := copyBatch(batch)
+	s.mu.Unlock()
+
+	if batch.Status == BatchStatusProcessing {
+		go s.process(context.Background(), batch.ID)
+	}
+	return found, nil
+}
+
+// validateRow checks one row and returns the amount it would refund
+func (s *BatchService) validateRow(ctx context.Context, row BatchRow, heldMinor int64) (int64, error) {
+	if row.TransactionID == "" {
+		return 0, errors.New("transaction_id is required")
+	}
+	var amountMinor int64
+	if row.Amount != "" {
+		minor, err := parseMinorUnits(row.Amount)
+		if err != nil {
+			return 0, err
+		}
+		if minor <= 0 {
+			return 0, errors.New("amount must be positive")
+		}
+		amountMinor = minor
+	}
+
+	return s.refunds.ValidateRefund(ctx, &CreateRefundRequest{
+		TransactionID: row.TransactionID,
+		AmountMinor:   amountMinor,
+		Currency:      row.Currency,
+		Reason:        row.Reason,
+	}, heldMinor)
+}
+
+// process makes the refunds of a batch one at a time at the service's
+// rate. Payments may have changed since upload, so each refund is checked
+// again when it is made.
+func (s *BatchService) process(ctx context.Context, batchID string) {
+	s.mu.RLock()
+	interval := s.interval
+	rows := len(s.batches[batchID].Rows)
+	s.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		s.mu.RLock()
+		row := *s.batches[batchID].Rows[i]
+		s.mu.RUnlock()
+
+		status, refundID, errMsg := s.makeRefund(ctx, &row)
+
+		s.mu.Lock()
+		batch := s.batches[batchID]
+		result := batch.Rows[i]
+		result.Status = status
+		result.RefundID = refundID
+		result.Error = errMsg
+		batch.Processed++
+		switch status {
+		case RefundStatusSucceeded:
+			batch.Succeeded++
+		case RefundStatusFailed, RowStatusError:
+			batch.Failed++
+		case RefundStatusQueued:
+			batch.Queued++
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	batch := s.batches[batchID]
+	now := time.Now()
+	batch.Status = BatchStatusCompleted
+	batch.CompletedAt = &now
+	log.Printf("Batch %s completed: %d succeeded, %d failed of %d", batch.ID, batch.Succeeded, batch.Failed, batch.TotalRows)
+	s.mu.Unlock()
+}
+
+// makeRefund creates and processes the refund of one row and returns the
+// row's status, the refund ID and any error
+func (s *BatchService) makeRefund(ctx context.Context, row *BatchRowResult) (string, string, string) {
+	refund, err := s.refunds.CreateRefund(ctx, &CreateRefundRequest{
+		TransactionID: row.TransactionID,
+		AmountMinor:   row.AmountMinor,
+		Currency:      row.Currency,
+		Reason:        row.Reason,
+	})
+	if err != nil {
+		return RowStatusError, "", err.Error()
+	}
+
+	processed, err := s.refunds.ProcessRefund(ctx, refund.ID)
+	if err != nil {
+		return RowStatusError, refund.ID, err.Error()
+	}
+	return processed.Status, processed.ID, processed.FailureReason
+}
+
+// GetBatch returns a batch
+func (s *BatchService) GetBatch(batchID string) (*Batch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	batch, ok := s.batches[batchID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBatchNotFound, batchID)
+	}
+	return copyBatch(batch), nil
+}
+
+// ListBatches returns batches without their rows, newest first
+func (s *BatchService) ListBatches() []*Batch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	batches := []*Batch{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		summary := *s.batches[s.order[i]]
+		summary.Rows = nil
+		batches = append(batches, &summary)
+	}
+	return batches
+}
+
+// BatchReportCSV renders the per-row results of a batch as CSV
+func BatchReportCSV(batch *Batch) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	rows := [][]string{
+		{"line", "transaction_id", "amount", "currency", "reason", "status", "refund_id", "error"},
+	}
+	for _, row := range batch.Rows {
+		amount := row.Amount
+		if row.AmountMinor > 0 {
+			amount = formatMinorUnits(row.AmountMinor)
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(row.Line), row.TransactionID, amount, row.Currency,
+			row.Reason, row.Status, row.RefundID, row.Error,
+		})
+	}
+
+	if err := w.WriteAll(rows); err != nil {
+		return nil, fmt.Errorf("failed to write batch report: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// copyBatch returns a copy of a batch safe to hand out
+func copyBatch(batch *Batch) *Batch {
+	found := *batch
+	found.Rows = make([]*BatchRowResult, len(batch.Rows))
+	for i, row := range batch.Rows {
+		copied := *row
+		found.Rows[i] = &copied
+	}
+	return &found
+}
+
+// parseMinorUnits parses a decimal amount with at most two decimals, e.g.
+// "12.5" as 1250
+func parseMinorUnits(value string) (int64, error) {
+	whole, fraction, _ := strings.Cut(value, ".")
+	if len(fraction) > 2 {
+		return 0, fmt.Errorf("invalid amount %q: at most 2 decimals", value)
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	cents, err := strconv.ParseUint(fraction, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	if strings.HasPrefix(whole, "-") {
+		return units*100 - int64(cents), nil
+	}
+	return units*100 + int64(cents), nil
+}
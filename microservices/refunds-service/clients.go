@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrPaymentNotFound is returned when payment-service does not know a payment
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// RefundsClearingAccount is the ledger account refunds are paid out from to
+// customers
+const RefundsClearingAccount = "refunds_clearing"
+
+// Payment is what refunds need to know of a payment-service payment
+type Payment struct {
+	ID          string
+	MerchantID  string
+	Provider    string
+	Method      string
+	AmountMinor int64
+	Currency    string
+	Status      string
+}
+
+// PaymentClient reads payments and reports refunds to payment-service
+type PaymentClient interface {
+	GetPayment(ctx context.Context, paymentID string) (*Payment, error)
+	RecordRefund(ctx context.Context, refund *Refund) error
+}
+
+// Ledger account types the refund accounts are opened with
+const (
+	AccountTypeAsset     = "asset"
+	AccountTypeLiability = "liability"
+	AccountTypeRevenue   = "revenue"
+	AccountTypeReserve   = "reserve"
+)
+
+// LedgerTransfer moves an amount between two ledger accounts. ID
+// identifies the transfer to the ledger, so a retried transfer is booked
+// once.
+type LedgerTransfer struct {
+	ID            string
+	TransactionID string
+	FromAccount   string
+	ToAccount     string
+	FromType      string
+	ToType        string
+	AmountMinor   int64
+	Currency      string
+	Description   string
+	Metadata      map[string]interface{}
+}
+
+// LedgerPoster posts transfers to the ledger
+type LedgerPoster interface {
+	Post(ctx context.Context, transfer *LedgerTransfer) error
+}
+
+// reversalTransfer takes a refund back out of the merchant's balance
+func reversalTransfer(refund *Refund) *LedgerTransfer {
+	return &LedgerTransfer{
+		ID:            refund.ID + ":reversal",
+		TransactionID: refund.ID,
+		FromAccount:   refund.MerchantID,
+		ToAccount:     RefundsClearingAccount,
+		FromType:      AccountTypeLiability,
+		ToType:        AccountTypeLiability,
+		AmountMinor:   refund.AmountMinor,
+		Currency:      refund.Currency,
+		Description:   fmt.Sprintf("Refund of payment %s", refund.TransactionID),
+		Metadata: map[string]interface{}{
+			"refund_id":          refund.ID,
+			"payment_id":         refund.TransactionID,
+			"provider_refund_id": refund.ProviderRefundID,
+			"reason":             refund.Reason,
+		},
+	}
+}
+
+// HTTPPaymentClient calls payment-service over HTTP
+type HTTPPaymentClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPPaymentClient creates a new payment-service client
+func NewHTTPPaymentClient(baseURL string) *HTTPPaymentClient {
+	return &HTTPPaymentClient{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// money is payment-service's and ledger-service's amount; values are
+// decimal strings
+type money struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// GetPayment fetches a payment
+func (c *HTTPPaymentClient) GetPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/v1/payments/"+paymentID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call payment service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrPaymentNotFound, paymentID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("payment service returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		ID        string                 `json:"id"`
+		AccountID string                 `json:"account_id"`
+		Provider  string                 `json:"provider"`
+		Method    string                 `json:"method"`
+		Amount    money                  `json:"amount"`
+		Status    string                 `json:"status"`
+		Metadata  map[string]interface{} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode payment: %w", err)
+	}
+
+	amountMinor, err := parseAmountMinor(body.Amount.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment amount: %w", err)
+	}
+
+	// Payments made for a merchant carry its ID; otherwise the paying
+	// account is the merchant's
+	merchantID := body.AccountID
+	if id, ok := body.Metadata["merchant_id"].(string); ok && id != "" {
+		merchantID = id
+	}
+
+	return &Payment{
+		ID:          body.ID,
+		MerchantID:  merchantID,
+		Provider:    body.Provider,
+		Method:      body.Method,
+		AmountMinor: amountMinor,
+		Currency:    body.Amount.Currency,
+		Status:      body.Status,
+	}, nil
+}
+
+// RecordRefund reports a succeeded refund so payment-service updates the
+// payment's status
+func (c *HTTPPaymentClient) RecordRefund(ctx context.Context, refund *Refund) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"refund_id": refund.ID,
+		"amount":    money{Value: formatMinorUnits(refund.AmountMinor), Currency: refund.Currency},
+		"reason":    refund.Reason,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal refund: %w", err)
+	}
+
+	return postJSON(ctx, c.client, c.baseURL+"/v1/payments/"+refund.TransactionID+"/refunds", body)
+}
+
+// HTTPLedgerPoster posts to ledger-service over HTTP, each transfer as one
+// ledger transfer keyed by its ID
+type HTTPLedgerPoster struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPLedgerPoster creates a new ledger client
+func NewHTTPLedgerPoster(baseURL string) *HTTPLedgerPoster {
+	return &HTTPLedgerPoster{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Post moves the amount from the from account to the to account in one
+// transfer, opening either account if it does not exist yet. The ledger
+// answers a transfer it already booked with the original.
+func (c *HTTPLedgerPoster) Post(ctx context.Context, transfer *LedgerTransfer) error {
+	metadata := map[string]interface{}{"transaction_id": transfer.TransactionID, "created_by": "refunds-service"}
+	for key, value := range transfer.Metadata {
+		metadata[key] = value
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"transfer_id":       transfer.ID,
+		"from_account":      transfer.FromAccount,
+		"to_account":        transfer.ToAccount,
+		"from_account_type": transfer.FromType,
+		"to_account_type":   transfer.ToType,
+		"type":              "refund",
+		"amount":            money{Value: formatMinorUnits(transfer.AmountMinor), Currency: transfer.Currency},
+		"description":       transfer.Description,
+		"metadata":          metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal transfer: %w", err)
+	}
+
+	if err := postJSON(ctx, c.client, c.baseURL+"/v1/transfers", body); err != nil {
+		return fmt.Errorf("failed to post transfer %s: %w", transfer.ID, err)
+	}
+	return nil
+}
+
+// Balance reads an account's balance
+func (c *HTTPLedgerPoster) Balance(ctx context.Context, accountID string) (int64, error) {
+	var balance money
+	if err := getJSON(ctx, c.client, c.baseURL+"/v1/balance/"+accountID, &balance); err != nil {
+		return 0, err
+	}
+	return parseAmountMinor(balance.Value)
+}
+
+// HTTPFeeClient calls fees-service over HTTP
+type HTTPFeeClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPFeeClient creates a new fees-service client
+func NewHTTPFeeClient(baseURL string) *HTTPFeeClient {
+	return &HTTPFeeClient{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// GetFee returns the fee fees-service recorded for a payment
+func (c *HTTPFeeClient) GetFee(ctx context.Context, transactionID string) (int64, error) {
+	var calc struct {
+		FeeMinor int64 `json:"fee_minor"`
+	}
+	err := getJSON(ctx, c.client, c.baseURL+"/api/v1/fees/"+transactionID, &calc)
+	if errors.Is(err, errNotFound) {
+		return 0, fmt.Errorf("%w: %s", ErrFeeNotFound, transactionID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return calc.FeeMinor, nil
+}
+
+// errNotFound is returned by getJSON for 404 responses
+var errNotFound = errors.New("not found")
+
+// getJSON gets a URL and decodes its JSON body into out
+func getJSON(ctx context.Context, client *http.Client, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", url, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", url, err)
+	}
+	return nil
+}
+
+// parseAmountMinor parses a decimal amount string as minor units
+func parseAmountMinor(value string) (int64, error) {
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", value, err)
+	}
+	return int64(math.Round(amount * 100)), nil
+}
+
+// postJSON posts a JSON body and checks for a success status
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Fee refund policies. With proportional, a refund returns the share of the
+// payment's processing fee that the refund is of the payment.
+const (
+	FeeRefundNone         = "none"
+	FeeRefundProportional = "proportional"
+)
+
+var (
+	// ErrInsufficientFunds is returned when neither the merchant's balance
+	// nor its reserve covers a refund
+	ErrInsufficientFunds = errors.New("insufficient merchant funds")
+	// ErrFeeNotFound is returned when fees-service has no fee for a payment
+	ErrFeeNotFound = errors.New("fee not found")
+)
+
+// ReserveAccount is the ledger account holding a merchant's reserve, drawn
+// from when its balance does not cover a refund
+func ReserveAccount(merchantID string) string {
+	return "reserve_" + merchantID
+}
+
+// FeesReceivableAccount is the ledger account holding what a merchant owes
+// in fees, as fees-service posts them
+func FeesReceivableAccount(merchantID string) string {
+	return "fees_receivable_" + merchantID
+}
+
+// FeeRevenueAccount is the ledger account fees are earned into
+const FeeRevenueAccount = "fee_revenue"
+
+// BalanceReader reads ledger account balances in minor units
+type BalanceReader interface {
+	Balance(ctx context.Context, accountID string) (int64, error)
+}
+
+// FeeClient reads the processing fee charged on a payment
+type FeeClient interface {
+	GetFee(ctx context.Context, transactionID string) (int64, error)
+}
+
+// FeePolicy is how a merchant's refunds treat processing fees
+type FeePolicy struct {
+	MerchantID string `json:"merchant_id,omitempty"`
+	FeeRefund  string `json:"fee_refund"` // none or proportional
+}
+
+// SetBalanceReader configures checking merchant balances and reserves
+// before refunds are submitted
+func (s *RefundService) SetBalanceReader(balances BalanceReader) {
+	s.balances = balances
+}
+
+// SetFeeClient configures reading payment fees for fee refunds
+func (s *RefundService) SetFeeClient(fees FeeClient) {
+	s.fees = fees
+}
+
+// SetDefaultFeePolicy sets the fee refund policy of merchants without
+// their own
+func (s *RefundService) SetDefaultFeePolicy(feeRefund string) error {
+	if err := validateFeeRefund(feeRefund); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feeRefund = feeRefund
+	return nil
+}
+
+// SetFeePolicy sets a merchant's fee refund policy. It applies to refunds
+// created afterwards.
+func (s *RefundService) SetFeePolicy(policy *FeePolicy) error {
+	if policy.MerchantID == "" {
+		return errors.New("merchant_id is required")
+	}
+	if err := validateFeeRefund(policy.FeeRefund); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commitLocked(&JournalEntry{Kind: JournalFeePolicy, FeePolicy: &FeePolicy{MerchantID: policy.MerchantID, FeeRefund: policy.FeeRefund}})
+}
+
+// GetFeePolicy returns the fee refund policy that applies to a merchant
+func (s *RefundService) GetFeePolicy(merchantID string) *FeePolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &FeePolicy{MerchantID: merchantID, FeeRefund: s.feePolicyLocked(merchantID)}
+}
+
+func (s *RefundService) feePolicyLocked(merchantID string) string {
+	if feeRefund, ok := s.policies[merchantID]; ok {
+		return feeRefund
+	}
+	return s.feeRefund
+}
+
+func validateFeeRefund(feeRefund string) error {
+	if feeRefund != FeeRefundNone && feeRefund != FeeRefundProportional {
+		return fmt.Errorf("fee_refund must be %s or %s", FeeRefundNone, FeeRefundProportional)
+	}
+	return nil
+}
+
+// paymentFee returns the fee charged on a payment when the merchant's
+// policy refunds fees, and 0 otherwise
+func (s *RefundService) paymentFee(ctx context.Context, payment *Payment) (int64, error) {
+	s.mu.RLock()
+	policy := s.feePolicyLocked(payment.MerchantID)
+	s.mu.RUnlock()
+
+	if policy != FeeRefundProportional || s.fees == nil {
+		return 0, nil
+	}
+	fee, err := s.fees.GetFee(ctx, payment.ID)
+	if errors.Is(err, ErrFeeNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get fee of payment %s: %w", payment.ID, err)
+	}
+	return fee, nil
+}
+
+// feeRefundLocked returns the share of a payment's fee a refund returns,
+// rounded down. The refund that completes the payment returns what is
+// left of the fee so the shares add up to it. Callers hold s.mu.
+func (s *RefundService) feeRefundLocked(payment *Payment, feeMinor, amountMinor, committedMinor int64) int64 {
+	if feeMinor <= 0 || payment.AmountMinor <= 0 {
+		return 0
+	}
+
+	var refunded int64
+	for _, refund := range s.refunds {
+		if refund.TransactionID == payment.ID && refund.Status != RefundStatusFailed {
+			refunded += refund.FeeRefundMinor
+		}
+	}
+	left := feeMinor - refunded
+	if left <= 0 {
+		return 0
+	}
+	if committedMinor+amountMinor >= payment.AmountMinor {
+		return left
+	}
+
+	share := feeMinor * amountMinor / payment.AmountMinor
+	if share > left {
+		share = left
+	}
+	return share
+}
+
+// reserveFunds submits a refund once its merchant can pay it. The funds
+// check and the move to submitted run under the merchant's lock, and a
+// submitted refund counts against the balance from then on, so concurrent
+// refunds of a merchant are never paid from the same funds. A refund that
+// fails stops counting, releasing what it reserved.
+func (s *RefundService) reserveFunds(ctx context.Context, refund *Refund) (*Refund, error) {
+	lock := s.fundLock(refund.MerchantID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	reserveDraw, err := s.checkFunds(ctx, refund)
+	if err != nil {
+		return nil, err
+	}
+	return s.transition(refund.ID, RefundStatusSubmitted, "", func(r *Refund) {
+		now := time.Now()
+		r.SubmittedAt = &now
+		r.ReserveDrawMinor = reserveDraw
+	})
+}
+
+// fundLock returns the lock serialising a merchant's funds checks
+func (s *RefundService) fundLock(merchantID string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, ok := s.fundLocks[merchantID]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.fundLocks[merchantID] = lock
+	}
+	return lock
+}
+
+// checkFunds makes sure the merchant can pay a refund. Refunds already
+// submitted but not yet taken from the ledger count against the balance.
+// A shortfall is drawn from the merchant's reserve if it covers it; the
+// amount to draw is returned. Callers hold the merchant's fund lock.
+func (s *RefundService) checkFunds(ctx context.Context, refund *Refund) (int64, error) {
+	if s.balances == nil {
+		return 0, nil
+	}
+
+	balance, err := s.balances.Balance(ctx, refund.MerchantID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read balance of merchant %s: %w", refund.MerchantID, err)
+	}
+
+	inFlight, drawn := s.inFlight(refund.MerchantID, refund.ID)
+	available := balance - inFlight + drawn
+	if available >= refund.AmountMinor {
+		return 0, nil
+	}
+
+	reserve, err := s.balances.Balance(ctx, ReserveAccount(refund.MerchantID))
+	if err != nil {
+		// Merchants without a reserve account have nothing to draw
+		log.Printf("No reserve for merchant %s: %v", refund.MerchantID, err)
+		reserve = 0
+	}
+	reserve -= drawn
+
+	shortfall := refund.AmountMinor
+	if available > 0 {
+		shortfall -= available
+	}
+	if reserve < shortfall {
+		return 0, fmt.Errorf("%w: %s needed, %s available and %s in reserve", ErrInsufficientFunds,
+			formatMinorUnits(refund.AmountMinor), formatMinorUnits(available), formatMinorUnits(reserve))
+	}
+	return shortfall, nil
+}
+
+// inFlight returns how much a merchant's other refunds will take from its
+// balance and reserve once posted to the ledger. Succeeded refunds count
+// until their ledger posting is done.
+func (s *RefundService) inFlight(merchantID, exceptID string) (int64, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var amount, drawn int64
+	for id, refund := range s.refunds {
+		if id == exceptID || refund.MerchantID != merchantID {
+			continue
+		}
+		if refund.Status == RefundStatusSubmitted ||
+			(refund.Status == RefundStatusSucceeded && s.ledger != nil && refund.LedgerStatus != SyncStatusDone) {
+			amount += refund.AmountMinor
+			drawn += refund.ReserveDrawMinor
+		}
+	}
+	return amount, drawn
+}
+
+// RetryQueued submits queued refunds, oldest first, whose merchants now
+// have the funds and returns how many left the queue
+func (s *RefundService) RetryQueued(ctx context.Context) int {
+	queued := s.ListRefunds("", RefundStatusQueued)
+
+	submitted := 0
+	for i := len(queued) - 1; i >= 0; i-- {
+		refund, err := s.ProcessRefund(ctx, queued[i].ID)
+		if err != nil {
+			log.Printf("Failed to process queued refund %s: %v", queued[i].ID, err)
+			continue
+		}
+		if refund.Status != RefundStatusQueued {
+			submitted++
+		}
+	}
+	return submitted
+}
+
+// refundTransfers returns the ledger transfers of a succeeded refund: the
+// draw from the merchant's reserve, the reversal out of its balance and
+// the fee returned against what it owes in fees
+func refundTransfers(refund *Refund) []*LedgerTransfer {
+	var transfers []*LedgerTransfer
+	if refund.ReserveDrawMinor > 0 {
+		transfers = append(transfers, &LedgerTransfer{
+			ID:            refund.ID + ":reserve_draw",
+			TransactionID: refund.ID,
+			FromAccount:   ReserveAccount(refund.MerchantID),
+			ToAccount:     refund.MerchantID,
+			FromType:      AccountTypeReserve,
+			ToType:        AccountTypeLiability,
+			AmountMinor:   refund.ReserveDrawMinor,
+			Currency:      refund.Currency,
+			Description:   fmt.Sprintf("Reserve draw for refund of payment %s", refund.TransactionID),
+			Metadata: map[string]interface{}{
+				"refund_id":  refund.ID,
+				"payment_id": refund.TransactionID,
+			},
+		})
+	}
+
+	transfers = append(transfers, reversalTransfer(refund))
+
+	if refund.FeeRefundMinor > 0 {
+		transfers = append(transfers, &LedgerTransfer{
+			ID:            refund.ID + ":fee_refund",
+			TransactionID: refund.ID,
+			FromAccount:   FeesReceivableAccount(refund.MerchantID),
+			ToAccount:     FeeRevenueAccount,
+			FromType:      AccountTypeAsset,
+			ToType:        AccountTypeRevenue,
+			AmountMinor:   refund.FeeRefundMinor,
+			Currency:      refund.Currency,
+			Description:   fmt.Sprintf("Fee refund for refund of payment %s", refund.TransactionID),
+			Metadata: map[string]interface{}{
+				"refund_id":  refund.ID,
+				"payment_id": refund.TransactionID,
+			},
+		})
+	}
+	return transfers
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal entry kinds
+const (
+	JournalRefund    = "refund"
+	JournalFeePolicy = "fee_policy"
+)
+
+// maxJournalLine bounds one journal entry
+const maxJournalLine = 4 << 20
+
+// JournalEntry is one change to the refund records: a refund saved,
+// replacing the earlier one with the same ID, or a merchant's fee refund
+// policy set
+type JournalEntry struct {
+	Kind      string     `json:"kind"`
+	Refund    *Refund    `json:"refund,omitempty"`
+	FeePolicy *FeePolicy `json:"fee_policy,omitempty"`
+}
+
+// Journal keeps refunds and fee policies across restarts
+type Journal interface {
+	Append(entry *JournalEntry) error
+	Replay(fn func(entry *JournalEntry) error) error
+}
+
+// FileJournal appends journal entries as JSON lines to a file, syncing
+// each one before it is acknowledged
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenFileJournal opens the journal at path, creating it if needed
+func OpenFileJournal(path string) (*FileJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &FileJournal{path: path, file: file}, nil
+}
+
+// Append writes an entry and syncs it to disk
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Replay calls fn with every entry in the order they were written. A last
+// line cut short by a crash is cut off so later entries start on a line
+// of their own; a corrupt line elsewhere is an error.
+func (j *FileJournal) Replay(fn func(entry *JournalEntry) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64<<10)
+	var offset int64
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Dropping incomplete last line %d of journal %s", number, j.path)
+				if err := j.file.Truncate(offset); err != nil {
+					return fmt.Errorf("failed to truncate journal: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		if len(line) > maxJournalLine {
+			return fmt.Errorf("journal line %d is too long", number)
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt journal line %d: %w", number, err)
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Close closes the journal file
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// SetJournal loads the records a journal holds and keeps every later
+// change in it. It is called before the service handles requests.
+func (s *RefundService) SetJournal(journal Journal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := journal.Replay(s.applyLocked); err != nil {
+		return fmt.Errorf("failed to load refund journal: %w", err)
+	}
+	s.journal = journal
+	return nil
+}
+
+// commitLocked writes a change to the journal and then applies it, so
+// nothing is acknowledged that a restart would lose. Callers hold s.mu.
+func (s *RefundService) commitLocked(entry *JournalEntry) error {
+	if s.journal != nil {
+		if err := s.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	return s.applyLocked(entry)
+}
+
+// applyLocked applies a journal entry to the records. Callers hold s.mu.
+func (s *RefundService) applyLocked(entry *JournalEntry) error {
+	switch entry.Kind {
+	case JournalRefund:
+		if entry.Refund == nil {
+			return errors.New("journal refund entry has no refund")
+		}
+		refund := copyRefund(entry.Refund)
+		if _, ok := s.refunds[refund.ID]; !ok {
+			s.order = append(s.order, refund.ID)
+		}
+		s.refunds[refund.ID] = refund
+	case JournalFeePolicy:
+		if entry.FeePolicy == nil {
+			return errors.New("journal fee policy entry has no policy")
+		}
+		s.policies[entry.FeePolicy.MerchantID] = entry.FeePolicy.FeeRefund
+	default:
+		return fmt.Errorf("unknown journal entry kind %q", entry.Kind)
+	}
+	return nil
+}
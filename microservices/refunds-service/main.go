@@ -1,35 +1,100 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-type Refund struct {
-	ID            string    `json:"id"`
-	TransactionID string    `json:"transaction_id"`
-	Amount        float64   `json:"amount"`
-	Reason        string    `json:"reason"`
-	Status        string    `json:"status"`
-	Currency      string    `json:"currency"`
-	CreatedAt     time.Time `json:"created_at"`
-	ProcessedAt   time.Time `json:"processed_at"`
-}
+// Global services
+var (
+	refundService *RefundService
+	batchService  *BatchService
+)
 
 func main() {
-	log.Println("Starting Refunds Service on port 8093...")
+	port := flag.String("port", "8093", "Port to listen on")
+	flag.Parse()
+
+	log.Printf("Starting Refunds Service on port %s...", *port)
+
+	paymentServiceURL := os.Getenv("PAYMENT_SERVICE_URL")
+	if paymentServiceURL == "" {
+		paymentServiceURL = "http://payment-service:8083"
+	}
+	refundService = NewRefundService(NewHTTPPaymentClient(paymentServiceURL))
+
+	// Without provider adapters refunds fail; settling them in the simulator
+	// would reverse real payments in the ledger, so it is development only
+	if os.Getenv("ENVIRONMENT") == "development" {
+		refundService.Providers().SetFallback(&SimulatedProvider{})
+		log.Printf("Development mode: simulating refunds for providers without an adapter")
+	} else {
+		log.Printf("No simulated refund provider outside development; refunds for providers without an adapter will fail")
+	}
+
+	// Refunds and merchant fee policies are journaled to disk and reloaded
+	// on start, so refunded amounts and pending follow-ups survive restarts
+	journalPath := os.Getenv("REFUNDS_JOURNAL_PATH")
+	if journalPath == "" {
+		journalPath = "data/refunds/journal.jsonl"
+	}
+	journal, err := OpenFileJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to open refund journal: %v", err)
+	}
+	defer journal.Close()
+	if err := refundService.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load refunds: %v", err)
+	}
+	log.Printf("Journaling refunds to %s", journalPath)
+
+	batchService = NewBatchService(refundService)
+	if rate := os.Getenv("BATCH_REFUNDS_PER_SECOND"); rate != "" {
+		if perSecond, err := strconv.Atoi(rate); err == nil && perSecond > 0 {
+			batchService.SetRateLimit(perSecond)
+		}
+	}
+
+	if ledgerURL := os.Getenv("LEDGER_SERVICE_URL"); ledgerURL != "" {
+		ledger := NewHTTPLedgerPoster(ledgerURL)
+		refundService.SetLedgerPoster(ledger)
+		refundService.SetBalanceReader(ledger)
+		log.Printf("Checking merchant balances and posting refund reversals to ledger service at %s", ledgerURL)
+	}
+
+	if feesURL := os.Getenv("FEES_SERVICE_URL"); feesURL != "" {
+		refundService.SetFeeClient(NewHTTPFeeClient(feesURL))
+		log.Printf("Reading payment fees from fees service at %s", feesURL)
+	}
+	if policy := os.Getenv("REFUND_FEE_POLICY"); policy != "" {
+		if err := refundService.SetDefaultFeePolicy(policy); err != nil {
+			log.Fatalf("Invalid REFUND_FEE_POLICY: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
 
 	// Health endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"refunds","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
 	// Status endpoint
-	http.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
 		status := map[string]interface{}{
 			"service": "refunds",
 			"status":  "active",
@@ -45,100 +110,342 @@ func main() {
 		json.NewEncoder(w).Encode(status)
 	})
 
-	// Create refund endpoint
-	http.HandleFunc("/api/v1/refunds", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			var request struct {
-				TransactionID string  `json:"transaction_id"`
-				Amount        float64 `json:"amount"`
-				Reason        string  `json:"reason"`
-				Currency      string  `json:"currency"`
-			}
+	mux.HandleFunc("/api/v1/refunds", handleRefunds)
+	mux.HandleFunc("/api/v1/refunds/process", handleProcessRefund)
+	mux.HandleFunc("/api/v1/refunds/", handleRefundByID)
+	mux.HandleFunc("/api/v1/refunds/batches", handleBatches)
+	mux.HandleFunc("/api/v1/refunds/batches/", handleBatchByID)
+	mux.HandleFunc("/api/v1/merchants/", handleMerchantRefundPolicy)
 
-			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-				http.Error(w, "Invalid request", http.StatusBadRequest)
-				return
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runFollowUpRetry(ctx, time.Minute)
+	go runQueuedRefunds(ctx, time.Minute)
+
+	server := &http.Server{
+		Addr:    ":" + *port,
+		Handler: mux,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	server.Shutdown(shutdownCtx)
 
-			refund := Refund{
-				ID:            fmt.Sprintf("ref_%d", time.Now().Unix()),
-				TransactionID: request.TransactionID,
-				Amount:        request.Amount,
-				Reason:        request.Reason,
-				Status:        "pending",
-				Currency:      request.Currency,
-				CreatedAt:     time.Now(),
+	log.Println("Refunds service exited")
+}
+
+// runFollowUpRetry periodically retries ledger postings and payment updates
+// of succeeded refunds
+func runFollowUpRetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if synced := refundService.RetryFollowUps(ctx); synced > 0 {
+				log.Printf("Synced %d refunds with the ledger and payment-service on retry", synced)
 			}
+		}
+	}
+}
+
+// runQueuedRefunds periodically submits refunds queued for lack of
+// merchant funds
+func runQueuedRefunds(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(refund)
-
-		case "GET":
-			// List refunds
-			refunds := []Refund{
-				{
-					ID:            "ref_001",
-					TransactionID: "txn_001",
-					Amount:        50.00,
-					Reason:        "Customer request",
-					Status:        "completed",
-					Currency:      "USD",
-					CreatedAt:     time.Now().Add(-24 * time.Hour),
-					ProcessedAt:   time.Now().Add(-23 * time.Hour),
-				},
-				{
-					ID:            "ref_002",
-					TransactionID: "txn_002",
-					Amount:        100.00,
-					Reason:        "Product defect",
-					Status:        "pending",
-					Currency:      "USD",
-					CreatedAt:     time.Now(),
-				},
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if submitted := refundService.RetryQueued(ctx); submitted > 0 {
+				log.Printf("Submitted %d queued refunds", submitted)
 			}
+		}
+	}
+}
+
+// refundErrorStatus maps refund errors to HTTP statuses
+func refundErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRefundNotFound), errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrBatchNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPaymentNotRefundable), errors.Is(err, ErrExceedsRefundable):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrInvalidTransition):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handleRefunds creates refunds and lists them, optionally
+// ?transaction_id= and ?status=
+func handleRefunds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var req CreateRefundRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		refund, err := refundService.CreateRefund(r.Context(), &req)
+		if err != nil {
+			http.Error(w, err.Error(), refundErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(refund)
+
+	case "GET":
+		refunds := refundService.ListRefunds(r.URL.Query().Get("transaction_id"), r.URL.Query().Get("status"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"refunds": refunds,
+			"total":   len(refunds),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleProcessRefund submits a pending refund to the provider
+func handleProcessRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefundID string `json:"refund_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	refund, err := refundService.ProcessRefund(r.Context(), req.RefundID)
+	if err != nil {
+		http.Error(w, err.Error(), refundErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
 
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"refunds": refunds,
-				"total":   len(refunds),
-			})
+// handleRefundByID serves GET /api/v1/refunds/{id} and
+// POST /api/v1/refunds/{id}/outcome, where providers that settle refunds
+// later report the result
+func handleRefundByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/refunds/"), "/")
+	refundID := parts[0]
+	if refundID == "" {
+		http.Error(w, "Refund ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		refund, err := refundService.GetRefund(refundID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(refund)
+
+	case len(parts) == 2 && parts[1] == "outcome" && r.Method == "POST":
+		var outcome RefundOutcome
+		if err := json.NewDecoder(r.Body).Decode(&outcome); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		refund, err := refundService.CompleteRefund(r.Context(), refundID, &outcome)
+		if err != nil {
+			http.Error(w, err.Error(), refundErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(refund)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleBatches lists batches and accepts batch files, as a multipart
+// "file" upload or the request body, in CSV or JSON by file extension,
+// ?format= or Content-Type. ?dry_run=true only validates the rows.
+func handleBatches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		body := io.Reader(r.Body)
+		fileName := ""
+		format := r.URL.Query().Get("format")
+		contentType := r.Header.Get("Content-Type")
+
+		if strings.HasPrefix(contentType, "multipart/form-data") {
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, "file is required", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			body = file
+			fileName = header.Filename
+			contentType = header.Header.Get("Content-Type")
+		}
+		if format == "" {
+			switch {
+			case strings.EqualFold(filepath.Ext(fileName), ".csv"), strings.Contains(contentType, "csv"):
+				format = "csv"
+			default:
+				format = "json"
+			}
+		}
 
+		var rows []BatchRow
+		var err error
+		switch format {
+		case "csv":
+			rows, err = ParseBatchCSV(body)
+		case "json":
+			rows, err = ParseBatchJSON(body)
 		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			http.Error(w, "format must be csv or json", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	})
 
-	// Process refund endpoint
-	http.HandleFunc("/api/v1/refunds/process", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		batch, err := batchService.SubmitBatch(r.Context(), fileName, rows, dryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		var request struct {
-			RefundID string `json:"refund_id"`
+		status := http.StatusAccepted
+		switch batch.Status {
+		case BatchStatusRejected:
+			status = http.StatusUnprocessableEntity
+		case BatchStatusValidated:
+			status = http.StatusOK
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(batch)
+
+	case "GET":
+		batches := batchService.ListBatches()
 
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"batches": batches,
+			"total":   len(batches),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBatchByID serves GET /api/v1/refunds/batches/{id} and
+// /api/v1/refunds/batches/{id}/report, the per-row results as CSV
+func handleBatchByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/refunds/batches/"), "/")
+	batch, err := batchService.GetBatch(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), refundErrorStatus(err))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(batch)
+
+	case len(parts) == 2 && parts[1] == "report":
+		data, err := BatchReportCSV(batch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-report.csv"`, batch.ID))
+		w.Write(data)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleMerchantRefundPolicy serves GET and PUT
+// /api/v1/merchants/{id}/refund-policy, whether the merchant's refunds
+// return processing fees
+func handleMerchantRefundPolicy(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/merchants/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "refund-policy" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	merchantID := parts[0]
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(refundService.GetFeePolicy(merchantID))
+
+	case "PUT":
+		var policy FeePolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		policy.MerchantID = merchantID
 
-		response := map[string]interface{}{
-			"refund_id": request.RefundID,
-			"status":    "processed",
-			"message":   "Refund processed successfully",
-			"timestamp": time.Now(),
+		if err := refundService.SetFeePolicy(&policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	})
+		json.NewEncoder(w).Encode(refundService.GetFeePolicy(merchantID))
 
-	log.Println("Refunds service listening on port 8093")
-	if err := http.ListenAndServe(":8093", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoProviderAdapter is returned for providers that have no adapter and
+// no fallback
+var ErrNoProviderAdapter = errors.New("no refund adapter for provider")
+
+// ProviderRefundRequest asks a payment provider to return funds
+type ProviderRefundRequest struct {
+	RefundID      string
+	TransactionID string
+	AmountMinor   int64
+	Currency      string
+	Reason        string
+}
+
+// ProviderRefundResult is a provider's answer to a refund request. Status
+// is succeeded or failed when the provider settles the refund at once, or
+// submitted when it reports the outcome later.
+type ProviderRefundResult struct {
+	Status           string
+	ProviderRefundID string
+	FailureReason    string
+}
+
+// ProviderAdapter submits refunds to one payment provider
+type ProviderAdapter interface {
+	Refund(ctx context.Context, req *ProviderRefundRequest) (*ProviderRefundResult, error)
+}
+
+// ProviderRegistry maps payment providers to their adapters. Providers
+// without an adapter use the fallback when one is set.
+type ProviderRegistry struct {
+	mu       sync.RWMutex
+	adapters map[string]ProviderAdapter
+	fallback ProviderAdapter
+}
+
+// NewProviderRegistry creates a registry without a fallback, so refunds of
+// unknown providers fail
+func NewProviderRegistry() *ProviderRegistry {
+	return &ProviderRegistry{
+		adapters: make(map[string]ProviderAdapter),
+	}
+}
+
+// Register sets the adapter of a provider
+func (r *ProviderRegistry) Register(provider string, adapter ProviderAdapter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.adapters[provider] = adapter
+}
+
+// SetFallback sets the adapter for providers without their own
+func (r *ProviderRegistry) SetFallback(adapter ProviderAdapter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = adapter
+}
+
+// For returns the adapter of a provider
+func (r *ProviderRegistry) For(provider string) (ProviderAdapter, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if adapter, ok := r.adapters[provider]; ok {
+		return adapter, nil
+	}
+	if r.fallback != nil {
+		return r.fallback, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoProviderAdapter, provider)
+}
+
+// SimulatedProvider settles every refund immediately. It is only installed
+// as the fallback in development, where no real provider is reachable.
+type SimulatedProvider struct{}
+
+// Refund accepts the refund
+func (p *SimulatedProvider) Refund(ctx context.Context, req *ProviderRefundRequest) (*ProviderRefundResult, error) {
+	return &ProviderRefundResult{
+		Status:           RefundStatusSucceeded,
+		ProviderRefundID: fmt.Sprintf("sim_%s", req.RefundID),
+	}, nil
+}
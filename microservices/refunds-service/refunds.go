@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Refund statuses. A refund is created pending, waits queued while the
+// merchant lacks the funds, is submitted to the provider and ends succeeded
+// or failed.
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusQueued    = "queued"
+	RefundStatusSubmitted = "submitted"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+)
+
+// Follow-up statuses of a succeeded refund's ledger posting and payment
+// update
+const (
+	SyncStatusDone   = "done"
+	SyncStatusFailed = "failed"
+)
+
+var (
+	// ErrRefundNotFound is returned for unknown refunds
+	ErrRefundNotFound = errors.New("refund not found")
+	// ErrPaymentNotRefundable is returned when the payment cannot be refunded
+	ErrPaymentNotRefundable = errors.New("payment cannot be refunded")
+	// ErrExceedsRefundable is returned when a refund is above what is left
+	// of the payment
+	ErrExceedsRefundable = errors.New("refund exceeds refundable balance")
+	// ErrInvalidTransition is returned for refund status changes the state
+	// machine does not allow
+	ErrInvalidTransition = errors.New("invalid refund status transition")
+)
+
+// refundTransitions lists the statuses each refund status can move to
+var refundTransitions = map[string][]string{
+	RefundStatusPending:   {RefundStatusQueued, RefundStatusSubmitted, RefundStatusFailed},
+	RefundStatusQueued:    {RefundStatusSubmitted, RefundStatusFailed},
+	RefundStatusSubmitted: {RefundStatusSucceeded, RefundStatusFailed},
+	RefundStatusSucceeded: {},
+	RefundStatusFailed:    {},
+}
+
+// RefundEvent records a status change of a refund
+type RefundEvent struct {
+	Status string    `json:"status"`
+	Note   string    `json:"note,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Refund returns all or part of a payment to the customer
+type Refund struct {
+	ID               string        `json:"id"`
+	TransactionID    string        `json:"transaction_id"` // the payment refunded
+	MerchantID       string        `json:"merchant_id"`
+	Provider         string        `json:"provider"`
+	Amount           float64       `json:"amount"`
+	AmountMinor      int64         `json:"amount_minor"`
+	Currency         string        `json:"currency"`
+	Reason           string        `json:"reason"`
+	FeeRefundMinor   int64         `json:"fee_refund_minor"`             // processing fee returned to the merchant
+	ReserveDrawMinor int64         `json:"reserve_draw_minor,omitempty"` // taken from the merchant's reserve
+	Status           string        `json:"status"`
+	ProviderRefundID string        `json:"provider_refund_id,omitempty"`
+	FailureReason    string        `json:"failure_reason,omitempty"`
+	LedgerStatus     string        `json:"ledger_status,omitempty"`
+	PaymentStatus    string        `json:"payment_status,omitempty"` // payment-service update
+	Events           []RefundEvent `json:"events"`
+	CreatedAt        time.Time     `json:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+	SubmittedAt      *time.Time    `json:"submitted_at,omitempty"`
+	ProcessedAt      *time.Time    `json:"processed_at,omitempty"`
+}
+
+// CreateRefundRequest asks for a refund. Without an amount the rest of the
+// payment is refunded.
+type CreateRefundRequest struct {
+	TransactionID string  `json:"transaction_id"`
+	Amount        float64 `json:"amount,omitempty"` // major units, used when AmountMinor is 0
+	AmountMinor   int64   `json:"amount_minor,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	Reason        string  `json:"reason"`
+}
+
+// RefundOutcome is a provider's final answer on a submitted refund
+type RefundOutcome struct {
+	Status           string `json:"status"` // succeeded or failed
+	ProviderRefundID string `json:"provider_refund_id,omitempty"`
+	FailureReason    string `json:"failure_reason,omitempty"`
+}
+
+// RefundService owns refund records and drives them through the provider,
+// the ledger and payment-service
+type RefundService struct {
+	mu        sync.RWMutex
+	refunds   map[string]*Refund
+	order     []string
+	payments  PaymentClient
+	providers *ProviderRegistry
+	ledger    LedgerPoster
+	balances  BalanceReader
+	fees      FeeClient
+	policies  map[string]string // fee refund policy by merchant
+	feeRefund string            // fee refund policy of other merchants
+	fundLocks map[string]*sync.Mutex
+	journal   Journal
+}
+
+// NewRefundService creates a refund service over payment-service
+func NewRefundService(payments PaymentClient) *RefundService {
+	return &RefundService{
+		refunds:   make(map[string]*Refund),
+		payments:  payments,
+		providers: NewProviderRegistry(),
+		policies:  make(map[string]string),
+		feeRefund: FeeRefundNone,
+		fundLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+// SetLedgerPoster configures posting of reversal entries to the ledger
+func (s *RefundService) SetLedgerPoster(ledger LedgerPoster) {
+	s.ledger = ledger
+}
+
+// Providers returns the provider adapters refunds are submitted through
+func (s *RefundService) Providers() *ProviderRegistry {
+	return s.providers
+}
+
+// CreateRefund validates a refund against the payment's refundable balance
+// and records it as pending
+func (s *RefundService) CreateRefund(ctx context.Context, req *CreateRefundRequest) (*Refund, error) {
+	payment, err := s.checkPayment(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	feeMinor, err := s.paymentFee(ctx, payment)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	committed := s.committedLocked(payment.ID)
+	amount, err := refundAmount(payment, req.AmountMinor, committed)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refund := &Refund{
+		ID:             generateID("ref"),
+		TransactionID:  payment.ID,
+		MerchantID:     payment.MerchantID,
+		Provider:       payment.Provider,
+		Amount:         float64(amount) / 100,
+		AmountMinor:    amount,
+		Currency:       payment.Currency,
+		Reason:         req.Reason,
+		FeeRefundMinor: s.feeRefundLocked(payment, feeMinor, amount, committed),
+		Status:         RefundStatusPending,
+		Events:         []RefundEvent{{Status: RefundStatusPending, At: now}},
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := s.commitLocked(&JournalEntry{Kind: JournalRefund, Refund: refund}); err != nil {
+		return nil, fmt.Errorf("failed to save refund: %w", err)
+	}
+
+	return copyRefund(refund), nil
+}
+
+// ValidateRefund checks a refund request as CreateRefund would without
+// recording it and returns the amount that would be refunded. heldMinor is
+// taken off the refundable balance on top of existing refunds.
+func (s *RefundService) ValidateRefund(ctx context.Context, req *CreateRefundRequest, heldMinor int64) (int64, error) {
+	payment, err := s.checkPayment(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return refundAmount(payment, req.AmountMinor, s.committedLocked(payment.ID)+heldMinor)
+}
+
+// checkPayment normalises a refund request and fetches its payment if it
+// can be refunded
+func (s *RefundService) checkPayment(ctx context.Context, req *CreateRefundRequest) (*Payment, error) {
+	if req.TransactionID == "" {
+		return nil, errors.New("transaction_id is required")
+	}
+	if req.AmountMinor == 0 && req.Amount != 0 {
+		req.AmountMinor = int64(math.Round(req.Amount * 100))
+	}
+	if req.AmountMinor < 0 {
+		return nil, errors.New("amount must be positive")
+	}
+
+	payment, err := s.payments.GetPayment(ctx, req.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if payment.Status != "completed" && payment.Status != "partially_refunded" {
+		return nil, fmt.Errorf("%w: payment %s is %s", ErrPaymentNotRefundable, payment.ID, payment.Status)
+	}
+	if req.Currency != "" && req.Currency != payment.Currency {
+		return nil, fmt.Errorf("refund currency %s does not match payment currency %s", req.Currency, payment.Currency)
+	}
+	return payment, nil
+}
+
+// refundAmount returns the amount to refund of a payment given what is
+// already committed; 0 requested means the rest
+func refundAmount(payment *Payment, requested, committed int64) (int64, error) {
+	refundable := payment.AmountMinor - committed
+	amount := requested
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		return 0, fmt.Errorf("%w: %s of %s left on payment %s", ErrExceedsRefundable,
+			formatMinorUnits(amount), formatMinorUnits(refundable), payment.ID)
+	}
+	return amount, nil
+}
+
+// committedLocked returns how much of a payment is refunded or being
+// refunded. Callers hold s.mu.
+func (s *RefundService) committedLocked(transactionID string) int64 {
+	var committed int64
+	for _, refund := range s.refunds {
+		if refund.TransactionID == transactionID && refund.Status != RefundStatusFailed {
+			committed += refund.AmountMinor
+		}
+	}
+	return committed
+}
+
+// ProcessRefund submits a pending or queued refund to the payment's
+// provider once the merchant has the funds for it; until then the refund
+// stays queued. The provider may settle it at once or answer later through
+// CompleteRefund.
+func (s *RefundService) ProcessRefund(ctx context.Context, refundID string) (*Refund, error) {
+	current, err := s.GetRefund(refundID)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(current.Status, RefundStatusSubmitted) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, current.Status, RefundStatusSubmitted)
+	}
+
+	adapter, err := s.providers.For(current.Provider)
+	if err != nil {
+		log.Printf("Failing refund %s: %v", refundID, err)
+		return s.transition(refundID, RefundStatusFailed, err.Error(), func(r *Refund) {
+			now := time.Now()
+			r.ProcessedAt = &now
+			r.FailureReason = err.Error()
+		})
+	}
+
+	refund, err := s.reserveFunds(ctx, current)
+	if errors.Is(err, ErrInvalidTransition) || errors.Is(err, ErrRefundNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		if current.Status == RefundStatusQueued {
+			return current, nil
+		}
+		log.Printf("Queueing refund %s: %v", refundID, err)
+		return s.transition(refundID, RefundStatusQueued, err.Error(), nil)
+	}
+
+	result, err := adapter.Refund(ctx, &ProviderRefundRequest{
+		RefundID:      refund.ID,
+		TransactionID: refund.TransactionID,
+		AmountMinor:   refund.AmountMinor,
+		Currency:      refund.Currency,
+		Reason:        refund.Reason,
+	})
+	if err != nil {
+		log.Printf("Provider %s failed refund %s: %v", refund.Provider, refund.ID, err)
+		result = &ProviderRefundResult{Status: RefundStatusFailed, FailureReason: err.Error()}
+	}
+
+	if result.Status == RefundStatusSubmitted {
+		return s.update(refundID, func(r *Refund) {
+			r.ProviderRefundID = result.ProviderRefundID
+		})
+	}
+
+	return s.CompleteRefund(ctx, refundID, &RefundOutcome{
+		Status:           result.Status,
+		ProviderRefundID: result.ProviderRefundID,
+		FailureReason:    result.FailureReason,
+	})
+}
+
+// CompleteRefund applies the provider's outcome to a submitted refund. A
+// succeeded refund is reversed in the ledger and reported to
+// payment-service.
+func (s *RefundService) CompleteRefund(ctx context.Context, refundID string, outcome *RefundOutcome) (*Refund, error) {
+	if outcome.Status != RefundStatusSucceeded && outcome.Status != RefundStatusFailed {
+		return nil, fmt.Errorf("%w: outcome must be %s or %s", ErrInvalidTransition, RefundStatusSucceeded, RefundStatusFailed)
+	}
+
+	refund, err := s.transition(refundID, outcome.Status, outcome.FailureReason, func(r *Refund) {
+		now := time.Now()
+		r.ProcessedAt = &now
+		if outcome.ProviderRefundID != "" {
+			r.ProviderRefundID = outcome.ProviderRefundID
+		}
+		r.FailureReason = outcome.FailureReason
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if refund.Status == RefundStatusSucceeded {
+		s.followUp(ctx, refund)
+	}
+	return s.GetRefund(refundID)
+}
+
+// followUp posts a succeeded refund's reversal to the ledger and reports
+// it to payment-service, recording what failed for RetryFollowUps. The
+// ledger books each transfer ID once, so a retry re-posts only what did
+// not go through.
+func (s *RefundService) followUp(ctx context.Context, refund *Refund) {
+	ledgerStatus := refund.LedgerStatus
+	if s.ledger != nil && ledgerStatus != SyncStatusDone {
+		ledgerStatus = SyncStatusDone
+		for _, transfer := range refundTransfers(refund) {
+			if err := s.ledger.Post(ctx, transfer); err != nil {
+				log.Printf("Failed to post refund %s to the ledger: %v", refund.ID, err)
+				ledgerStatus = SyncStatusFailed
+				break
+			}
+		}
+	}
+
+	paymentStatus := refund.PaymentStatus
+	if paymentStatus != SyncStatusDone {
+		paymentStatus = SyncStatusDone
+		if err := s.payments.RecordRefund(ctx, refund); err != nil {
+			log.Printf("Failed to report refund %s to payment-service: %v", refund.ID, err)
+			paymentStatus = SyncStatusFailed
+		}
+	}
+
+	_, err := s.update(refund.ID, func(r *Refund) {
+		r.LedgerStatus = ledgerStatus
+		r.PaymentStatus = paymentStatus
+	})
+	if err != nil {
+		log.Printf("Failed to record follow-up of refund %s: %v", refund.ID, err)
+	}
+}
+
+// RetryFollowUps retries ledger postings and payment updates of succeeded
+// refunds that failed and returns how many refunds are now in sync
+func (s *RefundService) RetryFollowUps(ctx context.Context) int {
+	s.mu.RLock()
+	var pending []*Refund
+	for _, id := range s.order {
+		refund := s.refunds[id]
+		if refund.Status == RefundStatusSucceeded && (refund.LedgerStatus == SyncStatusFailed || refund.PaymentStatus == SyncStatusFailed) {
+			pending = append(pending, copyRefund(refund))
+		}
+	}
+	s.mu.RUnlock()
+
+	synced := 0
+	for _, refund := range pending {
+		s.followUp(ctx, refund)
+		if updated, err := s.GetRefund(refund.ID); err == nil &&
+			updated.LedgerStatus != SyncStatusFailed && updated.PaymentStatus != SyncStatusFailed {
+			synced++
+		}
+	}
+	return synced
+}
+
+// transition moves a refund to a new status if the state machine allows it
+func (s *RefundService) transition(refundID, status, note string, fn func(r *Refund)) (*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refunds[refundID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRefundNotFound, refundID)
+	}
+	if !canTransition(stored.Status, status) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, stored.Status, status)
+	}
+
+	now := time.Now()
+	refund := copyRefund(stored)
+	refund.Status = status
+	refund.UpdatedAt = now
+	refund.Events = append(refund.Events, RefundEvent{Status: status, Note: note, At: now})
+	if fn != nil {
+		fn(refund)
+	}
+	if err := s.commitLocked(&JournalEntry{Kind: JournalRefund, Refund: refund}); err != nil {
+		return nil, fmt.Errorf("failed to save refund %s: %w", refundID, err)
+	}
+
+	return refund, nil
+}
+
+// update applies fn to a refund without changing its status
+func (s *RefundService) update(refundID string, fn func(r *Refund)) (*Refund, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refunds[refundID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRefundNotFound, refundID)
+	}
+	refund := copyRefund(stored)
+	fn(refund)
+	refund.UpdatedAt = time.Now()
+	if err := s.commitLocked(&JournalEntry{Kind: JournalRefund, Refund: refund}); err != nil {
+		return nil, fmt.Errorf("failed to save refund %s: %w", refundID, err)
+	}
+
+	return refund, nil
+}
+
+// canTransition reports whether a refund can move between two statuses
+func canTransition(from, to string) bool {
+	for _, allowed := range refundTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRefund returns a refund
+func (s *RefundService) GetRefund(refundID string) (*Refund, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refund, ok := s.refunds[refundID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRefundNotFound, refundID)
+	}
+	return copyRefund(refund), nil
+}
+
+// ListRefunds returns refunds, newest first, optionally for one payment and
+// status
+func (s *RefundService) ListRefunds(transactionID, status string) []*Refund {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	refunds := []*Refund{}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		refund := s.refunds[s.order[i]]
+		if transactionID != "" && refund.TransactionID != transactionID {
+			continue
+		}
+		if status != "" && refund.Status != status {
+			continue
+		}
+		refunds = append(refunds, copyRefund(refund))
+	}
+	return refunds
+}
+
+// copyRefund returns a copy of a refund safe to hand out
+func copyRefund(refund *Refund) *Refund {
+	found := *refund
+	found.Events = append([]RefundEvent(nil), refund.Events...)
+	return &found
+}
+
+// lastID keeps generated IDs unique when the clock does not advance
+// between calls
+var lastID int64
+
+// generateID returns a unique ID with the given prefix
+func generateID(prefix string) string {
+	for {
+		last := atomic.LoadInt64(&lastID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastID, last, next) {
+			return fmt.Sprintf("%s_%d", prefix, next)
+		}
+	}
+}
+
+// formatMinorUnits renders minor units as a decimal amount, e.g. -1234 as
+// "-12.34"
+func formatMinorUnits(minor int64) string {
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/100, minor%100)
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubPaymentClient struct {
+	payments map[string]*Payment
+	recorded []*Refund
+	err      error
+}
+
+func (c *stubPaymentClient) GetPayment(ctx context.Context, paymentID string) (*Payment, error) {
+	payment, ok := c.payments[paymentID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	found := *payment
+	return &found, nil
+}
+
+func (c *stubPaymentClient) RecordRefund(ctx context.Context, refund *Refund) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.recorded = append(c.recorded, refund)
+	return nil
+}
+
+type stubLedgerPoster struct {
+	transfers []*LedgerTransfer
+	err       error
+}
+
+func (l *stubLedgerPoster) Post(ctx context.Context, transfer *LedgerTransfer) error {
+	if l.err != nil {
+		return l.err
+	}
+	l.transfers = append(l.transfers, transfer)
+	return nil
+}
+
+type stubProvider struct {
+	result *ProviderRefundResult
+	err    error
+}
+
+func (p *stubProvider) Refund(ctx context.Context, req *ProviderRefundRequest) (*ProviderRefundResult, error) {
+	return p.result, p.err
+}
+
+func newTestRefundService() (*RefundService, *stubPaymentClient, *stubLedgerPoster) {
+	payments := &stubPaymentClient{payments: map[string]*Payment{
+		"pay_1": {ID: "pay_1", MerchantID: "merchant_1", Provider: "stripe", AmountMinor: 10000, Currency: "USD", Status: "completed"},
+		"pay_2": {ID: "pay_2", MerchantID: "merchant_1", Provider: "stripe", AmountMinor: 5000, Currency: "USD", Status: "pending"},
+	}}
+	ledger := &stubLedgerPoster{}
+	service := NewRefundService(payments)
+	service.Providers().SetFallback(&SimulatedProvider{})
+	service.SetLedgerPoster(ledger)
+	return service, payments, ledger
+}
+
+func TestRefundService_FailsWithoutProviderAdapter(t *testing.T) {
+	ctx := context.Background()
+	payments := &stubPaymentClient{payments: map[string]*Payment{
+		"pay_1": {ID: "pay_1", MerchantID: "merchant_1", Provider: "stripe", AmountMinor: 10000, Currency: "USD", Status: "completed"},
+	}}
+	ledger := &stubLedgerPoster{}
+	service := NewRefundService(payments)
+	service.SetLedgerPoster(ledger)
+
+	refund, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", Amount: 40, Reason: "damaged"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	refund, err = service.ProcessRefund(ctx, refund.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if refund.Status != RefundStatusFailed {
+		t.Errorf("Expected refund without a provider adapter to fail, got %s", refund.Status)
+	}
+	if len(ledger.transfers) != 0 {
+		t.Errorf("Expected no ledger reversals, got %d", len(ledger.transfers))
+	}
+	if len(payments.recorded) != 0 {
+		t.Errorf("Expected payment-service not to be told of the refund, got %d updates", len(payments.recorded))
+	}
+
+	// The failed refund no longer holds the payment's balance
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", Reason: "damaged"}); err != nil {
+		t.Errorf("Expected the full payment to be refundable again, got %v", err)
+	}
+}
+
+func TestRefundService_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	service, payments, ledger := newTestRefundService()
+
+	refund, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", Amount: 40, Reason: "damaged"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if refund.Status != RefundStatusPending || refund.AmountMinor != 4000 || refund.MerchantID != "merchant_1" {
+		t.Errorf("Expected pending refund of 4000 for merchant_1, got %+v", refund)
+	}
+
+	processed, err := service.ProcessRefund(ctx, refund.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if processed.Status != RefundStatusSucceeded || processed.ProviderRefundID == "" || len(processed.Events) != 3 {
+		t.Errorf("Expected succeeded refund with 3 events, got %+v", processed)
+	}
+	if processed.LedgerStatus != SyncStatusDone || processed.PaymentStatus != SyncStatusDone {
+		t.Errorf("Expected ledger and payment in sync, got %s and %s", processed.LedgerStatus, processed.PaymentStatus)
+	}
+
+	transfer := ledger.transfers[0]
+	if transfer.FromAccount != "merchant_1" || transfer.ToAccount != RefundsClearingAccount || transfer.AmountMinor != 4000 {
+		t.Errorf("Expected 4000 reversed from merchant_1, got %+v", transfer)
+	}
+	if len(payments.recorded) != 1 || payments.recorded[0].ID != refund.ID {
+		t.Errorf("Expected the refund reported to payment-service, got %d", len(payments.recorded))
+	}
+
+	// Finished refunds cannot be processed again
+	if _, err := service.ProcessRefund(ctx, refund.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected ErrInvalidTransition, got %v", err)
+	}
+	if _, err := service.ProcessRefund(ctx, "missing"); !errors.Is(err, ErrRefundNotFound) {
+		t.Errorf("Expected ErrRefundNotFound, got %v", err)
+	}
+}
+
+func TestRefundService_RefundableBalance(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestRefundService()
+
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_2"}); !errors.Is(err, ErrPaymentNotRefundable) {
+		t.Errorf("Expected ErrPaymentNotRefundable, got %v", err)
+	}
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "missing"}); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("Expected ErrPaymentNotFound, got %v", err)
+	}
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 100, Currency: "EUR"}); err == nil {
+		t.Error("Expected error for a currency mismatch")
+	}
+
+	// Pending refunds hold their amount
+	first, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 7000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 4000}); !errors.Is(err, ErrExceedsRefundable) {
+		t.Errorf("Expected ErrExceedsRefundable, got %v", err)
+	}
+
+	// Without an amount the rest is refunded
+	rest, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if rest.AmountMinor != 3000 {
+		t.Errorf("Expected the remaining 3000, got %d", rest.AmountMinor)
+	}
+
+	// A failed refund frees its amount
+	service.Providers().Register("stripe", &stubProvider{result: &ProviderRefundResult{Status: RefundStatusFailed, FailureReason: "card_closed"}})
+	failed, err := service.ProcessRefund(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if failed.Status != RefundStatusFailed || failed.FailureReason != "card_closed" || failed.LedgerStatus != "" {
+		t.Errorf("Expected failed refund without ledger posting, got %+v", failed)
+	}
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 7000}); err != nil {
+		t.Errorf("Expected 7000 refundable again, got %v", err)
+	}
+}
+
+func TestRefundService_AsyncOutcomeAndRetry(t *testing.T) {
+	ctx := context.Background()
+	service, payments, ledger := newTestRefundService()
+	service.Providers().Register("stripe", &stubProvider{result: &ProviderRefundResult{Status: RefundStatusSubmitted, ProviderRefundID: "re_123"}})
+
+	refund, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 2500})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	submitted, err := service.ProcessRefund(ctx, refund.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if submitted.Status != RefundStatusSubmitted || submitted.ProviderRefundID != "re_123" {
+		t.Errorf("Expected submitted refund re_123, got %+v", submitted)
+	}
+
+	if _, err := service.CompleteRefund(ctx, refund.ID, &RefundOutcome{Status: RefundStatusPending}); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Expected ErrInvalidTransition, got %v", err)
+	}
+
+	// The provider confirms while the ledger and payment-service are down
+	ledger.err = errors.New("connection refused")
+	payments.err = errors.New("connection refused")
+	succeeded, err := service.CompleteRefund(ctx, refund.ID, &RefundOutcome{Status: RefundStatusSucceeded})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if succeeded.LedgerStatus != SyncStatusFailed || succeeded.PaymentStatus != SyncStatusFailed {
+		t.Errorf("Expected failed follow-ups, got %s and %s", succeeded.LedgerStatus, succeeded.PaymentStatus)
+	}
+
+	ledger.err = nil
+	payments.err = nil
+	if synced := service.RetryFollowUps(ctx); synced != 1 {
+		t.Fatalf("Expected 1 refund synced, got %d", synced)
+	}
+	if len(ledger.transfers) != 1 || len(payments.recorded) != 1 {
+		t.Errorf("Expected one reversal and one payment update, got %d and %d", len(ledger.transfers), len(payments.recorded))
+	}
+	if synced := service.RetryFollowUps(ctx); synced != 0 {
+		t.Errorf("Expected nothing left to sync, got %d", synced)
+	}
+}
+
+func TestRefundService_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	restart := func() (*RefundService, *stubPaymentClient, *stubLedgerPoster, *FileJournal) {
+		t.Helper()
+		journal, err := OpenFileJournal(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		service, payments, ledger := newTestRefundService()
+		if err := service.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return service, payments, ledger, journal
+	}
+
+	service, payments, ledger, journal := restart()
+	if err := service.SetFeePolicy(&FeePolicy{MerchantID: "merchant_1", FeeRefund: FeeRefundProportional}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// One refund succeeds while the ledger and payment-service are down,
+	// another waits in the queue
+	ledger.err = errors.New("connection refused")
+	payments.err = errors.New("connection refused")
+	succeeded, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 6000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.ProcessRefund(ctx, succeeded.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	queued, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 1000})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := service.transition(queued.ID, RefundStatusQueued, "insufficient funds", nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	journal.Close()
+
+	service, payments, ledger, journal = restart()
+	defer journal.Close()
+
+	if refunds := service.ListRefunds("pay_1", ""); len(refunds) != 2 || refunds[0].Status != RefundStatusQueued || refunds[1].Status != RefundStatusSucceeded {
+		t.Fatalf("Expected queued and succeeded refunds after restart, got %+v", refunds)
+	}
+	if policy := service.GetFeePolicy("merchant_1"); policy.FeeRefund != FeeRefundProportional {
+		t.Errorf("Expected proportional fee policy after restart, got %s", policy.FeeRefund)
+	}
+
+	// What was refunded still counts against the payment
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 5000}); !errors.Is(err, ErrExceedsRefundable) {
+		t.Errorf("Expected ErrExceedsRefundable, got %v", err)
+	}
+
+	if synced := service.RetryFollowUps(ctx); synced != 1 {
+		t.Fatalf("Expected 1 refund synced, got %d", synced)
+	}
+	if len(ledger.transfers) != 1 || len(payments.recorded) != 1 {
+		t.Errorf("Expected one reversal and one payment update, got %d and %d", len(ledger.transfers), len(payments.recorded))
+	}
+	if submitted := service.RetryQueued(ctx); submitted != 1 {
+		t.Errorf("Expected the queued refund submitted, got %d", submitted)
+	}
+}
+
+func TestBatchService_ParseAndValidate(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestRefundService()
+	batches := NewBatchService(service)
+
+	rows, err := ParseBatchCSV(strings.NewReader("Transaction_ID,amount,currency,reason\npay_1,60.00,usd,incident\npay_1,,,incident\n\npay_2,10,,\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rows) != 3 || rows[0].Currency != "USD" || rows[2].Line != 5 {
+		t.Fatalf("Expected 3 rows with line numbers, got %+v", rows)
+	}
+	if _, err := ParseBatchCSV(strings.NewReader("id,amount\npay_1,10\n")); !errors.Is(err, ErrInvalidBatchFile) {
+		t.Errorf("Expected ErrInvalidBatchFile, got %v", err)
+	}
+
+	// The second row refunds what the first leaves; pay_2 is not completed
+	batch, err := batches.SubmitBatch(ctx, "incident.csv", rows, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if batch.Status != BatchStatusRejected || batch.InvalidRows != 1 {
+		t.Errorf("Expected rejected batch with 1 invalid row, got %s with %d", batch.Status, batch.InvalidRows)
+	}
+	if batch.Rows[1].AmountMinor != 4000 || batch.Rows[2].Status != RowStatusInvalid {
+		t.Errorf("Expected 4000 left for row 2 and row 3 invalid, got %+v and %+v", batch.Rows[1], batch.Rows[2])
+	}
+
+	rows, err = ParseBatchJSON(strings.NewReader(`{"rows":[{"transaction_id":"pay_1","amount":25.5},{"transaction_id":"pay_1","amount":"74.50"}]}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	dryRun, err := batches.SubmitBatch(ctx, "", rows, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dryRun.Status != BatchStatusValidated || dryRun.TotalMinor != 10000 {
+		t.Errorf("Expected validated batch of 10000, got %s of %d", dryRun.Status, dryRun.TotalMinor)
+	}
+	if refunds := service.ListRefunds("", ""); len(refunds) != 0 {
+		t.Errorf("Expected no refunds from dry runs, got %d", len(refunds))
+	}
+
+	over := []BatchRow{{Line: 1, TransactionID: "pay_1", Amount: "80"}, {Line: 2, TransactionID: "pay_1", Amount: "20.01"}, {Line: 3, TransactionID: "pay_1", Amount: "1.234"}}
+	batch, _ = batches.SubmitBatch(ctx, "", over, true)
+	if batch.InvalidRows != 2 || !strings.Contains(batch.Rows[1].Error, ErrExceedsRefundable.Error()) {
+		t.Errorf("Expected rows 2 and 3 invalid, got %+v", batch.Rows)
+	}
+}
+
+func TestBatchService_Process(t *testing.T) {
+	ctx := context.Background()
+	service, payments, _ := newTestRefundService()
+	payments.payments["pay_3"] = &Payment{ID: "pay_3", MerchantID: "merchant_2", Provider: "paynow", AmountMinor: 3000, Currency: "USD", Status: "completed"}
+	service.Providers().Register("paynow", &stubProvider{result: &ProviderRefundResult{Status: RefundStatusFailed, FailureReason: "insufficient_float"}})
+	batches := NewBatchService(service)
+	batches.SetRateLimit(1000)
+
+	rows := []BatchRow{
+		{Line: 2, TransactionID: "pay_1", Amount: "10", Reason: "incident"},
+		{Line: 3, TransactionID: "pay_3", Reason: "incident"},
+		{Line: 4, TransactionID: "pay_1", Amount: "90", Reason: "incident"},
+	}
+	batch, err := batches.SubmitBatch(ctx, "incident.csv", rows, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if batch.Status != BatchStatusProcessing {
+		t.Fatalf("Expected processing batch, got %s", batch.Status)
+	}
+
+	// A refund made outside the batch takes what row 4 was validated for
+	if _, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 5000}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for batch.Status != BatchStatusCompleted && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		batch, _ = batches.GetBatch(batch.ID)
+	}
+	if batch.Status != BatchStatusCompleted || batch.Processed != 3 {
+		t.Fatalf("Expected completed batch with 3 processed rows, got %s with %d", batch.Status, batch.Processed)
+	}
+	if batch.Succeeded != 1 || batch.Failed != 2 {
+		t.Errorf("Expected 1 succeeded and 2 failed, got %d and %d", batch.Succeeded, batch.Failed)
+	}
+	if batch.Rows[1].Status != RefundStatusFailed || batch.Rows[1].Error != "insufficient_float" || batch.Rows[2].Status != RowStatusError {
+		t.Errorf("Expected provider failure and refundable error, got %+v and %+v", batch.Rows[1], batch.Rows[2])
+	}
+
+	report, err := BatchReportCSV(batch)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(report)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "2,pay_1,10.00,,incident,succeeded,ref_") {
+		t.Errorf("Expected header and 3 result rows, got %q", lines)
+	}
+}
+
+type stubBalances struct {
+	balances map[string]int64
+}
+
+func (b *stubBalances) Balance(ctx context.Context, accountID string) (int64, error) {
+	balance, ok := b.balances[accountID]
+	if !ok {
+		return 0, errors.New("account not found: " + accountID)
+	}
+	return balance, nil
+}
+
+type stubFees struct {
+	fees map[string]int64
+}
+
+func (f *stubFees) GetFee(ctx context.Context, transactionID string) (int64, error) {
+	fee, ok := f.fees[transactionID]
+	if !ok {
+		return 0, ErrFeeNotFound
+	}
+	return fee, nil
+}
+
+func TestRefundService_FeeRefunds(t *testing.T) {
+	ctx := context.Background()
+	service, _, ledger := newTestRefundService()
+	service.SetFeeClient(&stubFees{fees: map[string]int64{"pay_1": 329}})
+
+	if err := service.SetFeePolicy(&FeePolicy{MerchantID: "merchant_1", FeeRefund: "half"}); err == nil {
+		t.Error("Expected error for an unknown fee refund policy")
+	}
+
+	// The default policy keeps fees
+	refund, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 1000})
+	if refund.FeeRefundMinor != 0 {
+		t.Errorf("Expected no fee refund, got %d", refund.FeeRefundMinor)
+	}
+
+	if err := service.SetFeePolicy(&FeePolicy{MerchantID: "merchant_1", FeeRefund: FeeRefundProportional}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	partial, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 2500})
+	if partial.FeeRefundMinor != 82 {
+		t.Errorf("Expected 82 fee refund rounded down, got %d", partial.FeeRefundMinor)
+	}
+
+	// The last refund returns the rest of the fee
+	last, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1"})
+	if last.AmountMinor != 6500 || last.FeeRefundMinor != 247 {
+		t.Errorf("Expected 6500 with 247 fee refund, got %d with %d", last.AmountMinor, last.FeeRefundMinor)
+	}
+
+	if _, err := service.ProcessRefund(ctx, partial.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(ledger.transfers) != 2 {
+		t.Fatalf("Expected reversal and fee refund transfers, got %d", len(ledger.transfers))
+	}
+	fee := ledger.transfers[1]
+	if fee.FromAccount != FeesReceivableAccount("merchant_1") || fee.ToAccount != FeeRevenueAccount || fee.AmountMinor != 82 {
+		t.Errorf("Expected 82 taken off merchant_1's fees receivable, got %+v", fee)
+	}
+	if ledger.transfers[0].ID == fee.ID || fee.ID != partial.ID+":fee_refund" {
+		t.Errorf("Expected each transfer keyed by the refund and its kind, got %s and %s", ledger.transfers[0].ID, fee.ID)
+	}
+}
+
+func TestHTTPLedgerPoster_PostsOneTransfer(t *testing.T) {
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/transfers" {
+			t.Errorf("Expected a transfer, got %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, body)
+		// The second attempt is a replay the ledger already booked
+		if len(requests) > 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	poster := NewHTTPLedgerPoster(server.URL)
+	transfer := reversalTransfer(&Refund{ID: "ref_1", TransactionID: "pay_1", MerchantID: "merchant_1", AmountMinor: 2500, Currency: "USD"})
+	for i := 0; i < 2; i++ {
+		if err := poster.Post(context.Background(), transfer); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	if len(requests) != 2 || requests[0]["transfer_id"] != "ref_1:reversal" || requests[1]["transfer_id"] != "ref_1:reversal" {
+		t.Fatalf("Expected both attempts keyed by the transfer ID, got %+v", requests)
+	}
+	body := requests[0]
+	if body["from_account"] != "merchant_1" || body["to_account"] != RefundsClearingAccount || body["to_account_type"] != AccountTypeLiability {
+		t.Errorf("Expected merchant_1 to refunds clearing, got %+v", body)
+	}
+	if amount := body["amount"].(map[string]interface{}); amount["value"] != "25.00" {
+		t.Errorf("Expected 25.00, got %v", amount["value"])
+	}
+}
+
+func TestRefundService_MerchantFunds(t *testing.T) {
+	ctx := context.Background()
+	service, _, ledger := newTestRefundService()
+	balances := &stubBalances{balances: map[string]int64{"merchant_1": 3000, ReserveAccount("merchant_1"): 1500}}
+	service.SetBalanceReader(balances)
+
+	// The reserve covers the shortfall
+	refund, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 4000})
+	processed, err := service.ProcessRefund(ctx, refund.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if processed.Status != RefundStatusSucceeded || processed.ReserveDrawMinor != 1000 {
+		t.Errorf("Expected succeeded refund drawing 1000 from reserve, got %s drawing %d", processed.Status, processed.ReserveDrawMinor)
+	}
+	draw := ledger.transfers[0]
+	if draw.FromAccount != ReserveAccount("merchant_1") || draw.ToAccount != "merchant_1" || draw.AmountMinor != 1000 {
+		t.Errorf("Expected 1000 drawn from the reserve first, got %+v", draw)
+	}
+	if len(ledger.transfers) != 2 || ledger.transfers[1].AmountMinor != 4000 {
+		t.Errorf("Expected reversal of 4000 after the draw, got %d transfers", len(ledger.transfers))
+	}
+
+	// Submitted refunds count against the balance until they are posted
+	balances.balances["merchant_1"] = 3000
+	balances.balances[ReserveAccount("merchant_1")] = 0
+	service.Providers().Register("stripe", &stubProvider{result: &ProviderRefundResult{Status: RefundStatusSubmitted}})
+	first, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 2500})
+	if first, _ = service.ProcessRefund(ctx, first.ID); first.Status != RefundStatusSubmitted {
+		t.Fatalf("Expected submitted refund, got %s", first.Status)
+	}
+	second, _ := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 1000})
+	queued, err := service.ProcessRefund(ctx, second.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if queued.Status != RefundStatusQueued || !strings.Contains(queued.Events[len(queued.Events)-1].Note, ErrInsufficientFunds.Error()) {
+		t.Errorf("Expected refund queued for insufficient funds, got %+v", queued)
+	}
+	if queued, _ = service.ProcessRefund(ctx, second.ID); queued.Status != RefundStatusQueued || len(queued.Events) != 2 {
+		t.Errorf("Expected refund to stay queued without new events, got %s with %d", queued.Status, len(queued.Events))
+	}
+	if submitted := service.RetryQueued(ctx); submitted != 0 {
+		t.Errorf("Expected nothing submitted, got %d", submitted)
+	}
+
+	// Once the first refund is posted and funds arrive the queue drains
+	service.CompleteRefund(ctx, first.ID, &RefundOutcome{Status: RefundStatusSucceeded})
+	balances.balances["merchant_1"] = 1500
+	if submitted := service.RetryQueued(ctx); submitted != 1 {
+		t.Fatalf("Expected 1 queued refund submitted, got %d", submitted)
+	}
+	if found, _ := service.GetRefund(second.ID); found.Status != RefundStatusSubmitted {
+		t.Errorf("Expected submitted refund, got %s", found.Status)
+	}
+}
+
+func TestRefundService_ConcurrentRefundsReserveFunds(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestRefundService()
+	service.SetBalanceReader(&stubBalances{balances: map[string]int64{"merchant_1": 3000}})
+	service.Providers().Register("stripe", &stubProvider{result: &ProviderRefundResult{Status: RefundStatusSubmitted}})
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		refund, err := service.CreateRefund(ctx, &CreateRefundRequest{TransactionID: "pay_1", AmountMinor: 1000})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		ids = append(ids, refund.ID)
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			service.ProcessRefund(ctx, id)
+		}(id)
+	}
+	wg.Wait()
+
+	if submitted := len(service.ListRefunds("", RefundStatusSubmitted)); submitted != 3 {
+		t.Errorf("Expected 3 refunds submitted against a balance of 3000, got %d", submitted)
+	}
+	if queued := len(service.ListRefunds("", RefundStatusQueued)); queued != 7 {
+		t.Errorf("Expected 7 refunds queued, got %d", queued)
+	}
+
+	// A failed refund releases its funds to the queue
+	failed := service.ListRefunds("", RefundStatusSubmitted)[0]
+	service.CompleteRefund(ctx, failed.ID, &RefundOutcome{Status: RefundStatusFailed, FailureReason: "card closed"})
+	if submitted := service.RetryQueued(ctx); submitted != 1 {
+		t.Errorf("Expected 1 queued refund submitted after the failure, got %d", submitted)
+	}
+}
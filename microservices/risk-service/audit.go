@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// RuleSetSnapshot is the exact set of rules an assessment was evaluated with
+type RuleSetSnapshot struct {
+	Version   string      `json:"version"`
+	Rules     []*RiskRule `json:"rules"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// AssessmentAudit is everything needed to explain and reproduce an
+// assessment: the request and the state it was scored against, the rule
+// set and model versions, and each intermediate score
+type AssessmentAudit struct {
+	AssessmentID   string                 `json:"assessment_id"`
+	AssessedAt     time.Time              `json:"assessed_at"`
+	Request        *AssessRiskRequest     `json:"request"`
+	Profile        RiskProfile            `json:"profile"` // as it was before the assessment
+	Velocity       map[string]interface{} `json:"velocity"`
+	Graph          map[string]interface{} `json:"graph"`
+	Inputs         map[string]interface{} `json:"inputs"` // rule environment before model scoring
+	RuleSetVersion string                 `json:"rule_set_version"`
+	ModelVersion   string                 `json:"model_version,omitempty"`
+	Scores         map[string]float64     `json:"scores"`
+	RiskScore      float64                `json:"risk_score"`
+	RiskLevel      string                 `json:"risk_level"`
+	Decision       string                 `json:"decision"`
+	DecisionRule   string                 `json:"decision_rule,omitempty"`
+	RuleHits       []RuleHit              `json:"rule_hits,omitempty"`
+	RuleErrors     []RuleError            `json:"rule_errors,omitempty"`
+}
+
+// ReplayResult compares a replayed assessment with the original
+type ReplayResult struct {
+	AssessmentID   string             `json:"assessment_id"`
+	RuleSetVersion string             `json:"rule_set_version"`
+	ModelVersion   string             `json:"model_version,omitempty"`
+	Original       RuleDecision       `json:"original"`
+	Replayed       RuleDecision       `json:"replayed"`
+	Scores         map[string]float64 `json:"scores"`
+	Matches        bool               `json:"matches"`
+	Differences    []string           `json:"differences,omitempty"`
+}
+
+// auditScoreKeys are the intermediate scores kept from assessment factors
+var auditScoreKeys = []string{
+	"velocity_score", "amount_risk_score", "payment_method_score", "context_score",
+	"link_risk_score", "behavioral_score", "heuristic_risk_score", "ml_score",
+	"base_risk_score", "rule_score_adjustment",
+}
+
+// ruleSetVersion hashes everything about the rules that affects evaluation
+func ruleSetVersion(rules []*RiskRule) string {
+	type versionedRule struct {
+		ID         string                 `json:"id"`
+		Name       string                 `json:"name"`
+		RuleType   string                 `json:"rule_type"`
+		Conditions map[string]interface{} `json:"conditions"`
+		Actions    []string               `json:"actions"`
+		Priority   int                    `json:"priority"`
+		Mode       string                 `json:"mode"`
+		IsActive   bool                   `json:"is_active"`
+		CreatedAt  time.Time              `json:"created_at"`
+	}
+
+	versioned := make([]versionedRule, 0, len(rules))
+	for _, rule := range rules {
+		versioned = append(versioned, versionedRule{
+			ID:         rule.ID,
+			Name:       rule.Name,
+			RuleType:   rule.RuleType,
+			Conditions: rule.Conditions,
+			Actions:    rule.Actions,
+			Priority:   rule.Priority,
+			Mode:       rule.Mode,
+			IsActive:   rule.IsActive,
+			CreatedAt:  rule.CreatedAt.UTC(),
+		})
+	}
+	sort.Slice(versioned, func(i, j int) bool {
+		return versioned[i].ID < versioned[j].ID
+	})
+
+	data, _ := json.Marshal(versioned)
+	sum := sha256.Sum256(data)
+	return "rs_" + hex.EncodeToString(sum[:8])
+}
+
+// snapshotRuleSet stores the rule set under its version if it is new
+func (s *Service) snapshotRuleSet(ctx context.Context, rules []*RiskRule) (string, error) {
+	version := ruleSetVersion(rules)
+
+	existing, err := s.repo.GetRuleSet(ctx, version)
+	if err != nil {
+		return "", fmt.Errorf("failed to get rule set: %w", err)
+	}
+	if existing != nil {
+		return version, nil
+	}
+
+	snapshot := &RuleSetSnapshot{Version: version, CreatedAt: time.Now()}
+	for _, rule := range rules {
+		copied := *rule
+		copied.Conditions = make(map[string]interface{}, len(rule.Conditions))
+		for key, value := range rule.Conditions {
+			copied.Conditions[key] = value
+		}
+		copied.Actions = append([]string(nil), rule.Actions...)
+		snapshot.Rules = append(snapshot.Rules, &copied)
+	}
+
+	if err := s.repo.SaveRuleSet(ctx, snapshot); err != nil {
+		return "", fmt.Errorf("failed to save rule set: %w", err)
+	}
+	return version, nil
+}
+
+// modelVersion identifies a model as name@version
+func modelVersion(model *Model) string {
+	if model == nil {
+		return ""
+	}
+	return model.Name + "@" + model.Version
+}
+
+// snapshotModel stores the model under its version if it is new
+func (s *Service) snapshotModel(ctx context.Context, model *Model) error {
+	if model == nil {
+		return nil
+	}
+
+	existing, err := s.repo.GetModelVersion(ctx, modelVersion(model))
+	if err != nil {
+		return fmt.Errorf("failed to get model: %w", err)
+	}
+	if existing != nil {
+		return nil
+	}
+
+	if err := s.repo.SaveModelVersion(ctx, model); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	return nil
+}
+
+// copyRiskProfile copies a profile so later updates do not change the audit
+func copyRiskProfile(profile *RiskProfile) RiskProfile {
+	copied := *profile
+	copied.Factors = make(map[string]interface{}, len(profile.Factors))
+	for key, value := range profile.Factors {
+		copied.Factors[key] = value
+	}
+	copied.Metadata = make(map[string]interface{}, len(profile.Metadata))
+	for key, value := range profile.Metadata {
+		copied.Metadata[key] = value
+	}
+	copied.SignalCounts = make(map[string]int, len(profile.SignalCounts))
+	for key, value := range profile.SignalCounts {
+		copied.SignalCounts[key] = value
+	}
+	copied.RulesApplied = append([]string(nil), profile.RulesApplied...)
+	return copied
+}
+
+// GetRuleSet returns a rule set snapshot by version
+func (s *Service) GetRuleSet(ctx context.Context, version string) (*RuleSetSnapshot, error) {
+	ruleSet, err := s.repo.GetRuleSet(ctx, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rule set: %w", err)
+	}
+	if ruleSet == nil {
+		return nil, fmt.Errorf("rule set not found: %s", version)
+	}
+	return ruleSet, nil
+}
+
+// GetAssessmentAudit returns the audit record of an assessment
+func (s *Service) GetAssessmentAudit(ctx context.Context, assessmentID string) (*AssessmentAudit, error) {
+	audit, err := s.repo.GetAssessmentAudit(ctx, assessmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get assessment audit: %w", err)
+	}
+	if audit == nil {
+		return nil, fmt.Errorf("assessment audit not found: %s", assessmentID)
+	}
+	return audit, nil
+}
+
+// recordAssessmentAudit persists the audit record of a finished assessment
+func (s *Service) recordAssessmentAudit(ctx context.Context, audit *AssessmentAudit, assessment *RiskAssessment) error {
+	audit.AssessmentID = assessment.ID
+	audit.RuleSetVersion = assessment.RuleSetVersion
+	audit.ModelVersion = assessment.ModelVersion
+	audit.Scores = auditScores(assessment)
+	audit.RiskScore = assessment.RiskScore
+	audit.RiskLevel = assessment.RiskLevel
+	audit.Decision = assessment.Decision
+	audit.DecisionRule = assessment.DecisionRule
+	audit.RuleHits = assessment.RuleHits
+	audit.RuleErrors = assessment.RuleErrors
+
+	if err := s.repo.CreateAssessmentAudit(ctx, audit); err != nil {
+		return fmt.Errorf("failed to create assessment audit: %w", err)
+	}
+	return nil
+}
+
+// auditScores collects the intermediate scores of an assessment
+func auditScores(assessment *RiskAssessment) map[string]float64 {
+	scores := map[string]float64{"final_risk_score": assessment.RiskScore}
+	for _, key := range auditScoreKeys {
+		if value, ok := assessment.Factors[key].(float64); ok {
+			scores[key] = value
+		}
+	}
+	return scores
+}
+
+// ReplayAssessment re-runs a historical assessment with its original
+// inputs, rule set and model version and compares the outcome
+func (s *Service) ReplayAssessment(ctx context.Context, assessmentID string) (*ReplayResult, error) {
+	audit, err := s.GetAssessmentAudit(ctx, assessmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	ruleSet, err := s.GetRuleSet(ctx, audit.RuleSetVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var model *Model
+	if audit.ModelVersion != "" {
+		model, err = s.repo.GetModelVersion(ctx, audit.ModelVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get model: %w", err)
+		}
+		if model == nil {
+			return nil, fmt.Errorf("model not found: %s", audit.ModelVersion)
+		}
+	}
+
+	// Score again as of the original assessment time
+	profile := audit.Profile
+	assessment := s.performComprehensiveRiskAssessment(ctx, audit.Request, &profile, audit.Velocity, audit.Graph, audit.AssessedAt)
+	assessment.ID = audit.AssessmentID
+
+	env := make(map[string]interface{}, len(audit.Inputs))
+	for key, value := range audit.Inputs {
+		env[key] = value
+	}
+	if err := s.scoreAssessment(assessment, env, ruleSet.Rules, model, false); err != nil {
+		return nil, fmt.Errorf("failed to replay assessment: %w", err)
+	}
+
+	result := &ReplayResult{
+		AssessmentID:   audit.AssessmentID,
+		RuleSetVersion: audit.RuleSetVersion,
+		ModelVersion:   audit.ModelVersion,
+		Original:       RuleDecision{RiskScore: audit.RiskScore, Decision: audit.Decision, DecisionRule: audit.DecisionRule},
+		Replayed:       RuleDecision{RiskScore: assessment.RiskScore, Decision: assessment.Decision, DecisionRule: assessment.DecisionRule},
+		Scores:         auditScores(assessment),
+	}
+
+	for key, original := range audit.Scores {
+		if replayed, ok := result.Scores[key]; !ok || math.Abs(replayed-original) > 1e-9 {
+			result.Differences = append(result.Differences, fmt.Sprintf("%s: %v -> %v", key, original, result.Scores[key]))
+		}
+	}
+	if result.Original.Decision != result.Replayed.Decision {
+		result.Differences = append(result.Differences, fmt.Sprintf("decision: %s -> %s", result.Original.Decision, result.Replayed.Decision))
+	}
+	if result.Original.DecisionRule != result.Replayed.DecisionRule {
+		result.Differences = append(result.Differences, fmt.Sprintf("decision_rule: %s -> %s", result.Original.DecisionRule, result.Replayed.DecisionRule))
+	}
+	sort.Strings(result.Differences)
+	result.Matches = len(result.Differences) == 0
+
+	return result, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// LabelFraud marks an assessment confirmed as fraud
+	LabelFraud = "fraud"
+
+	// LabelLegitimate marks an assessment confirmed as legitimate
+	LabelLegitimate = "legitimate"
+)
+
+// BacktestRequest describes a candidate rule set and the history to replay
+// it against
+type BacktestRequest struct {
+	// RuleIDs selects stored rules as the candidate set, whatever their mode.
+	// When empty the candidate set is every active rule with shadow rules
+	// promoted to live.
+	RuleIDs []string `json:"rule_ids,omitempty"`
+
+	// Rules are new candidate rules added to the set
+	Rules []*CreateRiskRuleRequest `json:"rules,omitempty"`
+
+	FromDate   time.Time `json:"from_date"`
+	ToDate     time.Time `json:"to_date"`
+	EntityType string    `json:"entity_type,omitempty"`
+
+	// Labels override the stored labels, keyed by assessment ID
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// FlaggedDecisions are the decisions counted as predicting fraud,
+	// block and review by default
+	FlaggedDecisions []string `json:"flagged_decisions,omitempty"`
+}
+
+// BacktestReport is the result of replaying assessments against a rule set
+type BacktestReport struct {
+	Assessments      int              `json:"assessments"`
+	Replayed         int              `json:"replayed"`
+	Skipped          int              `json:"skipped"` // recorded without rule inputs
+	Labeled          int              `json:"labeled"`
+	DecisionsChanged int              `json:"decisions_changed"`
+	Transitions      map[string]int   `json:"transitions"` // e.g. "allow->block"
+	Baseline         ConfusionMatrix  `json:"baseline"`
+	Candidate        ConfusionMatrix  `json:"candidate"`
+	RuleHits         map[string]int   `json:"rule_hits"`
+	RuleErrors       map[string]int   `json:"rule_errors,omitempty"` // rules that failed to evaluate
+	Changes          []BacktestChange `json:"changes,omitempty"`
+	FromDate         time.Time        `json:"from_date"`
+	ToDate           time.Time        `json:"to_date"`
+	CompletedAt      time.Time        `json:"completed_at"`
+}
+
+// BacktestChange is an assessment whose decision the candidate rules change
+type BacktestChange struct {
+	AssessmentID      string   `json:"assessment_id"`
+	EntityID          string   `json:"entity_id"`
+	RecordedDecision  string   `json:"recorded_decision"`
+	CandidateDecision string   `json:"candidate_decision"`
+	Label             string   `json:"label,omitempty"`
+	RulesFired        []string `json:"rules_fired"`
+}
+
+// ConfusionMatrix scores flagged decisions against fraud labels
+type ConfusionMatrix struct {
+	TruePositives  int     `json:"true_positives"`
+	FalsePositives int     `json:"false_positives"`
+	FalseNegatives int     `json:"false_negatives"`
+	TrueNegatives  int     `json:"true_negatives"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+}
+
+func (m *ConfusionMatrix) add(flagged, fraud bool) {
+	switch {
+	case flagged && fraud:
+		m.TruePositives++
+	case flagged && !fraud:
+		m.FalsePositives++
+	case !flagged && fraud:
+		m.FalseNegatives++
+	default:
+		m.TrueNegatives++
+	}
+}
+
+func (m *ConfusionMatrix) finish() {
+	if m.TruePositives+m.FalsePositives > 0 {
+		m.Precision = float64(m.TruePositives) / float64(m.TruePositives+m.FalsePositives)
+	}
+	if m.TruePositives+m.FalseNegatives > 0 {
+		m.Recall = float64(m.TruePositives) / float64(m.TruePositives+m.FalseNegatives)
+	}
+}
+
+// maxBacktestChanges caps the changed assessments listed in a report
+const maxBacktestChanges = 500
+
+// BacktestRules replays recorded assessments against a candidate rule set.
+// Each assessment is re-decided from its score before rules and the rule
+// inputs stored with it, so the replay sees exactly what the live rules saw.
+func (s *Service) BacktestRules(ctx context.Context, req *BacktestRequest) (*BacktestReport, error) {
+	if req == nil {
+		return nil, errors.New("request cannot be nil")
+	}
+
+	if req.ToDate.IsZero() {
+		req.ToDate = time.Now()
+	}
+	if req.FromDate.IsZero() {
+		req.FromDate = req.ToDate.AddDate(0, 0, -30)
+	}
+	if !req.FromDate.Before(req.ToDate) {
+		return nil, errors.New("from_date must be before to_date")
+	}
+
+	rules, err := s.backtestRuleSet(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	flagged := req.FlaggedDecisions
+	if len(flagged) == 0 {
+		flagged = []string{"block", "review"}
+	}
+	isFlagged := func(decision string) bool {
+		for _, d := range flagged {
+			if d == decision {
+				return true
+			}
+		}
+		return false
+	}
+
+	assessments, err := s.repo.ListRiskAssessments(ctx, RiskFilters{
+		EntityType: req.EntityType,
+		FromDate:   req.FromDate,
+		ToDate:     req.ToDate,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list risk assessments: %w", err)
+	}
+
+	// A fresh engine so candidate rules never share cached compilations
+	// with the live ones
+	engine := NewRuleEngine()
+
+	report := &BacktestReport{
+		Assessments: len(assessments),
+		Transitions: make(map[string]int),
+		RuleHits:    make(map[string]int),
+		RuleErrors:  make(map[string]int),
+		FromDate:    req.FromDate,
+		ToDate:      req.ToDate,
+	}
+
+	for _, assessment := range assessments {
+		if assessment.Inputs == nil {
+			report.Skipped++
+			continue
+		}
+		report.Replayed++
+
+		baseScore := assessment.RiskScore
+		if score, ok := assessment.Factors["base_risk_score"].(float64); ok {
+			baseScore = score
+		}
+
+		outcome := engine.EvaluateWithShadow(rules, assessment.Inputs)
+		for _, ruleErr := range outcome.Errors {
+			report.RuleErrors[ruleErr.RuleID]++
+		}
+		candidate := s.ruleDecision(baseScore, outcome)
+
+		var fired []string
+		for _, hit := range outcome.Hits {
+			report.RuleHits[hit.RuleID]++
+			fired = append(fired, hit.RuleID)
+		}
+
+		label := assessment.Label
+		if override, ok := req.Labels[assessment.ID]; ok {
+			label = override
+		}
+
+		if candidate.Decision != assessment.Decision {
+			report.DecisionsChanged++
+			report.Transitions[assessment.Decision+"->"+candidate.Decision]++
+			if len(report.Changes) < maxBacktestChanges {
+				report.Changes = append(report.Changes, BacktestChange{
+					AssessmentID:      assessment.ID,
+					EntityID:          assessment.EntityID,
+					RecordedDecision:  assessment.Decision,
+					CandidateDecision: candidate.Decision,
+					Label:             label,
+					RulesFired:        fired,
+				})
+			}
+		}
+
+		if label == LabelFraud || label == LabelLegitimate {
+			report.Labeled++
+			report.Baseline.add(isFlagged(assessment.Decision), label == LabelFraud)
+			report.Candidate.add(isFlagged(candidate.Decision), label == LabelFraud)
+		}
+	}
+
+	report.Baseline.finish()
+	report.Candidate.finish()
+	report.CompletedAt = time.Now()
+
+	return report, nil
+}
+
+// backtestRuleSet resolves the candidate rules of a backtest. Every rule in
+// the set is treated as live.
+func (s *Service) backtestRuleSet(ctx context.Context, req *BacktestRequest) ([]*RiskRule, error) {
+	var rules []*RiskRule
+
+	if len(req.RuleIDs) > 0 {
+		for _, id := range req.RuleIDs {
+			rule, err := s.repo.GetRiskRule(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get risk rule %s: %w", id, err)
+			}
+			if rule == nil {
+				return nil, fmt.Errorf("risk rule not found: %s", id)
+			}
+			rules = append(rules, rule)
+		}
+	} else {
+		stored, err := s.repo.ListRiskRules(ctx, RiskFilters{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list risk rules: %w", err)
+		}
+		for _, rule := range stored {
+			if rule.IsActive {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	now := time.Now()
+	for i, candidate := range req.Rules {
+		if err := s.validator.ValidateCreateRiskRuleRequest(candidate); err != nil {
+			return nil, fmt.Errorf("candidate rule %d: %w", i, err)
+		}
+		rules = append(rules, &RiskRule{
+			ID:         fmt.Sprintf("candidate_%d", i+1),
+			Name:       candidate.Name,
+			RuleType:   candidate.RuleType,
+			Conditions: candidate.Conditions,
+			Actions:    candidate.Actions,
+			Priority:   candidate.Priority,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		})
+	}
+
+	// Promote everything to live for the replay
+	candidates := make([]*RiskRule, len(rules))
+	for i, rule := range rules {
+		promoted := *rule
+		promoted.Mode = RuleModeLive
+		promoted.IsActive = true
+		candidates[i] = &promoted
+	}
+
+	return candidates, nil
+}
+
+// LabelAssessment records the known outcome of an assessment
+func (s *Service) LabelAssessment(ctx context.Context, assessmentID, label string) (*RiskAssessment, error) {
+	if label != LabelFraud && label != LabelLegitimate {
+		return nil, fmt.Errorf("invalid label: %s", label)
+	}
+
+	assessment, err := s.repo.GetRiskAssessment(ctx, assessmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get risk assessment: %w", err)
+	}
+	if assessment == nil {
+		return nil, fmt.Errorf("risk assessment not found: %s", assessmentID)
+	}
+
+	now := time.Now()
+	assessment.Label = label
+	assessment.LabeledAt = &now
+
+	if err := s.repo.UpdateRiskAssessment(ctx, assessment); err != nil {
+		return nil, fmt.Errorf("failed to update risk assessment: %w", err)
+	}
+
+	// Confirmed fraud seeds the link graph's fraud-ring search
+	if label == LabelFraud && s.links != nil {
+		s.links.SetFraud(assessment.EntityID, true)
+	}
+
+	return assessment, nil
+}
@@ -44,6 +44,8 @@ func (s *Service) CreateRiskProfileWithValidation(ctx context.Context, req *Crea
 	initialAssessment := s.performInitialRiskAssessment(profile)
 	profile.RiskScore = initialAssessment.RiskScore
 	profile.RiskLevel = initialAssessment.RiskLevel
+	profile.BaselineScore = initialAssessment.RiskScore
+	profile.ScoredAt = profile.CreatedAt
 	profile.Factors = initialAssessment.Factors
 	profile.RulesApplied = initialAssessment.RulesApplied
 
@@ -79,9 +81,11 @@ func (s *Service) UpdateRiskProfileWithValidation(ctx context.Context, req *Upda
 	}
 
 	// Update fields
+	previousLevel := profile.RiskLevel
 	if req.RiskScore != nil {
 		profile.RiskScore = *req.RiskScore
 		profile.RiskLevel = s.calculateRiskLevel(*req.RiskScore)
+		profile.ScoredAt = time.Now()
 	}
 	if req.RiskLevel != nil {
 		profile.RiskLevel = *req.RiskLevel
@@ -117,9 +121,11 @@ func (s *Service) UpdateRiskProfileWithValidation(ctx context.Context, req *Upda
 	// Enrich with metadata
 	s.enrichProfileMetadata(profile)
 
+	recordLevelHistory(profile, previousLevel)
 	if err := s.repo.UpdateRiskProfile(ctx, profile); err != nil {
 		return nil, fmt.Errorf("failed to update risk profile: %w", err)
 	}
+	s.publishLevelChange(ctx, profile, previousLevel, "manual")
 
 	return profile, nil
 }
@@ -143,31 +149,70 @@ func (s *Service) AssessRiskWithValidation(ctx context.Context, req *AssessRiskR
 	//     return nil, fmt.Errorf("assessment frequency validation failed: %w", err)
 	// }
 
+	// Read the velocity counters and graph features as they will be once
+	// this request is recorded; nothing is recorded until it is saved
+	assessmentID := generateID()
+	velocity := s.previewVelocity(ctx, req)
+	graph := s.previewLinks(ctx, req)
+
 	// Perform comprehensive risk assessment
-	assessment := s.performComprehensiveRiskAssessment(ctx, req, profile)
+	assessment := s.performComprehensiveRiskAssessment(ctx, req, profile, velocity, graph, time.Now())
+	assessment.ID = assessmentID
+
+	// Apply configured risk rules
+	audit, err := s.applyRiskRules(ctx, req, profile, velocity, graph, assessment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate risk rules: %w", err)
+	}
 
 	// Validate business rules
 	if err := s.validator.businessRuleValidator.ValidateBusinessRules(assessment); err != nil {
 		return nil, fmt.Errorf("business rule validation failed: %w", err)
 	}
 
-	// Update risk profile with new assessment
-	profile.RiskScore = assessment.RiskScore
-	profile.RiskLevel = assessment.RiskLevel
+	// Hold review decisions until an analyst decides
+	if assessment.Decision == "review" {
+		reviewCase, err := s.openReviewCase(ctx, req, assessment)
+		if err != nil {
+			return nil, err
+		}
+		assessment.ReviewCaseID = reviewCase.ID
+	}
+
+	// Save the assessment and everything needed to reproduce it before the
+	// profile moves, so a failure leaves no level change without its
+	// assessment
+	if err := s.repo.CreateRiskAssessment(ctx, assessment); err != nil {
+		return nil, fmt.Errorf("failed to create risk assessment: %w", err)
+	}
+	if err := s.recordAssessmentAudit(ctx, audit, assessment); err != nil {
+		return nil, err
+	}
+
+	// Count the request and link its devices, tokens and accounts into the
+	// entity graph now that the assessment is saved
+	s.recordVelocity(ctx, assessment.ID, req)
+	s.recordLinks(ctx, req)
+
+	// Recalculate the risk profile with the new assessment
+	previousLevel := profile.RiskLevel
+	if err := s.applyProfileSignal(profile, &ProfileSignal{
+		Type:        ProfileSignalAssessment,
+		Score:       assessment.RiskScore,
+		ReferenceID: assessment.ID,
+	}, time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to recalculate risk profile: %w", err)
+	}
+	recordLevelHistory(profile, previousLevel)
 	profile.Factors = assessment.Factors
 	profile.RulesApplied = assessment.RulesApplied
 	profile.LastAssessment = time.Now()
-	profile.UpdatedAt = time.Now()
 
 	// Save updated profile
 	if err := s.repo.UpdateRiskProfile(ctx, profile); err != nil {
 		return nil, fmt.Errorf("failed to update risk profile: %w", err)
 	}
-
-	// Save assessment
-	if err := s.repo.CreateRiskAssessment(ctx, assessment); err != nil {
-		return nil, fmt.Errorf("failed to create risk assessment: %w", err)
-	}
+	s.publishLevelChange(ctx, profile, previousLevel, ProfileSignalAssessment)
 
 	return assessment, nil
 }
@@ -187,12 +232,17 @@ func (s *Service) CreateRiskRuleWithValidation(ctx context.Context, req *CreateR
 		Conditions:  req.Conditions,
 		Actions:     req.Actions,
 		Priority:    req.Priority,
+		Mode:        RuleModeLive,
 		IsActive:    true,
 		Metadata:    req.Metadata,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
 
+	if req.Mode != "" {
+		rule.Mode = req.Mode
+	}
+
 	// Enrich with metadata
 	s.enrichRuleMetadata(rule)
 
@@ -248,7 +298,7 @@ func (s *Service) performInitialRiskAssessment(profile *RiskProfile) *RiskAssess
 }
 
 // performComprehensiveRiskAssessment performs detailed risk assessment
-func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *AssessRiskRequest, profile *RiskProfile) *RiskAssessment {
+func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *AssessRiskRequest, profile *RiskProfile, velocity, graph map[string]interface{}, now time.Time) *RiskAssessment {
 	factors := make(map[string]interface{})
 	rulesApplied := []string{}
 	
@@ -256,8 +306,9 @@ func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *A
 	score := profile.RiskScore
 
 	// Velocity analysis
-	velocityScore := s.calculateVelocityScore(ctx, req)
+	velocityScore := s.calculateVelocityScore(velocity)
 	factors["velocity_score"] = velocityScore
+	factors["velocity"] = velocity
 	score += velocityScore * 0.3
 	rulesApplied = append(rulesApplied, "velocity_analysis")
 
@@ -283,8 +334,17 @@ func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *A
 	score += contextScore * 0.25
 	rulesApplied = append(rulesApplied, "context_analysis")
 
+	// Link analysis against shared identifiers and known fraud
+	if len(graph) > 0 {
+		linkScore := s.calculateLinkRisk(graph)
+		factors["link_risk_score"] = linkScore
+		factors["graph"] = graph
+		score += linkScore * 0.3
+		rulesApplied = append(rulesApplied, "link_analysis")
+	}
+
 	// Behavioral analysis
-	behavioralScore := s.calculateBehavioralRisk(ctx, req, profile)
+	behavioralScore := s.calculateBehavioralRisk(ctx, req, profile, now)
 	factors["behavioral_score"] = behavioralScore
 	score += behavioralScore * 0.1
 	rulesApplied = append(rulesApplied, "behavioral_analysis")
@@ -293,7 +353,7 @@ func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *A
 	score = math.Min(1.0, math.Max(0.0, score))
 
 	// Calculate confidence based on available data
-	confidence := s.calculateConfidence(req, profile, factors)
+	confidence := s.calculateConfidence(req, profile, factors, now)
 
 	return &RiskAssessment{
 		ID:           generateID(),
@@ -306,24 +366,30 @@ func (s *Service) performComprehensiveRiskAssessment(ctx context.Context, req *A
 		RulesApplied: rulesApplied,
 		Confidence:   confidence,
 		Metadata:     req.Metadata,
-		CreatedAt:    time.Now(),
+		CreatedAt:    now,
 	}
 }
 
 // calculateVelocityScore calculates risk based on transaction velocity
-func (s *Service) calculateVelocityScore(ctx context.Context, req *AssessRiskRequest) float64 {
-	// This would typically query transaction history
-	// For now, return a simulated score based on context
-	if req.Context["transaction_count_24h"] != nil {
-		if count, ok := req.Context["transaction_count_24h"].(float64); ok {
-			if count > 10 {
-				return 0.8 // High velocity
-			} else if count > 5 {
-				return 0.4 // Medium velocity
-			}
+func (s *Service) calculateVelocityScore(velocity map[string]interface{}) float64 {
+	score := 0.1 // Low velocity
+
+	if count, ok := velocity["transaction_count_24h"].(float64); ok {
+		if count > 10 {
+			score = 0.8 // High velocity
+		} else if count > 5 {
+			score = 0.4 // Medium velocity
 		}
 	}
-	return 0.1 // Low velocity
+
+	// Bursts on a shared card, IP or device are riskier than on one entity
+	for _, dimension := range []string{"card", "ip", "device"} {
+		if count, ok := velocity[dimension+"_count_1h"].(float64); ok && count > 5 {
+			score = math.Max(score, 0.7)
+		}
+	}
+
+	return score
 }
 
 // calculateAmountRisk calculates risk based on transaction amount
@@ -404,11 +470,11 @@ func (s *Service) calculateContextRisk(context map[string]interface{}) float64 {
 }
 
 // calculateBehavioralRisk calculates risk based on behavioral patterns
-func (s *Service) calculateBehavioralRisk(ctx context.Context, req *AssessRiskRequest, profile *RiskProfile) float64 {
+func (s *Service) calculateBehavioralRisk(ctx context.Context, req *AssessRiskRequest, profile *RiskProfile, now time.Time) float64 {
 	score := 0.0
 
 	// Frequency deviation
-	timeSinceLastAssessment := time.Since(profile.LastAssessment)
+	timeSinceLastAssessment := now.Sub(profile.LastAssessment)
 	if timeSinceLastAssessment < 5*time.Minute {
 		score += 0.3 // Very frequent assessments
 	} else if timeSinceLastAssessment > 30*24*time.Hour {
@@ -421,7 +487,7 @@ func (s *Service) calculateBehavioralRisk(ctx context.Context, req *AssessRiskRe
 }
 
 // calculateConfidence calculates confidence in the risk assessment
-func (s *Service) calculateConfidence(req *AssessRiskRequest, profile *RiskProfile, factors map[string]interface{}) float64 {
+func (s *Service) calculateConfidence(req *AssessRiskRequest, profile *RiskProfile, factors map[string]interface{}, now time.Time) float64 {
 	confidence := 0.5 // Base confidence
 
 	// More data points increase confidence
@@ -429,7 +495,7 @@ func (s *Service) calculateConfidence(req *AssessRiskRequest, profile *RiskProfi
 	confidence += float64(dataPoints) * 0.02
 
 	// Historical data increases confidence
-	daysSinceCreation := time.Since(profile.CreatedAt).Hours() / 24
+	daysSinceCreation := now.Sub(profile.CreatedAt).Hours() / 24
 	confidence += math.Min(0.3, daysSinceCreation*0.01)
 
 	// Amount data increases confidence
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event represents a domain event published for webhooks and other consumers
+type Event struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"event_type"`
+	AggregateID string                 `json:"aggregate_id"`
+	Data        map[string]interface{} `json:"data"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// EventPublisher publishes domain events
+type EventPublisher interface {
+	Publish(ctx context.Context, event *Event) error
+}
+
+// publishEvent publishes an event if a publisher is configured. Publishing is
+// best effort: a failure is logged but never fails the business operation.
+func (s *Service) publishEvent(ctx context.Context, eventType, aggregateID string, data map[string]interface{}) {
+	if s.events == nil {
+		return
+	}
+
+	event := &Event{
+		ID:          fmt.Sprintf("evt_%d", time.Now().UnixNano()),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		Data:        data,
+		Timestamp:   time.Now(),
+	}
+
+	if err := s.events.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish %s event for %s: %v", eventType, aggregateID, err)
+	}
+}
+
+// SetEventPublisher configures where domain events are published
+func (s *Service) SetEventPublisher(events EventPublisher) {
+	s.events = events
+}
+
+// HTTPEventPublisher publishes events to the event bus service
+type HTTPEventPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPEventPublisher creates a new event bus publisher
+func NewHTTPEventPublisher(baseURL string) *HTTPEventPublisher {
+	return &HTTPEventPublisher{
+		baseURL: baseURL,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Publish sends the event to the event bus
+func (p *HTTPEventPublisher) Publish(ctx context.Context, event *Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"topic": event.Type,
+		"event": event,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/v1/publish", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("event bus returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// InMemoryEventPublisher records published events, used for testing
+type InMemoryEventPublisher struct {
+	mu     sync.RWMutex
+	events []*Event
+}
+
+// NewInMemoryEventPublisher creates a new in-memory publisher
+func NewInMemoryEventPublisher() *InMemoryEventPublisher {
+	return &InMemoryEventPublisher{}
+}
+
+func (p *InMemoryEventPublisher) Publish(ctx context.Context, event *Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+// EventsOfType returns the recorded events of the given type
+func (p *InMemoryEventPublisher) EventsOfType(eventType string) []*Event {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var events []*Event
+	for _, event := range p.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
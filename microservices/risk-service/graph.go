@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Node types of the entity-link graph
+const (
+	NodeAccount      = "account"
+	NodeDevice       = "device"
+	NodePaymentToken = "payment_token"
+	NodeMSISDN       = "msisdn"
+	NodeIP           = "ip"
+	NodeBankAccount  = "bank_account"
+)
+
+// DefaultFraudSearchHops is how many account-to-account links the fraud
+// search follows when scoring
+const DefaultFraudSearchHops = 3
+
+// identifierKeys are the context keys each identifier type is read from
+var identifierKeys = map[string][]string{
+	NodeDevice:       {"device_id", "device_fingerprint"},
+	NodePaymentToken: {"card_fingerprint", "card_token", "payment_token"},
+	NodeMSISDN:       {"msisdn", "phone", "phone_number"},
+	NodeIP:           {"ip_address", "ip"},
+	NodeBankAccount:  {"bank_account", "iban", "account_number"},
+}
+
+// identifierTypes lists identifier types in a stable order
+var identifierTypes = []string{NodeDevice, NodePaymentToken, NodeMSISDN, NodeIP, NodeBankAccount}
+
+// GraphNode is an account or an identifier accounts can share
+type GraphNode struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func (n GraphNode) key() string {
+	return n.Type + ":" + n.Value
+}
+
+// GraphEdge links an account to an identifier it used
+type GraphEdge struct {
+	Node      GraphNode `json:"node"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+}
+
+// LinkedAccount is an account reachable through shared identifiers
+type LinkedAccount struct {
+	AccountID string      `json:"account_id"`
+	Fraud     bool        `json:"fraud"`
+	SharedVia []GraphNode `json:"shared_via"`
+}
+
+// FraudPath is the shortest path from an account to a known fraudster.
+// Hops counts account-to-account links.
+type FraudPath struct {
+	AccountID      string      `json:"account_id"`
+	FraudAccountID string      `json:"fraud_account_id"`
+	Hops           int         `json:"hops"`
+	Path           []GraphNode `json:"path"`
+}
+
+// LinkGraph is a graph of accounts and the devices, payment tokens, phone
+// numbers, IPs and bank accounts they use. It is bipartite: accounts only
+// link to identifiers and identifiers only to accounts.
+type LinkGraph struct {
+	mu    sync.RWMutex
+	edges map[string]map[string]*GraphEdge
+	nodes map[string]GraphNode
+	fraud map[string]bool
+}
+
+// NewLinkGraph creates an empty link graph
+func NewLinkGraph() *LinkGraph {
+	return &LinkGraph{
+		edges: make(map[string]map[string]*GraphEdge),
+		nodes: make(map[string]GraphNode),
+		fraud: make(map[string]bool),
+	}
+}
+
+// ExtractIdentifiers reads the linkable identifiers from an assessment context
+func ExtractIdentifiers(context map[string]interface{}) []GraphNode {
+	var identifiers []GraphNode
+	for _, nodeType := range identifierTypes {
+		seen := map[string]bool{}
+		for _, key := range identifierKeys[nodeType] {
+			raw, ok := context[key].(string)
+			if !ok {
+				continue
+			}
+			value := normalizeIdentifier(nodeType, raw)
+			if value == "" || seen[value] {
+				continue
+			}
+			seen[value] = true
+			identifiers = append(identifiers, GraphNode{Type: nodeType, Value: value})
+		}
+	}
+	return identifiers
+}
+
+// normalizeIdentifier makes equal identifiers compare equal: phone numbers
+// keep digits only, bank accounts drop spaces and are upper-cased
+func normalizeIdentifier(nodeType, value string) string {
+	value = strings.TrimSpace(value)
+	switch nodeType {
+	case NodeMSISDN:
+		return strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, value)
+	case NodeBankAccount:
+		return strings.ToUpper(strings.ReplaceAll(value, " ", ""))
+	case NodeDevice, NodePaymentToken:
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// Link records that an account used the given identifiers
+func (g *LinkGraph) Link(accountID string, identifiers []GraphNode, at time.Time) {
+	if accountID == "" || len(identifiers) == 0 {
+		return
+	}
+
+	account := GraphNode{Type: NodeAccount, Value: accountID}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.nodes[account.key()] = account
+	for _, identifier := range identifiers {
+		g.nodes[identifier.key()] = identifier
+		g.addEdge(account, identifier, at)
+		g.addEdge(identifier, account, at)
+	}
+}
+
+func (g *LinkGraph) addEdge(from, to GraphNode, at time.Time) {
+	edges, exists := g.edges[from.key()]
+	if !exists {
+		edges = make(map[string]*GraphEdge)
+		g.edges[from.key()] = edges
+	}
+
+	edge, exists := edges[to.key()]
+	if !exists {
+		edge = &GraphEdge{Node: to, FirstSeen: at}
+		edges[to.key()] = edge
+	}
+	edge.LastSeen = at
+	edge.Count++
+}
+
+// SetFraud marks or clears an account as a known fraudster
+func (g *LinkGraph) SetFraud(accountID string, fraud bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	account := GraphNode{Type: NodeAccount, Value: accountID}
+	if fraud {
+		g.nodes[account.key()] = account
+		g.fraud[accountID] = true
+	} else {
+		delete(g.fraud, accountID)
+	}
+}
+
+// IsFraud reports whether an account is a known fraudster
+func (g *LinkGraph) IsFraud(accountID string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.fraud[accountID]
+}
+
+// Identifiers returns the identifiers an account has used
+func (g *LinkGraph) Identifiers(accountID string) []GraphEdge {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	account := GraphNode{Type: NodeAccount, Value: accountID}
+	edges := []GraphEdge{}
+	for _, edge := range g.edges[account.key()] {
+		edges = append(edges, *edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].Node.key() < edges[j].Node.key()
+	})
+	return edges
+}
+
+// AccountsUsing returns the accounts that used an identifier
+func (g *LinkGraph) AccountsUsing(identifier GraphNode) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	identifier.Value = normalizeIdentifier(identifier.Type, identifier.Value)
+	return g.accountsUsing(identifier.key(), "")
+}
+
+func (g *LinkGraph) accountsUsing(identifierKey, exclude string) []string {
+	accounts := []string{}
+	for _, edge := range g.edges[identifierKey] {
+		if edge.Node.Type == NodeAccount && edge.Node.Value != exclude {
+			accounts = append(accounts, edge.Node.Value)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// LinkedAccounts returns the accounts sharing any identifier with an
+// account, optionally only identifiers of one type (e.g. devices)
+func (g *LinkGraph) LinkedAccounts(accountID, identifierType string) []LinkedAccount {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.linkedAccounts(accountID, g.identifiersOf(accountID, nil), identifierType)
+}
+
+// identifiersOf returns the identifiers an account has used, and any extra
+// ones, by key
+func (g *LinkGraph) identifiersOf(accountID string, extra []GraphNode) map[string]GraphNode {
+	account := GraphNode{Type: NodeAccount, Value: accountID}
+	used := make(map[string]GraphNode, len(g.edges[account.key()])+len(extra))
+	for identifierKey, edge := range g.edges[account.key()] {
+		used[identifierKey] = edge.Node
+	}
+	for _, identifier := range extra {
+		used[identifier.key()] = identifier
+	}
+	return used
+}
+
+func (g *LinkGraph) linkedAccounts(accountID string, used map[string]GraphNode, identifierType string) []LinkedAccount {
+	linked := map[string]*LinkedAccount{}
+	for identifierKey, identifier := range used {
+		if identifierType != "" && identifier.Type != identifierType {
+			continue
+		}
+		for _, other := range g.accountsUsing(identifierKey, accountID) {
+			entry, exists := linked[other]
+			if !exists {
+				entry = &LinkedAccount{AccountID: other, Fraud: g.fraud[other]}
+				linked[other] = entry
+			}
+			entry.SharedVia = append(entry.SharedVia, identifier)
+		}
+	}
+
+	accounts := make([]LinkedAccount, 0, len(linked))
+	for _, entry := range linked {
+		sort.Slice(entry.SharedVia, func(i, j int) bool {
+			return entry.SharedVia[i].key() < entry.SharedVia[j].key()
+		})
+		accounts = append(accounts, *entry)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].AccountID < accounts[j].AccountID
+	})
+	return accounts
+}
+
+// PathToFraud finds the shortest path from an account to a known fraudster
+// within maxHops account-to-account links, or nil if there is none
+func (g *LinkGraph) PathToFraud(accountID string, maxHops int) *FraudPath {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.pathToFraud(accountID, g.identifiersOf(accountID, nil), maxHops)
+}
+
+func (g *LinkGraph) pathToFraud(accountID string, used map[string]GraphNode, maxHops int) *FraudPath {
+	start := GraphNode{Type: NodeAccount, Value: accountID}
+	parents := map[string]string{start.key(): ""}
+	frontier := []string{start.key()}
+
+	// Each account hop crosses two edges: account -> identifier -> account
+	for depth := 0; depth < maxHops*2 && len(frontier) > 0; depth++ {
+		var next []string
+		for _, current := range frontier {
+			neighbors := make([]string, 0, len(g.edges[current]))
+			if current == start.key() {
+				for neighbor := range used {
+					neighbors = append(neighbors, neighbor)
+				}
+			} else {
+				for neighbor := range g.edges[current] {
+					neighbors = append(neighbors, neighbor)
+				}
+			}
+			sort.Strings(neighbors)
+
+			for _, neighbor := range neighbors {
+				if _, seen := parents[neighbor]; seen {
+					continue
+				}
+				parents[neighbor] = current
+
+				node := g.nodes[neighbor]
+				if node.Type == NodeAccount && g.fraud[node.Value] {
+					return g.fraudPath(start, neighbor, parents, used)
+				}
+				next = append(next, neighbor)
+			}
+		}
+		frontier = next
+	}
+
+	return nil
+}
+
+func (g *LinkGraph) fraudPath(start GraphNode, target string, parents map[string]string, used map[string]GraphNode) *FraudPath {
+	var path []GraphNode
+	for key := target; key != ""; key = parents[key] {
+		// The account and its identifiers may not be linked yet
+		node, ok := g.nodes[key]
+		if !ok {
+			node, ok = used[key]
+		}
+		if !ok {
+			node = start
+		}
+		path = append([]GraphNode{node}, path...)
+	}
+	return &FraudPath{
+		AccountID:      start.Value,
+		FraudAccountID: g.nodes[target].Value,
+		Hops:           (len(path) - 1) / 2,
+		Path:           path,
+	}
+}
+
+// Features returns graph-derived scoring features for an account:
+// shared_<type>_accounts is the most other accounts sharing one identifier
+// of that type, linked_accounts the distinct accounts sharing any
+// identifier, and fraud_hops the distance to the nearest known fraudster.
+func (g *LinkGraph) Features(accountID string) map[string]interface{} {
+	return g.FeaturesWith(accountID, nil)
+}
+
+// FeaturesWith returns the features an account would have if it had also
+// used identifiers, without linking them
+func (g *LinkGraph) FeaturesWith(accountID string, identifiers []GraphNode) map[string]interface{} {
+	features := map[string]interface{}{}
+	for _, nodeType := range identifierTypes {
+		features["shared_"+nodeType+"_accounts"] = 0.0
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	used := g.identifiersOf(accountID, identifiers)
+	for identifierKey, identifier := range used {
+		shared := float64(len(g.accountsUsing(identifierKey, accountID)))
+		key := "shared_" + identifier.Type + "_accounts"
+		if shared > features[key].(float64) {
+			features[key] = shared
+		}
+	}
+	fraud := g.fraud[accountID]
+
+	linked := g.linkedAccounts(accountID, used, "")
+	fraudLinked := 0
+	for _, other := range linked {
+		if other.Fraud {
+			fraudLinked++
+		}
+	}
+	features["linked_accounts"] = float64(len(linked))
+	features["fraud_linked_accounts"] = float64(fraudLinked)
+	features["known_fraud"] = fraud
+
+	if path := g.pathToFraud(accountID, used, DefaultFraudSearchHops); path != nil {
+		features["fraud_hops"] = float64(path.Hops)
+	}
+
+	return features
+}
+
+// SetLinkGraph replaces the entity-link graph
+func (s *Service) SetLinkGraph(graph *LinkGraph) {
+	s.links = graph
+}
+
+// LinkGraph returns the entity-link graph
+func (s *Service) LinkGraph() *LinkGraph {
+	return s.links
+}
+
+// previewLinks returns the graph features the assessed entity has with the
+// request's identifiers, without adding them to the link graph
+func (s *Service) previewLinks(ctx context.Context, req *AssessRiskRequest) map[string]interface{} {
+	if s.links == nil {
+		return map[string]interface{}{}
+	}
+
+	return s.links.FeaturesWith(req.EntityID, ExtractIdentifiers(req.Context))
+}
+
+// recordLinks adds a saved assessment's identifiers to the link graph
+func (s *Service) recordLinks(ctx context.Context, req *AssessRiskRequest) {
+	if s.links == nil {
+		return
+	}
+
+	s.links.Link(req.EntityID, ExtractIdentifiers(req.Context), time.Now())
+}
+
+// calculateLinkRisk scores how closely an entity is tied to other accounts
+// and to known fraud
+func (s *Service) calculateLinkRisk(graph map[string]interface{}) float64 {
+	score := 0.0
+	raise := func(value float64) {
+		if value > score {
+			score = value
+		}
+	}
+
+	if known, _ := graph["known_fraud"].(bool); known {
+		return 1.0
+	}
+
+	if hops, ok := graph["fraud_hops"].(float64); ok {
+		switch {
+		case hops <= 1:
+			raise(0.8)
+		case hops <= 2:
+			raise(0.5)
+		default:
+			raise(0.3)
+		}
+	}
+
+	if devices, _ := graph["shared_device_accounts"].(float64); devices >= 5 {
+		raise(0.6)
+	} else if devices >= 2 {
+		raise(0.4)
+	}
+
+	for _, key := range []string{"shared_payment_token_accounts", "shared_bank_account_accounts", "shared_msisdn_accounts"} {
+		if shared, _ := graph[key].(float64); shared >= 3 {
+			raise(0.5)
+		} else if shared >= 1 {
+			raise(0.3)
+		}
+	}
+
+	return score
+}
+
+// parseGraphNode parses an identifier given as type and value
+func parseGraphNode(nodeType, value string) (GraphNode, error) {
+	for _, known := range identifierTypes {
+		if nodeType == known {
+			return GraphNode{Type: nodeType, Value: value}, nil
+		}
+	}
+	return GraphNode{}, fmt.Errorf("unknown identifier type: %s", nodeType)
+}
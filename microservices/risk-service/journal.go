@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal entry kinds
+const (
+	JournalProfile       = "profile"
+	JournalProfileDelete = "profile_delete"
+	JournalRule          = "rule"
+	JournalRuleDelete    = "rule_delete"
+	JournalAssessment    = "assessment"
+	JournalReviewCase    = "review_case"
+	JournalAudit         = "audit"
+	JournalRuleSet       = "rule_set"
+	JournalModel         = "model"
+)
+
+// maxJournalLine bounds one journal entry
+const maxJournalLine = 4 << 20
+
+// JournalEntry is one write to the repository: a record saved, replacing
+// the earlier one with the same key, or a profile or rule deleted by key
+type JournalEntry struct {
+	Kind       string           `json:"kind"`
+	Key        string           `json:"key,omitempty"` // of a deleted record
+	Profile    *RiskProfile     `json:"profile,omitempty"`
+	Rule       *RiskRule        `json:"rule,omitempty"`
+	Assessment *RiskAssessment  `json:"assessment,omitempty"`
+	ReviewCase *ReviewCase      `json:"review_case,omitempty"`
+	Audit      *AssessmentAudit `json:"audit,omitempty"`
+	RuleSet    *RuleSetSnapshot `json:"rule_set,omitempty"`
+	Model      *Model           `json:"model,omitempty"`
+}
+
+// Journal keeps the in-memory repository across restarts
+type Journal interface {
+	Append(entry *JournalEntry) error
+	Replay(fn func(entry *JournalEntry) error) error
+}
+
+// FileJournal appends journal entries as JSON lines to a file, syncing
+// each one before it is acknowledged
+type FileJournal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenFileJournal opens the journal at path, creating it if needed
+func OpenFileJournal(path string) (*FileJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	return &FileJournal{path: path, file: file}, nil
+}
+
+// Append writes an entry and syncs it to disk
+func (j *FileJournal) Append(entry *JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Replay calls fn with every entry in the order they were written. A last
+// line cut short by a crash is cut off so later entries start on a line
+// of their own; a corrupt line elsewhere is an error.
+func (j *FileJournal) Replay(fn func(entry *JournalEntry) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64<<10)
+	var offset int64
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Dropping incomplete last line %d of journal %s", number, j.path)
+				if err := j.file.Truncate(offset); err != nil {
+					return fmt.Errorf("failed to truncate journal: %w", err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		if len(line) > maxJournalLine {
+			return fmt.Errorf("journal line %d is too long", number)
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("corrupt journal line %d: %w", number, err)
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Close closes the journal file
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// SetJournal loads the records a journal holds and keeps every later
+// write in it. It is called before the service handles requests.
+func (r *InMemoryRepository) SetJournal(journal Journal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := journal.Replay(r.applyLocked); err != nil {
+		return fmt.Errorf("failed to load risk journal: %w", err)
+	}
+	r.journal = journal
+	return nil
+}
+
+// commitLocked writes a change to the journal and then applies it, so
+// nothing is acknowledged that a restart would lose. Callers hold r.mu.
+func (r *InMemoryRepository) commitLocked(entry *JournalEntry) error {
+	if r.journal != nil {
+		if err := r.journal.Append(entry); err != nil {
+			return err
+		}
+	}
+	return r.applyLocked(entry)
+}
+
+// applyLocked applies a journal entry to the records. Callers hold r.mu.
+func (r *InMemoryRepository) applyLocked(entry *JournalEntry) error {
+	switch entry.Kind {
+	case JournalProfile:
+		if entry.Profile == nil {
+			return errors.New("journal profile entry has no profile")
+		}
+		stored := *entry.Profile
+		r.profiles[stored.EntityID] = &stored
+	case JournalProfileDelete:
+		delete(r.profiles, entry.Key)
+	case JournalRule:
+		if entry.Rule == nil {
+			return errors.New("journal rule entry has no rule")
+		}
+		stored := *entry.Rule
+		r.rules[stored.ID] = &stored
+	case JournalRuleDelete:
+		delete(r.rules, entry.Key)
+	case JournalAssessment:
+		if entry.Assessment == nil {
+			return errors.New("journal assessment entry has no assessment")
+		}
+		stored := *entry.Assessment
+		r.assessments[stored.ID] = &stored
+	case JournalReviewCase:
+		if entry.ReviewCase == nil {
+			return errors.New("journal review case entry has no case")
+		}
+		stored := *entry.ReviewCase
+		r.reviews[stored.ID] = &stored
+	case JournalAudit:
+		if entry.Audit == nil {
+			return errors.New("journal audit entry has no audit")
+		}
+		stored := *entry.Audit
+		r.audits[stored.AssessmentID] = &stored
+	case JournalRuleSet:
+		if entry.RuleSet == nil {
+			return errors.New("journal rule set entry has no rule set")
+		}
+		stored := *entry.RuleSet
+		r.ruleSets[stored.Version] = &stored
+	case JournalModel:
+		if entry.Model == nil {
+			return errors.New("journal model entry has no model")
+		}
+		r.models[modelVersion(entry.Model)] = entry.Model
+	default:
+		return fmt.Errorf("unknown journal entry kind %q", entry.Kind)
+	}
+	return nil
+}
@@ -0,0 +1,993 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions limits apply to
+const (
+	LimitActionPayment  = "payment"
+	LimitActionTransfer = "transfer"
+	LimitActionEscrow   = "escrow"
+)
+
+// ErrReservationNotFound is returned when releasing an unknown reservation
+var ErrReservationNotFound = errors.New("limit reservation not found")
+
+// ErrLimitUsageUnavailable is returned when the usage counters cannot be
+// read or updated
+var ErrLimitUsageUnavailable = errors.New("limit usage unavailable")
+
+// LimitScope selects who a limit rule applies to. Empty fields match
+// anything; the most specific matching rule wins.
+type LimitScope struct {
+	EntityID   string `json:"entity_id,omitempty"`
+	EntityType string `json:"entity_type,omitempty"`
+	Tier       string `json:"tier,omitempty"`
+	RiskLevel  string `json:"risk_level,omitempty"`
+}
+
+// specificity ranks scopes: an entity beats a risk level, which beats a tier
+func (s LimitScope) specificity() int {
+	score := 0
+	if s.EntityID != "" {
+		score += 32
+	}
+	if s.RiskLevel != "" {
+		score += 8
+	}
+	if s.Tier != "" {
+		score += 4
+	}
+	if s.EntityType != "" {
+		score += 2
+	}
+	return score
+}
+
+// Limits are amount and count limits. Amounts are in minor units; zero
+// means unlimited.
+type Limits struct {
+	PerTransaction int64 `json:"per_transaction_minor,omitempty"`
+	DailyAmount    int64 `json:"daily_amount_minor,omitempty"`
+	MonthlyAmount  int64 `json:"monthly_amount_minor,omitempty"`
+	DailyCount     int64 `json:"daily_count,omitempty"`
+	MonthlyCount   int64 `json:"monthly_count,omitempty"`
+}
+
+// LimitRule sets limits for an action within a scope
+type LimitRule struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scope     LimitScope `json:"scope"`
+	Action    string     `json:"action,omitempty"`   // payment, transfer, escrow; empty for all
+	Currency  string     `json:"currency,omitempty"` // empty for all
+	Limits    Limits     `json:"limits"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func (r *LimitRule) specificity() int {
+	score := r.Scope.specificity()
+	if r.Action != "" {
+		score++
+	}
+	if r.Currency != "" {
+		score++
+	}
+	return score
+}
+
+// LimitIncrease temporarily raises an entity's limits. Increases add to the
+// matching rule's limits and never lift an unlimited dimension.
+type LimitIncrease struct {
+	ID        string    `json:"id"`
+	EntityID  string    `json:"entity_id"`
+	Action    string    `json:"action,omitempty"`
+	Currency  string    `json:"currency,omitempty"`
+	Increase  Limits    `json:"increase"`
+	Reason    string    `json:"reason"`
+	GrantedBy string    `json:"granted_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LimitRequest asks to use limit for an action
+type LimitRequest struct {
+	EntityID    string `json:"entity_id"`
+	EntityType  string `json:"entity_type,omitempty"`
+	Tier        string `json:"tier,omitempty"`
+	Action      string `json:"action"`
+	Amount      *Money `json:"amount"`
+	ReferenceID string `json:"reference_id,omitempty"` // consuming twice for one reference counts once
+}
+
+// LimitHeadroom is what is left of each limit. Nil fields are unlimited.
+type LimitHeadroom struct {
+	Currency       string     `json:"currency"`
+	RiskLevel      string     `json:"risk_level,omitempty"`
+	RuleID         string     `json:"rule_id,omitempty"`
+	PerTransaction *int64     `json:"per_transaction_minor,omitempty"`
+	DailyAmount    *int64     `json:"daily_amount_minor,omitempty"`
+	MonthlyAmount  *int64     `json:"monthly_amount_minor,omitempty"`
+	DailyCount     *int64     `json:"daily_count,omitempty"`
+	MonthlyCount   *int64     `json:"monthly_count,omitempty"`
+	IncreaseIDs    []string   `json:"increase_ids,omitempty"`
+	IncreaseUntil  *time.Time `json:"increase_until,omitempty"`
+}
+
+// LimitDecision is the outcome of consuming a limit
+type LimitDecision struct {
+	Allowed       bool          `json:"allowed"`
+	Reason        string        `json:"reason,omitempty"`
+	ReservationID string        `json:"reservation_id,omitempty"`
+	Headroom      LimitHeadroom `json:"headroom"`
+}
+
+// LimitReservation is usage consumed by one action, kept so it can be
+// released if the action does not go ahead. Reservations are kept until
+// the end of their month, after which their usage no longer counts.
+type LimitReservation struct {
+	ID          string    `json:"id"`
+	EntityID    string    `json:"entity_id"`
+	Action      string    `json:"action"`
+	Currency    string    `json:"currency"`
+	Amount      int64     `json:"amount_minor"`
+	ReferenceID string    `json:"reference_id,omitempty"`
+	Day         string    `json:"day"`
+	Month       string    `json:"month"`
+	Released    bool      `json:"released"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type limitUsage struct {
+	amount int64
+	count  int64
+}
+
+// LimitUsageStore keeps the usage counters and reservations of the limits
+type LimitUsageStore interface {
+	// Reserve adds a reservation to its day and month usage if it fits
+	// within limits, checking and adding atomically. A reference that
+	// already holds an unreleased reservation is not counted again. It
+	// returns the ID of the reservation holding the usage, or the reason
+	// the limits refused it.
+	Reserve(ctx context.Context, reservation *LimitReservation, limits Limits) (string, string, error)
+	// Usage returns the day and month usage of an entity's action in a currency
+	Usage(ctx context.Context, entityID, action, currency string, now time.Time) (limitUsage, limitUsage, error)
+	// Release gives back the usage of a reservation
+	Release(ctx context.Context, reservationID string) (*LimitReservation, error)
+}
+
+// LimitEngine holds limit rules and temporary increases, and checks
+// requests against them using the usage in its store
+type LimitEngine struct {
+	mu        sync.Mutex
+	rules     map[string]*LimitRule
+	increases map[string]*LimitIncrease
+	usage     LimitUsageStore
+	sequence  int64
+}
+
+// NewLimitEngine creates a limit engine with the default rules and
+// in-memory usage counters
+func NewLimitEngine() *LimitEngine {
+	engine := &LimitEngine{
+		rules:     make(map[string]*LimitRule),
+		increases: make(map[string]*LimitIncrease),
+		usage:     NewInMemoryLimitUsageStore(),
+	}
+	for _, rule := range DefaultLimitRules() {
+		engine.rules[rule.ID] = rule
+	}
+	return engine
+}
+
+// DefaultLimitRules returns the built-in limits: the former fixed maximums
+// per action, tightened for high and critical risk entities
+func DefaultLimitRules() []*LimitRule {
+	now := time.Now()
+	rule := func(id, name, action, riskLevel string, limits Limits) *LimitRule {
+		return &LimitRule{
+			ID:        id,
+			Name:      name,
+			Scope:     LimitScope{RiskLevel: riskLevel},
+			Action:    action,
+			Limits:    limits,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+	}
+
+	return []*LimitRule{
+		rule("limit_default_payment", "Default payment limit", LimitActionPayment, "", Limits{PerTransaction: 100000000}),
+		rule("limit_default_transfer", "Default transfer limit", LimitActionTransfer, "", Limits{PerTransaction: 1000000000}),
+		rule("limit_default_escrow", "Default escrow limit", LimitActionEscrow, "", Limits{PerTransaction: 100000000}),
+		rule("limit_high_risk", "High risk limit", "", "high", Limits{PerTransaction: 1000000, DailyAmount: 5000000, DailyCount: 20}),
+		rule("limit_critical_risk", "Critical risk limit", "", "critical", Limits{PerTransaction: 100000, DailyAmount: 200000, DailyCount: 5}),
+	}
+}
+
+// SetUsageStore configures where usage counters and reservations are kept
+func (e *LimitEngine) SetUsageStore(store LimitUsageStore) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.usage = store
+}
+
+func (e *LimitEngine) nextID(prefix string) string {
+	e.sequence++
+	return fmt.Sprintf("%s_%d_%d", prefix, time.Now().UnixNano(), e.sequence)
+}
+
+// newReservationID returns a reservation ID that is unique across
+// replicas sharing a usage store
+func newReservationID() (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("limit_reservation_%d_%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// SetRule creates or replaces a limit rule
+func (e *LimitEngine) SetRule(rule *LimitRule) *LimitRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if rule.ID == "" {
+		rule.ID = e.nextID("limit")
+		rule.CreatedAt = now
+	} else if existing, ok := e.rules[rule.ID]; ok {
+		rule.CreatedAt = existing.CreatedAt
+	} else {
+		rule.CreatedAt = now
+	}
+	rule.UpdatedAt = now
+
+	stored := *rule
+	e.rules[rule.ID] = &stored
+	return rule
+}
+
+// Rules returns the limit rules, most specific first
+func (e *LimitEngine) Rules() []*LimitRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules := make([]*LimitRule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		found := *rule
+		rules = append(rules, &found)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].specificity() != rules[j].specificity() {
+			return rules[i].specificity() > rules[j].specificity()
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules
+}
+
+// GrantIncrease records a temporary limit increase
+func (e *LimitEngine) GrantIncrease(increase *LimitIncrease) *LimitIncrease {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	increase.ID = e.nextID("limit_increase")
+	increase.CreatedAt = time.Now()
+	e.pruneIncreases(increase.CreatedAt)
+
+	stored := *increase
+	e.increases[increase.ID] = &stored
+	return increase
+}
+
+// Increases returns an entity's increases that are still active at now
+func (e *LimitEngine) Increases(entityID string, now time.Time) []*LimitIncrease {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.pruneIncreases(now)
+	increases := []*LimitIncrease{}
+	for _, increase := range e.increases {
+		if (entityID == "" || increase.EntityID == entityID) && now.Before(increase.ExpiresAt) {
+			found := *increase
+			increases = append(increases, &found)
+		}
+	}
+	sort.Slice(increases, func(i, j int) bool {
+		return increases[i].CreatedAt.Before(increases[j].CreatedAt)
+	})
+	return increases
+}
+
+// Consume checks a request against the entity's limits and, if it fits,
+// adds it to the usage counters. riskLevel is the entity's current level.
+func (e *LimitEngine) Consume(ctx context.Context, req *LimitRequest, riskLevel string, amount int64, now time.Time) (*LimitDecision, error) {
+	currency := req.Amount.Currency
+
+	e.mu.Lock()
+	limits, headroom := e.effectiveLimits(req, riskLevel, currency, now)
+	store := e.usage
+	e.mu.Unlock()
+
+	id, err := newReservationID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate reservation ID: %w", err)
+	}
+	dayKey, monthKey := periodKeys(now)
+	reservation := &LimitReservation{
+		ID:          id,
+		EntityID:    req.EntityID,
+		Action:      req.Action,
+		Currency:    currency,
+		Amount:      amount,
+		ReferenceID: req.ReferenceID,
+		Day:         dayKey,
+		Month:       monthKey,
+		CreatedAt:   now,
+	}
+
+	reservationID, reason, err := store.Reserve(ctx, reservation, limits)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLimitUsageUnavailable, err)
+	}
+	if err := fillHeadroom(ctx, store, &headroom, limits, req.EntityID, req.Action, currency, now); err != nil {
+		return nil, err
+	}
+	if reason != "" {
+		return &LimitDecision{Allowed: false, Reason: reason, Headroom: headroom}, nil
+	}
+	return &LimitDecision{Allowed: true, ReservationID: reservationID, Headroom: headroom}, nil
+}
+
+// Headroom returns what is left of the entity's limits without consuming
+func (e *LimitEngine) Headroom(ctx context.Context, req *LimitRequest, riskLevel, currency string, now time.Time) (LimitHeadroom, error) {
+	e.mu.Lock()
+	limits, headroom := e.effectiveLimits(req, riskLevel, currency, now)
+	store := e.usage
+	e.mu.Unlock()
+
+	err := fillHeadroom(ctx, store, &headroom, limits, req.EntityID, req.Action, currency, now)
+	return headroom, err
+}
+
+// Release gives back the usage of a reservation whose action did not go ahead
+func (e *LimitEngine) Release(ctx context.Context, reservationID string) (*LimitReservation, error) {
+	e.mu.Lock()
+	store := e.usage
+	e.mu.Unlock()
+
+	reservation, err := store.Release(ctx, reservationID)
+	if err != nil && !errors.Is(err, ErrReservationNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrLimitUsageUnavailable, err)
+	}
+	return reservation, err
+}
+
+// pruneIncreases drops increases that have expired. Callers hold e.mu.
+func (e *LimitEngine) pruneIncreases(now time.Time) {
+	for id, increase := range e.increases {
+		if !now.Before(increase.ExpiresAt) {
+			delete(e.increases, id)
+		}
+	}
+}
+
+// effectiveLimits picks the most specific matching rule and adds active
+// increases to it
+func (e *LimitEngine) effectiveLimits(req *LimitRequest, riskLevel, currency string, now time.Time) (Limits, LimitHeadroom) {
+	headroom := LimitHeadroom{Currency: currency, RiskLevel: riskLevel}
+
+	var selected *LimitRule
+	for _, rule := range e.rules {
+		if !rule.matches(req, riskLevel, currency) {
+			continue
+		}
+		if selected == nil || rule.specificity() > selected.specificity() ||
+			(rule.specificity() == selected.specificity() && rule.ID < selected.ID) {
+			selected = rule
+		}
+	}
+	if selected == nil {
+		return Limits{}, headroom
+	}
+
+	limits := selected.Limits
+	headroom.RuleID = selected.ID
+
+	raise := func(limit *int64, by int64) {
+		if *limit > 0 {
+			*limit += by
+		}
+	}
+	e.pruneIncreases(now)
+	for _, increase := range e.increases {
+		if increase.EntityID != req.EntityID {
+			continue
+		}
+		if (increase.Action != "" && increase.Action != req.Action) || (increase.Currency != "" && increase.Currency != currency) {
+			continue
+		}
+		raise(&limits.PerTransaction, increase.Increase.PerTransaction)
+		raise(&limits.DailyAmount, increase.Increase.DailyAmount)
+		raise(&limits.MonthlyAmount, increase.Increase.MonthlyAmount)
+		raise(&limits.DailyCount, increase.Increase.DailyCount)
+		raise(&limits.MonthlyCount, increase.Increase.MonthlyCount)
+
+		headroom.IncreaseIDs = append(headroom.IncreaseIDs, increase.ID)
+		if headroom.IncreaseUntil == nil || increase.ExpiresAt.Before(*headroom.IncreaseUntil) {
+			until := increase.ExpiresAt
+			headroom.IncreaseUntil = &until
+		}
+	}
+	sort.Strings(headroom.IncreaseIDs)
+
+	return limits, headroom
+}
+
+func (r *LimitRule) matches(req *LimitRequest, riskLevel, currency string) bool {
+	return (r.Scope.EntityID == "" || r.Scope.EntityID == req.EntityID) &&
+		(r.Scope.EntityType == "" || r.Scope.EntityType == req.EntityType) &&
+		(r.Scope.Tier == "" || r.Scope.Tier == req.Tier) &&
+		(r.Scope.RiskLevel == "" || r.Scope.RiskLevel == riskLevel) &&
+		(r.Action == "" || r.Action == req.Action) &&
+		(r.Currency == "" || r.Currency == currency)
+}
+
+func fillHeadroom(ctx context.Context, store LimitUsageStore, headroom *LimitHeadroom, limits Limits, entityID, action, currency string, now time.Time) error {
+	day, month, err := store.Usage(ctx, entityID, action, currency, now)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLimitUsageUnavailable, err)
+	}
+	remaining := func(limit, used int64) *int64 {
+		if limit <= 0 {
+			return nil
+		}
+		left := limit - used
+		if left < 0 {
+			left = 0
+		}
+		return &left
+	}
+
+	headroom.PerTransaction = remaining(limits.PerTransaction, 0)
+	headroom.DailyAmount = remaining(limits.DailyAmount, day.amount)
+	headroom.MonthlyAmount = remaining(limits.MonthlyAmount, month.amount)
+	headroom.DailyCount = remaining(limits.DailyCount, day.count)
+	headroom.MonthlyCount = remaining(limits.MonthlyCount, month.count)
+	return nil
+}
+
+// exceededLimit returns why an amount does not fit within limits given the
+// day and month usage, or "" when it fits
+func exceededLimit(limits Limits, amount int64, day, month limitUsage) string {
+	switch {
+	case limits.PerTransaction > 0 && amount > limits.PerTransaction:
+		return "amount exceeds per-transaction limit"
+	case limits.DailyAmount > 0 && day.amount+amount > limits.DailyAmount:
+		return "amount exceeds daily limit"
+	case limits.MonthlyAmount > 0 && month.amount+amount > limits.MonthlyAmount:
+		return "amount exceeds monthly limit"
+	case limits.DailyCount > 0 && day.count+1 > limits.DailyCount:
+		return "daily transaction count limit reached"
+	case limits.MonthlyCount > 0 && month.count+1 > limits.MonthlyCount:
+		return "monthly transaction count limit reached"
+	}
+	return ""
+}
+
+func usageKey(entityID, action, currency string) string {
+	return entityID + "|" + action + "|" + currency
+}
+
+func referenceKey(action, referenceID string) string {
+	return action + "|" + referenceID
+}
+
+// periodKeys returns the UTC day and month usage periods for a time
+func periodKeys(now time.Time) (string, string) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), now.Format("2006-01")
+}
+
+// periodEnds returns when the UTC day and month of a time end
+func periodEnds(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	year, month, day := now.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC), time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// InMemoryLimitUsageStore implements LimitUsageStore in memory. Counters of
+// past periods and reservations of past months are dropped once a day.
+type InMemoryLimitUsageStore struct {
+	mu           sync.Mutex
+	usage        map[string]*limitUsage
+	reservations map[string]*LimitReservation
+	references   map[string]string
+	day          string // period of the last prune
+}
+
+// NewInMemoryLimitUsageStore creates a new in-memory limit usage store
+func NewInMemoryLimitUsageStore() *InMemoryLimitUsageStore {
+	return &InMemoryLimitUsageStore{
+		usage:        make(map[string]*limitUsage),
+		reservations: make(map[string]*LimitReservation),
+		references:   make(map[string]string),
+	}
+}
+
+func (m *InMemoryLimitUsageStore) Reserve(ctx context.Context, reservation *LimitReservation, limits Limits) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune(reservation.Day, reservation.Month)
+	if reservation.ReferenceID != "" {
+		if id, ok := m.references[referenceKey(reservation.Action, reservation.ReferenceID)]; ok {
+			return id, "", nil
+		}
+	}
+
+	base := usageKey(reservation.EntityID, reservation.Action, reservation.Currency)
+	day, month := m.counter(base+"|"+reservation.Day), m.counter(base+"|"+reservation.Month)
+	if reason := exceededLimit(limits, reservation.Amount, *day, *month); reason != "" {
+		return "", reason, nil
+	}
+
+	day.amount += reservation.Amount
+	day.count++
+	month.amount += reservation.Amount
+	month.count++
+	stored := *reservation
+	m.reservations[reservation.ID] = &stored
+	if reservation.ReferenceID != "" {
+		m.references[referenceKey(reservation.Action, reservation.ReferenceID)] = reservation.ID
+	}
+	return reservation.ID, "", nil
+}
+
+func (m *InMemoryLimitUsageStore) Usage(ctx context.Context, entityID, action, currency string, now time.Time) (limitUsage, limitUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	base := usageKey(entityID, action, currency)
+	dayKey, monthKey := periodKeys(now)
+	var day, month limitUsage
+	if usage, ok := m.usage[base+"|"+dayKey]; ok {
+		day = *usage
+	}
+	if usage, ok := m.usage[base+"|"+monthKey]; ok {
+		month = *usage
+	}
+	return day, month, nil
+}
+
+func (m *InMemoryLimitUsageStore) Release(ctx context.Context, reservationID string) (*LimitReservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reservation, ok := m.reservations[reservationID]
+	if !ok {
+		return nil, ErrReservationNotFound
+	}
+
+	if !reservation.Released {
+		base := usageKey(reservation.EntityID, reservation.Action, reservation.Currency)
+		for _, key := range []string{base + "|" + reservation.Day, base + "|" + reservation.Month} {
+			if usage, ok := m.usage[key]; ok {
+				usage.amount -= reservation.Amount
+				usage.count--
+			}
+		}
+		reservation.Released = true
+		if reservation.ReferenceID != "" {
+			delete(m.references, referenceKey(reservation.Action, reservation.ReferenceID))
+		}
+	}
+
+	found := *reservation
+	return &found, nil
+}
+
+// counter returns the usage counter at key, creating it as needed
+func (m *InMemoryLimitUsageStore) counter(key string) *limitUsage {
+	usage, ok := m.usage[key]
+	if !ok {
+		usage = &limitUsage{}
+		m.usage[key] = usage
+	}
+	return usage
+}
+
+// prune drops counters of other periods than day and month, and the
+// reservations of other months, the first time a day is seen
+func (m *InMemoryLimitUsageStore) prune(day, month string) {
+	if day == m.day {
+		return
+	}
+	m.day = day
+
+	for key := range m.usage {
+		if !strings.HasSuffix(key, "|"+day) && !strings.HasSuffix(key, "|"+month) {
+			delete(m.usage, key)
+		}
+	}
+	for id, reservation := range m.reservations {
+		if reservation.Month == month {
+			continue
+		}
+		delete(m.reservations, id)
+		if reservation.ReferenceID != "" && m.references[referenceKey(reservation.Action, reservation.ReferenceID)] == id {
+			delete(m.references, referenceKey(reservation.Action, reservation.ReferenceID))
+		}
+	}
+}
+
+// RedisLimitUsageStore implements LimitUsageStore in Redis so usage is
+// shared between replicas. Day and month counters are hashes with amount
+// and count fields that expire when their period ends; reservations and
+// their references expire at the end of their month.
+type RedisLimitUsageStore struct {
+	redis RedisEvaluator
+}
+
+// NewRedisLimitUsageStore creates a Redis backed limit usage store
+func NewRedisLimitUsageStore(redis RedisEvaluator) *RedisLimitUsageStore {
+	return &RedisLimitUsageStore{redis: redis}
+}
+
+// reserveLimitScript checks a reservation against the limits in ARGV[3..7]
+// and adds it to the day and month counters. KEYS are the day and month
+// counters, the reservation and, for requests with one, the reference.
+const reserveLimitScript = `
+if KEYS[4] then
+	local existing = redis.call('GET', KEYS[4])
+	if existing then
+		return {'existing', existing}
+	end
+end
+local amount = tonumber(ARGV[2])
+local function used(key, field)
+	return tonumber(redis.call('HGET', key, field) or '0')
+end
+local function over(limit, value)
+	limit = tonumber(limit)
+	return limit > 0 and value > limit
+end
+local reason = ''
+if over(ARGV[3], amount) then
+	reason = 'amount exceeds per-transaction limit'
+elseif over(ARGV[4], used(KEYS[1], 'amount') + amount) then
+	reason = 'amount exceeds daily limit'
+elseif over(ARGV[5], used(KEYS[2], 'amount') + amount) then
+	reason = 'amount exceeds monthly limit'
+elseif over(ARGV[6], used(KEYS[1], 'count') + 1) then
+	reason = 'daily transaction count limit reached'
+elseif over(ARGV[7], used(KEYS[2], 'count') + 1) then
+	reason = 'monthly transaction count limit reached'
+end
+if reason ~= '' then
+	return {'refused', reason}
+end
+for i = 1, 2 do
+	redis.call('HINCRBY', KEYS[i], 'amount', ARGV[2])
+	redis.call('HINCRBY', KEYS[i], 'count', 1)
+	redis.call('PEXPIREAT', KEYS[i], ARGV[8 + i])
+end
+redis.call('HSET', KEYS[3], 'data', ARGV[8], 'released', '0')
+redis.call('PEXPIREAT', KEYS[3], ARGV[10])
+if KEYS[4] then
+	redis.call('SET', KEYS[4], ARGV[1])
+	redis.call('PEXPIREAT', KEYS[4], ARGV[10])
+end
+return {'reserved', ARGV[1]}
+`
+
+// usageLimitScript returns the amount and count of the day and month
+// counters as strings
+const usageLimitScript = `
+local day = redis.call('HMGET', KEYS[1], 'amount', 'count')
+local month = redis.call('HMGET', KEYS[2], 'amount', 'count')
+return {day[1] or '0', day[2] or '0', month[1] or '0', month[2] or '0'}
+`
+
+// getReservationScript returns a reservation's JSON and released flag
+const getReservationScript = `
+return redis.call('HMGET', KEYS[1], 'data', 'released')
+`
+
+// releaseLimitScript marks the reservation in KEYS[1] released and takes
+// its amount in ARGV[1] off the counters still alive. The reference is
+// removed so it can be reserved again.
+const releaseLimitScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if redis.call('HGET', KEYS[1], 'released') == '1' then
+	return 1
+end
+redis.call('HSET', KEYS[1], 'released', '1')
+for i = 2, 3 do
+	if redis.call('EXISTS', KEYS[i]) == 1 then
+		redis.call('HINCRBY', KEYS[i], 'amount', '-' .. ARGV[1])
+		redis.call('HINCRBY', KEYS[i], 'count', -1)
+	end
+end
+if KEYS[4] and redis.call('GET', KEYS[4]) == ARGV[2] then
+	redis.call('DEL', KEYS[4])
+end
+return 1
+`
+
+func redisUsageKey(entityID, action, currency, period string) string {
+	return "risk:limits:usage:" + usageKey(entityID, action, currency) + "|" + period
+}
+
+func redisReservationKey(reservationID string) string {
+	return "risk:limits:reservation:" + reservationID
+}
+
+func redisReferenceKey(action, referenceID string) string {
+	return "risk:limits:reference:" + referenceKey(action, referenceID)
+}
+
+// reservationKeys returns the Redis keys a reservation touches
+func reservationKeys(reservation *LimitReservation) []string {
+	keys := []string{
+		redisUsageKey(reservation.EntityID, reservation.Action, reservation.Currency, reservation.Day),
+		redisUsageKey(reservation.EntityID, reservation.Action, reservation.Currency, reservation.Month),
+		redisReservationKey(reservation.ID),
+	}
+	if reservation.ReferenceID != "" {
+		keys = append(keys, redisReferenceKey(reservation.Action, reservation.ReferenceID))
+	}
+	return keys
+}
+
+func (r *RedisLimitUsageStore) Reserve(ctx context.Context, reservation *LimitReservation, limits Limits) (string, string, error) {
+	data, err := json.Marshal(reservation)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode reservation: %w", err)
+	}
+	dayEnd, monthEnd := periodEnds(reservation.CreatedAt)
+
+	result, err := r.redis.Eval(ctx, reserveLimitScript, reservationKeys(reservation),
+		reservation.ID, reservation.Amount,
+		limits.PerTransaction, limits.DailyAmount, limits.MonthlyAmount, limits.DailyCount, limits.MonthlyCount,
+		string(data), dayEnd.UnixMilli(), monthEnd.UnixMilli())
+	if err != nil {
+		return "", "", err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return "", "", fmt.Errorf("unexpected reserve result: %v", result)
+	}
+	outcome, _ := values[0].(string)
+	value, _ := values[1].(string)
+	switch outcome {
+	case "existing", "reserved":
+		return value, "", nil
+	case "refused":
+		return "", value, nil
+	}
+	return "", "", fmt.Errorf("unexpected reserve result: %v", result)
+}
+
+func (r *RedisLimitUsageStore) Usage(ctx context.Context, entityID, action, currency string, now time.Time) (limitUsage, limitUsage, error) {
+	dayKey, monthKey := periodKeys(now)
+	result, err := r.redis.Eval(ctx, usageLimitScript, []string{
+		redisUsageKey(entityID, action, currency, dayKey),
+		redisUsageKey(entityID, action, currency, monthKey),
+	})
+	if err != nil {
+		return limitUsage{}, limitUsage{}, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 4 {
+		return limitUsage{}, limitUsage{}, fmt.Errorf("unexpected usage result: %v", result)
+	}
+	numbers := make([]int64, len(values))
+	for i, value := range values {
+		text, _ := value.(string)
+		number, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return limitUsage{}, limitUsage{}, fmt.Errorf("unexpected usage value: %v", value)
+		}
+		numbers[i] = number
+	}
+
+	return limitUsage{amount: numbers[0], count: numbers[1]}, limitUsage{amount: numbers[2], count: numbers[3]}, nil
+}
+
+func (r *RedisLimitUsageStore) Release(ctx context.Context, reservationID string) (*LimitReservation, error) {
+	result, err := r.redis.Eval(ctx, getReservationScript, []string{redisReservationKey(reservationID)})
+	if err != nil {
+		return nil, err
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, fmt.Errorf("unexpected reservation result: %v", result)
+	}
+	data, ok := values[0].(string)
+	if !ok {
+		return nil, ErrReservationNotFound
+	}
+
+	var reservation LimitReservation
+	if err := json.Unmarshal([]byte(data), &reservation); err != nil {
+		return nil, fmt.Errorf("failed to decode reservation: %w", err)
+	}
+
+	released, err := r.redis.Eval(ctx, releaseLimitScript, reservationKeys(&reservation), reservation.Amount, reservation.ID)
+	if err != nil {
+		return nil, err
+	}
+	if released == int64(0) {
+		return nil, ErrReservationNotFound
+	}
+
+	reservation.Released = true
+	return &reservation, nil
+}
+
+// moneyToMinorUnits converts an amount to minor units of its currency,
+// rounding half away from zero
+func moneyToMinorUnits(amount *Money) int64 {
+	scale := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(amount.Currency))), nil))
+	scaled := new(big.Float).Mul(amount.Value, scale)
+	if scaled.Sign() < 0 {
+		scaled.Sub(scaled, big.NewFloat(0.5))
+	} else {
+		scaled.Add(scaled, big.NewFloat(0.5))
+	}
+	minor, _ := scaled.Int64()
+	return minor
+}
+
+// SetLimitEngine replaces the limit engine
+func (s *Service) SetLimitEngine(engine *LimitEngine) {
+	s.limits = engine
+}
+
+// SetLimitUsageStore configures where limit usage is kept
+func (s *Service) SetLimitUsageStore(store LimitUsageStore) {
+	s.limits.SetUsageStore(store)
+}
+
+// ConsumeLimit checks an action against the entity's limits for its tier
+// and current risk level and records its usage when it fits
+func (s *Service) ConsumeLimit(ctx context.Context, req *LimitRequest) (*LimitDecision, error) {
+	if err := validateLimitRequest(req, true); err != nil {
+		return nil, err
+	}
+
+	riskLevel, err := s.entityRiskLevel(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.limits.Consume(ctx, req, riskLevel, moneyToMinorUnits(req.Amount), time.Now())
+}
+
+// GetLimitHeadroom returns the remaining limits of an entity
+func (s *Service) GetLimitHeadroom(ctx context.Context, req *LimitRequest, currency string) (*LimitHeadroom, error) {
+	if err := validateLimitRequest(req, false); err != nil {
+		return nil, err
+	}
+	if currency == "" {
+		return nil, fmt.Errorf("currency is required")
+	}
+
+	riskLevel, err := s.entityRiskLevel(ctx, req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	headroom, err := s.limits.Headroom(ctx, req, riskLevel, currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &headroom, nil
+}
+
+// ReleaseLimit gives back the usage of an action that did not go ahead
+func (s *Service) ReleaseLimit(ctx context.Context, reservationID string) (*LimitReservation, error) {
+	return s.limits.Release(ctx, reservationID)
+}
+
+// SetLimitRule creates or replaces a limit rule
+func (s *Service) SetLimitRule(ctx context.Context, rule *LimitRule) (*LimitRule, error) {
+	if rule.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if rule.Action != "" && !isLimitAction(rule.Action) {
+		return nil, fmt.Errorf("invalid action: %s", rule.Action)
+	}
+	if rule.Limits.PerTransaction < 0 || rule.Limits.DailyAmount < 0 || rule.Limits.MonthlyAmount < 0 ||
+		rule.Limits.DailyCount < 0 || rule.Limits.MonthlyCount < 0 {
+		return nil, fmt.Errorf("limits cannot be negative")
+	}
+
+	return s.limits.SetRule(rule), nil
+}
+
+// ListLimitRules returns the limit rules, most specific first
+func (s *Service) ListLimitRules(ctx context.Context) []*LimitRule {
+	return s.limits.Rules()
+}
+
+// GrantLimitIncrease grants an entity a temporary limit increase
+func (s *Service) GrantLimitIncrease(ctx context.Context, increase *LimitIncrease) (*LimitIncrease, error) {
+	if increase.EntityID == "" {
+		return nil, fmt.Errorf("entity_id is required")
+	}
+	if increase.Action != "" && !isLimitAction(increase.Action) {
+		return nil, fmt.Errorf("invalid action: %s", increase.Action)
+	}
+	if increase.Reason == "" || increase.GrantedBy == "" {
+		return nil, fmt.Errorf("reason and granted_by are required")
+	}
+	if !increase.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	if increase.Increase == (Limits{}) {
+		return nil, fmt.Errorf("increase must raise at least one limit")
+	}
+
+	return s.limits.GrantIncrease(increase), nil
+}
+
+// ListLimitIncreases returns the active increases of an entity
+func (s *Service) ListLimitIncreases(ctx context.Context, entityID string) []*LimitIncrease {
+	return s.limits.Increases(entityID, time.Now())
+}
+
+// entityRiskLevel returns the entity's current profile risk level, empty
+// for entities without a profile
+func (s *Service) entityRiskLevel(ctx context.Context, entityID string) (string, error) {
+	profile, err := s.repo.GetRiskProfile(ctx, entityID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get risk profile: %w", err)
+	}
+	if profile == nil {
+		return "", nil
+	}
+	return profile.RiskLevel, nil
+}
+
+func validateLimitRequest(req *LimitRequest, needAmount bool) error {
+	if req.EntityID == "" {
+		return fmt.Errorf("entity_id is required")
+	}
+	if !isLimitAction(req.Action) {
+		return fmt.Errorf("invalid action: %s", req.Action)
+	}
+	if needAmount {
+		if req.Amount == nil || req.Amount.Value == nil || req.Amount.Currency == "" {
+			return fmt.Errorf("amount with currency is required")
+		}
+		if req.Amount.Value.Sign() <= 0 {
+			return fmt.Errorf("amount must be positive")
+		}
+	}
+	return nil
+}
+
+func isLimitAction(action string) bool {
+	return action == LimitActionPayment || action == LimitActionTransfer || action == LimitActionEscrow
+}
@@ -1,37 +1,138 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Global services
+var (
+	riskService *Service
+)
+
 func main() {
 	port := flag.String("port", "8085", "Port to listen on")
 	flag.Parse()
 
 	log.Printf("Starting Risk Microservice on port %s...", *port)
 
+	// Initialize risk service with an in-memory repository journaled to
+	// disk, so profiles, assessments and their audit snapshots survive
+	// restarts
+	repo := NewInMemoryRepository()
+	journalPath := os.Getenv("RISK_JOURNAL_PATH")
+	if journalPath == "" {
+		journalPath = "data/risk/journal.jsonl"
+	}
+	journal, err := OpenFileJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to open risk journal: %v", err)
+	}
+	defer journal.Close()
+	if err := repo.SetJournal(journal); err != nil {
+		log.Fatalf("Failed to load risk records: %v", err)
+	}
+	log.Printf("Journaling risk records to %s", journalPath)
+	riskService = NewService(repo, nil)
+
+	// Keep velocity counters and limit usage in Redis when configured so
+	// they are shared between replicas; otherwise they live in memory
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redisClient, err := NewRedisClient(redisURL)
+		if err != nil {
+			log.Printf("Redis unavailable, using in-memory velocity counters and limit usage: %v", err)
+		} else {
+			defer redisClient.Close()
+			riskService.SetVelocityStore(NewRedisVelocityStore(redisClient))
+			riskService.SetLimitUsageStore(NewRedisLimitUsageStore(redisClient))
+		}
+	}
+
+	// Score assessments with a locally stored model when one is configured
+	if modelPath := os.Getenv("RISK_MODEL_PATH"); modelPath != "" {
+		if model, err := LoadModelFile(modelPath); err != nil {
+			log.Printf("Failed to load risk model from %s: %v", modelPath, err)
+		} else {
+			riskService.SetModel(model)
+			log.Printf("Loaded risk model %s@%s (feature schema %s)", model.Name, model.Version, model.FeatureSchema.Version)
+		}
+	}
+
+	// Report review decisions back to the services holding the actions
+	paymentServiceURL := os.Getenv("PAYMENT_SERVICE_URL")
+	if paymentServiceURL == "" {
+		paymentServiceURL = "http://payment-service:8083"
+	}
+	escrowServiceURL := os.Getenv("ESCROW_SERVICE_URL")
+	if escrowServiceURL == "" {
+		escrowServiceURL = "http://escrow-service:8081"
+	}
+	reviewSigningKey := []byte(os.Getenv("REVIEW_SIGNING_KEY"))
+	if len(reviewSigningKey) == 0 {
+		log.Println("REVIEW_SIGNING_KEY not set, payment-service and escrow-service will reject review decisions")
+	}
+	riskService.SetReviewNotifier(NewHTTPReviewNotifier(paymentServiceURL, escrowServiceURL, reviewSigningKey))
+
+	reviewPolicy := DefaultReviewPolicy()
+	if ttl, err := time.ParseDuration(os.Getenv("REVIEW_TTL")); err == nil && ttl > 0 {
+		reviewPolicy.TTL = ttl
+	}
+	if decision := os.Getenv("REVIEW_DEFAULT_DECISION"); decision == ReviewDecisionApprove || decision == ReviewDecisionDecline {
+		reviewPolicy.DefaultDecision = decision
+	}
+	riskService.SetReviewPolicy(reviewPolicy)
+
+	reviewCtx, stopReviews := context.WithCancel(context.Background())
+	defer stopReviews()
+	go runReviewExpiry(reviewCtx, time.Minute)
+
+	// Publish risk level changes so reserves and limits can react
+	if eventBusURL := os.Getenv("EVENTBUS_URL"); eventBusURL != "" {
+		riskService.SetEventPublisher(NewHTTPEventPublisher(eventBusURL))
+	}
+
+	profilePolicy := DefaultProfilePolicy()
+	if halfLife, err := time.ParseDuration(os.Getenv("PROFILE_HALF_LIFE")); err == nil && halfLife > 0 {
+		profilePolicy.HalfLife = halfLife
+	}
+	riskService.SetProfilePolicy(profilePolicy)
+	go runProfileDecay(reviewCtx, time.Hour)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"status":"healthy","service":"risk","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 	})
 
-	mux.HandleFunc("/v1/assess", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"score": 0.2,
-			"severity": "low",
-			"decision": "allow",
-		})
-	})
+	mux.HandleFunc("/v1/assess", handleAssess)
+	mux.HandleFunc("/v1/rules", handleRules)
+	mux.HandleFunc("/v1/rules/", handleRuleByID)
+	mux.HandleFunc("/v1/rules/backtest", handleBacktest)
+	mux.HandleFunc("/v1/assessments/", handleAssessmentByID)
+	mux.HandleFunc("/v1/rule-sets/", handleRuleSetByVersion)
+	mux.HandleFunc("/v1/model", handleModel)
+	mux.HandleFunc("/v1/model/reload", handleModelReload)
+	mux.HandleFunc("/v1/reviews", handleReviews)
+	mux.HandleFunc("/v1/reviews/", handleReviewByID)
+	mux.HandleFunc("/v1/profiles/", handleProfileByID)
+	mux.HandleFunc("/v1/limits/rules", handleLimitRules)
+	mux.HandleFunc("/v1/limits/increases", handleLimitIncreases)
+	mux.HandleFunc("/v1/limits/consume", handleLimitConsume)
+	mux.HandleFunc("/v1/limits/headroom", handleLimitHeadroom)
+	mux.HandleFunc("/v1/limits/reservations/", handleLimitReservation)
+	mux.HandleFunc("/v1/graph/accounts/", handleGraphAccount)
+	mux.HandleFunc("/v1/graph/identifiers/", handleGraphIdentifier)
 
 	server := &http.Server{
 		Addr: ":" + *port,
@@ -48,5 +149,661 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+
 	log.Println("Risk service exited")
 }
+
+func handleAssess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AssessRiskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	assessment, err := riskService.AssessRiskWithValidation(r.Context(), &req)
+	if err != nil {
+		log.Printf("Failed to assess risk: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assessment)
+}
+
+func handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rules, err := riskService.repo.ListRiskRules(r.Context(), RiskFilters{})
+		if err != nil {
+			log.Printf("Failed to list rules: %v", err)
+			http.Error(w, "Failed to list rules", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+
+	case "POST":
+		var req CreateRiskRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := riskService.CreateRiskRuleWithValidation(r.Context(), &req)
+		if err != nil {
+			log.Printf("Failed to create rule: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleRuleByID(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/rules/")
+	parts := strings.Split(path, "/")
+	ruleID := parts[0]
+	if ruleID == "" {
+		http.Error(w, "Rule ID required", http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "mode" {
+		handleRuleMode(w, r, ruleID)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rule, err := riskService.repo.GetRiskRule(r.Context(), ruleID)
+		if err != nil || rule == nil {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+
+	case "DELETE":
+		if err := riskService.repo.DeleteRiskRule(r.Context(), ruleID); err != nil {
+			log.Printf("Failed to delete rule: %v", err)
+			http.Error(w, "Failed to delete rule", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleRuleMode(w http.ResponseWriter, r *http.Request, ruleID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := riskService.SetRiskRuleMode(r.Context(), ruleID, req.Mode)
+	if err != nil {
+		log.Printf("Failed to set rule mode: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func handleBacktest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BacktestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	report, err := riskService.BacktestRules(r.Context(), &req)
+	if err != nil {
+		log.Printf("Failed to backtest rules: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func handleAssessmentByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/assessments/"), "/")
+	assessmentID := parts[0]
+	if assessmentID == "" {
+		http.Error(w, "Assessment ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		assessment, err := riskService.repo.GetRiskAssessment(r.Context(), assessmentID)
+		if err != nil || assessment == nil {
+			http.Error(w, "Assessment not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assessment)
+
+	case len(parts) == 2 && parts[1] == "label" && r.Method == "POST":
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		assessment, err := riskService.LabelAssessment(r.Context(), assessmentID, req.Label)
+		if err != nil {
+			log.Printf("Failed to label assessment: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assessment)
+
+	case len(parts) == 2 && parts[1] == "audit" && r.Method == "GET":
+		audit, err := riskService.GetAssessmentAudit(r.Context(), assessmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(audit)
+
+	case len(parts) == 2 && parts[1] == "replay" && r.Method == "POST":
+		result, err := riskService.ReplayAssessment(r.Context(), assessmentID)
+		if err != nil {
+			log.Printf("Failed to replay assessment: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleRuleSetByVersion returns the rules an assessment was evaluated with
+func handleRuleSetByVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	version := strings.TrimPrefix(r.URL.Path, "/v1/rule-sets/")
+	if version == "" {
+		http.Error(w, "Rule set version required", http.StatusBadRequest)
+		return
+	}
+
+	ruleSet, err := riskService.GetRuleSet(r.Context(), version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ruleSet)
+}
+
+// runReviewExpiry periodically expires overdue review cases
+func runReviewExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := riskService.ExpireReviewCases(ctx, time.Now())
+			if err != nil {
+				log.Printf("Review expiry failed: %v", err)
+			} else if expired > 0 {
+				log.Printf("Expired %d review cases", expired)
+			}
+		}
+	}
+}
+
+func runProfileDecay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := riskService.DecayRiskProfiles(ctx, time.Now())
+			if err != nil {
+				log.Printf("Profile decay failed: %v", err)
+			} else if changed > 0 {
+				log.Printf("Decay changed the risk level of %d profiles", changed)
+			}
+		}
+	}
+}
+
+func handleProfileByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/profiles/"), "/")
+	entityID := parts[0]
+	if entityID == "" {
+		http.Error(w, "Entity ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		profile, err := riskService.GetRiskProfile(r.Context(), entityID)
+		if err != nil || profile == nil {
+			http.Error(w, "Risk profile not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	case len(parts) == 2 && parts[1] == "signals" && r.Method == "POST":
+		var signal ProfileSignal
+		if err := json.NewDecoder(r.Body).Decode(&signal); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		profile, err := riskService.RecordProfileSignal(r.Context(), entityID, &signal)
+		if err != nil {
+			log.Printf("Failed to record profile signal: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleReviews(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filters := ReviewFilters{
+		Status:      query.Get("status"),
+		SubjectType: query.Get("subject_type"),
+		EntityID:    query.Get("entity_id"),
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil {
+		filters.Limit = limit
+	}
+
+	reviews, err := riskService.ListReviewCases(r.Context(), filters)
+	if err != nil {
+		log.Printf("Failed to list review cases: %v", err)
+		http.Error(w, "Failed to list review cases", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+func handleReviewByID(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/reviews/"), "/")
+	caseID := parts[0]
+	if caseID == "" {
+		http.Error(w, "Review case ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		reviewCase, err := riskService.GetReviewCase(r.Context(), caseID)
+		if err != nil {
+			http.Error(w, "Review case not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reviewCase)
+
+	case len(parts) == 2 && parts[1] == "decision" && r.Method == "POST":
+		// The analyst is who the API gateway authenticated, not who the
+		// body names
+		analyst := r.Header.Get("X-User-ID")
+		if analyst == "" || !CanDecideReviews(r.Header.Get("X-User-Role")) {
+			http.Error(w, "Review decisions require an authenticated risk analyst", http.StatusForbidden)
+			return
+		}
+
+		var req ReviewDecisionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Analyst = analyst
+
+		reviewCase, err := riskService.DecideReviewCase(r.Context(), caseID, &req)
+		if err != nil {
+			log.Printf("Failed to decide review case: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reviewCase)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	model := riskService.Model()
+	if model == nil {
+		http.Error(w, "No model loaded", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.Info())
+}
+
+func handleModelReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	modelPath := os.Getenv("RISK_MODEL_PATH")
+	if modelPath == "" {
+		http.Error(w, "RISK_MODEL_PATH is not configured", http.StatusBadRequest)
+		return
+	}
+
+	// A model that fails validation leaves the current one in place
+	model, err := LoadModelFile(modelPath)
+	if err != nil {
+		log.Printf("Failed to reload risk model: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	riskService.SetModel(model)
+	log.Printf("Reloaded risk model %s@%s", model.Name, model.Version)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.Info())
+}
+
+func handleGraphAccount(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/graph/accounts/"), "/")
+	accountID := parts[0]
+	if accountID == "" {
+		http.Error(w, "Account ID required", http.StatusBadRequest)
+		return
+	}
+
+	graph := riskService.LinkGraph()
+	query := r.URL.Query()
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account_id":  accountID,
+			"fraud":       graph.IsFraud(accountID),
+			"identifiers": graph.Identifiers(accountID),
+			"features":    graph.Features(accountID),
+		})
+
+	case len(parts) == 2 && parts[1] == "linked" && r.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(graph.LinkedAccounts(accountID, query.Get("type")))
+
+	case len(parts) == 2 && parts[1] == "fraud-path" && r.Method == "GET":
+		maxHops := DefaultFraudSearchHops
+		if hops, err := strconv.Atoi(query.Get("max_hops")); err == nil && hops > 0 {
+			maxHops = hops
+		}
+
+		path := graph.PathToFraud(accountID, maxHops)
+		if path == nil {
+			http.Error(w, "No path to a known fraud account", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(path)
+
+	case len(parts) == 2 && parts[1] == "fraud" && r.Method == "POST":
+		var req struct {
+			Fraud bool `json:"fraud"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		graph.SetFraud(accountID, req.Fraud)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"account_id": accountID,
+			"fraud":      req.Fraud,
+		})
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleGraphIdentifier(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/graph/identifiers/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		http.Error(w, "Identifier type and value required", http.StatusBadRequest)
+		return
+	}
+
+	identifier, err := parseGraphNode(parts[0], parts[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"identifier": identifier,
+		"accounts":   riskService.LinkGraph().AccountsUsing(identifier),
+	})
+}
+
+func handleLimitRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(riskService.ListLimitRules(r.Context()))
+
+	case "POST":
+		var rule LimitRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		saved, err := riskService.SetLimitRule(r.Context(), &rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleLimitIncreases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(riskService.ListLimitIncreases(r.Context(), r.URL.Query().Get("entity_id")))
+
+	case "POST":
+		var increase LimitIncrease
+		if err := json.NewDecoder(r.Body).Decode(&increase); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		granted, err := riskService.GrantLimitIncrease(r.Context(), &increase)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Granted limit increase %s to %s until %s by %s", granted.ID, granted.EntityID, granted.ExpiresAt.Format(time.RFC3339), granted.GrantedBy)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(granted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleLimitConsume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := riskService.ConsumeLimit(r.Context(), &req)
+	if errors.Is(err, ErrLimitUsageUnavailable) {
+		log.Printf("Failed to consume limit: %v", err)
+		http.Error(w, "Limit usage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision)
+}
+
+func handleLimitHeadroom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	req := &LimitRequest{
+		EntityID:   query.Get("entity_id"),
+		EntityType: query.Get("entity_type"),
+		Tier:       query.Get("tier"),
+		Action:     query.Get("action"),
+	}
+
+	headroom, err := riskService.GetLimitHeadroom(r.Context(), req, query.Get("currency"))
+	if errors.Is(err, ErrLimitUsageUnavailable) {
+		log.Printf("Failed to read limit headroom: %v", err)
+		http.Error(w, "Limit usage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(headroom)
+}
+
+func handleLimitReservation(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/limits/reservations/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "release" || r.Method != "POST" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	reservation, err := riskService.ReleaseLimit(r.Context(), parts[0])
+	if errors.Is(err, ErrLimitUsageUnavailable) {
+		log.Printf("Failed to release limit: %v", err)
+		http.Error(w, "Limit usage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
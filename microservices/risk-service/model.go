@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Supported model types
+const (
+	ModelTypeLogisticRegression = "logistic_regression"
+	ModelTypeGradientBoosted    = "gradient_boosted_trees"
+)
+
+// DefaultModelBlendWeight is the share of the final base score taken from
+// the model when the model file does not set one
+const DefaultModelBlendWeight = 0.5
+
+// FeatureSchema is the versioned list of inputs a model was trained on
+type FeatureSchema struct {
+	Version  string         `json:"version"`
+	Features []ModelFeature `json:"features"`
+	index    map[string]int
+}
+
+// ModelFeature maps a value from the assessment environment (the same keys
+// rules use, e.g. "amount" or "velocity.count_1h") to a model input
+type ModelFeature struct {
+	Name      string  `json:"name"`
+	Source    string  `json:"source"`
+	Equals    string  `json:"equals,omitempty"`    // one-hot: 1 when the source equals this value
+	Transform string  `json:"transform,omitempty"` // log1p
+	Default   float64 `json:"default"`
+	Mean      float64 `json:"mean,omitempty"`
+	Std       float64 `json:"std,omitempty"`
+}
+
+// TreeNode is a node of a regression tree. Leaves have no feature.
+type TreeNode struct {
+	ID        int      `json:"id"`
+	Feature   string   `json:"feature,omitempty"`
+	Threshold float64  `json:"threshold,omitempty"`
+	Yes       int      `json:"yes,omitempty"` // taken when value < threshold
+	No        int      `json:"no,omitempty"`
+	Missing   int      `json:"missing,omitempty"` // taken when the feature is missing, defaults to yes
+	Leaf      *float64 `json:"leaf,omitempty"`
+	Cover     float64  `json:"cover,omitempty"`
+}
+
+// Tree is one tree of a gradient-boosted ensemble
+type Tree struct {
+	Nodes []TreeNode `json:"nodes"`
+
+	nodes    map[int]*TreeNode
+	expected map[int]float64
+}
+
+// Model is a scoring model exported to JSON
+type Model struct {
+	Name          string             `json:"name"`
+	Version       string             `json:"version"`
+	Type          string             `json:"type"`
+	BlendWeight   *float64           `json:"blend_weight,omitempty"`
+	FeatureSchema FeatureSchema      `json:"feature_schema"`
+	Intercept     float64            `json:"intercept,omitempty"`
+	Coefficients  map[string]float64 `json:"coefficients,omitempty"`
+	BaseScore     float64            `json:"base_score,omitempty"` // log-odds
+	Trees         []Tree             `json:"trees,omitempty"`
+}
+
+// ModelScore is a model's score for one assessment. Contributions are in
+// log-odds and, together with Bias, add up to the model's margin.
+type ModelScore struct {
+	Score           float64            `json:"score"`
+	Margin          float64            `json:"margin"`
+	Bias            float64            `json:"bias"`
+	Contributions   map[string]float64 `json:"contributions"`
+	Features        map[string]float64 `json:"features"`
+	MissingFeatures []string           `json:"missing_features,omitempty"`
+}
+
+// ModelInfo describes the loaded model
+type ModelInfo struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Type          string   `json:"type"`
+	SchemaVersion string   `json:"feature_schema_version"`
+	Features      []string `json:"features"`
+	BlendWeight   float64  `json:"blend_weight"`
+}
+
+// LoadModelFile reads and validates a model from a JSON file
+func LoadModelFile(path string) (*Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model: %w", err)
+	}
+	return ParseModel(data)
+}
+
+// ParseModel parses and validates a JSON model
+func ParseModel(data []byte) (*Model, error) {
+	var model Model
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("failed to parse model: %w", err)
+	}
+	if err := model.compile(); err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+// compile validates the model and precomputes what scoring needs
+func (m *Model) compile() error {
+	if strings.TrimSpace(m.Name) == "" || strings.TrimSpace(m.Version) == "" {
+		return errors.New("model name and version are required")
+	}
+	if strings.TrimSpace(m.FeatureSchema.Version) == "" {
+		return errors.New("feature schema version is required")
+	}
+	if len(m.FeatureSchema.Features) == 0 {
+		return errors.New("feature schema has no features")
+	}
+	if m.BlendWeight != nil && (*m.BlendWeight < 0 || *m.BlendWeight > 1) {
+		return errors.New("blend weight must be between 0 and 1")
+	}
+
+	m.FeatureSchema.index = make(map[string]int)
+	for i, feature := range m.FeatureSchema.Features {
+		if feature.Name == "" || feature.Source == "" {
+			return fmt.Errorf("feature %d needs a name and source", i)
+		}
+		if _, exists := m.FeatureSchema.index[feature.Name]; exists {
+			return fmt.Errorf("duplicate feature: %s", feature.Name)
+		}
+		if feature.Transform != "" && feature.Transform != "log1p" {
+			return fmt.Errorf("unknown transform for feature %s: %s", feature.Name, feature.Transform)
+		}
+		m.FeatureSchema.index[feature.Name] = i
+	}
+
+	switch m.Type {
+	case ModelTypeLogisticRegression:
+		if len(m.Coefficients) == 0 {
+			return errors.New("logistic regression model has no coefficients")
+		}
+		for name := range m.Coefficients {
+			if _, exists := m.FeatureSchema.index[name]; !exists {
+				return fmt.Errorf("coefficient for unknown feature: %s", name)
+			}
+		}
+
+	case ModelTypeGradientBoosted:
+		if len(m.Trees) == 0 {
+			return errors.New("gradient boosted model has no trees")
+		}
+		for i := range m.Trees {
+			if err := m.Trees[i].compile(m.FeatureSchema.index); err != nil {
+				return fmt.Errorf("tree %d: %w", i, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown model type: %s", m.Type)
+	}
+
+	return nil
+}
+
+func (t *Tree) compile(features map[string]int) error {
+	t.nodes = make(map[int]*TreeNode)
+	for i := range t.Nodes {
+		node := &t.Nodes[i]
+		if _, exists := t.nodes[node.ID]; exists {
+			return fmt.Errorf("duplicate node id %d", node.ID)
+		}
+		t.nodes[node.ID] = node
+	}
+
+	root, exists := t.nodes[0]
+	if !exists {
+		return errors.New("tree has no root node 0")
+	}
+
+	for _, node := range t.nodes {
+		if node.Leaf != nil {
+			continue
+		}
+		if _, exists := features[node.Feature]; !exists {
+			return fmt.Errorf("node %d splits on unknown feature %s", node.ID, node.Feature)
+		}
+		// Node 0 is the root, so it is never a child
+		if node.Yes == 0 || node.No == 0 {
+			return fmt.Errorf("node %d needs yes and no children", node.ID)
+		}
+		if node.Missing == 0 {
+			node.Missing = node.Yes
+		}
+		if node.Missing != node.Yes && node.Missing != node.No {
+			return fmt.Errorf("node %d missing branch must be its yes or no child", node.ID)
+		}
+		for _, child := range []int{node.Yes, node.No} {
+			if _, exists := t.nodes[child]; !exists {
+				return fmt.Errorf("node %d references missing node %d", node.ID, child)
+			}
+		}
+	}
+
+	// Expected values of every node, used to attribute each split's change
+	// in prediction to the feature it splits on
+	t.expected = make(map[int]float64)
+	if _, err := t.expectedValue(root, 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// expectedValue is the cover-weighted mean leaf value under a node, or the
+// plain mean of its children when the export has no cover
+func (t *Tree) expectedValue(node *TreeNode, depth int) (float64, error) {
+	if depth > len(t.nodes) {
+		return 0, errors.New("tree contains a cycle")
+	}
+	if node.Leaf != nil {
+		t.expected[node.ID] = *node.Leaf
+		return *node.Leaf, nil
+	}
+
+	yes, no := t.nodes[node.Yes], t.nodes[node.No]
+	yesValue, err := t.expectedValue(yes, depth+1)
+	if err != nil {
+		return 0, err
+	}
+	noValue, err := t.expectedValue(no, depth+1)
+	if err != nil {
+		return 0, err
+	}
+
+	value := (yesValue + noValue) / 2
+	if yes.Cover+no.Cover > 0 {
+		value = (yesValue*yes.Cover + noValue*no.Cover) / (yes.Cover + no.Cover)
+	}
+	t.expected[node.ID] = value
+	return value, nil
+}
+
+// Info describes the model
+func (m *Model) Info() ModelInfo {
+	features := make([]string, len(m.FeatureSchema.Features))
+	for i, feature := range m.FeatureSchema.Features {
+		features[i] = feature.Name
+	}
+	return ModelInfo{
+		Name:          m.Name,
+		Version:       m.Version,
+		Type:          m.Type,
+		SchemaVersion: m.FeatureSchema.Version,
+		Features:      features,
+		BlendWeight:   m.blendWeight(),
+	}
+}
+
+func (m *Model) blendWeight() float64 {
+	if m.BlendWeight == nil {
+		return DefaultModelBlendWeight
+	}
+	return *m.BlendWeight
+}
+
+// Score scores an assessment environment
+func (m *Model) Score(env map[string]interface{}) *ModelScore {
+	values, present, missing := m.FeatureSchema.extract(env)
+	result := &ModelScore{
+		Contributions:   make(map[string]float64),
+		Features:        values,
+		MissingFeatures: missing,
+	}
+
+	switch m.Type {
+	case ModelTypeLogisticRegression:
+		result.Bias = m.Intercept
+		result.Margin = m.Intercept
+		for name, weight := range m.Coefficients {
+			contribution := weight * values[name]
+			result.Contributions[name] = contribution
+			result.Margin += contribution
+		}
+
+	case ModelTypeGradientBoosted:
+		result.Bias = m.BaseScore
+		result.Margin = m.BaseScore
+		for i := range m.Trees {
+			bias, leaf := m.Trees[i].predict(values, present, result.Contributions)
+			result.Bias += bias
+			result.Margin += leaf
+		}
+	}
+
+	result.Score = 1 / (1 + math.Exp(-result.Margin))
+	return result
+}
+
+// predict walks the tree, crediting each split's change in expected value to
+// the split feature. It returns the root's expected value and the leaf value.
+func (t *Tree) predict(values map[string]float64, present map[string]bool, contributions map[string]float64) (float64, float64) {
+	node := t.nodes[0]
+	for node.Leaf == nil {
+		next := node.No
+		if !present[node.Feature] {
+			next = node.Missing
+		} else if values[node.Feature] < node.Threshold {
+			next = node.Yes
+		}
+
+		child := t.nodes[next]
+		contributions[node.Feature] += t.expected[child.ID] - t.expected[node.ID]
+		node = child
+	}
+	return t.expected[0], *node.Leaf
+}
+
+// extract computes the model inputs from an assessment environment
+func (s *FeatureSchema) extract(env map[string]interface{}) (map[string]float64, map[string]bool, []string) {
+	values := make(map[string]float64, len(s.Features))
+	present := make(map[string]bool, len(s.Features))
+	var missing []string
+
+	for _, feature := range s.Features {
+		raw, exists := env[feature.Source]
+		value, ok := featureValue(raw, feature.Equals)
+
+		// One-hot features are 0 when the source is absent
+		if feature.Equals != "" {
+			exists = true
+		}
+		if !exists || !ok {
+			values[feature.Name] = feature.Default
+			missing = append(missing, feature.Name)
+			continue
+		}
+
+		if feature.Transform == "log1p" {
+			value = math.Log1p(math.Max(0, value))
+		}
+		if feature.Std > 0 {
+			value = (value - feature.Mean) / feature.Std
+		}
+		values[feature.Name] = value
+		present[feature.Name] = true
+	}
+
+	return values, present, missing
+}
+
+func featureValue(raw interface{}, equals string) (float64, bool) {
+	if equals != "" {
+		if raw != nil && fmt.Sprint(raw) == equals {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch v := raw.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// TopContributions returns the features pushing the score up the most
+func (r *ModelScore) TopContributions(n int) []string {
+	names := make([]string, 0, len(r.Contributions))
+	for name, contribution := range r.Contributions {
+		if contribution > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if r.Contributions[names[i]] != r.Contributions[names[j]] {
+			return r.Contributions[names[i]] > r.Contributions[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// SetModel replaces the scoring model; nil disables model scoring
+func (s *Service) SetModel(model *Model) {
+	s.model.Store(model)
+}
+
+// Model returns the loaded scoring model, or nil
+func (s *Service) Model() *Model {
+	return s.model.Load()
+}
+
+// applyModel scores the assessment with the given model, blends the model
+// score into the base score and records the explanation in Factors. The
+// score is also exposed to rules as model.score.
+func (s *Service) applyModel(assessment *RiskAssessment, env map[string]interface{}, model *Model) {
+	if model == nil {
+		return
+	}
+
+	result := model.Score(env)
+	weight := model.blendWeight()
+	heuristic := assessment.RiskScore
+	blended := math.Min(1.0, math.Max(0.0, (1-weight)*heuristic+weight*result.Score))
+
+	env["model.score"] = result.Score
+	env["model.version"] = model.Version
+
+	assessment.Factors["heuristic_risk_score"] = heuristic
+	assessment.Factors["ml_score"] = result.Score
+	assessment.Factors["ml_model"] = model.Name
+	assessment.Factors["ml_model_version"] = model.Version
+	assessment.Factors["ml_feature_schema"] = model.FeatureSchema.Version
+	assessment.Factors["ml_bias"] = result.Bias
+	assessment.Factors["ml_contributions"] = result.Contributions
+	assessment.Factors["ml_top_factors"] = result.TopContributions(3)
+	if len(result.MissingFeatures) > 0 {
+		assessment.Factors["ml_missing_features"] = result.MissingFeatures
+	}
+	assessment.RulesApplied = append(assessment.RulesApplied, "ml_model:"+model.Name+"@"+model.Version)
+
+	assessment.RiskScore = blended
+	assessment.RiskLevel = s.calculateRiskLevel(blended)
+	assessment.Decision = s.calculateDecision(blended)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Signals that move a risk profile
+const (
+	ProfileSignalAssessment = "assessment"
+	ProfileSignalChargeback = "chargeback"
+	ProfileSignalDispute    = "dispute"
+	ProfileSignalKYCStatus  = "kyc_status"
+)
+
+// EventRiskLevelChanged is published when a profile moves between risk levels
+const EventRiskLevelChanged = "risk.level_changed"
+
+// ProfileSignal is something that happened to an entity that changes how
+// risky it is
+type ProfileSignal struct {
+	Type        string  `json:"type"`
+	EntityType  string  `json:"entity_type,omitempty"`
+	Score       float64 `json:"score,omitempty"`  // assessment risk score
+	Status      string  `json:"status,omitempty"` // kyc: verified, pending, expired, rejected; dispute: opened, won, lost
+	ReferenceID string  `json:"reference_id,omitempty"`
+}
+
+// ProfilePolicy controls how profiles are recalculated. Scores decay
+// towards the entity's baseline with the given half-life; each signal then
+// moves the decayed score.
+type ProfilePolicy struct {
+	HalfLife         time.Duration
+	AssessmentWeight float64 // pull towards each new assessment score
+	ChargebackImpact float64 // share of the remaining headroom a chargeback adds
+	DisputeImpact    float64
+	KYCFailureImpact float64
+	KYCReliefWeight  float64 // pull towards the baseline on successful KYC
+}
+
+// DefaultProfilePolicy returns the default profile recalculation policy
+func DefaultProfilePolicy() ProfilePolicy {
+	return ProfilePolicy{
+		HalfLife:         30 * 24 * time.Hour,
+		AssessmentWeight: 0.5,
+		ChargebackImpact: 0.35,
+		DisputeImpact:    0.15,
+		KYCFailureImpact: 0.4,
+		KYCReliefWeight:  0.25,
+	}
+}
+
+// SetProfilePolicy configures profile recalculation
+func (s *Service) SetProfilePolicy(policy ProfilePolicy) {
+	s.profilePolicy = policy
+}
+
+// decay returns the score after decaying towards the baseline for elapsed
+func (p ProfilePolicy) decay(score, baseline float64, elapsed time.Duration) float64 {
+	if p.HalfLife <= 0 || elapsed <= 0 {
+		return score
+	}
+	return baseline + (score-baseline)*math.Pow(0.5, elapsed.Hours()/p.HalfLife.Hours())
+}
+
+// decayProfile decays a profile's score up to now
+func (s *Service) decayProfile(profile *RiskProfile, now time.Time) {
+	scoredAt := profile.ScoredAt
+	if scoredAt.IsZero() {
+		scoredAt = profile.UpdatedAt
+	}
+
+	profile.RiskScore = s.profilePolicy.decay(profile.RiskScore, profile.BaselineScore, now.Sub(scoredAt))
+	profile.RiskLevel = s.calculateRiskLevel(profile.RiskScore)
+	profile.ScoredAt = now
+}
+
+// applyProfileSignal decays a profile and folds a signal into its score
+func (s *Service) applyProfileSignal(profile *RiskProfile, signal *ProfileSignal, now time.Time) error {
+	s.decayProfile(profile, now)
+
+	policy := s.profilePolicy
+	score := profile.RiskScore
+	raise := func(impact float64) {
+		score += (1 - score) * impact
+	}
+	relieve := func(weight float64) {
+		score -= (score - profile.BaselineScore) * weight
+	}
+
+	switch signal.Type {
+	case ProfileSignalAssessment:
+		score += (signal.Score - score) * policy.AssessmentWeight
+	case ProfileSignalChargeback:
+		raise(policy.ChargebackImpact)
+	case ProfileSignalDispute:
+		switch signal.Status {
+		case "", "opened":
+			raise(policy.DisputeImpact)
+		case "lost":
+			raise(policy.ChargebackImpact)
+		case "won":
+			// Nothing to add when the dispute went the entity's way
+		default:
+			return fmt.Errorf("invalid dispute status: %s", signal.Status)
+		}
+	case ProfileSignalKYCStatus:
+		switch signal.Status {
+		case "verified":
+			relieve(policy.KYCReliefWeight)
+		case "pending", "expired":
+			raise(policy.KYCFailureImpact / 4)
+		case "rejected", "failed":
+			raise(policy.KYCFailureImpact)
+		default:
+			return fmt.Errorf("invalid kyc status: %s", signal.Status)
+		}
+		profile.KYCStatus = signal.Status
+	default:
+		return fmt.Errorf("invalid signal type: %s", signal.Type)
+	}
+
+	profile.RiskScore = math.Min(1.0, math.Max(0.0, score))
+	profile.RiskLevel = s.calculateRiskLevel(profile.RiskScore)
+	if profile.SignalCounts == nil {
+		profile.SignalCounts = make(map[string]int)
+	}
+	profile.SignalCounts[signal.Type]++
+	profile.UpdatedAt = now
+
+	return nil
+}
+
+// RecordProfileSignal recalculates an entity's profile after a chargeback,
+// dispute, KYC status change or assessment
+func (s *Service) RecordProfileSignal(ctx context.Context, entityID string, signal *ProfileSignal) (*RiskProfile, error) {
+	if entityID == "" {
+		return nil, fmt.Errorf("entity_id is required")
+	}
+
+	entityType := signal.EntityType
+	if entityType == "" {
+		entityType = "user"
+	}
+	profile, err := s.getOrCreateRiskProfile(ctx, entityID, entityType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get risk profile: %w", err)
+	}
+
+	previousLevel := profile.RiskLevel
+	if err := s.applyProfileSignal(profile, signal, time.Now()); err != nil {
+		return nil, err
+	}
+	recordLevelHistory(profile, previousLevel)
+
+	if err := s.repo.UpdateRiskProfile(ctx, profile); err != nil {
+		return nil, fmt.Errorf("failed to update risk profile: %w", err)
+	}
+
+	s.publishLevelChange(ctx, profile, previousLevel, signal.Type)
+
+	return profile, nil
+}
+
+// DecayRiskProfiles decays every profile up to now and returns how many
+// changed risk level
+func (s *Service) DecayRiskProfiles(ctx context.Context, now time.Time) (int, error) {
+	profiles, err := s.repo.ListRiskProfiles(ctx, RiskFilters{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list risk profiles: %w", err)
+	}
+
+	changed := 0
+	for _, profile := range profiles {
+		previousLevel := profile.RiskLevel
+		s.decayProfile(profile, now)
+		recordLevelHistory(profile, previousLevel)
+
+		if err := s.repo.UpdateRiskProfile(ctx, profile); err != nil {
+			return changed, fmt.Errorf("failed to update risk profile %s: %w", profile.EntityID, err)
+		}
+
+		if profile.RiskLevel != previousLevel {
+			s.publishLevelChange(ctx, profile, previousLevel, "decay")
+			changed++
+		}
+	}
+
+	return changed, nil
+}
+
+// recordLevelHistory appends a changed risk level to the profile's history
+func recordLevelHistory(profile *RiskProfile, previousLevel string) {
+	if previousLevel == profile.RiskLevel {
+		return
+	}
+	if history, ok := profile.Metadata["risk_level_history"].([]string); ok {
+		profile.Metadata["risk_level_history"] = append(history, profile.RiskLevel)
+	}
+}
+
+// publishLevelChange publishes a move between risk levels so reserves and
+// limits can react
+func (s *Service) publishLevelChange(ctx context.Context, profile *RiskProfile, previousLevel, reason string) {
+	if previousLevel == profile.RiskLevel || previousLevel == "unknown" {
+		return
+	}
+
+	s.publishEvent(ctx, EventRiskLevelChanged, profile.EntityID, map[string]interface{}{
+		"entity_id":      profile.EntityID,
+		"entity_type":    profile.EntityType,
+		"previous_level": previousLevel,
+		"risk_level":     profile.RiskLevel,
+		"risk_score":     profile.RiskScore,
+		"reason":         reason,
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -424,3 +426,317 @@ func (r *PostgreSQLRepository) Close() error {
 func (r *PostgreSQLRepository) Health(ctx context.Context) error {
 	return r.db.PingContext(ctx)
 }
+
+// InMemoryRepository implements Repository in memory. Unlike MockRepository
+// it is safe for concurrent use, so the HTTP server can run on it.
+type InMemoryRepository struct {
+	mu          sync.RWMutex
+	profiles    map[string]*RiskProfile
+	rules       map[string]*RiskRule
+	assessments map[string]*RiskAssessment
+	reviews     map[string]*ReviewCase
+	audits      map[string]*AssessmentAudit
+	ruleSets    map[string]*RuleSetSnapshot
+	models      map[string]*Model
+	journal     Journal
+}
+
+// NewInMemoryRepository creates a new in-memory repository
+func NewInMemoryRepository() *InMemoryRepository {
+	return &InMemoryRepository{
+		profiles:    make(map[string]*RiskProfile),
+		rules:       make(map[string]*RiskRule),
+		assessments: make(map[string]*RiskAssessment),
+		reviews:     make(map[string]*ReviewCase),
+		audits:      make(map[string]*AssessmentAudit),
+		ruleSets:    make(map[string]*RuleSetSnapshot),
+		models:      make(map[string]*Model),
+	}
+}
+
+func (r *InMemoryRepository) CreateRiskProfile(ctx context.Context, profile *RiskProfile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.profiles[profile.EntityID]; exists {
+		return fmt.Errorf("risk profile already exists: %s", profile.EntityID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalProfile, Profile: profile})
+}
+
+func (r *InMemoryRepository) GetRiskProfile(ctx context.Context, entityID string) (*RiskProfile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	profile, exists := r.profiles[entityID]
+	if !exists {
+		return nil, nil
+	}
+	found := *profile
+	return &found, nil
+}
+
+func (r *InMemoryRepository) UpdateRiskProfile(ctx context.Context, profile *RiskProfile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitLocked(&JournalEntry{Kind: JournalProfile, Profile: profile})
+}
+
+func (r *InMemoryRepository) ListRiskProfiles(ctx context.Context, filters RiskFilters) ([]*RiskProfile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	profiles := []*RiskProfile{}
+	for _, profile := range r.profiles {
+		if filters.EntityType != "" && profile.EntityType != filters.EntityType {
+			continue
+		}
+		if filters.RiskLevel != "" && profile.RiskLevel != filters.RiskLevel {
+			continue
+		}
+		found := *profile
+		profiles = append(profiles, &found)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].CreatedAt.Before(profiles[j].CreatedAt)
+	})
+
+	return profiles, nil
+}
+
+func (r *InMemoryRepository) DeleteRiskProfile(ctx context.Context, entityID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitLocked(&JournalEntry{Kind: JournalProfileDelete, Key: entityID})
+}
+
+func (r *InMemoryRepository) CreateRiskRule(ctx context.Context, rule *RiskRule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.rules[rule.ID]; exists {
+		return fmt.Errorf("risk rule already exists: %s", rule.ID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalRule, Rule: rule})
+}
+
+func (r *InMemoryRepository) GetRiskRule(ctx context.Context, ruleID string) (*RiskRule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rule, exists := r.rules[ruleID]
+	if !exists {
+		return nil, nil
+	}
+	found := *rule
+	return &found, nil
+}
+
+func (r *InMemoryRepository) UpdateRiskRule(ctx context.Context, rule *RiskRule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.rules[rule.ID]; !exists {
+		return fmt.Errorf("risk rule not found: %s", rule.ID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalRule, Rule: rule})
+}
+
+func (r *InMemoryRepository) ListRiskRules(ctx context.Context, filters RiskFilters) ([]*RiskRule, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rules := []*RiskRule{}
+	for _, rule := range r.rules {
+		found := *rule
+		rules = append(rules, &found)
+	}
+
+	// Same order as the PostgreSQL repository
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+
+	return rules, nil
+}
+
+func (r *InMemoryRepository) DeleteRiskRule(ctx context.Context, ruleID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitLocked(&JournalEntry{Kind: JournalRuleDelete, Key: ruleID})
+}
+
+func (r *InMemoryRepository) CreateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitLocked(&JournalEntry{Kind: JournalAssessment, Assessment: assessment})
+}
+
+func (r *InMemoryRepository) GetRiskAssessment(ctx context.Context, assessmentID string) (*RiskAssessment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	assessment, exists := r.assessments[assessmentID]
+	if !exists {
+		return nil, nil
+	}
+	found := *assessment
+	return &found, nil
+}
+
+func (r *InMemoryRepository) UpdateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.assessments[assessment.ID]; !exists {
+		return fmt.Errorf("risk assessment not found: %s", assessment.ID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalAssessment, Assessment: assessment})
+}
+
+func (r *InMemoryRepository) ListRiskAssessments(ctx context.Context, filters RiskFilters) ([]*RiskAssessment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	assessments := []*RiskAssessment{}
+	for _, assessment := range r.assessments {
+		if filters.EntityType != "" && assessment.EntityType != filters.EntityType {
+			continue
+		}
+		if filters.RiskLevel != "" && assessment.RiskLevel != filters.RiskLevel {
+			continue
+		}
+		if !filters.FromDate.IsZero() && assessment.CreatedAt.Before(filters.FromDate) {
+			continue
+		}
+		if !filters.ToDate.IsZero() && assessment.CreatedAt.After(filters.ToDate) {
+			continue
+		}
+		found := *assessment
+		assessments = append(assessments, &found)
+	}
+
+	sort.Slice(assessments, func(i, j int) bool {
+		return assessments[i].CreatedAt.After(assessments[j].CreatedAt)
+	})
+
+	if filters.Offset > 0 {
+		if filters.Offset >= len(assessments) {
+			return []*RiskAssessment{}, nil
+		}
+		assessments = assessments[filters.Offset:]
+	}
+	if filters.Limit > 0 && len(assessments) > filters.Limit {
+		assessments = assessments[:filters.Limit]
+	}
+
+	return assessments, nil
+}
+
+func (r *InMemoryRepository) CreateReviewCase(ctx context.Context, reviewCase *ReviewCase) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitLocked(&JournalEntry{Kind: JournalReviewCase, ReviewCase: reviewCase})
+}
+
+func (r *InMemoryRepository) GetReviewCase(ctx context.Context, caseID string) (*ReviewCase, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reviewCase, exists := r.reviews[caseID]
+	if !exists {
+		return nil, nil
+	}
+	found := *reviewCase
+	return &found, nil
+}
+
+func (r *InMemoryRepository) UpdateReviewCase(ctx context.Context, reviewCase *ReviewCase) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.reviews[reviewCase.ID]; !exists {
+		return fmt.Errorf("review case not found: %s", reviewCase.ID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalReviewCase, ReviewCase: reviewCase})
+}
+
+func (r *InMemoryRepository) ListReviewCases(ctx context.Context, filters ReviewFilters) ([]*ReviewCase, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reviews := []*ReviewCase{}
+	for _, reviewCase := range r.reviews {
+		if filters.Status != "" && reviewCase.Status != filters.Status {
+			continue
+		}
+		if filters.SubjectType != "" && reviewCase.SubjectType != filters.SubjectType {
+			continue
+		}
+		if filters.EntityID != "" && reviewCase.EntityID != filters.EntityID {
+			continue
+		}
+		found := *reviewCase
+		reviews = append(reviews, &found)
+	}
+
+	sort.Slice(reviews, func(i, j int) bool {
+		return reviews[i].CreatedAt.Before(reviews[j].CreatedAt)
+	})
+	if filters.Limit > 0 && len(reviews) > filters.Limit {
+		reviews = reviews[:filters.Limit]
+	}
+	return reviews, nil
+}
+
+// Audit records, rule sets and models are never changed once written
+
+func (r *InMemoryRepository) CreateAssessmentAudit(ctx context.Context, audit *AssessmentAudit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.audits[audit.AssessmentID]; exists {
+		return fmt.Errorf("assessment audit already exists: %s", audit.AssessmentID)
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalAudit, Audit: audit})
+}
+
+func (r *InMemoryRepository) GetAssessmentAudit(ctx context.Context, assessmentID string) (*AssessmentAudit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	audit, exists := r.audits[assessmentID]
+	if !exists {
+		return nil, nil
+	}
+	found := *audit
+	return &found, nil
+}
+
+func (r *InMemoryRepository) SaveRuleSet(ctx context.Context, ruleSet *RuleSetSnapshot) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.ruleSets[ruleSet.Version]; exists {
+		return nil
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalRuleSet, RuleSet: ruleSet})
+}
+
+func (r *InMemoryRepository) GetRuleSet(ctx context.Context, version string) (*RuleSetSnapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ruleSet, exists := r.ruleSets[version]
+	if !exists {
+		return nil, nil
+	}
+	found := *ruleSet
+	return &found, nil
+}
+
+func (r *InMemoryRepository) SaveModelVersion(ctx context.Context, model *Model) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.models[modelVersion(model)]; exists {
+		return nil
+	}
+	return r.commitLocked(&JournalEntry{Kind: JournalModel, Model: model})
+}
+
+func (r *InMemoryRepository) GetModelVersion(ctx context.Context, version string) (*Model, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	model, exists := r.models[version]
+	if !exists {
+		return nil, nil
+	}
+	return model, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Review case statuses
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusDeclined = "declined"
+	ReviewStatusExpired  = "expired"
+)
+
+// Review decisions
+const (
+	ReviewDecisionApprove = "approve"
+	ReviewDecisionDecline = "decline"
+)
+
+// Subjects a review case can hold
+const (
+	ReviewSubjectPayment = "payment"
+	ReviewSubjectEscrow  = "escrow"
+)
+
+// ReviewSignatureHeader carries the HMAC-SHA256 of a review decision sent
+// to the owning service, keyed with the review signing key they share
+const ReviewSignatureHeader = "X-Review-Signature"
+
+// reviewerRoles may decide review cases
+var reviewerRoles = map[string]bool{
+	"admin":        true,
+	"risk_analyst": true,
+}
+
+// ReviewCase is a manual review opened for a "review" decision. The payment
+// or escrow action it refers to is held until the case is decided or expires.
+type ReviewCase struct {
+	ID              string     `json:"id"`
+	AssessmentID    string     `json:"assessment_id"`
+	EntityID        string     `json:"entity_id"`
+	EntityType      string     `json:"entity_type"`
+	SubjectType     string     `json:"subject_type,omitempty"` // payment, escrow
+	SubjectID       string     `json:"subject_id,omitempty"`
+	Action          string     `json:"action,omitempty"` // e.g. process, release
+	RiskScore       float64    `json:"risk_score"`
+	RiskLevel       string     `json:"risk_level"`
+	Reasons         []string   `json:"reasons,omitempty"`
+	Status          string     `json:"status"`
+	DefaultDecision string     `json:"default_decision"`
+	Decision        string     `json:"decision,omitempty"`
+	Analyst         string     `json:"analyst,omitempty"`
+	Notes           string     `json:"notes,omitempty"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	DecidedAt       *time.Time `json:"decided_at,omitempty"`
+	NotifiedAt      *time.Time `json:"notified_at,omitempty"`
+	NotifyError     string     `json:"notify_error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// ReviewFilters represents filters for listing review cases
+type ReviewFilters struct {
+	Status      string `json:"status,omitempty"`
+	SubjectType string `json:"subject_type,omitempty"`
+	EntityID    string `json:"entity_id,omitempty"`
+	Limit       int    `json:"limit,omitempty"`
+}
+
+// ReviewDecisionRequest is an analyst's decision on a review case. Over
+// HTTP the analyst is the caller the API gateway authenticated.
+type ReviewDecisionRequest struct {
+	Decision string `json:"decision"` // approve, decline
+	Analyst  string `json:"analyst"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// CanDecideReviews reports whether a caller's role may decide review cases
+func CanDecideReviews(role string) bool {
+	return reviewerRoles[role]
+}
+
+// ReviewPolicy controls how long cases wait for an analyst and what happens
+// when nobody decides in time
+type ReviewPolicy struct {
+	TTL             time.Duration
+	DefaultDecision string
+}
+
+// DefaultReviewPolicy declines held actions nobody reviewed within a day
+func DefaultReviewPolicy() ReviewPolicy {
+	return ReviewPolicy{
+		TTL:             24 * time.Hour,
+		DefaultDecision: ReviewDecisionDecline,
+	}
+}
+
+// ReviewNotifier tells the owning service that a held action was decided
+type ReviewNotifier interface {
+	NotifyReviewDecision(ctx context.Context, reviewCase *ReviewCase) error
+}
+
+// SetReviewPolicy configures review case expiry
+func (s *Service) SetReviewPolicy(policy ReviewPolicy) {
+	s.reviewPolicy = policy
+}
+
+// SetReviewNotifier configures how decided review cases are reported back
+func (s *Service) SetReviewNotifier(notifier ReviewNotifier) {
+	s.reviewNotifier = notifier
+}
+
+// openReviewCase opens a review case for an assessment that ended in review
+func (s *Service) openReviewCase(ctx context.Context, req *AssessRiskRequest, assessment *RiskAssessment) (*ReviewCase, error) {
+	subjectType, subjectID := reviewSubject(req.Context)
+	action, _ := req.Context["action"].(string)
+
+	reasons := []string{}
+	for _, hit := range assessment.RuleHits {
+		reasons = append(reasons, hit.Name)
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, fmt.Sprintf("risk score %.2f", assessment.RiskScore))
+	}
+
+	now := time.Now()
+	reviewCase := &ReviewCase{
+		ID:              "review_" + strings.TrimPrefix(assessment.ID, "risk_"),
+		AssessmentID:    assessment.ID,
+		EntityID:        assessment.EntityID,
+		EntityType:      assessment.EntityType,
+		SubjectType:     subjectType,
+		SubjectID:       subjectID,
+		Action:          action,
+		RiskScore:       assessment.RiskScore,
+		RiskLevel:       assessment.RiskLevel,
+		Reasons:         reasons,
+		Status:          ReviewStatusPending,
+		DefaultDecision: s.reviewPolicy.DefaultDecision,
+		ExpiresAt:       now.Add(s.reviewPolicy.TTL),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+
+	if err := s.repo.CreateReviewCase(ctx, reviewCase); err != nil {
+		return nil, fmt.Errorf("failed to create review case: %w", err)
+	}
+
+	return reviewCase, nil
+}
+
+// reviewSubject finds the payment or escrow an assessment was made for
+func reviewSubject(context map[string]interface{}) (string, string) {
+	if id, ok := context["payment_id"].(string); ok && id != "" {
+		return ReviewSubjectPayment, id
+	}
+	if id, ok := context["escrow_id"].(string); ok && id != "" {
+		return ReviewSubjectEscrow, id
+	}
+	return "", ""
+}
+
+// GetReviewCase retrieves a review case
+func (s *Service) GetReviewCase(ctx context.Context, caseID string) (*ReviewCase, error) {
+	reviewCase, err := s.repo.GetReviewCase(ctx, caseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get review case: %w", err)
+	}
+	if reviewCase == nil {
+		return nil, fmt.Errorf("review case not found: %s", caseID)
+	}
+	return reviewCase, nil
+}
+
+// ListReviewCases lists review cases, oldest first so the queue is worked in order
+func (s *Service) ListReviewCases(ctx context.Context, filters ReviewFilters) ([]*ReviewCase, error) {
+	return s.repo.ListReviewCases(ctx, filters)
+}
+
+// DecideReviewCase records an analyst decision, labels the assessment with
+// the outcome and releases or cancels the held action
+func (s *Service) DecideReviewCase(ctx context.Context, caseID string, req *ReviewDecisionRequest) (*ReviewCase, error) {
+	if req.Decision != ReviewDecisionApprove && req.Decision != ReviewDecisionDecline {
+		return nil, fmt.Errorf("invalid review decision: %s", req.Decision)
+	}
+	if strings.TrimSpace(req.Analyst) == "" {
+		return nil, fmt.Errorf("analyst is required")
+	}
+
+	reviewCase, err := s.GetReviewCase(ctx, caseID)
+	if err != nil {
+		return nil, err
+	}
+	if reviewCase.Status != ReviewStatusPending {
+		return nil, fmt.Errorf("review case %s is already %s", caseID, reviewCase.Status)
+	}
+
+	reviewCase.Decision = req.Decision
+	reviewCase.Analyst = req.Analyst
+	reviewCase.Notes = req.Notes
+	if req.Decision == ReviewDecisionApprove {
+		reviewCase.Status = ReviewStatusApproved
+	} else {
+		reviewCase.Status = ReviewStatusDeclined
+	}
+
+	if err := s.resolveReviewCase(ctx, reviewCase); err != nil {
+		return nil, err
+	}
+
+	// Analyst decisions are ground truth for backtesting
+	label := LabelLegitimate
+	if req.Decision == ReviewDecisionDecline {
+		label = LabelFraud
+	}
+	if _, err := s.LabelAssessment(ctx, reviewCase.AssessmentID, label); err != nil {
+		log.Printf("Failed to label assessment %s from review %s: %v", reviewCase.AssessmentID, reviewCase.ID, err)
+	}
+
+	return reviewCase, nil
+}
+
+// ExpireReviewCases applies the default decision to pending cases past their
+// expiry and retries notifications that previously failed. Expired cases are
+// not labelled since no analyst looked at them.
+func (s *Service) ExpireReviewCases(ctx context.Context, now time.Time) (int, error) {
+	pending, err := s.repo.ListReviewCases(ctx, ReviewFilters{Status: ReviewStatusPending})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list review cases: %w", err)
+	}
+
+	expired := 0
+	for _, reviewCase := range pending {
+		if now.Before(reviewCase.ExpiresAt) {
+			continue
+		}
+
+		reviewCase.Status = ReviewStatusExpired
+		reviewCase.Decision = reviewCase.DefaultDecision
+		if err := s.resolveReviewCase(ctx, reviewCase); err != nil {
+			log.Printf("Failed to expire review case %s: %v", reviewCase.ID, err)
+			continue
+		}
+		expired++
+	}
+
+	// Retry decided cases whose owner never heard about the decision
+	all, err := s.repo.ListReviewCases(ctx, ReviewFilters{})
+	if err != nil {
+		return expired, fmt.Errorf("failed to list review cases: %w", err)
+	}
+	for _, reviewCase := range all {
+		if reviewCase.Status != ReviewStatusPending && reviewCase.NotifiedAt == nil && reviewCase.SubjectID != "" {
+			s.notifyReviewDecision(ctx, reviewCase)
+			if err := s.repo.UpdateReviewCase(ctx, reviewCase); err != nil {
+				log.Printf("Failed to update review case %s: %v", reviewCase.ID, err)
+			}
+		}
+	}
+
+	return expired, nil
+}
+
+// resolveReviewCase stores a decided case and notifies the held action's owner
+func (s *Service) resolveReviewCase(ctx context.Context, reviewCase *ReviewCase) error {
+	now := time.Now()
+	reviewCase.DecidedAt = &now
+	reviewCase.UpdatedAt = now
+
+	if reviewCase.SubjectID != "" {
+		s.notifyReviewDecision(ctx, reviewCase)
+	}
+
+	if err := s.repo.UpdateReviewCase(ctx, reviewCase); err != nil {
+		return fmt.Errorf("failed to update review case: %w", err)
+	}
+
+	return nil
+}
+
+// notifyReviewDecision reports the decision to the owning service. A failure
+// is recorded on the case and retried by ExpireReviewCases.
+func (s *Service) notifyReviewDecision(ctx context.Context, reviewCase *ReviewCase) {
+	if s.reviewNotifier == nil {
+		return
+	}
+
+	if err := s.reviewNotifier.NotifyReviewDecision(ctx, reviewCase); err != nil {
+		log.Printf("Failed to notify %s %s of review decision: %v", reviewCase.SubjectType, reviewCase.SubjectID, err)
+		reviewCase.NotifyError = err.Error()
+		return
+	}
+
+	now := time.Now()
+	reviewCase.NotifiedAt = &now
+	reviewCase.NotifyError = ""
+}
+
+// HTTPReviewNotifier posts review decisions to payment-service and
+// escrow-service, signed so they can tell the decisions came from here
+type HTTPReviewNotifier struct {
+	baseURLs   map[string]string
+	signingKey []byte
+	client     *http.Client
+}
+
+// NewHTTPReviewNotifier creates a notifier for the given payment and escrow
+// service URLs, signing decisions with signingKey
+func NewHTTPReviewNotifier(paymentServiceURL, escrowServiceURL string, signingKey []byte) *HTTPReviewNotifier {
+	return &HTTPReviewNotifier{
+		baseURLs: map[string]string{
+			ReviewSubjectPayment: paymentServiceURL + "/v1/payments/",
+			ReviewSubjectEscrow:  escrowServiceURL + "/v1/escrows/",
+		},
+		signingKey: signingKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// NotifyReviewDecision posts the decision to {subject}/review
+func (n *HTTPReviewNotifier) NotifyReviewDecision(ctx context.Context, reviewCase *ReviewCase) error {
+	baseURL, ok := n.baseURLs[reviewCase.SubjectType]
+	if !ok {
+		return fmt.Errorf("unknown review subject type: %s", reviewCase.SubjectType)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"review_case_id": reviewCase.ID,
+		"assessment_id":  reviewCase.AssessmentID,
+		"decision":       reviewCase.Decision,
+		"status":         reviewCase.Status,
+		"analyst":        reviewCase.Analyst,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal review decision: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+reviewCase.SubjectID+"/review", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ReviewSignatureHeader, signReviewDecision(n.signingKey, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send review decision: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// A conflict means the action was already resolved on the other side
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("%s service returned status %d", reviewCase.SubjectType, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// signReviewDecision returns the hex HMAC-SHA256 of a review decision body
+func signReviewDecision(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
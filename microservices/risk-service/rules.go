@@ -0,0 +1,1083 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// RuleHit records a rule that fired during an assessment
+type RuleHit struct {
+	RuleID        string                 `json:"rule_id"`
+	Name          string                 `json:"name"`
+	Priority      int                    `json:"priority"`
+	Shadow        bool                   `json:"shadow,omitempty"`
+	Expression    string                 `json:"expression"`
+	Actions       []string               `json:"actions"`
+	MatchedValues map[string]interface{} `json:"matched_values"`
+}
+
+// RuleError records a rule that could not be evaluated and was skipped
+type RuleError struct {
+	RuleID string `json:"rule_id"`
+	Name   string `json:"name"`
+	Shadow bool   `json:"shadow,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ErrDivisionByZero is returned when a rule expression divides by zero
+var ErrDivisionByZero = errors.New("division by zero")
+
+// RuleOutcome is the combined effect of every rule that fired
+type RuleOutcome struct {
+	Hits          []RuleHit
+	Errors        []RuleError // rules skipped because they failed to evaluate
+	ScoreDelta    float64
+	Decision      string // empty when no rule forced a decision
+	DecisionRule  string
+	Tags          []string
+	Verifications []string
+}
+
+const (
+	// RuleModeLive rules change assessment decisions
+	RuleModeLive = "live"
+
+	// RuleModeShadow rules are evaluated and recorded on the assessment but
+	// do not change its score or decision
+	RuleModeShadow = "shadow"
+)
+
+// IsShadow reports whether the rule runs in shadow mode
+func (r *RiskRule) IsShadow() bool {
+	return r.Mode == RuleModeShadow
+}
+
+// RuleEngine evaluates active risk rules against an assessment context.
+//
+// A rule's Conditions either hold an "expression" in the rule language, for
+// example
+//
+//	amount > 5000 && country in ["NG", "RU"] && velocity.count_1h >= 3
+//
+// or a map of field conditions that are all required to match: a key ending
+// in _threshold or _min means field >= value, _max means field <= value, a
+// list means field in list, anything else means equality.
+//
+// Rules are evaluated from the highest Priority down. A rule that blocks or
+// explicitly allows stops evaluation of lower priority rules. A rule that
+// fails to compile or evaluate is skipped and recorded in the outcome's
+// Errors, so one broken rule does not fail the assessment.
+type RuleEngine struct {
+	mu    sync.RWMutex
+	cache map[string]compiledRule
+}
+
+type compiledRule struct {
+	updatedAt  time.Time
+	expression string
+	node       ruleNode
+}
+
+// NewRuleEngine creates a new rule engine
+func NewRuleEngine() *RuleEngine {
+	return &RuleEngine{
+		cache: make(map[string]compiledRule),
+	}
+}
+
+// Evaluate runs the live rules against the environment and collects their
+// actions. Shadow rules are skipped.
+func (e *RuleEngine) Evaluate(rules []*RiskRule, env map[string]interface{}) *RuleOutcome {
+	return e.evaluate(rules, env, func(rule *RiskRule) bool {
+		return rule.IsActive && !rule.IsShadow()
+	})
+}
+
+// EvaluateWithShadow runs the live and shadow rules together, giving the
+// outcome the assessment would have had with the shadow rules promoted
+func (e *RuleEngine) EvaluateWithShadow(rules []*RiskRule, env map[string]interface{}) *RuleOutcome {
+	return e.evaluate(rules, env, func(rule *RiskRule) bool {
+		return rule.IsActive
+	})
+}
+
+func (e *RuleEngine) evaluate(rules []*RiskRule, env map[string]interface{}, include func(rule *RiskRule) bool) *RuleOutcome {
+	active := make([]*RiskRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule != nil && include(rule) {
+			active = append(active, rule)
+		}
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		if active[i].Priority != active[j].Priority {
+			return active[i].Priority > active[j].Priority
+		}
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+
+	outcome := &RuleOutcome{}
+	for _, rule := range active {
+		compiled, err := e.compile(rule)
+		if err != nil {
+			outcome.skip(rule, err)
+			continue
+		}
+
+		matched := make(map[string]interface{})
+		result, err := compiled.node.eval(env, matched)
+		if err != nil {
+			outcome.skip(rule, err)
+			continue
+		}
+
+		if !truthy(result) {
+			continue
+		}
+
+		outcome.Hits = append(outcome.Hits, RuleHit{
+			RuleID:        rule.ID,
+			Name:          rule.Name,
+			Priority:      rule.Priority,
+			Shadow:        rule.IsShadow(),
+			Expression:    compiled.expression,
+			Actions:       rule.Actions,
+			MatchedValues: matched,
+		})
+
+		if terminal := outcome.apply(rule); terminal {
+			break
+		}
+	}
+
+	return outcome
+}
+
+// skip records a rule that failed to evaluate
+func (o *RuleOutcome) skip(rule *RiskRule, err error) {
+	o.Errors = append(o.Errors, RuleError{
+		RuleID: rule.ID,
+		Name:   rule.Name,
+		Shadow: rule.IsShadow(),
+		Error:  err.Error(),
+	})
+}
+
+// apply folds a fired rule's actions into the outcome and reports whether
+// evaluation should stop
+func (o *RuleOutcome) apply(rule *RiskRule) bool {
+	terminal := false
+	for _, raw := range rule.Actions {
+		action, arg := splitAction(raw)
+		switch action {
+		case "block":
+			o.Decision = "block"
+			o.DecisionRule = rule.ID
+			terminal = true
+		case "allow":
+			if o.Decision == "" {
+				o.Decision = "allow"
+				o.DecisionRule = rule.ID
+			}
+			terminal = true
+		case "review":
+			if o.Decision == "" {
+				o.Decision = "review"
+				o.DecisionRule = rule.ID
+			}
+		case "score_increase":
+			o.ScoreDelta += actionAmount(arg)
+		case "score_decrease":
+			o.ScoreDelta -= actionAmount(arg)
+		case "flag", "tag":
+			tag := arg
+			if tag == "" {
+				tag = rule.Name
+			}
+			o.Tags = append(o.Tags, tag)
+		case "require_verification":
+			o.Verifications = append(o.Verifications, rule.ID)
+		}
+	}
+	return terminal
+}
+
+func (e *RuleEngine) compile(rule *RiskRule) (compiledRule, error) {
+	e.mu.RLock()
+	cached, ok := e.cache[rule.ID]
+	e.mu.RUnlock()
+	if ok && cached.updatedAt.Equal(rule.UpdatedAt) {
+		return cached, nil
+	}
+
+	expression, err := RuleExpression(rule.Conditions)
+	if err != nil {
+		return compiledRule{}, err
+	}
+
+	node, err := ParseRuleExpression(expression)
+	if err != nil {
+		return compiledRule{}, err
+	}
+
+	compiled := compiledRule{updatedAt: rule.UpdatedAt, expression: expression, node: node}
+	e.mu.Lock()
+	e.cache[rule.ID] = compiled
+	e.mu.Unlock()
+
+	return compiled, nil
+}
+
+// RuleExpression returns the rule language expression for a rule's conditions
+func RuleExpression(conditions map[string]interface{}) (string, error) {
+	if expr, ok := conditions["expression"]; ok {
+		s, ok := expr.(string)
+		if !ok || strings.TrimSpace(s) == "" {
+			return "", errors.New("expression must be a non-empty string")
+		}
+		return s, nil
+	}
+
+	keys := make([]string, 0, len(conditions))
+	for key := range conditions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	clauses := make([]string, 0, len(keys))
+	for _, key := range keys {
+		literal, err := ruleLiteral(conditions[key])
+		if err != nil {
+			return "", fmt.Errorf("condition %s: %w", key, err)
+		}
+
+		switch {
+		case strings.HasSuffix(key, "_threshold"):
+			clauses = append(clauses, fmt.Sprintf("%s >= %s", strings.TrimSuffix(key, "_threshold"), literal))
+		case strings.HasSuffix(key, "_min"):
+			clauses = append(clauses, fmt.Sprintf("%s >= %s", strings.TrimSuffix(key, "_min"), literal))
+		case strings.HasSuffix(key, "_max"):
+			clauses = append(clauses, fmt.Sprintf("%s <= %s", strings.TrimSuffix(key, "_max"), literal))
+		default:
+			if strings.HasPrefix(literal, "[") {
+				clauses = append(clauses, fmt.Sprintf("%s in %s", key, literal))
+			} else {
+				clauses = append(clauses, fmt.Sprintf("%s == %s", key, literal))
+			}
+		}
+	}
+
+	if len(clauses) == 0 {
+		return "", errors.New("conditions cannot be empty")
+	}
+
+	return strings.Join(clauses, " && "), nil
+}
+
+// ruleLiteral renders a JSON value as a rule language literal
+func ruleLiteral(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return strconv.Quote(v), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			literal, err := ruleLiteral(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, literal)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case []string:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, strconv.Quote(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// buildRuleEnvironment flattens everything a rule can refer to. Context keys
+// are available both bare (country) and prefixed (context.country); bare
+// names never shadow the built-in fields.
+func buildRuleEnvironment(req *AssessRiskRequest, profile *RiskProfile, velocity, graph map[string]interface{}) map[string]interface{} {
+	env := make(map[string]interface{})
+
+	for key, value := range req.Context {
+		env["context."+key] = normalizeRuleValue(value)
+		env[key] = normalizeRuleValue(value)
+	}
+
+	env["entity_id"] = req.EntityID
+	env["entity_type"] = req.EntityType
+	env["payment_method"] = req.PaymentMethod
+	if req.Amount != nil && req.Amount.Value != nil {
+		amount, _ := req.Amount.Value.Float64()
+		env["amount"] = amount
+		env["currency"] = req.Amount.Currency
+	}
+
+	for key, value := range velocity {
+		env["velocity."+key] = normalizeRuleValue(value)
+	}
+
+	for key, value := range graph {
+		env["graph."+key] = normalizeRuleValue(value)
+	}
+
+	if profile != nil {
+		env["profile.risk_score"] = profile.RiskScore
+		env["profile.risk_level"] = profile.RiskLevel
+		env["profile.entity_type"] = profile.EntityType
+		env["profile.age_days"] = time.Since(profile.CreatedAt).Hours() / 24
+		for key, value := range profile.Factors {
+			env["profile.factors."+key] = normalizeRuleValue(value)
+		}
+	}
+
+	return env
+}
+
+func normalizeRuleValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return items
+	}
+	return value
+}
+
+func splitAction(action string) (string, string) {
+	if i := strings.Index(action, ":"); i >= 0 {
+		return action[:i], action[i+1:]
+	}
+	return action, ""
+}
+
+func actionAmount(arg string) float64 {
+	if arg == "" {
+		return 0.1
+	}
+	amount, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0
+	}
+	return amount
+}
+
+// Rule language
+
+// ruleNode is a node of a parsed rule expression
+type ruleNode interface {
+	eval(env map[string]interface{}, matched map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type identNode struct{ name string }
+
+type listNode struct{ items []ruleNode }
+
+type notNode struct{ operand ruleNode }
+
+type binaryNode struct {
+	op          string
+	left, right ruleNode
+}
+
+func (n literalNode) eval(env, matched map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n identNode) eval(env, matched map[string]interface{}) (interface{}, error) {
+	value := env[n.name]
+	matched[n.name] = value
+	return value, nil
+}
+
+func (n listNode) eval(env, matched map[string]interface{}) (interface{}, error) {
+	items := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(env, matched)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+func (n notNode) eval(env, matched map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(env, matched)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+func (n binaryNode) eval(env, matched map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(env, matched)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit so matched values only hold what decided the outcome
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(env, matched)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(env, matched)
+		return truthy(right), err
+	}
+
+	right, err := n.right.eval(env, matched)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return valuesEqual(left, right), nil
+	case "!=":
+		return !valuesEqual(left, right), nil
+	case ">", ">=", "<", "<=":
+		return compareValues(n.op, left, right), nil
+	case "in":
+		return listContains(right, left), nil
+	case "not in":
+		return !listContains(right, left), nil
+	case "contains":
+		if s, ok := left.(string); ok {
+			if sub, ok := right.(string); ok {
+				return strings.Contains(strings.ToLower(s), strings.ToLower(sub)), nil
+			}
+			return false, nil
+		}
+		return listContains(left, right), nil
+	case "+", "-", "*", "/":
+		return arithmetic(n.op, left, right)
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if af, ok := a.(float64); ok {
+		bf, ok := b.(float64)
+		return ok && af == bf
+	}
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		return ok && strings.EqualFold(as, bs)
+	}
+	return a == b
+}
+
+// compareValues orders numbers and strings; comparisons against missing
+// values are always false
+func compareValues(op string, a, b interface{}) bool {
+	var cmp int
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case av < bv:
+			cmp = -1
+		case av > bv:
+			cmp = 1
+		}
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(av, bv)
+	default:
+		return false
+	}
+
+	switch op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+func listContains(list, value interface{}) bool {
+	items, ok := list.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range items {
+		if valuesEqual(value, item) {
+			return true
+		}
+	}
+	return false
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	av, aok := a.(float64)
+	bv, bok := b.(float64)
+	if !aok || !bok {
+		return nil, nil
+	}
+	switch op {
+	case "+":
+		return av + bv, nil
+	case "-":
+		return av - bv, nil
+	case "*":
+		return av * bv, nil
+	}
+	if bv == 0 {
+		return nil, ErrDivisionByZero
+	}
+	return av / bv, nil
+}
+
+// ruleToken is a lexical token of the rule language
+type ruleToken struct {
+	kind  string // number, string, ident, op, eof
+	text  string
+	value interface{}
+	pos   int
+}
+
+func tokenizeRule(input string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			value, err := strconv.ParseFloat(string(runes[start:i]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d", start)
+			}
+			tokens = append(tokens, ruleToken{kind: "number", text: string(runes[start:i]), value: value, pos: start})
+		case r == '"' || r == '\'':
+			start := i
+			quote := r
+			i++
+			var sb strings.Builder
+			for i < len(runes) && runes[i] != quote {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			tokens = append(tokens, ruleToken{kind: "string", text: sb.String(), value: sb.String(), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			word := string(runes[start:i])
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, ruleToken{kind: "op", text: "&&", pos: start})
+			case "or":
+				tokens = append(tokens, ruleToken{kind: "op", text: "||", pos: start})
+			case "not":
+				tokens = append(tokens, ruleToken{kind: "op", text: "!", pos: start})
+			case "in", "contains":
+				tokens = append(tokens, ruleToken{kind: "op", text: strings.ToLower(word), pos: start})
+			case "true", "false":
+				tokens = append(tokens, ruleToken{kind: "bool", text: word, value: strings.ToLower(word) == "true", pos: start})
+			case "null":
+				tokens = append(tokens, ruleToken{kind: "null", text: word, pos: start})
+			default:
+				tokens = append(tokens, ruleToken{kind: "ident", text: word, pos: start})
+			}
+		default:
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "&&", "||", "==", "!=", ">=", "<=":
+				tokens = append(tokens, ruleToken{kind: "op", text: two, pos: start})
+				i += 2
+				continue
+			}
+			switch r {
+			case '>', '<', '!', '(', ')', '[', ']', ',', '+', '-', '*', '/':
+				tokens = append(tokens, ruleToken{kind: "op", text: string(r), pos: start})
+				i++
+			case '=':
+				// Accept a single = as equality, it is a common slip in hand-written rules
+				tokens = append(tokens, ruleToken{kind: "op", text: "==", pos: start})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q at %d", r, start)
+			}
+		}
+	}
+
+	return append(tokens, ruleToken{kind: "eof", pos: len(runes)}), nil
+}
+
+// ruleParser is a recursive descent parser for the rule language
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+// ParseRuleExpression parses a rule language expression
+func ParseRuleExpression(input string) (ruleNode, error) {
+	tokens, err := tokenizeRule(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ruleParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+
+	return node, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *ruleParser) isOp(text string) bool {
+	tok := p.peek()
+	return tok.kind == "op" && tok.text == text
+}
+
+func (p *ruleParser) expect(text string) error {
+	if !p.isOp(text) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at %d", text, tok.pos)
+	}
+	p.next()
+	return nil
+}
+
+func (p *ruleParser) parseOr() (ruleNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseNot() (ruleNode, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *ruleParser) parseComparison() (ruleNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.kind != "op" {
+		return left, nil
+	}
+
+	op := tok.text
+	switch op {
+	case "==", "!=", ">", ">=", "<", "<=", "in", "contains":
+		p.next()
+	case "!":
+		// "not in"
+		if p.tokens[p.pos+1].kind == "op" && p.tokens[p.pos+1].text == "in" {
+			p.next()
+			p.next()
+			op = "not in"
+		} else {
+			return left, nil
+		}
+	default:
+		return left, nil
+	}
+
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *ruleParser) parseAdditive() (ruleNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseMultiplicative() (ruleNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.next().text
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parsePrimary() (ruleNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case "number", "string", "bool":
+		return literalNode{value: tok.value}, nil
+	case "null":
+		return literalNode{value: nil}, nil
+	case "ident":
+		return identNode{name: tok.text}, nil
+	case "op":
+		switch tok.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case "[":
+			list := listNode{}
+			for !p.isOp("]") {
+				item, err := p.parseAdditive()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return list, nil
+		case "-":
+			operand, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return binaryNode{op: "-", left: literalNode{value: 0.0}, right: operand}, nil
+		}
+	case "eof":
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+// applyRiskRules evaluates the configured rules and folds their outcome into
+// the assessment. Shadow rules are evaluated alongside and only recorded. The
+// returned audit holds the inputs and versions needed to replay it.
+func (s *Service) applyRiskRules(ctx context.Context, req *AssessRiskRequest, profile *RiskProfile, velocity, graph map[string]interface{}, assessment *RiskAssessment) (*AssessmentAudit, error) {
+	rules, err := s.repo.ListRiskRules(ctx, RiskFilters{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list risk rules: %w", err)
+	}
+
+	ruleSetVersion, err := s.snapshotRuleSet(ctx, rules)
+	if err != nil {
+		return nil, err
+	}
+	assessment.RuleSetVersion = ruleSetVersion
+
+	model := s.Model()
+	if err := s.snapshotModel(ctx, model); err != nil {
+		return nil, err
+	}
+	assessment.ModelVersion = modelVersion(model)
+
+	// Keep what the rules saw so the assessment can be backtested later
+	env := buildRuleEnvironment(req, profile, velocity, graph)
+	assessment.Inputs = env
+
+	audit := &AssessmentAudit{
+		AssessedAt: assessment.CreatedAt,
+		Request:    req,
+		Profile:    copyRiskProfile(profile),
+		Velocity:   velocity,
+		Graph:      graph,
+		Inputs:     make(map[string]interface{}, len(env)),
+	}
+	for key, value := range env {
+		audit.Inputs[key] = value
+	}
+
+	if err := s.scoreAssessment(assessment, env, rules, model, true); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+// scoreAssessment blends in the model score and applies a rule set to an
+// assessment scored without rules
+func (s *Service) scoreAssessment(assessment *RiskAssessment, env map[string]interface{}, rules []*RiskRule, model *Model, shadowRules bool) error {
+	// Blend in the model score before rules adjust it
+	s.applyModel(assessment, env, model)
+	assessment.Factors["base_risk_score"] = assessment.RiskScore
+
+	outcome := s.rules.Evaluate(rules, env)
+	assessment.RuleErrors = outcome.Errors
+
+	if shadowRules && hasShadowRules(rules) {
+		shadow := s.rules.EvaluateWithShadow(rules, env)
+
+		for _, hit := range shadow.Hits {
+			if hit.Shadow {
+				assessment.ShadowRuleHits = append(assessment.ShadowRuleHits, hit)
+			}
+		}
+		for _, ruleErr := range shadow.Errors {
+			if ruleErr.Shadow {
+				assessment.RuleErrors = append(assessment.RuleErrors, ruleErr)
+			}
+		}
+
+		if len(assessment.ShadowRuleHits) > 0 {
+			shadowDecision := s.ruleDecision(assessment.RiskScore, shadow)
+			assessment.ShadowDecision = shadowDecision.Decision
+			log.Printf("Shadow rules fired for assessment %s: %d hits, decision %s (live %s)",
+				assessment.ID, len(assessment.ShadowRuleHits), shadowDecision.Decision, s.ruleDecision(assessment.RiskScore, outcome).Decision)
+		}
+	}
+
+	for _, ruleErr := range assessment.RuleErrors {
+		log.Printf("Skipped rule %s in assessment %s: %s", ruleErr.RuleID, assessment.ID, ruleErr.Error)
+	}
+
+	s.foldRuleOutcome(assessment, outcome)
+	return nil
+}
+
+// foldRuleOutcome applies a rule outcome to an assessment scored without rules
+func (s *Service) foldRuleOutcome(assessment *RiskAssessment, outcome *RuleOutcome) {
+	if len(outcome.Hits) == 0 {
+		return
+	}
+
+	for _, hit := range outcome.Hits {
+		assessment.RulesApplied = append(assessment.RulesApplied, hit.RuleID)
+	}
+	assessment.RuleHits = outcome.Hits
+	assessment.Tags = outcome.Tags
+
+	decision := s.ruleDecision(assessment.RiskScore, outcome)
+	if outcome.ScoreDelta != 0 {
+		assessment.Factors["rule_score_adjustment"] = outcome.ScoreDelta
+	}
+	if len(outcome.Verifications) > 0 {
+		assessment.Factors["verification_required"] = true
+	}
+
+	assessment.RiskScore = decision.RiskScore
+	assessment.RiskLevel = s.calculateRiskLevel(decision.RiskScore)
+	assessment.Decision = decision.Decision
+	assessment.DecisionRule = decision.DecisionRule
+}
+
+// RuleDecision is the score and decision that follow from a rule outcome
+type RuleDecision struct {
+	RiskScore    float64 `json:"risk_score"`
+	Decision     string  `json:"decision"`
+	DecisionRule string  `json:"decision_rule,omitempty"`
+}
+
+// ruleDecision combines a score computed without rules and a rule outcome
+func (s *Service) ruleDecision(baseScore float64, outcome *RuleOutcome) RuleDecision {
+	score := math.Min(1.0, math.Max(0.0, baseScore+outcome.ScoreDelta))
+	decision := RuleDecision{RiskScore: score, Decision: s.calculateDecision(score)}
+
+	if outcome.Decision != "" {
+		decision.Decision = outcome.Decision
+		decision.DecisionRule = outcome.DecisionRule
+	}
+
+	return decision
+}
+
+func hasShadowRules(rules []*RiskRule) bool {
+	for _, rule := range rules {
+		if rule.IsActive && rule.IsShadow() {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRiskRuleMode switches a rule between live and shadow mode
+func (s *Service) SetRiskRuleMode(ctx context.Context, ruleID, mode string) (*RiskRule, error) {
+	if err := s.validator.validateRuleMode(mode); err != nil {
+		return nil, err
+	}
+
+	rule, err := s.repo.GetRiskRule(ctx, ruleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get risk rule: %w", err)
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("risk rule not found: %s", ruleID)
+	}
+
+	rule.Mode = mode
+	rule.UpdatedAt = time.Now()
+
+	if err := s.repo.UpdateRiskRule(ctx, rule); err != nil {
+		return nil, fmt.Errorf("failed to update risk rule: %w", err)
+	}
+
+	return rule, nil
+}
+
+// velocityFromContext reads the velocity counters supplied by the caller,
+// either as a "velocity" object or as top-level *_count_* keys
+func velocityFromContext(context map[string]interface{}) map[string]interface{} {
+	velocity := make(map[string]interface{})
+
+	if nested, ok := context["velocity"].(map[string]interface{}); ok {
+		for key, value := range nested {
+			velocity[key] = value
+		}
+	}
+
+	for key, value := range context {
+		if strings.Contains(key, "_count_") {
+			if _, exists := velocity[key]; !exists {
+				velocity[key] = value
+			}
+		}
+	}
+
+	return velocity
+}
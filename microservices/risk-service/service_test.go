@@ -2,8 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRiskService_CreateRiskProfile(t *testing.T) {
@@ -388,6 +398,1324 @@ func TestRiskService_PaymentMethodRisk(t *testing.T) {
 	}
 }
 
+func TestRuleExpression_Evaluate(t *testing.T) {
+	env := map[string]interface{}{
+		"amount":                   7500.0,
+		"currency":                 "USD",
+		"country":                  "NG",
+		"device_id":                "dev_123",
+		"velocity.count_1h":        4.0,
+		"profile.risk_score":       0.35,
+		"context.email":            "buyer@example.com",
+		"context.flagged_products": []interface{}{"gift_card", "crypto"},
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{`amount > 5000 && currency == "USD"`, true},
+		{`amount > 5000 and country in ["RU", "KP"]`, false},
+		{`country in ["NG", "GH"] or amount < 10`, true},
+		{`not (velocity.count_1h >= 3)`, false},
+		{`profile.risk_score * 2 > 0.5`, true},
+		{`context.email contains "@example.com"`, true},
+		{`context.flagged_products contains "crypto"`, true},
+		{`country not in ["NG"]`, false},
+		{`device_id != null && missing_field == null`, true},
+		{`missing_field > 10`, false},
+	}
+
+	for _, tt := range tests {
+		node, err := ParseRuleExpression(tt.expression)
+		if err != nil {
+			t.Fatalf("Expected %q to parse, got %v", tt.expression, err)
+		}
+
+		result, err := node.eval(env, map[string]interface{}{})
+		if err != nil {
+			t.Fatalf("Expected %q to evaluate, got %v", tt.expression, err)
+		}
+
+		if truthy(result) != tt.expected {
+			t.Errorf("Expected %q to be %v, got %v", tt.expression, tt.expected, result)
+		}
+	}
+
+	for _, invalid := range []string{`amount >`, `(amount > 1`, `amount > "unterminated`, `amount # 1`} {
+		if _, err := ParseRuleExpression(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRiskService_RulesEngine(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	ctx := context.Background()
+
+	now := time.Now()
+	rules := []*RiskRule{
+		{
+			ID:         "rule_block_country",
+			Name:       "Sanctioned corridor",
+			Conditions: map[string]interface{}{"expression": `country in ["KP", "IR"] && amount > 100`},
+			Actions:    []string{"block"},
+			Priority:   90,
+			IsActive:   true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		{
+			ID:         "rule_velocity",
+			Name:       "High velocity",
+			Conditions: map[string]interface{}{"expression": `velocity.card_count_1h >= 3`},
+			Actions:    []string{"score_increase:0.3", "tag:high_velocity"},
+			Priority:   50,
+			IsActive:   true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		{
+			ID:         "rule_amount",
+			Name:       "High amount",
+			Conditions: map[string]interface{}{"amount_threshold": 5000.0, "currency": "USD"},
+			Actions:    []string{"review", "flag"},
+			Priority:   10,
+			IsActive:   true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		{
+			ID:         "rule_inactive",
+			Name:       "Inactive",
+			Conditions: map[string]interface{}{"expression": `amount > 0`},
+			Actions:    []string{"block"},
+			Priority:   100,
+			IsActive:   false,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+	for _, rule := range rules {
+		repo.CreateRiskRule(ctx, rule)
+	}
+
+	// Blocked corridor stops evaluation of lower priority rules
+	assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "rules_user_1",
+		EntityType: "user",
+		Context: map[string]interface{}{
+			"country": "KP",
+		},
+		Amount: FromMinorUnits("USD", 20000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if assessment.Decision != "block" || assessment.DecisionRule != "rule_block_country" {
+		t.Errorf("Expected block by rule_block_country, got %s by %s", assessment.Decision, assessment.DecisionRule)
+	}
+
+	if len(assessment.RuleHits) != 1 {
+		t.Fatalf("Expected 1 rule hit, got %d", len(assessment.RuleHits))
+	}
+
+	if assessment.RuleHits[0].MatchedValues["country"] != "KP" || assessment.RuleHits[0].MatchedValues["amount"] != 200.0 {
+		t.Errorf("Expected matched country KP and amount 200, got %v", assessment.RuleHits[0].MatchedValues)
+	}
+
+	// Velocity and amount rules both fire, in priority order, once the same
+	// card has been seen three times within the hour
+	for i := 0; i < 2; i++ {
+		_, err = service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+			EntityID:   fmt.Sprintf("rules_card_user_%d", i),
+			EntityType: "user",
+			Context:    map[string]interface{}{"country": "US", "card_fingerprint": "fp_shared"},
+			Amount:     FromMinorUnits("USD", 2000),
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	assessment, err = service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "rules_user_2",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US", "card_fingerprint": "fp_shared"},
+		Amount:     FromMinorUnits("USD", 600000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(assessment.RuleHits) != 2 || assessment.RuleHits[0].RuleID != "rule_velocity" || assessment.RuleHits[1].RuleID != "rule_amount" {
+		t.Fatalf("Expected rule_velocity then rule_amount to fire, got %v", assessment.RuleHits)
+	}
+
+	if assessment.Decision != "review" {
+		t.Errorf("Expected decision review, got %s", assessment.Decision)
+	}
+
+	if assessment.Factors["rule_score_adjustment"] != 0.3 {
+		t.Errorf("Expected rule score adjustment 0.3, got %v", assessment.Factors["rule_score_adjustment"])
+	}
+
+	if len(assessment.Tags) != 2 || assessment.Tags[0] != "high_velocity" || assessment.Tags[1] != "High amount" {
+		t.Errorf("Expected tags [high_velocity High amount], got %v", assessment.Tags)
+	}
+
+	applied := strings.Join(assessment.RulesApplied, ",")
+	if !strings.Contains(applied, "rule_velocity") || !strings.Contains(applied, "rule_amount") {
+		t.Errorf("Expected fired rules in rules applied, got %v", assessment.RulesApplied)
+	}
+
+	// No rule fires for a small domestic payment
+	assessment, err = service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "rules_user_3",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US"},
+		Amount:     FromMinorUnits("USD", 2000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(assessment.RuleHits) != 0 || assessment.DecisionRule != "" {
+		t.Errorf("Expected no rule hits, got %v", assessment.RuleHits)
+	}
+}
+
+func TestRiskService_RuleErrorsAreSkipped(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	ctx := context.Background()
+
+	now := time.Now()
+	rules := []*RiskRule{
+		{
+			ID:         "rule_divide",
+			Name:       "Divides by zero",
+			Conditions: map[string]interface{}{"expression": `amount / 0 > 1`},
+			Actions:    []string{"block"},
+			Priority:   90,
+			IsActive:   true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		{
+			ID:         "rule_amount",
+			Name:       "High amount",
+			Conditions: map[string]interface{}{"expression": `amount > 100`},
+			Actions:    []string{"review"},
+			Priority:   10,
+			IsActive:   true,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+	for _, rule := range rules {
+		repo.CreateRiskRule(ctx, rule)
+	}
+
+	assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "rule_errors_user",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US"},
+		Amount:     FromMinorUnits("USD", 20000),
+	})
+	if err != nil {
+		t.Fatalf("Expected a failing rule not to fail the assessment, got %v", err)
+	}
+
+	if len(assessment.RuleErrors) != 1 || assessment.RuleErrors[0].RuleID != "rule_divide" {
+		t.Fatalf("Expected rule_divide to be recorded as a rule error, got %+v", assessment.RuleErrors)
+	}
+
+	if !strings.Contains(assessment.RuleErrors[0].Error, ErrDivisionByZero.Error()) {
+		t.Errorf("Expected a division by zero error, got %q", assessment.RuleErrors[0].Error)
+	}
+
+	if len(assessment.RuleHits) != 1 || assessment.RuleHits[0].RuleID != "rule_amount" {
+		t.Errorf("Expected rule_amount to still fire, got %+v", assessment.RuleHits)
+	}
+
+	if assessment.Decision == "block" {
+		t.Errorf("Expected the skipped rule not to block, got %s", assessment.Decision)
+	}
+}
+
+func TestVelocityTracker_Windows(t *testing.T) {
+	store := NewInMemoryVelocityStore()
+	tracker := NewVelocityTracker(store)
+
+	now := time.Now()
+	req := &AssessRiskRequest{
+		EntityID:   "velocity_user",
+		EntityType: "user",
+		Context:    map[string]interface{}{"ip_address": "10.0.0.1"},
+		Amount:     FromMinorUnits("USD", 10000),
+	}
+
+	// Events 3 days, 5 hours and 10 minutes ago, then the current one
+	for i, age := range []time.Duration{72 * time.Hour, 5 * time.Hour, 10 * time.Minute} {
+		tracker.now = func() time.Time { return now.Add(-age) }
+		if _, err := tracker.Observe(context.Background(), fmt.Sprintf("event_%d", i), req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	tracker.now = func() time.Time { return now }
+	velocity, err := tracker.Observe(context.Background(), "event_current", req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := map[string]float64{
+		"entity_count_1h":       2,
+		"entity_count_24h":      3,
+		"entity_count_7d":       4,
+		"entity_sum_24h":        300,
+		"ip_count_7d":           4,
+		"transaction_count_24h": 3,
+	}
+	for key, value := range expected {
+		if velocity[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, velocity[key])
+		}
+	}
+
+	if _, exists := velocity["card_count_1h"]; exists {
+		t.Error("Expected no card counters without a card fingerprint")
+	}
+
+	// Read-only observations do not add events
+	req.Amount = nil
+	velocity, _ = tracker.Observe(context.Background(), "event_profile_check", req)
+	if velocity["entity_count_1h"] != 2.0 {
+		t.Errorf("Expected entity_count_1h 2, got %v", velocity["entity_count_1h"])
+	}
+}
+
+func TestRiskService_ShadowRules(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	ctx := context.Background()
+
+	_, err := service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Candidate block",
+		Description: "Block payments over $1000",
+		RuleType:    "threshold",
+		Conditions:  map[string]interface{}{"expression": `amount > 1000`},
+		Actions:     []string{"block"},
+		Priority:    50,
+		Mode:        RuleModeShadow,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "shadow_user",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US"},
+		Amount:     FromMinorUnits("USD", 200000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if assessment.Decision == "block" || len(assessment.RuleHits) != 0 {
+		t.Errorf("Expected shadow rule not to affect the decision, got %s with %d hits", assessment.Decision, len(assessment.RuleHits))
+	}
+
+	if len(assessment.ShadowRuleHits) != 1 || !assessment.ShadowRuleHits[0].Shadow {
+		t.Fatalf("Expected 1 shadow rule hit, got %v", assessment.ShadowRuleHits)
+	}
+
+	if assessment.ShadowDecision != "block" {
+		t.Errorf("Expected shadow decision block, got %s", assessment.ShadowDecision)
+	}
+
+	// Promoting the rule makes it live
+	if _, err := service.SetRiskRuleMode(ctx, assessment.ShadowRuleHits[0].RuleID, RuleModeLive); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	assessment, err = service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:   "shadow_user_2",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US"},
+		Amount:     FromMinorUnits("USD", 200000),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if assessment.Decision != "block" || len(assessment.ShadowRuleHits) != 0 {
+		t.Errorf("Expected live rule to block, got %s", assessment.Decision)
+	}
+}
+
+func TestRiskService_BacktestRules(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	ctx := context.Background()
+
+	payments := []struct {
+		amount int64
+		label  string
+	}{
+		{10000, LabelLegitimate},
+		{60000, LabelFraud},
+		{90000, LabelFraud},
+		{5000, LabelLegitimate},
+		{70000, ""},
+	}
+
+	for i, payment := range payments {
+		assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+			EntityID:   fmt.Sprintf("backtest_user_%d", i),
+			EntityType: "user",
+			Context:    map[string]interface{}{"country": "US"},
+			Amount:     FromMinorUnits("USD", payment.amount),
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if payment.label != "" {
+			if _, err := service.LabelAssessment(ctx, assessment.ID, payment.label); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+	}
+
+	report, err := service.BacktestRules(ctx, &BacktestRequest{
+		Rules: []*CreateRiskRuleRequest{{
+			Name:        "Block over $500",
+			Description: "Candidate amount rule",
+			RuleType:    "threshold",
+			Conditions:  map[string]interface{}{"amount_min": 500.0},
+			Actions:     []string{"block"},
+			Priority:    20,
+		}},
+		FlaggedDecisions: []string{"block"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if report.Replayed != 5 || report.Labeled != 4 {
+		t.Errorf("Expected 5 replayed and 4 labeled, got %d and %d", report.Replayed, report.Labeled)
+	}
+
+	if report.RuleHits["candidate_1"] != 3 {
+		t.Errorf("Expected candidate rule to fire 3 times, got %d", report.RuleHits["candidate_1"])
+	}
+
+	if report.DecisionsChanged != 3 || report.Transitions["allow->block"]+report.Transitions["review->block"] != 3 {
+		t.Errorf("Expected 3 decisions to change to block, got %v", report.Transitions)
+	}
+
+	candidate := report.Candidate
+	if candidate.TruePositives != 2 || candidate.FalsePositives != 0 || candidate.Precision != 1 || candidate.Recall != 1 {
+		t.Errorf("Expected perfect candidate precision and recall, got %+v", candidate)
+	}
+
+	if report.Baseline.Recall != 0 {
+		t.Errorf("Expected baseline recall 0 without block decisions, got %f", report.Baseline.Recall)
+	}
+
+	if _, err := service.LabelAssessment(ctx, "missing", LabelFraud); err == nil {
+		t.Error("Expected error labeling unknown assessment")
+	}
+}
+
+func TestRiskService_CreateRiskRuleValidatesConditions(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+
+	req := &CreateRiskRuleRequest{
+		Name:        "Broken Rule",
+		Description: "Review large payments",
+		RuleType:    "pattern",
+		Conditions:  map[string]interface{}{"expression": `amount > && country == "US"`},
+		Actions:     []string{"review"},
+		Priority:    10,
+	}
+	if _, err := service.CreateRiskRuleWithValidation(context.Background(), req); err == nil {
+		t.Error("Expected error for invalid expression")
+	}
+
+	req.Conditions = map[string]interface{}{"expression": `amount > 1000`}
+	req.Actions = []string{"score_increase:1.5"}
+	if _, err := service.CreateRiskRuleWithValidation(context.Background(), req); err == nil {
+		t.Error("Expected error for out of range score change")
+	}
+
+	req.Actions = []string{"score_increase:0.25", "tag:large_payment"}
+	if _, err := service.CreateRiskRuleWithValidation(context.Background(), req); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+type recordingReviewNotifier struct {
+	decisions map[string]string
+}
+
+func (n *recordingReviewNotifier) NotifyReviewDecision(ctx context.Context, reviewCase *ReviewCase) error {
+	n.decisions[reviewCase.SubjectID] = reviewCase.Decision
+	return nil
+}
+
+func TestHTTPReviewNotifier_SignsDecisions(t *testing.T) {
+	key := []byte("review-signing-key")
+	var path, signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		signature = r.Header.Get(ReviewSignatureHeader)
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	notifier := NewHTTPReviewNotifier(server.URL, server.URL, key)
+	err := notifier.NotifyReviewDecision(context.Background(), &ReviewCase{
+		ID:          "review_1",
+		SubjectType: ReviewSubjectPayment,
+		SubjectID:   "pay_1",
+		Decision:    ReviewDecisionApprove,
+		Status:      ReviewStatusApproved,
+		Analyst:     "analyst_1",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if path != "/v1/payments/pay_1/review" {
+		t.Errorf("Expected decision posted to the payment, got %s", path)
+	}
+	if signature == "" || signature != signReviewDecision(key, body) {
+		t.Errorf("Expected decision signed with the review key, got %q", signature)
+	}
+	if signature == signReviewDecision([]byte("other-key"), body) {
+		t.Error("Expected signature to depend on the key")
+	}
+}
+
+func TestCanDecideReviews(t *testing.T) {
+	if !CanDecideReviews("risk_analyst") || !CanDecideReviews("admin") {
+		t.Error("Expected risk analysts and admins to decide reviews")
+	}
+	if CanDecideReviews("merchant") || CanDecideReviews("") {
+		t.Error("Expected other roles not to decide reviews")
+	}
+}
+
+func TestRiskService_ReviewQueue(t *testing.T) {
+	repo := NewMockRepository()
+	service := NewService(repo, nil)
+	notifier := &recordingReviewNotifier{decisions: make(map[string]string)}
+	service.SetReviewNotifier(notifier)
+	ctx := context.Background()
+
+	_, err := service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Large payment review",
+		Description: "Review payments over $500",
+		RuleType:    "threshold",
+		Conditions:  map[string]interface{}{"expression": `amount > 500`},
+		Actions:     []string{"review"},
+		Priority:    50,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	assess := func(entityID, paymentID string) *RiskAssessment {
+		assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+			EntityID:   entityID,
+			EntityType: "user",
+			Context:    map[string]interface{}{"payment_id": paymentID, "action": "process"},
+			Amount:     FromMinorUnits("USD", 80000),
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return assessment
+	}
+
+	approved := assess("review_user_1", "pay_1")
+	if approved.Decision != "review" || approved.ReviewCaseID == "" {
+		t.Fatalf("Expected review decision with a case, got %s (%q)", approved.Decision, approved.ReviewCaseID)
+	}
+	expiring := assess("review_user_2", "pay_2")
+
+	reviewCase, err := service.GetReviewCase(ctx, approved.ReviewCaseID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reviewCase.SubjectType != ReviewSubjectPayment || reviewCase.SubjectID != "pay_1" || reviewCase.Status != ReviewStatusPending {
+		t.Errorf("Expected pending case for payment pay_1, got %+v", reviewCase)
+	}
+
+	// Analyst approval releases the payment and labels the assessment
+	reviewCase, err = service.DecideReviewCase(ctx, approved.ReviewCaseID, &ReviewDecisionRequest{Decision: ReviewDecisionApprove, Analyst: "analyst_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reviewCase.Status != ReviewStatusApproved || reviewCase.NotifiedAt == nil {
+		t.Errorf("Expected approved and notified case, got %+v", reviewCase)
+	}
+	if notifier.decisions["pay_1"] != ReviewDecisionApprove {
+		t.Errorf("Expected payment pay_1 to be approved, got %q", notifier.decisions["pay_1"])
+	}
+	labeled, _ := repo.GetRiskAssessment(ctx, approved.ID)
+	if labeled.Label != LabelLegitimate {
+		t.Errorf("Expected assessment labelled legitimate, got %q", labeled.Label)
+	}
+
+	if _, err := service.DecideReviewCase(ctx, approved.ReviewCaseID, &ReviewDecisionRequest{Decision: ReviewDecisionDecline, Analyst: "analyst_2"}); err == nil {
+		t.Error("Expected error deciding an already decided case")
+	}
+
+	// Undecided cases expire with the default decision and are not labelled
+	count, err := service.ExpireReviewCases(ctx, time.Now().Add(25*time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 expired case, got %d", count)
+	}
+	reviewCase, _ = service.GetReviewCase(ctx, expiring.ReviewCaseID)
+	if reviewCase.Status != ReviewStatusExpired || reviewCase.Decision != ReviewDecisionDecline {
+		t.Errorf("Expected expired case declined by default, got %s/%s", reviewCase.Status, reviewCase.Decision)
+	}
+	if notifier.decisions["pay_2"] != ReviewDecisionDecline {
+		t.Errorf("Expected payment pay_2 to be declined, got %q", notifier.decisions["pay_2"])
+	}
+	unlabeled, _ := repo.GetRiskAssessment(ctx, expiring.ID)
+	if unlabeled.Label != "" {
+		t.Errorf("Expected expired case not to label the assessment, got %q", unlabeled.Label)
+	}
+}
+
+const testLogisticModel = `{
+	"name": "fraud_lr",
+	"version": "2026.10.1",
+	"type": "logistic_regression",
+	"blend_weight": 0.6,
+	"feature_schema": {
+		"version": "v1",
+		"features": [
+			{"name": "amount_log", "source": "amount", "transform": "log1p"},
+			{"name": "count_1h", "source": "velocity.count_1h"},
+			{"name": "crypto", "source": "payment_method", "equals": "crypto"}
+		]
+	},
+	"intercept": -6,
+	"coefficients": {"amount_log": 0.5, "count_1h": 0.3, "crypto": 1.5}
+}`
+
+const testTreeModel = `{
+	"name": "fraud_gbt",
+	"version": "3",
+	"type": "gradient_boosted_trees",
+	"feature_schema": {
+		"version": "v2",
+		"features": [
+			{"name": "amount", "source": "amount"},
+			{"name": "new_account", "source": "profile.age_days"}
+		]
+	},
+	"base_score": -1,
+	"trees": [
+		{"nodes": [
+			{"id": 0, "feature": "amount", "threshold": 1000, "yes": 1, "no": 2},
+			{"id": 1, "leaf": -0.5, "cover": 90},
+			{"id": 2, "feature": "new_account", "threshold": 7, "yes": 3, "no": 4, "missing": 3, "cover": 10},
+			{"id": 3, "leaf": 2, "cover": 4},
+			{"id": 4, "leaf": 0.5, "cover": 6}
+		]}
+	]
+}`
+
+func TestModel_Score(t *testing.T) {
+	model, err := ParseModel([]byte(testLogisticModel))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	result := model.Score(map[string]interface{}{"amount": 999.0, "velocity.count_1h": 4.0, "payment_method": "crypto"})
+	margin := -6 + 0.5*math.Log1p(999) + 0.3*4 + 1.5
+	if math.Abs(result.Margin-margin) > 1e-9 {
+		t.Errorf("Expected margin %f, got %f", margin, result.Margin)
+	}
+	if math.Abs(result.Score-1/(1+math.Exp(-margin))) > 1e-9 {
+		t.Errorf("Expected sigmoid of margin, got %f", result.Score)
+	}
+	if top := result.TopContributions(1); len(top) != 1 || top[0] != "amount_log" {
+		t.Errorf("Expected amount_log as top contribution, got %v", top)
+	}
+
+	// Missing inputs fall back to defaults and are reported
+	result = model.Score(map[string]interface{}{"amount": 10.0})
+	if len(result.MissingFeatures) != 1 || result.MissingFeatures[0] != "count_1h" {
+		t.Errorf("Expected count_1h to be missing, got %v", result.MissingFeatures)
+	}
+
+	trees, err := ParseModel([]byte(testTreeModel))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Contributions and bias add up to the margin
+	result = trees.Score(map[string]interface{}{"amount": 5000.0, "profile.age_days": 2.0})
+	if result.Margin != 1 {
+		t.Errorf("Expected margin 1, got %f", result.Margin)
+	}
+	sum := result.Bias
+	for _, contribution := range result.Contributions {
+		sum += contribution
+	}
+	if math.Abs(sum-result.Margin) > 1e-9 {
+		t.Errorf("Expected contributions to add up to margin %f, got %f", result.Margin, sum)
+	}
+	if result.Contributions["amount"] <= 0 || result.Contributions["new_account"] <= 0 {
+		t.Errorf("Expected both features to raise the score, got %v", result.Contributions)
+	}
+
+	// A missing feature follows the missing branch
+	result = trees.Score(map[string]interface{}{"amount": 5000.0})
+	if result.Margin != 1 {
+		t.Errorf("Expected missing branch margin 1, got %f", result.Margin)
+	}
+
+	invalid := []string{
+		`{"name": "m", "version": "1", "type": "svm", "feature_schema": {"version": "v1", "features": [{"name": "a", "source": "amount"}]}}`,
+		`{"name": "m", "version": "1", "type": "logistic_regression", "feature_schema": {"features": [{"name": "a", "source": "amount"}]}, "coefficients": {"a": 1}}`,
+		`{"name": "m", "version": "1", "type": "logistic_regression", "feature_schema": {"version": "v1", "features": [{"name": "a", "source": "amount"}]}, "coefficients": {"b": 1}}`,
+		`{"name": "m", "version": "1", "type": "gradient_boosted_trees", "feature_schema": {"version": "v1", "features": [{"name": "a", "source": "amount"}]}, "trees": [{"nodes": [{"id": 0, "feature": "a", "yes": 1, "no": 5}, {"id": 1, "leaf": 0}]}]}`,
+	}
+	for i, data := range invalid {
+		if _, err := ParseModel([]byte(data)); err == nil {
+			t.Errorf("Expected error for invalid model %d", i)
+		}
+	}
+}
+
+func TestRiskService_ModelScoring(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	model, err := ParseModel([]byte(testLogisticModel))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service.SetModel(model)
+	ctx := context.Background()
+
+	// Rules can act on the model score
+	_, err = service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Model block",
+		Description: "Block when the model is confident",
+		RuleType:    "ml_model",
+		Conditions:  map[string]interface{}{"expression": `model.score > 0.4`},
+		Actions:     []string{"block"},
+		Priority:    100,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:      "model_user",
+		EntityType:    "user",
+		Context:       map[string]interface{}{"country": "US"},
+		Amount:        FromMinorUnits("USD", 500000),
+		PaymentMethod: "crypto",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	mlScore, ok := assessment.Factors["ml_score"].(float64)
+	if !ok {
+		t.Fatalf("Expected ml_score in factors, got %v", assessment.Factors)
+	}
+	heuristic := assessment.Factors["heuristic_risk_score"].(float64)
+	expected := 0.4*heuristic + 0.6*mlScore
+	if math.Abs(assessment.Factors["base_risk_score"].(float64)-expected) > 1e-9 {
+		t.Errorf("Expected blended base score %f, got %v", expected, assessment.Factors["base_risk_score"])
+	}
+
+	contributions, ok := assessment.Factors["ml_contributions"].(map[string]float64)
+	if !ok || len(contributions) != 3 {
+		t.Errorf("Expected 3 feature contributions, got %v", assessment.Factors["ml_contributions"])
+	}
+	if assessment.Factors["ml_model_version"] != "2026.10.1" || assessment.Factors["ml_feature_schema"] != "v1" {
+		t.Errorf("Expected model and schema versions in factors, got %v / %v", assessment.Factors["ml_model_version"], assessment.Factors["ml_feature_schema"])
+	}
+
+	if mlScore <= 0.4 || assessment.Decision != "block" || assessment.DecisionRule == "" {
+		t.Errorf("Expected the model rule to block at score %f, got %s", mlScore, assessment.Decision)
+	}
+}
+
+func TestRiskService_LinkGraph(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	ctx := context.Background()
+
+	assess := func(entityID string, context map[string]interface{}) *RiskAssessment {
+		assessment, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+			EntityID:   entityID,
+			EntityType: "user",
+			Context:    context,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return assessment
+	}
+
+	// alice and bob share a device, bob and carol a card and a phone number
+	assess("alice", map[string]interface{}{"device_id": "dev_1", "ip_address": "10.0.0.1"})
+	assess("bob", map[string]interface{}{"device_id": "dev_1", "card_fingerprint": "card_1", "msisdn": "+258 84 123 4567"})
+	carol := assess("carol", map[string]interface{}{"card_fingerprint": "card_1", "phone": "258841234567"})
+
+	graph := service.LinkGraph()
+	shared := graph.LinkedAccounts("alice", NodeDevice)
+	if len(shared) != 1 || shared[0].AccountID != "bob" {
+		t.Fatalf("Expected alice to share a device with bob, got %v", shared)
+	}
+	if accounts := graph.AccountsUsing(GraphNode{Type: NodeMSISDN, Value: "+258-84-123-4567"}); len(accounts) != 2 {
+		t.Errorf("Expected normalized phone number to link 2 accounts, got %v", accounts)
+	}
+	if path := graph.PathToFraud("alice", DefaultFraudSearchHops); path != nil {
+		t.Errorf("Expected no fraud path before labelling, got %v", path)
+	}
+
+	// Confirmed fraud on carol exposes the ring
+	if _, err := service.LabelAssessment(ctx, carol.ID, LabelFraud); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	path := graph.PathToFraud("alice", DefaultFraudSearchHops)
+	if path == nil || path.FraudAccountID != "carol" || path.Hops != 2 {
+		t.Fatalf("Expected alice 2 hops from carol, got %+v", path)
+	}
+	if len(path.Path) != 5 || path.Path[1].Type != NodeDevice {
+		t.Errorf("Expected path through alice's device, got %v", path.Path)
+	}
+	if graph.PathToFraud("alice", 1) != nil {
+		t.Error("Expected no fraud path within 1 hop")
+	}
+
+	// Graph features reach rules and the heuristic score
+	_, err := service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Fraud ring",
+		Description: "Review accounts close to known fraud",
+		RuleType:    "link_analysis",
+		Conditions:  map[string]interface{}{"expression": `graph.fraud_hops <= 2 && graph.shared_device_accounts >= 1`},
+		Actions:     []string{"review"},
+		Priority:    100,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	dave := assess("dave", map[string]interface{}{"device_id": "dev_1"})
+	features, ok := dave.Factors["graph"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected graph features in factors, got %v", dave.Factors)
+	}
+	if features["shared_device_accounts"] != 2.0 || features["fraud_hops"] != 2.0 {
+		t.Errorf("Expected 2 shared device accounts 2 hops from fraud, got %v", features)
+	}
+	if dave.Factors["link_risk_score"].(float64) < 0.5 {
+		t.Errorf("Expected link risk of at least 0.5, got %v", dave.Factors["link_risk_score"])
+	}
+	if dave.Decision != "review" || dave.DecisionRule == "" {
+		t.Errorf("Expected the fraud ring rule to review, got %s", dave.Decision)
+	}
+}
+
+// failingAssessmentRepository fails to save assessments while err is set
+type failingAssessmentRepository struct {
+	*MockRepository
+	err error
+}
+
+func (r *failingAssessmentRepository) CreateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.MockRepository.CreateRiskAssessment(ctx, assessment)
+}
+
+func TestRiskService_RecordsSideEffectsAfterSave(t *testing.T) {
+	repo := &failingAssessmentRepository{MockRepository: NewMockRepository(), err: errors.New("database unavailable")}
+	service := NewService(repo, nil)
+	ctx := context.Background()
+
+	req := &AssessRiskRequest{
+		EntityID:   "unsaved_user",
+		EntityType: "user",
+		Context:    map[string]interface{}{"country": "US", "card_fingerprint": "fp_unsaved", "device_id": "dev_unsaved"},
+		Amount:     FromMinorUnits("USD", 2000),
+	}
+	device := GraphNode{Type: NodeDevice, Value: "dev_unsaved"}
+
+	// An assessment that is not saved leaves no velocity or graph behind
+	if _, err := service.AssessRiskWithValidation(ctx, req); err == nil {
+		t.Fatal("Expected error when the assessment cannot be saved")
+	}
+
+	velocity, _ := service.velocity.Preview(ctx, req)
+	if velocity["card_count_1h"] != 1.0 {
+		t.Errorf("Expected only the previewed request counted, got %v", velocity["card_count_1h"])
+	}
+	if accounts := service.LinkGraph().AccountsUsing(device); len(accounts) != 0 {
+		t.Errorf("Expected the device not linked, got %v", accounts)
+	}
+	if profile, _ := repo.GetRiskProfile(ctx, "unsaved_user"); profile == nil || profile.SignalCounts[ProfileSignalAssessment] != 0 {
+		t.Errorf("Expected the profile left as it was, got %+v", profile)
+	}
+
+	// Once saved, the request is counted and linked
+	repo.err = nil
+	if _, err := service.AssessRiskWithValidation(ctx, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	velocity, _ = service.velocity.Preview(ctx, req)
+	if velocity["card_count_1h"] != 2.0 {
+		t.Errorf("Expected the saved request counted, got %v", velocity["card_count_1h"])
+	}
+	if accounts := service.LinkGraph().AccountsUsing(device); len(accounts) != 1 || accounts[0] != "unsaved_user" {
+		t.Errorf("Expected the device linked to unsaved_user, got %v", accounts)
+	}
+}
+
+func TestRiskService_ProfileRecalculation(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	events := NewInMemoryEventPublisher()
+	service.SetEventPublisher(events)
+	policy := DefaultProfilePolicy()
+	policy.HalfLife = 24 * time.Hour
+	service.SetProfilePolicy(policy)
+	ctx := context.Background()
+
+	profile, err := service.CreateRiskProfileWithValidation(ctx, &CreateRiskProfileRequest{EntityID: "decay_user", EntityType: "user"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if profile.BaselineScore != 0.1 || profile.RiskLevel != "low" {
+		t.Fatalf("Expected low profile with 0.1 baseline, got %s / %f", profile.RiskLevel, profile.BaselineScore)
+	}
+
+	// A chargeback moves the profile from low to medium
+	profile, err = service.RecordProfileSignal(ctx, "decay_user", &ProfileSignal{Type: ProfileSignalChargeback, ReferenceID: "cb_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if profile.RiskLevel != "medium" {
+		t.Errorf("Expected medium after a chargeback, got %s (%f)", profile.RiskLevel, profile.RiskScore)
+	}
+
+	if _, err := service.RecordProfileSignal(ctx, "decay_user", &ProfileSignal{Type: ProfileSignalChargeback}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	profile, err = service.RecordProfileSignal(ctx, "decay_user", &ProfileSignal{Type: ProfileSignalKYCStatus, Status: "rejected"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if profile.RiskLevel != "high" || profile.KYCStatus != "rejected" || profile.SignalCounts[ProfileSignalChargeback] != 2 {
+		t.Errorf("Expected high profile with 2 chargebacks and rejected KYC, got %s / %s / %v", profile.RiskLevel, profile.KYCStatus, profile.SignalCounts)
+	}
+
+	if _, err := service.RecordProfileSignal(ctx, "decay_user", &ProfileSignal{Type: "unknown"}); err == nil {
+		t.Error("Expected error for unknown signal type")
+	}
+
+	// Two half-lives later the excess risk has decayed to a quarter
+	changed, err := service.DecayRiskProfiles(ctx, time.Now().Add(48*time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	profile, _ = service.GetRiskProfile(ctx, "decay_user")
+	expected := 0.1 + (0.772-0.1)*0.25
+	if changed != 1 || math.Abs(profile.RiskScore-expected) > 0.01 || profile.RiskLevel != "low" {
+		t.Errorf("Expected decay to %f (low), got %f (%s), %d changed", expected, profile.RiskScore, profile.RiskLevel, changed)
+	}
+
+	levelChanges := events.EventsOfType(EventRiskLevelChanged)
+	if len(levelChanges) != 3 {
+		t.Fatalf("Expected 3 level change events, got %d", len(levelChanges))
+	}
+	last := levelChanges[2].Data
+	if last["previous_level"] != "high" || last["risk_level"] != "low" || last["reason"] != "decay" {
+		t.Errorf("Expected high to low decay event, got %v", last)
+	}
+}
+
+func TestRiskService_DynamicLimits(t *testing.T) {
+	service := NewService(NewMockRepository(), nil)
+	ctx := context.Background()
+
+	consume := func(entityID, reference string, minor int64) *LimitDecision {
+		decision, err := service.ConsumeLimit(ctx, &LimitRequest{
+			EntityID:    entityID,
+			EntityType:  "merchant",
+			Action:      LimitActionPayment,
+			Amount:      FromMinorUnits("USD", minor),
+			ReferenceID: reference,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return decision
+	}
+
+	// Entities without their own rule get the default per-transaction limit
+	decision := consume("other_merchant", "pay_0", 50000)
+	if !decision.Allowed || decision.Headroom.RuleID != "limit_default_payment" || decision.Headroom.DailyAmount != nil {
+		t.Errorf("Expected default payment limit without a daily limit, got %+v", decision)
+	}
+
+	_, err := service.SetLimitRule(ctx, &LimitRule{
+		Name:   "Merchant limit",
+		Scope:  LimitScope{EntityID: "limit_merchant"},
+		Action: LimitActionPayment,
+		Limits: Limits{PerTransaction: 60000, DailyAmount: 100000, DailyCount: 2},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	first := consume("limit_merchant", "pay_1", 60000)
+	if !first.Allowed || *first.Headroom.DailyAmount != 40000 || *first.Headroom.DailyCount != 1 {
+		t.Fatalf("Expected 40000 and 1 payment of headroom left, got %+v", first)
+	}
+	if again := consume("limit_merchant", "pay_1", 60000); again.ReservationID != first.ReservationID || *again.Headroom.DailyAmount != 40000 {
+		t.Errorf("Expected the same reference to be counted once, got %+v", again)
+	}
+	if denied := consume("limit_merchant", "pay_2", 50000); denied.Allowed || denied.Reason != "amount exceeds daily limit" {
+		t.Errorf("Expected daily limit to deny, got %+v", denied)
+	}
+	if denied := consume("limit_merchant", "pay_2", 70000); denied.Allowed || denied.Reason != "amount exceeds per-transaction limit" {
+		t.Errorf("Expected per-transaction limit to deny, got %+v", denied)
+	}
+
+	// A temporary increase raises the daily amount but not the count
+	increase, err := service.GrantLimitIncrease(ctx, &LimitIncrease{
+		EntityID:  "limit_merchant",
+		Action:    LimitActionPayment,
+		Increase:  Limits{DailyAmount: 50000},
+		Reason:    "seasonal sale",
+		GrantedBy: "ops@example.com",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	second := consume("limit_merchant", "pay_2", 50000)
+	if !second.Allowed || *second.Headroom.DailyAmount != 40000 || len(second.Headroom.IncreaseIDs) != 1 || second.Headroom.IncreaseIDs[0] != increase.ID {
+		t.Errorf("Expected the increase to allow the payment, got %+v", second)
+	}
+	if denied := consume("limit_merchant", "pay_3", 100); denied.Allowed || denied.Reason != "daily transaction count limit reached" {
+		t.Errorf("Expected daily count limit to deny, got %+v", denied)
+	}
+
+	// Releasing a payment that did not go ahead frees its usage
+	if _, err := service.ReleaseLimit(ctx, second.ReservationID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if allowed := consume("limit_merchant", "pay_3", 100); !allowed.Allowed {
+		t.Errorf("Expected released usage to be available, got %+v", allowed)
+	}
+	if _, err := service.GrantLimitIncrease(ctx, &LimitIncrease{EntityID: "limit_merchant", Increase: Limits{DailyCount: 1}, Reason: "x", GrantedBy: "ops", ExpiresAt: time.Now().Add(-time.Minute)}); err == nil {
+		t.Error("Expected error for an expired increase")
+	}
+
+	// High risk entities fall under the tighter risk level limits
+	if _, err := service.CreateRiskProfileWithValidation(ctx, &CreateRiskProfileRequest{EntityID: "risky_merchant", EntityType: "merchant"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	highScore := 0.8
+	if _, err := service.UpdateRiskProfileWithValidation(ctx, &UpdateRiskProfileRequest{EntityID: "risky_merchant", RiskScore: &highScore}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if denied := consume("risky_merchant", "pay_4", 2000000); denied.Allowed || denied.Headroom.RuleID != "limit_high_risk" || denied.Headroom.RiskLevel != "high" {
+		t.Errorf("Expected the high risk limit to deny, got %+v", denied)
+	}
+}
+
+func TestLimitEngine_ConcurrentConsume(t *testing.T) {
+	engine := NewLimitEngine()
+	engine.SetRule(&LimitRule{
+		Name:   "Count limit",
+		Scope:  LimitScope{EntityID: "busy_user"},
+		Limits: Limits{DailyCount: 10},
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			decision, err := engine.Consume(context.Background(), &LimitRequest{
+				EntityID:    "busy_user",
+				Action:      LimitActionTransfer,
+				Amount:      FromMinorUnits("USD", 100),
+				ReferenceID: fmt.Sprintf("transfer_%d", i),
+			}, "", 100, time.Now())
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			if decision.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("Expected exactly 10 allowed transfers, got %d", allowed)
+	}
+}
+
+func TestLimitEngine_PrunesPastPeriods(t *testing.T) {
+	engine := NewLimitEngine()
+	store := NewInMemoryLimitUsageStore()
+	engine.SetUsageStore(store)
+	engine.SetRule(&LimitRule{
+		Name:   "Monthly limit",
+		Scope:  LimitScope{EntityID: "pruned_user"},
+		Limits: Limits{MonthlyCount: 1},
+	})
+	ctx := context.Background()
+
+	consume := func(reference string, at time.Time) *LimitDecision {
+		decision, err := engine.Consume(ctx, &LimitRequest{
+			EntityID:    "pruned_user",
+			Action:      LimitActionPayment,
+			Amount:      FromMinorUnits("USD", 100),
+			ReferenceID: reference,
+		}, "", 100, at)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return decision
+	}
+
+	january := time.Date(2026, time.January, 31, 23, 0, 0, 0, time.UTC)
+	engine.GrantIncrease(&LimitIncrease{EntityID: "pruned_user", Increase: Limits{MonthlyCount: 1}, ExpiresAt: january.Add(time.Hour)})
+	old := consume("pay_1", january)
+	if !old.Allowed {
+		t.Fatalf("Expected the January payment to be allowed, got %+v", old)
+	}
+
+	// A new month starts with fresh counters and forgets January's
+	// reservations, references and expired increases
+	february := consume("pay_1", january.Add(2*time.Hour))
+	if !february.Allowed || february.ReservationID == old.ReservationID {
+		t.Errorf("Expected a new reservation in February, got %+v", february)
+	}
+	if len(store.usage) != 2 || len(store.reservations) != 1 || len(store.references) != 1 {
+		t.Errorf("Expected only February's usage and reservation, got %d counters, %d reservations and %d references",
+			len(store.usage), len(store.reservations), len(store.references))
+	}
+	if len(engine.increases) != 0 {
+		t.Errorf("Expected the expired increase to be dropped, got %d", len(engine.increases))
+	}
+	if _, err := engine.Release(ctx, old.ReservationID); !errors.Is(err, ErrReservationNotFound) {
+		t.Errorf("Expected ErrReservationNotFound for a past month reservation, got %v", err)
+	}
+}
+
+func TestMoneyToMinorUnits_CurrencyExponent(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		minor    int64
+	}{
+		{"12.34", "USD", 1234},
+		{"1234", "JPY", 1234},
+		{"1.234", "KWD", 1234},
+		{"0.125", "EUR", 13},
+	}
+
+	for _, tt := range tests {
+		value, _ := new(big.Float).SetString(tt.value)
+		if minor := moneyToMinorUnits(&Money{Value: value, Currency: tt.currency}); minor != tt.minor {
+			t.Errorf("Expected %s %s to be %d minor units, got %d", tt.value, tt.currency, tt.minor, minor)
+		}
+		if back := moneyToMinorUnits(FromMinorUnits(tt.currency, tt.minor)); back != tt.minor {
+			t.Errorf("Expected %d %s minor units to round trip, got %d", tt.minor, tt.currency, back)
+		}
+	}
+}
+
+func TestRiskService_AssessmentReplay(t *testing.T) {
+	service := NewService(NewInMemoryRepository(), nil)
+	model, err := ParseModel([]byte(testLogisticModel))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service.SetModel(model)
+	ctx := context.Background()
+
+	rule, err := service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Model block",
+		Description: "Block when the model is confident",
+		RuleType:    "ml_model",
+		Conditions:  map[string]interface{}{"expression": `model.score > 0.4`},
+		Actions:     []string{"block"},
+		Priority:    100,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	req := &AssessRiskRequest{
+		EntityID:      "replay_user",
+		EntityType:    "user",
+		Context:       map[string]interface{}{"country": "US"},
+		Amount:        FromMinorUnits("USD", 500000),
+		PaymentMethod: "crypto",
+	}
+	original, err := service.AssessRiskWithValidation(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if original.Decision != "block" || original.RuleSetVersion == "" || original.ModelVersion != model.Name+"@"+model.Version {
+		t.Fatalf("Expected a versioned block decision, got %s (%s, %s)", original.Decision, original.RuleSetVersion, original.ModelVersion)
+	}
+
+	audit, err := service.GetAssessmentAudit(ctx, original.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if audit.RiskScore != original.RiskScore || audit.Scores["ml_score"] != original.Factors["ml_score"] {
+		t.Errorf("Expected audit scores to match the assessment, got %v", audit.Scores)
+	}
+	if _, ok := audit.Inputs["model.score"]; ok {
+		t.Errorf("Expected audit inputs from before model scoring, got %v", audit.Inputs)
+	}
+	if !audit.Profile.LastAssessment.Before(audit.AssessedAt) {
+		t.Errorf("Expected the profile as it was before the assessment, got %v", audit.Profile.LastAssessment)
+	}
+
+	ruleSet, err := service.GetRuleSet(ctx, audit.RuleSetVersion)
+	if err != nil || len(ruleSet.Rules) != 1 || ruleSet.Rules[0].ID != rule.ID {
+		t.Fatalf("Expected the rule set to be stored, got %v (%v)", ruleSet, err)
+	}
+
+	// Change the rules and the model after the fact
+	if err := service.repo.DeleteRiskRule(ctx, rule.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	service.SetModel(nil)
+
+	current, err := service.AssessRiskWithValidation(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if current.Decision == "block" || current.RuleSetVersion == original.RuleSetVersion || current.ModelVersion != "" {
+		t.Errorf("Expected the new assessment to use the new versions, got %s (%s, %s)", current.Decision, current.RuleSetVersion, current.ModelVersion)
+	}
+
+	// Replaying uses the versions the assessment was made with
+	result, err := service.ReplayAssessment(ctx, original.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Matches || len(result.Differences) != 0 {
+		t.Errorf("Expected replay to match, got differences %v", result.Differences)
+	}
+	if result.Replayed.Decision != "block" || result.Replayed.DecisionRule != rule.ID || result.Replayed.RiskScore != original.RiskScore {
+		t.Errorf("Expected replayed block by %s at %f, got %+v", rule.ID, original.RiskScore, result.Replayed)
+	}
+
+	if _, err := service.ReplayAssessment(ctx, "missing"); err == nil {
+		t.Error("Expected error replaying an unknown assessment")
+	}
+}
+
+func TestInMemoryRepository_JournalSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	model, err := ParseModel([]byte(testLogisticModel))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	restart := func() (*Service, *FileJournal) {
+		t.Helper()
+		journal, err := OpenFileJournal(path)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		repo := NewInMemoryRepository()
+		if err := repo.SetJournal(journal); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return NewService(repo, nil), journal
+	}
+
+	service, journal := restart()
+	service.SetModel(model)
+	rule, err := service.CreateRiskRuleWithValidation(ctx, &CreateRiskRuleRequest{
+		Name:        "Model block",
+		Description: "Block when the model is confident",
+		RuleType:    "ml_model",
+		Conditions:  map[string]interface{}{"expression": `model.score > 0.4`},
+		Actions:     []string{"block"},
+		Priority:    100,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	original, err := service.AssessRiskWithValidation(ctx, &AssessRiskRequest{
+		EntityID:      "journal_user",
+		EntityType:    "user",
+		Context:       map[string]interface{}{"country": "US"},
+		Amount:        FromMinorUnits("USD", 500000),
+		PaymentMethod: "crypto",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := service.repo.DeleteRiskRule(ctx, rule.ID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	journal.Close()
+
+	service, journal = restart()
+	defer journal.Close()
+
+	if saved, err := service.repo.GetRiskAssessment(ctx, original.ID); err != nil || saved == nil || saved.Decision != original.Decision {
+		t.Fatalf("Expected assessment %s after restart, got %+v (%v)", original.ID, saved, err)
+	}
+	if profile, _ := service.repo.GetRiskProfile(ctx, "journal_user"); profile == nil || profile.SignalCounts[ProfileSignalAssessment] != 1 {
+		t.Errorf("Expected the assessed profile after restart, got %+v", profile)
+	}
+	if deleted, _ := service.repo.GetRiskRule(ctx, rule.ID); deleted != nil {
+		t.Errorf("Expected rule %s to stay deleted, got %+v", rule.ID, deleted)
+	}
+
+	// The audit, rule set and model are kept, so the decision replays
+	result, err := service.ReplayAssessment(ctx, original.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !result.Matches || result.Replayed.DecisionRule != rule.ID {
+		t.Errorf("Expected replay by %s to match, got differences %v", rule.ID, result.Differences)
+	}
+}
+
 // Benchmark tests
 func BenchmarkRiskService_AssessRisk(b *testing.B) {
 	repo := NewMockRepository()
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,15 +15,32 @@ type Money struct {
 	Currency string     `json:"currency"`
 }
 
-// FromMinorUnits creates Money from minor units (e.g., cents)
+// FromMinorUnits creates Money from minor units of the currency (e.g., cents)
 func FromMinorUnits(currency string, minorUnits int64) *Money {
-	value := big.NewFloat(float64(minorUnits) / 100.0)
+	scale := new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(currency))), nil))
+	value := new(big.Float).Quo(new(big.Float).SetInt64(minorUnits), scale)
 	return &Money{
 		Value:    value,
 		Currency: currency,
 	}
 }
 
+// currencyExponents lists the ISO 4217 minor unit exponents of currencies
+// whose minor unit is not a hundredth
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencyExponent returns the number of minor unit digits of a currency
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exponent
+	}
+	return 2
+}
+
 // RiskProfile represents a risk assessment profile for an entity
 type RiskProfile struct {
 	ID             string                 `json:"id"`
@@ -35,6 +54,12 @@ type RiskProfile struct {
 	Metadata       map[string]interface{} `json:"metadata,omitempty"`
 	CreatedAt      time.Time              `json:"created_at"`
 	UpdatedAt      time.Time              `json:"updated_at"`
+
+	// BaselineScore is the entity type's starting score stale risk decays to
+	BaselineScore float64        `json:"baseline_score"`
+	ScoredAt      time.Time      `json:"scored_at"` // when RiskScore was last decayed
+	KYCStatus     string         `json:"kyc_status,omitempty"`
+	SignalCounts  map[string]int `json:"signal_counts,omitempty"`
 }
 
 // RiskRule represents a risk assessment rule
@@ -46,6 +71,7 @@ type RiskRule struct {
 	Conditions  map[string]interface{} `json:"conditions"`
 	Actions     []string               `json:"actions"`
 	Priority    int                    `json:"priority"`
+	Mode        string                 `json:"mode"` // live, shadow
 	IsActive    bool                   `json:"is_active"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	CreatedAt   time.Time              `json:"created_at"`
@@ -62,7 +88,30 @@ type RiskAssessment struct {
 	Decision     string                 `json:"decision"` // allow, review, block
 	Factors      map[string]interface{} `json:"factors"`
 	RulesApplied []string               `json:"rules_applied"`
+	RuleHits     []RuleHit              `json:"rule_hits,omitempty"`
+	RuleErrors   []RuleError            `json:"rule_errors,omitempty"`   // rules skipped because they failed
+	DecisionRule string                 `json:"decision_rule,omitempty"` // rule that forced the decision
+	Tags         []string               `json:"tags,omitempty"`
 	Confidence   float64                `json:"confidence"`
+
+	// Shadow rule results, recorded without affecting the decision
+	ShadowRuleHits []RuleHit `json:"shadow_rule_hits,omitempty"`
+	ShadowDecision string    `json:"shadow_decision,omitempty"`
+
+	// Inputs is the rule environment the assessment was made with
+	Inputs map[string]interface{} `json:"inputs,omitempty"`
+
+	// Versions of the rule set and model that scored the assessment
+	RuleSetVersion string `json:"rule_set_version,omitempty"`
+	ModelVersion   string `json:"model_version,omitempty"`
+
+	// Label is the known outcome: fraud or legitimate
+	Label     string     `json:"label,omitempty"`
+	LabeledAt *time.Time `json:"labeled_at,omitempty"`
+
+	// ReviewCaseID is set when a review decision opened a manual review
+	ReviewCaseID string `json:"review_case_id,omitempty"`
+
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
 	CreatedAt    time.Time              `json:"created_at"`
 }
@@ -101,6 +150,7 @@ type CreateRiskRuleRequest struct {
 	Conditions  map[string]interface{} `json:"conditions"`
 	Actions     []string               `json:"actions"`
 	Priority    int                    `json:"priority"`
+	Mode        string                 `json:"mode,omitempty"` // live (default), shadow
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 }
 
@@ -133,13 +183,39 @@ type Repository interface {
 	// Risk Assessment operations
 	CreateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error
 	GetRiskAssessment(ctx context.Context, assessmentID string) (*RiskAssessment, error)
+	UpdateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error
 	ListRiskAssessments(ctx context.Context, filters RiskFilters) ([]*RiskAssessment, error)
+
+	// Review Case operations
+	CreateReviewCase(ctx context.Context, reviewCase *ReviewCase) error
+	GetReviewCase(ctx context.Context, caseID string) (*ReviewCase, error)
+	UpdateReviewCase(ctx context.Context, reviewCase *ReviewCase) error
+	ListReviewCases(ctx context.Context, filters ReviewFilters) ([]*ReviewCase, error)
+
+	// Audit operations
+	CreateAssessmentAudit(ctx context.Context, audit *AssessmentAudit) error
+	GetAssessmentAudit(ctx context.Context, assessmentID string) (*AssessmentAudit, error)
+	SaveRuleSet(ctx context.Context, ruleSet *RuleSetSnapshot) error
+	GetRuleSet(ctx context.Context, version string) (*RuleSetSnapshot, error)
+	SaveModelVersion(ctx context.Context, model *Model) error
+	GetModelVersion(ctx context.Context, version string) (*Model, error)
 }
 
 // Service represents the risk service
 type Service struct {
 	repo      Repository
 	validator *RiskValidator
+	rules     *RuleEngine
+	velocity  *VelocityTracker
+	links     *LinkGraph
+	limits    *LimitEngine
+
+	reviewPolicy   ReviewPolicy
+	reviewNotifier ReviewNotifier
+	profilePolicy  ProfilePolicy
+	events         EventPublisher
+
+	model atomic.Pointer[Model]
 }
 
 // NewService creates a new risk service
@@ -150,6 +226,13 @@ func NewService(repo Repository, validator *RiskValidator) *Service {
 	return &Service{
 		repo:      repo,
 		validator: validator,
+		rules:     NewRuleEngine(),
+		velocity:  NewVelocityTracker(NewInMemoryVelocityStore()),
+		links:     NewLinkGraph(),
+		limits:    NewLimitEngine(),
+
+		reviewPolicy:  DefaultReviewPolicy(),
+		profilePolicy: DefaultProfilePolicy(),
 	}
 }
 
@@ -240,6 +323,10 @@ type MockRepository struct {
 	profiles    map[string]*RiskProfile
 	rules       map[string]*RiskRule
 	assessments map[string]*RiskAssessment
+	reviews     map[string]*ReviewCase
+	audits      map[string]*AssessmentAudit
+	ruleSets    map[string]*RuleSetSnapshot
+	models      map[string]*Model
 }
 
 func NewMockRepository() *MockRepository {
@@ -247,6 +334,10 @@ func NewMockRepository() *MockRepository {
 		profiles:    make(map[string]*RiskProfile),
 		rules:       make(map[string]*RiskRule),
 		assessments: make(map[string]*RiskAssessment),
+		reviews:     make(map[string]*ReviewCase),
+		audits:      make(map[string]*AssessmentAudit),
+		ruleSets:    make(map[string]*RuleSetSnapshot),
+		models:      make(map[string]*Model),
 	}
 }
 
@@ -322,6 +413,11 @@ func (m *MockRepository) GetRiskAssessment(ctx context.Context, assessmentID str
 	return nil, nil
 }
 
+func (m *MockRepository) UpdateRiskAssessment(ctx context.Context, assessment *RiskAssessment) error {
+	m.assessments[assessment.ID] = assessment
+	return nil
+}
+
 func (m *MockRepository) ListRiskAssessments(ctx context.Context, filters RiskFilters) ([]*RiskAssessment, error) {
 	var assessments []*RiskAssessment
 	for _, assessment := range m.assessments {
@@ -330,6 +426,70 @@ func (m *MockRepository) ListRiskAssessments(ctx context.Context, filters RiskFi
 	return assessments, nil
 }
 
+func (m *MockRepository) CreateReviewCase(ctx context.Context, reviewCase *ReviewCase) error {
+	m.reviews[reviewCase.ID] = reviewCase
+	return nil
+}
+
+func (m *MockRepository) GetReviewCase(ctx context.Context, caseID string) (*ReviewCase, error) {
+	if reviewCase, exists := m.reviews[caseID]; exists {
+		return reviewCase, nil
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) UpdateReviewCase(ctx context.Context, reviewCase *ReviewCase) error {
+	m.reviews[reviewCase.ID] = reviewCase
+	return nil
+}
+
+func (m *MockRepository) ListReviewCases(ctx context.Context, filters ReviewFilters) ([]*ReviewCase, error) {
+	var reviews []*ReviewCase
+	for _, reviewCase := range m.reviews {
+		if filters.Status != "" && reviewCase.Status != filters.Status {
+			continue
+		}
+		reviews = append(reviews, reviewCase)
+	}
+	return reviews, nil
+}
+
+func (m *MockRepository) CreateAssessmentAudit(ctx context.Context, audit *AssessmentAudit) error {
+	m.audits[audit.AssessmentID] = audit
+	return nil
+}
+
+func (m *MockRepository) GetAssessmentAudit(ctx context.Context, assessmentID string) (*AssessmentAudit, error) {
+	if audit, exists := m.audits[assessmentID]; exists {
+		return audit, nil
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) SaveRuleSet(ctx context.Context, ruleSet *RuleSetSnapshot) error {
+	m.ruleSets[ruleSet.Version] = ruleSet
+	return nil
+}
+
+func (m *MockRepository) GetRuleSet(ctx context.Context, version string) (*RuleSetSnapshot, error) {
+	if ruleSet, exists := m.ruleSets[version]; exists {
+		return ruleSet, nil
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) SaveModelVersion(ctx context.Context, model *Model) error {
+	m.models[modelVersion(model)] = model
+	return nil
+}
+
+func (m *MockRepository) GetModelVersion(ctx context.Context, version string) (*Model, error) {
+	if model, exists := m.models[version]; exists {
+		return model, nil
+	}
+	return nil, nil
+}
+
 // Helper functions
 func generateID() string {
 	return fmt.Sprintf("risk_%d", time.Now().UnixNano())
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -139,6 +140,12 @@ func (v *RiskValidator) ValidateCreateRiskRuleRequest(req *CreateRiskRuleRequest
 		return fmt.Errorf("priority validation failed: %w", err)
 	}
 
+	if req.Mode != "" {
+		if err := v.validateRuleMode(req.Mode); err != nil {
+			return fmt.Errorf("mode validation failed: %w", err)
+		}
+	}
+
 	if err := v.validateMetadata(req.Metadata); err != nil {
 		return fmt.Errorf("metadata validation failed: %w", err)
 	}
@@ -325,6 +332,7 @@ func (v *RiskValidator) validateRuleType(ruleType string) error {
 	validTypes := []string{
 		"threshold", "pattern", "ml_model", "blacklist", "whitelist",
 		"velocity", "geolocation", "device_fingerprint", "behavioral",
+		"link_analysis",
 	}
 
 	for _, validType := range validTypes {
@@ -351,6 +359,16 @@ func (v *RiskValidator) validateRuleConditions(conditions map[string]interface{}
 		return errors.New("conditions cannot have more than 50 keys")
 	}
 
+	// Conditions must compile in the rule language
+	expression, err := RuleExpression(conditions)
+	if err != nil {
+		return fmt.Errorf("invalid conditions: %w", err)
+	}
+
+	if _, err := ParseRuleExpression(expression); err != nil {
+		return fmt.Errorf("invalid conditions: %w", err)
+	}
+
 	return nil
 }
 
@@ -362,13 +380,29 @@ func (v *RiskValidator) validateRuleActions(actions []string) error {
 
 	validActions := []string{
 		"allow", "review", "block", "flag", "score_increase", "score_decrease",
-		"require_verification", "limit_amount", "notify_admin",
+		"require_verification", "limit_amount", "notify_admin", "tag",
 	}
 
 	for _, action := range actions {
+		// Actions may carry an argument, e.g. score_increase:0.2 or tag:high_value
+		name, arg := splitAction(action)
+		switch name {
+		case "score_increase", "score_decrease":
+			if arg != "" {
+				amount, err := strconv.ParseFloat(arg, 64)
+				if err != nil || amount < 0 || amount > 1 {
+					return fmt.Errorf("invalid action: %s, score change must be between 0 and 1", action)
+				}
+			}
+		case "tag":
+			if arg == "" {
+				return errors.New("tag action requires a tag, e.g. tag:high_value")
+			}
+		}
+
 		found := false
 		for _, validAction := range validActions {
-			if action == validAction {
+			if name == validAction {
 				found = true
 				break
 			}
@@ -389,6 +423,14 @@ func (v *RiskValidator) validateRulePriority(priority int) error {
 	return nil
 }
 
+// validateRuleMode validates rule mode
+func (v *RiskValidator) validateRuleMode(mode string) error {
+	if mode != RuleModeLive && mode != RuleModeShadow {
+		return fmt.Errorf("invalid mode: %s", mode)
+	}
+	return nil
+}
+
 // validateMetadata validates metadata map
 func (v *RiskValidator) validateMetadata(metadata map[string]interface{}) error {
 	if metadata == nil {
@@ -528,8 +570,14 @@ func (v *BusinessRuleValidator) ValidateBusinessRules(assessment *RiskAssessment
 		return errors.New("assessment cannot be nil")
 	}
 
-	// Validate decision consistency with risk score
-	switch assessment.Decision {
+	// Validate decision consistency with risk score, unless a rule forced
+	// the decision
+	decision := assessment.Decision
+	if assessment.DecisionRule != "" {
+		decision = ""
+	}
+
+	switch decision {
 	case "allow":
 		if assessment.RiskScore > 0.7 {
 			return errors.New("allow decision should not have risk score > 0.7")
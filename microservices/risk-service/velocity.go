@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VelocityWindow is a named sliding window used by the velocity counters
+type VelocityWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+// DefaultVelocityWindows are the windows tracked for every dimension
+var DefaultVelocityWindows = []VelocityWindow{
+	{Name: "1h", Duration: time.Hour},
+	{Name: "24h", Duration: 24 * time.Hour},
+	{Name: "7d", Duration: 7 * 24 * time.Hour},
+}
+
+// velocityDimensions maps a counter dimension to the request context keys
+// that identify it. The entity dimension always uses the request entity ID.
+var velocityDimensions = map[string][]string{
+	"card":   {"card_fingerprint", "card_token"},
+	"ip":     {"ip_address", "ip"},
+	"device": {"device_id", "device_fingerprint"},
+}
+
+// VelocityStat is the count and amount sum of the events in one window
+type VelocityStat struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// VelocityStore keeps sliding-window event counters
+type VelocityStore interface {
+	// Record adds an event to the counter at key
+	Record(ctx context.Context, key, eventID string, amount float64, at time.Time) error
+	// Stats returns the count and sum of the events at key within each window ending at at
+	Stats(ctx context.Context, key string, windows []time.Duration, at time.Time) ([]VelocityStat, error)
+}
+
+// VelocityTracker records assessed transactions and reads their counters for
+// the entity, card fingerprint, IP and device of a request
+type VelocityTracker struct {
+	store   VelocityStore
+	windows []VelocityWindow
+	now     func() time.Time
+}
+
+// NewVelocityTracker creates a velocity tracker over the default windows
+func NewVelocityTracker(store VelocityStore) *VelocityTracker {
+	return &VelocityTracker{
+		store:   store,
+		windows: DefaultVelocityWindows,
+		now:     time.Now,
+	}
+}
+
+// Observe records the request as a transaction, when it carries an amount,
+// and returns the counters for every dimension it identifies. Keys have the
+// form <dimension>_count_<window> and <dimension>_sum_<window>, e.g.
+// card_count_1h. The entity counters are also exposed without a prefix
+// (count_24h) and as transaction_count_24h for existing callers.
+//
+// Sums add up amount values regardless of currency, so rules on sums should
+// also check the currency.
+func (t *VelocityTracker) Observe(ctx context.Context, eventID string, req *AssessRiskRequest) (map[string]interface{}, error) {
+	now := t.now()
+	if err := t.record(ctx, eventID, req, now); err != nil {
+		return nil, err
+	}
+	return t.counters(ctx, req, now, false)
+}
+
+// Preview returns the counters Observe would return for the request without
+// recording it, so nothing is counted for a request that is never saved
+func (t *VelocityTracker) Preview(ctx context.Context, req *AssessRiskRequest) (map[string]interface{}, error) {
+	return t.counters(ctx, req, t.now(), true)
+}
+
+// Record adds the request to the counters when it carries an amount
+func (t *VelocityTracker) Record(ctx context.Context, eventID string, req *AssessRiskRequest) error {
+	return t.record(ctx, eventID, req, t.now())
+}
+
+func (t *VelocityTracker) record(ctx context.Context, eventID string, req *AssessRiskRequest, now time.Time) error {
+	amount, ok := velocityAmount(req)
+	if !ok {
+		return nil
+	}
+
+	for _, key := range velocityKeys(req) {
+		if err := t.store.Record(ctx, key.key, eventID, amount, now); err != nil {
+			return fmt.Errorf("failed to record velocity event: %w", err)
+		}
+	}
+	return nil
+}
+
+// counters reads the counters for every dimension of a request. With
+// pending set, the request itself is added as if it had been recorded.
+func (t *VelocityTracker) counters(ctx context.Context, req *AssessRiskRequest, now time.Time, pending bool) (map[string]interface{}, error) {
+	keys := velocityKeys(req)
+	amount, hasAmount := velocityAmount(req)
+
+	durations := make([]time.Duration, len(t.windows))
+	for i, window := range t.windows {
+		durations[i] = window.Duration
+	}
+
+	velocity := make(map[string]interface{})
+	for _, key := range keys {
+		stats, err := t.store.Stats(ctx, key.key, durations, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read velocity counters: %w", err)
+		}
+
+		if pending && hasAmount {
+			for i := range stats {
+				stats[i].Count++
+				stats[i].Sum += amount
+			}
+		}
+
+		for i, window := range t.windows {
+			velocity[fmt.Sprintf("%s_count_%s", key.dimension, window.Name)] = float64(stats[i].Count)
+			velocity[fmt.Sprintf("%s_sum_%s", key.dimension, window.Name)] = stats[i].Sum
+			if key.dimension == "entity" {
+				velocity["count_"+window.Name] = float64(stats[i].Count)
+				velocity["sum_"+window.Name] = stats[i].Sum
+				velocity["transaction_count_"+window.Name] = float64(stats[i].Count)
+			}
+		}
+	}
+
+	return velocity, nil
+}
+
+// velocityAmount returns the amount a request adds to the counters, if any
+func velocityAmount(req *AssessRiskRequest) (float64, bool) {
+	if req.Amount == nil || req.Amount.Value == nil {
+		return 0, false
+	}
+	amount, _ := req.Amount.Value.Float64()
+	return amount, true
+}
+
+type velocityKey struct {
+	dimension string
+	key       string
+}
+
+// velocityKeys returns the counter keys identified by a request
+func velocityKeys(req *AssessRiskRequest) []velocityKey {
+	keys := []velocityKey{{
+		dimension: "entity",
+		key:       fmt.Sprintf("risk:velocity:entity:%s:%s", req.EntityType, req.EntityID),
+	}}
+
+	dimensions := make([]string, 0, len(velocityDimensions))
+	for dimension := range velocityDimensions {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+
+	for _, dimension := range dimensions {
+		for _, contextKey := range velocityDimensions[dimension] {
+			value, ok := req.Context[contextKey].(string)
+			if !ok || value == "" {
+				continue
+			}
+			keys = append(keys, velocityKey{
+				dimension: dimension,
+				key:       fmt.Sprintf("risk:velocity:%s:%s", dimension, strings.ToLower(value)),
+			})
+			break
+		}
+	}
+
+	return keys
+}
+
+// SetVelocityStore configures where velocity counters are kept
+func (s *Service) SetVelocityStore(store VelocityStore) {
+	s.velocity = NewVelocityTracker(store)
+}
+
+// previewVelocity returns the velocity counters for a request, counting the
+// request itself without recording it. Counters the caller supplied in the
+// context are kept unless the tracker has its own; when the store is
+// unavailable the assessment carries on with those.
+func (s *Service) previewVelocity(ctx context.Context, req *AssessRiskRequest) map[string]interface{} {
+	velocity := velocityFromContext(req.Context)
+
+	tracked, err := s.velocity.Preview(ctx, req)
+	if err != nil {
+		log.Printf("Velocity counters unavailable for %s: %v", req.EntityID, err)
+		return velocity
+	}
+
+	for key, value := range tracked {
+		velocity[key] = value
+	}
+
+	return velocity
+}
+
+// recordVelocity counts a saved assessment's request in the velocity
+// counters. The assessment is already saved, so a store failure is logged.
+func (s *Service) recordVelocity(ctx context.Context, eventID string, req *AssessRiskRequest) {
+	if err := s.velocity.Record(ctx, eventID, req); err != nil {
+		log.Printf("Failed to record velocity for %s: %v", req.EntityID, err)
+	}
+}
+
+// InMemoryVelocityStore implements VelocityStore in memory
+type InMemoryVelocityStore struct {
+	mu        sync.Mutex
+	events    map[string][]velocityEvent
+	retention time.Duration
+}
+
+type velocityEvent struct {
+	id     string
+	amount float64
+	at     time.Time
+}
+
+// NewInMemoryVelocityStore creates a new in-memory velocity store
+func NewInMemoryVelocityStore() *InMemoryVelocityStore {
+	return &InMemoryVelocityStore{
+		events:    make(map[string][]velocityEvent),
+		retention: maxVelocityWindow(),
+	}
+}
+
+func (m *InMemoryVelocityStore) Record(ctx context.Context, key, eventID string, amount float64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := m.events[key][:0]
+	for _, event := range m.events[key] {
+		if event.id == eventID || at.Sub(event.at) > m.retention {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	m.events[key] = append(events, velocityEvent{id: eventID, amount: amount, at: at})
+	return nil
+}
+
+func (m *InMemoryVelocityStore) Stats(ctx context.Context, key string, windows []time.Duration, at time.Time) ([]VelocityStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make([]VelocityStat, len(windows))
+	for _, event := range m.events[key] {
+		for i, window := range windows {
+			if event.at.After(at.Add(-window)) && !event.at.After(at) {
+				stats[i].Count++
+				stats[i].Sum += event.amount
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// RedisEvaluator runs Lua scripts on Redis. RedisClient implements it.
+type RedisEvaluator interface {
+	Eval(ctx context.Context, script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// RedisVelocityStore implements VelocityStore with one sorted set per key,
+// scored by event time in milliseconds. Members are "<event id>|<amount>" so
+// sums can be computed inside Redis without a second structure.
+type RedisVelocityStore struct {
+	redis     RedisEvaluator
+	retention time.Duration
+}
+
+// NewRedisVelocityStore creates a Redis backed velocity store
+func NewRedisVelocityStore(redis RedisEvaluator) *RedisVelocityStore {
+	return &RedisVelocityStore{
+		redis:     redis,
+		retention: maxVelocityWindow(),
+	}
+}
+
+// recordVelocityScript adds an event, trims events older than the retention
+// and keeps the key alive for one retention period
+const recordVelocityScript = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', tonumber(ARGV[1]) - tonumber(ARGV[3]))
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`
+
+// statsVelocityScript returns count and sum for each window length in ARGV[2..]
+// ending at ARGV[1]. Sums are returned as strings since Redis truncates Lua
+// numbers to integers.
+const statsVelocityScript = `
+local now = tonumber(ARGV[1])
+local result = {}
+for i = 2, #ARGV do
+	local members = redis.call('ZRANGEBYSCORE', KEYS[1], '(' .. (now - tonumber(ARGV[i])), now)
+	local sum = 0
+	for _, member in ipairs(members) do
+		local amount = string.match(member, '|([^|]*)$')
+		sum = sum + (tonumber(amount) or 0)
+	end
+	table.insert(result, #members)
+	table.insert(result, tostring(sum))
+end
+return result
+`
+
+func (r *RedisVelocityStore) Record(ctx context.Context, key, eventID string, amount float64, at time.Time) error {
+	member := eventID + "|" + strconv.FormatFloat(amount, 'f', -1, 64)
+	_, err := r.redis.Eval(ctx, recordVelocityScript, []string{key}, at.UnixMilli(), member, r.retention.Milliseconds())
+	return err
+}
+
+func (r *RedisVelocityStore) Stats(ctx context.Context, key string, windows []time.Duration, at time.Time) ([]VelocityStat, error) {
+	args := make([]interface{}, 0, len(windows)+1)
+	args = append(args, at.UnixMilli())
+	for _, window := range windows {
+		args = append(args, window.Milliseconds())
+	}
+
+	result, err := r.redis.Eval(ctx, statsVelocityScript, []string{key}, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2*len(windows) {
+		return nil, fmt.Errorf("unexpected velocity result: %v", result)
+	}
+
+	stats := make([]VelocityStat, len(windows))
+	for i := range windows {
+		count, ok := values[2*i].(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected velocity count: %v", values[2*i])
+		}
+		sumText, _ := values[2*i+1].(string)
+		sum, err := strconv.ParseFloat(sumText, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected velocity sum: %v", values[2*i+1])
+		}
+		stats[i] = VelocityStat{Count: count, Sum: sum}
+	}
+
+	return stats, nil
+}
+
+func maxVelocityWindow() time.Duration {
+	longest := time.Duration(0)
+	for _, window := range DefaultVelocityWindows {
+		if window.Duration > longest {
+			longest = window.Duration
+		}
+	}
+	return longest
+}
@@ -0,0 +1,84 @@
+// Package screening is the compliance-service name screening client shared
+// by the services that screen parties: kyb-service on onboarding and
+// payouts-service on payouts.
+package screening
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Request mirrors the compliance-service screening request
+type Request struct {
+	Name        string `json:"name"`
+	EntityType  string `json:"entity_type,omitempty"`
+	DateOfBirth string `json:"date_of_birth,omitempty"`
+	Country     string `json:"country,omitempty"`
+	Context     string `json:"context"`
+	ReferenceID string `json:"reference_id,omitempty"`
+}
+
+// Hit is a watchlist match reported by compliance-service
+type Hit struct {
+	Source      string  `json:"source"`
+	MatchedName string  `json:"matched_name"`
+	Score       float64 `json:"score"`
+	PEP         bool    `json:"pep"`
+}
+
+// Result is the part of the compliance-service result callers rely on
+type Result struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // clear, potential_match
+	CaseID string `json:"case_id,omitempty"`
+	Hits   []Hit  `json:"hits"`
+}
+
+// Client screens names through compliance-service
+type Client struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewClient creates a compliance-service screening client
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Screen screens a single name
+func (c *Client) Screen(ctx context.Context, req *Request) (*Result, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal screening request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/v1/screening", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create screening request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call compliance service: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("compliance service returned status %d", resp.StatusCode)
+	}
+
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode screening result: %w", err)
+	}
+
+	return &result, nil
+}
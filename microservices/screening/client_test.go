@@ -0,0 +1,57 @@
+package screening
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient_Screen(t *testing.T) {
+	var received Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v1/screening" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if received.Name == "Unavailable" {
+			http.Error(w, "Watchlists not loaded", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "scr_1",
+			"status":  "potential_match",
+			"case_id": "case_1",
+			"hits": []map[string]interface{}{
+				{"source": "ofac_sdn", "matched_name": "Victor Butt", "score": 0.93, "pep": false, "entry_id": "ofac_sdn:300"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	ctx := context.Background()
+
+	result, err := client.Screen(ctx, &Request{Name: "Viktor Bout", Country: "RU", Context: "payout", ReferenceID: "payout_1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if received.Name != "Viktor Bout" || received.Context != "payout" || received.ReferenceID != "payout_1" {
+		t.Errorf("Expected the request to be sent as given, got %+v", received)
+	}
+	if result.ID != "scr_1" || result.Status != "potential_match" || result.CaseID != "case_1" {
+		t.Errorf("Expected the screening result, got %+v", result)
+	}
+	if len(result.Hits) != 1 || result.Hits[0].MatchedName != "Victor Butt" || result.Hits[0].Score != 0.93 {
+		t.Errorf("Expected one hit on the alias, got %+v", result.Hits)
+	}
+
+	if _, err := client.Screen(ctx, &Request{Name: "Unavailable", Context: "payout"}); err == nil {
+		t.Error("Expected error when compliance-service is unavailable")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/project-x/microservices/screening
+
+go 1.24